@@ -0,0 +1,274 @@
+// Package benchmarks contains the benchmarks of IAVL, and a harness producing standardized
+// throughput and latency reports, so that performance can be compared between releases.
+package benchmarks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	db "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/iavl"
+)
+
+// Config configures a harness run. Zero fields take the defaults of DefaultConfig.
+type Config struct {
+	Keys        int            // Number of keys set before measuring.
+	KeySize     int            // Size of keys in bytes.
+	ValueSize   int            // Size of values in bytes.
+	Ops         int            // Number of Get and Set operations measured.
+	BlockSize   int            // Number of Sets per saved version.
+	IterateSpan int            // Number of keys read by each measured iteration.
+	Seed        int64          // Seed of the keys, values and operations, for reproducible runs.
+	Backend     db.BackendType // Database backend, memdb if empty.
+	Dir         string         // Directory of persistent backends, a temporary one if empty.
+	CacheSize   int            // Node cache size of the tree.
+	Options     *iavl.Options  `json:"-"` // Tree options, the defaults if nil.
+	CPUProfile  io.Writer      `json:"-"` // Receives a CPU profile of the measured phases, if not nil.
+}
+
+// DefaultConfig returns the default harness configuration.
+func DefaultConfig() Config {
+	return Config{
+		Keys:        100000,
+		KeySize:     16,
+		ValueSize:   100,
+		Ops:         100000,
+		BlockSize:   1000,
+		IterateSpan: 100,
+		Seed:        1,
+		Backend:     db.MemDBBackend,
+		CacheSize:   10000,
+	}
+}
+
+// Result contains the measurements of a phase of a harness run.
+type Result struct {
+	Name       string
+	Ops        int
+	Duration   time.Duration // Total time of the measured operations.
+	Throughput float64       // Operations per second.
+	P50        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+// Report is the result of a harness run.
+type Report struct {
+	Config    Config
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	Results   []Result // Set, SaveVersion, Get and Iterate, in that order.
+}
+
+// Run runs the harness: it sets Keys keys, and then measures Ops random Sets of existing and new
+// keys saved every BlockSize Sets, the SaveVersion calls, Ops Gets of existing keys, and
+// iterations over IterateSpan keys from random existing keys, which read Ops keys in total.
+// Keys, values and operations are generated from Seed, so runs with the same configuration
+// perform the same operations.
+func Run(cfg Config) (*Report, error) {
+	cfg = withDefaults(cfg)
+	database, cleanup, err := openDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	tree, err := iavl.NewMutableTreeWithOpts(database, cfg.CacheSize, cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	bytes := func(n int) []byte {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return b
+	}
+	keys := make([][]byte, 0, cfg.Keys+cfg.Ops)
+	for i := 0; i < cfg.Keys; i++ {
+		key := bytes(cfg.KeySize)
+		keys = append(keys, key)
+		tree.Set(key, bytes(cfg.ValueSize))
+		if (i+1)%cfg.BlockSize == 0 {
+			if _, _, err := tree.SaveVersion(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		return nil, err
+	}
+	runtime.GC()
+
+	if cfg.CPUProfile != nil {
+		if err := pprof.StartCPUProfile(cfg.CPUProfile); err != nil {
+			return nil, errors.Wrap(err, "starting CPU profile")
+		}
+		defer pprof.StopCPUProfile()
+	}
+
+	report := &Report{Config: cfg, GoVersion: runtime.Version(), GOOS: runtime.GOOS, GOARCH: runtime.GOARCH}
+	var sets, saves []time.Duration
+	for i := 0; i < cfg.Ops; i++ {
+		var key []byte
+		if len(keys) > 0 && rnd.Intn(2) == 0 {
+			key = keys[rnd.Intn(len(keys))]
+		} else {
+			key = bytes(cfg.KeySize)
+			keys = append(keys, key)
+		}
+		value := bytes(cfg.ValueSize)
+		start := time.Now()
+		tree.Set(key, value)
+		sets = append(sets, time.Since(start))
+
+		if (i+1)%cfg.BlockSize == 0 || i == cfg.Ops-1 {
+			start = time.Now()
+			if _, _, err := tree.SaveVersion(); err != nil {
+				return nil, err
+			}
+			saves = append(saves, time.Since(start))
+		}
+	}
+	report.Results = append(report.Results, newResult("Set", sets), newResult("SaveVersion", saves))
+
+	gets := make([]time.Duration, 0, cfg.Ops)
+	for i := 0; i < cfg.Ops; i++ {
+		key := keys[rnd.Intn(len(keys))]
+		start := time.Now()
+		tree.Get(key)
+		gets = append(gets, time.Since(start))
+	}
+	report.Results = append(report.Results, newResult("Get", gets))
+
+	var iterations []time.Duration
+	for read := 0; read < cfg.Ops; read += cfg.IterateSpan {
+		key := keys[rnd.Intn(len(keys))]
+		start := time.Now()
+		itr := tree.Iterator(key, nil, true)
+		for n := 0; n < cfg.IterateSpan && itr.Valid(); n++ {
+			itr.Next()
+		}
+		err := itr.Close()
+		iterations = append(iterations, time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+	}
+	report.Results = append(report.Results, newResult("Iterate", iterations))
+	return report, nil
+}
+
+func withDefaults(cfg Config) Config {
+	defaults := DefaultConfig()
+	if cfg.Keys == 0 {
+		cfg.Keys = defaults.Keys
+	}
+	if cfg.KeySize == 0 {
+		cfg.KeySize = defaults.KeySize
+	}
+	if cfg.ValueSize == 0 {
+		cfg.ValueSize = defaults.ValueSize
+	}
+	if cfg.Ops == 0 {
+		cfg.Ops = defaults.Ops
+	}
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaults.BlockSize
+	}
+	if cfg.IterateSpan == 0 {
+		cfg.IterateSpan = defaults.IterateSpan
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = defaults.Seed
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = defaults.Backend
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = defaults.CacheSize
+	}
+	return cfg
+}
+
+// openDB opens the database of a run, returning a function closing it and removing any
+// temporary directory.
+func openDB(cfg Config) (db.DB, func(), error) {
+	if cfg.Backend == db.MemDBBackend {
+		return db.NewMemDB(), func() {}, nil
+	}
+	dir, removeDir := cfg.Dir, false
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "iavl-bench"); err != nil {
+			return nil, nil, err
+		}
+		removeDir = true
+	}
+	database, err := db.NewDB("iavl-bench", cfg.Backend, dir)
+	if err != nil {
+		if removeDir {
+			os.RemoveAll(dir)
+		}
+		return nil, nil, errors.Wrapf(err, "opening %v database", cfg.Backend)
+	}
+	return database, func() {
+		database.Close()
+		if removeDir {
+			os.RemoveAll(dir)
+		}
+	}, nil
+}
+
+func newResult(name string, latencies []time.Duration) Result {
+	result := Result{Name: name, Ops: len(latencies)}
+	if len(latencies) == 0 {
+		return result
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, latency := range latencies {
+		result.Duration += latency
+	}
+	if result.Duration > 0 {
+		result.Throughput = float64(len(latencies)) / result.Duration.Seconds()
+	}
+	result.P50 = latencies[len(latencies)*50/100]
+	result.P99 = latencies[len(latencies)*99/100]
+	result.Max = latencies[len(latencies)-1]
+	return result
+}
+
+// WriteText writes the report as a table.
+func (r *Report) WriteText(w io.Writer) error {
+	c := r.Config
+	if _, err := fmt.Fprintf(w, "iavl benchmark: %v keys of %vB, values of %vB, %v ops, blocks of %v, "+
+		"backend %v, cache %v, seed %v, %v %v/%v\n\n", c.Keys, c.KeySize, c.ValueSize, c.Ops, c.BlockSize,
+		c.Backend, c.CacheSize, c.Seed, r.GoVersion, r.GOOS, r.GOARCH); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\ttotal\tops/s\tp50\tp99\tmax\t")
+	for _, res := range r.Results {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.0f\t%v\t%v\t%v\t\n", res.Name, res.Ops,
+			res.Duration.Round(time.Microsecond), res.Throughput, res.P50, res.P99, res.Max)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the report as JSON, e.g. to compare runs with other tools.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
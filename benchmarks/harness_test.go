@@ -0,0 +1,44 @@
+package benchmarks
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRun(t *testing.T) {
+	for _, backend := range []db.BackendType{db.MemDBBackend, db.GoLevelDBBackend} {
+		backend := backend
+		t.Run(string(backend), func(t *testing.T) {
+			var profile bytes.Buffer
+			report, err := Run(Config{Keys: 500, Ops: 1000, BlockSize: 100, Backend: backend, CPUProfile: &profile})
+			require.NoError(t, err)
+			require.NotZero(t, profile.Len())
+
+			require.Len(t, report.Results, 4)
+			counts := map[string]int{}
+			for _, result := range report.Results {
+				counts[result.Name] = result.Ops
+				require.True(t, result.P50 <= result.P99 && result.P99 <= result.Max, result.Name)
+				require.Positive(t, result.Throughput, result.Name)
+			}
+			require.Equal(t, map[string]int{"Set": 1000, "SaveVersion": 10, "Get": 1000, "Iterate": 10}, counts)
+
+			var text, js bytes.Buffer
+			require.NoError(t, report.WriteText(&text))
+			require.Contains(t, text.String(), "SaveVersion")
+			require.NoError(t, report.WriteJSON(&js))
+			var decoded Report
+			require.NoError(t, json.Unmarshal(js.Bytes(), &decoded))
+			require.Equal(t, report.Results, decoded.Results)
+		})
+	}
+}
+
+func TestRun_InvalidBackend(t *testing.T) {
+	_, err := Run(Config{Keys: 10, Ops: 10, Backend: "nonexistent"})
+	require.Error(t, err)
+}
@@ -0,0 +1,247 @@
+package iavl
+
+import (
+	"container/list"
+	"math"
+	"sync"
+)
+
+const (
+	// lruCacheShards is the number of independently locked shards of a large lruCache.
+	lruCacheShards = 16
+	// lruCacheMinShardSize is the minimum size of a shard. Smaller caches use fewer shards, so
+	// that the size limit is not skewed by uneven key distribution across shards.
+	lruCacheMinShardSize = 64
+	// lruCacheMinShardBytes is the minimum byte limit of a shard of a cache limited by bytes.
+	lruCacheMinShardBytes = 64 << 10
+)
+
+// lruCache is a size-limited LRU cache, safe for concurrent use. It is split into shards with
+// separate locks, so that concurrent lookups of different keys rarely contend. The size limit is
+// split evenly across the shards, each evicting its own least recently used entries.
+type lruCache struct {
+	shards []*lruCacheShard
+	sizeOf func(value interface{}) int // Approximate byte size of a value, if limited by bytes.
+
+	// onEvict is called with the key of each entry evicted to make room, if set. It is called
+	// with the shard locked, so it must not access the cache.
+	onEvict func(key string)
+}
+
+type lruCacheShard struct {
+	mtx      sync.Mutex
+	items    map[string]*list.Element
+	queue    *list.List // LRU queue of *lruCacheEntry, least recently used first.
+	size     int
+	maxBytes int // 0 if not limited by bytes.
+	bytes    int
+}
+
+type lruCacheEntry struct {
+	key   string
+	value interface{}
+	bytes int
+}
+
+// newLRUCache returns a cache holding at most size entries. A size of 0 disables caching.
+func newLRUCache(size int) *lruCache {
+	return newShardedLRUCache(size, size/lruCacheMinShardSize)
+}
+
+// newShardedLRUCache returns a cache holding at most size entries, split into the given number
+// of shards, up to lruCacheShards.
+func newShardedLRUCache(size, shards int) *lruCache {
+	if shards > lruCacheShards {
+		shards = lruCacheShards
+	}
+	if shards < 1 {
+		shards = 1
+	}
+
+	c := &lruCache{shards: make([]*lruCacheShard, shards)}
+	for i := range c.shards {
+		shardSize := size / shards
+		if i < size%shards {
+			shardSize++
+		}
+		c.shards[i] = &lruCacheShard{
+			items: make(map[string]*list.Element),
+			queue: list.New(),
+			size:  shardSize,
+		}
+	}
+	return c
+}
+
+// newLRUCacheBytes returns a cache holding at most size entries whose total size, as given by
+// sizeOf, is at most maxBytes. A size of 0 with a positive maxBytes only limits the bytes.
+func newLRUCacheBytes(size, maxBytes int, sizeOf func(value interface{}) int) *lruCache {
+	if maxBytes <= 0 {
+		return newLRUCache(size)
+	}
+	shards := size / lruCacheMinShardSize
+	if size <= 0 {
+		size = math.MaxInt32
+		shards = lruCacheShards
+	}
+	if maxBytes/lruCacheMinShardBytes < shards {
+		shards = maxBytes / lruCacheMinShardBytes
+	}
+	c := newShardedLRUCache(size, shards)
+	c.sizeOf = sizeOf
+	for i, s := range c.shards {
+		s.maxBytes = maxBytes / len(c.shards)
+		if i < maxBytes%len(c.shards) {
+			s.maxBytes++
+		}
+	}
+	return c
+}
+
+// shard returns the shard of the given key.
+func (c *lruCache) shard(key []byte) *lruCacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	return c.shards[shardIndex(key, len(c.shards))]
+}
+
+// shardIndex returns the shard of the given key among n shards, using the FNV-1a hash of the key.
+func shardIndex(key []byte, n int) int {
+	h := uint32(2166136261)
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+// Get returns the cached value of the key, marking it as recently used.
+func (c *lruCache) Get(key []byte) (interface{}, bool) {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	elem, ok := s.items[string(key)]
+	if !ok {
+		return nil, false
+	}
+	s.queue.MoveToBack(elem)
+	return elem.Value.(*lruCacheEntry).value, true
+}
+
+// Add adds or replaces the cached value of the key, evicting the least recently used entries of
+// the shard if it is full.
+func (c *lruCache) Add(key []byte, value interface{}) {
+	bytes := 0
+	if c.sizeOf != nil {
+		bytes = len(key) + c.sizeOf(value)
+	}
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if elem, ok := s.items[string(key)]; ok {
+		entry := elem.Value.(*lruCacheEntry)
+		s.bytes += bytes - entry.bytes
+		entry.value = value
+		entry.bytes = bytes
+		s.queue.MoveToBack(elem)
+	} else {
+		elem := s.queue.PushBack(&lruCacheEntry{key: string(key), value: value, bytes: bytes})
+		s.items[string(key)] = elem
+		s.bytes += bytes
+	}
+	s.evict(c.onEvict)
+}
+
+// evict evicts the least recently used entries until the shard is within its limits, calling
+// onEvict for each if set.
+func (s *lruCacheShard) evict(onEvict func(key string)) {
+	for s.queue.Len() > s.size || (s.maxBytes > 0 && s.bytes > s.maxBytes && s.queue.Len() > 0) {
+		entry := s.queue.Front().Value.(*lruCacheEntry)
+		s.removeElement(s.queue.Front())
+		if onEvict != nil {
+			onEvict(entry.key)
+		}
+	}
+}
+
+func (s *lruCacheShard) removeElement(elem *list.Element) {
+	entry := s.queue.Remove(elem).(*lruCacheEntry)
+	delete(s.items, entry.key)
+	s.bytes -= entry.bytes
+}
+
+// Remove removes the key from the cache, if present.
+func (c *lruCache) Remove(key []byte) {
+	s := c.shard(key)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if elem, ok := s.items[string(key)]; ok {
+		s.removeElement(elem)
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *lruCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mtx.Lock()
+		n += s.queue.Len()
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+// Each calls fn for each cached entry. The cache must not be modified by fn.
+func (c *lruCache) Each(fn func(key string, value interface{})) {
+	for _, s := range c.shards {
+		s.mtx.Lock()
+		for e := s.queue.Front(); e != nil; e = e.Next() {
+			entry := e.Value.(*lruCacheEntry)
+			fn(entry.key, entry.value)
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// RemoveIf removes all cached entries for which fn returns true.
+func (c *lruCache) RemoveIf(fn func(key string, value interface{}) bool) {
+	for _, s := range c.shards {
+		s.mtx.Lock()
+		for e := s.queue.Front(); e != nil; {
+			next := e.Next()
+			entry := e.Value.(*lruCacheEntry)
+			if fn(entry.key, entry.value) {
+				s.removeElement(e)
+			}
+			e = next
+		}
+		s.mtx.Unlock()
+	}
+}
+
+// Size returns the maximum number of cached entries.
+func (c *lruCache) Size() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mtx.Lock()
+		n += s.size
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+// Resize changes the maximum number of cached entries, evicting the least recently used entries
+// of each shard that no longer fit. The number of shards is not changed.
+func (c *lruCache) Resize(size int) {
+	for i, s := range c.shards {
+		shardSize := size / len(c.shards)
+		if i < size%len(c.shards) {
+			shardSize++
+		}
+		s.mtx.Lock()
+		s.size = shardSize
+		s.evict(c.onEvict)
+		s.mtx.Unlock()
+	}
+}
@@ -0,0 +1,243 @@
+package iavl
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultCacheAdvisorWindow   = 100
+	defaultCacheAdvisorHeadroom = 1.25
+)
+
+// CacheAdvisorOptions configures the cache advisor, see Options.CacheAdvisor.
+type CacheAdvisorOptions struct {
+	// Window is the number of recent versions whose working sets are considered. Defaults to 100.
+	Window int
+
+	// Headroom is the factor applied to the largest working set in the window to obtain the
+	// recommended cache size. Defaults to 1.25.
+	Headroom float64
+
+	// MinNodeCacheSize and MaxNodeCacheSize bound the recommended node cache size. The minimum
+	// is at least 1, and a maximum of 0 means unbounded.
+	MinNodeCacheSize int
+	MaxNodeCacheSize int
+
+	// MinFastNodeCacheSize and MaxFastNodeCacheSize bound the recommended fast node cache size.
+	// The minimum is at least 1, and a maximum of 0 means unbounded.
+	MinFastNodeCacheSize int
+	MaxFastNodeCacheSize int
+
+	// AutoAdjust resizes the caches to the recommended sizes after each SaveVersion().
+	AutoAdjust bool
+}
+
+// CacheAdvice contains the working set statistics and cache size recommendations of the cache
+// advisor, as returned by MutableTree.CacheAdvice().
+type CacheAdvice struct {
+	// Versions is the number of saved versions observed in the window.
+	Versions int
+
+	// NodeWorkingSet and FastNodeWorkingSet are the largest numbers of distinct nodes and fast
+	// nodes read in a single version in the window.
+	NodeWorkingSet     int
+	FastNodeWorkingSet int
+
+	// NodeCacheHitRate and FastNodeCacheHitRate are the cache hit rates in the window, or 0 if
+	// there were no reads.
+	NodeCacheHitRate     float64
+	FastNodeCacheHitRate float64
+
+	// NodeCacheSize and FastNodeCacheSize are the current cache sizes.
+	NodeCacheSize     int
+	FastNodeCacheSize int
+
+	// RecommendedNodeCacheSize and RecommendedFastNodeCacheSize are the recommended cache sizes,
+	// or the current sizes if no versions have been observed yet.
+	RecommendedNodeCacheSize     int
+	RecommendedFastNodeCacheSize int
+}
+
+// cacheWorkingSet holds the reads of a single version.
+type cacheWorkingSet struct {
+	nodes, fastNodes             int
+	nodeHits, nodeMisses         int64
+	fastNodeHits, fastNodeMisses int64
+}
+
+// cacheAdvisor tracks the distinct nodes and fast nodes read per version. Reads are recorded in
+// shards with separate locks and atomic counters, so that concurrent reads rarely contend.
+type cacheAdvisor struct {
+	nodeHits, nodeMisses         int64 // Reads of the current version, updated atomically.
+	fastNodeHits, fastNodeMisses int64
+
+	opts   CacheAdvisorOptions
+	shards [lruCacheShards]cacheAdvisorShard
+
+	mtx     sync.Mutex
+	history []cacheWorkingSet // ring buffer of the last Window versions
+	next    int
+}
+
+// cacheAdvisorShard holds the distinct nodes and fast nodes read in the current version, for
+// keys of the shard.
+type cacheAdvisorShard struct {
+	mtx       sync.Mutex
+	nodes     map[string]struct{}
+	fastNodes map[string]struct{}
+}
+
+func newCacheAdvisor(opts CacheAdvisorOptions) *cacheAdvisor {
+	if opts.Window <= 0 {
+		opts.Window = defaultCacheAdvisorWindow
+	}
+	if opts.Headroom <= 0 {
+		opts.Headroom = defaultCacheAdvisorHeadroom
+	}
+	a := &cacheAdvisor{
+		opts:    opts,
+		history: make([]cacheWorkingSet, 0, opts.Window),
+	}
+	for i := range a.shards {
+		a.shards[i].nodes = make(map[string]struct{})
+		a.shards[i].fastNodes = make(map[string]struct{})
+	}
+	return a
+}
+
+// readNode records a read of the node with the given hash.
+func (a *cacheAdvisor) readNode(hash []byte, hit bool) {
+	if hit {
+		atomic.AddInt64(&a.nodeHits, 1)
+	} else {
+		atomic.AddInt64(&a.nodeMisses, 1)
+	}
+	shard := &a.shards[shardIndex(hash, lruCacheShards)]
+	shard.mtx.Lock()
+	shard.nodes[string(hash)] = struct{}{}
+	shard.mtx.Unlock()
+}
+
+// readFastNode records a read of the fast node with the given key.
+func (a *cacheAdvisor) readFastNode(key []byte, hit bool) {
+	if hit {
+		atomic.AddInt64(&a.fastNodeHits, 1)
+	} else {
+		atomic.AddInt64(&a.fastNodeMisses, 1)
+	}
+	shard := &a.shards[shardIndex(key, lruCacheShards)]
+	shard.mtx.Lock()
+	shard.fastNodes[string(key)] = struct{}{}
+	shard.mtx.Unlock()
+}
+
+// endVersion records the working set of the version just saved, and starts a new one.
+func (a *cacheAdvisor) endVersion() {
+	current := cacheWorkingSet{
+		nodeHits:       atomic.SwapInt64(&a.nodeHits, 0),
+		nodeMisses:     atomic.SwapInt64(&a.nodeMisses, 0),
+		fastNodeHits:   atomic.SwapInt64(&a.fastNodeHits, 0),
+		fastNodeMisses: atomic.SwapInt64(&a.fastNodeMisses, 0),
+	}
+	for i := range a.shards {
+		shard := &a.shards[i]
+		shard.mtx.Lock()
+		current.nodes += len(shard.nodes)
+		current.fastNodes += len(shard.fastNodes)
+		shard.nodes = make(map[string]struct{}, len(shard.nodes))
+		shard.fastNodes = make(map[string]struct{}, len(shard.fastNodes))
+		shard.mtx.Unlock()
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if len(a.history) < a.opts.Window {
+		a.history = append(a.history, current)
+	} else {
+		a.history[a.next] = current
+	}
+	a.next = (a.next + 1) % a.opts.Window
+}
+
+// advice computes the cache advice for the given current cache sizes.
+func (a *cacheAdvisor) advice(nodeCacheSize, fastNodeCacheSize int) CacheAdvice {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	advice := CacheAdvice{
+		Versions:                     len(a.history),
+		NodeCacheSize:                nodeCacheSize,
+		FastNodeCacheSize:            fastNodeCacheSize,
+		RecommendedNodeCacheSize:     nodeCacheSize,
+		RecommendedFastNodeCacheSize: fastNodeCacheSize,
+	}
+	if len(a.history) == 0 {
+		return advice
+	}
+
+	var nodeHits, nodeReads, fastNodeHits, fastNodeReads int64
+	for _, ws := range a.history {
+		if ws.nodes > advice.NodeWorkingSet {
+			advice.NodeWorkingSet = ws.nodes
+		}
+		if ws.fastNodes > advice.FastNodeWorkingSet {
+			advice.FastNodeWorkingSet = ws.fastNodes
+		}
+		nodeHits += ws.nodeHits
+		nodeReads += ws.nodeHits + ws.nodeMisses
+		fastNodeHits += ws.fastNodeHits
+		fastNodeReads += ws.fastNodeHits + ws.fastNodeMisses
+	}
+	if nodeReads > 0 {
+		advice.NodeCacheHitRate = float64(nodeHits) / float64(nodeReads)
+	}
+	if fastNodeReads > 0 {
+		advice.FastNodeCacheHitRate = float64(fastNodeHits) / float64(fastNodeReads)
+	}
+	advice.RecommendedNodeCacheSize = a.recommend(advice.NodeWorkingSet,
+		a.opts.MinNodeCacheSize, a.opts.MaxNodeCacheSize)
+	advice.RecommendedFastNodeCacheSize = a.recommend(advice.FastNodeWorkingSet,
+		a.opts.MinFastNodeCacheSize, a.opts.MaxFastNodeCacheSize)
+	return advice
+}
+
+// recommend returns the working set size with headroom, within the given bounds. It is at least
+// 1, so that caches aren't disabled by versions without reads.
+func (a *cacheAdvisor) recommend(workingSet, min, max int) int {
+	if min < 1 {
+		min = 1
+	}
+	size := int(math.Ceil(float64(workingSet) * a.opts.Headroom))
+	if max > 0 && size > max {
+		size = max
+	}
+	if size < min {
+		size = min
+	}
+	return size
+}
+
+// endCacheAdvisorVersion records the working set of a saved version and, if enabled, resizes
+// the caches to the recommended sizes.
+func (ndb *nodeDB) endCacheAdvisorVersion() {
+	if ndb.cacheAdvisor == nil {
+		return
+	}
+	ndb.cacheAdvisor.endVersion()
+	if ndb.cacheAdvisor.opts.AutoAdjust {
+		advice := ndb.cacheAdvisor.advice(ndb.nodeCache.Size(), ndb.fastNodeCache.Size())
+		ndb.nodeCache.Resize(advice.RecommendedNodeCacheSize)
+		ndb.fastNodeCache.Resize(advice.RecommendedFastNodeCacheSize)
+	}
+}
+
+// CacheAdvice returns the working set statistics and cache size recommendations of the cache
+// advisor, see Options.CacheAdvisor. It returns false if the advisor is disabled.
+func (tree *MutableTree) CacheAdvice() (CacheAdvice, bool) {
+	if tree.ndb.cacheAdvisor == nil {
+		return CacheAdvice{}, false
+	}
+	return tree.ndb.cacheAdvisor.advice(tree.ndb.nodeCache.Size(), tree.ndb.fastNodeCache.Size()), true
+}
@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestCacheAdvisor(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 100, &Options{
+		CacheAdvisor: &CacheAdvisorOptions{
+			Window:               2,
+			Headroom:             2,
+			MinNodeCacheSize:     10,
+			MaxFastNodeCacheSize: 30,
+		},
+	})
+	require.NoError(t, err)
+
+	advice, ok := tree.CacheAdvice()
+	require.True(t, ok)
+	require.Zero(t, advice.Versions)
+	require.Equal(t, 100, advice.RecommendedNodeCacheSize)
+
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Read 20 distinct saved keys, each twice, through both the fast index and the tree.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 20; i++ {
+			key := []byte(fmt.Sprintf("key%03d", i))
+			require.NotNil(t, tree.Get(key))
+			_, _ = itree.GetWithIndex(key)
+		}
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	advice, ok = tree.CacheAdvice()
+	require.True(t, ok)
+	require.Equal(t, 2, advice.Versions)
+	require.Equal(t, 20, advice.FastNodeWorkingSet)
+	require.Greater(t, advice.NodeWorkingSet, 20)
+	require.Greater(t, advice.NodeCacheHitRate, 0.0)
+	require.Equal(t, 2*advice.NodeWorkingSet, advice.RecommendedNodeCacheSize)
+	require.Equal(t, 30, advice.RecommendedFastNodeCacheSize)
+	require.Equal(t, 100, advice.NodeCacheSize)
+
+	// Versions without reads age out of the window, leaving the minimum sizes, which are at least 1.
+	for i := 0; i < 2; i++ {
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	advice, _ = tree.CacheAdvice()
+	require.Equal(t, 2, advice.Versions)
+	require.Zero(t, advice.NodeWorkingSet)
+	require.Equal(t, 10, advice.RecommendedNodeCacheSize)
+	require.Equal(t, 1, advice.RecommendedFastNodeCacheSize)
+}
+
+func TestCacheAdvisor_AutoAdjust(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 1000, &Options{
+		CacheAdvisor: &CacheAdvisorOptions{
+			MinNodeCacheSize:     50,
+			MinFastNodeCacheSize: 50,
+			AutoAdjust:           true,
+		},
+	})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	advice, ok := tree.CacheAdvice()
+	require.True(t, ok)
+	require.Equal(t, 50, advice.NodeCacheSize)
+	require.Equal(t, 50, advice.FastNodeCacheSize)
+	require.Equal(t, 50, tree.ndb.nodeCache.Size())
+}
+
+func TestCacheAdvisor_Disabled(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, ok := tree.CacheAdvice()
+	require.False(t, ok)
+}
@@ -0,0 +1,132 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache_Evicts(t *testing.T) {
+	c := newLRUCache(3)
+	require.Len(t, c.shards, 1)
+
+	c.Add([]byte("a"), 1)
+	c.Add([]byte("b"), 2)
+	c.Add([]byte("c"), 3)
+	_, ok := c.Get([]byte("a")) // a is now the most recently used
+	require.True(t, ok)
+	c.Add([]byte("d"), 4)
+
+	require.Equal(t, 3, c.Len())
+	_, ok = c.Get([]byte("b"))
+	require.False(t, ok)
+	v, ok := c.Get([]byte("a"))
+	require.True(t, ok)
+	require.Equal(t, 1, v)
+
+	c.Add([]byte("a"), 5)
+	v, _ = c.Get([]byte("a"))
+	require.Equal(t, 5, v)
+	require.Equal(t, 3, c.Len())
+
+	c.Remove([]byte("a"))
+	_, ok = c.Get([]byte("a"))
+	require.False(t, ok)
+	require.Equal(t, 2, c.Len())
+}
+
+func TestLRUCache_Disabled(t *testing.T) {
+	c := newLRUCache(0)
+	c.Add([]byte("a"), 1)
+	_, ok := c.Get([]byte("a"))
+	require.False(t, ok)
+	require.Zero(t, c.Len())
+}
+
+func TestLRUCache_Sharded(t *testing.T) {
+	const size = 10000
+	c := newLRUCache(size)
+	require.Len(t, c.shards, lruCacheShards)
+	total := 0
+	for _, s := range c.shards {
+		total += s.size
+	}
+	require.Equal(t, size, total)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := []byte(fmt.Sprintf("%d-%d", w, i))
+				c.Add(key, i)
+				v, ok := c.Get(key)
+				if ok {
+					require.Equal(t, i, v)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.Len(), size)
+
+	c.RemoveIf(func(key string, value interface{}) bool {
+		return value.(int)%2 == 0
+	})
+	c.Each(func(key string, value interface{}) {
+		require.Equal(t, 1, value.(int)%2)
+	})
+}
+
+func TestLRUCache_Resize(t *testing.T) {
+	c := newLRUCache(4)
+	for i := 0; i < 4; i++ {
+		c.Add([]byte{byte(i)}, i)
+	}
+	c.Resize(2)
+	require.Equal(t, 2, c.Size())
+	require.Equal(t, 2, c.Len())
+	_, ok := c.Get([]byte{0})
+	require.False(t, ok)
+	_, ok = c.Get([]byte{3})
+	require.True(t, ok)
+
+	c.Resize(10)
+	require.Equal(t, 10, c.Size())
+	for i := 0; i < 10; i++ {
+		c.Add([]byte{byte(i)}, i)
+	}
+	require.Equal(t, 10, c.Len())
+}
+
+func TestLRUCache_Bytes(t *testing.T) {
+	sizeOf := func(value interface{}) int {
+		return len(value.([]byte))
+	}
+	require.Len(t, newLRUCacheBytes(0, 1<<30, sizeOf).shards, lruCacheShards)
+	require.Len(t, newLRUCacheBytes(1<<20, 1<<17, sizeOf).shards, 2)
+
+	c := newLRUCacheBytes(0, 10, sizeOf)
+	require.Len(t, c.shards, 1)
+
+	c.Add([]byte("a"), []byte("1234")) // 5 bytes
+	c.Add([]byte("b"), []byte("1234")) // 10 bytes
+	require.Equal(t, 2, c.Len())
+	c.Add([]byte("c"), []byte("1"))
+	require.Equal(t, 2, c.Len())
+	_, ok := c.Get([]byte("a"))
+	require.False(t, ok)
+
+	// Replacing a value accounts for its new size.
+	c.Add([]byte("c"), []byte("123456789"))
+	require.Equal(t, 1, c.Len())
+	c.Remove([]byte("c"))
+	require.Zero(t, c.shards[0].bytes)
+
+	// Entries larger than the limit are not retained.
+	c.Add([]byte("d"), make([]byte, 20))
+	require.Zero(t, c.Len())
+}
@@ -0,0 +1,75 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// checksumSize is the size of the checksum appended to stored values, see Options.Checksums.
+	checksumSize = 4
+	// checksumsKey is the metadata key marking a database whose values have checksums.
+	checksumsKey = "checksums"
+)
+
+// ErrChecksumMismatch is matched by errors returned for stored node or fast node values whose
+// checksum doesn't match, i.e. which were corrupted on disk, see Options.Checksums.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// appendChecksum appends the CRC-32C checksum of a value to be stored, if Options.Checksums is
+// set. The checksum covers the value as stored, i.e. after encryption.
+func (ndb *nodeDB) appendChecksum(bz []byte) []byte {
+	if !ndb.opts.Checksums {
+		return bz
+	}
+	var sum [checksumSize]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(bz, castagnoli))
+	return append(bz, sum[:]...)
+}
+
+// checkChecksums checks that a database opened with Options.Checksums uses checksums, marking a
+// database without nodes as using them. Databases opened without checksums are not checked, so
+// that opening them doesn't read the database.
+func (ndb *nodeDB) checkChecksums() error {
+	if !ndb.opts.Checksums {
+		return nil
+	}
+	marked, err := ndb.db.Has(metadataKeyFormat.Key([]byte(checksumsKey)))
+	if err != nil || marked {
+		return err
+	}
+	hasNodes := false
+	err = ndb.traversePrefix(nodeKeyFormat.Key(), func(k, v []byte) error {
+		hasNodes = true
+		return errStopTraversal
+	})
+	if err != nil && err != errStopTraversal {
+		return err
+	}
+	if hasNodes {
+		return errors.New("Options.Checksums can't be enabled for a database without checksums")
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(checksumsKey)), []byte{})
+}
+
+// verifyChecksum verifies and strips the checksum of a stored value written by appendChecksum.
+// Nil values, i.e. missing entries, are returned as is.
+func (ndb *nodeDB) verifyChecksum(bz []byte) ([]byte, error) {
+	if !ndb.opts.Checksums || bz == nil {
+		return bz, nil
+	}
+	if len(bz) < checksumSize {
+		return nil, errors.Wrapf(ErrChecksumMismatch, "value of %v bytes has no checksum", len(bz))
+	}
+	value, stored := bz[:len(bz)-checksumSize], binary.BigEndian.Uint32(bz[len(bz)-checksumSize:])
+	if computed := crc32.Checksum(value, castagnoli); computed != stored {
+		return nil, errors.Wrapf(ErrChecksumMismatch, "stored %08x, computed %08x", stored, computed)
+	}
+	return value, nil
+}
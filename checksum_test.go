@@ -0,0 +1,76 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestChecksums(t *testing.T) {
+	enc, err := NewAESGCMEncryption(1, map[byte][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	for _, opts := range []*Options{{Checksums: true}, {Checksums: true, Encryption: enc}} {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+		require.NoError(t, err)
+		tree.Set([]byte("a"), []byte("value-a"))
+		tree.Set([]byte("b"), []byte("value-b"))
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+		require.NoError(t, err)
+		_, err = tree.LoadVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, []byte("value-a"), tree.Get([]byte("a")))
+		require.Equal(t, hash, tree.Hash())
+
+		// Flip a bit of the stored root node and fast node.
+		corrupt := func(key []byte) {
+			bz, err := memDB.Get(key)
+			require.NoError(t, err)
+			bz = append([]byte(nil), bz...)
+			bz[len(bz)/2] ^= 0x01
+			require.NoError(t, memDB.Set(key, bz))
+		}
+		corrupt(tree.ndb.nodeKey(hash))
+		corrupt(tree.ndb.fastNodeKey([]byte("b")))
+
+		_, err = tree.GetRawNode(hash)
+		require.True(t, errors.Is(err, ErrChecksumMismatch), err)
+		_, err = tree.ndb.GetFastNode([]byte("b"))
+		require.True(t, errors.Is(err, ErrChecksumMismatch), err)
+
+		ndb := newNodeDB(memDB, 0, opts)
+		func() {
+			defer func() {
+				err, _ := recover().(error)
+				require.True(t, errors.Is(err, ErrChecksumMismatch), err)
+			}()
+			ndb.GetNode(hash)
+		}()
+
+		// Loading and proofs return the mismatch as an error.
+		tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+		require.NoError(t, err)
+		_, err = tree.LoadVersion(version)
+		require.True(t, errors.Is(err, ErrChecksumMismatch), err)
+		require.True(t, errors.Is(err, ErrNodeMissing), err)
+		itree := &ImmutableTree{root: &Node{leftHash: hash, rightHash: hash, height: 1}, ndb: tree.ndb}
+		_, err = itree.GetMembershipProof([]byte("a"))
+		require.True(t, errors.Is(err, ErrChecksumMismatch), err)
+	}
+
+	// Checksums can't be enabled for an existing database.
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("value-a"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = NewMutableTreeWithOpts(memDB, 0, &Options{Checksums: true})
+	require.Error(t, err)
+}
@@ -20,8 +20,13 @@ const (
 
 func main() {
 	args := os.Args[1:]
+	if len(args) >= 4 && args[0] == "diff" {
+		diffMain(args[1:])
+		return
+	}
 	if len(args) < 3 || (args[0] != "data" && args[0] != "shape" && args[0] != "versions") {
 		fmt.Fprintln(os.Stderr, "Usage: iaviewer <data|shape|versions> <leveldb dir> <prefix> [version number]")
+		fmt.Fprintln(os.Stderr, "       iaviewer diff <leveldb dir> <other leveldb dir> <prefix> [version number]")
 		fmt.Fprintln(os.Stderr, "<prefix> is the prefix of db, and the iavl tree of different modules in cosmos-sdk uses ")
 		fmt.Fprintln(os.Stderr, "different <prefix> to identify, just like \"s/k:gov/\" represents the prefix of gov module")
 		os.Exit(1)
@@ -171,6 +176,57 @@ func nodeEncoder(id []byte, depth int, isLeaf bool) string {
 	return fmt.Sprintf("%s%s", prefix, parseWeaveKey(id))
 }
 
+// diffMain prints the keys which differ between the trees of two databases at the same version.
+func diffMain(args []string) {
+	version := 0
+	if len(args) == 4 {
+		var err error
+		version, err = strconv.Atoi(args[3])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid version number: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	treeA, err := ReadTree(args[0], version, []byte(args[2]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading data: %s\n", err)
+		os.Exit(1)
+	}
+	treeB, err := ReadTree(args[1], int(treeA.Version()), []byte(args[2]))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading data: %s\n", err)
+		os.Exit(1)
+	}
+	PrintDiff(treeA, treeB)
+}
+
+// PrintDiff prints the keys which differ between two trees, with hashed values.
+func PrintDiff(treeA, treeB *iavl.MutableTree) {
+	fmt.Printf("Hashes: %X %X\n", treeA.Hash(), treeB.Hash())
+	count := 0
+	_, err := treeA.ImmutableTree.Diff(treeB.ImmutableTree, func(diff iavl.KeyDiff) bool {
+		fmt.Printf("  %s\n", parseWeaveKey(diff.Key))
+		for _, side := range []struct {
+			name    string
+			value   []byte
+			version int64
+		}{{"a", diff.ValueA, diff.VersionA}, {"b", diff.ValueB, diff.VersionB}} {
+			if side.version == 0 {
+				fmt.Printf("    %s: <missing>\n", side.name)
+			} else {
+				fmt.Printf("    %s: %X (version %d)\n", side.name, sha256.Sum256(side.value), side.version)
+			}
+		}
+		count++
+		return false
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error diffing trees: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Found %d differing keys\n", count)
+}
+
 func PrintVersions(tree *iavl.MutableTree) {
 	versions := tree.AvailableVersions()
 	fmt.Println("Available versions:")
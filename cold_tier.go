@@ -0,0 +1,211 @@
+package iavl
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// coldTierDemotedKey is the metadata key storing the last orphan version whose nodes have been
+// demoted to the cold tier.
+const coldTierDemotedKey = "cold_tier_demoted"
+
+// Tier is a slower backing store for cold nodes, e.g. a blob store or another database, see
+// Options.ColdTier. Values are the nodes as stored in the primary database.
+type Tier interface {
+	// Get returns the value stored for the node hash, or nil if there is none.
+	Get(hash []byte) ([]byte, error)
+
+	// Set stores the value for the node hash. Setting the same value again must succeed. The
+	// hash and value must not be retained after returning.
+	Set(hash, value []byte) error
+
+	// Delete deletes the value for the node hash, if any.
+	Delete(hash []byte) error
+}
+
+// ColdTierOptions configures demotion of cold nodes to a Tier, see Options.ColdTier.
+type ColdTierOptions struct {
+	// Tier is the store cold nodes are demoted to.
+	Tier Tier
+
+	// KeepRecent is the number of most recent versions whose nodes are kept in the primary
+	// database. Nodes which are only referenced by earlier versions are demoted.
+	KeepRecent int64
+
+	// AutoDemote demotes cold nodes after each SaveVersion(), otherwise they are only demoted by
+	// MutableTree.DemoteColdNodes().
+	AutoDemote bool
+}
+
+// dbTier is a Tier storing nodes in a database.
+type dbTier struct {
+	db dbm.DB
+}
+
+// NewDBTier returns a Tier storing nodes in the given database, keyed by hash.
+func NewDBTier(db dbm.DB) Tier {
+	return &dbTier{db: db}
+}
+
+// Get implements Tier.
+func (t *dbTier) Get(hash []byte) ([]byte, error) {
+	return t.db.Get(hash)
+}
+
+// Set implements Tier.
+func (t *dbTier) Set(hash, value []byte) error {
+	return t.db.Set(hash, value)
+}
+
+// Delete implements Tier.
+func (t *dbTier) Delete(hash []byte) error {
+	return t.db.Delete(hash)
+}
+
+// loadColdTierDemoted loads the last demoted orphan version, see coldTierDemotedKey. It is 0 if
+// no nodes have been demoted yet.
+func (ndb *nodeDB) loadColdTierDemoted() error {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(coldTierDemotedKey)))
+	if err != nil || bz == nil {
+		return err
+	}
+	if len(bz) != int64Size {
+		return errors.Errorf("invalid cold tier version %X", bz)
+	}
+	ndb.coldDemoted = int64(binary.BigEndian.Uint64(bz))
+	return nil
+}
+
+// setColdTierDemoted records the last demoted orphan version in the batch.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) setColdTierDemoted(version int64) error {
+	ndb.coldDemoted = version
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(coldTierDemotedKey)), formatUint64(uint64(version)))
+}
+
+// getNodeBytes returns the stored bytes of a node from the primary database or a snapshot of it,
+// or from the cold tier if it has been demoted. It returns nil if the node is in neither.
+func (ndb *nodeDB) getNodeBytes(r dbReader, hash []byte) ([]byte, error) {
+	buf, err := r.Get(ndb.nodeKey(hash))
+	if err != nil || buf != nil || ndb.opts.ColdTier == nil {
+		return buf, err
+	}
+	buf, err = ndb.opts.ColdTier.Tier.Get(hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading from cold tier")
+	}
+	return buf, nil
+}
+
+// deleteOrphanedNode deletes an orphaned node whose lifetime ended at the given version. If it
+// may have been demoted, it is also deleted from the cold tier once the batch is written.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteOrphanedNode(hash []byte, toVersion int64) error {
+	if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+		return err
+	}
+	if ndb.opts.ColdTier != nil && toVersion <= ndb.coldDemoted {
+		ndb.coldDeletes = append(ndb.coldDeletes, append([]byte(nil), hash...))
+	}
+	return nil
+}
+
+// promoteNode moves a demoted node back from the cold tier to the primary database, e.g. when it
+// is referenced by the latest version again after DeleteVersionsFrom().
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) promoteNode(hash []byte) error {
+	value, err := ndb.opts.ColdTier.Tier.Get(hash)
+	if err != nil {
+		return errors.Wrapf(err, "promoting node %X", hash)
+	}
+	if value == nil {
+		return nil // never demoted, or already promoted
+	}
+	if err := ndb.batch.Set(ndb.nodeKey(hash), value); err != nil {
+		return err
+	}
+	ndb.coldDeletes = append(ndb.coldDeletes, append([]byte(nil), hash...))
+	return nil
+}
+
+// flushColdDeletes deletes the nodes queued by deleteOrphanedNode from the cold tier. It must
+// only be called once the batch deleting them from the primary database has been written, so
+// that nodes are never lost if the batch isn't.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) flushColdDeletes() error {
+	for len(ndb.coldDeletes) > 0 {
+		if err := ndb.opts.ColdTier.Tier.Delete(ndb.coldDeletes[0]); err != nil {
+			return errors.Wrap(err, "deleting from cold tier")
+		}
+		ndb.coldDeletes = ndb.coldDeletes[1:]
+	}
+	ndb.coldDeletes = nil
+	return nil
+}
+
+// demoteColdNodes moves the nodes of orphans whose lifetime ended before the most recent
+// ColdTierOptions.KeepRecent versions from the primary database to the cold tier. Orphans are
+// keyed by the last version referencing them, so only orphans not yet demoted are scanned.
+func (ndb *nodeDB) demoteColdNodes() (int, error) {
+	opts := ndb.opts.ColdTier
+	if opts == nil {
+		return 0, errors.New("cold tier is not configured")
+	}
+	if ndb.opts.RefCountGC {
+		return 0, errors.New("cold tier can't be used with reference counts")
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	keepRecent := opts.KeepRecent
+	if keepRecent < 0 {
+		keepRecent = 0
+	}
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := latest - keepRecent
+	if cutoff <= ndb.coldDemoted {
+		return 0, nil
+	}
+
+	demoted := 0
+	err = ndb.traverseRangeFlushing(orphanKeyFormat.Key(ndb.coldDemoted+1), orphanKeyFormat.Key(cutoff+1), func(key, hash []byte) error {
+		value, err := ndb.db.Get(ndb.nodeKey(hash))
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return nil // demoted by an interrupted run
+		}
+		// The node is written to the tier before it is deleted from the primary database, so
+		// that it can always be read by concurrent readers.
+		if err := opts.Tier.Set(hash, value); err != nil {
+			return errors.Wrapf(err, "demoting node %X", hash)
+		}
+		if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			return err
+		}
+		ndb.logger.Debug("demoting node to cold tier", "hash", hash)
+		demoted++
+		return nil
+	})
+	if err != nil {
+		return demoted, err
+	}
+	if err := ndb.setColdTierDemoted(cutoff); err != nil {
+		return demoted, err
+	}
+	return demoted, ndb.resetBatch()
+}
+
+// DemoteColdNodes moves the nodes which are only referenced by versions before the most recent
+// ColdTierOptions.KeepRecent versions to the cold tier, see Options.ColdTier. Demoted nodes are
+// read from the cold tier transparently. It returns the number of nodes demoted.
+func (tree *MutableTree) DemoteColdNodes() (int, error) {
+	return tree.ndb.demoteColdNodes()
+}
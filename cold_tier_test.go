@@ -0,0 +1,115 @@
+package iavl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestColdTier(t *testing.T) {
+	memDB, coldDB := db.NewMemDB(), db.NewMemDB()
+	opts := &Options{ColdTier: &ColdTierOptions{Tier: NewDBTier(coldDB), KeepRecent: 2}}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	for v := 1; v <= 6; v++ {
+		for i := 0; i < 10; i++ {
+			tree.Set([]byte{byte(i)}, []byte(strconv.Itoa(v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	nodes := countPrefixKeys(t, memDB, nodeKeyFormat.Key())
+	demoted, err := tree.DemoteColdNodes()
+	require.NoError(t, err)
+	require.Positive(t, demoted)
+	require.Equal(t, nodes-demoted, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+	require.Equal(t, demoted, countPrefixKeys(t, coldDB, nil))
+
+	// Demoting again is a no-op until new versions are saved.
+	again, err := tree.DemoteColdNodes()
+	require.NoError(t, err)
+	require.Zero(t, again)
+
+	// All versions are readable from a reloaded tree, faulting in demoted nodes.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for v := 1; v <= 6; v++ {
+		require.Equal(t, []byte(strconv.Itoa(v)), tree.GetVersioned([]byte{3}, int64(v)))
+	}
+
+	// Deleting old versions also deletes their nodes from the cold tier.
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Less(t, countPrefixKeys(t, coldDB, nil), demoted)
+
+	// Rolling back past the demoted versions keeps all remaining versions readable.
+	_, err = tree.LoadVersionForOverwriting(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), tree.Get([]byte{3}))
+	require.Equal(t, []byte("2"), tree.GetVersioned([]byte{3}, 2))
+	tree.Set([]byte{3}, []byte("new"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), tree.GetVersioned([]byte{3}, 3))
+}
+
+func TestColdTier_AutoDemote(t *testing.T) {
+	memDB, coldDB := db.NewMemDB(), db.NewMemDB()
+	opts := &Options{ColdTier: &ColdTierOptions{Tier: NewDBTier(coldDB), KeepRecent: 1, AutoDemote: true}}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	for v := 1; v <= 3; v++ {
+		tree.Set([]byte("key"), []byte(strconv.Itoa(v)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// Only the leaf of the latest version remains in the primary database.
+	require.Equal(t, 1, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+	require.Equal(t, 2, countPrefixKeys(t, coldDB, nil))
+	require.Equal(t, []byte("1"), tree.GetVersioned([]byte("key"), 1))
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	_, err = tree.DemoteColdNodes()
+	require.Error(t, err)
+}
+
+func TestColdTier_InvalidDemotedVersion(t *testing.T) {
+	memDB := db.NewMemDB()
+	require.NoError(t, memDB.Set(metadataKeyFormat.Key([]byte(coldTierDemotedKey)), []byte{1}))
+	opts := &Options{ColdTier: &ColdTierOptions{Tier: NewDBTier(db.NewMemDB())}}
+	_, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.Error(t, err)
+}
+
+// failingTier is a cold tier failing all writes.
+type failingTier struct{}
+
+func (failingTier) Get([]byte) ([]byte, error) { return nil, nil }
+func (failingTier) Set([]byte, []byte) error   { return errors.New("tier unavailable") }
+func (failingTier) Delete([]byte) error        { return errors.New("tier unavailable") }
+
+func TestColdTier_AutoDemoteError(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		ColdTier: &ColdTierOptions{Tier: failingTier{}, KeepRecent: 1, AutoDemote: true},
+	})
+	require.NoError(t, err)
+	tree.Set([]byte("k"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.MaintenanceError())
+
+	// Demotion fails once the first version is cold, but the version is committed regardless.
+	tree.Set([]byte("k"), []byte{2})
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, tree.Hash(), hash)
+	require.Error(t, tree.MaintenanceError())
+	require.True(t, tree.VersionExists(2))
+}
@@ -0,0 +1,123 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// SetIfAbsent sets a key in the working tree only if it doesn't exist, and returns whether it was
+// set. See CompareAndSwap for the atomicity guarantees and errors.
+func (tree *MutableTree) SetIfAbsent(key, value []byte) (bool, error) {
+	_, ok, err := tree.setIf(key, value, func(_ []byte, exists bool) bool {
+		return !exists
+	})
+	return ok, err
+}
+
+// CompareAndSwap sets a key in the working tree to the new value only if its current value equals
+// the expected value, and returns whether it was set. A nil expected value only matches an absent
+// key. If the key wasn't set, its current value is returned, or nil if it is absent, so that
+// callers can retry without reading the key separately. If the entry exceeds the size limits, an
+// error matching ErrKeyTooLarge or ErrValueTooLarge is returned, and the key isn't set.
+//
+// The current value is checked during the same traversal as the write, and conditional writes are
+// serialized, so they are atomic with respect to each other: concurrent executors can use them
+// from several goroutines without read-then-write races, as long as the working tree isn't
+// read or modified concurrently by other means.
+func (tree *MutableTree) CompareAndSwap(key, expected, value []byte) (current []byte, swapped bool, err error) {
+	return tree.setIf(key, value, func(current []byte, exists bool) bool {
+		if expected == nil {
+			return !exists
+		}
+		return exists && bytes.Equal(current, expected)
+	})
+}
+
+// setIf sets a key if cond returns true for its current value, like SetChecked. If the key wasn't
+// set, its current value is returned.
+func (tree *MutableTree) setIf(key, value []byte, cond func(current []byte, exists bool) bool) ([]byte, bool, error) {
+	if value == nil {
+		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
+	}
+	if err := tree.ndb.checkSize(key, value); err != nil {
+		return nil, false, err
+	}
+	tree.condMtx.Lock()
+	defer tree.condMtx.Unlock()
+
+	if _, ok := tree.pendingMerges[string(key)]; ok {
+		// The condition applies to the merged value, which the set then supersedes.
+		current := tree.getMerged(tree.ImmutableTree, key)
+		if !cond(current, current != nil) {
+			return current, false, nil
+		}
+		delete(tree.pendingMerges, string(key))
+		orphans, _, _ := tree.set(key, value)
+		tree.addOrphans(orphans)
+	} else if tree.root == nil {
+		if !cond(nil, false) {
+			return nil, false, nil
+		}
+		tree.set(key, value)
+	} else {
+		orphans := tree.prepareOrphansSlice()
+		root, _, current, ok := tree.recursiveSetIf(tree.root, key, value, cond, &orphans)
+		if !ok {
+			return current, false, nil
+		}
+		tree.root = root
+		tree.addOrphans(orphans)
+	}
+
+	tree.journal(journalOpSet, key, value)
+	tree.clearExpiry(key)
+	for _, h := range tree.hooks {
+		h.OnSet(key, value)
+	}
+	return nil, true, nil
+}
+
+// recursiveSetIf is like recursiveSet, but only sets the key if cond returns true for the value of
+// its leaf, leaving the subtree unchanged and returning the current value otherwise.
+func (tree *MutableTree) recursiveSetIf(node *Node, key, value []byte, cond func([]byte, bool) bool, orphans *[]*Node) (
+	newSelf *Node, updated bool, current []byte, ok bool,
+) {
+	if node.isLeaf() {
+		exists := bytes.Equal(key, node.key)
+		var current []byte
+		if exists {
+			current = node.value
+			if current == nil {
+				current = []byte{}
+			}
+		}
+		if !cond(current, exists) {
+			return node, false, current, false
+		}
+		newSelf, _, updated = tree.recursiveSet(node, key, value, orphans)
+		return newSelf, updated, nil, true
+	}
+
+	left := bytes.Compare(key, node.key) < 0
+	child := node.getRightNode(tree.ImmutableTree)
+	if left {
+		child = node.getLeftNode(tree.ImmutableTree)
+	}
+	newChild, updated, current, ok := tree.recursiveSetIf(child, key, value, cond, orphans)
+	if !ok {
+		return node, false, current, false
+	}
+
+	*orphans = append(*orphans, node)
+	node = node.clone(tree.version + 1)
+	if left {
+		node.leftHash, node.leftNode = nil, newChild
+	} else {
+		node.rightHash, node.rightNode = nil, newChild
+	}
+	if updated {
+		return node, true, nil, true
+	}
+	node.calcHeightAndSize(tree.ImmutableTree)
+	return tree.balance(node, orphans), false, nil, true
+}
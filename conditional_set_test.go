@@ -0,0 +1,98 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func compareAndSwap(t *testing.T, tree *MutableTree, key, expected, value []byte) ([]byte, bool) {
+	current, swapped, err := tree.CompareAndSwap(key, expected, value)
+	require.NoError(t, err)
+	return current, swapped
+}
+
+func setIfAbsent(t *testing.T, tree *MutableTree, key, value []byte) bool {
+	set, err := tree.SetIfAbsent(key, value)
+	require.NoError(t, err)
+	return set
+}
+
+func TestConditionalSet(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	_, ok := compareAndSwap(t, tree, []byte("a"), []byte("1"), []byte("2"))
+	require.False(t, ok)
+	require.True(t, setIfAbsent(t, tree, []byte("a"), []byte("1")))
+	require.False(t, setIfAbsent(t, tree, []byte("a"), []byte("2")))
+	require.Equal(t, []byte("1"), tree.Get([]byte("a")))
+	for i := 0; i < 20; i++ {
+		require.True(t, setIfAbsent(t, tree, []byte(fmt.Sprintf("key%02d", i)), []byte{}))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	// Failed conditions leave the tree unchanged.
+	current, ok := compareAndSwap(t, tree, []byte("a"), []byte("2"), []byte("3"))
+	require.False(t, ok)
+	require.Equal(t, []byte("1"), current)
+	current, ok = compareAndSwap(t, tree, []byte("a"), nil, []byte("3"))
+	require.False(t, ok)
+	require.Equal(t, []byte("1"), current)
+	current, ok = compareAndSwap(t, tree, []byte("key05"), nil, []byte("3"))
+	require.False(t, ok)
+	require.Equal(t, []byte{}, current)
+	current, ok = compareAndSwap(t, tree, []byte("c"), []byte("1"), []byte("3"))
+	require.False(t, ok)
+	require.Nil(t, current)
+	require.False(t, setIfAbsent(t, tree, []byte("key05"), []byte("3")))
+	require.Equal(t, hash, tree.WorkingHash())
+	require.Empty(t, tree.unsavedFastNodeAdditions)
+
+	for _, cas := range [][3]string{{"a", "1", "3"}, {"key05", "", "3"}} {
+		_, ok = compareAndSwap(t, tree, []byte(cas[0]), []byte(cas[1]), []byte(cas[2]))
+		require.True(t, ok)
+	}
+	_, ok = compareAndSwap(t, tree, []byte("b"), nil, []byte("4"))
+	require.True(t, ok)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), tree.Get([]byte("a")))
+	require.Equal(t, []byte("3"), tree.Get([]byte("key05")))
+	require.Equal(t, []byte("4"), tree.Get([]byte("b")))
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Equal(t, countTreeNodes(tree.ImmutableTree), countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+}
+
+func TestConditionalSet_Concurrent(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("counter"), []byte{0})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			current := []byte{0}
+			for j := 0; j < 50; {
+				actual, ok, _ := tree.CompareAndSwap([]byte("counter"), current, []byte{current[0] + 1})
+				if ok {
+					current = []byte{current[0] + 1}
+					j++
+				} else {
+					current = actual
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, []byte{byte(400 % 256)}, tree.Get([]byte("counter")))
+}
@@ -0,0 +1,229 @@
+package iavl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// countdownContext is a context which is cancelled once Err() has been called n times, to
+// cancel operations part-way deterministically.
+type countdownContext struct {
+	context.Context
+	n int64
+}
+
+func newCountdownContext(n int64) *countdownContext {
+	return &countdownContext{Context: context.Background(), n: n}
+}
+
+func (c *countdownContext) Err() error {
+	if atomic.AddInt64(&c.n, -1) < 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func (c *countdownContext) Done() <-chan struct{} {
+	return nil
+}
+
+func cancelledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestIterateContext(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	for name, iterate := range map[string]func(context.Context, func(k, v []byte) bool) (bool, error){
+		"immutable": itree.IterateContext,
+		"mutable":   tree.IterateContext,
+	} {
+		t.Run(name, func(t *testing.T) {
+			count := 0
+			stopped, err := iterate(newCountdownContext(4), func(k, v []byte) bool {
+				count++
+				return false
+			})
+			require.True(t, errors.Is(err, context.Canceled))
+			require.False(t, stopped)
+			require.Less(t, count, 10)
+
+			count = 0
+			stopped, err = iterate(context.Background(), func(k, v []byte) bool {
+				count++
+				return count == 5
+			})
+			require.NoError(t, err)
+			require.True(t, stopped)
+		})
+	}
+}
+
+func TestDeleteVersionsRangeContext(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 10; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d", v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// A deletion cancelled part-way is discarded.
+	err = tree.DeleteVersionsRangeContext(newCountdownContext(5), 1, 4)
+	require.True(t, errors.Is(err, context.Canceled))
+	for v := int64(1); v <= 5; v++ {
+		require.True(t, tree.VersionExists(v))
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("v%d", v-1)), itree.Get([]byte("k3")))
+	}
+
+	err = tree.DeleteVersionsRangeContext(cancelledContext(), 1, 4)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.True(t, tree.VersionExists(1))
+
+	require.NoError(t, tree.DeleteVersionsRangeContext(context.Background(), 1, 4))
+	require.False(t, tree.VersionExists(1))
+	require.False(t, tree.VersionExists(3))
+	require.True(t, tree.VersionExists(4))
+}
+
+func TestLoadVersionContext_Migration(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	saveRefCountVersions(t, tree, 6)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := &Options{
+		RefCountGC:         true,
+		MigrationChunkSize: 5,
+		MigrationProgress:  func(MigrationProgress) { cancel() },
+	}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.LoadVersionContext(ctx, 0)
+	require.True(t, errors.Is(err, context.Canceled))
+	require.NotEmpty(t, dumpPrefix(t, memDB, migrationCursorKey("refcounts")))
+
+	// The migration resumes when the tree is next loaded.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{RefCountGC: true})
+	require.NoError(t, err)
+	version, err := tree.LoadVersionContext(context.Background(), 0)
+	require.NoError(t, err)
+	require.EqualValues(t, 6, version)
+	require.Empty(t, dumpPrefix(t, memDB, migrationCursorKey("refcounts")))
+}
+
+func TestLoadVersionContext_FastStorage(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Pretend the fast storage upgrade is needed, and cancel it part-way. No fast nodes must
+	// be written, since they wouldn't be cleared before the next upgrade.
+	for i := 0; i < 20; i++ {
+		require.NoError(t, tree.ndb.db.Delete(fastKeyFormat.Key([]byte(fmt.Sprintf("k%02d", i)))))
+	}
+	tree.ndb.storageVersion = defaultStorageVersionValue
+	err = tree.enableFastStorageAndCommit(newCountdownContext(5))
+	require.True(t, errors.Is(err, context.Canceled))
+	require.False(t, tree.ndb.hasUpgradedToFastStorage())
+	require.NoError(t, tree.ndb.Commit())
+	require.Zero(t, countPrefixKeys(t, tree.ndb.db, fastKeyFormat.Key()))
+
+	require.NoError(t, tree.enableFastStorageAndCommit(context.Background()))
+	require.Equal(t, 20, countPrefixKeys(t, tree.ndb.db, fastKeyFormat.Key()))
+}
+
+func TestExportContext(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		tree.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	exporter, err := itree.ExportContext(ctx, ExportPostOrder)
+	require.NoError(t, err)
+	defer exporter.Close()
+	_, err = exporter.Next()
+	require.NoError(t, err)
+	cancel()
+
+	deadline := time.After(5 * time.Second)
+	for err == nil {
+		select {
+		case <-deadline:
+			t.Fatal("export was not cancelled")
+		default:
+		}
+		_, err = exporter.Next()
+	}
+	require.True(t, errors.Is(err, context.Canceled))
+
+	// Closing an exporter doesn't make it fail.
+	exporter, err = itree.ExportContext(context.Background(), ExportPostOrder)
+	require.NoError(t, err)
+	exporter.Close()
+	_, err = exporter.Next()
+	require.Equal(t, ExportDone, err)
+}
+
+func TestImportContext(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	newTree, err := getTestTree(0)
+	require.NoError(t, err)
+	importer, err := newTree.ImportContext(ctx, 1)
+	require.NoError(t, err)
+	defer importer.Close()
+
+	exporter := itree.Export()
+	defer exporter.Close()
+	node, err := exporter.Next()
+	require.NoError(t, err)
+	require.NoError(t, importer.Add(node))
+
+	cancel()
+	node, err = exporter.Next()
+	require.NoError(t, err)
+	require.Equal(t, context.Canceled, importer.Add(node))
+	require.Equal(t, context.Canceled, importer.Commit())
+}
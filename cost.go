@@ -0,0 +1,43 @@
+package iavl
+
+// CostObserver is notified of the work done by tree operations, see Options.CostObserver, so
+// that execution layers can charge storage gas for the nodes actually read and the bytes actually
+// written rather than flat estimates. It is called synchronously, possibly concurrently by
+// concurrent readers, and must not access the tree.
+type CostObserver interface {
+	// OnNodeRead is called for each step from a node to a child while traversing a tree, e.g.
+	// along the path of a Get or Set or by an iterator, with the size of the child's encoding.
+	// Steps are reported whether the child is held in memory, cached or read from the database,
+	// so that the reads of an operation only depend on the tree, and not on the state of caches.
+	// cached is true if the child was held in memory by its parent, and is only informational.
+	OnNodeRead(size int, cached bool)
+	// OnFastNodeRead is called for each fast node read from the fast node cache or the database,
+	// including by fast iterators, with the size of its key and encoding. cached is true if it
+	// was read from the cache, and is only informational.
+	OnFastNodeRead(size int, cached bool)
+	// OnWrite is called for each key set in the working tree with the size of the key and value,
+	// and for each key removed with the size of the key.
+	OnWrite(size int)
+}
+
+// observeNodeRead reports a step to a child node to the cost observer, if any. It must not be
+// called with ndb.mtx held.
+func (t *ImmutableTree) observeNodeRead(node *Node, cached bool) {
+	if t != nil && t.ndb != nil && t.ndb.opts.CostObserver != nil {
+		t.ndb.opts.CostObserver.OnNodeRead(node.encodedSize(), cached)
+	}
+}
+
+// observeFastNodeRead reports a fast node read to the cost observer, if any.
+func (ndb *nodeDB) observeFastNodeRead(node *FastNode, cached bool) {
+	if ndb.opts.CostObserver != nil {
+		ndb.opts.CostObserver.OnFastNodeRead(len(node.key)+node.encodedSize(), cached)
+	}
+}
+
+// observeWrite reports a write of the working tree to the cost observer, if any.
+func (tree *MutableTree) observeWrite(key, value []byte) {
+	if tree.ndb.opts.CostObserver != nil {
+		tree.ndb.opts.CostObserver.OnWrite(len(key) + len(value))
+	}
+}
@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+type countingCostObserver struct {
+	nodeReads, nodeCacheHits, nodeBytes         int
+	fastNodeReads, fastNodeCacheHits, fastBytes int
+	writes, writeBytes                          int
+}
+
+func (o *countingCostObserver) OnNodeRead(size int, cached bool) {
+	o.nodeReads++
+	o.nodeBytes += size
+	if cached {
+		o.nodeCacheHits++
+	}
+}
+
+func (o *countingCostObserver) OnFastNodeRead(size int, cached bool) {
+	o.fastNodeReads++
+	o.fastBytes += size
+	if cached {
+		o.fastNodeCacheHits++
+	}
+}
+
+func (o *countingCostObserver) OnWrite(size int) {
+	o.writes++
+	o.writeBytes += size
+}
+
+func TestCostObserver(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 16; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	observer := &countingCostObserver{}
+	tree, err = NewMutableTreeWithOpts(memDB, 100, &Options{CostObserver: observer})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	height := int(tree.Height())
+
+	// Reading a key from the tree reads its path below the root, whether or not it is cached.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	*observer = countingCostObserver{}
+	_, value := itree.GetWithIndex([]byte("key05"))
+	require.Equal(t, []byte("value"), value)
+	require.Equal(t, height, observer.nodeReads)
+	require.Equal(t, 0, observer.nodeCacheHits)
+	require.Positive(t, observer.nodeBytes)
+	itree.GetWithIndex([]byte("key05"))
+	require.Equal(t, 2*height, observer.nodeReads)
+	require.Equal(t, 0, observer.nodeCacheHits)
+
+	// Fast node reads.
+	*observer = countingCostObserver{}
+	require.Equal(t, []byte("value"), tree.Get([]byte("key07")))
+	require.Equal(t, 1, observer.fastNodeReads)
+	require.Equal(t, len("key07")+(&FastNode{versionLastUpdatedAt: 1, value: []byte("value")}).encodedSize(),
+		observer.fastBytes)
+
+	// Iterating over saved keys reads their fast nodes.
+	*observer = countingCostObserver{}
+	itr := itree.Iterator([]byte("key02"), []byte("key06"), true)
+	for ; itr.Valid(); itr.Next() {
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 4, observer.fastNodeReads)
+
+	// Writes report their keys and values, and read the nodes along their paths.
+	*observer = countingCostObserver{}
+	tree.Set([]byte("key05"), []byte("new"))
+	tree.Remove([]byte("key06"))
+	require.Equal(t, 2, observer.writes)
+	require.Equal(t, len("key05")+len("new")+len("key06"), observer.writeBytes)
+	require.Positive(t, observer.nodeReads)
+
+	// Reading from the working tree reports the nodes held in memory too.
+	*observer = countingCostObserver{}
+	_, value = tree.ImmutableTree.GetWithIndex([]byte("key05"))
+	require.Equal(t, []byte("new"), value)
+	require.Positive(t, observer.nodeReads)
+	require.Equal(t, observer.nodeReads, observer.nodeCacheHits)
+}
@@ -0,0 +1,163 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// Cursor flags, see Cursor.MarshalBinary().
+const (
+	cursorAscending byte = 1 << iota
+	cursorDone
+	cursorHasStart
+	cursorHasEnd
+	cursorHasPosition
+)
+
+// Cursor is a stable iteration position over a key range which survives SaveVersion(). It
+// records the last key returned, and each call to Next() resumes after it on whichever version
+// it is given, typically the latest one. This allows long-running exporters to page through a
+// tree without pinning a version for the whole iteration. Keys are never returned twice, but
+// since each batch is read from the version given, keys added behind the cursor after it has
+// passed are not seen, and the pages don't form a snapshot of any single version.
+//
+// A Cursor can be persisted with MarshalBinary() and restored with UnmarshalBinary().
+type Cursor struct {
+	start, end []byte
+	ascending  bool
+	position   []byte // last key returned, nil if none
+	version    int64  // version of the last batch
+	done       bool
+}
+
+// NewCursor creates a cursor over the range [start, end), where nil means unbounded.
+func NewCursor(start, end []byte, ascending bool) *Cursor {
+	return &Cursor{start: start, end: end, ascending: ascending}
+}
+
+// Next returns up to limit key/value pairs following the cursor position in the given tree, and
+// advances the cursor past them. It returns no pairs once the end of the range is reached.
+func (c *Cursor) Next(tree *ImmutableTree, limit int) (keys, values [][]byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("limit must be positive")
+	}
+	if c.done {
+		return nil, nil, nil
+	}
+	start, end := c.start, c.end
+	if c.position != nil {
+		if c.ascending {
+			start = cpSucc(c.position) // the smallest key after the position
+		} else {
+			end = c.position
+		}
+	}
+
+	itr := tree.Iterator(start, end, c.ascending)
+	defer itr.Close()
+	for ; itr.Valid() && len(keys) < limit; itr.Next() {
+		keys = append(keys, itr.Key())
+		values = append(values, itr.Value())
+	}
+	if err := itr.Error(); err != nil {
+		return nil, nil, err
+	}
+
+	c.version = tree.Version()
+	if len(keys) > 0 {
+		c.position = keys[len(keys)-1]
+	}
+	c.done = !itr.Valid()
+	return keys, values, nil
+}
+
+// Done returns whether the cursor has reached the end of its range.
+func (c *Cursor) Done() bool {
+	return c.done
+}
+
+// Position returns the last key returned by the cursor, or nil if none.
+func (c *Cursor) Position() []byte {
+	return c.position
+}
+
+// Version returns the version from which the last batch was read, or 0 if none.
+func (c *Cursor) Version() int64 {
+	return c.version
+}
+
+// MarshalBinary encodes the cursor, e.g. to persist it across restarts.
+func (c *Cursor) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if c.ascending {
+		flags |= cursorAscending
+	}
+	if c.done {
+		flags |= cursorDone
+	}
+	if c.start != nil {
+		flags |= cursorHasStart
+	}
+	if c.end != nil {
+		flags |= cursorHasEnd
+	}
+	if c.position != nil {
+		flags |= cursorHasPosition
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(flags)
+	if err := encodeVarint(&buf, c.version); err != nil {
+		return nil, err
+	}
+	for _, bz := range [][]byte{c.start, c.end, c.position} {
+		if err := encodeBytes(&buf, bz); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a cursor encoded by MarshalBinary().
+func (c *Cursor) UnmarshalBinary(bz []byte) error {
+	if len(bz) == 0 {
+		return errors.New("cursor is empty")
+	}
+	flags := bz[0]
+	bz = bz[1:]
+	version, n, err := decodeVarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding version")
+	}
+	bz = bz[n:]
+
+	var fields [3][]byte
+	for i := range fields {
+		field, n, err := decodeBytes(bz)
+		if err != nil {
+			return errors.Wrap(err, "decoding cursor")
+		}
+		fields[i] = field
+		bz = bz[n:]
+	}
+	if len(bz) > 0 {
+		return errors.Errorf("cursor has %v trailing bytes", len(bz))
+	}
+
+	*c = Cursor{
+		ascending: flags&cursorAscending != 0,
+		done:      flags&cursorDone != 0,
+		version:   version,
+	}
+	if flags&cursorHasStart != 0 {
+		c.start = fields[0]
+	}
+	if flags&cursorHasEnd != 0 {
+		c.end = fields[1]
+	}
+	if flags&cursorHasPosition != 0 {
+		c.position = fields[2]
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursor(t *testing.T) {
+	for _, ascending := range []bool{true, false} {
+		t.Run(fmt.Sprintf("ascending=%v", ascending), func(t *testing.T) {
+			tree, err := getTestTree(0)
+			require.NoError(t, err)
+			for i := 0; i < 20; i += 2 {
+				tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v1"))
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			cursor := NewCursor([]byte("k02"), []byte("k18"), ascending)
+			seen := map[string]bool{}
+			for page := 0; !cursor.Done(); page++ {
+				keys, values, err := cursor.Next(tree.ImmutableTree, 3)
+				require.NoError(t, err)
+				require.Equal(t, len(keys), len(values))
+				require.Equal(t, tree.Version(), cursor.Version())
+				for _, key := range keys {
+					require.False(t, seen[string(key)], "key %s returned twice", key)
+					seen[string(key)] = true
+				}
+
+				// Persist the cursor, and save a new version updating keys on both sides of it
+				// while pruning the version it read from.
+				bz, err := cursor.MarshalBinary()
+				require.NoError(t, err)
+				cursor = &Cursor{}
+				require.NoError(t, cursor.UnmarshalBinary(bz))
+				tree.Set([]byte(fmt.Sprintf("k%02d", 2*page+3)), []byte("v2"))
+				tree.Set([]byte(fmt.Sprintf("k%02d", 17-2*page)), []byte("v2"))
+				_, version, err := tree.SaveVersion()
+				require.NoError(t, err)
+				require.NoError(t, tree.DeleteVersion(version-1))
+			}
+
+			// Original keys are all seen, along with new keys added ahead of the cursor.
+			for i := 2; i < 18; i += 2 {
+				require.True(t, seen[fmt.Sprintf("k%02d", i)])
+			}
+			ahead, behind := "k17", "k03"
+			if !ascending {
+				ahead, behind = behind, ahead
+			}
+			require.True(t, seen[ahead])
+			require.False(t, seen[behind])
+			require.False(t, seen["k18"])
+
+			keys, _, err := cursor.Next(tree.ImmutableTree, 3)
+			require.NoError(t, err)
+			require.Empty(t, keys)
+		})
+	}
+}
+
+func TestCursor_MarshalBinary(t *testing.T) {
+	for _, cursor := range []*Cursor{
+		NewCursor(nil, nil, true),
+		NewCursor([]byte{}, []byte("z"), false),
+		{start: []byte("a"), position: []byte("b"), version: 7, done: true},
+	} {
+		bz, err := cursor.MarshalBinary()
+		require.NoError(t, err)
+		decoded := &Cursor{}
+		require.NoError(t, decoded.UnmarshalBinary(bz))
+		require.Equal(t, cursor, decoded)
+	}
+
+	require.Error(t, (&Cursor{}).UnmarshalBinary(nil))
+	require.Error(t, (&Cursor{}).UnmarshalBinary([]byte{1, 2}))
+}
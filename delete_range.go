@@ -0,0 +1,129 @@
+package iavl
+
+import (
+	"bytes"
+)
+
+// DeleteRange removes all keys in [start, end) from the working tree, and returns the number of
+// keys removed. A nil start or end is unbounded.
+//
+// Rather than removing keys one at a time, subtrees entirely within the range are dropped, and the
+// remaining subtrees are joined and rebalanced only along the range boundaries. The resulting
+// tree, and thus the root hash, differs from removing the same keys with Remove, so all nodes
+// replicating the tree must delete the range the same way.
+func (tree *MutableTree) DeleteRange(start, end []byte) int {
+	tree.discardMerges(start, end)
+	removed := tree.deleteRange(start, end)
+	if len(removed) > 0 {
+		tree.journal(journalOpDeleteRange, start, end)
+	}
+	for _, key := range removed {
+		tree.clearExpiry(key)
+		for _, h := range tree.hooks {
+			h.OnRemove(key)
+		}
+	}
+	return len(removed)
+}
+
+// deleteRange removes the keys in [start, end) from the working tree, and returns them.
+func (tree *MutableTree) deleteRange(start, end []byte) [][]byte {
+	if tree.root == nil || (start != nil && end != nil && bytes.Compare(start, end) >= 0) {
+		return nil
+	}
+	orphans := tree.prepareOrphansSlice()
+	var removed [][]byte
+	tree.root = tree.deleteRangeFrom(tree.root, nil, nil, start, end, &orphans, &removed)
+	tree.addOrphans(orphans)
+	for _, key := range removed {
+		tree.addUnsavedRemoval(key)
+	}
+	return removed
+}
+
+// deleteRangeFrom removes the keys in [start, end) from the subtree of node, whose keys are known
+// to be in [lo, hi), and returns the new subtree, or nil if it is empty. The subtree is returned
+// unchanged if it has no keys in the range.
+func (tree *MutableTree) deleteRangeFrom(node *Node, lo, hi, start, end []byte, orphans *[]*Node, removed *[][]byte) *Node {
+	if (lo != nil && end != nil && bytes.Compare(lo, end) >= 0) ||
+		(hi != nil && start != nil && bytes.Compare(start, hi) >= 0) {
+		return node
+	}
+
+	if node.isLeaf() {
+		if (start != nil && bytes.Compare(node.key, start) < 0) || (end != nil && bytes.Compare(node.key, end) >= 0) {
+			return node
+		}
+		*orphans = append(*orphans, node)
+		*removed = append(*removed, node.key)
+		return nil
+	}
+
+	if (start == nil || (lo != nil && bytes.Compare(start, lo) <= 0)) &&
+		(end == nil || (hi != nil && bytes.Compare(hi, end) <= 0)) {
+		node.traverse(tree.ImmutableTree, true, func(n *Node) bool {
+			*orphans = append(*orphans, n)
+			if n.isLeaf() {
+				*removed = append(*removed, n.key)
+			}
+			return false
+		})
+		return nil
+	}
+
+	leftNode, rightNode := node.getLeftNode(tree.ImmutableTree), node.getRightNode(tree.ImmutableTree)
+	left := tree.deleteRangeFrom(leftNode, lo, node.key, start, end, orphans, removed)
+	right := tree.deleteRangeFrom(rightNode, node.key, hi, start, end, orphans, removed)
+	if left == leftNode && right == rightNode {
+		return node
+	}
+	*orphans = append(*orphans, node)
+	return tree.join(left, right, orphans)
+}
+
+// join returns a balanced tree containing the nodes of a and b, where all keys of a are smaller
+// than all keys of b. Either may be nil. Only the nodes along the edge of the taller tree where the
+// shorter one is attached are replaced.
+func (tree *MutableTree) join(a, b *Node, orphans *[]*Node) *Node {
+	version := tree.version + 1
+
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+
+	case a.height > b.height+1:
+		*orphans = append(*orphans, a)
+		a = a.clone(version)
+		right := tree.join(a.getRightNode(tree.ImmutableTree), b, orphans)
+		a.rightHash, a.rightNode = right.hash, right
+		a.calcHeightAndSize(tree.ImmutableTree)
+		return tree.balance(a, orphans)
+
+	case b.height > a.height+1:
+		*orphans = append(*orphans, b)
+		b = b.clone(version)
+		left := tree.join(a, b.getLeftNode(tree.ImmutableTree), orphans)
+		b.leftHash, b.leftNode = left.hash, left
+		b.calcHeightAndSize(tree.ImmutableTree)
+		return tree.balance(b, orphans)
+
+	default:
+		// Inner nodes are keyed by the smallest key of their right subtree.
+		leftmost := b
+		for !leftmost.isLeaf() {
+			leftmost = leftmost.getLeftNode(tree.ImmutableTree)
+		}
+		node := &Node{
+			key:       leftmost.key,
+			version:   version,
+			leftHash:  a.hash,
+			leftNode:  a,
+			rightHash: b.hash,
+			rightNode: b,
+		}
+		node.calcHeightAndSize(tree.ImmutableTree)
+		return node
+	}
+}
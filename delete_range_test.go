@@ -0,0 +1,132 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestDeleteRange(t *testing.T) {
+	testcases := []struct {
+		start, end []byte
+	}{
+		{nil, nil},
+		{nil, []byte("key100")},
+		{[]byte("key100"), nil},
+		{[]byte("key050"), []byte("key060")},
+		{[]byte("key0505"), []byte("key0605")},
+		{[]byte("key123"), []byte("key124")},
+		{[]byte("key123"), []byte("key123")},
+		{[]byte("key300"), nil},
+		{[]byte("a"), []byte("b")},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(fmt.Sprintf("%s-%s", tc.start, tc.end), func(t *testing.T) {
+			memDB := db.NewMemDB()
+			tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{RunInvariantChecks: true})
+			require.NoError(t, err)
+			expect := map[string]string{}
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%03d", i)
+				tree.Set([]byte(key), []byte("value"))
+				expect[key] = "value"
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			// Unsaved keys are removed as well.
+			tree.Set([]byte("key0505"), []byte("unsaved"))
+			expect["key0505"] = "unsaved"
+
+			removed := 0
+			for key := range expect {
+				if (tc.start == nil || key >= string(tc.start)) && (tc.end == nil || key < string(tc.end)) {
+					delete(expect, key)
+					removed++
+				}
+			}
+			require.Equal(t, removed, tree.DeleteRange(tc.start, tc.end))
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			require.EqualValues(t, len(expect), tree.Size())
+
+			actual := map[string]string{}
+			tree.Iterate(func(key, value []byte) bool {
+				actual[string(key)] = string(value)
+				return false
+			})
+			require.Equal(t, expect, actual)
+
+			// Nodes of the previous version which are no longer used are orphaned.
+			require.NoError(t, tree.DeleteVersion(1))
+			require.Equal(t, countTreeNodes(tree.ImmutableTree), countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+		})
+	}
+}
+
+func TestDeleteRange_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RunInvariantChecks: true})
+	require.NoError(t, err)
+	keys := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 50; j++ {
+			key := fmt.Sprintf("%04d", r.Intn(10000))
+			tree.Set([]byte(key), []byte{1})
+			keys[key] = true
+		}
+		start, end := []byte(fmt.Sprintf("%04d", r.Intn(10000))), []byte(fmt.Sprintf("%04d", r.Intn(10000)))
+		if bytes.Compare(start, end) > 0 {
+			start, end = end, start
+		}
+		for key := range keys {
+			if key >= string(start) && key < string(end) {
+				delete(keys, key)
+			}
+		}
+		tree.DeleteRange(start, end)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		expect := make([]string, 0, len(keys))
+		for key := range keys {
+			expect = append(expect, key)
+		}
+		sort.Strings(expect)
+		var actual []string
+		tree.Iterate(func(key, value []byte) bool {
+			actual = append(actual, string(key))
+			return false
+		})
+		require.Equal(t, expect, actual)
+	}
+}
+
+func TestDeleteRange_Journal(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{Journal: true}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 40, tree.DeleteRange([]byte("key30"), []byte("key70")))
+	require.Equal(t, 10, tree.DeleteRange(nil, []byte("key10")))
+	require.Equal(t, 2, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+	workingHash := tree.WorkingHash()
+
+	// The replayed tree has the same shape as the one the range was deleted from.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, workingHash, tree.WorkingHash())
+	require.EqualValues(t, 50, tree.Size())
+}
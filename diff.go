@@ -0,0 +1,105 @@
+package iavl
+
+import (
+	"bytes"
+)
+
+// KeyDiff is a key whose leaf differs between two trees, see ImmutableTree.Diff().
+type KeyDiff struct {
+	Key      []byte
+	ValueA   []byte // value in the first tree, nil if absent
+	ValueB   []byte // value in the second tree, nil if absent
+	VersionA int64  // version the key was set at in the first tree, 0 if absent
+	VersionB int64  // version the key was set at in the second tree, 0 if absent
+}
+
+// diffFrontier is the sequence of disjoint subtrees of a tree yet to be compared, in key order,
+// with the next one last.
+type diffFrontier struct {
+	tree  *ImmutableTree
+	nodes []*Node
+}
+
+func newDiffFrontier(tree *ImmutableTree) *diffFrontier {
+	f := &diffFrontier{tree: tree}
+	if tree != nil && tree.root != nil {
+		f.nodes = []*Node{tree.root}
+	}
+	return f
+}
+
+func (f *diffFrontier) next() *Node {
+	if len(f.nodes) == 0 {
+		return nil
+	}
+	return f.nodes[len(f.nodes)-1]
+}
+
+func (f *diffFrontier) pop() {
+	f.nodes = f.nodes[:len(f.nodes)-1]
+}
+
+// expand replaces the next subtree by its children.
+func (f *diffFrontier) expand() {
+	node := f.next()
+	f.pop()
+	f.nodes = append(f.nodes, node.getRightNode(f.tree), node.getLeftNode(f.tree))
+}
+
+// Diff calls fn for each key which differs between the trees, in key order, i.e. keys only
+// present in one of them, or with a different value or set version, until fn returns true. It
+// is meant for debugging app hash mismatches between replicas, e.g. given trees of the same
+// version loaded from two databases.
+//
+// Both trees are walked simultaneously, skipping subtrees with equal hashes, so the cost is
+// proportional to the differences rather than the tree size when the trees have the same shape.
+// It returns whether fn stopped the walk.
+func (t *ImmutableTree) Diff(other *ImmutableTree, fn func(diff KeyDiff) bool) (stopped bool, err error) {
+	defer recoverNodeMissing(&err)
+
+	a, b := newDiffFrontier(t), newDiffFrontier(other)
+	for {
+		nodeA, nodeB := a.next(), b.next()
+		var diff KeyDiff
+		switch {
+		case nodeA == nil && nodeB == nil:
+			return false, nil
+
+		case nodeA != nil && nodeB != nil && bytes.Equal(nodeA._hash(), nodeB._hash()):
+			a.pop()
+			b.pop()
+			continue
+
+		case nodeA != nil && !nodeA.isLeaf() && (nodeB == nil || nodeA.height >= nodeB.height):
+			a.expand()
+			continue
+
+		case nodeB != nil && !nodeB.isLeaf():
+			b.expand()
+			continue
+
+		// Both are leaves, or one tree is exhausted and the other has a leaf next.
+		case nodeB == nil || (nodeA != nil && bytes.Compare(nodeA.key, nodeB.key) < 0):
+			diff = KeyDiff{Key: nodeA.key, ValueA: nodeA.value, VersionA: nodeA.version}
+			a.pop()
+
+		case nodeA == nil || bytes.Compare(nodeA.key, nodeB.key) > 0:
+			diff = KeyDiff{Key: nodeB.key, ValueB: nodeB.value, VersionB: nodeB.version}
+			b.pop()
+
+		default:
+			diff = KeyDiff{
+				Key:      nodeA.key,
+				ValueA:   nodeA.value,
+				ValueB:   nodeB.value,
+				VersionA: nodeA.version,
+				VersionB: nodeB.version,
+			}
+			a.pop()
+			b.pop()
+		}
+		if fn(diff) {
+			return true, nil
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// bruteForceDiff diffs two trees by iterating over all of their keys.
+func bruteForceDiff(t *testing.T, a, b *ImmutableTree) []KeyDiff {
+	leaves := func(tree *ImmutableTree) map[string]*Node {
+		nodes := map[string]*Node{}
+		if tree.root != nil {
+			tree.root.traverse(tree, true, func(node *Node) bool {
+				if node.isLeaf() {
+					nodes[string(node.key)] = node
+				}
+				return false
+			})
+		}
+		return nodes
+	}
+	leavesA, leavesB := leaves(a), leaves(b)
+	keys := [][]byte{}
+	for key := range leavesA {
+		keys = append(keys, []byte(key))
+	}
+	for key := range leavesB {
+		if _, ok := leavesA[key]; !ok {
+			keys = append(keys, []byte(key))
+		}
+	}
+	keys = sortByteSlices(keys)
+
+	var diffs []KeyDiff
+	for _, key := range keys {
+		diff := KeyDiff{Key: key}
+		if leaf, ok := leavesA[string(key)]; ok {
+			diff.ValueA, diff.VersionA = leaf.value, leaf.version
+		}
+		if leaf, ok := leavesB[string(key)]; ok {
+			diff.ValueB, diff.VersionB = leaf.value, leaf.version
+		}
+		if diff.VersionA != diff.VersionB || !bytes.Equal(diff.ValueA, diff.ValueB) {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+func TestImmutableTree_Diff(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	treeA, err := getTestTree(0)
+	require.NoError(t, err)
+	treeB, err := getTestTree(0)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 100; i++ {
+			key := []byte(fmt.Sprintf("k%03d", r.Intn(300)))
+			value := []byte{byte(r.Intn(4))}
+			treeA.Set(key, value)
+			treeB.Set(key, value)
+		}
+		if v == 4 {
+			// Diverge in the last version, also changing the shape of the trees.
+			for i := 0; i < 10; i++ {
+				treeA.Set([]byte(fmt.Sprintf("k%03d", r.Intn(300))), []byte("a"))
+				treeB.Remove([]byte(fmt.Sprintf("k%03d", r.Intn(300))))
+			}
+		}
+		_, _, err = treeA.SaveVersion()
+		require.NoError(t, err)
+		_, _, err = treeB.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	a, err := treeA.GetImmutable(5)
+	require.NoError(t, err)
+	b, err := treeB.GetImmutable(5)
+	require.NoError(t, err)
+	expect := bruteForceDiff(t, a, b)
+	require.NotEmpty(t, expect)
+
+	var diffs []KeyDiff
+	stopped, err := a.Diff(b, func(diff KeyDiff) bool {
+		diffs = append(diffs, diff)
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, expect, diffs)
+
+	// Identical versions have no differences.
+	a4, err := treeA.GetImmutable(4)
+	require.NoError(t, err)
+	b4, err := treeB.GetImmutable(4)
+	require.NoError(t, err)
+	_, err = a4.Diff(b4, func(diff KeyDiff) bool {
+		require.Fail(t, "unexpected diff", "%+v", diff)
+		return false
+	})
+	require.NoError(t, err)
+
+	// Diffing against an empty tree reports all keys, and the walk can be stopped.
+	empty, err := getTestTree(0)
+	require.NoError(t, err)
+	count := 0
+	stopped, err = empty.ImmutableTree.Diff(b, func(diff KeyDiff) bool {
+		require.Zero(t, diff.VersionA)
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
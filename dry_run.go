@@ -0,0 +1,420 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Tags of the entries of a dry run overlay, prepended to their values.
+const (
+	dryRunDeleted byte = iota
+	dryRunSet
+)
+
+// DryRunReport summarizes the changes to the database which a tree opened with Options.DryRun
+// would have written so far, see MutableTree.DryRunReport.
+type DryRunReport struct {
+	Changes          []BatchOp // Net changes in key order. Deletes are only listed for existing keys.
+	DeletedVersions  []int64   // Versions whose roots would be deleted, in order.
+	DeletedNodes     int       // Number of nodes deleted from the database.
+	DeletedOrphans   int       // Number of orphan records deleted, including re-anchored ones.
+	DeletedFastNodes int       // Number of fast nodes deleted.
+	BytesWritten     int64     // Size of the keys and values set.
+	BytesFreed       int64     // Size of the keys and values deleted, as currently stored.
+	ColdTierSets     int       // Number of nodes demoted to the cold tier.
+	ColdTierDeletes  int       // Number of nodes deleted from the cold tier.
+}
+
+// String returns a summary of the report.
+func (r *DryRunReport) String() string {
+	return fmt.Sprintf("DryRunReport{changes=%d versions=%v nodes=%d orphans=%d fastnodes=%d written=%dB freed=%dB}",
+		len(r.Changes), r.DeletedVersions, r.DeletedNodes, r.DeletedOrphans, r.DeletedFastNodes,
+		r.BytesWritten, r.BytesFreed)
+}
+
+// DryRunReport returns the changes which the tree would have written to the database so far,
+// compared to the database as currently stored. It returns an error if the tree wasn't opened
+// with Options.DryRun.
+func (tree *MutableTree) DryRunReport() (*DryRunReport, error) {
+	ndb := tree.ndb
+	overlay, ok := ndb.db.(*dryRunDB)
+	if !ok {
+		return nil, errors.New("tree was not opened with the DryRun option")
+	}
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+	report, err := overlay.report()
+	if err != nil {
+		return nil, err
+	}
+	if ndb.opts.ColdTier != nil {
+		if tier, ok := ndb.opts.ColdTier.Tier.(*dryRunTier); ok {
+			report.ColdTierSets, report.ColdTierDeletes = tier.counts()
+		}
+	}
+	return report, nil
+}
+
+// dryRunDB is a database which keeps all writes in memory, on top of a database which is only
+// read, see Options.DryRun.
+type dryRunDB struct {
+	base    dbm.DB
+	overlay *dbm.MemDB // tagged values, dryRunDeleted for deleted keys
+}
+
+var _ dbm.DB = (*dryRunDB)(nil)
+
+func newDryRunDB(base dbm.DB) *dryRunDB {
+	return &dryRunDB{base: base, overlay: dbm.NewMemDB()}
+}
+
+// Get implements dbm.DB.
+func (d *dryRunDB) Get(key []byte) ([]byte, error) {
+	tagged, err := d.overlay.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if tagged == nil {
+		return d.base.Get(key)
+	}
+	if tagged[0] == dryRunDeleted {
+		return nil, nil
+	}
+	return tagged[1:], nil
+}
+
+// Has implements dbm.DB.
+func (d *dryRunDB) Has(key []byte) (bool, error) {
+	value, err := d.Get(key)
+	return value != nil, err
+}
+
+// Set implements dbm.DB.
+func (d *dryRunDB) Set(key, value []byte) error {
+	if value == nil {
+		return errors.New("value cannot be nil")
+	}
+	return d.overlay.Set(cp(key), append([]byte{dryRunSet}, value...))
+}
+
+// SetSync implements dbm.DB.
+func (d *dryRunDB) SetSync(key, value []byte) error {
+	return d.Set(key, value)
+}
+
+// Delete implements dbm.DB.
+func (d *dryRunDB) Delete(key []byte) error {
+	return d.overlay.Set(cp(key), []byte{dryRunDeleted})
+}
+
+// DeleteSync implements dbm.DB.
+func (d *dryRunDB) DeleteSync(key []byte) error {
+	return d.Delete(key)
+}
+
+// Iterator implements dbm.DB.
+func (d *dryRunDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	return d.iterator(start, end, false)
+}
+
+// ReverseIterator implements dbm.DB.
+func (d *dryRunDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	return d.iterator(start, end, true)
+}
+
+func (d *dryRunDB) iterator(start, end []byte, reverse bool) (dbm.Iterator, error) {
+	open := d.base.Iterator
+	if reverse {
+		open = d.base.ReverseIterator
+	}
+	base, err := open(start, end)
+	if err != nil {
+		return nil, err
+	}
+	open = d.overlay.Iterator
+	if reverse {
+		open = d.overlay.ReverseIterator
+	}
+	overlay, err := open(start, end)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	itr := &dryRunIterator{base: base, overlay: overlay, reverse: reverse}
+	itr.settle()
+	return itr, nil
+}
+
+// Close implements dbm.DB. The base database is left open.
+func (d *dryRunDB) Close() error {
+	return d.overlay.Close()
+}
+
+// NewBatch implements dbm.DB.
+func (d *dryRunDB) NewBatch() dbm.Batch {
+	return &dryRunBatch{db: d}
+}
+
+// Print implements dbm.DB.
+func (d *dryRunDB) Print() error {
+	return d.overlay.Print()
+}
+
+// Stats implements dbm.DB.
+func (d *dryRunDB) Stats() map[string]string {
+	return d.base.Stats()
+}
+
+// report compares the overlay with the base database.
+func (d *dryRunDB) report() (*DryRunReport, error) {
+	report := &DryRunReport{}
+	itr, err := d.overlay.Iterator(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		key, tagged := itr.Key(), itr.Value()
+		stored, err := d.base.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if tagged[0] == dryRunSet {
+			if value := tagged[1:]; !bytes.Equal(value, stored) {
+				report.Changes = append(report.Changes, BatchOp{Key: cp(key), Value: cp(value)})
+				report.BytesWritten += int64(len(key) + len(value))
+			}
+			continue
+		}
+		if stored == nil {
+			continue
+		}
+		report.Changes = append(report.Changes, BatchOp{Key: cp(key), Delete: true})
+		report.BytesFreed += int64(len(key) + len(stored))
+		switch key[0] {
+		case rootKeyFormat.prefix:
+			var version int64
+			rootKeyFormat.Scan(key, &version)
+			report.DeletedVersions = append(report.DeletedVersions, version)
+		case nodeKeyFormat.prefix:
+			report.DeletedNodes++
+		case orphanKeyFormat.prefix:
+			report.DeletedOrphans++
+		case fastKeyFormat.prefix:
+			report.DeletedFastNodes++
+		}
+	}
+	return report, itr.Error()
+}
+
+// dryRunBatch is a batch of a dryRunDB, written to its overlay.
+type dryRunBatch struct {
+	db  *dryRunDB
+	ops []BatchOp
+}
+
+// Set implements dbm.Batch.
+func (b *dryRunBatch) Set(key, value []byte) error {
+	if b.db == nil {
+		return errors.New("batch has been written or closed")
+	}
+	b.ops = append(b.ops, BatchOp{Key: key, Value: value})
+	return nil
+}
+
+// Delete implements dbm.Batch.
+func (b *dryRunBatch) Delete(key []byte) error {
+	if b.db == nil {
+		return errors.New("batch has been written or closed")
+	}
+	b.ops = append(b.ops, BatchOp{Key: key, Delete: true})
+	return nil
+}
+
+// Write implements dbm.Batch.
+func (b *dryRunBatch) Write() error {
+	if b.db == nil {
+		return errors.New("batch has been written or closed")
+	}
+	for _, op := range b.ops {
+		var err error
+		if op.Delete {
+			err = b.db.Delete(op.Key)
+		} else {
+			err = b.db.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.Close()
+}
+
+// WriteSync implements dbm.Batch.
+func (b *dryRunBatch) WriteSync() error {
+	return b.Write()
+}
+
+// Close implements dbm.Batch.
+func (b *dryRunBatch) Close() error {
+	b.db, b.ops = nil, nil
+	return nil
+}
+
+// dryRunIterator merges an iterator of the base database of a dryRunDB with one of its overlay,
+// in which deleted keys are skipped.
+type dryRunIterator struct {
+	base    dbm.Iterator
+	overlay dbm.Iterator
+	reverse bool
+}
+
+var _ dbm.Iterator = (*dryRunIterator)(nil)
+
+// compare compares the keys of the base and overlay iterators, which must both be valid, in
+// iteration order.
+func (itr *dryRunIterator) compare() int {
+	c := bytes.Compare(itr.base.Key(), itr.overlay.Key())
+	if itr.reverse {
+		return -c
+	}
+	return c
+}
+
+// settle skips base entries shadowed by the overlay and deleted overlay entries, such that the
+// next entry of either iterator is visible.
+func (itr *dryRunIterator) settle() {
+	for itr.overlay.Valid() {
+		if itr.base.Valid() {
+			c := itr.compare()
+			if c < 0 {
+				return
+			}
+			if c == 0 {
+				itr.base.Next()
+				continue
+			}
+		}
+		if itr.overlay.Value()[0] == dryRunSet {
+			return
+		}
+		itr.overlay.Next()
+	}
+}
+
+// fromBase returns true if the current entry is from the base iterator.
+func (itr *dryRunIterator) fromBase() bool {
+	return itr.base.Valid() && (!itr.overlay.Valid() || itr.compare() < 0)
+}
+
+// Domain implements dbm.Iterator.
+func (itr *dryRunIterator) Domain() ([]byte, []byte) {
+	return itr.base.Domain()
+}
+
+// Valid implements dbm.Iterator.
+func (itr *dryRunIterator) Valid() bool {
+	return itr.base.Valid() || itr.overlay.Valid()
+}
+
+// Next implements dbm.Iterator.
+func (itr *dryRunIterator) Next() {
+	if !itr.Valid() {
+		panic("iterator is invalid")
+	}
+	if itr.fromBase() {
+		itr.base.Next()
+	} else {
+		itr.overlay.Next()
+	}
+	itr.settle()
+}
+
+// Key implements dbm.Iterator.
+func (itr *dryRunIterator) Key() []byte {
+	if itr.fromBase() {
+		return itr.base.Key()
+	}
+	return itr.overlay.Key()
+}
+
+// Value implements dbm.Iterator.
+func (itr *dryRunIterator) Value() []byte {
+	if itr.fromBase() {
+		return itr.base.Value()
+	}
+	return itr.overlay.Value()[1:]
+}
+
+// Error implements dbm.Iterator.
+func (itr *dryRunIterator) Error() error {
+	if err := itr.base.Error(); err != nil {
+		return err
+	}
+	return itr.overlay.Error()
+}
+
+// Close implements dbm.Iterator.
+func (itr *dryRunIterator) Close() error {
+	err := itr.base.Close()
+	if overlayErr := itr.overlay.Close(); err == nil {
+		err = overlayErr
+	}
+	return err
+}
+
+// dryRunTier is a cold tier which keeps all writes in memory, on top of a tier which is only read,
+// see Options.DryRun.
+type dryRunTier struct {
+	base    Tier
+	mtx     sync.Mutex
+	values  map[string][]byte // nil for deleted nodes
+	sets    int
+	deletes int
+}
+
+var _ Tier = (*dryRunTier)(nil)
+
+func newDryRunTier(base Tier) *dryRunTier {
+	return &dryRunTier{base: base, values: map[string][]byte{}}
+}
+
+// Get implements Tier.
+func (t *dryRunTier) Get(hash []byte) ([]byte, error) {
+	t.mtx.Lock()
+	value, ok := t.values[string(hash)]
+	t.mtx.Unlock()
+	if ok {
+		return value, nil
+	}
+	return t.base.Get(hash)
+}
+
+// Set implements Tier.
+func (t *dryRunTier) Set(hash, value []byte) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.values[string(hash)] = cp(value)
+	t.sets++
+	return nil
+}
+
+// Delete implements Tier.
+func (t *dryRunTier) Delete(hash []byte) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.values[string(hash)] = nil
+	t.deletes++
+	return nil
+}
+
+// counts returns the number of nodes set and deleted.
+func (t *dryRunTier) counts() (int, int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.sets, t.deletes
+}
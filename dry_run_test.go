@@ -0,0 +1,107 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestDryRunDB_Iterator(t *testing.T) {
+	base := db.NewMemDB()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, base.Set([]byte(key), []byte("base-"+key)))
+	}
+	d := newDryRunDB(base)
+	require.NoError(t, d.Delete([]byte("a")))
+	require.NoError(t, d.Set([]byte("b"), []byte("new-b")))
+	require.NoError(t, d.Set([]byte("bb"), []byte("new-bb")))
+	require.NoError(t, d.Delete([]byte("c")))
+	require.NoError(t, d.Delete([]byte("x")))
+	batch := d.NewBatch()
+	require.NoError(t, batch.Set([]byte("e"), []byte("new-e")))
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	require.Equal(t, map[string]string{"b": "new-b", "bb": "new-bb", "d": "base-d", "e": "new-e"}, dumpPrefix(t, d, nil))
+	require.Len(t, dumpPrefix(t, base, nil), 4)
+	itr, err := d.ReverseIterator([]byte("b"), []byte("e"))
+	require.NoError(t, err)
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, []string{"d", "bb", "b"}, keys)
+	value, err := d.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+func TestDryRun(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 10; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%d", (v*3+i)%15)), []byte(fmt.Sprintf("v%d", v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, err = tree.DryRunReport()
+	require.Error(t, err)
+
+	for name, tc := range map[string]struct {
+		op       func(*MutableTree) error
+		versions []int64
+	}{
+		"DeleteVersionsRange": {func(tree *MutableTree) error {
+			return tree.DeleteVersionsRange(1, 3)
+		}, []int64{1, 2}},
+		"LoadVersionForOverwriting": {func(tree *MutableTree) error {
+			_, err := tree.LoadVersionForOverwriting(3)
+			return err
+		}, []int64{4, 5}},
+	} {
+		op := tc.op
+		t.Run(name, func(t *testing.T) {
+			before := dumpPrefix(t, memDB, nil)
+			dryTree, err := NewMutableTreeWithOpts(memDB, 0, &Options{DryRun: true})
+			require.NoError(t, err)
+			_, err = dryTree.Load()
+			require.NoError(t, err)
+			require.NoError(t, op(dryTree))
+			report, err := dryTree.DryRunReport()
+			require.NoError(t, err)
+			require.Equal(t, before, dumpPrefix(t, memDB, nil))
+			require.Equal(t, tc.versions, report.DeletedVersions)
+			require.NotZero(t, report.DeletedNodes)
+			require.NotZero(t, report.BytesFreed)
+
+			// Applying the reported changes has the same effect as the operation.
+			previewed := db.NewMemDB()
+			for k, v := range before {
+				require.NoError(t, previewed.Set([]byte(k), []byte(v)))
+			}
+			for _, change := range report.Changes {
+				if change.Delete {
+					require.NoError(t, previewed.Delete(change.Key))
+				} else {
+					require.NoError(t, previewed.Set(change.Key, change.Value))
+				}
+			}
+			actual := db.NewMemDB()
+			for k, v := range before {
+				require.NoError(t, actual.Set([]byte(k), []byte(v)))
+			}
+			tree, err := NewMutableTree(actual, 0)
+			require.NoError(t, err)
+			_, err = tree.Load()
+			require.NoError(t, err)
+			require.NoError(t, op(tree))
+			require.Equal(t, dumpPrefix(t, actual, nil), dumpPrefix(t, previewed, nil))
+		})
+	}
+}
@@ -22,9 +22,53 @@ var uvarintPool = &sync.Pool{
 	},
 }
 
+// maxPooledBufferSize is the capacity above which buffers are not returned to bufferPool, to
+// avoid retaining memory after encoding e.g. a few very large values.
+const maxPooledBufferSize = 1 << 16
+
+// bufferPool holds buffers used for encoding nodes. Buffers are reset by getBuffer().
+var bufferPool = &sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// getBuffer returns an empty buffer from bufferPool. It must be returned with putBuffer() once
+// its contents are no longer referenced.
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putBuffer returns a buffer to bufferPool.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// cloneBufferBytes returns a copy of the buffer contents, which remains valid after the buffer
+// is returned to the pool.
+func cloneBufferBytes(buf *bytes.Buffer) []byte {
+	bz := make([]byte, buf.Len())
+	copy(bz, buf.Bytes())
+	return bz
+}
+
 // decodeBytes decodes a varint length-prefixed byte slice, returning it along with the number
 // of input bytes read.
 func decodeBytes(bz []byte) ([]byte, int, error) {
+	bz2, n, err := decodeBytesNoCopy(bz)
+	if err != nil {
+		return nil, n, err
+	}
+	return append(make([]byte, 0, len(bz2)), bz2...), n, nil
+}
+
+// decodeBytesNoCopy is like decodeBytes, but returns a subslice of the input instead of a copy.
+func decodeBytesNoCopy(bz []byte) ([]byte, int, error) {
 	s, n, err := decodeUvarint(bz)
 	if err != nil {
 		return nil, n, err
@@ -45,9 +89,7 @@ func decodeBytes(bz []byte) ([]byte, int, error) {
 	if len(bz) < end {
 		return nil, n, fmt.Errorf("insufficient bytes decoding []byte of length %v", size)
 	}
-	bz2 := make([]byte, size)
-	copy(bz2, bz[n:end])
-	return bz2, end, nil
+	return bz[n:end:end], end, nil
 }
 
 // decodeUvarint decodes a varint-encoded unsigned integer from a byte slice, returning it and the
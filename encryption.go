@@ -0,0 +1,125 @@
+package iavl
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// EncryptionProvider encrypts node and fast node values before they are written to the
+// database, see Options.Encryption. Keys, such as node hashes and fast node keys, are not
+// encrypted since they are needed for lookups and iteration.
+type EncryptionProvider interface {
+	// KeyVersion returns the version of the key used to encrypt new values. It is stored as the
+	// first byte of every encrypted value, so that values encrypted with earlier keys can still
+	// be decrypted after the key is rotated.
+	KeyVersion() byte
+
+	// Encrypt encrypts a value with the key of the given version.
+	Encrypt(keyVersion byte, plaintext []byte) ([]byte, error)
+
+	// Decrypt decrypts a value encrypted with the key of the given version.
+	Decrypt(keyVersion byte, ciphertext []byte) ([]byte, error)
+}
+
+// AESGCMEncryption is an EncryptionProvider using AES-GCM with random nonces.
+type AESGCMEncryption struct {
+	current byte
+	aeads   map[byte]cipher.AEAD
+}
+
+var _ EncryptionProvider = (*AESGCMEncryption)(nil)
+
+// NewAESGCMEncryption creates an AES-GCM EncryptionProvider from a set of 16, 24 or 32 byte AES
+// keys by version. New values are encrypted with the key of the current version, while the other
+// keys are kept to decrypt values written before a rotation.
+func NewAESGCMEncryption(current byte, keys map[byte][]byte) (*AESGCMEncryption, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, errors.Errorf("no key for current key version %v", current)
+	}
+	aeads := make(map[byte]cipher.AEAD, len(keys))
+	for version, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid key version %v", version)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[version] = aead
+	}
+	return &AESGCMEncryption{current: current, aeads: aeads}, nil
+}
+
+// KeyVersion implements EncryptionProvider.
+func (e *AESGCMEncryption) KeyVersion() byte {
+	return e.current
+}
+
+// Encrypt implements EncryptionProvider. The nonce is prepended to the ciphertext.
+func (e *AESGCMEncryption) Encrypt(keyVersion byte, plaintext []byte) ([]byte, error) {
+	aead, ok := e.aeads[keyVersion]
+	if !ok {
+		return nil, errors.Errorf("unknown key version %v", keyVersion)
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt implements EncryptionProvider.
+func (e *AESGCMEncryption) Decrypt(keyVersion byte, ciphertext []byte) ([]byte, error) {
+	aead, ok := e.aeads[keyVersion]
+	if !ok {
+		return nil, errors.Errorf("unknown key version %v", keyVersion)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// encryptValue encrypts a node or fast node value with Options.Encryption, prefixed by the key
+// version, and appends its checksum with Options.Checksums. The value is returned as is if both
+// are disabled.
+func (ndb *nodeDB) encryptValue(bz []byte) ([]byte, error) {
+	enc := ndb.opts.Encryption
+	if enc == nil {
+		return ndb.appendChecksum(bz), nil
+	}
+	keyVersion := enc.KeyVersion()
+	ciphertext, err := enc.Encrypt(keyVersion, bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "encrypting value")
+	}
+	return ndb.appendChecksum(append([]byte{keyVersion}, ciphertext...)), nil
+}
+
+// decryptValue verifies the checksum of a value written by encryptValue, returning an error
+// matching ErrChecksumMismatch if it was corrupted, and decrypts it. Nil values, i.e. missing
+// entries, are returned as is.
+func (ndb *nodeDB) decryptValue(bz []byte) ([]byte, error) {
+	bz, err := ndb.verifyChecksum(bz)
+	if err != nil {
+		return nil, err
+	}
+	enc := ndb.opts.Encryption
+	if enc == nil || bz == nil {
+		return bz, nil
+	}
+	if len(bz) == 0 {
+		return nil, errors.New("encrypted value has no key version")
+	}
+	plaintext, err := enc.Decrypt(bz[0], bz[1:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypting value with key version %v", bz[0])
+	}
+	return plaintext, nil
+}
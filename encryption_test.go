@@ -0,0 +1,87 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestAESGCMEncryption(t *testing.T) {
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+
+	_, err := NewAESGCMEncryption(3, map[byte][]byte{1: key1})
+	require.Error(t, err)
+	_, err = NewAESGCMEncryption(1, map[byte][]byte{1: []byte("short")})
+	require.Error(t, err)
+
+	enc, err := NewAESGCMEncryption(1, map[byte][]byte{1: key1})
+	require.NoError(t, err)
+	ciphertext, err := enc.Encrypt(enc.KeyVersion(), []byte("value"))
+	require.NoError(t, err)
+	require.NotContains(t, string(ciphertext), "value")
+
+	// After a rotation, values encrypted with the previous key can still be decrypted.
+	rotated, err := NewAESGCMEncryption(2, map[byte][]byte{1: key1, 2: key2})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, rotated.KeyVersion())
+	plaintext, err := rotated.Decrypt(1, ciphertext)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), plaintext)
+
+	_, err = rotated.Decrypt(2, ciphertext)
+	require.Error(t, err)
+	_, err = enc.Decrypt(2, ciphertext)
+	require.Error(t, err)
+}
+
+func TestEncryption_Tree(t *testing.T) {
+	key1, key2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	enc, err := NewAESGCMEncryption(1, map[byte][]byte{1: key1})
+	require.NoError(t, err)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Encryption: enc})
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("secret-a"))
+	tree.Set([]byte("b"), []byte("secret-b"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Neither nodes nor fast nodes are stored in plaintext.
+	for _, value := range dumpPrefix(t, memDB, nil) {
+		require.NotContains(t, value, "secret")
+	}
+
+	// Rotate the key, and write a new version with it.
+	rotated, err := NewAESGCMEncryption(2, map[byte][]byte{1: key1, 2: key2})
+	require.NoError(t, err)
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Encryption: rotated})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret-a"), tree.Get([]byte("a")))
+	tree.Set([]byte("c"), []byte("secret-c"))
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	bz, err := memDB.Get(tree.ndb.fastNodeKey([]byte("c")))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, bz[0])
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Encryption: rotated})
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(version)
+	require.NoError(t, err)
+	var values []string
+	tree.Iterate(func(key, value []byte) bool {
+		values = append(values, string(value))
+		return false
+	})
+	require.Equal(t, []string{"secret-a", "secret-b", "secret-c"}, values)
+	itree, err := tree.GetImmutable(version - 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret-b"), itree.Get([]byte("b")))
+	require.Nil(t, itree.Get([]byte("c")))
+}
@@ -0,0 +1,269 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// expiryIndexPrefix prefixes the keys of the expiry index in the metadata keyspace. It is
+	// followed by the big-endian expiry version and the tree key, so that expired keys can be
+	// found with a range scan.
+	expiryIndexPrefix = "expiry/"
+
+	// expiryKeyPrefix prefixes the reverse expiry index from tree keys to their big-endian expiry
+	// version in the metadata keyspace. Since entries of the expiry index aren't deleted when a
+	// key is updated, an entry is only valid if it matches the reverse entry.
+	expiryKeyPrefix = "expiry_key/"
+
+	// expiryUndoPrefix prefixes the expiry changes made by each version in the metadata keyspace,
+	// so that they can be rolled back when the version is deleted by DeleteVersionsFrom. It is
+	// followed by the big-endian version and the tree key, and the value is the big-endian
+	// previous and new expiry versions of the key, 0 if it had none.
+	expiryUndoPrefix = "expiry_undo/"
+)
+
+func expiryIndexKey(expiry int64, key []byte) []byte {
+	bz := make([]byte, 0, len(expiryIndexPrefix)+int64Size+len(key))
+	bz = append(bz, expiryIndexPrefix...)
+	bz = append(bz, formatUint64(uint64(expiry))...)
+	return metadataKeyFormat.Key(append(bz, key...))
+}
+
+func expiryKeyKey(key []byte) []byte {
+	bz := make([]byte, 0, len(expiryKeyPrefix)+len(key))
+	bz = append(bz, expiryKeyPrefix...)
+	return metadataKeyFormat.Key(append(bz, key...))
+}
+
+func expiryUndoKey(version int64, key []byte) []byte {
+	bz := make([]byte, 0, len(expiryUndoPrefix)+int64Size+len(key))
+	bz = append(bz, expiryUndoPrefix...)
+	bz = append(bz, formatUint64(uint64(version))...)
+	return metadataKeyFormat.Key(append(bz, key...))
+}
+
+// getExpiry returns the persisted expiry version of the key, or 0 if it has none.
+func (ndb *nodeDB) getExpiry(key []byte) (int64, error) {
+	bz, err := ndb.db.Get(expiryKeyKey(key))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	if len(bz) != int64Size {
+		return 0, errors.Errorf("invalid expiry for key %X: %X", key, bz)
+	}
+	return int64(binary.BigEndian.Uint64(bz)), nil
+}
+
+// setExpiry writes the expiry version of the key to the batch, or clears it if expiry is 0.
+func (ndb *nodeDB) setExpiry(key []byte, expiry int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.setExpiryUnlocked(key, expiry)
+}
+
+// setExpiryUnlocked is like setExpiry, but doesn't lock.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) setExpiryUnlocked(key []byte, expiry int64) error {
+	if expiry == 0 {
+		return ndb.batch.Delete(expiryKeyKey(key))
+	}
+	if err := ndb.batch.Set(expiryIndexKey(expiry, key), []byte{}); err != nil {
+		return err
+	}
+	return ndb.batch.Set(expiryKeyKey(key), formatUint64(uint64(expiry)))
+}
+
+// logExpiryChange records in the batch that the given version changed the expiry of the key from
+// previous to expiry, see expiryUndoPrefix.
+func (ndb *nodeDB) logExpiryChange(version int64, key []byte, previous, expiry int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	value := append(formatUint64(uint64(previous)), formatUint64(uint64(expiry))...)
+	return ndb.batch.Set(expiryUndoKey(version, key), value)
+}
+
+// deleteExpiriesFrom rolls back the expiry changes made by the given version and later ones in
+// the batch, restoring the expiries of the keys as of the previous version.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteExpiriesFrom(version int64) error {
+	var keys []string
+	restored := map[string]int64{}
+	prefixLen := len(expiryUndoKey(0, nil))
+	err := ndb.traverseRange(expiryUndoKey(version, nil), expiryUndoKey(math.MaxInt64, nil), func(k, v []byte) error {
+		if len(v) != 2*int64Size {
+			return errors.Errorf("invalid expiry undo entry %X", v)
+		}
+		key := k[prefixLen:]
+		if expiry := int64(binary.BigEndian.Uint64(v[int64Size:])); expiry != 0 {
+			if err := ndb.batch.Delete(expiryIndexKey(expiry, key)); err != nil {
+				return err
+			}
+		}
+		// The earliest change of a key holds its expiry as of the previous version.
+		if _, ok := restored[string(key)]; !ok {
+			keys = append(keys, string(key))
+			restored[string(key)] = int64(binary.BigEndian.Uint64(v[:int64Size]))
+		}
+		return ndb.batch.Delete(k)
+	})
+	if err != nil {
+		return err
+	}
+	// The index entries of restored expiries may have been deleted above or purged, so they are
+	// written again after the deletes.
+	for _, key := range keys {
+		if err := ndb.setExpiryUnlocked([]byte(key), restored[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExpiryUndo deletes the expiry changes made by versions before toVersion when pruning the
+// versions in [fromVersion, toVersion) leaves no earlier version, since they can no longer be
+// rolled back.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteExpiryUndo(fromVersion, toVersion int64) error {
+	previous, err := ndb.getPreviousVersion(fromVersion)
+	if err != nil || previous != 0 {
+		return err
+	}
+	return ndb.traverseRange(expiryUndoKey(0, nil), expiryUndoKey(toVersion, nil), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+}
+
+// deleteExpiryIndexEntries deletes the given expiry index keys in the batch.
+func (ndb *nodeDB) deleteExpiryIndexEntries(keys [][]byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	for _, key := range keys {
+		if err := ndb.batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// traverseExpiryIndex calls fn with the persisted expiry index entries with an expiry version up
+// to and including the given version, ordered by expiry version.
+func (ndb *nodeDB) traverseExpiryIndex(version int64, fn func(expiry int64, key []byte) error) error {
+	prefixLen := len(expiryIndexKey(0, nil)) - int64Size
+	return ndb.traverseRange(expiryIndexKey(0, nil), expiryIndexKey(version+1, nil), func(k, v []byte) error {
+		expiry := int64(binary.BigEndian.Uint64(k[prefixLen:]))
+		return fn(expiry, k[prefixLen+int64Size:])
+	})
+}
+
+// SetWithExpiry sets a key in the working tree like Set, and schedules it to be removed when
+// the given version is saved, i.e. the key does not exist in that version. Setting or removing
+// the key again clears the expiry. It requires Options.Expiry.
+//
+// Expiries are not recorded in the journal. The expiry changes of versions deleted by
+// DeleteVersionsFrom, e.g. when loading a version for overwriting, are rolled back.
+func (tree *MutableTree) SetWithExpiry(key, value []byte, expiry int64) (updated bool, err error) {
+	if !tree.ndb.opts.Expiry {
+		return false, errors.New("expiry index is disabled, see Options.Expiry")
+	}
+	if expiry <= tree.version {
+		return false, errors.Errorf("expiry version %v is not after the latest version %v", expiry, tree.version)
+	}
+	updated = tree.Set(key, value)
+	tree.pendingExpiries[string(key)] = expiry
+	return updated, nil
+}
+
+// GetExpiry returns the version at which the key expires in the working tree, or 0 if it has no
+// expiry.
+func (tree *MutableTree) GetExpiry(key []byte) (int64, error) {
+	if expiry, ok := tree.pendingExpiries[string(key)]; ok {
+		return expiry, nil
+	}
+	if !tree.ndb.opts.Expiry {
+		return 0, nil
+	}
+	return tree.ndb.getExpiry(key)
+}
+
+// clearExpiry clears the expiry of a key which is set or removed, if the expiry index is enabled.
+func (tree *MutableTree) clearExpiry(key []byte) {
+	if tree.ndb.opts.Expiry {
+		tree.pendingExpiries[string(key)] = 0
+	}
+}
+
+// PurgeExpired removes all keys from the working tree which expire at or before the given
+// version, and returns the number of keys removed. With Options.Expiry, SaveVersion does this
+// automatically for the version being saved.
+func (tree *MutableTree) PurgeExpired(version int64) (int, error) {
+	if !tree.ndb.opts.Expiry {
+		return 0, errors.New("expiry index is disabled, see Options.Expiry")
+	}
+
+	var expired [][]byte
+	err := tree.ndb.traverseExpiryIndex(version, func(expiry int64, key []byte) error {
+		tree.purgedExpiries = append(tree.purgedExpiries, expiryIndexKey(expiry, key))
+		if _, ok := tree.pendingExpiries[string(key)]; ok {
+			return nil // handled below
+		}
+		current, err := tree.ndb.getExpiry(key)
+		if err != nil {
+			return err
+		}
+		if current == expiry {
+			expired = append(expired, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for key, expiry := range tree.pendingExpiries {
+		if expiry > 0 && expiry <= version {
+			expired = append(expired, []byte(key))
+		}
+	}
+
+	// Remove keys in order, so that the resulting tree doesn't depend on map iteration order.
+	sort.Slice(expired, func(i, j int) bool {
+		return bytes.Compare(expired[i], expired[j]) < 0
+	})
+	removed := 0
+	for _, key := range expired {
+		if _, ok := tree.Remove(key); ok {
+			removed++
+		}
+		tree.pendingExpiries[string(key)] = 0
+	}
+	return removed, nil
+}
+
+// saveExpiries writes the pending expiry changes of the working tree to the batch, along with
+// their undo entries for the given version. Expiries which don't change, e.g. those cleared by
+// setting or removing keys without one, are skipped, to avoid writes for every key.
+func (tree *MutableTree) saveExpiries(version int64) error {
+	if err := tree.ndb.deleteExpiryIndexEntries(tree.purgedExpiries); err != nil {
+		return err
+	}
+	for key, expiry := range tree.pendingExpiries {
+		persisted, err := tree.ndb.getExpiry([]byte(key))
+		if err != nil {
+			return err
+		}
+		if persisted == expiry {
+			continue
+		}
+		if err := tree.ndb.setExpiry([]byte(key), expiry); err != nil {
+			return err
+		}
+		if err := tree.ndb.logExpiryChange(version, []byte(key), persisted, expiry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
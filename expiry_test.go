@@ -0,0 +1,173 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestExpiry(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Expiry: true})
+	require.NoError(t, err)
+
+	tree.Set([]byte("permanent"), []byte{1})
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{1}, 2)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("b"), []byte{1}, 3)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("c"), []byte{1}, 3)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("d"), []byte{1}, 1) // expires in the version being saved
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.False(t, tree.Has([]byte("d")))
+
+	_, err = tree.SetWithExpiry([]byte("e"), []byte{1}, 1)
+	require.Error(t, err)
+
+	expiry, err := tree.GetExpiry([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, expiry)
+
+	// Updating c clears its expiry, and extending b moves it.
+	tree.Set([]byte("c"), []byte{2})
+	_, err = tree.SetWithExpiry([]byte("b"), []byte{2}, 4)
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.False(t, tree.Has([]byte("a")))
+	require.True(t, tree.Has([]byte("b")))
+
+	// Reload to check that the index is persisted.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{Expiry: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	expiry, err = tree.GetExpiry([]byte("c"))
+	require.NoError(t, err)
+	require.Zero(t, expiry)
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.True(t, tree.Has([]byte("b")))
+	require.True(t, tree.Has([]byte("c")))
+
+	removed, err := tree.PurgeExpired(4)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	require.False(t, tree.Has([]byte("b")))
+	tree.Rollback()
+	require.True(t, tree.Has([]byte("b")))
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.False(t, tree.Has([]byte("b")))
+	require.True(t, tree.Has([]byte("c")))
+	require.True(t, tree.Has([]byte("permanent")))
+	require.EqualValues(t, 2, tree.Size())
+
+	// The index is emptied once all entries are processed.
+	count := 0
+	err = tree.ndb.traverseExpiryIndex(1<<62, func(expiry int64, key []byte) error {
+		count++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Zero(t, count)
+	removed, err = tree.PurgeExpired(100)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func TestExpiry_Disabled(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{1}, 2)
+	require.Error(t, err)
+	_, err = tree.PurgeExpired(2)
+	require.Error(t, err)
+}
+
+func TestExpiry_SaveVersion(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Expiry: true})
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{1}, 2)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Writing keys without an expiry doesn't touch the expiry index.
+	tree.Set([]byte("b"), []byte{1})
+	tree.ndb.startReplication()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for _, op := range tree.ndb.takeReplicated() {
+		require.NotEqual(t, expiryKeyKey([]byte("b")), op.Key)
+	}
+	require.False(t, tree.Has([]byte("a")))
+
+	// Failing to save an existing version doesn't purge the working tree.
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	tree.Set([]byte("c"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	var existsErr *VersionExistsError
+	require.ErrorAs(t, err, &existsErr)
+	require.True(t, tree.Has([]byte("a")))
+}
+
+func TestExpiry_Rollback(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Expiry: true})
+	require.NoError(t, err)
+	saveVersion := func() {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{1}, 5)
+	require.NoError(t, err)
+	saveVersion()
+	_, err = tree.SetWithExpiry([]byte("a"), []byte{2}, 10)
+	require.NoError(t, err)
+	_, err = tree.SetWithExpiry([]byte("b"), []byte{1}, 3)
+	require.NoError(t, err)
+	saveVersion()
+	saveVersion()
+	require.False(t, tree.Has([]byte("b")))
+
+	// Rolling back the purge of a key restores its expiry, so it is purged again.
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.NoError(t, err)
+	require.True(t, tree.Has([]byte("b")))
+	expiry, err := tree.GetExpiry([]byte("b"))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, expiry)
+	saveVersion()
+	require.False(t, tree.Has([]byte("b")))
+
+	// Rolling back the versions which set expiries restores the previous ones.
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	expiry, err = tree.GetExpiry([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, expiry)
+	expiry, err = tree.GetExpiry([]byte("b"))
+	require.NoError(t, err)
+	require.Zero(t, expiry)
+	require.Equal(t, 1, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(expiryIndexPrefix))))
+	for i := 0; i < 3; i++ {
+		saveVersion()
+	}
+	require.True(t, tree.Has([]byte("a")))
+	saveVersion()
+	require.False(t, tree.Has([]byte("a")))
+
+	// Changes which can't be rolled back anymore are deleted by pruning.
+	require.Equal(t, 2, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(expiryUndoPrefix))))
+	require.NoError(t, tree.DeleteVersionsRange(1, 5))
+	require.Equal(t, 1, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(expiryUndoPrefix))))
+}
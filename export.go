@@ -22,35 +22,85 @@ type ExportNode struct {
 	Height  int8
 }
 
+// ExportOrder is the order in which an Exporter yields nodes.
+type ExportOrder int
+
+const (
+	// ExportPostOrder exports nodes depth-first post-order (LRN), such that children precede their
+	// parents. This is the order required by MutableTree.Import().
+	ExportPostOrder ExportOrder = iota
+
+	// ExportInOrder exports nodes depth-first in-order (LNR), such that keys are sorted and each
+	// inner node follows its left subtree, e.g. for audits verifying key ranges. These exports
+	// can't be imported.
+	ExportInOrder
+)
+
 // Exporter exports nodes from an ImmutableTree. It is created by ImmutableTree.Export().
 //
 // Exported nodes can be imported into an empty tree with MutableTree.Import(). Nodes are exported
 // depth-first post-order (LRN), this order must be preserved when importing in order to recreate
-// the same tree structure.
+// the same tree structure. ImmutableTree.ExportWithOrder() can export nodes in-order instead.
 type Exporter struct {
 	tree   *ImmutableTree
 	ch     chan *ExportNode
 	cancel context.CancelFunc
+	order  ExportOrder
+	err    error // snapshot or context error, returned by Next()
+
+	untrack func() // unregisters the exporter from the nodeDB, see nodeDB.Close
+
+	// Attestation state, see Attest().
+	version  int64
+	rootHash []byte
+	digest   *exportDigest
+	done     bool
+
+	// Chunk state, see NextChunk().
+	chunkHashes  [][]byte
+	chunkedNodes int64
 }
 
 // NewExporter creates a new Exporter. Callers must call Close() when done.
-func newExporter(tree *ImmutableTree) *Exporter {
-	ctx, cancel := context.WithCancel(context.Background())
+func newExporter(parent context.Context, tree *ImmutableTree, order ExportOrder) *Exporter {
+	ctx, cancel := context.WithCancel(parent)
 	exporter := &Exporter{
-		tree:   tree,
-		ch:     make(chan *ExportNode, exportBufferSize),
-		cancel: cancel,
+		tree:     tree,
+		ch:       make(chan *ExportNode, exportBufferSize),
+		cancel:   cancel,
+		order:    order,
+		version:  tree.version,
+		rootHash: tree.Hash(),
+		digest:   newExportDigest(),
 	}
 
 	tree.ndb.incrVersionReaders(tree.version)
-	go exporter.export(ctx)
+	exporter.untrack = tree.ndb.resources.track(exporter.Close)
+
+	// Read from a database snapshot if supported, so the export sees a consistent view.
+	snapshot, err := tree.ndb.snapshot()
+	if err != nil {
+		exporter.err = errors.Wrap(err, "taking database snapshot")
+		close(exporter.ch)
+		return exporter
+	}
+	go exporter.export(ctx, parent, snapshot)
 
 	return exporter
 }
 
-// export exports nodes
-func (e *Exporter) export(ctx context.Context) {
-	e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
+// export exports nodes, reading them from the snapshot if non-nil. It stops when ctx is done,
+// recording the error if the parent context is done rather than the exporter closed.
+func (e *Exporter) export(ctx, parent context.Context, snapshot DBSnapshot) {
+	defer close(e.ch)
+	t := e.tree.root.newTraversal(e.tree, nil, nil, true, false, e.order == ExportPostOrder)
+	throttle := e.tree.ndb.throttle
+	t.inOrder = e.order == ExportInOrder
+	if snapshot != nil {
+		defer snapshot.Close()
+		t.useSnapshot(snapshot)
+	}
+	for node := t.next(); node != nil; node = t.next() {
 		exportNode := &ExportNode{
 			Key:     node.key,
 			Value:   node.value,
@@ -60,22 +110,47 @@ func (e *Exporter) export(ctx context.Context) {
 
 		select {
 		case e.ch <- exportNode:
-			return false
 		case <-ctx.Done():
-			return true
+			e.err = parent.Err()
+			return
+		}
+		if throttle != nil {
+			throttle.charge(1, len(node.key)+len(node.value))
+			if throttle.wait(ctx) != nil {
+				e.err = parent.Err()
+				return
+			}
 		}
-	})
-	close(e.ch)
+	}
 }
 
 // Next fetches the next exported node, or returns ExportDone when done.
 func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
+		e.digest.add(exportNode)
 		return exportNode, nil
 	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	e.done = e.tree != nil // not cancelled by Close()
 	return nil, ExportDone
 }
 
+// Order returns the order in which nodes are exported.
+func (e *Exporter) Order() ExportOrder {
+	return e.order
+}
+
+// checkPostOrder returns an error unless nodes are exported post-order, which is required by
+// consumers rebuilding the tree from the exported nodes.
+func (e *Exporter) checkPostOrder() error {
+	if e.order != ExportPostOrder {
+		return errors.New("only supported for post-order exports")
+	}
+	return nil
+}
+
 // Close closes the exporter. It is safe to call multiple times.
 func (e *Exporter) Close() {
 	e.cancel()
@@ -83,6 +158,7 @@ func (e *Exporter) Close() {
 	}
 	if e.tree != nil {
 		e.tree.ndb.decrVersionReaders(e.tree.version)
+		e.untrack()
 	}
 	e.tree = nil
 }
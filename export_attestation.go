@@ -0,0 +1,196 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"hash"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// attestationDomain prefixes the signed bytes of an ExportAttestation, so that signatures can't
+// be confused with signatures of other messages made with the same key.
+const attestationDomain = "iavl/export-attestation/v1"
+
+// ErrAttestationMismatch is returned when an import doesn't match its ExportAttestation.
+var ErrAttestationMismatch = errors.New("import does not match export attestation")
+
+// ExportAttestation attests to the contents of a snapshot export. It is created by
+// Exporter.Attest() once all nodes have been exported, and is checked by
+// Importer.VerifyAttestation() before committing an import, which authenticates the exported
+// nodes end-to-end regardless of how they were chunked or distributed.
+type ExportAttestation struct {
+	Version   int64
+	RootHash  []byte
+	NodeCount int64
+	LeafCount int64
+	// NodesHash is the SHA-256 hash of the exported nodes in export order, see exportDigest.
+	NodesHash []byte
+	// Metadata is arbitrary exporter metadata, e.g. the chain ID or the exporter's identity.
+	Metadata  map[string]string
+	Signature []byte
+}
+
+// AttestationSigner signs the canonical bytes of an ExportAttestation.
+type AttestationSigner func(msg []byte) ([]byte, error)
+
+// AttestationVerifier verifies a signature of the canonical bytes of an ExportAttestation,
+// returning an error if it is invalid.
+type AttestationVerifier func(msg, signature []byte) error
+
+// Ed25519Signer returns an AttestationSigner signing with an Ed25519 private key.
+func Ed25519Signer(key ed25519.PrivateKey) AttestationSigner {
+	return func(msg []byte) ([]byte, error) {
+		return ed25519.Sign(key, msg), nil
+	}
+}
+
+// Ed25519Verifier returns an AttestationVerifier verifying signatures of an Ed25519 public key.
+func Ed25519Verifier(key ed25519.PublicKey) AttestationVerifier {
+	return func(msg, signature []byte) error {
+		if !ed25519.Verify(key, msg, signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+}
+
+// SignBytes returns the canonical bytes of the attestation which are signed, i.e. all fields
+// except the signature, with the metadata sorted by key.
+func (a *ExportAttestation) SignBytes() []byte {
+	var buf bytes.Buffer
+	_ = encodeBytes(&buf, []byte(attestationDomain))
+	_ = encodeVarint(&buf, a.Version)
+	_ = encodeBytes(&buf, a.RootHash)
+	_ = encodeVarint(&buf, a.NodeCount)
+	_ = encodeVarint(&buf, a.LeafCount)
+	_ = encodeBytes(&buf, a.NodesHash)
+
+	keys := make([]string, 0, len(a.Metadata))
+	for key := range a.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	_ = encodeUvarint(&buf, uint64(len(keys)))
+	for _, key := range keys {
+		_ = encodeBytes(&buf, []byte(key))
+		_ = encodeBytes(&buf, []byte(a.Metadata[key]))
+	}
+	return buf.Bytes()
+}
+
+// Verify verifies the signature of the attestation. It does not check the attested nodes, see
+// Importer.VerifyAttestation.
+func (a *ExportAttestation) Verify(verify AttestationVerifier) error {
+	if verify == nil {
+		return errors.New("attestation verifier cannot be nil")
+	}
+	if len(a.Signature) == 0 {
+		return errors.New("attestation is not signed")
+	}
+	if err := verify(a.SignBytes(), a.Signature); err != nil {
+		return errors.Wrap(err, "invalid attestation signature")
+	}
+	return nil
+}
+
+// exportDigest accumulates the node counts and hash of an exported node stream. Each node is
+// hashed as
+//
+//	int8(height) || varint(version) || bytes(key) || bytes(value)
+//
+// where bytes are length-prefixed.
+type exportDigest struct {
+	nodes  int64
+	leaves int64
+	hash   hash.Hash
+	buf    bytes.Buffer
+}
+
+func newExportDigest() *exportDigest {
+	return &exportDigest{hash: sha256.New()}
+}
+
+func (d *exportDigest) add(node *ExportNode) {
+	d.buf.Reset()
+	d.buf.WriteByte(byte(node.Height))
+	_ = encodeVarint(&d.buf, node.Version)
+	_ = encodeBytes(&d.buf, node.Key)
+	_ = encodeBytes(&d.buf, node.Value)
+	d.hash.Write(d.buf.Bytes())
+
+	d.nodes++
+	if node.Height == 0 {
+		d.leaves++
+	}
+}
+
+func (d *exportDigest) sum() []byte {
+	return d.hash.Sum(nil)
+}
+
+// Attest returns an attestation of the exported nodes, signed with sign unless it is nil. It can
+// only be called once Next() has returned ExportDone, and only for post-order exports.
+func (e *Exporter) Attest(metadata map[string]string, sign AttestationSigner) (*ExportAttestation, error) {
+	if err := e.checkPostOrder(); err != nil {
+		return nil, err
+	}
+	if !e.done {
+		return nil, errors.New("export is not complete")
+	}
+	attestation := &ExportAttestation{
+		Version:   e.version,
+		RootHash:  e.rootHash,
+		NodeCount: e.digest.nodes,
+		LeafCount: e.digest.leaves,
+		NodesHash: e.digest.sum(),
+		Metadata:  make(map[string]string, len(metadata)),
+	}
+	for key, value := range metadata {
+		attestation.Metadata[key] = value
+	}
+	if sign != nil {
+		signature, err := sign(attestation.SignBytes())
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to sign attestation")
+		}
+		attestation.Signature = signature
+	}
+	return attestation, nil
+}
+
+// VerifyAttestation verifies the signature of the attestation, and that the nodes added so far
+// match it. It should be called after all nodes have been added, before Commit(). It can't be
+// used after Importer.AddChunksParallel().
+func (i *Importer) VerifyAttestation(attestation *ExportAttestation, verify AttestationVerifier) error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if i.digest == nil {
+		return errors.New("nodes were not hashed, since chunks were added in parallel")
+	}
+	if err := attestation.Verify(verify); err != nil {
+		return err
+	}
+
+	rootHash, err := i.rootHash()
+	if err != nil {
+		return errors.Wrap(ErrAttestationMismatch, err.Error())
+	}
+
+	switch {
+	case attestation.Version != i.version:
+		return errors.Wrapf(ErrAttestationMismatch, "version %v, expected %v", i.version, attestation.Version)
+	case attestation.NodeCount != i.digest.nodes:
+		return errors.Wrapf(ErrAttestationMismatch, "%v nodes, expected %v", i.digest.nodes, attestation.NodeCount)
+	case attestation.LeafCount != i.digest.leaves:
+		return errors.Wrapf(ErrAttestationMismatch, "%v leaves, expected %v", i.digest.leaves, attestation.LeafCount)
+	case !bytes.Equal(attestation.NodesHash, i.digest.sum()):
+		return errors.Wrap(ErrAttestationMismatch, "nodes hash differs")
+	case !bytes.Equal(attestation.RootHash, rootHash):
+		return errors.Wrapf(ErrAttestationMismatch, "root hash %X, expected %X", rootHash, attestation.RootHash)
+	}
+	return nil
+}
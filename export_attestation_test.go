@@ -0,0 +1,127 @@
+package iavl
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func exportAttested(t *testing.T, tree *ImmutableTree, sign AttestationSigner) ([]*ExportNode, *ExportAttestation) {
+	exporter := tree.Export()
+	defer exporter.Close()
+
+	_, err := exporter.Attest(nil, sign)
+	require.Error(t, err)
+
+	var nodes []*ExportNode
+	for {
+		node, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+	attestation, err := exporter.Attest(map[string]string{"chain-id": "test"}, sign)
+	require.NoError(t, err)
+	return nodes, attestation
+}
+
+func importAttested(t *testing.T, nodes []*ExportNode, attestation *ExportAttestation, verify AttestationVerifier) (*MutableTree, error) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := tree.Import(attestation.Version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for _, node := range nodes {
+		require.NoError(t, importer.Add(node))
+	}
+	if err := importer.VerifyAttestation(attestation, verify); err != nil {
+		return nil, err
+	}
+	require.NoError(t, importer.Commit())
+	return tree, nil
+}
+
+func TestExportAttestation(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPub, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	itree := setupExportTreeBasic(t)
+	nodes, attestation := exportAttested(t, itree, Ed25519Signer(priv))
+	require.Equal(t, itree.Version(), attestation.Version)
+	require.Equal(t, itree.Hash(), attestation.RootHash)
+	require.EqualValues(t, len(nodes), attestation.NodeCount)
+	require.EqualValues(t, itree.Size(), attestation.LeafCount)
+	require.NoError(t, attestation.Verify(Ed25519Verifier(pub)))
+
+	// Exporting again yields an identical attestation.
+	_, again := exportAttested(t, itree, Ed25519Signer(priv))
+	require.Equal(t, attestation, again)
+
+	tree, err := importAttested(t, nodes, attestation, Ed25519Verifier(pub))
+	require.NoError(t, err)
+	require.Equal(t, attestation.RootHash, tree.Hash())
+
+	_, err = importAttested(t, nodes, attestation, Ed25519Verifier(otherPub))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrAttestationMismatch))
+
+	// Changing any attested field invalidates the signature.
+	tampered := *attestation
+	tampered.Metadata = map[string]string{"chain-id": "other"}
+	require.Error(t, tampered.Verify(Ed25519Verifier(pub)))
+	tampered = *attestation
+	tampered.NodeCount++
+	require.Error(t, tampered.Verify(Ed25519Verifier(pub)))
+
+	unsigned := *attestation
+	unsigned.Signature = nil
+	require.Error(t, unsigned.Verify(Ed25519Verifier(pub)))
+}
+
+func TestExportAttestation_Mismatch(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	sign := Ed25519Signer(priv)
+
+	itree := setupExportTreeBasic(t)
+	nodes, attestation := exportAttested(t, itree, sign)
+
+	// A node with a different version yields the same tree shape but a different stream.
+	modified := make([]*ExportNode, len(nodes))
+	copy(modified, nodes)
+	node := *modified[0]
+	node.Version = 1
+	if nodes[0].Version == 1 {
+		node.Version = 2
+	}
+	modified[0] = &node
+	_, err = importAttested(t, modified, attestation, Ed25519Verifier(pub))
+	require.True(t, errors.Is(err, ErrAttestationMismatch))
+
+	// An attestation of another version of the tree doesn't match.
+	other := setupExportTreeRandom(t)
+	_, otherAttestation := exportAttested(t, other, sign)
+	otherAttestation.Version = attestation.Version
+	otherAttestation.Signature, err = sign(otherAttestation.SignBytes())
+	require.NoError(t, err)
+	_, err = importAttested(t, nodes, otherAttestation, Ed25519Verifier(pub))
+	require.True(t, errors.Is(err, ErrAttestationMismatch))
+}
+
+func TestExportAttestation_Closed(t *testing.T) {
+	exporter := setupExportTreeBasic(t).Export()
+	_, err := exporter.Next()
+	require.NoError(t, err)
+	exporter.Close()
+	_, err = exporter.Next()
+	require.Equal(t, ExportDone, err)
+	_, err = exporter.Attest(nil, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,163 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidChunkProof is returned when an export chunk can't be verified against a root hash.
+var ErrInvalidChunkProof = errors.New("invalid export chunk proof")
+
+// ExportSubtree summarizes an exported subtree by its root node.
+type ExportSubtree struct {
+	Hash   []byte
+	Height int8
+	Size   int64
+}
+
+// ExportProofStep is a step of ExportChunkProof.Right: either a subtree following the chunk, or
+// an ancestor of the chunk nodes which joins the subtrees before it.
+type ExportProofStep struct {
+	Subtree *ExportSubtree
+	Node    *ExportNode
+}
+
+// ExportChunkProof ties an export chunk to the root hash of the exported tree, such that chunks
+// received from untrusted peers can be verified individually before they are applied, see
+// ExportChunk.Verify.
+//
+// In depth-first post-order, the nodes preceding a chunk which have not been joined by a parent
+// yet form a stack of complete subtrees, which are given by Left. The nodes following the chunk
+// consist of the remaining ancestors of the chunk nodes and their right subtrees, which are given
+// by Right. Both have at most two entries per tree level.
+type ExportChunkProof struct {
+	Left  []*ExportSubtree
+	Right []*ExportProofStep
+}
+
+// Verify verifies that the chunk is the part of the export of the tree with the given root hash
+// that it claims to be, by building the chunk nodes on top of the preceding subtrees and joining
+// them with the following subtrees and ancestors. It also checks the chunk hash.
+func (chunk *ExportChunk) Verify(rootHash []byte) error {
+	if chunk.Proof == nil {
+		return errors.Wrap(ErrInvalidChunkProof, "chunk has no proof")
+	}
+	if hash := hashExportChunk(chunk.Nodes); !bytes.Equal(hash, chunk.Hash) {
+		return errors.Wrapf(ErrInvalidChunkProof, "chunk hash %X, expected %X", hash, chunk.Hash)
+	}
+
+	stack := make([]*Node, 0, len(chunk.Proof.Left)+8)
+	for _, subtree := range chunk.Proof.Left {
+		stack = append(stack, subtree.node())
+	}
+	add := func(exportNode *ExportNode) error {
+		node, children, err := buildImportNode(exportNode, stack)
+		if err != nil {
+			return errors.Wrap(ErrInvalidChunkProof, err.Error())
+		}
+		stack = append(stack[:len(stack)-children], node)
+		return nil
+	}
+	for _, node := range chunk.Nodes {
+		if node == nil {
+			return errors.Wrap(ErrInvalidChunkProof, "node cannot be nil")
+		}
+		if err := add(node); err != nil {
+			return err
+		}
+	}
+	for _, step := range chunk.Proof.Right {
+		switch {
+		case step.Subtree != nil && step.Node == nil:
+			stack = append(stack, step.Subtree.node())
+		case step.Node != nil && step.Subtree == nil:
+			if err := add(step.Node); err != nil {
+				return err
+			}
+		default:
+			return errors.Wrap(ErrInvalidChunkProof, "proof step must have either a subtree or a node")
+		}
+	}
+
+	if len(stack) != 1 {
+		return errors.Wrapf(ErrInvalidChunkProof, "proof yields %v subtrees, expected 1", len(stack))
+	}
+	if !bytes.Equal(stack[0].hash, rootHash) {
+		return errors.Wrapf(ErrInvalidChunkProof, "proof yields root hash %X, expected %X", stack[0].hash, rootHash)
+	}
+	return nil
+}
+
+// node returns a node standing in for the subtree when building nodes on top of it.
+func (s *ExportSubtree) node() *Node {
+	return &Node{hash: s.Hash, height: s.Height, size: s.Size}
+}
+
+func newExportSubtree(node *Node) *ExportSubtree {
+	return &ExportSubtree{Hash: node._hash(), Height: node.height, Size: node.size}
+}
+
+// exportPath returns the path from the root to the exported node with the given key and height,
+// along with whether each step descends to the right.
+func (t *ImmutableTree) exportPath(exportNode *ExportNode) ([]*Node, []bool, error) {
+	var (
+		path  []*Node
+		right []bool
+	)
+	node := t.root
+	for node != nil && node.height > exportNode.Height {
+		path = append(path, node)
+		if bytes.Compare(exportNode.Key, node.key) < 0 {
+			right = append(right, false)
+			node = node.getLeftNode(t)
+		} else {
+			right = append(right, true)
+			node = node.getRightNode(t)
+		}
+	}
+	if node == nil || node.height != exportNode.Height || !bytes.Equal(node.key, exportNode.Key) {
+		return nil, nil, errors.Errorf("exported node %X at height %v not found", exportNode.Key, exportNode.Height)
+	}
+	return append(path, node), right, nil
+}
+
+// exportChunkProof generates the proof of a chunk of nodes exported from the tree.
+func (t *ImmutableTree) exportChunkProof(nodes []*ExportNode) (*ExportChunkProof, error) {
+	proof := &ExportChunkProof{}
+
+	// The subtrees preceding the first node are the left children of the ancestors whose right
+	// subtree contains it, and its own children.
+	path, right, err := t.exportPath(nodes[0])
+	if err != nil {
+		return nil, err
+	}
+	for i, ancestor := range path[:len(path)-1] {
+		if right[i] {
+			proof.Left = append(proof.Left, newExportSubtree(ancestor.getLeftNode(t)))
+		}
+	}
+	if first := path[len(path)-1]; !first.isLeaf() {
+		proof.Left = append(proof.Left, newExportSubtree(first.getLeftNode(t)),
+			newExportSubtree(first.getRightNode(t)))
+	}
+
+	// The nodes following the last node are its ancestors, bottom-up, each preceded by its right
+	// subtree unless it contains the last node.
+	path, right, err = t.exportPath(nodes[len(nodes)-1])
+	if err != nil {
+		return nil, err
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		ancestor := path[i]
+		if !right[i] {
+			proof.Right = append(proof.Right, &ExportProofStep{Subtree: newExportSubtree(ancestor.getRightNode(t))})
+		}
+		proof.Right = append(proof.Right, &ExportProofStep{Node: &ExportNode{
+			Key:     ancestor.key,
+			Version: ancestor.version,
+			Height:  ancestor.height,
+		}})
+	}
+	return proof, nil
+}
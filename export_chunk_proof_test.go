@@ -0,0 +1,61 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportChunk_Verify(t *testing.T) {
+	trees := map[string]*ImmutableTree{
+		"basic tree":  setupExportTreeBasic(t),
+		"random tree": setupExportTreeRandom(t),
+	}
+	for desc, itree := range trees {
+		for _, size := range []int{1, 2, 7, 100, 1 << 20} {
+			itree, size := itree, size
+			t.Run(fmt.Sprintf("%v size=%v", desc, size), func(t *testing.T) {
+				chunks, _ := exportChunks(t, itree, size)
+				for _, chunk := range chunks {
+					require.NoError(t, chunk.Verify(itree.Hash()))
+				}
+			})
+		}
+	}
+}
+
+func TestExportChunk_VerifyInvalid(t *testing.T) {
+	itree := setupExportTreeRandom(t)
+	chunks, _ := exportChunks(t, itree, 50)
+	require.Greater(t, len(chunks), 2)
+	chunk := chunks[1]
+
+	require.True(t, errors.Is(chunk.Verify([]byte("foo")), ErrInvalidChunkProof))
+
+	// A chunk can't be verified with the proof of another chunk.
+	other := *chunk
+	other.Proof = chunks[2].Proof
+	require.True(t, errors.Is(other.Verify(itree.Hash()), ErrInvalidChunkProof))
+
+	// A tampered node is detected, even if the chunk hash is updated.
+	tampered := *chunk
+	tampered.Nodes = make([]*ExportNode, len(chunk.Nodes))
+	copy(tampered.Nodes, chunk.Nodes)
+	for i, node := range tampered.Nodes {
+		if node.Height == 0 {
+			leaf := *node
+			leaf.Value = []byte("tampered")
+			tampered.Nodes[i] = &leaf
+			break
+		}
+	}
+	require.True(t, errors.Is(tampered.Verify(itree.Hash()), ErrInvalidChunkProof))
+	tampered.Hash = hashExportChunk(tampered.Nodes)
+	require.True(t, errors.Is(tampered.Verify(itree.Hash()), ErrInvalidChunkProof))
+
+	noProof := *chunk
+	noProof.Proof = nil
+	require.True(t, errors.Is(noProof.Verify(itree.Hash()), ErrInvalidChunkProof))
+}
@@ -0,0 +1,345 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding"
+
+	"github.com/pkg/errors"
+)
+
+// importProgressKey is the metadata key of the progress of a chunked import, see
+// MutableTree.ImportChunks.
+const importProgressKey = "import_progress"
+
+// ErrChunkMismatch is returned when an export chunk, or the progress of a resumed import, doesn't
+// match the ExportManifest.
+var ErrChunkMismatch = errors.New("chunk does not match export manifest")
+
+// ExportChunk is a run of consecutive exported nodes, see Exporter.NextChunk.
+type ExportChunk struct {
+	Index int64
+	Nodes []*ExportNode
+	// Hash is the SHA-256 hash of the chunk nodes, encoded as for ExportAttestation.NodesHash.
+	Hash []byte
+	// Proof ties the chunk to the root hash, see Verify().
+	Proof *ExportChunkProof
+}
+
+// ExportManifest lists the hashes of all chunks of an export, in order. It is created by
+// Exporter.Manifest(), and is used by MutableTree.ImportChunks() to verify chunks before
+// applying them, and to verify already applied chunks when resuming an import.
+type ExportManifest struct {
+	Version     int64
+	RootHash    []byte
+	ChunkHashes [][]byte
+}
+
+// hashExportChunk returns the hash of the given chunk nodes.
+func hashExportChunk(nodes []*ExportNode) []byte {
+	digest := newExportDigest()
+	for _, node := range nodes {
+		digest.add(node)
+	}
+	return digest.sum()
+}
+
+// NextChunk fetches the next chunk of at most size exported nodes along with its proof, or
+// returns ExportDone when done. Nodes must either be fetched only with NextChunk() or only with
+// Next(), and Manifest() is only available in the former case. Only post-order exports can be
+// chunked.
+func (e *Exporter) NextChunk(size int) (*ExportChunk, error) {
+	if err := e.checkPostOrder(); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	chunk := &ExportChunk{
+		Index: int64(len(e.chunkHashes)),
+		Nodes: make([]*ExportNode, 0, size),
+	}
+	for len(chunk.Nodes) < size {
+		node, err := e.Next()
+		if err == ExportDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		chunk.Nodes = append(chunk.Nodes, node)
+	}
+	if len(chunk.Nodes) == 0 {
+		return nil, ExportDone
+	}
+	chunk.Hash = hashExportChunk(chunk.Nodes)
+	proof, err := e.tree.exportChunkProof(chunk.Nodes)
+	if err != nil {
+		return nil, err
+	}
+	chunk.Proof = proof
+	e.chunkHashes = append(e.chunkHashes, chunk.Hash)
+	e.chunkedNodes += int64(len(chunk.Nodes))
+	return chunk, nil
+}
+
+// Manifest returns the manifest of the exported chunks. It can only be called once NextChunk()
+// has returned ExportDone.
+func (e *Exporter) Manifest() (*ExportManifest, error) {
+	if !e.done {
+		return nil, errors.New("export is not complete")
+	}
+	if e.chunkedNodes != e.digest.nodes {
+		return nil, errors.New("nodes were not exported in chunks")
+	}
+	return &ExportManifest{
+		Version:     e.version,
+		RootHash:    e.rootHash,
+		ChunkHashes: e.chunkHashes,
+	}, nil
+}
+
+// ImportChunks starts a chunked import of the given manifest into an empty tree, or resumes a
+// previous one that was interrupted, e.g. by a crash or restart. The progress is persisted after
+// every chunk, and when resuming the hashes of the applied chunks are checked against the
+// manifest and the import continues with chunk Importer.ChunksApplied(). If they don't match,
+// ErrChunkMismatch is returned and the import must be restarted in an empty database.
+//
+// Chunks are added with Importer.AddChunk(), and Commit() checks the root hash against the
+// manifest. If AddChunk() fails, the importer must be closed and the import resumed. Chunks
+// received from untrusted peers can be verified against a trusted root hash with
+// ExportChunk.Verify() before they are added.
+func (tree *MutableTree) ImportChunks(manifest *ExportManifest) (*Importer, error) {
+	if manifest == nil {
+		return nil, errors.New("manifest cannot be nil")
+	}
+	importer, err := newImporter(tree, manifest.Version)
+	if err != nil {
+		return nil, err
+	}
+	importer.manifest = manifest
+
+	bz, err := tree.ndb.db.Get(metadataKeyFormat.Key([]byte(importProgressKey)))
+	if err != nil {
+		importer.Close()
+		return nil, err
+	}
+	if bz != nil {
+		if err = importer.restoreProgress(bz); err != nil {
+			importer.Close()
+			return nil, err
+		}
+	}
+	return importer, nil
+}
+
+// ChunksApplied returns the number of chunks applied by a chunked import, i.e. the index of the
+// next chunk to add.
+func (i *Importer) ChunksApplied() int64 {
+	return int64(len(i.chunkHashes))
+}
+
+// AddChunk verifies the chunk against the manifest and adds its nodes to a chunked import, see
+// MutableTree.ImportChunks(). Chunks must be added in order, and the progress is persisted once
+// the chunk has been added.
+func (i *Importer) AddChunk(chunk *ExportChunk) error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if i.manifest == nil {
+		return errors.New("not a chunked import")
+	}
+	if chunk == nil {
+		return errors.New("chunk cannot be nil")
+	}
+	next := i.ChunksApplied()
+	if chunk.Index != next {
+		return errors.Errorf("expected chunk %v, got chunk %v", next, chunk.Index)
+	}
+	if chunk.Index >= int64(len(i.manifest.ChunkHashes)) {
+		return errors.Wrapf(ErrChunkMismatch, "chunk %v is not in the manifest", chunk.Index)
+	}
+	hash := hashExportChunk(chunk.Nodes)
+	if !bytes.Equal(hash, i.manifest.ChunkHashes[chunk.Index]) {
+		return errors.Wrapf(ErrChunkMismatch, "chunk %v hash %X, expected %X", chunk.Index, hash,
+			i.manifest.ChunkHashes[chunk.Index])
+	}
+
+	for _, node := range chunk.Nodes {
+		if err := i.Add(node); err != nil {
+			return errors.Wrapf(err, "chunk %v", chunk.Index)
+		}
+	}
+	i.chunkHashes = append(i.chunkHashes, hash)
+	return i.saveProgress()
+}
+
+// saveProgress writes the progress of a chunked import along with any outstanding nodes.
+func (i *Importer) saveProgress() error {
+	bz, err := i.encodeProgress()
+	if err != nil {
+		return err
+	}
+	if err = i.batch.Set(metadataKeyFormat.Key([]byte(importProgressKey)), bz); err != nil {
+		return err
+	}
+	return i.flush()
+}
+
+// encodeProgress encodes the state of a chunked import: the version, the hashes of the applied
+// chunks, the hashes of the unresolved nodes on the stack and the state of the node digest, if
+// any.
+func (i *Importer) encodeProgress() ([]byte, error) {
+	var (
+		nodes, leaves int64
+		digestState   []byte
+	)
+	if i.digest != nil {
+		var err error
+		digestState, err = i.digest.hash.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		nodes, leaves = i.digest.nodes, i.digest.leaves
+	}
+
+	var buf bytes.Buffer
+	if err := encodeVarint(&buf, i.version); err != nil {
+		return nil, err
+	}
+	if err := encodeUvarint(&buf, uint64(len(i.chunkHashes))); err != nil {
+		return nil, err
+	}
+	for _, hash := range i.chunkHashes {
+		if err := encodeBytes(&buf, hash); err != nil {
+			return nil, err
+		}
+	}
+	if err := encodeUvarint(&buf, uint64(len(i.stack))); err != nil {
+		return nil, err
+	}
+	for _, node := range i.stack {
+		if err := encodeBytes(&buf, node.hash); err != nil {
+			return nil, err
+		}
+	}
+	if err := encodeVarint(&buf, nodes); err != nil {
+		return nil, err
+	}
+	if err := encodeVarint(&buf, leaves); err != nil {
+		return nil, err
+	}
+	if err := encodeBytes(&buf, digestState); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// restoreProgress restores the state of a chunked import encoded by encodeProgress, checking it
+// against the manifest and loading the stack nodes from the database.
+func (i *Importer) restoreProgress(bz []byte) error {
+	version, n, err := decodeVarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress version")
+	}
+	bz = bz[n:]
+	if version != i.version {
+		return errors.Wrapf(ErrChunkMismatch, "found import progress for version %v, expected %v",
+			version, i.version)
+	}
+
+	count, n, err := decodeUvarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress chunk count")
+	}
+	bz = bz[n:]
+	if count > uint64(len(i.manifest.ChunkHashes)) {
+		return errors.Wrapf(ErrChunkMismatch, "found %v applied chunks, manifest has %v",
+			count, len(i.manifest.ChunkHashes))
+	}
+	chunkHashes := make([][]byte, 0, count)
+	for j := uint64(0); j < count; j++ {
+		hash, n, err := decodeBytes(bz)
+		if err != nil {
+			return errors.Wrap(err, "decoding import progress chunk hash")
+		}
+		bz = bz[n:]
+		if !bytes.Equal(hash, i.manifest.ChunkHashes[j]) {
+			return errors.Wrapf(ErrChunkMismatch, "applied chunk %v hash %X, expected %X", j, hash,
+				i.manifest.ChunkHashes[j])
+		}
+		chunkHashes = append(chunkHashes, hash)
+	}
+
+	stackSize, n, err := decodeUvarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress stack size")
+	}
+	bz = bz[n:]
+	stack := make([]*Node, 0, stackSize)
+	for j := uint64(0); j < stackSize; j++ {
+		hash, n, err := decodeBytes(bz)
+		if err != nil {
+			return errors.Wrap(err, "decoding import progress stack hash")
+		}
+		bz = bz[n:]
+		buf, err := i.tree.ndb.db.Get(i.tree.ndb.nodeKey(hash))
+		if err != nil {
+			return err
+		}
+		if buf == nil {
+			return errors.Errorf("imported node %X not found", hash)
+		}
+		buf, err = i.tree.ndb.decryptValue(buf)
+		if err != nil {
+			return err
+		}
+		node, err := MakeNode(buf)
+		if err != nil {
+			return errors.Wrapf(err, "decoding imported node %X", hash)
+		}
+		node.hash = hash
+		stack = append(stack, node)
+	}
+
+	nodes, n, err := decodeVarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress node count")
+	}
+	bz = bz[n:]
+	leaves, n, err := decodeVarint(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress leaf count")
+	}
+	bz = bz[n:]
+	digestState, _, err := decodeBytes(bz)
+	if err != nil {
+		return errors.Wrap(err, "decoding import progress digest")
+	}
+	var digest *exportDigest
+	if len(digestState) > 0 {
+		digest = newExportDigest()
+		if err = digest.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(digestState); err != nil {
+			return errors.Wrap(err, "restoring import progress digest")
+		}
+		digest.nodes = nodes
+		digest.leaves = leaves
+	}
+
+	i.chunkHashes = chunkHashes
+	i.stack = stack
+	i.digest = digest
+	return nil
+}
+
+// checkManifest checks that a chunked import is complete and matches the manifest root hash, and
+// deletes the import progress. It is called by Commit().
+func (i *Importer) checkManifest(rootHash []byte) error {
+	if applied := i.ChunksApplied(); applied != int64(len(i.manifest.ChunkHashes)) {
+		return errors.Errorf("import is incomplete, applied %v of %v chunks", applied,
+			len(i.manifest.ChunkHashes))
+	}
+	if !bytes.Equal(rootHash, i.manifest.RootHash) {
+		return errors.Wrapf(ErrChunkMismatch, "root hash %X, expected %X", rootHash, i.manifest.RootHash)
+	}
+	return i.batch.Delete(metadataKeyFormat.Key([]byte(importProgressKey)))
+}
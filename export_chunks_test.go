@@ -0,0 +1,151 @@
+package iavl
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func exportChunks(t *testing.T, tree *ImmutableTree, size int) ([]*ExportChunk, *ExportManifest) {
+	exporter := tree.Export()
+	defer exporter.Close()
+
+	var chunks []*ExportChunk
+	for {
+		chunk, err := exporter.NextChunk(size)
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	manifest, err := exporter.Manifest()
+	require.NoError(t, err)
+	return chunks, manifest
+}
+
+func TestExporter_Chunks(t *testing.T) {
+	testcases := map[string]*ImmutableTree{
+		"empty tree": NewImmutableTree(db.NewMemDB(), 0),
+		"basic tree": setupExportTreeBasic(t),
+		"sized tree": setupExportTreeSized(t, 4096),
+	}
+	for desc, itree := range testcases {
+		itree := itree
+		t.Run(desc, func(t *testing.T) {
+			chunks, manifest := exportChunks(t, itree, 100)
+			require.Equal(t, itree.Version(), manifest.Version)
+			require.Equal(t, itree.Hash(), manifest.RootHash)
+			require.Len(t, manifest.ChunkHashes, len(chunks))
+
+			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(t, err)
+			importer, err := tree.ImportChunks(manifest)
+			require.NoError(t, err)
+			defer importer.Close()
+			for _, chunk := range chunks {
+				require.NoError(t, importer.AddChunk(chunk))
+			}
+			require.NoError(t, importer.Commit())
+			require.Equal(t, itree.Hash(), tree.Hash())
+			require.EqualValues(t, itree.Size(), tree.Size())
+		})
+	}
+}
+
+func TestExporter_ManifestUnchunked(t *testing.T) {
+	exporter := setupExportTreeBasic(t).Export()
+	defer exporter.Close()
+	_, err := exporter.Manifest()
+	require.Error(t, err)
+	for {
+		if _, err := exporter.Next(); err == ExportDone {
+			break
+		}
+	}
+	_, err = exporter.Manifest()
+	require.Error(t, err)
+}
+
+func TestImporter_ResumeChunks(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	itree := setupExportTreeSized(t, 4096)
+	exporter := itree.Export()
+	var chunks []*ExportChunk
+	for {
+		chunk, err := exporter.NextChunk(500)
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	manifest, err := exporter.Manifest()
+	require.NoError(t, err)
+	attestation, err := exporter.Attest(nil, Ed25519Signer(priv))
+	require.NoError(t, err)
+	exporter.Close()
+	require.Greater(t, len(chunks), 3)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err := tree.ImportChunks(manifest)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, importer.ChunksApplied())
+	for _, chunk := range chunks[:2] {
+		require.NoError(t, importer.AddChunk(chunk))
+	}
+	require.Error(t, importer.AddChunk(chunks[3]))
+	importer.Close()
+
+	// A different manifest doesn't match the applied chunks.
+	other := *manifest
+	other.ChunkHashes = append([][]byte{chunks[1].Hash}, manifest.ChunkHashes[1:]...)
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.ImportChunks(&other)
+	require.True(t, errors.Is(err, ErrChunkMismatch))
+
+	// Resuming continues after the applied chunks.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err = tree.ImportChunks(manifest)
+	require.NoError(t, err)
+	defer importer.Close()
+	require.EqualValues(t, 2, importer.ChunksApplied())
+
+	tampered := *chunks[2]
+	tampered.Nodes = tampered.Nodes[1:]
+	require.True(t, errors.Is(importer.AddChunk(&tampered), ErrChunkMismatch))
+
+	for _, chunk := range chunks[2:] {
+		require.NoError(t, importer.AddChunk(chunk))
+	}
+	require.NoError(t, importer.VerifyAttestation(attestation, Ed25519Verifier(pub)))
+	require.NoError(t, importer.Commit())
+	require.Equal(t, itree.Hash(), tree.Hash())
+
+	progress, err := memDB.Get(metadataKeyFormat.Key([]byte(importProgressKey)))
+	require.NoError(t, err)
+	require.Nil(t, progress)
+}
+
+func TestImporter_ChunksIncomplete(t *testing.T) {
+	chunks, manifest := exportChunks(t, setupExportTreeSized(t, 1024), 100)
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := tree.ImportChunks(manifest)
+	require.NoError(t, err)
+	defer importer.Close()
+	for _, chunk := range chunks[:len(chunks)-1] {
+		require.NoError(t, importer.AddChunk(chunk))
+	}
+	require.Error(t, importer.Commit())
+}
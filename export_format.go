@@ -0,0 +1,312 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is the version of the export stream format written by ExportWriter.
+//
+// Any change to the serialization of exports must bump the format version, and keep a reader for
+// the previous formats in exportFormats, so that archived snapshots can still be restored.
+const ExportFormat = 1
+
+// exportMagic starts every export stream, followed by the uvarint format version.
+const exportMagic = "IAVLEXPORT"
+
+// maxExportBytesSize is the largest key, value or hash accepted by export readers, to avoid
+// allocating excessive memory for corrupt streams.
+const maxExportBytesSize = 1 << 30
+
+// ErrUnknownExportFormat is returned when reading an export stream with an unsupported format
+// version, e.g. one written by a newer release.
+var ErrUnknownExportFormat = errors.New("unknown export format")
+
+// exportFormatReader reads the body of an export stream of a given format version.
+type exportFormatReader interface {
+	// readHeader reads the header following the format version.
+	readHeader(r *bufio.Reader) (version int64, rootHash []byte, err error)
+	// readNode reads the next node, or returns ExportDone at the end of the stream.
+	readNode(r *bufio.Reader) (*ExportNode, error)
+}
+
+// exportFormats contains readers for all supported export format versions.
+var exportFormats = map[uint64]exportFormatReader{
+	1: exportFormatV1{},
+}
+
+// exportFormatV1 is export format version 1:
+//
+//	header: varint(version) || bytes(root hash)
+//	node:   0x01 || int8(height) || varint(version) || bytes(key) || bytes(value)
+//	end:    0x00
+//
+// where bytes are uvarint length-prefixed.
+type exportFormatV1 struct{}
+
+func (exportFormatV1) readHeader(r *bufio.Reader) (int64, []byte, error) {
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, errors.Wrap(unexpectedEOF(err), "reading export version")
+	}
+	rootHash, err := readExportBytes(r)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "reading export root hash")
+	}
+	return version, rootHash, nil
+}
+
+func (exportFormatV1) readNode(r *bufio.Reader) (*ExportNode, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading export node")
+	}
+	switch marker {
+	case 0x00:
+		return nil, ExportDone
+	case 0x01:
+	default:
+		return nil, errors.Errorf("invalid export node marker %#x", marker)
+	}
+
+	height, err := r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading export node height")
+	}
+	node := &ExportNode{Height: int8(height)}
+	if node.Version, err = binary.ReadVarint(r); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading export node version")
+	}
+	if node.Key, err = readExportBytes(r); err != nil {
+		return nil, errors.Wrap(err, "reading export node key")
+	}
+	if node.Value, err = readExportBytes(r); err != nil {
+		return nil, errors.Wrap(err, "reading export node value")
+	}
+	// Inner nodes have no value, distinguish it from an empty leaf value.
+	if node.Height > 0 && len(node.Value) == 0 {
+		node.Value = nil
+	}
+	return node, nil
+}
+
+// readExportBytes reads a uvarint length-prefixed byte slice from an export stream.
+func readExportBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size > maxExportBytesSize {
+		return nil, errors.Errorf("invalid length %v", size)
+	}
+	bz := make([]byte, size)
+	if _, err = io.ReadFull(r, bz); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return bz, nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, since export streams are terminated
+// explicitly and thus never end cleanly in the middle of an item.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ExportWriter serializes exported nodes as a stream in the current ExportFormat, which can be
+// read by ExportReader, including by later releases.
+type ExportWriter struct {
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+// NewExportWriter writes the header of an export stream of the given tree version and root hash,
+// and returns a writer for its nodes. Callers must call Close() to terminate the stream.
+func NewExportWriter(w io.Writer, version int64, rootHash []byte) (*ExportWriter, error) {
+	ew := &ExportWriter{w: bufio.NewWriter(w)}
+	ew.buf.WriteString(exportMagic)
+	if err := encodeUvarint(&ew.buf, ExportFormat); err != nil {
+		return nil, err
+	}
+	if err := encodeVarint(&ew.buf, version); err != nil {
+		return nil, err
+	}
+	if err := encodeBytes(&ew.buf, rootHash); err != nil {
+		return nil, err
+	}
+	if _, err := ew.w.Write(ew.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// WriteNode writes an exported node to the stream.
+func (ew *ExportWriter) WriteNode(node *ExportNode) error {
+	if node == nil {
+		return errors.New("node cannot be nil")
+	}
+	ew.buf.Reset()
+	ew.buf.WriteByte(0x01)
+	ew.buf.WriteByte(byte(node.Height))
+	if err := encodeVarint(&ew.buf, node.Version); err != nil {
+		return err
+	}
+	if err := encodeBytes(&ew.buf, node.Key); err != nil {
+		return err
+	}
+	if err := encodeBytes(&ew.buf, node.Value); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(ew.buf.Bytes())
+	return err
+}
+
+// Close terminates the stream and flushes it to the underlying writer. It does not close the
+// underlying writer.
+func (ew *ExportWriter) Close() error {
+	if err := ew.w.WriteByte(0x00); err != nil {
+		return err
+	}
+	return ew.w.Flush()
+}
+
+// ExportReader reads an export stream written by ExportWriter in the current or any earlier
+// export format.
+type ExportReader struct {
+	r        *bufio.Reader
+	format   uint64
+	reader   exportFormatReader
+	version  int64
+	rootHash []byte
+}
+
+// NewExportReader reads the header of an export stream, returning ErrUnknownExportFormat if its
+// format is not supported.
+func NewExportReader(r io.Reader) (*ExportReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading export header")
+	}
+	if string(magic) != exportMagic {
+		return nil, errors.New("not an export stream")
+	}
+	format, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading export format")
+	}
+	reader, ok := exportFormats[format]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownExportFormat, "format %v", format)
+	}
+	version, rootHash, err := reader.readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &ExportReader{
+		r:        br,
+		format:   format,
+		reader:   reader,
+		version:  version,
+		rootHash: rootHash,
+	}, nil
+}
+
+// Format returns the export format version of the stream.
+func (er *ExportReader) Format() uint64 {
+	return er.format
+}
+
+// Version returns the exported tree version.
+func (er *ExportReader) Version() int64 {
+	return er.version
+}
+
+// RootHash returns the exported tree root hash.
+func (er *ExportReader) RootHash() []byte {
+	return er.rootHash
+}
+
+// Next reads the next exported node, or returns ExportDone when done.
+func (er *ExportReader) Next() (*ExportNode, error) {
+	return er.reader.readNode(er.r)
+}
+
+// WriteTo writes the remaining exported nodes to w as an export stream, see ExportWriter. Only
+// post-order exports can be written.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	if err := e.checkPostOrder(); err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	ew, err := NewExportWriter(cw, e.version, e.rootHash)
+	if err != nil {
+		return cw.n, err
+	}
+	for {
+		node, err := e.Next()
+		if err == ExportDone {
+			break
+		}
+		if err != nil {
+			return cw.n, err
+		}
+		if err = ew.WriteNode(node); err != nil {
+			return cw.n, err
+		}
+	}
+	err = ew.Close()
+	return cw.n, err
+}
+
+// ImportFrom imports an export stream into an empty tree, see Import(), and checks that the
+// resulting root hash matches the one in the stream.
+func (tree *MutableTree) ImportFrom(r io.Reader) error {
+	er, err := NewExportReader(r)
+	if err != nil {
+		return err
+	}
+	importer, err := tree.Import(er.Version())
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	for {
+		node, err := er.Next()
+		if err == ExportDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err = importer.Add(node); err != nil {
+			return err
+		}
+	}
+	hash, err := importer.rootHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, er.RootHash()) {
+		return errors.Errorf("imported root hash %X does not match export root hash %X", hash, er.RootHash())
+	}
+	return importer.Commit()
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,116 @@
+package iavl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestExportFormat_RoundTrip(t *testing.T) {
+	testcases := map[string]*ImmutableTree{
+		"empty tree":  NewImmutableTree(db.NewMemDB(), 0),
+		"basic tree":  setupExportTreeBasic(t),
+		"random tree": setupExportTreeRandom(t),
+	}
+	for desc, itree := range testcases {
+		itree := itree
+		t.Run(desc, func(t *testing.T) {
+			exporter := itree.Export()
+			defer exporter.Close()
+			var buf bytes.Buffer
+			n, err := exporter.WriteTo(&buf)
+			require.NoError(t, err)
+			require.EqualValues(t, buf.Len(), n)
+
+			er, err := NewExportReader(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			require.EqualValues(t, ExportFormat, er.Format())
+			require.Equal(t, itree.Version(), er.Version())
+			require.Equal(t, itree.Hash(), er.RootHash())
+
+			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(t, err)
+			require.NoError(t, tree.ImportFrom(&buf))
+			require.Equal(t, itree.Hash(), tree.Hash())
+			require.Equal(t, itree.Version(), tree.Version())
+		})
+	}
+}
+
+// testdata/export-v1.bin is an export stream of setupExportTreeBasic() in format version 1. It
+// must never be regenerated, to ensure that streams written by earlier releases can be read.
+func TestExportFormat_V1(t *testing.T) {
+	bz, err := ioutil.ReadFile("testdata/export-v1.bin")
+	require.NoError(t, err)
+
+	er, err := NewExportReader(bytes.NewReader(bz))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, er.Format())
+
+	exporter := setupExportTreeBasic(t).Export()
+	defer exporter.Close()
+	for {
+		expect, err := exporter.Next()
+		node, readErr := er.Next()
+		if err == ExportDone {
+			require.Equal(t, ExportDone, readErr)
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, readErr)
+		require.Equal(t, expect, node)
+	}
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.NoError(t, tree.ImportFrom(bytes.NewReader(bz)))
+	require.Equal(t, setupExportTreeBasic(t).Hash(), tree.Hash())
+}
+
+func TestExportFormat_Invalid(t *testing.T) {
+	var buf bytes.Buffer
+	exporter := setupExportTreeBasic(t).Export()
+	_, err := exporter.WriteTo(&buf)
+	require.NoError(t, err)
+	exporter.Close()
+	bz := buf.Bytes()
+
+	_, err = NewExportReader(bytes.NewReader([]byte("foo")))
+	require.Error(t, err)
+
+	// A newer format is rejected.
+	future := append([]byte(exportMagic), 99)
+	_, err = NewExportReader(bytes.NewReader(future))
+	require.True(t, errors.Is(err, ErrUnknownExportFormat))
+
+	// A truncated stream is detected.
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	err = tree.ImportFrom(bytes.NewReader(bz[:len(bz)-1]))
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	// A stream with a wrong root hash is not committed.
+	er, err := NewExportReader(bytes.NewReader(bz))
+	require.NoError(t, err)
+	var tampered bytes.Buffer
+	ew, err := NewExportWriter(&tampered, er.Version(), []byte("foo"))
+	require.NoError(t, err)
+	for {
+		node, err := er.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, ew.WriteNode(node))
+	}
+	require.NoError(t, ew.Close())
+	tree, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Error(t, tree.ImportFrom(&tampered))
+	require.True(t, tree.IsEmpty())
+}
@@ -170,6 +170,46 @@ func TestExporter(t *testing.T) {
 	assert.Equal(t, expect, actual)
 }
 
+func TestExporter_InOrder(t *testing.T) {
+	tree := setupExportTreeBasic(t)
+
+	expect := []*ExportNode{
+		{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0},
+		{Key: []byte("b"), Value: nil, Version: 3, Height: 1},
+		{Key: []byte("b"), Value: []byte{2}, Version: 3, Height: 0},
+		{Key: []byte("c"), Value: nil, Version: 3, Height: 2},
+		{Key: []byte("c"), Value: []byte{3}, Version: 3, Height: 0},
+		{Key: []byte("d"), Value: nil, Version: 3, Height: 3},
+		{Key: []byte("d"), Value: []byte{4}, Version: 2, Height: 0},
+		{Key: []byte("e"), Value: nil, Version: 3, Height: 1},
+		{Key: []byte("e"), Value: []byte{5}, Version: 3, Height: 0},
+	}
+
+	exporter, err := tree.ExportWithOrder(ExportInOrder)
+	require.NoError(t, err)
+	defer exporter.Close()
+	require.Equal(t, ExportInOrder, exporter.Order())
+	_, err = exporter.NextChunk(2)
+	require.Error(t, err)
+
+	actual := make([]*ExportNode, 0, len(expect))
+	for {
+		node, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		actual = append(actual, node)
+	}
+	assert.Equal(t, expect, actual)
+
+	_, err = exporter.Attest(nil, nil)
+	require.Error(t, err)
+
+	_, err = tree.ExportWithOrder(ExportOrder(2))
+	require.Error(t, err)
+}
+
 func TestExporter_Import(t *testing.T) {
 	testcases := map[string]*ImmutableTree{
 		"empty tree": NewImmutableTree(db.NewMemDB(), 0),
@@ -25,6 +25,8 @@ type FastIterator struct {
 	nextFastNode *FastNode
 
 	fastIterator dbm.Iterator
+
+	untrack func() // unregisters the iterator from the nodeDB, see nodeDB.Close
 }
 
 var _ dbm.Iterator = &FastIterator{}
@@ -106,6 +108,7 @@ func (iter *FastIterator) Next() {
 	if iter.fastIterator == nil {
 		iter.fastIterator, iter.err = iter.ndb.getFastIterator(iter.start, iter.end, iter.ascending)
 		iter.valid = true
+		iter.untrack = iter.ndb.resources.track(func() { iter.Close() })
 	} else {
 		iter.fastIterator.Next()
 	}
@@ -116,7 +119,14 @@ func (iter *FastIterator) Next() {
 
 	iter.valid = iter.valid && iter.fastIterator.Valid()
 	if iter.valid {
-		iter.nextFastNode, iter.err = DeserializeFastNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+		var value []byte
+		value, iter.err = iter.ndb.decryptValue(iter.fastIterator.Value())
+		if iter.err == nil {
+			iter.nextFastNode, iter.err = DeserializeFastNode(iter.fastIterator.Key()[1:], value)
+		}
+		if iter.err == nil {
+			iter.ndb.observeFastNodeRead(iter.nextFastNode, false)
+		}
 		iter.valid = iter.err == nil
 	}
 }
@@ -128,6 +138,10 @@ func (iter *FastIterator) Close() error {
 	}
 	iter.valid = false
 	iter.fastIterator = nil
+	if iter.untrack != nil {
+		iter.untrack()
+		iter.untrack = nil
+	}
 	return iter.err
 }
 
@@ -25,13 +25,23 @@ func NewFastNode(key []byte, value []byte, version int64) *FastNode {
 
 // DeserializeFastNode constructs an *FastNode from an encoded byte slice.
 func DeserializeFastNode(key []byte, buf []byte) (*FastNode, error) {
+	return deserializeFastNode(key, buf, decodeBytes)
+}
+
+// deserializeFastNodeNoCopy is like DeserializeFastNode, but the value aliases buf instead of
+// being copied, see Options.ZeroCopyDecode.
+func deserializeFastNodeNoCopy(key []byte, buf []byte) (*FastNode, error) {
+	return deserializeFastNode(key, buf, decodeBytesNoCopy)
+}
+
+func deserializeFastNode(key []byte, buf []byte, decode func([]byte) ([]byte, int, error)) (*FastNode, error) {
 	ver, n, cause := decodeVarint(buf)
 	if cause != nil {
 		return nil, errors.Wrap(cause, "decoding fastnode.version")
 	}
 	buf = buf[n:]
 
-	val, _, cause := decodeBytes(buf)
+	val, _, cause := decode(buf)
 	if cause != nil {
 		return nil, errors.Wrap(cause, "decoding fastnode.value")
 	}
@@ -0,0 +1,259 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// ErrReplicaMismatch is returned by Follower.Apply for a replication batch which doesn't produce
+// the root hash announced by the leader.
+var ErrReplicaMismatch = errors.New("replicated version does not match announced root hash")
+
+// Follower applies the replication batches shipped by a Replicator to a follower database,
+// verifying each version before writing it: the nodes written by the batch must have the hashes
+// they are stored under, their children must exist, and the root hash of the version, recomputed
+// from its root node, must match the root hash announced by the leader. The fast nodes written or
+// deleted by the batch must match the leaves of the version, since reads of the latest version
+// are served from them, and orphan entries must be well-formed and end before the version.
+// Other writes, such as metadata and the deletion of pruned versions, are applied as shipped,
+// and can't change the contents of the verified version.
+//
+// A rejected batch is not written, and the follower then rejects all later batches, since they
+// depend on it. The follower database can be read with a tree loading the applied versions, but
+// must not be written to otherwise.
+type Follower struct {
+	ndb *nodeDB
+
+	mtx      sync.Mutex
+	version  int64
+	rejected []int64
+	err      error
+}
+
+// NewFollower returns a follower writing to the given database, which must be a copy of the leader
+// database taken when its Replicator was created. The options must have the Encryption and
+// KeyPrefix of the leader, other options are ignored.
+func NewFollower(db dbm.DB, opts *Options) *Follower {
+	return &Follower{ndb: newNodeDB(db, 0, opts)}
+}
+
+// Apply verifies and writes a replication batch. It returns an error matching
+// ErrReplicaMismatch if the batch doesn't match its announced root hash, in which case its version
+// is added to Rejected.
+func (f *Follower) Apply(batch *ReplicationBatch) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return errors.Wrapf(f.err, "rejecting version %v after earlier rejection", batch.Version)
+	}
+
+	if err := f.verify(batch); err != nil {
+		if errors.Is(err, ErrReplicaMismatch) {
+			f.rejected = append(f.rejected, batch.Version)
+			f.err = err
+			f.ndb.logger.Error("rejected replicated version", "version", batch.Version, "err", err)
+		}
+		return err
+	}
+
+	if err := ApplyReplicationBatch(f.ndb.db, batch); err != nil {
+		return err
+	}
+	f.version = batch.Version
+	return nil
+}
+
+// ApplyFrom applies the batches of a replication stream until it ends, e.g. read from a network
+// connection to the leader.
+func (f *Follower) ApplyFrom(r *ReplicationReader) error {
+	for {
+		batch, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f.Apply(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// Version returns the last applied version, or 0 if none was applied.
+func (f *Follower) Version() int64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.version
+}
+
+// Rejected returns the versions whose batches were rejected for mismatching their root hash.
+func (f *Follower) Rejected() []int64 {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]int64(nil), f.rejected...)
+}
+
+// verify checks that a batch produces its announced root hash, see Follower.
+func (f *Follower) verify(batch *ReplicationBatch) error {
+	ndb := f.ndb
+	rootKey := ndb.rootKey(batch.Version)
+	var rootHash []byte
+	nodes := map[string]*Node{}
+	for _, op := range batch.Ops {
+		if op.Delete {
+			continue
+		}
+		if bytes.Equal(op.Key, rootKey) {
+			rootHash = op.Value
+			continue
+		}
+		if len(op.Key) == 0 || op.Key[0] != nodeKeyFormat.prefix {
+			continue
+		}
+		var hash []byte
+		if err := nodeKeyFormat.ScanStrict(op.Key, &hash); err != nil {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: %v", batch.Version, err)
+		}
+		buf, err := ndb.decryptValue(op.Value)
+		if err != nil {
+			return err
+		}
+		node, err := DecodeNode(buf)
+		if err != nil {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: node %X: %v", batch.Version, hash, err)
+		}
+		if !bytes.Equal(node.hash, hash) {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: node %X has hash %X",
+				batch.Version, hash, node.hash)
+		}
+		nodes[string(hash)] = node
+	}
+	if rootHash == nil {
+		return errors.Wrapf(ErrReplicaMismatch, "version %v: batch does not save the version", batch.Version)
+	}
+
+	// Children of new nodes are either new, or existing nodes verified when they were written.
+	for _, node := range nodes {
+		if node.isLeaf() {
+			continue
+		}
+		for _, child := range [][]byte{node.leftHash, node.rightHash} {
+			if _, ok := nodes[string(child)]; ok {
+				continue
+			}
+			if ok, err := ndb.Has(child); err != nil {
+				return err
+			} else if !ok {
+				return errors.Wrapf(ErrReplicaMismatch, "version %v: child node %X is missing",
+					batch.Version, child)
+			}
+		}
+	}
+
+	computed := sha256.New().Sum(nil)
+	if len(rootHash) > 0 {
+		root, ok := nodes[string(rootHash)]
+		if !ok {
+			node, err := ndb.readNode(rootHash)
+			if err != nil {
+				return errors.Wrapf(ErrReplicaMismatch, "version %v: root: %v", batch.Version, err)
+			}
+			root = node
+		}
+		computed = root._hash()
+	}
+	if !bytes.Equal(computed, batch.RootHash) {
+		return errors.Wrapf(ErrReplicaMismatch, "version %v: computed root hash %X, announced %X",
+			batch.Version, computed, batch.RootHash)
+	}
+	return f.verifyIndexes(batch, nodes, rootHash)
+}
+
+// verifyIndexes checks the fast nodes and orphan entries written by a batch whose nodes and root
+// hash have been verified, see Follower.
+func (f *Follower) verifyIndexes(batch *ReplicationBatch, nodes map[string]*Node, rootHash []byte) error {
+	// Only the last write of each fast node is checked, since it is the one persisted.
+	fastOps := map[string]BatchOp{}
+	for _, op := range batch.Ops {
+		if len(op.Key) == 0 {
+			continue
+		}
+		switch op.Key[0] {
+		case fastKeyFormat.prefix:
+			fastOps[string(op.Key[1:])] = op
+		case orphanKeyFormat.prefix:
+			if op.Delete {
+				continue
+			}
+			var toVersion, fromVersion int64
+			var hash []byte
+			if err := orphanKeyFormat.ScanStrict(op.Key, &toVersion, &fromVersion, &hash); err != nil {
+				return errors.Wrapf(ErrReplicaMismatch, "version %v: %v", batch.Version, err)
+			}
+			if !bytes.Equal(op.Value, hash) || fromVersion > toVersion || toVersion >= batch.Version {
+				return errors.Wrapf(ErrReplicaMismatch, "version %v: invalid orphan entry %X",
+					batch.Version, op.Key)
+			}
+		}
+	}
+
+	for key, op := range fastOps {
+		leaf, err := f.findLeaf(nodes, rootHash, []byte(key))
+		if err != nil {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: fast node %X: %v", batch.Version, key, err)
+		}
+		if op.Delete {
+			if leaf != nil {
+				return errors.Wrapf(ErrReplicaMismatch, "version %v: fast node of existing key %X is deleted",
+					batch.Version, key)
+			}
+			continue
+		}
+		buf, err := f.ndb.decryptValue(op.Value)
+		if err != nil {
+			return err
+		}
+		fastNode, err := DeserializeFastNode([]byte(key), buf)
+		if err != nil {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: fast node %X: %v", batch.Version, key, err)
+		}
+		if leaf == nil || !bytes.Equal(fastNode.value, leaf.value) ||
+			fastNode.versionLastUpdatedAt < leaf.version || fastNode.versionLastUpdatedAt > batch.Version {
+			return errors.Wrapf(ErrReplicaMismatch, "version %v: fast node %X does not match the tree",
+				batch.Version, key)
+		}
+	}
+	return nil
+}
+
+// findLeaf returns the leaf of the key in the tree with the given root hash, reading the nodes
+// from the batch or else the database, or nil if the key doesn't exist.
+func (f *Follower) findLeaf(nodes map[string]*Node, rootHash, key []byte) (*Node, error) {
+	hash := rootHash
+	for len(hash) > 0 {
+		node, ok := nodes[string(hash)]
+		if !ok {
+			var err error
+			if node, err = f.ndb.readNode(hash); err != nil {
+				return nil, err
+			}
+		}
+		if node.isLeaf() {
+			if bytes.Equal(node.key, key) {
+				return node, nil
+			}
+			return nil, nil
+		}
+		if bytes.Compare(key, node.key) < 0 {
+			hash = node.leftHash
+		} else {
+			hash = node.rightHash
+		}
+	}
+	return nil, nil
+}
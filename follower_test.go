@@ -0,0 +1,169 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// newReplicatedTree returns a leader tree with a saved version, a follower database copied from
+// it, and a channel receiving the batches of later versions.
+func newReplicatedTree(t *testing.T, opts *Options) (*MutableTree, db.DB, chan *ReplicationBatch) {
+	leaderDB := db.NewMemDB()
+	leader, err := NewMutableTreeWithOpts(leaderDB, 0, opts)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		leader.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+	}
+	_, _, err = leader.SaveVersion()
+	require.NoError(t, err)
+
+	followerDB := db.NewMemDB()
+	for key, value := range dumpPrefix(t, leaderDB, nil) {
+		require.NoError(t, followerDB.Set([]byte(key), []byte(value)))
+	}
+	batches := make(chan *ReplicationBatch, 10)
+	NewReplicator(leader, ChannelSink(batches))
+	return leader, followerDB, batches
+}
+
+func saveReplicatedVersion(t *testing.T, leader *MutableTree, batches chan *ReplicationBatch) *ReplicationBatch {
+	version := leader.Version() + 1
+	leader.Set([]byte(fmt.Sprintf("key%02d", version)), []byte(fmt.Sprintf("value%d", version)))
+	_, _, err := leader.SaveVersion()
+	require.NoError(t, err)
+	return <-batches
+}
+
+func TestFollower(t *testing.T) {
+	leader, followerDB, batches := newReplicatedTree(t, nil)
+	follower := NewFollower(followerDB, nil)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, follower.Apply(saveReplicatedVersion(t, leader, batches)))
+	}
+	require.EqualValues(t, 4, follower.Version())
+
+	// A version with an unchanged root.
+	_, _, err := leader.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, follower.Apply(<-batches))
+	require.Empty(t, follower.Rejected())
+
+	tree, err := NewMutableTree(followerDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, leader.Hash(), tree.Hash())
+}
+
+func TestFollower_Mismatch(t *testing.T) {
+	testcases := map[string]func(batch *ReplicationBatch){
+		"announced root hash": func(batch *ReplicationBatch) {
+			batch.RootHash = bytes.Repeat([]byte{1}, 32)
+		},
+		"node value": func(batch *ReplicationBatch) {
+			for i, op := range batch.Ops {
+				if op.Key[0] == 'n' {
+					node, err := MakeNode(op.Value)
+					require.NoError(t, err)
+					node.version++
+					batch.Ops[i].Value, err = encodeNode(node)
+					require.NoError(t, err)
+					return
+				}
+			}
+		},
+		"missing node": func(batch *ReplicationBatch) {
+			for i, op := range batch.Ops {
+				if op.Key[0] == 'n' {
+					batch.Ops = append(batch.Ops[:i:i], batch.Ops[i+1:]...)
+					return
+				}
+			}
+		},
+		"fast node value": func(batch *ReplicationBatch) {
+			for i, op := range batch.Ops {
+				if op.Key[0] == 'f' && !op.Delete {
+					var buf bytes.Buffer
+					require.NoError(t, NewFastNode(op.Key[1:], []byte("forged"), batch.Version).writeBytes(&buf))
+					batch.Ops[i].Value = buf.Bytes()
+					return
+				}
+			}
+		},
+		"fast node delete": func(batch *ReplicationBatch) {
+			batch.Ops = append(batch.Ops, BatchOp{Key: fastKeyFormat.KeyBytes([]byte("key00")), Delete: true})
+		},
+		"orphan entry": func(batch *ReplicationBatch) {
+			hash := bytes.Repeat([]byte{1}, hashSize)
+			batch.Ops = append(batch.Ops, BatchOp{Key: orphanKeyFormat.Key(batch.Version, int64(1), hash), Value: hash})
+		},
+		"missing root": func(batch *ReplicationBatch) {
+			for i, op := range batch.Ops {
+				if op.Key[0] == 'r' {
+					batch.Ops = append(batch.Ops[:i:i], batch.Ops[i+1:]...)
+					return
+				}
+			}
+		},
+	}
+	for name, tamper := range testcases {
+		tamper := tamper
+		t.Run(name, func(t *testing.T) {
+			leader, followerDB, batches := newReplicatedTree(t, nil)
+			follower := NewFollower(followerDB, nil)
+			require.NoError(t, follower.Apply(saveReplicatedVersion(t, leader, batches)))
+			before := dumpPrefix(t, followerDB, nil)
+
+			batch := saveReplicatedVersion(t, leader, batches)
+			tamper(batch)
+			err := follower.Apply(batch)
+			require.True(t, errors.Is(err, ErrReplicaMismatch), "got %v", err)
+			require.Equal(t, []int64{3}, follower.Rejected())
+			require.Equal(t, before, dumpPrefix(t, followerDB, nil))
+			require.EqualValues(t, 2, follower.Version())
+
+			// Later versions depend on the rejected one.
+			err = follower.Apply(saveReplicatedVersion(t, leader, batches))
+			require.True(t, errors.Is(err, ErrReplicaMismatch), "got %v", err)
+			require.Equal(t, before, dumpPrefix(t, followerDB, nil))
+		})
+	}
+}
+
+func TestFollower_Stream(t *testing.T) {
+	enc, err := NewAESGCMEncryption(1, map[byte][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	opts := &Options{KeyPrefix: []byte("tree/"), Encryption: enc}
+
+	leaderDB := db.NewMemDB()
+	leader, err := NewMutableTreeWithOpts(leaderDB, 0, opts)
+	require.NoError(t, err)
+	var stream bytes.Buffer
+	sink, err := NewStreamSink(&stream)
+	require.NoError(t, err)
+	NewReplicator(leader, sink)
+	for v := 0; v < 3; v++ {
+		leader.Set([]byte(fmt.Sprintf("key%d", v)), []byte("value"))
+		_, _, err = leader.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	followerDB := db.NewMemDB()
+	follower := NewFollower(followerDB, opts)
+	reader, err := NewReplicationReader(&stream)
+	require.NoError(t, err)
+	require.NoError(t, follower.ApplyFrom(reader))
+	require.EqualValues(t, 3, follower.Version())
+	require.Equal(t, dumpPrefix(t, leaderDB, nil), dumpPrefix(t, followerDB, nil))
+
+	tree, err := NewMutableTreeWithOpts(followerDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, leader.Hash(), tree.Hash())
+}
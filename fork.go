@@ -0,0 +1,95 @@
+package iavl
+
+import (
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// ForkVersion creates an independent tree in newDB, starting from the state of the given saved
+// version, e.g. to fork a devnet or simulate changes from mainnet state. newDB must not contain
+// any versions. The fork shares the nodes of the version with this tree by reading them from the
+// database of this tree, so only nodes created by the fork are written to newDB. The fork thus
+// requires the version to be kept in this database for as long as the fork is used, and database
+// scans of the fork, such as TraverseNodeHashes, only cover nodes written to newDB.
+//
+// The fork is loaded at the given version, and uses the cache size and options of this tree
+// except for InitialVersion. Its fast index is built when loaded, which requires a pass over all leaves. To
+// open the fork again later, use the database returned by NewForkDB.
+func (tree *MutableTree) ForkVersion(version int64, newDB dbm.DB) (*MutableTree, error) {
+	if !tree.VersionExists(version) {
+		return nil, tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %v", version))
+	}
+	rootHash, err := tree.ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := tree.ndb.opts
+	opts.InitialVersion = 0
+	fork, err := NewMutableTreeWithOpts(NewForkDB(newDB, tree.ndb.db), tree.ndb.cacheSize, &opts)
+	if err != nil {
+		return nil, err
+	}
+	if latest, err := fork.ndb.getLatestVersion(); err != nil {
+		return nil, err
+	} else if latest > 0 {
+		return nil, errors.Errorf("fork database already contains version %v", latest)
+	}
+
+	if err := fork.ndb.saveRoot(rootHash, version); err != nil {
+		return nil, err
+	}
+	if err := fork.ndb.Commit(); err != nil {
+		return nil, err
+	}
+	if _, err := fork.LoadVersion(version); err != nil {
+		return nil, errors.Wrap(err, "loading fork")
+	}
+	return fork, nil
+}
+
+// NewForkDB returns the database of a tree forked from the tree in base with ForkVersion, given
+// the database passed to ForkVersion. It must be used to open the fork again later.
+func NewForkDB(db, base dbm.DB) dbm.DB {
+	return &forkDB{DB: db, base: base}
+}
+
+// forkDB is the database of a forked tree, which reads nodes missing from its own database from
+// the database of the tree it was forked from. All other keys, and all writes, only use its own
+// database.
+type forkDB struct {
+	dbm.DB
+	base dbm.DB // the database of the tree the fork was created from
+}
+
+// isSharedKey returns true if the key may be read from the base database.
+func (db *forkDB) isSharedKey(key []byte) bool {
+	return len(key) > 0 && key[0] == nodeKeyFormat.prefix
+}
+
+// Get implements dbm.DB.
+func (db *forkDB) Get(key []byte) ([]byte, error) {
+	value, err := db.DB.Get(key)
+	if err != nil || value != nil || !db.isSharedKey(key) {
+		return value, err
+	}
+	return db.base.Get(key)
+}
+
+// Has implements dbm.DB.
+func (db *forkDB) Has(key []byte) (bool, error) {
+	has, err := db.DB.Has(key)
+	if err != nil || has || !db.isSharedKey(key) {
+		return has, err
+	}
+	return db.base.Has(key)
+}
+
+// HasKey implements KeyChecker.
+func (db *forkDB) HasKey(key []byte) (bool, error) {
+	has, err := hasKey(db.DB, key)
+	if err != nil || has || !db.isSharedKey(key) {
+		return has, err
+	}
+	return hasKey(db.base, key)
+}
@@ -0,0 +1,66 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestForkVersion(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 100)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(i)}, []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte{0}, []byte{2})
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte{0}, []byte{3})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.ForkVersion(5, db.NewMemDB())
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+
+	forkDB := db.NewMemDB()
+	fork, err := tree.ForkVersion(2, forkDB)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, fork.Version())
+	require.Equal(t, tree.ndb.nodeCache.Size(), fork.ndb.nodeCache.Size())
+	require.Equal(t, hash2, fork.Hash())
+	require.Equal(t, []byte{2}, fork.Get([]byte{0}))
+	require.Equal(t, []int{2}, fork.AvailableVersions())
+
+	// The fork only writes new nodes, and evolves independently of the original tree.
+	nodes := 0
+	require.NoError(t, fork.TraverseNodeHashes(func(hash []byte, size int, version int64) error {
+		nodes++
+		return nil
+	}))
+	require.Zero(t, nodes)
+
+	fork.Set([]byte{0}, []byte{4})
+	fork.Remove([]byte{1})
+	_, version, err := fork.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, []byte{3}, tree.Get([]byte{0}))
+	require.Equal(t, []byte{1}, tree.Get([]byte{1}))
+
+	// Reopening the fork reads shared nodes from the original database.
+	fork, err = NewMutableTreeWithOpts(NewForkDB(forkDB, tree.ndb.db), 0, nil)
+	require.NoError(t, err)
+	_, err = fork.Load()
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, fork.Get([]byte{0}))
+	require.Nil(t, fork.Get([]byte{1}))
+	require.Equal(t, []byte{1}, fork.GetVersioned([]byte{1}, 2))
+	require.EqualValues(t, 99, fork.Size())
+
+	_, err = tree.ForkVersion(2, forkDB)
+	require.Error(t, err)
+}
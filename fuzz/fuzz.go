@@ -0,0 +1,125 @@
+// Package fuzz contains fuzz targets for the parsers of data read from the database, snapshots
+// and proofs, which may come from untrusted sources.
+//
+// The targets follow the go-fuzz convention, e.g. for go-fuzz or OSS-Fuzz:
+//
+//	go-fuzz-build -func MakeNode github.com/cosmos/iavl/fuzz
+//
+// They return 1 if the input decoded and should be prioritized in the corpus, and 0 otherwise.
+// A target panics if a parser panics or its results are inconsistent. The same targets are run
+// by the native Go fuzz tests of this package, with go test -fuzz.
+package fuzz
+
+import (
+	"bytes"
+	"fmt"
+
+	tmmerkle "github.com/tendermint/tendermint/proto/tendermint/crypto"
+
+	"github.com/cosmos/iavl"
+)
+
+// MakeNode decodes data as an encoded node, checking that DecodeNodeDiagnostics agrees with
+// iavl.MakeNode.
+func MakeNode(data []byte) int {
+	node, err := iavl.MakeNode(data)
+	diag := iavl.DecodeNodeDiagnostics(data)
+	if (err == nil) != (diag.Err == nil) {
+		panic(fmt.Sprintf("MakeNode returned %v, but DecodeNodeDiagnostics returned %v", err, diag.Err))
+	}
+	_ = diag.String()
+	if err != nil {
+		return 0
+	}
+	_ = node.String()
+	return 1
+}
+
+// DeserializeFastNode decodes data as an encoded fast node.
+func DeserializeFastNode(data []byte) int {
+	if _, err := iavl.DeserializeFastNode([]byte("key"), data); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// fuzzRoot is the root hash proofs are verified against. Fuzzed proofs are not expected to
+// verify, only to not panic.
+var fuzzRoot = bytes.Repeat([]byte{0x01}, 32)
+
+// Proof decodes data as a serialized ics23 commitment proof and as the data of IAVL value and
+// absence proof operators, and verifies them.
+func Proof(data []byte) int {
+	decoded := 0
+	if err := iavl.VerifyMembership(fuzzRoot, []byte("key"), []byte("value"), data); err == nil {
+		panic("fuzzed membership proof verified")
+	}
+	_ = iavl.VerifyNonMembership(fuzzRoot, []byte("key"), data)
+
+	if op, err := iavl.ValueOpDecoder(tmmerkle.ProofOp{
+		Type: iavl.ProofOpIAVLValue,
+		Key:  []byte("key"),
+		Data: data,
+	}); err == nil {
+		decoded = 1
+		_, _ = op.Run([][]byte{[]byte("value")})
+	}
+	if op, err := iavl.AbsenceOpDecoder(tmmerkle.ProofOp{
+		Type: iavl.ProofOpIAVLAbsence,
+		Key:  []byte("key"),
+		Data: data,
+	}); err == nil {
+		decoded = 1
+		_, _ = op.Run(nil)
+	}
+	return decoded
+}
+
+// keyFormats are the key formats used by the nodeDB, with their number of segments.
+var keyFormats = []struct {
+	kf       *iavl.KeyFormat
+	segments int
+}{
+	{iavl.NewKeyFormat('n', 32), 1},       // node
+	{iavl.NewKeyFormat('o', 8, 8, 32), 3}, // orphan
+	{iavl.NewKeyFormat('r', 8), 1},        // root
+	{iavl.NewKeyFormat('j', 8, 8), 2},     // journal
+	{iavl.NewKeyFormat('f', 0), 1},        // fast node
+	{iavl.NewKeyFormat('m', 0), 1},        // metadata
+}
+
+// KeyFormat scans data with the key formats of the nodeDB having its prefix, checking that the
+// scanned segments round-trip through KeyFormat.KeyBytes, and that KeyFormat.ScanStrict only
+// accepts complete keys.
+func KeyFormat(data []byte) int {
+	complete := 0
+	for _, format := range keyFormats {
+		kf := format.kf
+		if len(data) == 0 || string(data[:1]) != kf.Prefix() {
+			continue
+		}
+		segments := kf.ScanBytes(data)
+		args := make([]interface{}, len(segments))
+		for i, segment := range segments {
+			if len(segment) == 8 {
+				args[i] = new(int64)
+			} else {
+				args[i] = new([]byte)
+			}
+		}
+		kf.Scan(data, args...)
+
+		key := kf.KeyBytes(segments...)
+		if !bytes.HasPrefix(data, key) {
+			panic(fmt.Sprintf("key %X scanned into %X does not round-trip, got %X", data, segments, key))
+		}
+		err := kf.ScanStrict(data, args...)
+		if (err == nil) != (len(key) == len(data) && len(segments) == format.segments) {
+			panic(fmt.Sprintf("ScanStrict of key %X with %d segments returned %v", data, len(segments), err))
+		}
+		if err == nil {
+			complete = 1
+		}
+	}
+	return complete
+}
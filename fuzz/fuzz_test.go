@@ -0,0 +1,110 @@
+//go:build go1.18
+// +build go1.18
+
+package fuzz
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/iavl"
+)
+
+// seeds is the seed corpus of the fuzz tests, taken from a saved tree.
+type seeds struct {
+	nodes     [][]byte
+	fastNodes [][]byte
+	keys      [][]byte
+	proofs    [][]byte
+}
+
+func getSeeds(t testing.TB) seeds {
+	memDB := db.NewMemDB()
+	tree, err := iavl.NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if i%5 == 4 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	tree.Remove([]byte("key07"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	var s seeds
+	itr, err := memDB.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		key := itr.Key()
+		s.keys = append(s.keys, key)
+		switch key[0] {
+		case 'n':
+			s.nodes = append(s.nodes, itr.Value())
+		case 'f':
+			s.fastNodes = append(s.fastNodes, itr.Value())
+		}
+	}
+	require.NoError(t, itr.Error())
+
+	for _, key := range [][]byte{[]byte("key03"), []byte("key07")} {
+		proof, err := tree.GetMembershipProof(key)
+		if err != nil {
+			proof, err = tree.GetNonMembershipProof(key)
+		}
+		require.NoError(t, err)
+		bz, err := proof.Marshal()
+		require.NoError(t, err)
+		s.proofs = append(s.proofs, bz)
+
+		_, rangeProof, err := tree.GetWithProof(key)
+		require.NoError(t, err)
+		s.proofs = append(s.proofs,
+			iavl.NewValueOp(key, rangeProof).ProofOp().Data,
+			iavl.NewAbsenceOp(key, rangeProof).ProofOp().Data)
+	}
+	return s
+}
+
+func FuzzMakeNode(f *testing.F) {
+	for _, seed := range getSeeds(f).nodes {
+		require.Equal(f, 1, MakeNode(seed))
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		MakeNode(data)
+	})
+}
+
+func FuzzDeserializeFastNode(f *testing.F) {
+	for _, seed := range getSeeds(f).fastNodes {
+		require.Equal(f, 1, DeserializeFastNode(seed))
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DeserializeFastNode(data)
+	})
+}
+
+func FuzzProof(f *testing.F) {
+	for _, seed := range getSeeds(f).proofs {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Proof(data)
+	})
+}
+
+func FuzzKeyFormat(f *testing.F) {
+	for _, seed := range getSeeds(f).keys {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		KeyFormat(data)
+	})
+}
@@ -0,0 +1,41 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sync"
+)
+
+// hasherPool holds the SHA-256 hashers used to hash nodes if set by SetSHA256(), and is nil to
+// use crypto/sha256.
+var hasherPool *sync.Pool
+
+// SetSHA256 replaces the SHA-256 implementation used to hash nodes, e.g. with a SIMD-accelerated
+// implementation such as github.com/minio/sha256-simd, or restores crypto/sha256 if nil. The
+// implementation must compute standard SHA-256 digests, otherwise hashes and proofs are invalid.
+// It is not safe for concurrent use with trees, and should be called during initialization.
+func SetSHA256(newHash func() hash.Hash) {
+	if newHash == nil {
+		hasherPool = nil
+		return
+	}
+	hasherPool = &sync.Pool{
+		New: func() interface{} {
+			return newHash()
+		},
+	}
+}
+
+// sumSHA256 returns the SHA-256 digest of the given bytes. It is returned by value, as by
+// sha256.Sum256, to avoid allocating on the hot path of hashing leaves.
+func sumSHA256(bz []byte) (sum [hashSize]byte) {
+	if hasherPool == nil {
+		return sha256.Sum256(bz)
+	}
+	h := hasherPool.Get().(hash.Hash)
+	h.Reset()
+	_, _ = h.Write(bz) // never fails
+	copy(sum[:], h.Sum(nil))
+	hasherPool.Put(h)
+	return sum
+}
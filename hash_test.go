@@ -0,0 +1,97 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// countingHash counts the digests computed by a SHA-256 hasher.
+type countingHash struct {
+	hash.Hash
+	sums *int
+}
+
+func (h countingHash) Sum(b []byte) []byte {
+	*h.sums++
+	return h.Hash.Sum(b)
+}
+
+func TestSetSHA256(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{byte(i)})
+	}
+	expect, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	sums := 0
+	SetSHA256(func() hash.Hash {
+		return countingHash{Hash: sha256.New(), sums: &sums}
+	})
+	defer SetSHA256(nil)
+
+	tree, err = NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{byte(i)})
+	}
+	actual, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expect, actual)
+	require.Positive(t, sums)
+}
+
+func TestSumSHA256_NoAllocs(t *testing.T) {
+	value := []byte("value")
+	require.Zero(t, testing.AllocsPerRun(100, func() { sumSHA256(value) }))
+}
+
+func TestNode_HashChangedPathOnly(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%04d", i)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Updating a key only rehashes the path from its leaf to the root.
+	tree.Set([]byte("key0500"), []byte("new"))
+	_, count := tree.root.hashWithCount()
+	require.EqualValues(t, tree.root.height+1, count)
+
+	// The hash is memoized until the next update.
+	_, count = tree.root.hashWithCount()
+	require.Zero(t, count)
+}
+
+func BenchmarkHash_Commit(b *testing.B) {
+	for _, updates := range []int{100, 10000} {
+		b.Run(fmt.Sprintf("updates=%v", updates), func(b *testing.B) {
+			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(b, err)
+			for i := 0; i < 100000; i++ {
+				tree.Set([]byte(fmt.Sprintf("key%08d", i)), randBytes(32))
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(b, err)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				for j := 0; j < updates; j++ {
+					tree.Set([]byte(fmt.Sprintf("key%08d", (i*updates+j*7919)%100000)), randBytes(32))
+				}
+				b.StartTimer()
+				tree.WorkingHash()
+			}
+		})
+	}
+}
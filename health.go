@@ -0,0 +1,274 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// healthSamplePaths is the number of random root-to-leaf paths read by HealthSampled checks.
+const healthSamplePaths = 64
+
+// HealthLevel is the thoroughness of a health check, see MutableTree.HealthCheck. Each level
+// includes the checks of the previous ones.
+type HealthLevel int
+
+const (
+	// HealthMetadata checks that the storage version is readable, that no commit is pending, and
+	// that the latest version has a root. It reads a few keys, cheap enough for a readiness probe.
+	HealthMetadata HealthLevel = iota
+	// HealthRoots checks that the root node of every version exists, decodes and has the hash
+	// it is stored under.
+	HealthRoots
+	// HealthSampled checks the nodes along random paths from the root of the latest version to
+	// its leaves.
+	HealthSampled
+	// HealthFull checks every node of every version, that the nodes of all orphan records exist,
+	// and that the latest version has as many leaves as there are fast nodes. It reads the whole
+	// database, and blocks saving versions while it runs.
+	HealthFull
+)
+
+// String returns the name of the level.
+func (l HealthLevel) String() string {
+	switch l {
+	case HealthMetadata:
+		return "metadata"
+	case HealthRoots:
+		return "roots"
+	case HealthSampled:
+		return "sampled"
+	case HealthFull:
+		return "full"
+	default:
+		return fmt.Sprintf("HealthLevel(%d)", int(l))
+	}
+}
+
+// HealthReport is the result of a health check.
+type HealthReport struct {
+	Level          HealthLevel
+	StorageVersion string
+	LatestVersion  int64
+	Versions       int           // Number of root records, from HealthRoots.
+	Orphans        int           // Number of orphan records, from HealthFull.
+	NodesChecked   int           // Number of distinct nodes read and verified.
+	Problems       []error       // Problems found, errors matching ErrNodeMissing for bad nodes.
+	Duration       time.Duration // Time taken by the check.
+}
+
+// Healthy returns true if the check found no problems.
+func (r *HealthReport) Healthy() bool {
+	return len(r.Problems) == 0
+}
+
+// String returns a summary of the report, with one line per problem.
+func (r *HealthReport) String() string {
+	s := fmt.Sprintf("HealthReport{level=%v latest=%d versions=%d orphans=%d nodes=%d problems=%d took=%v}",
+		r.Level, r.LatestVersion, r.Versions, r.Orphans, r.NodesChecked, len(r.Problems), r.Duration)
+	for _, problem := range r.Problems {
+		s += "\n  " + problem.Error()
+	}
+	return s
+}
+
+// HealthCheck checks the consistency of the saved versions in the database at the given level,
+// without using the caches, and returns a report. Problems, including database errors, are
+// recorded in the report rather than returned.
+func (tree *MutableTree) HealthCheck(level HealthLevel) *HealthReport {
+	return tree.ndb.HealthCheck(level)
+}
+
+// HealthCheck checks the database, see MutableTree.HealthCheck.
+func (ndb *nodeDB) HealthCheck(level HealthLevel) *HealthReport {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+
+	start := time.Now()
+	report := &HealthReport{Level: level}
+	problem := func(err error) {
+		report.Problems = append(report.Problems, err)
+	}
+	defer func() {
+		report.Duration = time.Since(start)
+	}()
+
+	storageVersion, err := ndb.db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	if err != nil {
+		problem(errors.Wrap(err, "reading storage version"))
+	}
+	report.StorageVersion = string(storageVersion)
+	if report.StorageVersion == "" {
+		report.StorageVersion = defaultStorageVersionValue
+	}
+	pending, err := ndb.db.Get(metadataKeyFormat.Key([]byte(commitPendingKey)))
+	if err != nil {
+		problem(errors.Wrap(err, "reading pending commit marker"))
+	} else if len(pending) == int64Size {
+		problem(errors.Errorf("commit of version %v is pending or was torn", int64(binary.BigEndian.Uint64(pending))))
+	} else if pending != nil {
+		problem(errors.Errorf("invalid pending commit marker %X", pending))
+	}
+
+	itr, err := ndb.db.ReverseIterator(rootKeyFormat.Key(1), rootKeyFormat.Key(int64(1<<63-1)))
+	if err != nil {
+		problem(errors.Wrap(err, "reading latest root"))
+		return report
+	}
+	var latestRoot []byte
+	if itr.Valid() {
+		if err := rootKeyFormat.ScanStrict(itr.Key(), &report.LatestVersion); err != nil {
+			problem(err)
+		}
+		latestRoot = append([]byte(nil), itr.Value()...)
+	}
+	if err := itr.Error(); err != nil {
+		problem(errors.Wrap(err, "reading latest root"))
+	}
+	itr.Close()
+	if level < HealthRoots {
+		return report
+	}
+
+	checked := map[string]bool{}
+	var roots []RootEntry
+	sizes := map[string]int64{}
+	err = ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		var version int64
+		if err := rootKeyFormat.ScanStrict(k, &version); err != nil {
+			return err
+		}
+		report.Versions++
+		roots = append(roots, RootEntry{Version: version, Hash: append([]byte(nil), v...)})
+		if len(v) == 0 || checked[string(v)] {
+			return nil
+		}
+		checked[string(v)] = true
+		root, err := ndb.checkStoredNode(v)
+		if err != nil {
+			problem(errors.Wrapf(err, "root of version %v", version))
+		} else {
+			sizes[string(v)] = root.size
+		}
+		return nil
+	})
+	if err != nil {
+		problem(errors.Wrap(err, "reading roots"))
+	}
+	report.NodesChecked = len(checked)
+	if level < HealthFull {
+		if level == HealthSampled && len(latestRoot) > 0 {
+			ndb.checkSampledPaths(latestRoot, checked, problem)
+			report.NodesChecked = len(checked)
+		}
+		return report
+	}
+
+	visited := map[string]bool{}
+	for _, root := range roots {
+		if len(root.Hash) == 0 || visited[string(root.Hash)] {
+			continue
+		}
+		version := root.Version
+		ndb.checkSubtree(root.Hash, visited, func(err error) {
+			problem(errors.Wrapf(err, "version %v", version))
+		})
+	}
+	report.NodesChecked = len(visited)
+
+	err = ndb.traverseOrphans(func(k, v []byte) error {
+		report.Orphans++
+		if buf, err := ndb.getNodeBytes(ndb.db, v); err != nil {
+			return err
+		} else if buf == nil {
+			problem(errors.Wrapf(ErrNodeMissing, "orphaned node %X not found", v))
+		}
+		return nil
+	})
+	if err != nil {
+		problem(errors.Wrap(err, "reading orphans"))
+	}
+
+	if ndb.hasUpgradedToFastStorage() {
+		fastNodes := 0
+		if err := ndb.traverseFastNodes(func(k, v []byte) error {
+			fastNodes++
+			return nil
+		}); err != nil {
+			problem(errors.Wrap(err, "reading fast nodes"))
+		} else if leaves := sizes[string(latestRoot)]; int64(fastNodes) != leaves {
+			problem(errors.Errorf("found %v fast nodes for %v leaves at version %v", fastNodes, leaves,
+				report.LatestVersion))
+		}
+	}
+	return report
+}
+
+// checkStoredNode reads a node from the database, bypassing the cache, and checks that it decodes
+// and has the given hash.
+func (ndb *nodeDB) checkStoredNode(hash []byte) (*Node, error) {
+	buf, err := ndb.getNodeBytes(ndb.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	if buf == nil {
+		return nil, errors.Wrapf(ErrNodeMissing, "node %X not found", hash)
+	}
+	if buf, err = ndb.decryptValue(buf); err != nil {
+		return nil, errors.Wrapf(ErrNodeMissing, "can't decrypt node %X: %v", hash, err)
+	}
+	node, err := MakeNode(buf)
+	if err != nil {
+		return nil, errors.Wrapf(ErrNodeMissing, "can't decode node %X: %v", hash, err)
+	}
+	if computed := node._hash(); !bytes.Equal(computed, hash) {
+		return nil, errors.Wrapf(ErrNodeMissing, "node %X has hash %X", hash, computed)
+	}
+	return node, nil
+}
+
+// checkSampledPaths checks the nodes along random paths from the given root to its leaves.
+func (ndb *nodeDB) checkSampledPaths(root []byte, checked map[string]bool, problem func(error)) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < healthSamplePaths; i++ {
+		hash := root
+		for {
+			node, err := ndb.checkStoredNode(hash)
+			checked[string(hash)] = true
+			if err != nil {
+				problem(err)
+				return
+			}
+			if node.isLeaf() {
+				break
+			}
+			hash = node.leftHash
+			if rnd.Intn(2) == 1 {
+				hash = node.rightHash
+			}
+		}
+	}
+}
+
+// checkSubtree checks the nodes of the subtree with the given root, skipping subtrees already
+// visited, e.g. those shared with other versions.
+func (ndb *nodeDB) checkSubtree(hash []byte, visited map[string]bool, problem func(error)) {
+	visited[string(hash)] = true
+	node, err := ndb.checkStoredNode(hash)
+	if err != nil {
+		problem(err)
+		return
+	}
+	if node.isLeaf() {
+		return
+	}
+	for _, child := range [][]byte{node.leftHash, node.rightHash} {
+		if !visited[string(child)] {
+			ndb.checkSubtree(child, visited, problem)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestHealthCheck(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("value%d", v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// A version with an unchanged root.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for _, level := range []HealthLevel{HealthMetadata, HealthRoots, HealthSampled, HealthFull} {
+		report := tree.HealthCheck(level)
+		require.True(t, report.Healthy(), "%v", report)
+		require.EqualValues(t, 4, report.LatestVersion)
+	}
+	report := tree.HealthCheck(HealthFull)
+	require.Equal(t, 4, report.Versions)
+	require.Equal(t, countPrefixKeys(t, memDB, nodeKeyFormat.Key()), report.NodesChecked)
+	require.Equal(t, countPrefixKeys(t, memDB, orphanKeyFormat.Key()), report.Orphans)
+
+	// A missing leaf is only found by the full check.
+	leaf := tree.root.getLeftNode(tree.ImmutableTree).getLeftNode(tree.ImmutableTree).
+		getLeftNode(tree.ImmutableTree).getLeftNode(tree.ImmutableTree)
+	require.True(t, leaf.isLeaf())
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(leaf.hash)))
+	require.True(t, tree.HealthCheck(HealthRoots).Healthy())
+	report = tree.HealthCheck(HealthFull)
+	require.Len(t, report.Problems, 1)
+	require.True(t, errors.Is(report.Problems[0], ErrNodeMissing), "%v", report)
+
+	// A corrupt root is found by the roots check.
+	require.NoError(t, memDB.Set(tree.ndb.nodeKey(tree.root.hash), []byte{0xff}))
+	report = tree.HealthCheck(HealthRoots)
+	require.False(t, report.Healthy())
+	require.True(t, errors.Is(report.Problems[0], ErrNodeMissing), "%v", report)
+
+	// A torn commit is found by the metadata check.
+	require.NoError(t, memDB.Set(metadataKeyFormat.Key([]byte(commitPendingKey)), formatUint64(5)))
+	report = tree.HealthCheck(HealthMetadata)
+	require.Len(t, report.Problems, 1)
+	require.Contains(t, report.Problems[0].Error(), "version 5")
+}
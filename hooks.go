@@ -0,0 +1,61 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+)
+
+// KVPair is a key/value pair. A nil Value denotes a removed key.
+type KVPair struct {
+	Key   []byte
+	Value []byte
+}
+
+// Hooks receives notifications about changes made to a MutableTree. Hooks are called
+// synchronously, and must not modify the tree or the given byte slices.
+type Hooks interface {
+	// OnSet is called after a key is set in the working tree.
+	OnSet(key, value []byte)
+	// OnRemove is called after an existing key is removed from the working tree.
+	OnRemove(key []byte)
+	// OnSaveVersion is called after a version has been saved, with the keys changed since the
+	// previous version in sorted order. Removed keys have a nil value.
+	OnSaveVersion(version int64, rootHash []byte, changed []KVPair)
+}
+
+// BaseHooks is a Hooks implementation which does nothing. It can be embedded to only implement
+// a subset of the hooks.
+type BaseHooks struct{}
+
+var _ Hooks = BaseHooks{}
+
+func (BaseHooks) OnSet(key, value []byte)                                        {}
+func (BaseHooks) OnRemove(key []byte)                                            {}
+func (BaseHooks) OnSaveVersion(version int64, rootHash []byte, changed []KVPair) {}
+
+// AddHooks registers hooks to be notified of changes to the tree, in registration order.
+func (tree *MutableTree) AddHooks(hooks Hooks) {
+	tree.hooks = append(tree.hooks, hooks)
+}
+
+// unsavedChanges returns the keys changed in the working tree since the last saved version,
+// sorted by key. Removals of keys which don't exist in the last saved version, i.e. keys set and
+// removed again, are skipped. They are looked up in the saved nodes rather than the fast index,
+// which may already hold the working tree.
+func (tree *MutableTree) unsavedChanges() []KVPair {
+	changed := make([]KVPair, 0, len(tree.unsavedFastNodeAdditions)+len(tree.unsavedFastNodeRemovals))
+	for _, node := range tree.unsavedFastNodeAdditions {
+		changed = append(changed, KVPair{Key: node.key, Value: node.value})
+	}
+	saved := tree.lastSaved
+	for key := range tree.unsavedFastNodeRemovals {
+		if saved.root == nil || !saved.root.has(saved, []byte(key)) {
+			continue
+		}
+		changed = append(changed, KVPair{Key: []byte(key)})
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return bytes.Compare(changed[i].Key, changed[j].Key) < 0
+	})
+	return changed
+}
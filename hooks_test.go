@@ -0,0 +1,69 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+type recordingHooks struct {
+	BaseHooks
+	sets     []KVPair
+	removes  [][]byte
+	versions []int64
+	hashes   [][]byte
+	changed  [][]KVPair
+}
+
+func (h *recordingHooks) OnSet(key, value []byte) {
+	h.sets = append(h.sets, KVPair{Key: key, Value: value})
+}
+
+func (h *recordingHooks) OnRemove(key []byte) {
+	h.removes = append(h.removes, key)
+}
+
+func (h *recordingHooks) OnSaveVersion(version int64, rootHash []byte, changed []KVPair) {
+	h.versions = append(h.versions, version)
+	h.hashes = append(h.hashes, rootHash)
+	h.changed = append(h.changed, changed)
+}
+
+func TestMutableTree_Hooks(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	hooks := &recordingHooks{}
+	tree.AddHooks(hooks)
+	tree.AddHooks(BaseHooks{})
+
+	tree.Set([]byte("b"), []byte("1"))
+	tree.Set([]byte("a"), []byte("2"))
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, []KVPair{{[]byte("b"), []byte("1")}, {[]byte("a"), []byte("2")}}, hooks.sets)
+	require.Equal(t, []int64{version}, hooks.versions)
+	require.Equal(t, [][]byte{hash}, hooks.hashes)
+	require.Equal(t, []KVPair{{[]byte("a"), []byte("2")}, {[]byte("b"), []byte("1")}}, hooks.changed[0])
+
+	tree.Set([]byte("c"), []byte("3"))
+	tree.Remove([]byte("a"))
+	tree.Remove([]byte("x"))
+	hash, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Equal(t, [][]byte{[]byte("a")}, hooks.removes)
+	require.Equal(t, []int64{1, 2}, hooks.versions)
+	require.Equal(t, hash, hooks.hashes[1])
+	require.EqualValues(t, 2, version)
+	require.Equal(t, []KVPair{{[]byte("a"), nil}, {[]byte("c"), []byte("3")}}, hooks.changed[1])
+
+	// Keys set and removed again within a version are not reported as changed.
+	tree.Set([]byte("d"), []byte("4"))
+	tree.Remove([]byte("d"))
+	tree.Set([]byte("b"), []byte("5"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []KVPair{{[]byte("b"), []byte("5")}}, hooks.changed[2])
+}
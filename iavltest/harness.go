@@ -0,0 +1,170 @@
+package iavltest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/cosmos/iavl"
+)
+
+// Tree is the tree API exercised by the harness. It is implemented by *iavl.MutableTree, and
+// can be implemented by wrappers or forks to run differential tests against the model.
+type Tree interface {
+	Get(key []byte) []byte
+	GetVersioned(key []byte, version int64) []byte
+	Set(key, value []byte) bool
+	Remove(key []byte) ([]byte, bool)
+	Iterate(fn func(key []byte, value []byte) bool) bool
+	Size() int64
+	Hash() []byte
+	Version() int64
+	AvailableVersions() []int
+	SaveVersion() ([]byte, int64, error)
+	DeleteVersion(version int64) error
+	LoadVersion(version int64) (int64, error)
+}
+
+var _ Tree = (*iavl.MutableTree)(nil)
+
+// Apply applies an operation to the tree, returning the root hash for OpSaveVersion.
+func Apply(tree Tree, op Op) ([]byte, error) {
+	switch op.Kind {
+	case OpSet:
+		tree.Set(op.Key, op.Value)
+	case OpRemove:
+		tree.Remove(op.Key)
+	case OpSaveVersion:
+		hash, _, err := tree.SaveVersion()
+		return hash, err
+	case OpDeleteVersion:
+		return nil, tree.DeleteVersion(op.Version)
+	case OpLoadVersion:
+		_, err := tree.LoadVersion(op.Version)
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unknown operation %v", op.Kind)
+	}
+	return nil, nil
+}
+
+// CheckInvariants checks that the tree matches the model: the loaded and available versions,
+// the working state, the contents of all saved versions, and the root hash of the loaded version.
+func CheckInvariants(tree Tree, m *Model) error {
+	if tree.Version() != m.Version() {
+		return fmt.Errorf("tree is at version %v, model at %v", tree.Version(), m.Version())
+	}
+	versions := m.Versions()
+	available := tree.AvailableVersions()
+	if len(available) != len(versions) {
+		return fmt.Errorf("tree has versions %v, model has %v", available, versions)
+	}
+	for i, version := range versions {
+		if int64(available[i]) != version {
+			return fmt.Errorf("tree has versions %v, model has %v", available, versions)
+		}
+	}
+
+	// Working state.
+	keys := m.Keys()
+	if tree.Size() != int64(len(keys)) {
+		return fmt.Errorf("tree has %v keys, model has %v", tree.Size(), len(keys))
+	}
+	i := 0
+	var err error
+	tree.Iterate(func(key, value []byte) bool {
+		switch {
+		case i >= len(keys):
+			err = fmt.Errorf("tree iterated extra key %X", key)
+		case !bytes.Equal(key, keys[i]):
+			err = fmt.Errorf("tree iterated key %X, expected %X", key, keys[i])
+		case !bytes.Equal(value, m.Get(key)):
+			err = fmt.Errorf("tree iterated key %X with value %X, expected %X", key, value, m.Get(key))
+		}
+		i++
+		return err != nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if value := tree.Get(key); !bytes.Equal(value, m.Get(key)) {
+			return fmt.Errorf("tree has value %X for key %X, expected %X", value, key, m.Get(key))
+		}
+	}
+
+	// Saved versions, including keys missing from them.
+	for _, version := range versions {
+		for key := range m.versions[version] {
+			expected := m.GetVersioned([]byte(key), version)
+			if value := tree.GetVersioned([]byte(key), version); !bytes.Equal(value, expected) {
+				return fmt.Errorf("tree has value %X for key %X at version %v, expected %X", value, key, version, expected)
+			}
+		}
+		for _, key := range keys {
+			expected := m.GetVersioned(key, version)
+			if value := tree.GetVersioned(key, version); !bytes.Equal(value, expected) {
+				return fmt.Errorf("tree has value %X for key %X at version %v, expected %X", value, key, version, expected)
+			}
+		}
+	}
+
+	if hash := m.Hash(m.Version()); hash != nil && !bytes.Equal(tree.Hash(), hash) {
+		return fmt.Errorf("tree has hash %X at version %v, expected %X", tree.Hash(), m.Version(), hash)
+	}
+	return nil
+}
+
+// RunError is returned by Run when the tree diverges from the model, with the operations
+// leading up to it.
+type RunError struct {
+	Seed int64
+	Step int
+	Ops  []Op // the operations run, the last of which failed
+	Err  error
+}
+
+func (e *RunError) Error() string {
+	var ops strings.Builder
+	from := 0
+	if len(e.Ops) > 20 {
+		from = len(e.Ops) - 20
+	}
+	for _, op := range e.Ops[from:] {
+		fmt.Fprintf(&ops, "\n  %v", op)
+	}
+	return fmt.Sprintf("seed %v, step %v: %v\nlast operations:%v", e.Seed, e.Step, e.Err, ops.String())
+}
+
+// Run runs the given number of random operations generated from the seed against the tree and a
+// model, checking invariants after each operation other than Set and Remove, and at the end. The
+// tree must be empty. It returns a *RunError if the tree diverges from the model.
+func Run(tree Tree, seed int64, steps int, cfg Config) error {
+	m := NewModel()
+	g := NewGenerator(seed, cfg)
+	ops := make([]Op, 0, steps)
+	for step := 0; step < steps; step++ {
+		op := g.Next(m)
+		ops = append(ops, op)
+		fail := func(err error) error {
+			return &RunError{Seed: seed, Step: step, Ops: ops, Err: err}
+		}
+
+		hash, err := Apply(tree, op)
+		if err != nil {
+			return fail(err)
+		}
+		if err := m.Apply(op, hash); err != nil {
+			return fail(err)
+		}
+		if op.Kind == OpSet || op.Kind == OpRemove {
+			if step < steps-1 {
+				continue
+			}
+		}
+		if err := CheckInvariants(tree, m); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package iavltest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+
+	"github.com/cosmos/iavl"
+)
+
+func TestRun(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		tree, err := iavl.NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		require.NoError(t, Run(tree, seed, 1000, Config{}))
+	}
+}
+
+func TestGenerator_Deterministic(t *testing.T) {
+	gen := func() []Op {
+		m := NewModel()
+		g := NewGenerator(7, Config{SaveEvery: 4})
+		var ops []Op
+		for i := 0; i < 200; i++ {
+			op := g.Next(m)
+			require.NoError(t, m.Apply(op, nil))
+			ops = append(ops, op)
+		}
+		return ops
+	}
+	require.Equal(t, gen(), gen())
+}
+
+// brokenTree drops every 10th Set.
+type brokenTree struct {
+	*iavl.MutableTree
+	sets int
+}
+
+func (t *brokenTree) Set(key, value []byte) bool {
+	t.sets++
+	if t.sets%10 == 0 {
+		return false
+	}
+	return t.MutableTree.Set(key, value)
+}
+
+func TestRun_Divergence(t *testing.T) {
+	tree, err := iavl.NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	err = Run(&brokenTree{MutableTree: tree}, 1, 2000, Config{})
+	require.Error(t, err)
+	var runErr *RunError
+	require.True(t, errors.As(err, &runErr))
+	require.EqualValues(t, 1, runErr.Seed)
+	require.NotEmpty(t, runErr.Ops)
+}
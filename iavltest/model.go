@@ -0,0 +1,118 @@
+package iavltest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Model is a reference model of a versioned tree, keeping a map of the working state and of each
+// saved version.
+type Model struct {
+	working  map[string][]byte
+	versions map[int64]map[string][]byte
+	hashes   map[int64][]byte // root hashes returned when saving versions
+	version  int64            // the loaded version
+	latest   int64            // the latest saved version
+}
+
+// NewModel returns an empty model.
+func NewModel() *Model {
+	return &Model{
+		working:  map[string][]byte{},
+		versions: map[int64]map[string][]byte{},
+		hashes:   map[int64][]byte{},
+	}
+}
+
+// Version returns the loaded version.
+func (m *Model) Version() int64 {
+	return m.version
+}
+
+// Latest returns the latest saved version.
+func (m *Model) Latest() int64 {
+	return m.latest
+}
+
+// Versions returns the saved versions in ascending order.
+func (m *Model) Versions() []int64 {
+	versions := make([]int64, 0, len(m.versions))
+	for version := range m.versions {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+// Get returns the value of the key in the working state, or nil.
+func (m *Model) Get(key []byte) []byte {
+	return m.working[string(key)]
+}
+
+// GetVersioned returns the value of the key in a saved version, or nil.
+func (m *Model) GetVersioned(key []byte, version int64) []byte {
+	return m.versions[version][string(key)]
+}
+
+// Keys returns the keys of the working state in ascending order.
+func (m *Model) Keys() [][]byte {
+	return sortedKeys(m.working)
+}
+
+// Hash returns the root hash recorded for a saved version, or nil if unknown.
+func (m *Model) Hash(version int64) []byte {
+	return m.hashes[version]
+}
+
+// Apply applies an operation to the model. hash is the root hash returned by the tree for
+// OpSaveVersion, which is recorded for later checks.
+func (m *Model) Apply(op Op, hash []byte) error {
+	switch op.Kind {
+	case OpSet:
+		m.working[string(op.Key)] = op.Value
+	case OpRemove:
+		delete(m.working, string(op.Key))
+	case OpSaveVersion:
+		if m.version != m.latest {
+			return fmt.Errorf("model can only save on top of the latest version %v", m.latest)
+		}
+		m.version++
+		m.latest = m.version
+		m.versions[m.version] = copyState(m.working)
+		m.hashes[m.version] = hash
+	case OpDeleteVersion:
+		if _, ok := m.versions[op.Version]; !ok || op.Version == m.latest {
+			return fmt.Errorf("model can't delete version %v", op.Version)
+		}
+		delete(m.versions, op.Version)
+		delete(m.hashes, op.Version)
+	case OpLoadVersion:
+		state, ok := m.versions[op.Version]
+		if !ok {
+			return fmt.Errorf("model has no version %v", op.Version)
+		}
+		m.working = copyState(state)
+		m.version = op.Version
+	default:
+		return fmt.Errorf("unknown operation %v", op.Kind)
+	}
+	return nil
+}
+
+func copyState(state map[string][]byte) map[string][]byte {
+	copied := make(map[string][]byte, len(state))
+	for key, value := range state {
+		copied[key] = value
+	}
+	return copied
+}
+
+func sortedKeys(state map[string][]byte) [][]byte {
+	keys := make([][]byte, 0, len(state))
+	for key := range state {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	return keys
+}
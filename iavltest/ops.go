@@ -0,0 +1,137 @@
+package iavltest
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// OpKind is the kind of an operation.
+type OpKind int
+
+// Operation kinds.
+const (
+	OpSet OpKind = iota
+	OpRemove
+	OpSaveVersion
+	OpDeleteVersion
+	OpLoadVersion
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpSet:
+		return "Set"
+	case OpRemove:
+		return "Remove"
+	case OpSaveVersion:
+		return "SaveVersion"
+	case OpDeleteVersion:
+		return "DeleteVersion"
+	case OpLoadVersion:
+		return "LoadVersion"
+	default:
+		return fmt.Sprintf("OpKind(%d)", int(k))
+	}
+}
+
+// Op is an operation on a tree.
+type Op struct {
+	Kind    OpKind
+	Key     []byte // for OpSet and OpRemove
+	Value   []byte // for OpSet
+	Version int64  // for OpDeleteVersion and OpLoadVersion
+}
+
+func (op Op) String() string {
+	switch op.Kind {
+	case OpSet:
+		return fmt.Sprintf("Set(%X, %X)", op.Key, op.Value)
+	case OpRemove:
+		return fmt.Sprintf("Remove(%X)", op.Key)
+	case OpDeleteVersion, OpLoadVersion:
+		return fmt.Sprintf("%v(%v)", op.Kind, op.Version)
+	default:
+		return fmt.Sprintf("%v()", op.Kind)
+	}
+}
+
+// Config configures the random operations generated by a Generator. Zero fields use the
+// defaults of DefaultConfig.
+type Config struct {
+	Keys        int // number of distinct keys
+	ValueSize   int // maximum value size in bytes
+	SaveEvery   int // average number of changes per saved version
+	MaxVersions int // number of saved versions above which old versions are deleted
+	LoadEvery   int // average number of saved versions per load of a random version
+}
+
+// DefaultConfig returns the default generator configuration.
+func DefaultConfig() Config {
+	return Config{
+		Keys:        256,
+		ValueSize:   16,
+		SaveEvery:   32,
+		MaxVersions: 8,
+		LoadEvery:   4,
+	}
+}
+
+func (c Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if c.Keys <= 0 {
+		c.Keys = defaults.Keys
+	}
+	if c.ValueSize <= 0 {
+		c.ValueSize = defaults.ValueSize
+	}
+	if c.SaveEvery <= 0 {
+		c.SaveEvery = defaults.SaveEvery
+	}
+	if c.MaxVersions <= 0 {
+		c.MaxVersions = defaults.MaxVersions
+	}
+	if c.LoadEvery <= 0 {
+		c.LoadEvery = defaults.LoadEvery
+	}
+	return c
+}
+
+// Generator generates a deterministic sequence of random operations valid for a model.
+type Generator struct {
+	cfg  Config
+	rand *rand.Rand
+}
+
+// NewGenerator returns a generator with the given seed. The same seed and configuration always
+// generate the same operations for the same model.
+func NewGenerator(seed int64, cfg Config) *Generator {
+	return &Generator{cfg: cfg.withDefaults(), rand: rand.New(rand.NewSource(seed))}
+}
+
+// Next returns the next operation for the model. After an older version is loaded, the next
+// operation always loads the latest version again, since the model can only save on top of it.
+func (g *Generator) Next(m *Model) Op {
+	if m.Version() != m.Latest() {
+		return Op{Kind: OpLoadVersion, Version: m.Latest()}
+	}
+	versions := m.Versions()
+	if len(versions) > g.cfg.MaxVersions {
+		// Delete a random version other than the latest.
+		return Op{Kind: OpDeleteVersion, Version: versions[g.rand.Intn(len(versions)-1)]}
+	}
+
+	if g.rand.Intn(g.cfg.SaveEvery) == 0 {
+		if len(versions) > 0 && g.rand.Intn(g.cfg.LoadEvery) == 0 {
+			return Op{Kind: OpLoadVersion, Version: versions[g.rand.Intn(len(versions))]}
+		}
+		return Op{Kind: OpSaveVersion}
+	}
+
+	key := []byte(fmt.Sprintf("key%06d", g.rand.Intn(g.cfg.Keys)))
+	if g.rand.Intn(4) == 0 {
+		return Op{Kind: OpRemove, Key: key}
+	}
+	value := make([]byte, 1+g.rand.Intn(g.cfg.ValueSize))
+	g.rand.Read(value)
+	return Op{Kind: OpSet, Key: key, Value: value}
+}
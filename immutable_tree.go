@@ -1,9 +1,12 @@
 package iavl
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"strings"
 
+	"github.com/pkg/errors"
 	dbm "github.com/tendermint/tm-db"
 )
 
@@ -17,6 +20,7 @@ type ImmutableTree struct {
 	root    *Node
 	ndb     *nodeDB
 	version int64
+	stats   *readStats // Reads of a traced operation, see Options.Tracer. Nil if not traced.
 }
 
 // NewImmutableTree creates both in-memory and persistent instances
@@ -39,6 +43,32 @@ func NewImmutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) *Immutabl
 	}
 }
 
+// LoadRootOnly returns the tree at a saved version, sharing this tree's node database and caches.
+// Unlike MutableTree.LoadVersion, it reads only the version's root, without scanning the roots of
+// other versions or checking fast storage, so it is cheap enough to call for every query against
+// a historical version.
+func (t *ImmutableTree) LoadRootOnly(version int64) (*ImmutableTree, error) {
+	if t.ndb == nil {
+		return nil, ErrVersionDoesNotExist
+	}
+	rootHash, err := t.ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootHash == nil {
+		return nil, t.ndb.versionMissing(version, ErrVersionDoesNotExist)
+	}
+
+	tree := &ImmutableTree{
+		ndb:     t.ndb,
+		version: version,
+	}
+	if len(rootHash) > 0 {
+		tree.root = t.ndb.GetNode(rootHash)
+	}
+	return tree, nil
+}
+
 // String returns a string representation of Tree.
 func (t *ImmutableTree) String() string {
 	leaves := []string{}
@@ -117,12 +147,55 @@ func (t *ImmutableTree) Height() int8 {
 	return t.root.height
 }
 
-// Has returns whether or not a key exists.
+// Has returns whether or not a key exists. Like Get, it consults the fast index when possible,
+// and otherwise stops at the leaf, so existence checks avoid loading the value where they can.
 func (t *ImmutableTree) Has(key []byte) bool {
 	if t.root == nil {
 		return false
 	}
-	return t.root.has(t, key)
+	if t.ndb.missingKeys == nil {
+		return t.has(key)
+	}
+	if t.ndb.missingKeys.has(t.version, key) {
+		return false
+	}
+	has := t.has(key)
+	if !has {
+		t.ndb.missingKeys.add(t.version, key)
+	}
+	return has
+}
+
+// has is like Has, but doesn't use the missing key cache.
+func (t *ImmutableTree) has(key []byte) bool {
+	// For the latest version, the fast index holds exactly the live keys, so a key lookup
+	// without decoding the fast node suffices.
+	if t.version == t.ndb.latestVersion {
+		has, err := t.ndb.hasFastNode(key)
+		if err == nil {
+			return has
+		}
+		t.ndb.logger.Error("failed to check fast node, falling back to regular IAVL logic", "key", key, "err", err)
+		return t.root.has(t, key)
+	}
+
+	fastNode, err := t.getFastNode(key)
+	if err != nil || fastNode == nil || fastNode.versionLastUpdatedAt > t.version {
+		return t.root.has(t, key)
+	}
+	return true
+}
+
+// HasAll returns whether or not each of the given keys exists, in the order given.
+func (t *ImmutableTree) HasAll(keys [][]byte) []bool {
+	has := make([]bool, len(keys))
+	if t.root == nil {
+		return has
+	}
+	for i, key := range keys {
+		has[i] = t.Has(key)
+	}
+	return has
 }
 
 // Hash returns the root hash.
@@ -139,7 +212,24 @@ func (t *ImmutableTree) hashWithCount() ([]byte, int64) {
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
 // imported with MutableTree.Import() to recreate an identical tree.
 func (t *ImmutableTree) Export() *Exporter {
-	return newExporter(t)
+	return newExporter(context.Background(), t, ExportPostOrder)
+}
+
+// ExportContext is like ExportWithOrder, but the export stops if ctx is done, and
+// Exporter.Next() then returns the context's error.
+func (t *ImmutableTree) ExportContext(ctx context.Context, order ExportOrder) (*Exporter, error) {
+	switch order {
+	case ExportPostOrder, ExportInOrder:
+		return newExporter(ctx, t, order), nil
+	default:
+		return nil, errors.Errorf("unknown export order %v", order)
+	}
+}
+
+// ExportWithOrder returns an iterator that exports tree nodes as ExportNodes in the given order.
+// Only post-order exports can be imported, see ExportOrder.
+func (t *ImmutableTree) ExportWithOrder(order ExportOrder) (*Exporter, error) {
+	return t.ExportContext(context.Background(), order)
 }
 
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
@@ -152,6 +242,9 @@ func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte) {
 	if t.root == nil {
 		return 0, nil
 	}
+	if t.rankCacheEnabled() {
+		return t.getWithIndexCached(key)
+	}
 	return t.root.get(t, key)
 }
 
@@ -162,12 +255,26 @@ func (t *ImmutableTree) Get(key []byte) []byte {
 	if t.root == nil {
 		return nil
 	}
+	if t.ndb.missingKeys == nil {
+		return t.get(key)
+	}
+	if t.ndb.missingKeys.has(t.version, key) {
+		return nil
+	}
+	value := t.get(key)
+	if value == nil {
+		t.ndb.missingKeys.add(t.version, key)
+	}
+	return value
+}
 
+// get is like Get, but doesn't use the missing key cache.
+func (t *ImmutableTree) get(key []byte) []byte {
 	// attempt to get a FastNode directly from db/cache.
 	// if call fails, fall back to the original IAVL logic in place.
-	fastNode, err := t.ndb.GetFastNode(key)
+	fastNode, err := t.getFastNode(key)
 	if err != nil {
-		debug("failed to get FastNode with key: %X, falling back to regular IAVL logic\n", key)
+		t.ndb.logger.Error("failed to get fast node, falling back to regular IAVL logic", "key", key, "err", err)
 		_, result := t.root.get(t, key)
 		return result
 	}
@@ -177,18 +284,18 @@ func (t *ImmutableTree) Get(key []byte) []byte {
 		// then the regular node is not in the tree either because fast node
 		// represents live state.
 		if t.version == t.ndb.latestVersion {
-			debug("latest version with no fast node for key: %X. The node must not exist, return nil. Tree version: %d\n", key, t.version)
+			t.ndb.logger.Debug("latest version with no fast node for key, the node must not exist", "key", key, "version", t.version)
 			return nil
 		}
 
-		debug("old version with no fast node for key: %X, falling back to regular IAVL logic. Tree version: %d\n", key, t.version)
+		t.ndb.logger.Debug("old version with no fast node for key, falling back to regular IAVL logic", "key", key, "version", t.version)
 		_, result := t.root.get(t, key)
 		return result
 	}
 
 	// cache node was updated later than the current tree. Use regular strategy for reading from the current tree
 	if fastNode.versionLastUpdatedAt > t.version {
-		debug("last updated version %d is too new for FastNode where tree is of version %d with key %X, falling back to regular IAVL logic\n", fastNode.versionLastUpdatedAt, t.version, key)
+		t.ndb.logger.Debug("fast node is too new for version, falling back to regular IAVL logic", "key", key, "version", t.version, "lastUpdated", fastNode.versionLastUpdatedAt)
 		_, result := t.root.get(t, key)
 		return result
 	}
@@ -201,10 +308,75 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte) {
 	if t.root == nil {
 		return nil, nil
 	}
-
+	if t.rankCacheEnabled() {
+		return t.getByIndexCached(index)
+	}
 	return t.root.getByIndex(t, index)
 }
 
+// FirstKey returns the smallest key of the tree and its value, or nil if the tree is empty.
+func (t *ImmutableTree) FirstKey() (key []byte, value []byte) {
+	if t.root == nil {
+		return nil, nil
+	}
+	leaf := t.root.firstLeaf(t)
+	return leaf.key, leaf.value
+}
+
+// LastKey returns the largest key of the tree and its value, or nil if the tree is empty.
+func (t *ImmutableTree) LastKey() (key []byte, value []byte) {
+	if t.root == nil {
+		return nil, nil
+	}
+	leaf := t.root.lastLeaf(t)
+	return leaf.key, leaf.value
+}
+
+// Floor returns the greatest key less than or equal to the given key and its value, or nil if
+// there is none.
+func (t *ImmutableTree) Floor(key []byte) ([]byte, []byte) {
+	if t.root == nil {
+		return nil, nil
+	}
+	if leaf := t.root.floor(t, key); leaf != nil {
+		return leaf.key, leaf.value
+	}
+	return nil, nil
+}
+
+// Ceiling returns the smallest key greater than or equal to the given key and its value, or nil
+// if there is none.
+func (t *ImmutableTree) Ceiling(key []byte) ([]byte, []byte) {
+	if t.root == nil {
+		return nil, nil
+	}
+	if leaf := t.root.ceiling(t, key); leaf != nil {
+		return leaf.key, leaf.value
+	}
+	return nil, nil
+}
+
+// CountRange returns the number of keys in the range [start, end), where nil start or end means
+// an open bound. The count is computed from the subtree sizes along the paths to the bounds, in
+// O(log n) rather than by iterating. See GetRangeCountProof for a verifiable variant.
+func (t *ImmutableTree) CountRange(start, end []byte) (int64, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) > 0 {
+		return 0, errors.Errorf("range start %X is after end %X", start, end)
+	}
+	if t.root == nil {
+		return 0, nil
+	}
+	var startIndex int64
+	if start != nil {
+		startIndex, _ = t.GetWithIndex(start)
+	}
+	endIndex := t.root.size
+	if end != nil {
+		endIndex, _ = t.GetWithIndex(end)
+	}
+	return endIndex - startIndex, nil
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) bool {
@@ -223,6 +395,29 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) bool {
 	return false
 }
 
+// IterateContext is like Iterate, but stops with the context's error if ctx is done. Since
+// ctx is checked between keys, a database read which never returns still blocks.
+func (t *ImmutableTree) IterateContext(ctx context.Context, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if t.root == nil {
+		return false, nil
+	}
+
+	itr := t.Iterator(nil, nil, true)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if fn(itr.Key(), itr.Value()) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
 // Iterator returns an iterator over the immutable tree.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) dbm.Iterator {
 	if t.IsFastCacheEnabled() {
@@ -270,8 +465,11 @@ func (t *ImmutableTree) IsFastCacheEnabled() bool {
 	return t.isLatestTreeVersion() && t.ndb.hasUpgradedToFastStorage()
 }
 
+// isLatestTreeVersion returns true if the tree is of the latest version. It returns false if the
+// latest version can't be read, so that reads fall back to the tree.
 func (t *ImmutableTree) isLatestTreeVersion() bool {
-	return t.version == t.ndb.getLatestVersion()
+	latest, err := t.ndb.getLatestVersion()
+	return err == nil && t.version == latest
 }
 
 // Clone creates a clone of the tree.
@@ -284,6 +482,19 @@ func (t *ImmutableTree) clone() *ImmutableTree {
 	}
 }
 
+// getNode loads a node of the tree, recording the read if the tree is traced.
+func (t *ImmutableTree) getNode(hash []byte) *Node {
+	if t.stats == nil {
+		return t.ndb.GetNode(hash)
+	}
+	return t.ndb.getNodeFrom(t.ndb.db, hash, true, t.stats)
+}
+
+// getFastNode loads a fast node, recording the read if the tree is traced.
+func (t *ImmutableTree) getFastNode(key []byte) (*FastNode, error) {
+	return t.ndb.getFastNode(key, t.stats)
+}
+
 // nodeSize is like Size, but includes inner nodes too.
 func (t *ImmutableTree) nodeSize() int {
 	size := 0
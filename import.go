@@ -2,6 +2,8 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 
 	"github.com/pkg/errors"
 
@@ -22,11 +24,17 @@ var ErrNoImport = errors.New("no import in progress")
 // Importer is not concurrency-safe, it is the caller's responsibility to ensure the tree is not
 // modified while performing an import.
 type Importer struct {
+	ctx       context.Context // see MutableTree.ImportContext()
 	tree      *MutableTree
 	version   int64
 	batch     db.Batch
 	batchSize uint32
 	stack     []*Node
+	digest    *exportDigest // see VerifyAttestation
+
+	// Chunked import state, see MutableTree.ImportChunks().
+	manifest    *ExportManifest
+	chunkHashes [][]byte
 }
 
 // newImporter creates a new Importer for an empty MutableTree.
@@ -45,10 +53,12 @@ func newImporter(tree *MutableTree, version int64) (*Importer, error) {
 	}
 
 	return &Importer{
+		ctx:     context.Background(),
 		tree:    tree,
 		version: version,
 		batch:   tree.ndb.db.NewBatch(),
 		stack:   make([]*Node, 0, 8),
+		digest:  newExportDigest(),
 	}, nil
 }
 
@@ -69,6 +79,9 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if err := i.ctx.Err(); err != nil {
+		return err
+	}
 	if exportNode == nil {
 		return errors.New("node cannot be nil")
 	}
@@ -77,6 +90,34 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 			exportNode.Version, i.version)
 	}
 
+	// We don't modify the stack until we've verified the built node, to avoid leaving the
+	// importer in an inconsistent state when we return an error.
+	node, children, err := buildImportNode(exportNode, i.stack)
+	if err != nil {
+		return err
+	}
+	if err = i.writeNode(node); err != nil {
+		return err
+	}
+
+	// Update the stack now that we know there were no errors
+	i.stack = append(i.stack[:len(i.stack)-children], node)
+	if i.digest != nil {
+		i.digest.add(exportNode)
+	}
+
+	return nil
+}
+
+// buildImportNode builds and validates the node of an ExportNode, taking its children from the
+// top of the stack, and returns it along with the number of children taken. The stack is not
+// modified.
+//
+// We build the tree from the bottom-left up. The stack is used to store unresolved left
+// children while constructing right children. When all children are built, the parent can
+// be constructed and the resolved children can be discarded from the stack. Using a stack
+// ensures that we can handle additional unresolved left children while building a right branch.
+func buildImportNode(exportNode *ExportNode, stack []*Node) (*Node, int, error) {
 	node := &Node{
 		key:     exportNode.Key,
 		value:   exportNode.Value,
@@ -84,23 +125,19 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		height:  exportNode.Height,
 	}
 
-	// We build the tree from the bottom-left up. The stack is used to store unresolved left
-	// children while constructing right children. When all children are built, the parent can
-	// be constructed and the resolved children can be discarded from the stack. Using a stack
-	// ensures that we can handle additional unresolved left children while building a right branch.
-	//
-	// We don't modify the stack until we've verified the built node, to avoid leaving the
-	// importer in an inconsistent state when we return an error.
-	stackSize := len(i.stack)
+	children := 0
+	stackSize := len(stack)
 	switch {
-	case stackSize >= 2 && i.stack[stackSize-1].height < node.height && i.stack[stackSize-2].height < node.height:
-		node.leftNode = i.stack[stackSize-2]
+	case stackSize >= 2 && stack[stackSize-1].height < node.height && stack[stackSize-2].height < node.height:
+		node.leftNode = stack[stackSize-2]
 		node.leftHash = node.leftNode.hash
-		node.rightNode = i.stack[stackSize-1]
+		node.rightNode = stack[stackSize-1]
 		node.rightHash = node.rightNode.hash
-	case stackSize >= 1 && i.stack[stackSize-1].height < node.height:
-		node.leftNode = i.stack[stackSize-1]
+		children = 2
+	case stackSize >= 1 && stack[stackSize-1].height < node.height:
+		node.leftNode = stack[stackSize-1]
 		node.leftHash = node.leftNode.hash
+		children = 1
 	}
 
 	if node.height == 0 {
@@ -114,41 +151,60 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 	}
 
 	node._hash()
-	err := node.validate()
-	if err != nil {
-		return err
+	if err := node.validate(); err != nil {
+		return nil, 0, err
 	}
+	return node, children, nil
+}
 
+// writeNode writes a built node to the batch, flushing it when full.
+func (i *Importer) writeNode(node *Node) error {
 	var buf bytes.Buffer
-	err = node.writeBytes(&buf)
+	if err := node.writeBytes(&buf); err != nil {
+		return err
+	}
+	bz, err := i.tree.ndb.encryptValue(buf.Bytes())
 	if err != nil {
 		return err
 	}
-
-	if err = i.batch.Set(i.tree.ndb.nodeKey(node.hash), buf.Bytes()); err != nil {
+	if err := i.batch.Set(i.tree.ndb.nodeKey(node.hash), bz); err != nil {
 		return err
 	}
+	// Every node of an imported tree is referenced once, by its parent or the version root.
+	if i.tree.ndb.opts.RefCountGC {
+		if err := i.batch.Set(refCountKeyFormat.Key(node.hash), formatUint64(1)); err != nil {
+			return err
+		}
+	}
 
 	i.batchSize++
 	if i.batchSize >= maxBatchSize {
-		err = i.batch.Write()
-		if err != nil {
-			return err
-		}
-		i.batch.Close()
-		i.batch = i.tree.ndb.db.NewBatch()
-		i.batchSize = 0
+		return i.flush()
 	}
+	return nil
+}
 
-	// Update the stack now that we know there were no errors
-	switch {
-	case node.leftHash != nil && node.rightHash != nil:
-		i.stack = i.stack[:stackSize-2]
-	case node.leftHash != nil || node.rightHash != nil:
-		i.stack = i.stack[:stackSize-1]
+// rootHash returns the root hash of the nodes added so far, or an error if they don't form a
+// complete tree.
+func (i *Importer) rootHash() ([]byte, error) {
+	switch len(i.stack) {
+	case 0:
+		return sha256.New().Sum(nil), nil
+	case 1:
+		return i.stack[0].hash, nil
+	default:
+		return nil, errors.Errorf("import is incomplete, found stack size %v", len(i.stack))
 	}
-	i.stack = append(i.stack, node)
+}
 
+// flush writes the batch to the database and starts a new one.
+func (i *Importer) flush() error {
+	if err := i.batch.Write(); err != nil {
+		return err
+	}
+	i.batch.Close()
+	i.batch = i.tree.ndb.db.NewBatch()
+	i.batchSize = 0
 	return nil
 }
 
@@ -159,13 +215,19 @@ func (i *Importer) Commit() error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if err := i.ctx.Err(); err != nil {
+		return err
+	}
 
+	var rootHash []byte
 	switch len(i.stack) {
 	case 0:
+		rootHash = sha256.New().Sum(nil)
 		if err := i.batch.Set(i.tree.ndb.rootKey(i.version), []byte{}); err != nil {
 			panic(err)
 		}
 	case 1:
+		rootHash = i.stack[0].hash
 		if err := i.batch.Set(i.tree.ndb.rootKey(i.version), i.stack[0].hash); err != nil {
 			panic(err)
 		}
@@ -173,11 +235,23 @@ func (i *Importer) Commit() error {
 		return errors.Errorf("invalid node structure, found stack size %v when committing",
 			len(i.stack))
 	}
+	if i.manifest != nil {
+		if err := i.checkManifest(rootHash); err != nil {
+			return err
+		}
+	}
+	if i.tree.ndb.opts.RefCountGC {
+		err := i.batch.Set(metadataKeyFormat.Key([]byte(refCountStorageKey)), []byte(refCountStorageVersion))
+		if err != nil {
+			return err
+		}
+	}
 
 	err := i.batch.WriteSync()
 	if err != nil {
 		return err
 	}
+	i.tree.ndb.refCounted = i.tree.ndb.opts.RefCountGC || i.tree.ndb.refCounted
 	i.tree.ndb.resetLatestVersion(i.version)
 
 	_, err = i.tree.LoadVersion(i.version)
@@ -0,0 +1,187 @@
+package iavl
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pkg/errors"
+	db "github.com/tendermint/tm-db"
+)
+
+// importItem is an entry of the residual of a chunk built by importChunkWorker: either a node
+// that was fully built from the chunk, or an export node whose children (in part) come from
+// earlier chunks, and which must be built sequentially.
+type importItem struct {
+	node     *Node
+	deferred *ExportNode
+}
+
+// importChunkWorker builds the subtrees of a single chunk that don't depend on earlier chunks,
+// writing their nodes to its own batch.
+type importChunkWorker struct {
+	ndb       *nodeDB
+	batch     db.Batch
+	batchSize uint32
+}
+
+// build builds the nodes of a chunk in post-order, like Importer.Add(), using a local stack.
+// A node is only built locally if the local stack determines its children, otherwise the local
+// stack and the node are appended to the returned residual, to be replayed in order onto the
+// importer stack once the earlier chunks have been added. The residual is thus at most a few
+// nodes per tree level.
+func (w *importChunkWorker) build(chunk *ExportChunk, version int64) ([]importItem, error) {
+	residual := []importItem{}
+	stack := make([]*Node, 0, 8)
+	for _, exportNode := range chunk.Nodes {
+		if exportNode == nil {
+			return nil, errors.New("node cannot be nil")
+		}
+		if exportNode.Version > version {
+			return nil, errors.Errorf("node version %v can't be greater than import version %v",
+				exportNode.Version, version)
+		}
+
+		// An inner node whose children are not both on the local stack may have a child from an
+		// earlier chunk, unless the local top isn't a child, which buildImportNode rejects.
+		if exportNode.Height > 0 && len(stack) < 2 &&
+			(len(stack) == 0 || stack[len(stack)-1].height < exportNode.Height) {
+			for _, node := range stack {
+				residual = append(residual, importItem{node: node})
+			}
+			residual = append(residual, importItem{deferred: exportNode})
+			stack = stack[:0]
+			continue
+		}
+
+		node, children, err := buildImportNode(exportNode, stack)
+		if err != nil {
+			return nil, err
+		}
+		if err = w.write(node); err != nil {
+			return nil, err
+		}
+		stack = append(stack[:len(stack)-children], node)
+	}
+	for _, node := range stack {
+		residual = append(residual, importItem{node: node})
+	}
+	return residual, w.batch.Write()
+}
+
+func (w *importChunkWorker) write(node *Node) error {
+	var buf bytes.Buffer
+	if err := node.writeBytes(&buf); err != nil {
+		return err
+	}
+	bz, err := w.ndb.encryptValue(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := w.batch.Set(w.ndb.nodeKey(node.hash), bz); err != nil {
+		return err
+	}
+	if w.ndb.opts.RefCountGC {
+		if err := w.batch.Set(refCountKeyFormat.Key(node.hash), formatUint64(1)); err != nil {
+			return err
+		}
+	}
+	w.batchSize++
+	if w.batchSize >= maxBatchSize {
+		if err := w.batch.Write(); err != nil {
+			return err
+		}
+		w.batch.Close()
+		w.batch = w.ndb.db.NewBatch()
+		w.batchSize = 0
+	}
+	return nil
+}
+
+// AddChunksParallel adds consecutive chunks to a chunked import like AddChunk(), but verifies
+// the chunks and writes the subtrees contained in each chunk concurrently, using the given number
+// of workers. Since nodes are addressed by hash, they can be written in any order; only the nodes
+// spanning several chunks are then built sequentially. Commit() verifies the resulting root hash
+// against the manifest.
+//
+// The node stream is not hashed, so VerifyAttestation() can't be used after adding chunks in
+// parallel. The progress is persisted once all chunks have been added, and if this fails the
+// importer must be closed and the import resumed.
+func (i *Importer) AddChunksParallel(chunks []*ExportChunk, workers int) error {
+	if i.tree == nil {
+		return ErrNoImport
+	}
+	if i.manifest == nil {
+		return errors.New("not a chunked import")
+	}
+	if workers <= 0 {
+		return errors.New("number of workers must be positive")
+	}
+	next := i.ChunksApplied()
+	for j, chunk := range chunks {
+		if chunk == nil {
+			return errors.New("chunk cannot be nil")
+		}
+		if chunk.Index != next+int64(j) {
+			return errors.Errorf("expected chunk %v, got chunk %v", next+int64(j), chunk.Index)
+		}
+		if chunk.Index >= int64(len(i.manifest.ChunkHashes)) {
+			return errors.Wrapf(ErrChunkMismatch, "chunk %v is not in the manifest", chunk.Index)
+		}
+	}
+
+	residuals := make([][]importItem, len(chunks))
+	errs := make([]error, len(chunks))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(chunks); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range indexes {
+				if errs[j] = i.ctx.Err(); errs[j] != nil {
+					continue
+				}
+				chunk := chunks[j]
+				if hash := hashExportChunk(chunk.Nodes); !bytes.Equal(hash, i.manifest.ChunkHashes[chunk.Index]) {
+					errs[j] = errors.Wrapf(ErrChunkMismatch, "hash %X, expected %X", hash,
+						i.manifest.ChunkHashes[chunk.Index])
+					continue
+				}
+				worker := &importChunkWorker{ndb: i.tree.ndb, batch: i.tree.ndb.db.NewBatch()}
+				residuals[j], errs[j] = worker.build(chunk, i.version)
+				worker.batch.Close()
+			}
+		}()
+	}
+	for j := range chunks {
+		indexes <- j
+	}
+	close(indexes)
+	wg.Wait()
+	for j, err := range errs {
+		if err != nil {
+			return errors.Wrapf(err, "chunk %v", chunks[j].Index)
+		}
+	}
+
+	// Replay the residuals onto the importer stack, in order.
+	i.digest = nil
+	for j, residual := range residuals {
+		for _, item := range residual {
+			if item.node != nil {
+				i.stack = append(i.stack, item.node)
+				continue
+			}
+			node, children, err := buildImportNode(item.deferred, i.stack)
+			if err != nil {
+				return errors.Wrapf(err, "chunk %v", chunks[j].Index)
+			}
+			if err = i.writeNode(node); err != nil {
+				return err
+			}
+			i.stack = append(i.stack[:len(i.stack)-children], node)
+		}
+		i.chunkHashes = append(i.chunkHashes, i.manifest.ChunkHashes[chunks[j].Index])
+	}
+	return i.saveProgress()
+}
@@ -0,0 +1,72 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestImporter_AddChunksParallel(t *testing.T) {
+	trees := map[string]*ImmutableTree{
+		"empty tree":  NewImmutableTree(db.NewMemDB(), 0),
+		"basic tree":  setupExportTreeBasic(t),
+		"random tree": setupExportTreeRandom(t),
+	}
+	for desc, itree := range trees {
+		for _, size := range []int{1, 3, 64} {
+			for _, workers := range []int{1, 4} {
+				itree, size, workers := itree, size, workers
+				t.Run(fmt.Sprintf("%v size=%v workers=%v", desc, size, workers), func(t *testing.T) {
+					chunks, manifest := exportChunks(t, itree, size)
+
+					tree, err := NewMutableTree(db.NewMemDB(), 0)
+					require.NoError(t, err)
+					importer, err := tree.ImportChunks(manifest)
+					require.NoError(t, err)
+					defer importer.Close()
+					require.NoError(t, importer.AddChunksParallel(chunks, workers))
+					require.NoError(t, importer.Commit())
+					require.Equal(t, itree.Hash(), tree.Hash())
+					require.EqualValues(t, itree.Size(), tree.Size())
+				})
+			}
+		}
+	}
+}
+
+func TestImporter_AddChunksParallelResume(t *testing.T) {
+	itree := setupExportTreeSized(t, 4096)
+	chunks, manifest := exportChunks(t, itree, 300)
+	require.Greater(t, len(chunks), 10)
+
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err := tree.ImportChunks(manifest)
+	require.NoError(t, err)
+	require.NoError(t, importer.AddChunk(chunks[0]))
+	require.NoError(t, importer.AddChunksParallel(chunks[1:5], 3))
+	require.Error(t, importer.AddChunksParallel(chunks[6:8], 3))
+	require.Error(t, importer.VerifyAttestation(&ExportAttestation{}, nil))
+	importer.Close()
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	importer, err = tree.ImportChunks(manifest)
+	require.NoError(t, err)
+	defer importer.Close()
+	require.EqualValues(t, 5, importer.ChunksApplied())
+
+	tampered := *chunks[6]
+	tampered.Nodes = tampered.Nodes[1:]
+	err = importer.AddChunksParallel([]*ExportChunk{chunks[5], &tampered}, 2)
+	require.True(t, errors.Is(err, ErrChunkMismatch))
+	require.EqualValues(t, 5, importer.ChunksApplied())
+
+	require.NoError(t, importer.AddChunksParallel(chunks[5:], 4))
+	require.NoError(t, importer.Commit())
+	require.Equal(t, itree.Hash(), tree.Hash())
+}
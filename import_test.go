@@ -1,6 +1,8 @@
 package iavl
 
 import (
+	"fmt"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -212,6 +214,87 @@ func TestImporter_Commit_Empty(t *testing.T) {
 	assert.EqualValues(t, 3, tree.Version())
 }
 
+// sliceLeafStream is a LeafStream over a slice of key/value pairs.
+type sliceLeafStream struct {
+	pairs [][2][]byte
+}
+
+func (s *sliceLeafStream) Next() ([]byte, []byte, error) {
+	if len(s.pairs) == 0 {
+		return nil, nil, io.EOF
+	}
+	pair := s.pairs[0]
+	s.pairs = s.pairs[1:]
+	return pair[0], pair[1], nil
+}
+
+func TestMutableTree_ImportLeaves(t *testing.T) {
+	for _, count := range []int{0, 1, 2, 3, 7, 100, 1000} {
+		pairs := make([][2][]byte, count)
+		for i := range pairs {
+			pairs[i] = [2][]byte{[]byte(fmt.Sprintf("key%06d", i)), []byte{byte(i)}}
+		}
+
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		report, err := tree.ImportLeaves(3, int64(count), &sliceLeafStream{pairs: pairs})
+		require.NoError(t, err)
+		require.EqualValues(t, 3, report.Version)
+		require.EqualValues(t, count, report.Leaves)
+		require.Equal(t, tree.Hash(), report.RootHash)
+		require.EqualValues(t, 3, tree.Version())
+		require.EqualValues(t, count, tree.Size())
+
+		// The tree contains all leaves, and is balanced.
+		i := 0
+		tree.Iterate(func(key, value []byte) bool {
+			require.Equal(t, pairs[i][0], key)
+			require.Equal(t, pairs[i][1], value)
+			i++
+			return false
+		})
+		require.Equal(t, count, i)
+		if tree.root != nil {
+			tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+				if node.height > 0 {
+					left, right := node.getLeftNode(tree.ImmutableTree), node.getRightNode(tree.ImmutableTree)
+					require.LessOrEqual(t, int(left.height)-int(right.height), 1)
+					require.LessOrEqual(t, int(right.height)-int(left.height), 1)
+				}
+				return false
+			})
+		}
+
+		// The tree can be modified further.
+		tree.Set([]byte("key"), []byte{1})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestMutableTree_ImportLeaves_Invalid(t *testing.T) {
+	pairs := [][2][]byte{{[]byte("a"), {1}}, {[]byte("c"), {2}}, {[]byte("b"), {3}}}
+	testcases := map[string]struct {
+		pairs [][2][]byte
+		count int64
+	}{
+		"unordered": {pairs, 3},
+		"too few":   {pairs[:2], 3},
+		"too many":  {pairs[:2], 1},
+		"nil value": {[][2][]byte{{[]byte("a"), nil}}, 1},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			tree, err := NewMutableTree(db.NewMemDB(), 0)
+			require.NoError(t, err)
+			_, err = tree.ImportLeaves(1, tc.count, &sliceLeafStream{pairs: tc.pairs})
+			require.Error(t, err)
+			require.Zero(t, tree.Version())
+		})
+	}
+}
+
 func BenchmarkImport(b *testing.B) {
 	b.StopTimer()
 	tree := setupExportTreeSized(b, 4096)
@@ -0,0 +1,372 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+const (
+	// indexPrefix prefixes the entries of secondary indexes in the metadata keyspace. It is
+	// followed by the index name, a 0x00 separator, the escaped term, see appendIndexTerm, and
+	// the tree key.
+	indexPrefix = "index/"
+	// indexStalePrefix prefixes the markers of indexes which no longer match the latest saved
+	// version, in the metadata keyspace. It is followed by the index name.
+	indexStalePrefix = "index_stale/"
+	// indexRebuildBatchBytes is the size of the keys and values written by RebuildIndex above
+	// which its batch is written, unless Options.MaxBatchBytes is set.
+	indexRebuildBatchBytes = 1 << 22
+)
+
+// ErrIndexStale is returned when iterating over an index which no longer matches the latest
+// saved version, see MutableTree.RebuildIndex.
+var ErrIndexStale = errors.New("index is stale")
+
+// IndexEntry is an entry of a secondary index, under which the key it was extracted from is found
+// by an IndexIterator.
+type IndexEntry struct {
+	Term []byte
+}
+
+// IndexExtractor returns the index entries of a key and its value, e.g. the owner of an account
+// decoded from the value. It must be deterministic, and must not retain or modify the slices.
+type IndexExtractor func(key, value []byte) []IndexEntry
+
+// RegisterIndex registers a secondary index, maintained in the same batch as each saved version,
+// so that it always matches the latest saved version. Indexes must be registered each time the
+// tree is opened, before saving versions. Registering an index for a tree with saved versions
+// requires a RebuildIndex. Registered indexes are rebuilt by LoadVersionForOverwriting, while
+// other indexes are marked stale until they are rebuilt.
+func (tree *MutableTree) RegisterIndex(name string, extract IndexExtractor) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 {
+		return errors.Errorf("invalid index name %q", name)
+	}
+	if _, ok := tree.indexes[name]; ok {
+		return errors.Errorf("index %q is already registered", name)
+	}
+	if tree.indexes == nil {
+		tree.indexes = map[string]IndexExtractor{}
+	}
+	tree.indexes[name] = extract
+	return nil
+}
+
+// RebuildIndex replaces the entries of a registered index with those of the latest saved
+// version. It writes its own batches, whenever they exceed Options.MaxBatchBytes or 4 MiB, so
+// the index is stale until it returns, and must be rebuilt again if it fails.
+func (tree *MutableTree) RebuildIndex(name string) error {
+	extract, ok := tree.indexes[name]
+	if !ok {
+		return errors.Errorf("index %q is not registered", name)
+	}
+	prefix := indexEntryPrefix(name)
+	maxBytes := tree.ndb.opts.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = indexRebuildBatchBytes
+	}
+	batch := newSizedBatch(tree.ndb.db.NewBatch())
+	defer func() { batch.Close() }()
+	flush := func() error {
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		batch.Close()
+		batch = newSizedBatch(tree.ndb.db.NewBatch())
+		return nil
+	}
+
+	// The index is marked stale first, so that an interrupted rebuild is not mistaken for a
+	// complete one.
+	if err := batch.Set(indexStaleKey(name), []byte{}); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// Since some databases don't allow writes while an iterator is open, the iterator is closed
+	// before writing and reopened after the last key seen.
+	start, end := prefix, cpIncr(prefix)
+	for start != nil {
+		var next []byte
+		err := tree.ndb.traverseRange(start, end, func(k, v []byte) error {
+			if err := batch.Delete(k); err != nil {
+				return err
+			}
+			if batch.size >= maxBytes {
+				next = cpSucc(k)
+				return errStopTraversal
+			}
+			return nil
+		})
+		if err != nil && err != errStopTraversal {
+			return err
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		start = next
+	}
+
+	var err error
+	saved := tree.lastSaved
+	if saved.root != nil {
+		saved.root.traverse(saved, true, func(node *Node) bool {
+			if !node.isLeaf() {
+				return false
+			}
+			for _, entry := range extract(node.key, node.value) {
+				if err = batch.Set(indexEntryKey(prefix, entry.Term, node.key), node.key); err != nil {
+					return true
+				}
+			}
+			if batch.size >= maxBytes {
+				err = flush()
+			}
+			return err != nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if err := batch.Delete(indexStaleKey(name)); err != nil {
+		return err
+	}
+	if tree.ndb.opts.Sync {
+		return batch.WriteSync()
+	}
+	return batch.Write()
+}
+
+// rebuildIndexes rebuilds all registered indexes, see RebuildIndex.
+func (tree *MutableTree) rebuildIndexes() error {
+	names := make([]string, 0, len(tree.indexes))
+	for name := range tree.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := tree.RebuildIndex(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markIndexesStale marks all indexes with entries as stale, writing to the batch. It is used when
+// deleting the latest versions, whose changes the index entries reflect.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) markIndexesStale() error {
+	base := metadataKeyFormat.Key([]byte(indexPrefix))
+	start, end := base, cpIncr(base)
+	for {
+		var name []byte
+		err := ndb.traverseRange(start, end, func(k, v []byte) error {
+			i := bytes.IndexByte(k[len(base):], 0)
+			if i < 0 {
+				return errors.Errorf("invalid index entry %X", k)
+			}
+			name = append([]byte{}, k[len(base):len(base)+i]...)
+			return errStopTraversal
+		})
+		if err != nil && err != errStopTraversal {
+			return err
+		}
+		if name == nil {
+			return nil
+		}
+		if err := ndb.batch.Set(indexStaleKey(string(name)), []byte{}); err != nil {
+			return err
+		}
+		start = cpIncr(indexEntryPrefix(string(name)))
+	}
+}
+
+func indexStaleKey(name string) []byte {
+	return metadataKeyFormat.Key([]byte(indexStalePrefix + name))
+}
+
+// saveIndexes updates the registered indexes for the keys changed since the last saved version,
+// writing to the batch. Previous values are read from the nodes of the last saved version, which
+// are immutable, so fast nodes flushed early don't affect them.
+func (tree *MutableTree) saveIndexes() error {
+	if len(tree.indexes) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(tree.indexes))
+	for name := range tree.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changed := tree.unsavedChanges()
+	saved := tree.lastSaved
+
+	// Entries of previous values are deleted before entries of new values are set, so entries in
+	// both are kept.
+	var ops []BatchOp
+	for _, kv := range changed {
+		var previous []byte
+		if saved.root != nil {
+			_, previous = saved.root.get(saved, kv.Key)
+		}
+		for _, name := range names {
+			extract, prefix := tree.indexes[name], indexEntryPrefix(name)
+			if previous != nil {
+				for _, entry := range extract(kv.Key, previous) {
+					ops = append(ops, BatchOp{Key: indexEntryKey(prefix, entry.Term, kv.Key), Delete: true})
+				}
+			}
+			if kv.Value != nil {
+				for _, entry := range extract(kv.Key, kv.Value) {
+					ops = append(ops, BatchOp{Key: indexEntryKey(prefix, entry.Term, kv.Key), Value: kv.Key})
+				}
+			}
+		}
+	}
+
+	tree.ndb.mtx.Lock()
+	defer tree.ndb.mtx.Unlock()
+	for _, op := range ops {
+		var err error
+		if op.Delete {
+			err = tree.ndb.batch.Delete(op.Key)
+		} else {
+			err = tree.ndb.batch.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexEntryPrefix(name string) []byte {
+	return metadataKeyFormat.Key([]byte(indexPrefix + name + "\x00"))
+}
+
+func indexEntryKey(prefix, term, key []byte) []byte {
+	k := make([]byte, 0, len(prefix)+len(term)+2+len(key))
+	k = append(k, prefix...)
+	k = appendIndexTerm(k, term)
+	return append(k, key...)
+}
+
+// appendIndexTerm appends a term escaped such that the entries of an index sort by term and then
+// key: 0x00 bytes are escaped as 0x00 0xff, and the term is terminated by 0x00 0x01.
+func appendIndexTerm(buf, term []byte) []byte {
+	for _, b := range term {
+		buf = append(buf, b)
+		if b == 0x00 {
+			buf = append(buf, 0xff)
+		}
+	}
+	return append(buf, 0x00, 0x01)
+}
+
+// IndexIterator iterates over the entries of a secondary index in term and then key order, see
+// MutableTree.IndexIterator.
+type IndexIterator struct {
+	itr     dbm.Iterator
+	prefix  []byte
+	term    []byte
+	err     error
+	untrack func() // unregisters the iterator from the nodeDB, see nodeDB.Close
+}
+
+// IndexIterator returns an iterator over the entries of an index with terms in [start, end), at
+// the latest saved version. A nil start or end is unbounded. The index doesn't need to be
+// registered. It returns ErrIndexStale if the index must be rebuilt, see RebuildIndex.
+func (tree *MutableTree) IndexIterator(name string, start, end []byte) (*IndexIterator, error) {
+	stale, err := tree.ndb.db.Has(indexStaleKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		return nil, errors.Wrapf(ErrIndexStale, "index %q", name)
+	}
+	prefix := indexEntryPrefix(name)
+	startKey := prefix
+	if start != nil {
+		startKey = appendIndexTerm(append([]byte{}, prefix...), start)
+		startKey = startKey[:len(startKey)-2]
+	}
+	endKey := cpIncr(prefix)
+	if end != nil {
+		endKey = appendIndexTerm(append([]byte{}, prefix...), end)
+		endKey = endKey[:len(endKey)-2]
+	}
+	itr, err := tree.ndb.db.Iterator(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	iter := &IndexIterator{itr: itr, prefix: prefix}
+	iter.untrack = tree.ndb.resources.track(func() { iter.Close() })
+	iter.decode()
+	return iter, nil
+}
+
+// decode decodes the term of the current entry.
+func (iter *IndexIterator) decode() {
+	iter.term = nil
+	if !iter.itr.Valid() {
+		return
+	}
+	k := iter.itr.Key()[len(iter.prefix):]
+	term := []byte{}
+	for i := 0; i < len(k)-1; i++ {
+		if k[i] != 0x00 {
+			term = append(term, k[i])
+			continue
+		}
+		if k[i+1] == 0x01 {
+			iter.term = term
+			return
+		}
+		term = append(term, 0x00)
+		i++
+	}
+	iter.err = errors.Errorf("invalid index entry %X", iter.itr.Key())
+}
+
+// Valid returns true if the iterator is positioned at an entry.
+func (iter *IndexIterator) Valid() bool {
+	return iter.err == nil && iter.itr.Valid()
+}
+
+// Next moves to the next entry.
+func (iter *IndexIterator) Next() {
+	iter.itr.Next()
+	iter.decode()
+}
+
+// Term returns the term of the current entry.
+func (iter *IndexIterator) Term() []byte {
+	return iter.term
+}
+
+// Key returns the tree key of the current entry.
+func (iter *IndexIterator) Key() []byte {
+	return iter.itr.Value()
+}
+
+// Error returns the error of the iterator, if any.
+func (iter *IndexIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.itr.Error()
+}
+
+// Close closes the iterator.
+func (iter *IndexIterator) Close() error {
+	if iter.untrack == nil {
+		return nil
+	}
+	iter.untrack()
+	iter.untrack = nil
+	return iter.itr.Close()
+}
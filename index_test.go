@@ -0,0 +1,89 @@
+package iavl
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// ownerIndex indexes values of the form owner:data by owner.
+func ownerIndex(key, value []byte) []IndexEntry {
+	i := bytes.IndexByte(value, ':')
+	if i < 0 {
+		return nil
+	}
+	return []IndexEntry{{Term: value[:i]}}
+}
+
+func indexEntries(t *testing.T, tree *MutableTree, name string, start, end []byte) []string {
+	itr, err := tree.IndexIterator(name, start, end)
+	require.NoError(t, err)
+	defer itr.Close()
+	var entries []string
+	for ; itr.Valid(); itr.Next() {
+		entries = append(entries, string(itr.Term())+"="+string(itr.Key()))
+	}
+	require.NoError(t, itr.Error())
+	return entries
+}
+
+func TestSecondaryIndex(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	require.NoError(t, tree.RegisterIndex("owner", ownerIndex))
+	require.Error(t, tree.RegisterIndex("owner", ownerIndex))
+	require.Error(t, tree.RegisterIndex("", ownerIndex))
+
+	tree.Set([]byte("acc1"), []byte("alice:10"))
+	tree.Set([]byte("acc2"), []byte("bob:20"))
+	tree.Set([]byte("acc3"), []byte("alice:30"))
+	tree.Set([]byte("acc4"), []byte("a\x00b:40"))
+	tree.Set([]byte("acc5"), []byte("unindexed"))
+	require.Empty(t, indexEntries(t, tree, "owner", nil, nil))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a\x00b=acc4", "alice=acc1", "alice=acc3", "bob=acc2"},
+		indexEntries(t, tree, "owner", nil, nil))
+	require.Equal(t, []string{"alice=acc1", "alice=acc3"},
+		indexEntries(t, tree, "owner", []byte("alice"), []byte("b")))
+	require.Equal(t, []string{"a\x00b=acc4"}, indexEntries(t, tree, "owner", []byte("a"), []byte("al")))
+
+	// Entries follow updates and removals, and unchanged entries are kept.
+	tree.Set([]byte("acc1"), []byte("bob:10"))
+	tree.Set([]byte("acc3"), []byte("alice:31"))
+	tree.Remove([]byte("acc2"))
+	tree.Remove([]byte("acc4"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice=acc3", "bob=acc1"}, indexEntries(t, tree, "owner", nil, nil))
+
+	// A new index is built from the latest saved version.
+	tree.Set([]byte("acc6"), []byte("carol:60"))
+	require.NoError(t, tree.RegisterIndex("ownerCopy", ownerIndex))
+	require.NoError(t, tree.RebuildIndex("ownerCopy"))
+	require.Equal(t, []string{"alice=acc3", "bob=acc1"}, indexEntries(t, tree, "ownerCopy", nil, nil))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, indexEntries(t, tree, "owner", nil, nil), indexEntries(t, tree, "ownerCopy", nil, nil))
+	require.Len(t, indexEntries(t, tree, "owner", nil, nil), 3)
+
+	// Loading an older version for overwriting rebuilds registered indexes, and marks others
+	// stale until they are rebuilt.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{MaxBatchBytes: 1})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.NoError(t, tree.RegisterIndex("owner", ownerIndex))
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a\x00b=acc4", "alice=acc1", "alice=acc3", "bob=acc2"},
+		indexEntries(t, tree, "owner", nil, nil))
+	_, err = tree.IndexIterator("ownerCopy", nil, nil)
+	require.ErrorIs(t, err, ErrIndexStale)
+	require.NoError(t, tree.RegisterIndex("ownerCopy", ownerIndex))
+	require.NoError(t, tree.RebuildIndex("ownerCopy"))
+	require.Equal(t, indexEntries(t, tree, "owner", nil, nil), indexEntries(t, tree, "ownerCopy", nil, nil))
+}
@@ -0,0 +1,71 @@
+package iavl
+
+import "fmt"
+
+// OrphanEntry is an orphan record of the database: a node created in version From which is no
+// longer referenced by versions after To, and is deleted once versions From through To are.
+type OrphanEntry struct {
+	From int64
+	To   int64
+	Hash []byte
+}
+
+// String returns a string representation of the entry.
+func (e OrphanEntry) String() string {
+	return fmt.Sprintf("OrphanEntry{%X versions %d-%d}", e.Hash, e.From, e.To)
+}
+
+// RootEntry is a root record of the database: the root hash of a saved version. The hash is empty
+// for versions of an empty tree.
+type RootEntry struct {
+	Version int64
+	Hash    []byte
+}
+
+// String returns a string representation of the entry.
+func (e RootEntry) String() string {
+	return fmt.Sprintf("RootEntry{version %d: %X}", e.Version, e.Hash)
+}
+
+// IterateOrphans calls fn for each orphan record in the database, ordered by To and then From,
+// until fn returns true. Together with IterateRoots, it lets monitoring tools track the
+// accumulation of orphans and the pruning backlog. The byte slices passed to fn must not be
+// retained.
+func (tree *MutableTree) IterateOrphans(fn func(entry OrphanEntry) (stop bool)) error {
+	err := tree.ndb.traverseOrphans(func(k, v []byte) error {
+		var entry OrphanEntry
+		if err := orphanKeyFormat.ScanStrict(k, &entry.To, &entry.From); err != nil {
+			return err
+		}
+		entry.Hash = v
+		if fn(entry) {
+			return errStopTraversal
+		}
+		return nil
+	})
+	if err == errStopTraversal {
+		return nil
+	}
+	return err
+}
+
+// IterateRoots calls fn for each root record in the database, i.e. each saved version which was
+// not deleted, in ascending version order, until fn returns true. The byte slices passed to fn
+// must not be retained.
+func (tree *MutableTree) IterateRoots(fn func(entry RootEntry) (stop bool)) error {
+	err := tree.ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		var entry RootEntry
+		if err := rootKeyFormat.ScanStrict(k, &entry.Version); err != nil {
+			return err
+		}
+		entry.Hash = v
+		if fn(entry) {
+			return errStopTraversal
+		}
+		return nil
+	})
+	if err == errStopTraversal {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestIterateOrphansAndRoots(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("1"))
+	hash1, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	leaf := tree.root.getRightNode(tree.ImmutableTree).hash
+	tree.Set([]byte("b"), []byte("2"))
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Remove([]byte("a"))
+	tree.Remove([]byte("b"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	var roots []RootEntry
+	require.NoError(t, tree.IterateRoots(func(entry RootEntry) bool {
+		roots = append(roots, RootEntry{Version: entry.Version, Hash: append([]byte{}, entry.Hash...)})
+		return false
+	}))
+	require.Equal(t, []RootEntry{{1, hash1}, {2, hash2}, {3, []byte{}}}, roots)
+
+	var orphans []OrphanEntry
+	require.NoError(t, tree.IterateOrphans(func(entry OrphanEntry) bool {
+		orphans = append(orphans, entry)
+		return false
+	}))
+	// The root and leaf b of version 1, then all three nodes of version 2.
+	require.Len(t, orphans, 5)
+	require.Contains(t, orphans[:2], OrphanEntry{From: 1, To: 1, Hash: leaf})
+	for i, orphan := range orphans {
+		if i < 2 {
+			require.EqualValues(t, 1, orphan.To)
+		} else {
+			require.EqualValues(t, 2, orphan.To)
+		}
+	}
+
+	count := 0
+	require.NoError(t, tree.IterateOrphans(func(entry OrphanEntry) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 1, count)
+
+	// Deleting version 1 deletes its orphans.
+	require.NoError(t, tree.DeleteVersion(1))
+	orphans = nil
+	require.NoError(t, tree.IterateOrphans(func(entry OrphanEntry) bool {
+		orphans = append(orphans, entry)
+		return false
+	}))
+	require.Len(t, orphans, 3)
+}
@@ -0,0 +1,112 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvariantViolation is returned by SaveVersion when Options.RunInvariantChecks is enabled and
+// the working tree is corrupted.
+var ErrInvariantViolation = errors.New("tree invariant violation")
+
+// checkInvariants validates the nodes of the working tree which are about to be saved as the
+// given version, along with the orphans they replace. Persisted subtrees were validated when they
+// were saved, so only their roots are checked against their parents.
+func (tree *MutableTree) checkInvariants(version int64) error {
+	roots := map[string]bool{}
+	if tree.root != nil {
+		if _, err := tree.checkNode(tree.root, nil, nil, version, roots); err != nil {
+			return err
+		}
+	}
+
+	// Orphans are persisted nodes of earlier versions which the new version no longer
+	// references, at least not directly from new nodes.
+	for hash, fromVersion := range tree.orphans {
+		if fromVersion > tree.version {
+			return errors.Wrapf(ErrInvariantViolation, "orphan %X has version %v after the latest saved version %v",
+				[]byte(hash), fromVersion, tree.version)
+		}
+		if roots[hash] {
+			return errors.Wrapf(ErrInvariantViolation, "orphan %X is still referenced by the tree", []byte(hash))
+		}
+	}
+	return nil
+}
+
+// checkNode checks a node of the working tree whose keys must be in [lower, upper), recursing
+// into unpersisted children, and returns its minimum key, or nil if it is only known by
+// loading a persisted subtree. The hashes of persisted nodes
+// referenced by unpersisted ones are added to refs.
+func (tree *MutableTree) checkNode(node *Node, lower, upper []byte, version int64, refs map[string]bool) ([]byte, error) {
+	fail := func(format string, args ...interface{}) error {
+		return errors.Wrapf(ErrInvariantViolation, "node with key %X at version %v: %v",
+			node.key, node.version, fmt.Sprintf(format, args...))
+	}
+
+	if (lower != nil && bytes.Compare(node.key, lower) < 0) || (upper != nil && bytes.Compare(node.key, upper) >= 0) {
+		return nil, fail("key is outside of the range [%X, %X)", lower, upper)
+	}
+	if node.persisted {
+		refs[string(node.hash)] = true
+		if node.version > tree.version {
+			return nil, fail("persisted node is newer than the latest saved version %v", tree.version)
+		}
+		if node.isLeaf() {
+			return node.key, nil
+		}
+		return nil, nil // unknown without loading the subtree
+	}
+	if node.version <= tree.version || node.version > version {
+		return nil, fail("new node must have a version in (%v, %v]", tree.version, version)
+	}
+
+	if node.isLeaf() {
+		switch {
+		case node.size != 1:
+			return nil, fail("leaf has size %v", node.size)
+		case node.value == nil:
+			return nil, fail("leaf has nil value")
+		case node.leftNode != nil || node.rightNode != nil || node.leftHash != nil || node.rightHash != nil:
+			return nil, fail("leaf has children")
+		}
+		return node.key, nil
+	}
+
+	if node.value != nil {
+		return nil, fail("inner node has a value")
+	}
+	left, right := node.getLeftNode(tree.ImmutableTree), node.getRightNode(tree.ImmutableTree)
+	if left == nil || right == nil {
+		return nil, fail("inner node is missing a child")
+	}
+	if left.version > node.version || right.version > node.version {
+		return nil, fail("children have versions %v and %v", left.version, right.version)
+	}
+	if height := maxInt8(left.height, right.height) + 1; node.height != height {
+		return nil, fail("height is %v, expected %v", node.height, height)
+	}
+	if balance := int(left.height) - int(right.height); balance < -1 || balance > 1 {
+		return nil, fail("balance factor is %v", balance)
+	}
+	if size := left.size + right.size; node.size != size {
+		return nil, fail("size is %v, expected %v", node.size, size)
+	}
+
+	// The key of an inner node is the minimum key of its right subtree, so the left subtree
+	// is below it.
+	minKey, err := tree.checkNode(left, lower, node.key, version, refs)
+	if err != nil {
+		return nil, err
+	}
+	rightMin, err := tree.checkNode(right, node.key, upper, version, refs)
+	if err != nil {
+		return nil, err
+	}
+	if rightMin != nil && !bytes.Equal(rightMin, node.key) {
+		return nil, fail("key is not the minimum key %X of the right subtree", rightMin)
+	}
+	return minKey, nil
+}
@@ -0,0 +1,73 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRunInvariantChecks(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RunInvariantChecks: true, InitialVersion: 10})
+	require.NoError(t, err)
+	for version := 0; version < 20; version++ {
+		for i := 0; i < 50; i++ {
+			key := []byte(fmt.Sprintf("%03d", r.Intn(300)))
+			if r.Intn(3) == 0 {
+				tree.Remove(key)
+			} else {
+				tree.Set(key, []byte{byte(i)})
+			}
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+func TestRunInvariantChecks_Corrupted(t *testing.T) {
+	testcases := map[string]func(tree *MutableTree){
+		"size": func(tree *MutableTree) {
+			tree.root.size++
+		},
+		"height": func(tree *MutableTree) {
+			tree.root.height++
+		},
+		"key order": func(tree *MutableTree) {
+			tree.root.key = []byte("zzz")
+		},
+		"version": func(tree *MutableTree) {
+			tree.root.version = 1
+		},
+		"orphan": func(tree *MutableTree) {
+			// Orphan a node which is still referenced.
+			left := tree.root.getLeftNode(tree.ImmutableTree)
+			for !left.persisted {
+				left = left.getLeftNode(tree.ImmutableTree)
+			}
+			tree.orphans[string(left.hash)] = left.version
+		},
+	}
+	for name, corrupt := range testcases {
+		corrupt := corrupt
+		t.Run(name, func(t *testing.T) {
+			tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RunInvariantChecks: true})
+			require.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				tree.Set([]byte(fmt.Sprintf("%03d", i)), []byte{1})
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			tree.Set([]byte("050"), []byte{2})
+			corrupt(tree)
+
+			_, _, err = tree.SaveVersion()
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrInvariantViolation), err.Error())
+			require.EqualValues(t, 1, tree.Version())
+		})
+	}
+}
@@ -12,17 +12,21 @@ import (
 
 type traversal struct {
 	tree         *ImmutableTree
-	start, end   []byte        // iteration domain
-	ascending    bool          // ascending traversal
-	inclusive    bool          // end key inclusiveness
-	post         bool          // postorder traversal
-	delayedNodes *delayedNodes // delayed nodes to be traversed
+	start, end   []byte          // iteration domain
+	ascending    bool            // ascending traversal
+	inclusive    bool            // end key inclusiveness
+	post         bool            // postorder traversal
+	inOrder      bool            // inorder traversal, requires post to be false
+	delayedNodes *delayedNodes   // delayed nodes to be traversed
+	noCache      bool            // load nodes without adding them to the node cache
+	prefetcher   *nodePrefetcher // asynchronous loads of upcoming nodes, if enabled
+	snapshot     DBSnapshot      // database snapshot to load nodes from, if not the live database
 }
 
 var errIteratorNilTreeGiven = errors.New("iterator must be created with an immutable tree but the tree was nil")
 
 func (node *Node) newTraversal(tree *ImmutableTree, start, end []byte, ascending bool, inclusive bool, post bool) *traversal {
-	return &traversal{
+	t := &traversal{
 		tree:         tree,
 		start:        start,
 		end:          end,
@@ -31,6 +35,55 @@ func (node *Node) newTraversal(tree *ImmutableTree, start, end []byte, ascending
 		post:         post,
 		delayedNodes: &delayedNodes{{node, true}}, // set initial traverse to the node
 	}
+	if tree != nil && tree.ndb != nil {
+		t.noCache = tree.ndb.opts.SkipCacheOnIterate
+		if tree.ndb.opts.IteratorPrefetch > 0 {
+			t.prefetcher = newNodePrefetcher(tree.ndb, tree.ndb.opts.IteratorPrefetch, !t.noCache)
+		}
+	}
+	return t
+}
+
+// getLeftNode returns the left child of the node, see Options.SkipCacheOnIterate and
+// Options.IteratorPrefetch.
+func (t *traversal) getLeftNode(node *Node) *Node {
+	if node.leftNode != nil {
+		t.tree.observeNodeRead(node.leftNode, true)
+		return node.leftNode
+	}
+	left := t.loadNode(node.leftHash)
+	t.tree.observeNodeRead(left, false)
+	return left
+}
+
+// getRightNode returns the right child of the node, see Options.SkipCacheOnIterate and
+// Options.IteratorPrefetch.
+func (t *traversal) getRightNode(node *Node) *Node {
+	if node.rightNode != nil {
+		t.tree.observeNodeRead(node.rightNode, true)
+		return node.rightNode
+	}
+	right := t.loadNode(node.rightHash)
+	t.tree.observeNodeRead(right, false)
+	return right
+}
+
+func (t *traversal) loadNode(hash []byte) *Node {
+	if t.prefetcher != nil {
+		return t.prefetcher.get(hash)
+	}
+	if t.snapshot != nil {
+		return t.tree.ndb.getNodeFrom(t.snapshot, hash, !t.noCache, nil)
+	}
+	return t.tree.ndb.getNode(hash, !t.noCache)
+}
+
+// useSnapshot loads nodes from the given database snapshot.
+func (t *traversal) useSnapshot(snapshot DBSnapshot) {
+	t.snapshot = snapshot
+	if t.prefetcher != nil {
+		t.prefetcher.reader = snapshot
+	}
 }
 
 // delayedNode represents the delayed iteration on the nodes.
@@ -102,12 +155,7 @@ func (t *traversal) next() *Node {
 		return node
 	}
 
-	afterStart := t.start == nil || bytes.Compare(t.start, node.key) < 0
-	startOrAfter := afterStart || bytes.Equal(t.start, node.key)
-	beforeEnd := t.end == nil || bytes.Compare(node.key, t.end) < 0
-	if t.inclusive {
-		beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
-	}
+	afterStart, startOrAfter, beforeEnd := t.bounds(node)
 
 	// case of postorder. A-1 and B-1
 	// Recursively process left sub-tree, then right-subtree, then node itself.
@@ -122,26 +170,43 @@ func (t *traversal) next() *Node {
 		if t.ascending {
 			if beforeEnd {
 				// push the delayed traversal for the right nodes,
-				t.delayedNodes.push(node.getRightNode(t.tree), true)
+				t.delayedNodes.push(t.getRightNode(node), true)
+			}
+			if t.inOrder {
+				// return the node itself between the subtrees,
+				t.delayedNodes.push(node, false)
 			}
 			if afterStart {
 				// push the delayed traversal for the left nodes,
-				t.delayedNodes.push(node.getLeftNode(t.tree), true)
+				t.delayedNodes.push(t.getLeftNode(node), true)
 			}
 		} else {
 			// if node is a branch node and the order is not ascending
 			// We traverse through the right subtree, then the left subtree.
 			if afterStart {
 				// push the delayed traversal for the left nodes,
-				t.delayedNodes.push(node.getLeftNode(t.tree), true)
+				t.delayedNodes.push(t.getLeftNode(node), true)
+			}
+			if t.inOrder {
+				// return the node itself between the subtrees,
+				t.delayedNodes.push(node, false)
 			}
 			if beforeEnd {
 				// push the delayed traversal for the right nodes,
-				t.delayedNodes.push(node.getRightNode(t.tree), true)
+				t.delayedNodes.push(t.getRightNode(node), true)
 			}
 		}
 	}
 
+	if t.prefetcher != nil {
+		t.prefetch()
+	}
+
+	// case of inorder traversal, the branch node is returned after its first subtree.
+	if t.inOrder && !node.isLeaf() {
+		return t.next()
+	}
+
 	// case of preorder traversal. A-3 and B-2.
 	// Process root then (recursively) processing left child, then process right child
 	if !t.post && (!node.isLeaf() || (startOrAfter && beforeEnd)) {
@@ -152,6 +217,18 @@ func (t *traversal) next() *Node {
 	return t.next()
 }
 
+// bounds returns whether the node key is after the start, at or after the start, and before the
+// end of the iteration domain.
+func (t *traversal) bounds(node *Node) (afterStart, startOrAfter, beforeEnd bool) {
+	afterStart = t.start == nil || bytes.Compare(t.start, node.key) < 0
+	startOrAfter = afterStart || bytes.Equal(t.start, node.key)
+	beforeEnd = t.end == nil || bytes.Compare(node.key, t.end) < 0
+	if t.inclusive {
+		beforeEnd = beforeEnd || bytes.Equal(node.key, t.end)
+	}
+	return afterStart, startOrAfter, beforeEnd
+}
+
 // Iterator is a dbm.Iterator for ImmutableTree
 type Iterator struct {
 	start, end []byte
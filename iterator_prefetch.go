@@ -0,0 +1,99 @@
+package iavl
+
+// prefetchResult is the outcome of an asynchronous node load. Loading a missing or corrupt node
+// panics, so the panic is captured and raised again by the traversal which requested the node.
+type prefetchResult struct {
+	node  *Node
+	panic interface{}
+}
+
+// nodePrefetcher loads nodes asynchronously ahead of a traversal, see Options.IteratorPrefetch.
+// It is only used by the goroutine driving the traversal.
+type nodePrefetcher struct {
+	ndb     *nodeDB
+	reader  dbReader // database or snapshot to load nodes from
+	limit   int
+	cache   bool // add loaded nodes to the node cache
+	pending map[string]chan prefetchResult
+}
+
+func newNodePrefetcher(ndb *nodeDB, limit int, cache bool) *nodePrefetcher {
+	return &nodePrefetcher{
+		ndb:     ndb,
+		reader:  ndb.db,
+		limit:   limit,
+		cache:   cache,
+		pending: make(map[string]chan prefetchResult, limit),
+	}
+}
+
+// full returns whether the maximum number of nodes are already being prefetched.
+func (p *nodePrefetcher) full() bool {
+	return len(p.pending) >= p.limit
+}
+
+// request starts loading the node with the given hash, unless it is already requested or the
+// limit is reached.
+func (p *nodePrefetcher) request(hash []byte) {
+	if p.full() {
+		return
+	}
+	if _, ok := p.pending[string(hash)]; ok {
+		return
+	}
+	ch := make(chan prefetchResult, 1)
+	p.pending[string(hash)] = ch
+	workers := &p.ndb.resources.workers
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		var result prefetchResult
+		defer func() {
+			if r := recover(); r != nil {
+				result.panic = r
+			}
+			ch <- result
+		}()
+		result.node = p.ndb.getNodeFrom(p.reader, hash, p.cache, nil)
+	}()
+}
+
+// get returns the node with the given hash, waiting for it if it was requested, or loading it
+// synchronously otherwise.
+func (p *nodePrefetcher) get(hash []byte) *Node {
+	ch, ok := p.pending[string(hash)]
+	if !ok {
+		return p.ndb.getNodeFrom(p.reader, hash, p.cache, nil)
+	}
+	delete(p.pending, string(hash))
+	result := <-ch
+	if result.panic != nil {
+		panic(result.panic)
+	}
+	return result.node
+}
+
+// prefetch requests the children of the delayed nodes next in line to be expanded, in the order
+// they will be reached, skipping children outside the iteration domain.
+func (t *traversal) prefetch() {
+	nodes := *t.delayedNodes
+	for i := len(nodes) - 1; i >= 0 && !t.prefetcher.full(); i-- {
+		node := nodes[i].node
+		if !nodes[i].delayed || node == nil || node.isLeaf() {
+			continue
+		}
+		afterStart, _, beforeEnd := t.bounds(node)
+		first, second := node.leftHash, node.rightHash
+		firstOk, secondOk := afterStart && node.leftNode == nil, beforeEnd && node.rightNode == nil
+		if !t.ascending {
+			first, second = second, first
+			firstOk, secondOk = secondOk, firstOk
+		}
+		if firstOk {
+			t.prefetcher.request(first)
+		}
+		if secondOk {
+			t.prefetcher.request(second)
+		}
+	}
+}
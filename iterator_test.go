@@ -295,7 +295,9 @@ func TestIterator_WithDelete_Full_Ascending_Success(t *testing.T) {
 	err = tree.DeleteVersion(1)
 	require.NoError(t, err)
 
-	immutableTree, err := tree.GetImmutable(tree.ndb.getLatestVersion())
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	immutableTree, err := tree.GetImmutable(latest)
 	require.NoError(t, err)
 
 	// sort mirror for assertion
@@ -335,7 +337,9 @@ func setupIteratorAndMirror(t *testing.T, config *iteratorTestConfig) (dbm.Itera
 	_, _, err = tree.SaveVersion()
 	require.NoError(t, err)
 
-	immutableTree, err := tree.GetImmutable(tree.ndb.getLatestVersion())
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	immutableTree, err := tree.GetImmutable(latest)
 	require.NoError(t, err)
 
 	itr := NewIterator(config.startIterate, config.endIterate, config.ascending, immutableTree)
@@ -407,3 +411,52 @@ func setupUnsavedFastIterator(t *testing.T, config *iteratorTestConfig) (dbm.Ite
 	itr := NewUnsavedFastIterator(config.startIterate, config.endIterate, config.ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
 	return itr, mergedMirror
 }
+
+func TestIterator_Prefetch(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree, err := NewMutableTree(db, 0)
+	require.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte{byte(i >> 8), byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	prefetching, err := NewMutableTreeWithOpts(db, 0, &Options{IteratorPrefetch: 8})
+	require.NoError(t, err)
+	_, err = prefetching.Load()
+	require.NoError(t, err)
+
+	ranges := [][2][]byte{{nil, nil}, {{0, 10}, {1, 20}}, {{0, 255}, nil}}
+	for _, r := range ranges {
+		for _, ascending := range []bool{true, false} {
+			expected := iterateAll(t, NewIterator(r[0], r[1], ascending, tree.ImmutableTree))
+			itr := NewIterator(r[0], r[1], ascending, prefetching.ImmutableTree).(*Iterator)
+			prefetcher := itr.t.prefetcher
+			require.NotNil(t, prefetcher)
+			require.Equal(t, expected, iterateAll(t, itr))
+			require.Empty(t, prefetcher.pending)
+		}
+	}
+
+	// Post-order traversals, e.g. exports, prefetch too.
+	var expected, actual [][]byte
+	tree.ImmutableTree.root.traversePost(tree.ImmutableTree, true, func(node *Node) bool {
+		expected = append(expected, node.hash)
+		return false
+	})
+	prefetching.ImmutableTree.root.traversePost(prefetching.ImmutableTree, true, func(node *Node) bool {
+		actual = append(actual, node.hash)
+		return false
+	})
+	require.Equal(t, expected, actual)
+}
+
+func iterateAll(t *testing.T, itr dbm.Iterator) [][]byte {
+	var keys [][]byte
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, itr.Key())
+	}
+	require.NoError(t, itr.Close())
+	return keys
+}
@@ -0,0 +1,278 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// journalOp is the type of a journaled mutation.
+type journalOp byte
+
+const (
+	journalOpSet         journalOp = 1
+	journalOpRemove      journalOp = 2
+	journalOpDeleteRange journalOp = 3
+	journalOpSetBatch    journalOp = 4
+)
+
+// Flags of journalOpDeleteRange entries, marking an unbounded start or end.
+const (
+	journalRangeNoStart = 1 << 0
+	journalRangeNoEnd   = 1 << 1
+)
+
+// journalEntry is a single mutation recorded in the journal. For journalOpDeleteRange, key and
+// value are the start and end of the range, either of which may be nil. For journalOpSetBatch,
+// pairs holds the batch instead.
+type journalEntry struct {
+	op    journalOp
+	key   []byte
+	value []byte
+	pairs []KVPair
+}
+
+func (e *journalEntry) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(1 + encodeBytesSize(e.key) + encodeBytesSize(e.value))
+	buf.WriteByte(byte(e.op))
+	if e.op == journalOpSetBatch {
+		if err := encodeUvarint(&buf, uint64(len(e.pairs))); err != nil {
+			return nil, err
+		}
+		for _, pair := range e.pairs {
+			if err := encodeBytes(&buf, pair.Key); err != nil {
+				return nil, err
+			}
+			if err := encodeBytes(&buf, pair.Value); err != nil {
+				return nil, err
+			}
+		}
+		return buf.Bytes(), nil
+	}
+	if e.op == journalOpDeleteRange {
+		var flags byte
+		if e.key == nil {
+			flags |= journalRangeNoStart
+		}
+		if e.value == nil {
+			flags |= journalRangeNoEnd
+		}
+		buf.WriteByte(flags)
+		if err := encodeBytes(&buf, e.key); err != nil {
+			return nil, err
+		}
+		if err := encodeBytes(&buf, e.value); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	if err := encodeBytes(&buf, e.key); err != nil {
+		return nil, err
+	}
+	if e.op == journalOpSet {
+		if err := encodeBytes(&buf, e.value); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeJournalEntry(bz []byte) (*journalEntry, error) {
+	if len(bz) == 0 {
+		return nil, errors.New("empty journal entry")
+	}
+	e := &journalEntry{op: journalOp(bz[0])}
+	switch e.op {
+	case journalOpDeleteRange:
+		return decodeJournalRange(e, bz[1:])
+	case journalOpSetBatch:
+		return decodeJournalBatch(e, bz[1:])
+	}
+	key, n, err := decodeBytes(bz[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding journal entry key")
+	}
+	e.key = key
+
+	switch e.op {
+	case journalOpSet:
+		value, _, err := decodeBytes(bz[1+n:])
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding journal entry value")
+		}
+		e.value = value
+	case journalOpRemove:
+	default:
+		return nil, fmt.Errorf("unknown journal op %v", e.op)
+	}
+	return e, nil
+}
+
+// decodeJournalRange decodes the flags, start and end of a journalOpDeleteRange entry.
+func decodeJournalRange(e *journalEntry, bz []byte) (*journalEntry, error) {
+	if len(bz) == 0 {
+		return nil, errors.New("missing journal range flags")
+	}
+	flags := bz[0]
+	start, n, err := decodeBytes(bz[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding journal range start")
+	}
+	end, _, err := decodeBytes(bz[1+n:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding journal range end")
+	}
+	if flags&journalRangeNoStart == 0 {
+		e.key = start
+	}
+	if flags&journalRangeNoEnd == 0 {
+		e.value = end
+	}
+	return e, nil
+}
+
+// decodeJournalBatch decodes the pairs of a journalOpSetBatch entry.
+func decodeJournalBatch(e *journalEntry, bz []byte) (*journalEntry, error) {
+	count, n := binary.Uvarint(bz)
+	if n <= 0 {
+		return nil, errors.New("decoding journal batch size")
+	}
+	bz = bz[n:]
+	// Each pair takes at least the two length prefixes, so a corrupt count can't make us allocate
+	// more than the entry size.
+	if count > uint64(len(bz)/2) {
+		return nil, errors.Errorf("journal batch size %v exceeds entry of %v bytes", count, len(bz))
+	}
+	e.pairs = make([]KVPair, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, n, err := decodeBytes(bz)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding journal batch key")
+		}
+		bz = bz[n:]
+		value, n, err := decodeBytes(bz)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding journal batch value")
+		}
+		bz = bz[n:]
+		e.pairs = append(e.pairs, KVPair{Key: key, Value: value})
+	}
+	return e, nil
+}
+
+// appendJournal writes a journal entry directly to the database, bypassing the batch, since it
+// must be durable before the next SaveVersion().
+func (ndb *nodeDB) appendJournal(version int64, seq int64, entry *journalEntry) error {
+	bz, err := entry.encode()
+	if err != nil {
+		return err
+	}
+	key := journalKeyFormat.Key(version, seq)
+	if ndb.opts.Sync {
+		return ndb.db.SetSync(key, bz)
+	}
+	return ndb.db.Set(key, bz)
+}
+
+// traverseJournal calls fn for each journal entry on top of the given version, in order.
+func (ndb *nodeDB) traverseJournal(version int64, fn func(entry *journalEntry) error) error {
+	return ndb.traversePrefix(journalKeyFormat.Key(version), func(key, value []byte) error {
+		entry, err := decodeJournalEntry(value)
+		if err != nil {
+			return err
+		}
+		return fn(entry)
+	})
+}
+
+// deleteJournal deletes the journal of the given version in the current batch.
+func (ndb *nodeDB) deleteJournal(version int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.traversePrefix(journalKeyFormat.Key(version), func(key, value []byte) error {
+		return ndb.batch.Delete(key)
+	})
+}
+
+// deleteJournalsFrom deletes all journals on top of the given version or later, and commits.
+func (ndb *nodeDB) deleteJournalsFrom(version int64) error {
+	ndb.mtx.Lock()
+	err := ndb.traverseRange(journalKeyFormat.Key(version), journalKeyFormat.Key(int64(math.MaxInt64)),
+		func(key, value []byte) error {
+			return ndb.batch.Delete(key)
+		})
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return ndb.Commit()
+}
+
+// journal records a mutation of the working tree if journaling is enabled. Since Set() and
+// Remove() can't return errors, the first failure is kept and returned by SaveVersion().
+func (tree *MutableTree) journal(op journalOp, key, value []byte) {
+	tree.writeJournal(&journalEntry{op: op, key: key, value: value})
+}
+
+// writeJournal records a journal entry if journaling is enabled, see journal.
+func (tree *MutableTree) writeJournal(entry *journalEntry) {
+	if !tree.ndb.opts.Journal || tree.journalErr != nil {
+		return
+	}
+	err := tree.ndb.appendJournal(tree.version, tree.journalSeq, entry)
+	if err != nil {
+		tree.journalErr = errors.Wrap(err, "failed to write journal")
+		return
+	}
+	tree.journalSeq++
+}
+
+// replayJournal applies the journaled mutations on top of the loaded version to the working
+// tree, returning the number of entries replayed.
+func (tree *MutableTree) replayJournal() (int, error) {
+	tree.journalSeq = 0
+	tree.journalErr = nil
+	if !tree.ndb.opts.Journal {
+		return 0, nil
+	}
+	err := tree.ndb.traverseJournal(tree.version, func(entry *journalEntry) error {
+		switch entry.op {
+		case journalOpSet:
+			orphaned, _, _ := tree.set(entry.key, entry.value)
+			tree.addOrphans(orphaned)
+		case journalOpRemove:
+			_, orphaned, _ := tree.remove(entry.key)
+			tree.addOrphans(orphaned)
+		case journalOpDeleteRange:
+			tree.deleteRange(entry.key, entry.value)
+		case journalOpSetBatch:
+			tree.setBatch(entry.pairs)
+		}
+		tree.journalSeq++
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to replay journal")
+	}
+	return int(tree.journalSeq), nil
+}
+
+// discardJournal deletes the journal of unsaved changes on top of the current version. Any
+// failure is kept and returned by SaveVersion().
+func (tree *MutableTree) discardJournal() {
+	tree.journalSeq = 0
+	if !tree.ndb.opts.Journal {
+		return
+	}
+	err := tree.ndb.deleteJournal(tree.version)
+	if err == nil {
+		err = tree.ndb.Commit()
+	}
+	if err != nil {
+		tree.journalErr = errors.Wrap(err, "failed to discard journal")
+	}
+}
@@ -0,0 +1,126 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestJournal_ReplayAfterCrash(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{Journal: true}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	require.Equal(t, 2, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Zero(t, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+
+	tree.Set([]byte("c"), []byte("3"))
+	tree.Set([]byte("a"), []byte("4"))
+	tree.Remove([]byte("b"))
+	tree.Remove([]byte("x")) // not journaled, since nothing was removed
+	require.Equal(t, 3, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+	workingHash := tree.WorkingHash()
+
+	// Reopen without saving, as if the process had crashed.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, workingHash, tree.WorkingHash())
+	require.Equal(t, []byte("4"), tree.Get([]byte("a")))
+	require.Nil(t, tree.Get([]byte("b")))
+
+	// Writes after replay continue the journal.
+	tree.Set([]byte("d"), []byte("5"))
+	require.Equal(t, 4, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Zero(t, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+
+	// Rollback discards the journal.
+	tree.Set([]byte("e"), []byte("6"))
+	tree.Rollback()
+	require.Zero(t, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Nil(t, tree.Get([]byte("e")))
+	require.Equal(t, tree.Hash(), tree.WorkingHash())
+}
+
+func TestJournal_NotReplayedForOldVersion(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{Journal: true}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("b"), []byte("3"))
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	require.Nil(t, tree.Get([]byte("b")))
+
+	// Overwriting from version 1 drops the journal of version 2.
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	require.Zero(t, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+}
+
+func TestJournal_Disabled(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Remove([]byte("a"))
+	require.Zero(t, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+}
+
+func TestJournalEntry_EncodeDecode(t *testing.T) {
+	for _, entry := range []*journalEntry{
+		{op: journalOpSet, key: []byte("key"), value: []byte("value")},
+		{op: journalOpSet, key: []byte("key"), value: []byte{}},
+		{op: journalOpRemove, key: []byte("key")},
+		{op: journalOpDeleteRange, key: []byte("a"), value: []byte("b")},
+		{op: journalOpDeleteRange, key: []byte{}},
+		{op: journalOpDeleteRange, value: []byte("b")},
+		{op: journalOpSetBatch, pairs: []KVPair{{Key: []byte("a"), Value: []byte("1")}, {Key: []byte("b"), Value: []byte{}}}},
+	} {
+		bz, err := entry.encode()
+		require.NoError(t, err)
+		decoded, err := decodeJournalEntry(bz)
+		require.NoError(t, err)
+		require.Equal(t, entry.op, decoded.op)
+		require.Equal(t, entry.key, decoded.key)
+		if entry.op != journalOpRemove {
+			require.Equal(t, entry.value, decoded.value)
+		}
+		require.Equal(t, entry.pairs, decoded.pairs)
+	}
+
+	_, err := decodeJournalEntry(nil)
+	require.Error(t, err)
+	_, err = decodeJournalEntry([]byte{9, 0})
+	require.Error(t, err)
+	// A corrupt batch size larger than the entry is rejected rather than allocated.
+	_, err = decodeJournalEntry([]byte{byte(journalOpSetBatch), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	require.Error(t, err)
+}
@@ -0,0 +1,26 @@
+package iavl
+
+import (
+	dbm "github.com/tendermint/tm-db"
+)
+
+// KeyChecker can be implemented by databases, or wrappers of them, which can check whether a key
+// exists without reading its value, e.g. with a key-only lookup or bloom filter of RocksDB, Pebble
+// or Badger. The Has method of most tm-db backends reads the whole value, so existence checks of
+// nodes use HasKey instead when the database implements it. GoLevelDB databases are checked
+// natively without implementing it.
+type KeyChecker interface {
+	HasKey(key []byte) (bool, error)
+}
+
+// hasKey checks whether a key exists in the database, with the cheapest lookup it supports.
+func hasKey(db dbm.DB, key []byte) (bool, error) {
+	switch db := db.(type) {
+	case KeyChecker:
+		return db.HasKey(key)
+	case *dbm.GoLevelDB:
+		return db.DB().Has(key, nil)
+	default:
+		return db.Has(key)
+	}
+}
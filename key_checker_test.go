@@ -0,0 +1,47 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// keyCheckerDB counts the lookups of a MemDB implementing KeyChecker.
+type keyCheckerDB struct {
+	*db.MemDB
+	gets    int
+	hasKeys int
+}
+
+func (d *keyCheckerDB) Get(key []byte) ([]byte, error) {
+	d.gets++
+	return d.MemDB.Get(key)
+}
+
+func (d *keyCheckerDB) HasKey(key []byte) (bool, error) {
+	d.hasKeys++
+	return d.MemDB.Has(key)
+}
+
+func TestNodeDB_HasUsesKeyChecker(t *testing.T) {
+	for _, prefix := range [][]byte{nil, []byte("ns")} {
+		memDB := &keyCheckerDB{MemDB: db.NewMemDB()}
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{KeyPrefix: prefix})
+		require.NoError(t, err)
+		tree.Set([]byte("a"), []byte{1})
+		tree.Set([]byte("b"), []byte{2})
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		memDB.gets, memDB.hasKeys = 0, 0
+		has, err := tree.ndb.Has(hash)
+		require.NoError(t, err)
+		require.True(t, has)
+		has, err = tree.ndb.Has([]byte("missing"))
+		require.NoError(t, err)
+		require.False(t, has)
+		require.Equal(t, 2, memDB.hasKeys)
+		require.Zero(t, memDB.gets)
+	}
+}
@@ -3,8 +3,13 @@ package iavl
 import (
 	"encoding/binary"
 	"fmt"
+
+	"github.com/pkg/errors"
 )
 
+// ErrMalformedKey is returned by KeyFormat.ScanStrict when a key doesn't match the key format.
+var ErrMalformedKey = errors.New("malformed key")
+
 // Provides a fixed-width lexicographically sortable []byte key format
 type KeyFormat struct {
 	prefix    byte
@@ -142,6 +147,41 @@ func (kf *KeyFormat) Scan(key []byte, args ...interface{}) {
 	}
 }
 
+// ScanStrict is like Scan, but returns an error wrapping ErrMalformedKey instead of panicking if the
+// key doesn't have the prefix and length of the key format, e.g. because it was truncated or is
+// overlong, or if a segment has the wrong width for its arg. It is used for keys read from the
+// database, so that a corrupt key can't crash a traversal.
+func (kf *KeyFormat) ScanStrict(key []byte, args ...interface{}) error {
+	if len(args) > len(kf.layout) {
+		return errors.Errorf("keyFormat.ScanStrict() is provided with %d args but format only has %d segments",
+			len(args), len(kf.layout))
+	}
+	if len(key) == 0 || key[0] != kf.prefix {
+		return errors.Wrapf(ErrMalformedKey, "key %X does not have prefix %X", key, kf.prefix)
+	}
+	if kf.unbounded && len(key) < kf.length {
+		return errors.Wrapf(ErrMalformedKey, "key %X has length %d, expected at least %d", key, len(key), kf.length)
+	}
+	if !kf.unbounded && len(key) != kf.length {
+		return errors.Wrapf(ErrMalformedKey, "key %X has length %d, expected %d", key, len(key), kf.length)
+	}
+	segments := kf.ScanBytes(key)
+	for i, a := range args {
+		switch a.(type) {
+		case *int64, *uint64:
+			if len(segments[i]) != 8 {
+				return errors.Wrapf(ErrMalformedKey, "segment %d of key %X has length %d, expected 8",
+					i, key, len(segments[i]))
+			}
+		case *[]byte:
+		default:
+			return errors.Errorf("keyFormat.ScanStrict() does not support scanning value of type %T: %v", a, a)
+		}
+		scan(a, segments[i])
+	}
+	return nil
+}
+
 // Return the prefix as a string.
 func (kf *KeyFormat) Prefix() string {
 	return string([]byte{kf.prefix})
@@ -1,9 +1,11 @@
 package iavl
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestKeyFormatBytes(t *testing.T) {
@@ -116,6 +118,46 @@ func TestOverflow(t *testing.T) {
 	assert.Equal(t, int64(b), *bo)
 }
 
+func TestKeyFormatScanStrict(t *testing.T) {
+	kf := NewKeyFormat(byte('e'), 8, 4)
+	key := kf.Key(int64(100), []byte{1, 2, 3, 4})
+
+	var a int64
+	var b []byte
+	require.NoError(t, kf.ScanStrict(key, &a, &b))
+	require.EqualValues(t, 100, a)
+	require.Equal(t, []byte{1, 2, 3, 4}, b)
+	require.NoError(t, kf.ScanStrict(key, &a))
+	require.NoError(t, kf.ScanStrict(key))
+
+	testcases := map[string][]byte{
+		"empty":     {},
+		"prefix":    {'f', 0, 0, 0, 0, 0, 0, 0, 100, 1, 2, 3, 4},
+		"truncated": key[:len(key)-1],
+		"overlong":  append(append([]byte{}, key...), 5),
+		"segment":   key[:9],
+	}
+	for name, key := range testcases {
+		key := key
+		t.Run(name, func(t *testing.T) {
+			err := kf.ScanStrict(key, &a, &b)
+			require.Error(t, err)
+			require.True(t, errors.Is(err, ErrMalformedKey))
+		})
+	}
+
+	unbounded := NewKeyFormat(byte('u'), 8, 0)
+	require.NoError(t, unbounded.ScanStrict(unbounded.Key(int64(1), []byte("abc")), &a, &b))
+	require.Equal(t, []byte("abc"), b)
+	require.NoError(t, unbounded.ScanStrict(unbounded.Key(int64(1)), &a, &b))
+	require.Empty(t, b)
+	err := unbounded.ScanStrict(unbounded.Key(int64(1), []byte("abc")), &a, &a)
+	require.True(t, errors.Is(err, ErrMalformedKey))
+
+	require.Error(t, kf.ScanStrict(key, &a, &b, &b))
+	require.Error(t, kf.ScanStrict(key, new(int32)))
+}
+
 func benchmarkKeyFormatBytes(b *testing.B, kf *KeyFormat, segments ...[]byte) {
 	for i := 0; i < b.N; i++ {
 		kf.KeyBytes(segments...)
@@ -0,0 +1,101 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// KeyChange is a change of a key's value, see MutableTree.GetKeyHistory().
+type KeyChange struct {
+	Version int64  // Version at which the key was set or removed.
+	Value   []byte // Value set, or nil if the key was removed.
+}
+
+// GetKeyHistory returns the changes of a key across the saved versions in [fromVersion,
+// toVersion], in version order. Set versions are exact, since they are recorded in the leaves,
+// while removals are reported at the first saved version without the key. A removal before the
+// first saved version in the range is not reported.
+//
+// Each version root is walked towards the key, stopping at the first node created no later than
+// the previous version walked, since the key's leaf can't have changed beneath it. Versions which
+// didn't touch the path to the key therefore only cost a few node loads.
+func (tree *MutableTree) GetKeyHistory(key []byte, fromVersion, toVersion int64) (changes []KeyChange, err error) {
+	defer recoverNodeMissing(&err)
+	if len(key) == 0 {
+		return nil, errors.New("key cannot be empty")
+	}
+	if fromVersion > toVersion {
+		return nil, errors.Errorf("fromVersion %v is greater than toVersion %v", fromVersion, toVersion)
+	}
+
+	versions, err := tree.ndb.getVersionsInRange(fromVersion, toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	var prevVersion int64
+	present := false
+	for i, version := range versions {
+		t, err := tree.ImmutableTree.LoadRootOnly(version)
+		if err != nil {
+			return nil, err
+		}
+		// The first version is walked in full, to find whether the key is present.
+		leaf, changed := findKeyLeaf(t, key, prevVersion, i == 0)
+		if !changed {
+			prevVersion = version
+			continue
+		}
+		switch {
+		case leaf != nil && (i > 0 || leaf.version >= fromVersion):
+			changes = append(changes, KeyChange{Version: leaf.version, Value: leaf.value})
+		case leaf == nil && present:
+			changes = append(changes, KeyChange{Version: version, Value: nil})
+		}
+		present = leaf != nil
+		prevVersion = version
+	}
+	return changes, nil
+}
+
+// findKeyLeaf returns the leaf with the given key in the tree, or nil if there is none. Unless
+// full is set, it returns changed false without reaching the leaf if the path to the key
+// reaches a node created at or before sinceVersion, i.e. if the leaf is unchanged since then.
+func findKeyLeaf(t *ImmutableTree, key []byte, sinceVersion int64, full bool) (leaf *Node, changed bool) {
+	node := t.root
+	for node != nil {
+		if !full && node.version <= sinceVersion {
+			return nil, false
+		}
+		if node.isLeaf() {
+			if bytes.Equal(node.key, key) {
+				return node, true
+			}
+			return nil, true
+		}
+		if bytes.Compare(key, node.key) < 0 {
+			node = node.getLeftNode(t)
+		} else {
+			node = node.getRightNode(t)
+		}
+	}
+	return nil, true
+}
+
+// getVersionsInRange returns the saved versions in [fromVersion, toVersion], in order.
+func (ndb *nodeDB) getVersionsInRange(fromVersion, toVersion int64) ([]int64, error) {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+
+	var versions []int64
+	err := ndb.traverseRange(rootKeyFormat.Key(fromVersion), cpIncr(rootKeyFormat.Key(toVersion)), func(k, _ []byte) error {
+		var version int64
+		if err := rootKeyFormat.ScanStrict(k, &version); err != nil {
+			return err
+		}
+		versions = append(versions, version)
+		return nil
+	})
+	return versions, err
+}
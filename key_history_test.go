@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutableTree_GetKeyHistory(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	key := []byte("k050")
+	for v := 1; v <= 10; v++ {
+		for i := 0; i < 100; i += 10 + v {
+			tree.Set([]byte(fmt.Sprintf("k%03d", i+1)), []byte{byte(v)})
+		}
+		switch v {
+		case 2, 4, 8:
+			tree.Set(key, []byte(fmt.Sprintf("v%d", v)))
+		case 6:
+			tree.Remove(key)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	changes, err := tree.GetKeyHistory(key, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, []KeyChange{
+		{Version: 2, Value: []byte("v2")},
+		{Version: 4, Value: []byte("v4")},
+		{Version: 6, Value: nil},
+		{Version: 8, Value: []byte("v8")},
+	}, changes)
+
+	// Changes before the range aren't reported.
+	changes, err = tree.GetKeyHistory(key, 3, 7)
+	require.NoError(t, err)
+	require.Equal(t, []KeyChange{
+		{Version: 4, Value: []byte("v4")},
+		{Version: 6, Value: nil},
+	}, changes)
+
+	// Set versions are exact even if the version is deleted, while removals are reported at the
+	// next saved version.
+	require.NoError(t, tree.DeleteVersion(4))
+	require.NoError(t, tree.DeleteVersion(6))
+	changes, err = tree.GetKeyHistory(key, 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, []KeyChange{
+		{Version: 2, Value: []byte("v2")},
+		{Version: 4, Value: []byte("v4")},
+		{Version: 7, Value: nil},
+		{Version: 8, Value: []byte("v8")},
+	}, changes)
+
+	changes, err = tree.GetKeyHistory([]byte("missing"), 1, 10)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+
+	_, err = tree.GetKeyHistory(key, 5, 4)
+	require.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// cleanShutdownKey is the metadata key written by Close, holding the latest version at the time.
+// It is deleted when the tree is next loaded, so that it is only found after a clean shutdown.
+const cleanShutdownKey = "clean_shutdown"
+
+// ErrClosed is returned when committing to a tree which has been closed.
+var ErrClosed = errors.New("tree is closed")
+
+// resourceTracker tracks the open resources of a nodeDB which hold database iterators or
+// goroutines, such as iterators and exporters, so that they can be released by Close.
+type resourceTracker struct {
+	mtx     sync.Mutex
+	nextID  uint64
+	open    map[uint64]func()
+	workers sync.WaitGroup // Background goroutines, e.g. those of iterator prefetching.
+}
+
+// track registers an open resource with the function closing it, and returns the function
+// unregistering it, to be called when it is closed.
+func (r *resourceTracker) track(close func()) func() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.open == nil {
+		r.open = map[uint64]func(){}
+	}
+	id := r.nextID
+	r.nextID++
+	r.open[id] = close
+	return func() {
+		r.mtx.Lock()
+		delete(r.open, id)
+		r.mtx.Unlock()
+	}
+}
+
+// closeAll closes all open resources, and waits for the background goroutines to finish.
+func (r *resourceTracker) closeAll() {
+	r.mtx.Lock()
+	closers := make([]func(), 0, len(r.open))
+	for _, close := range r.open {
+		closers = append(closers, close)
+	}
+	r.mtx.Unlock()
+	for _, close := range closers {
+		close()
+	}
+	r.workers.Wait()
+}
+
+// Close shuts the tree down gracefully: it closes any iterators and exporters left open, waits for
+// background goroutines such as iterator prefetching, discards any pending batch, and writes a
+// clean shutdown marker, see CleanShutdown, unless a commit was interrupted part-way, which is
+// then rolled back when the tree is next loaded. Unsaved changes are discarded, unless they are
+// journaled, see Options.Journal. The database itself is left open, since it is owned by the
+// caller. The tree must not be used afterwards, nor concurrently with Close.
+func (tree *MutableTree) Close() error {
+	return tree.ndb.Close()
+}
+
+// CleanShutdown returns true if the tree was closed with Close when it was last used, in which
+// case no crash recovery was needed when it was first loaded, e.g. to skip consistency checks at
+// startup. It is only known once the tree has been loaded.
+func (tree *MutableTree) CleanShutdown() bool {
+	tree.ndb.mtx.RLock()
+	defer tree.ndb.mtx.RUnlock()
+	return tree.ndb.cleanShutdown
+}
+
+// Close closes the nodeDB, see MutableTree.Close. Closing it again is a no-op.
+func (ndb *nodeDB) Close() error {
+	ndb.mtx.RLock()
+	closed := ndb.closed
+	ndb.mtx.RUnlock()
+	if closed {
+		return nil
+	}
+	ndb.resources.closeAll()
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	// Anything left in the batch belongs to an operation which didn't complete.
+	if err := ndb.batch.Close(); err != nil {
+		return err
+	}
+	ndb.newBatch()
+	ndb.closed = true
+
+	pending, err := ndb.db.Has(metadataKeyFormat.Key([]byte(commitPendingKey)))
+	if err != nil {
+		return err
+	}
+	if !pending {
+		latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return err
+		}
+		if err := ndb.db.SetSync(metadataKeyFormat.Key([]byte(cleanShutdownKey)),
+			formatUint64(uint64(latest))); err != nil {
+			return errors.Wrap(err, "failed to write clean shutdown marker")
+		}
+	}
+	return ndb.flushColdDeletes()
+}
+
+// recoverOnLoad rolls back any torn commit, see recoverTornCommit, unless this is the first load
+// since the tree was closed cleanly, in which case the clean shutdown marker is deleted instead,
+// so that any later crash is recovered from.
+func (ndb *nodeDB) recoverOnLoad() error {
+	ndb.mtx.Lock()
+	first := !ndb.loaded
+	ndb.loaded = true
+	var marker []byte
+	var err error
+	if first {
+		marker, err = ndb.db.Get(metadataKeyFormat.Key([]byte(cleanShutdownKey)))
+	}
+	if err == nil && marker != nil {
+		var latest int64
+		if latest, err = ndb.getLatestVersion(); err == nil {
+			ndb.cleanShutdown = len(marker) == int64Size && int64(binary.BigEndian.Uint64(marker)) == latest
+			err = ndb.batch.Delete(metadataKeyFormat.Key([]byte(cleanShutdownKey)))
+		}
+	}
+	clean := ndb.cleanShutdown
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if marker != nil {
+		if err := ndb.Commit(); err != nil {
+			return err
+		}
+	}
+	if clean && first {
+		return nil
+	}
+	_, err = ndb.recoverTornCommit()
+	return err
+}
@@ -0,0 +1,75 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestClose(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{IteratorPrefetch: 4})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.False(t, tree.CleanShutdown())
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(i)}, []byte{1})
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	itr := itree.Iterator(nil, nil, true)
+	require.True(t, itr.Valid())
+	exporter := itree.Export()
+	_, err = exporter.Next()
+	require.NoError(t, err)
+
+	require.NoError(t, tree.Close())
+	require.NoError(t, tree.Close())
+	require.False(t, itr.Valid())
+	_, err = exporter.Next()
+	require.Error(t, err)
+	exporter.Close()
+	require.Empty(t, tree.ndb.resources.open)
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.True(t, errors.Is(err, ErrClosed), err)
+
+	// The next load finds the clean shutdown, and deletes the marker.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.True(t, tree.CleanShutdown())
+	marker, err := memDB.Get(metadataKeyFormat.Key([]byte(cleanShutdownKey)))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.False(t, tree.CleanShutdown())
+
+	// Pending batches are discarded, and a commit interrupted part-way is not a clean shutdown.
+	require.NoError(t, tree.ndb.setCommitPending(version+1))
+	require.NoError(t, tree.ndb.resetBatch())
+	require.NoError(t, tree.ndb.batch.Set([]byte("pending"), []byte{1}))
+	require.NoError(t, tree.Close())
+	pending, err := memDB.Get([]byte("pending"))
+	require.NoError(t, err)
+	require.Nil(t, pending)
+	marker, err = memDB.Get(metadataKeyFormat.Key([]byte(cleanShutdownKey)))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.False(t, tree.CleanShutdown())
+}
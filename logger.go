@@ -1,15 +1,19 @@
 package iavl
 
-import (
-	"fmt"
-)
-
-var (
-	debugging = false
-)
-
-func debug(format string, args ...interface{}) {
-	if debugging {
-		fmt.Printf(format, args...)
-	}
+// Logger is a structured logger with levels, see Options.Logger. Messages are followed by
+// alternating keys and values. It is satisfied by the Tendermint logger
+// (github.com/tendermint/tendermint/libs/log), so that can be passed directly.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
 }
+
+// nopLogger is a Logger discarding all messages, used if Options.Logger is nil.
+type nopLogger struct{}
+
+var _ Logger = nopLogger{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,73 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// recordingLogger records the messages logged at each level.
+type recordingLogger struct {
+	mtx     sync.Mutex
+	entries []string
+}
+
+func (l *recordingLogger) log(level, msg string, keyvals ...interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.entries = append(l.entries, fmt.Sprintf("%v %v", level, msg))
+	if len(keyvals)%2 != 0 {
+		panic(fmt.Sprintf("odd number of keyvals for %q", msg))
+	}
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals...) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals...) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals...) }
+
+func (l *recordingLogger) count(entry string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for _, e := range l.entries {
+		if e == entry {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 2, &Options{Logger: logger})
+	require.NoError(t, err)
+
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 10; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%d", i)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, logger.count("info saving version"))
+	require.Positive(t, logger.count("debug saving node"))
+	require.Positive(t, logger.count("debug saving orphan"))
+	require.Positive(t, logger.count("debug evicted node from cache"))
+
+	require.NoError(t, tree.DeleteVersion(1))
+	require.Equal(t, 1, logger.count("info deleting version"))
+	require.Positive(t, logger.count("debug deleting orphan"))
+	require.Zero(t, logger.count("error failed to delete orphan"))
+}
+
+func TestLogger_Nil(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{})
+	require.NoError(t, err)
+	tree.Set([]byte("k"), []byte("v"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, nopLogger{}, tree.ndb.logger)
+}
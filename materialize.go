@@ -0,0 +1,63 @@
+package iavl
+
+import (
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// ErrTreeTooLarge is returned by MaterializeInMemory for trees exceeding the size limit.
+var ErrTreeTooLarge = errors.New("tree too large to materialize")
+
+// MaterializeInMemory loads the whole tree into memory, and returns a copy of it detached from the
+// node database, e.g. for simulations and gas estimation which read it heavily without touching
+// disk. Loaded nodes are not added to the node cache. If the encoded size of the nodes exceeds
+// maxBytes, an error matching ErrTreeTooLarge is returned. Zero or less means unlimited.
+//
+// The copy has no versions other than its own, and uses neither fast nodes nor the caches of this
+// tree.
+func (t *ImmutableTree) MaterializeInMemory(maxBytes int64) (*ImmutableTree, error) {
+	tree := &ImmutableTree{
+		ndb:     newNodeDB(dbm.NewMemDB(), 0, nil),
+		version: t.version,
+	}
+	if t.root == nil {
+		return tree, nil
+	}
+	var size int64
+	root, err := t.materialize(t.root, maxBytes, &size)
+	if err != nil {
+		return nil, err
+	}
+	tree.root = root
+	return tree, nil
+}
+
+// materialize returns an in-memory copy of the subtree of node, adding the encoded size of its
+// nodes to size.
+func (t *ImmutableTree) materialize(node *Node, maxBytes int64, size *int64) (*Node, error) {
+	*size += int64(node.encodedSize())
+	if maxBytes > 0 && *size > maxBytes {
+		return nil, errors.Wrapf(ErrTreeTooLarge, "version %v exceeds %v bytes", t.version, maxBytes)
+	}
+	copied := *node
+	if node.isLeaf() {
+		return &copied, nil
+	}
+
+	left := node.leftNode
+	if left == nil {
+		left = t.ndb.getNode(node.leftHash, false)
+	}
+	right := node.rightNode
+	if right == nil {
+		right = t.ndb.getNode(node.rightHash, false)
+	}
+	var err error
+	if copied.leftNode, err = t.materialize(left, maxBytes, size); err != nil {
+		return nil, err
+	}
+	if copied.rightNode, err = t.materialize(right, maxBytes, size); err != nil {
+		return nil, err
+	}
+	return &copied, nil
+}
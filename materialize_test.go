@@ -0,0 +1,63 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMaterializeInMemory(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTree(memDB, 1000)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	_, err = itree.MaterializeInMemory(100)
+	require.True(t, errors.Is(err, ErrTreeTooLarge), "got %v", err)
+	mtree, err := itree.MaterializeInMemory(0)
+	require.NoError(t, err)
+	require.Equal(t, 1, tree.ndb.nodeCache.Len())
+
+	// The copy doesn't read the database.
+	for key := range dumpPrefix(t, memDB, nil) {
+		require.NoError(t, memDB.Delete([]byte(key)))
+	}
+	require.Equal(t, hash, mtree.Hash())
+	require.EqualValues(t, version, mtree.Version())
+	require.EqualValues(t, 100, mtree.Size())
+	require.Equal(t, []byte("value42"), mtree.Get([]byte("key042")))
+	require.Nil(t, mtree.Get([]byte("missing")))
+	value, proof, err := mtree.GetWithProof([]byte("key042"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value42"), value)
+	require.NoError(t, proof.Verify(hash))
+	count := 0
+	mtree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 100, count)
+
+	// Unsaved nodes of a working tree are copied too.
+	work, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	work.Set([]byte("a"), []byte("1"))
+	work.Set([]byte("b"), []byte("2"))
+	mtree, err = work.ImmutableTree.MaterializeInMemory(0)
+	require.NoError(t, err)
+	require.Equal(t, work.WorkingHash(), mtree.Hash())
+}
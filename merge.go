@@ -0,0 +1,113 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// MergeFunc computes the new value of a key from its existing value, or nil if it doesn't exist,
+// and the operands of its pending merges in the order they were made. Returning nil removes the
+// key. The existing value and operands must not be modified.
+type MergeFunc func(key, existing []byte, operands [][]byte) []byte
+
+// pendingMerge holds the merges of a key which have not been applied yet.
+type pendingMerge struct {
+	fn       MergeFunc
+	operands [][]byte
+}
+
+// Merge records a merge of an operand into the value of a key, e.g. an increment of a balance,
+// without reading the key. The merges of a key are applied to the working tree together, with a
+// single call to the merge function given with the last of them, only when the working tree is
+// hashed or saved, in key order, see ApplyMerges, so that the resulting tree doesn't depend on
+// the reads made in between. The merge function must therefore be deterministic.
+//
+// Get and Has return the merged value by calling the merge function without applying it, on
+// every read. A Set or Remove of a key supersedes its pending merges, returning the merged value
+// as the previous one, and DeleteRange discards them. Other reads of the working tree, such as
+// iteration, proofs and GetWithIndex, don't see pending merges until they are applied. Rollback
+// discards pending merges. Merge functions can't be journaled, so Merge returns an error if
+// Options.Journal is set, rather than letting pending merges be lost on replay.
+func (tree *MutableTree) Merge(key, operand []byte, fn MergeFunc) error {
+	if tree.ndb.opts.Journal {
+		return errors.New("merges can't be journaled, see Options.Journal")
+	}
+	if tree.pendingMerges == nil {
+		tree.pendingMerges = map[string]*pendingMerge{}
+	}
+	m, ok := tree.pendingMerges[string(key)]
+	if !ok {
+		m = &pendingMerge{}
+		tree.pendingMerges[string(key)] = m
+	}
+	m.fn = fn
+	m.operands = append(m.operands, operand)
+	return nil
+}
+
+// ApplyMerges applies all pending merges to the working tree, in key order. It is called by
+// WorkingHash and SaveVersion. If a merged value exceeds the size limits, an error matching
+// ErrKeyTooLarge or ErrValueTooLarge is returned and no merges are applied, so that the
+// offending key can be set or removed, superseding its merges, or the working tree rolled back.
+func (tree *MutableTree) ApplyMerges() error {
+	if len(tree.pendingMerges) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(tree.pendingMerges))
+	for key := range tree.pendingMerges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = tree.getMerged(tree.ImmutableTree, []byte(key))
+		if values[i] == nil {
+			continue
+		}
+		if err := tree.ndb.checkSize([]byte(key), values[i]); err != nil {
+			return errors.Wrap(err, "merge result")
+		}
+	}
+	for i, key := range keys {
+		delete(tree.pendingMerges, key)
+		if values[i] == nil {
+			tree.Remove([]byte(key))
+		} else {
+			tree.Set([]byte(key), values[i])
+		}
+	}
+	return nil
+}
+
+// getMerged is like getFrom, but returns the value with the pending merges of the key applied,
+// without applying them to the working tree.
+func (tree *MutableTree) getMerged(working *ImmutableTree, key []byte) []byte {
+	value := tree.getFrom(working, key)
+	if m, ok := tree.pendingMerges[string(key)]; ok {
+		value = m.fn(key, value, m.operands)
+	}
+	return value
+}
+
+// takeMerged returns the value of a key with its pending merges applied, and discards them, for a
+// write superseding them. It returns false if the key has no pending merges.
+func (tree *MutableTree) takeMerged(key []byte) ([]byte, bool) {
+	m, ok := tree.pendingMerges[string(key)]
+	if !ok {
+		return nil, false
+	}
+	delete(tree.pendingMerges, string(key))
+	return m.fn(key, tree.get(key), m.operands), true
+}
+
+// discardMerges discards the pending merges of keys in [start, end), see DeleteRange.
+func (tree *MutableTree) discardMerges(start, end []byte) {
+	for key := range tree.pendingMerges {
+		k := []byte(key)
+		if (start == nil || bytes.Compare(k, start) >= 0) && (end == nil || bytes.Compare(k, end) < 0) {
+			delete(tree.pendingMerges, key)
+		}
+	}
+}
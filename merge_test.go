@@ -0,0 +1,88 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMerge(t *testing.T) {
+	calls := 0
+	add := func(key, existing []byte, operands [][]byte) []byte {
+		calls++
+		var sum uint64
+		if existing != nil {
+			sum = binary.BigEndian.Uint64(existing)
+		}
+		for _, op := range operands {
+			sum += binary.BigEndian.Uint64(op)
+		}
+		if sum == 0 {
+			return nil
+		}
+		return formatUint64(sum)
+	}
+
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), formatUint64(10))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, tree.Merge([]byte("a"), formatUint64(1), add))
+		require.NoError(t, tree.Merge([]byte("b"), formatUint64(2), add))
+	}
+	require.Zero(t, calls)
+
+	// Reads compute the merged value without applying it.
+	root := tree.root
+	require.Equal(t, formatUint64(15), tree.Get([]byte("a")))
+	require.True(t, tree.Has([]byte("b")))
+	require.Equal(t, 2, calls)
+	require.Same(t, root, tree.root)
+	require.Len(t, tree.pendingMerges, 2)
+	calls = 0
+
+	// Merges are applied when saving.
+	require.NoError(t, tree.Merge([]byte("a"), formatUint64(1), add))
+	require.NoError(t, tree.Merge([]byte("c"), formatUint64(0), add))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+	require.Equal(t, formatUint64(16), tree.Get([]byte("a")))
+	require.Equal(t, formatUint64(10), tree.Get([]byte("b")))
+	require.False(t, tree.Has([]byte("c")))
+
+	// Writes supersede pending merges, returning the merged value as the previous one.
+	require.NoError(t, tree.Merge([]byte("a"), formatUint64(4), add))
+	old, updated, err := tree.SetWithOldValue([]byte("a"), formatUint64(1))
+	require.NoError(t, err)
+	require.Equal(t, formatUint64(20), old)
+	require.True(t, updated)
+	require.NoError(t, tree.Merge([]byte("b"), formatUint64(5), add))
+	value, removed := tree.Remove([]byte("b"))
+	require.Equal(t, formatUint64(15), value)
+	require.True(t, removed)
+
+	// Rollback and DeleteRange discard pending merges.
+	require.NoError(t, tree.Merge([]byte("a"), formatUint64(1), add))
+	tree.Rollback()
+	require.NoError(t, tree.Merge([]byte("d"), formatUint64(1), add))
+	tree.DeleteRange([]byte("d"), nil)
+	calls = 0
+	require.NoError(t, tree.ApplyMerges())
+	require.Zero(t, calls)
+	require.Equal(t, formatUint64(16), tree.Get([]byte("a")))
+	require.Equal(t, formatUint64(10), tree.Get([]byte("b")))
+	require.Nil(t, tree.Get([]byte("d")))
+}
+
+func TestMerge_Journal(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{Journal: true})
+	require.NoError(t, err)
+	err = tree.Merge([]byte("a"), []byte{1}, func(key, existing []byte, operands [][]byte) []byte {
+		return operands[0]
+	})
+	require.Error(t, err)
+	require.Nil(t, tree.Get([]byte("a")))
+}
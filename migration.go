@@ -0,0 +1,174 @@
+package iavl
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// defaultMigrationChunkSize is the default number of keys migrated per batch, see
+// Options.MigrationChunkSize.
+const defaultMigrationChunkSize = 10000
+
+// MigrationProgress reports the progress of a storage migration, see Options.MigrationProgress.
+type MigrationProgress struct {
+	Name    string // Name of the migration.
+	Version int    // Storage format version the migration upgrades to.
+	Keys    int64  // Number of keys migrated so far by this run.
+	Done    bool   // Whether the migration has completed.
+}
+
+// migration upgrades the storage format of a database. Migrations are run in chunks when a
+// version is loaded, each chunk being written in the same batch as a cursor recording where the
+// migration left off, so that an interrupted migration is resumed rather than restarted.
+type migration struct {
+	// name identifies the migration, and keys its cursor in the metadata.
+	name string
+
+	// version is the storage format version the migration upgrades to. Migrations are run in
+	// order of version.
+	version int
+
+	// needed returns whether the migration must be run on the database with its options. It
+	// returns an error if the database can't be used with the options at all.
+	needed func(ndb *nodeDB) (bool, error)
+
+	// step migrates up to limit keys starting at the cursor, which is nil for the first step. It
+	// writes to ndb.batch, and returns the cursor to continue from, or nil when the migration is
+	// complete, in which case it must also mark it as completed in the batch.
+	step func(ndb *nodeDB, cursor []byte, limit int) (next []byte, keys int, err error)
+}
+
+// migrations are the registered migrations, ordered by version.
+var migrations []*migration
+
+// registerMigration registers a storage migration. It must be called from an init function.
+func registerMigration(m *migration) {
+	for _, other := range migrations {
+		if other.version == m.version || other.name == m.name {
+			panic(errors.Errorf("migration %v version %v is already registered", m.name, m.version))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+}
+
+// migrationCursorKey returns the metadata key of the cursor of an in-progress migration.
+func migrationCursorKey(name string) []byte {
+	return metadataKeyFormat.Key([]byte("migration_cursor_" + name))
+}
+
+// runMigrations runs the registered migrations needed by the database, resuming any
+// interrupted ones. The lock is only held for one chunk at a time, so readers aren't blocked for
+// the whole migration. It stops between chunks if ctx is done, and the migration resumes from
+// the last chunk written when the database is next loaded.
+func (ndb *nodeDB) runMigrations(ctx context.Context) error {
+	for _, m := range migrations {
+		if err := ndb.runMigration(ctx, m); err != nil {
+			return errors.Wrapf(err, "migration %v", m.name)
+		}
+	}
+	return nil
+}
+
+// runMigration runs a single migration to completion, if needed.
+func (ndb *nodeDB) runMigration(ctx context.Context, m *migration) error {
+	ndb.mtx.Lock()
+	cursor, err := ndb.db.Get(migrationCursorKey(m.name))
+	var needed bool
+	if err == nil {
+		needed, err = m.needed(ndb)
+	}
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if !needed {
+		if cursor != nil {
+			return errors.New("migration is in progress, but not enabled")
+		}
+		return nil
+	}
+
+	limit := ndb.opts.MigrationChunkSize
+	if limit <= 0 {
+		limit = defaultMigrationChunkSize
+	}
+	progress := MigrationProgress{Name: m.name, Version: m.version}
+	ndb.logger.Info("running storage migration", "name", m.name, "version", m.version, "resumed", cursor != nil)
+	for {
+		if err := ctx.Err(); err != nil {
+			ndb.logger.Info("storage migration interrupted", "name", m.name, "keys", progress.Keys)
+			return err
+		}
+		done, err := ndb.migrateChunk(m, &cursor, limit, &progress)
+		if err != nil {
+			ndb.logger.Error("storage migration failed", "name", m.name, "keys", progress.Keys, "err", err)
+			return err
+		}
+		ndb.logger.Debug("migrated storage chunk", "name", m.name, "keys", progress.Keys)
+		if ndb.opts.MigrationProgress != nil {
+			ndb.opts.MigrationProgress(progress)
+		}
+		if done {
+			ndb.logger.Info("storage migration done", "name", m.name, "keys", progress.Keys)
+			return nil
+		}
+		if ndb.throttle != nil {
+			if err := ndb.throttle.wait(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// migrateChunk runs one step of a migration, writing it along with the updated cursor.
+func (ndb *nodeDB) migrateChunk(m *migration, cursor *[]byte, limit int, progress *MigrationProgress) (bool, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	next, keys, err := m.step(ndb, *cursor, limit)
+	if err != nil {
+		return false, err
+	}
+	if next == nil {
+		err = ndb.batch.Delete(migrationCursorKey(m.name))
+	} else {
+		err = ndb.batch.Set(migrationCursorKey(m.name), next)
+	}
+	if err != nil {
+		return false, err
+	}
+	if ndb.throttle != nil {
+		ndb.throttle.charge(keys, ndb.batch.size)
+	}
+	if err := ndb.resetBatch(); err != nil {
+		return false, err
+	}
+	*cursor = next
+	progress.Keys += int64(keys)
+	progress.Done = next == nil
+	return progress.Done, nil
+}
+
+// migrateRange calls fn for up to limit keys in [start, end). It returns the key to continue
+// from if the limit was reached, or nil if the range is exhausted.
+func (ndb *nodeDB) migrateRange(start, end []byte, limit int, fn func(k, v []byte) error) ([]byte, int, error) {
+	var next []byte
+	keys := 0
+	err := ndb.traverseRange(start, end, func(k, v []byte) error {
+		if keys >= limit {
+			next = append([]byte(nil), k...)
+			return errStopTraversal
+		}
+		keys++
+		return fn(k, v)
+	})
+	if err != nil && err != errStopTraversal {
+		return nil, keys, err
+	}
+	return next, keys, nil
+}
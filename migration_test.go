@@ -0,0 +1,87 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMigration_Resume(t *testing.T) {
+	expectDB, memDB := db.NewMemDB(), db.NewMemDB()
+	for _, d := range []db.DB{expectDB, memDB} {
+		tree, err := NewMutableTreeWithOpts(d, 0, nil)
+		require.NoError(t, err)
+		saveRefCountVersions(t, tree, 6)
+	}
+	tree, err := NewMutableTreeWithOpts(expectDB, 0, &Options{RefCountGC: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	expect := dumpPrefix(t, expectDB, refCountKeyFormat.Key())
+	require.NotEmpty(t, expect)
+
+	// Interrupt the migration after a few chunks have been written.
+	chunks := 0
+	opts := &Options{
+		RefCountGC:         true,
+		MigrationChunkSize: 5,
+		MigrationProgress: func(progress MigrationProgress) {
+			chunks++
+			if chunks == 4 {
+				panic("interrupted")
+			}
+		},
+	}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	require.PanicsWithValue(t, "interrupted", func() {
+		_, _ = tree.Load()
+	})
+	require.NotEmpty(t, dumpPrefix(t, memDB, migrationCursorKey("refcounts")))
+
+	// The migration must be completed before the database can be used without it.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.Error(t, err)
+
+	var progress []MigrationProgress
+	opts.MigrationProgress = func(p MigrationProgress) {
+		progress = append(progress, p)
+	}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, expect, dumpPrefix(t, memDB, refCountKeyFormat.Key()))
+	require.Empty(t, dumpPrefix(t, memDB, orphanKeyFormat.Key()))
+
+	last := progress[len(progress)-1]
+	require.True(t, last.Done)
+	require.Equal(t, "refcounts", last.Name)
+	require.Positive(t, last.Keys)
+	for _, p := range progress[:len(progress)-1] {
+		require.False(t, p.Done)
+	}
+
+	// Completed migrations aren't run again.
+	progress = nil
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Empty(t, progress)
+}
+
+func TestRegisterMigration_Duplicate(t *testing.T) {
+	registered := migrations
+	defer func() { migrations = registered }()
+	migrations = append([]*migration(nil), registered...)
+
+	require.Panics(t, func() {
+		registerMigration(&migration{name: "other", version: registered[0].version})
+	})
+	registerMigration(&migration{name: "other", version: 0})
+	require.Equal(t, "other", migrations[0].name)
+}
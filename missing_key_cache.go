@@ -0,0 +1,65 @@
+package iavl
+
+import "sync"
+
+// missingKeyCache caches keys confirmed to be absent from the latest saved version, see
+// Options.MissingKeyCacheSize.
+type missingKeyCache struct {
+	mtx     sync.Mutex
+	version int64 // The version the cached keys are absent from.
+	keys    *lruCache
+}
+
+func newMissingKeyCache(size int) *missingKeyCache {
+	return &missingKeyCache{keys: newLRUCache(size)}
+}
+
+// has returns whether the key is known to be absent from the given version.
+func (c *missingKeyCache) has(version int64, key []byte) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if version != c.version {
+		return false
+	}
+	_, ok := c.keys.Get(key)
+	return ok
+}
+
+// add records that the key is absent from the given version. It is ignored if the cache has
+// since moved on to another version, so that a lookup racing with SaveVersion() can't cache a
+// key which was just added.
+func (c *missingKeyCache) add(version int64, key []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if version == c.version {
+		c.keys.Add(key, nil)
+	}
+}
+
+// advance moves the cache to a newly saved version, invalidating the keys added in it. Keys
+// absent from the previous version and not added remain absent. If the version doesn't follow
+// the cached version, the cache is reset instead.
+func (c *missingKeyCache) advance(version int64, added map[string]*FastNode) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.version != version-1 {
+		c.resetUnlocked(version)
+		return
+	}
+	for key := range added {
+		c.keys.Remove([]byte(key))
+	}
+	c.version = version
+}
+
+// reset clears the cache, e.g. when the latest version is reloaded or deleted.
+func (c *missingKeyCache) reset(version int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.resetUnlocked(version)
+}
+
+func (c *missingKeyCache) resetUnlocked(version int64) {
+	c.keys.RemoveIf(func(string, interface{}) bool { return true })
+	c.version = version
+}
@@ -0,0 +1,69 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestMissingKeyCache(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MissingKeyCacheSize: 10})
+	require.NoError(t, err)
+	cache := tree.ndb.missingKeys
+
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.Nil(t, tree.Get([]byte("b")))
+	require.True(t, cache.has(1, []byte("b")))
+	require.False(t, tree.Has([]byte("c")))
+	require.True(t, cache.has(1, []byte("c")))
+	require.NotNil(t, tree.Get([]byte("a")))
+	require.False(t, cache.has(1, []byte("a")))
+
+	// Keys set in the working tree are visible before and after saving.
+	tree.Set([]byte("b"), []byte{2})
+	require.Equal(t, []byte{2}, tree.Get([]byte("b")))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.False(t, cache.has(2, []byte("b")))
+	require.True(t, cache.has(2, []byte("c")))
+	require.Equal(t, []byte{2}, tree.Get([]byte("b")))
+	require.True(t, tree.Has([]byte("b")))
+
+	// Older versions don't use the cache.
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Nil(t, itree.Get([]byte("b")))
+	require.False(t, cache.has(2, []byte("b")))
+
+	// Reloading an older version resets the cache.
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	require.False(t, cache.has(2, []byte("c")))
+	require.False(t, cache.has(1, []byte("c")))
+	tree.Set([]byte("c"), []byte{3})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, tree.Get([]byte("c")))
+}
+
+func TestMissingKeyCache_StaleAdd(t *testing.T) {
+	cache := newMissingKeyCache(10)
+	cache.advance(1, nil)
+	cache.add(1, []byte("a"))
+	require.True(t, cache.has(1, []byte("a")))
+
+	// A lookup of version 1 finishing after version 2 added the key must not cache it.
+	cache.advance(2, map[string]*FastNode{"a": nil, "b": nil})
+	cache.add(1, []byte("b"))
+	require.False(t, cache.has(2, []byte("a")))
+	require.False(t, cache.has(2, []byte("b")))
+
+	// Skipping a version resets the cache.
+	cache.add(2, []byte("c"))
+	cache.advance(4, nil)
+	require.False(t, cache.has(4, []byte("c")))
+}
@@ -2,8 +2,10 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"math"
 	"runtime"
 	"sort"
 	"sync"
@@ -17,6 +19,24 @@ import (
 // ErrVersionDoesNotExist is returned if a requested version does not exist.
 var ErrVersionDoesNotExist = errors.New("version does not exist")
 
+// ErrKeyNotFound is returned if a requested key does not exist in the version.
+var ErrKeyNotFound = errors.New("key not found")
+
+// VersionExistsError is returned by SaveVersion when the version was already saved with a
+// different root hash, e.g. when replaying blocks after a crash diverges from the saved state.
+// Saving a version again with the same root hash is a no-op instead.
+type VersionExistsError struct {
+	Version      int64
+	ExistingHash []byte
+	NewHash      []byte
+}
+
+// Error implements the error interface.
+func (e *VersionExistsError) Error() string {
+	return fmt.Sprintf("version %d was already saved to different hash %X (existing hash %X)",
+		e.Version, e.NewHash, e.ExistingHash)
+}
+
 // MutableTree is a persistent tree which keeps track of versions. It is not safe for concurrent
 // use, and should be guarded by a Mutex or RWLock as appropriate. An immutable tree at a given
 // version can be returned via GetImmutable, which is safe for concurrent access.
@@ -26,16 +46,34 @@ var ErrVersionDoesNotExist = errors.New("version does not exist")
 //
 // The inner ImmutableTree should not be used directly by callers.
 type MutableTree struct {
-	*ImmutableTree                                  // The current, working tree.
-	lastSaved                *ImmutableTree         // The most recently saved tree.
-	orphans                  map[string]int64       // Nodes removed by changes to working tree.
-	versions                 map[int64]bool         // The previous, saved versions of the tree.
-	allRootLoaded            bool                   // Whether all roots are loaded or not(by LazyLoadVersion)
-	unsavedFastNodeAdditions map[string]*FastNode   // FastNodes that have not yet been saved to disk
-	unsavedFastNodeRemovals  map[string]interface{} // FastNodes that have not yet been removed from disk
+	*ImmutableTree                                     // The current, working tree.
+	lastSaved                *ImmutableTree            // The most recently saved tree.
+	orphans                  map[string]int64          // Nodes removed by changes to working tree.
+	versions                 map[int64]bool            // The previous, saved versions of the tree.
+	allRootLoaded            bool                      // Whether all roots are loaded or not(by LazyLoadVersion)
+	versionIndex             *versionIndex             // Sorted persisted versions, nil until built after a lazy load
+	unsavedFastNodeAdditions map[string]*FastNode      // FastNodes that have not yet been saved to disk
+	unsavedFastNodeRemovals  map[string]interface{}    // FastNodes that have not yet been removed from disk
+	journalSeq               int64                     // Sequence number of the next journal entry
+	journalErr               error                     // First error writing the journal, returned by SaveVersion
+	hooks                    []Hooks                   // Hooks notified of changes, see AddHooks
+	pendingMetadata          *VersionMetadata          // Metadata of the working version, see SetVersionMetadata
+	pendingPreimages         map[string][]byte         // Pre-images registered since the last saved version
+	indexes                  map[string]IndexExtractor // Secondary indexes by name, see RegisterIndex
+	pendingExpiries          map[string]int64          // Expiries changed in the working tree, 0 if cleared, see SetWithExpiry
+	purgedExpiries           [][]byte                  // Expiry index entries processed by PurgeExpired
+	pendingMerges            map[string]*pendingMerge  // Merges not applied to the working tree yet, see Merge
+	rotations                []Rotation                // Rotations of the working tree, see Options.RotationAudit
+	savedRotations           []Rotation                // Rotations of the last saved version, see Options.RotationAudit
+	orphanedLeaves           map[string]bool           // Keys of saved leaves orphaned by the working tree
+	saveStats                SaveStats                 // Statistics of the last saved version, see LastSaveStats
+	maintenanceErr           error                     // Error of pruning or demotion by the last save, see MaintenanceError
+	pruneCursor              int64                     // First version not visited by pruning yet, see pruneWith
+	pruneSkipped             []int64                   // Prunable versions skipped because of readers or retention
 	ndb                      *nodeDB
 
-	mtx sync.RWMutex // versions Read/write lock.
+	mtx     sync.RWMutex // versions Read/write lock.
+	condMtx sync.Mutex   // Serializes conditional writes, see CompareAndSwap.
 }
 
 // NewMutableTree returns a new tree with the specified cache size and datastore.
@@ -46,6 +84,14 @@ func NewMutableTree(db dbm.DB, cacheSize int) (*MutableTree, error) {
 // NewMutableTreeWithOpts returns a new tree with the specified options.
 func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) (*MutableTree, error) {
 	ndb := newNodeDB(db, cacheSize, opts)
+	if err := ndb.checkChecksums(); err != nil {
+		return nil, err
+	}
+	if ndb.opts.ColdTier != nil {
+		if err := ndb.loadColdTierDemoted(); err != nil {
+			return nil, err
+		}
+	}
 	head := &ImmutableTree{ndb: ndb}
 
 	return &MutableTree{
@@ -56,6 +102,7 @@ func NewMutableTreeWithOpts(db dbm.DB, cacheSize int, opts *Options) (*MutableTr
 		allRootLoaded:            false,
 		unsavedFastNodeAdditions: make(map[string]*FastNode),
 		unsavedFastNodeRemovals:  make(map[string]interface{}),
+		pendingExpiries:          make(map[string]int64),
 		ndb:                      ndb,
 	}, nil
 }
@@ -69,26 +116,41 @@ func (tree *MutableTree) IsEmpty() bool {
 // VersionExists returns whether or not a version exists.
 func (tree *MutableTree) VersionExists(version int64) bool {
 	tree.mtx.RLock()
-	defer tree.mtx.RUnlock()
-
-	if tree.allRootLoaded {
-		return tree.versions[version]
+	if tree.versionIndex != nil {
+		defer tree.mtx.RUnlock()
+		return tree.versionIndex.contains(version)
 	}
-
 	has, ok := tree.versions[version]
-	if ok {
+	allRootLoaded := tree.allRootLoaded
+	tree.mtx.RUnlock()
+
+	if ok || allRootLoaded {
 		return has
 	}
+
+	// The versions map is written under the write lock, since concurrent readers may hold the
+	// read lock.
 	has, _ = tree.ndb.HasRoot(version)
+	tree.mtx.Lock()
 	tree.versions[version] = has
+	tree.mtx.Unlock()
 	return has
 }
 
-// AvailableVersions returns all available versions in ascending order
+// AvailableVersions returns all available versions in ascending order. After a lazy load, only
+// the versions accessed so far are returned until the version index is built, see Versions.
 func (tree *MutableTree) AvailableVersions() []int {
 	tree.mtx.RLock()
 	defer tree.mtx.RUnlock()
 
+	if tree.versionIndex != nil {
+		res := make([]int, 0, len(tree.versionIndex.versions))
+		for _, version := range tree.versionIndex.versions {
+			res = append(res, int(version))
+		}
+		return res
+	}
+
 	res := make([]int, 0, len(tree.versions))
 	for i, v := range tree.versions {
 		if v {
@@ -105,8 +167,15 @@ func (tree *MutableTree) Hash() []byte {
 	return tree.lastSaved.Hash()
 }
 
-// WorkingHash returns the hash of the current working tree.
+// WorkingHash returns the hash of the current working tree. Node hashes are memoized, and
+// Set/Remove only replace the nodes on the path to the updated key, so this only hashes the nodes
+// changed since the previous call, and is O(1) if the working tree is unchanged.
+//
+// It applies pending merges first, and panics with the error of ApplyMerges, if any.
 func (tree *MutableTree) WorkingHash() []byte {
+	if err := tree.ApplyMerges(); err != nil {
+		panic(err)
+	}
 	return tree.ImmutableTree.Hash()
 }
 
@@ -124,26 +193,100 @@ func (tree *MutableTree) prepareOrphansSlice() []*Node {
 // Set sets a key in the working tree. Nil values are invalid. The given
 // key/value byte slices must not be modified after this call, since they point
 // to slices stored within IAVL. It returns true when an existing value was
-// updated, while false means it was a new key.
+// updated, while false means it was a new key. It panics with an error matching
+// ErrKeyTooLarge or ErrValueTooLarge if the entry exceeds the size limits, see SetChecked.
 func (tree *MutableTree) Set(key, value []byte) (updated bool) {
+	updated, err := tree.SetChecked(key, value)
+	if err != nil {
+		panic(err)
+	}
+	return updated
+}
+
+// SetChecked is like Set, but returns an error matching ErrKeyTooLarge or ErrValueTooLarge,
+// leaving the working tree unchanged, if the entry exceeds Options.MaxKeySize or
+// Options.MaxValueSize.
+func (tree *MutableTree) SetChecked(key, value []byte) (updated bool, err error) {
+	_, updated, err = tree.SetWithOldValue(key, value)
+	return updated, err
+}
+
+// SetWithOldValue is like SetChecked, but also returns the previous value of the key, or nil if
+// it is a new key, found while descending the tree to set it. It spares callers needing the
+// previous value, e.g. to update indexes, a separate Get. The returned value must not be
+// modified.
+func (tree *MutableTree) SetWithOldValue(key, value []byte) (oldValue []byte, updated bool, err error) {
+	if err := tree.ndb.checkSize(key, value); err != nil {
+		return nil, false, err
+	}
+	merged, pending := tree.takeMerged(key)
 	var orphaned []*Node
-	orphaned, updated = tree.set(key, value)
+	orphaned, oldValue, updated = tree.set(key, value)
 	tree.addOrphans(orphaned)
-	return updated
+	if pending {
+		oldValue, updated = merged, merged != nil
+	}
+	tree.journal(journalOpSet, key, value)
+	tree.clearExpiry(key)
+	for _, h := range tree.hooks {
+		h.OnSet(key, value)
+	}
+	return oldValue, updated, nil
 }
 
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (t *MutableTree) Get(key []byte) []byte {
-	if t.root == nil {
+	return t.getMerged(t.ImmutableTree, key)
+}
+
+// get is like Get, but ignores pending merges.
+func (t *MutableTree) get(key []byte) []byte {
+	return t.getFrom(t.ImmutableTree, key)
+}
+
+// getFrom is like get, but reads the saved nodes through the given copy of the working tree,
+// e.g. one recording its reads, see startSpan.
+func (t *MutableTree) getFrom(working *ImmutableTree, key []byte) []byte {
+	if working.root == nil {
 		return nil
 	}
 
 	if fastNode, ok := t.unsavedFastNodeAdditions[string(key)]; ok {
 		return fastNode.value
 	}
+	if _, ok := t.unsavedFastNodeRemovals[string(key)]; ok {
+		return nil
+	}
+
+	return working.Get(key)
+}
+
+// Has returns whether or not a key exists in the working tree.
+func (t *MutableTree) Has(key []byte) bool {
+	if _, ok := t.pendingMerges[string(key)]; ok {
+		return t.getMerged(t.ImmutableTree, key) != nil
+	}
+	if t.root == nil {
+		return false
+	}
+	if _, ok := t.unsavedFastNodeAdditions[string(key)]; ok {
+		return true
+	}
+	if _, ok := t.unsavedFastNodeRemovals[string(key)]; ok {
+		return false
+	}
+	return t.ImmutableTree.Has(key)
+}
 
-	return t.ImmutableTree.Get(key)
+// HasAll returns whether or not each of the given keys exists in the working tree, in the order
+// given.
+func (t *MutableTree) HasAll(keys [][]byte) []bool {
+	has := make([]bool, len(keys))
+	for i, key := range keys {
+		has[i] = t.Has(key)
+	}
+	return has
 }
 
 // Import returns an importer for tree nodes previously exported by ImmutableTree.Export(),
@@ -158,6 +301,24 @@ func (tree *MutableTree) Import(version int64) (*Importer, error) {
 	return newImporter(tree, version)
 }
 
+// ImportContext is like Import, but the importer returns the context's error once ctx is done.
+// The nodes already flushed are left in the database, but the version is not visible.
+func (tree *MutableTree) ImportContext(ctx context.Context, version int64) (*Importer, error) {
+	importer, err := newImporter(tree, version)
+	if err != nil {
+		return nil, err
+	}
+	importer.ctx = ctx
+	return importer, nil
+}
+
+// TraverseNodeHashes calls fn with the hash, encoded size and version of every node persisted in
+// the database, across all versions, without fully decoding the nodes. The hash is only valid
+// until fn returns.
+func (tree *MutableTree) TraverseNodeHashes(fn func(hash []byte, size int, version int64) error) error {
+	return tree.ndb.TraverseNodeHashes(fn)
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callnack, false otherwise
 func (t *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
@@ -179,13 +340,27 @@ func (t *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped b
 	return false
 }
 
+// IterateContext is like Iterate, but stops with the context's error if ctx is done.
+func (t *MutableTree) IterateContext(ctx context.Context, fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	stopped = t.Iterate(func(key, value []byte) bool {
+		if err = ctx.Err(); err != nil {
+			return true
+		}
+		return fn(key, value)
+	})
+	if err != nil {
+		return false, err
+	}
+	return stopped, nil
+}
+
 // Iterator returns an iterator over the mutable tree.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (t *MutableTree) Iterator(start, end []byte, ascending bool) dbm.Iterator {
 	return NewUnsavedFastIterator(start, end, ascending, t.ndb, t.unsavedFastNodeAdditions, t.unsavedFastNodeRemovals)
 }
 
-func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated bool) {
+func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, oldValue []byte, updated bool) {
 	if value == nil {
 		panic(fmt.Sprintf("Attempt to store nil value at key '%s'", key))
 	}
@@ -193,16 +368,16 @@ func (tree *MutableTree) set(key []byte, value []byte) (orphans []*Node, updated
 	if tree.ImmutableTree.root == nil {
 		tree.addUnsavedAddition(key, NewFastNode(key, value, tree.version+1))
 		tree.ImmutableTree.root = NewNode(key, value, tree.version+1)
-		return nil, updated
+		return nil, nil, updated
 	}
 
 	orphans = tree.prepareOrphansSlice()
-	tree.ImmutableTree.root, updated = tree.recursiveSet(tree.ImmutableTree.root, key, value, &orphans)
-	return orphans, updated
+	tree.ImmutableTree.root, oldValue, updated = tree.recursiveSet(tree.ImmutableTree.root, key, value, &orphans)
+	return orphans, oldValue, updated
 }
 
 func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orphans *[]*Node) (
-	newSelf *Node, updated bool,
+	newSelf *Node, oldValue []byte, updated bool,
 ) {
 	version := tree.version + 1
 
@@ -218,7 +393,7 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 				leftNode:  NewNode(key, value, version),
 				rightNode: node,
 				version:   version,
-			}, false
+			}, nil, false
 		case 1:
 			return &Node{
 				key:       key,
@@ -227,37 +402,50 @@ func (tree *MutableTree) recursiveSet(node *Node, key []byte, value []byte, orph
 				leftNode:  node,
 				rightNode: NewNode(key, value, version),
 				version:   version,
-			}, false
+			}, nil, false
 		default:
 			*orphans = append(*orphans, node)
-			return NewNode(key, value, version), true
+			return NewNode(key, value, version), node.value, true
 		}
 	} else {
 		*orphans = append(*orphans, node)
 		node = node.clone(version)
 
 		if bytes.Compare(key, node.key) < 0 {
-			node.leftNode, updated = tree.recursiveSet(node.getLeftNode(tree.ImmutableTree), key, value, orphans)
+			node.leftNode, oldValue, updated = tree.recursiveSet(node.getLeftNode(tree.ImmutableTree), key, value, orphans)
 			node.leftHash = nil // leftHash is yet unknown
 		} else {
-			node.rightNode, updated = tree.recursiveSet(node.getRightNode(tree.ImmutableTree), key, value, orphans)
+			node.rightNode, oldValue, updated = tree.recursiveSet(node.getRightNode(tree.ImmutableTree), key, value, orphans)
 			node.rightHash = nil // rightHash is yet unknown
 		}
 
 		if updated {
-			return node, updated
+			return node, oldValue, updated
 		}
 		node.calcHeightAndSize(tree.ImmutableTree)
 		newNode := tree.balance(node, orphans)
-		return newNode, updated
+		return newNode, oldValue, updated
 	}
 }
 
 // Remove removes a key from the working tree. The given key byte slice should not be modified
-// after this call, since it may point to data stored inside IAVL.
+// after this call, since it may point to data stored inside IAVL. It returns the removed value,
+// found while descending the tree to remove it, so no preceding Get is needed, and whether the
+// key existed.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool) {
+	merged, pending := tree.takeMerged(key)
 	val, orphaned, removed := tree.remove(key)
 	tree.addOrphans(orphaned)
+	if removed {
+		tree.journal(journalOpRemove, key, nil)
+		tree.clearExpiry(key)
+		for _, h := range tree.hooks {
+			h.OnRemove(key)
+		}
+	}
+	if pending {
+		return merged, merged != nil
+	}
 	return val, removed
 }
 
@@ -352,10 +540,23 @@ func (tree *MutableTree) Load() (int64, error) {
 // will be loaded by default. If the latest version is non-positive, this method
 // performs a no-op. Otherwise, if the root does not exist, an error will be
 // returned.
-func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
-	latestVersion := tree.ndb.getLatestVersion()
+func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (version int64, err error) {
+	defer recoverNodeMissing(&err)
+	ctx := context.Background()
+	if err := tree.ndb.recoverOnLoad(); err != nil {
+		return 0, err
+	}
+	if err := tree.ndb.runMigrations(ctx); err != nil {
+		return 0, err
+	}
+
+	latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
 	if latestVersion < targetVersion {
-		return latestVersion, fmt.Errorf("wanted to load target %d but only found up to %d", targetVersion, latestVersion)
+		return latestVersion, errors.Wrapf(ErrVersionDoesNotExist, "wanted to load target %d but only found up to %d",
+			targetVersion, latestVersion)
 	}
 
 	// no versions have been saved if the latest version is non-positive
@@ -363,10 +564,13 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		if targetVersion <= 0 {
 			tree.mtx.Lock()
 			defer tree.mtx.Unlock()
-			_, err := tree.enableFastStorageAndCommitIfNotEnabled()
+			if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
+				return 0, err
+			}
+			_, err := tree.replayJournal()
 			return 0, err
 		}
-		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
+		return 0, errors.Wrapf(ErrVersionDoesNotExist, "no versions found while trying to load %v", targetVersion)
 	}
 
 	// default to the latest version if the targeted version is non-positive
@@ -379,13 +583,14 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		return 0, err
 	}
 	if rootHash == nil {
-		return latestVersion, ErrVersionDoesNotExist
+		return latestVersion, tree.ndb.versionMissing(targetVersion, ErrVersionDoesNotExist)
 	}
 
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
 	tree.versions[targetVersion] = true
+	tree.versionIndex = nil
 
 	iTree := &ImmutableTree{
 		ndb:     tree.ndb,
@@ -397,20 +602,41 @@ func (tree *MutableTree) LazyLoadVersion(targetVersion int64) (int64, error) {
 		iTree.root = tree.ndb.GetNode(rootHash)
 	}
 
-	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = iTree
 	tree.lastSaved = iTree.clone()
+	tree.resetWorkingState(true)
 
 	// Attempt to upgrade
-	if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
+	if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
 		return 0, err
 	}
 
+	if targetVersion == latestVersion {
+		if _, err := tree.replayJournal(); err != nil {
+			return targetVersion, err
+		}
+	}
+
 	return targetVersion, nil
 }
 
 // Returns the version number of the latest version found
-func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+func (tree *MutableTree) LoadVersion(targetVersion int64) (version int64, err error) {
+	return tree.LoadVersionContext(context.Background(), targetVersion)
+}
+
+// LoadVersionContext is like LoadVersion, but stops any storage migration or fast storage
+// upgrade if ctx is done. Migrations resume where they stopped when the tree is next loaded,
+// while the fast storage upgrade starts over.
+func (tree *MutableTree) LoadVersionContext(ctx context.Context, targetVersion int64) (version int64, err error) {
+	defer recoverNodeMissing(&err)
+	if err := tree.ndb.recoverOnLoad(); err != nil {
+		return 0, err
+	}
+	if err := tree.ndb.runMigrations(ctx); err != nil {
+		return 0, err
+	}
+
 	roots, err := tree.ndb.getRoots()
 	if err != nil {
 		return 0, err
@@ -420,10 +646,13 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		if targetVersion <= 0 {
 			tree.mtx.Lock()
 			defer tree.mtx.Unlock()
-			_, err := tree.enableFastStorageAndCommitIfNotEnabled()
+			if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
+				return 0, err
+			}
+			_, err := tree.replayJournal()
 			return 0, err
 		}
-		return 0, fmt.Errorf("no versions found while trying to load %v", targetVersion)
+		return 0, errors.Wrapf(ErrVersionDoesNotExist, "no versions found while trying to load %v", targetVersion)
 	}
 
 	firstVersion := int64(0)
@@ -432,6 +661,8 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
+	tree.versionIndex = newVersionIndex(roots)
+
 	var latestRoot []byte
 	for version, r := range roots {
 		tree.versions[version] = true
@@ -445,8 +676,8 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	}
 
 	if !(targetVersion == 0 || latestVersion == targetVersion) {
-		return latestVersion, fmt.Errorf("wanted to load target %v but only found up to %v",
-			targetVersion, latestVersion)
+		return latestVersion, tree.ndb.versionMissing(targetVersion, errors.Wrapf(ErrVersionDoesNotExist,
+			"wanted to load target %v but only found up to %v", targetVersion, latestVersion))
 	}
 
 	if firstVersion > 0 && firstVersion < int64(tree.ndb.opts.InitialVersion) {
@@ -463,37 +694,66 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		t.root = tree.ndb.GetNode(latestRoot)
 	}
 
-	tree.orphans = map[string]int64{}
 	tree.ImmutableTree = t
 	tree.lastSaved = t.clone()
 	tree.allRootLoaded = true
+	tree.resetWorkingState(true)
 
 	// Attempt to upgrade
-	if _, err := tree.enableFastStorageAndCommitIfNotEnabled(); err != nil {
+	if _, err := tree.enableFastStorageAndCommitIfNotEnabled(ctx); err != nil {
 		return 0, err
 	}
 
+	if latest, err := tree.ndb.getLatestVersion(); err != nil {
+		return latestVersion, err
+	} else if latestVersion == latest {
+		if _, err := tree.replayJournal(); err != nil {
+			return latestVersion, err
+		}
+	}
+
 	return latestVersion, nil
 }
 
 // LoadVersionForOverwriting attempts to load a tree at a previously committed
 // version, or the latest version below it. Any versions greater than targetVersion will be deleted.
 func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64, error) {
+	tree.ndb.mtx.Lock()
+	err := tree.ndb.checkRetention(targetVersion+1, math.MaxInt64)
+	tree.ndb.mtx.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
 	latestVersion, err := tree.LoadVersion(targetVersion)
 	if err != nil {
 		return latestVersion, err
 	}
 
+	deletedLatest, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return latestVersion, err
+	}
 	if err = tree.ndb.DeleteVersionsFrom(targetVersion + 1); err != nil {
 		return latestVersion, err
 	}
 
+	if err = tree.ndb.deleteJournalsFrom(targetVersion + 1); err != nil {
+		return latestVersion, err
+	}
+
 	if err := tree.enableFastStorageAndCommitLocked(); err != nil {
 		return latestVersion, err
 	}
 
 	tree.ndb.resetLatestVersion(latestVersion)
 
+	if deletedLatest > targetVersion {
+		if err := tree.rebuildIndexes(); err != nil {
+			return latestVersion, err
+		}
+	}
+
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
@@ -502,6 +762,9 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64,
 			delete(tree.versions, v)
 		}
 	}
+	if tree.versionIndex != nil {
+		tree.versionIndex.removeRange(targetVersion+1, math.MaxInt64)
+	}
 
 	return latestVersion, nil
 }
@@ -509,15 +772,23 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) (int64,
 // Returns true if the tree may be auto-upgraded, false otherwise
 // An example of when an upgrade may be performed is when we are enaling fast storage for the first time or
 // need to overwrite fast nodes due to mismatch with live state.
+// If the latest version can't be read, it returns true, and the upgrade returns the error.
 func (tree *MutableTree) IsUpgradeable() bool {
-	return !tree.ndb.hasUpgradedToFastStorage() || tree.ndb.shouldForceFastStorageUpgrade()
+	if !tree.ndb.hasUpgradedToFastStorage() {
+		return true
+	}
+	shouldForceUpdate, err := tree.ndb.shouldForceFastStorageUpgrade()
+	return shouldForceUpdate || err != nil
 }
 
 // enableFastStorageAndCommitIfNotEnabled if nodeDB doesn't mark fast storage as enabled, enable it, and commit the update.
 // Checks whether the fast cache on disk matches latest live state. If not, deletes all existing fast nodes and repopulates them
 // from latest tree.
-func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error) {
-	shouldForceUpdate := tree.ndb.shouldForceFastStorageUpgrade()
+func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled(ctx context.Context) (bool, error) {
+	shouldForceUpdate, err := tree.ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return false, err
+	}
 	isFastStorageEnabled := tree.ndb.hasUpgradedToFastStorage()
 
 	if !tree.IsUpgradeable() {
@@ -541,7 +812,7 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 	// Force garbage collection before we proceed to enabling fast storage.
 	runtime.GC()
 
-	if err := tree.enableFastStorageAndCommit(); err != nil {
+	if err := tree.enableFastStorageAndCommit(ctx); err != nil {
 		tree.ndb.storageVersion = defaultStorageVersionValue
 		return false, err
 	}
@@ -551,17 +822,19 @@ func (tree *MutableTree) enableFastStorageAndCommitIfNotEnabled() (bool, error)
 func (tree *MutableTree) enableFastStorageAndCommitLocked() error {
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
-	return tree.enableFastStorageAndCommit()
+	return tree.enableFastStorageAndCommit(context.Background())
 }
 
-func (tree *MutableTree) enableFastStorageAndCommit() error {
-	debug("enabling fast storage, might take a while.")
+// enableFastStorageAndCommit writes the fast nodes of the working tree. If ctx is done, the
+// fast nodes not yet written are discarded, and the storage version is left unchanged.
+func (tree *MutableTree) enableFastStorageAndCommit(ctx context.Context) error {
+	tree.ndb.logger.Info("enabling fast storage, might take a while")
 	var err error
 	defer func() {
 		if err != nil {
-			debug("failed to enable fast storage: %v\n", err)
+			tree.ndb.logger.Error("failed to enable fast storage", "err", err)
 		} else {
-			debug("fast storage is enabled.")
+			tree.ndb.logger.Info("fast storage is enabled")
 		}
 	}()
 
@@ -603,9 +876,23 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
 	defer itr.Close()
 	for ; itr.Valid(); itr.Next() {
+		if err = ctx.Err(); err != nil {
+			tree.ndb.mtx.Lock()
+			if discardErr := tree.ndb.discardBatch(); discardErr != nil {
+				err = discardErr
+			}
+			tree.ndb.mtx.Unlock()
+			return err
+		}
 		if err = tree.ndb.SaveFastNodeNoCache(NewFastNode(itr.Key(), itr.Value(), tree.version)); err != nil {
 			return err
 		}
+		if throttle := tree.ndb.throttle; throttle != nil {
+			throttle.charge(1, len(itr.Key())+len(itr.Value()))
+			if err = throttle.wait(ctx); err != nil {
+				return err
+			}
+		}
 	}
 
 	if err = itr.Error(); err != nil {
@@ -624,30 +911,17 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
-func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
-	rootHash, err := tree.ndb.getRoot(version)
+func (tree *MutableTree) GetImmutable(version int64) (iTree *ImmutableTree, err error) {
+	defer recoverNodeMissing(&err)
+	iTree, err = tree.ImmutableTree.LoadRootOnly(version)
 	if err != nil {
 		return nil, err
 	}
-	if rootHash == nil {
-		return nil, ErrVersionDoesNotExist
-	}
 
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
-	if len(rootHash) == 0 {
-		tree.versions[version] = true
-		return &ImmutableTree{
-			ndb:     tree.ndb,
-			version: version,
-		}, nil
-	}
 	tree.versions[version] = true
-	return &ImmutableTree{
-		root:    tree.ndb.GetNode(rootHash),
-		ndb:     tree.ndb,
-		version: version,
-	}, nil
+	return iTree, nil
 }
 
 // Rollback resets the working tree to the latest saved version, discarding
@@ -658,9 +932,28 @@ func (tree *MutableTree) Rollback() {
 	} else {
 		tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, version: 0}
 	}
+	tree.resetWorkingState(false)
+	tree.discardJournal()
+}
+
+// resetWorkingState discards the changes of the working tree which haven't been saved, once it
+// has been set to a saved version. If loaded is true, a version has been loaded, so the saved
+// versions may have changed, and the state derived from them is discarded too.
+func (tree *MutableTree) resetWorkingState(loaded bool) {
 	tree.orphans = map[string]int64{}
-	tree.unsavedFastNodeAdditions = map[string]*FastNode{}
-	tree.unsavedFastNodeRemovals = map[string]interface{}{}
+	tree.orphanedLeaves = nil
+	tree.unsavedFastNodeAdditions = make(map[string]*FastNode)
+	tree.unsavedFastNodeRemovals = make(map[string]interface{})
+	tree.pendingMetadata = nil
+	tree.pendingPreimages = nil
+	tree.pendingExpiries = make(map[string]int64)
+	tree.purgedExpiries = nil
+	tree.pendingMerges = nil
+	tree.rotations = nil
+	if loaded {
+		tree.savedRotations = nil
+		tree.pruneCursor, tree.pruneSkipped = 0, nil
+	}
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
@@ -687,13 +980,44 @@ func (tree *MutableTree) GetVersioned(key []byte, version int64) []byte {
 	return nil
 }
 
-// SaveVersion saves a new tree version to disk, based on the current state of
-// the tree. Returns the hash and new version number.
-func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+// LookupVersioned is like GetVersioned, but returns an error matching ErrVersionDoesNotExist if
+// the version does not exist (and ErrVersionPruned if it was pruned, see Options.PrunedStubs),
+// ErrKeyNotFound if the key does not exist in the version, and ErrNodeMissing for broken nodes in
+// recovery mode.
+func (tree *MutableTree) LookupVersioned(key []byte, version int64) (value []byte, err error) {
+	defer recoverNodeMissing(&err)
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	value = t.Get(key)
+	if value == nil && !t.Has(key) {
+		return nil, errors.Wrapf(ErrKeyNotFound, "key %X at version %v", key, version)
+	}
+	return value, nil
+}
+
+// workingVersion returns the version number the working tree will be saved as.
+func (tree *MutableTree) workingVersion() int64 {
 	version := tree.version + 1
 	if version == 1 && tree.ndb.opts.InitialVersion > 0 {
 		version = int64(tree.ndb.opts.InitialVersion)
 	}
+	return version
+}
+
+// SaveVersion saves a new tree version to disk, based on the current state of
+// the tree. Returns the hash and new version number.
+func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	return tree.saveVersion(tree.workingVersion())
+}
+
+// saveVersion is like SaveVersion, but saves the given version, which must follow the latest
+// saved version unless no version has been saved yet.
+func (tree *MutableTree) saveVersion(version int64) ([]byte, int64, error) {
+	if err := tree.ApplyMerges(); err != nil {
+		return nil, version, err
+	}
 
 	if tree.VersionExists(version) {
 		// If the version already exists, return an error as we're attempting to overwrite.
@@ -712,28 +1036,66 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		var newHash = tree.WorkingHash()
 
 		if bytes.Equal(existingHash, newHash) {
+			tree.discardJournal()
 			tree.version = version
 			tree.ImmutableTree = tree.ImmutableTree.clone()
 			tree.lastSaved = tree.ImmutableTree.clone()
-			tree.orphans = map[string]int64{}
+			tree.savedRotations = tree.rotations
+			tree.resetWorkingState(false)
+			tree.saveStats = SaveStats{Version: version}
 			return existingHash, version, nil
 		}
 
-		return nil, version, fmt.Errorf("version %d was already saved to different hash %X (existing hash %X)", version, newHash, existingHash)
+		return nil, version, &VersionExistsError{
+			Version:      version,
+			ExistingHash: existingHash,
+			NewHash:      newHash,
+		}
+	}
+
+	if tree.journalErr != nil {
+		return nil, version, tree.journalErr
+	}
+
+	// Expired keys are only purged once the version is known to be new, so that failing to save
+	// an existing version leaves the working tree untouched.
+	if tree.ndb.opts.Expiry {
+		if _, err := tree.PurgeExpired(version); err != nil {
+			return nil, version, errors.Wrap(err, "failed to purge expired keys")
+		}
+	}
+
+	if tree.ndb.opts.RunInvariantChecks {
+		if err := tree.checkInvariants(version); err != nil {
+			return nil, version, err
+		}
+	}
+
+	stats := tree.unsavedStats(version)
+	writtenBefore := tree.ndb.writtenBytes()
+
+	// Nodes may be flushed to disk before the root is written (e.g. for the genesis version), so
+	// mark the commit as pending until the final batch lands. See nodeDB.recoverTornCommit().
+	if err := tree.ndb.setCommitPending(version); err != nil {
+		return nil, version, err
 	}
 
 	if tree.root == nil {
 		// There can still be orphans, for example if the root is the node being
 		// removed.
-		debug("SAVE EMPTY TREE %v\n", version)
-		tree.ndb.SaveOrphans(version, tree.orphans)
+		tree.ndb.logger.Info("saving empty version", "version", version)
+		if err := tree.ndb.SaveOrphans(version, tree.orphans); err != nil {
+			return nil, 0, err
+		}
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
 			return nil, 0, err
 		}
 	} else {
-		debug("SAVE TREE %v\n", version)
+		tree.ndb.logger.Info("saving version", "version", version)
 		tree.ndb.SaveBranch(tree.root)
-		tree.ndb.SaveOrphans(version, tree.orphans)
+		if err := tree.ndb.SaveOrphans(version, tree.orphans); err != nil {
+			return nil, 0, err
+		}
 		if err := tree.ndb.SaveRoot(tree.root, version); err != nil {
 			return nil, 0, err
 		}
@@ -743,23 +1105,83 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		return nil, version, err
 	}
 
+	if tree.ndb.opts.Journal {
+		if err := tree.ndb.deleteJournal(tree.version); err != nil {
+			return nil, version, err
+		}
+	}
+
+	if tree.pendingMetadata != nil {
+		if err := tree.ndb.setVersionMetadata(version, tree.pendingMetadata); err != nil {
+			return nil, version, err
+		}
+	}
+
+	if err := tree.savePreimages(version); err != nil {
+		return nil, version, err
+	}
+
+	if err := tree.saveIndexes(); err != nil {
+		return nil, version, err
+	}
+
+	if err := tree.saveExpiries(version); err != nil {
+		return nil, version, err
+	}
+
+	if err := tree.ndb.clearCommitPending(); err != nil {
+		return nil, version, err
+	}
+
 	if err := tree.ndb.Commit(); err != nil {
 		return nil, version, err
 	}
+	stats.BytesWritten = tree.ndb.writtenBytes() - writtenBefore
+	tree.ndb.endCacheAdvisorVersion()
+	if tree.ndb.missingKeys != nil {
+		tree.ndb.missingKeys.advance(version, tree.unsavedFastNodeAdditions)
+	}
+
+	var changed []KVPair
+	if len(tree.hooks) > 0 {
+		changed = tree.unsavedChanges()
+	}
 
 	tree.mtx.Lock()
-	defer tree.mtx.Unlock()
 	tree.version = version
 	tree.versions[version] = true
+	if tree.versionIndex != nil {
+		tree.versionIndex.add(version)
+	}
 
 	// set new working tree
 	tree.ImmutableTree = tree.ImmutableTree.clone()
 	tree.lastSaved = tree.ImmutableTree.clone()
-	tree.orphans = map[string]int64{}
-	tree.unsavedFastNodeAdditions = make(map[string]*FastNode)
-	tree.unsavedFastNodeRemovals = make(map[string]interface{})
+	tree.journalSeq = 0
+	tree.savedRotations = tree.rotations
+	tree.resetWorkingState(false)
+	tree.saveStats = stats
+	tree.mtx.Unlock()
+
+	// The version is committed, so maintenance errors are reported by MaintenanceError instead.
+	tree.maintenanceErr = nil
+	if err := tree.prune(); err != nil {
+		tree.maintenanceErr = errors.Wrap(err, "failed to prune versions")
+		tree.ndb.logger.Error("failed to prune versions", "version", version, "err", err)
+	}
+	if opts := tree.ndb.opts.ColdTier; opts != nil && opts.AutoDemote && tree.maintenanceErr == nil {
+		if _, err := tree.ndb.demoteColdNodes(); err != nil {
+			tree.maintenanceErr = errors.Wrap(err, "failed to demote cold nodes")
+			tree.ndb.logger.Error("failed to demote cold nodes", "version", version, "err", err)
+		}
+	}
+
+	hash := tree.Hash()
+	for _, h := range tree.hooks {
+		h.OnSaveVersion(version, hash, changed)
+	}
 
-	return tree.Hash(), version, nil
+	return hash, version, nil
 }
 
 func (tree *MutableTree) saveFastNodeVersion() error {
@@ -789,6 +1211,7 @@ func (tree *MutableTree) getUnsavedFastNodeRemovals() map[string]interface{} {
 func (tree *MutableTree) addUnsavedAddition(key []byte, node *FastNode) {
 	delete(tree.unsavedFastNodeRemovals, string(key))
 	tree.unsavedFastNodeAdditions[string(key)] = node
+	tree.observeWrite(key, node.value)
 }
 
 func (tree *MutableTree) saveFastNodeAdditions() error {
@@ -809,6 +1232,7 @@ func (tree *MutableTree) saveFastNodeAdditions() error {
 func (tree *MutableTree) addUnsavedRemoval(key []byte) {
 	delete(tree.unsavedFastNodeAdditions, string(key))
 	tree.unsavedFastNodeRemovals[string(key)] = true
+	tree.observeWrite(key, nil)
 }
 
 func (tree *MutableTree) saveFastNodeRemovals() error {
@@ -851,7 +1275,7 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 // DeleteVersions deletes a series of versions from the MutableTree.
 // Deprecated: please use DeleteVersionsRange instead.
 func (tree *MutableTree) DeleteVersions(versions ...int64) error {
-	debug("DELETING VERSIONS: %v\n", versions)
+	tree.ndb.logger.Info("deleting versions", "versions", versions)
 
 	if len(versions) == 0 {
 		return nil
@@ -884,7 +1308,33 @@ func (tree *MutableTree) DeleteVersions(versions ...int64) error {
 // An error is returned if any single version has active readers.
 // All writes happen in a single batch with a single commit.
 func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error {
-	if err := tree.ndb.DeleteVersionsRange(fromVersion, toVersion); err != nil {
+	tree.ndb.logger.Info("deleting versions", "fromVersion", fromVersion, "toVersion", toVersion)
+	return tree.deleteVersionsRange(context.Background(), fromVersion, toVersion)
+}
+
+// DeleteVersionsRangeContext is like DeleteVersionsRange, but stops if ctx is done. The
+// deletion is then discarded, unless the batch has already been written part-way, see
+// Options.MaxBatchBytes, in which case the versions are deleted but some of their nodes may be
+// left behind. It is meant for deletions in the background, and is throttled by
+// Options.IOThrottle: once the deletion is committed, it waits for the work done with the
+// database unlocked, or until ctx is done.
+func (tree *MutableTree) DeleteVersionsRangeContext(ctx context.Context, fromVersion, toVersion int64) error {
+	tree.ndb.logger.Info("deleting versions", "fromVersion", fromVersion, "toVersion", toVersion)
+	if err := tree.deleteVersionsRange(ctx, fromVersion, toVersion); err != nil {
+		return err
+	}
+	if tree.ndb.throttle != nil {
+		return tree.ndb.throttle.wait(ctx)
+	}
+	return nil
+}
+
+// deleteVersionsRange deletes the versions in [fromVersion, toVersion) and commits the deletion.
+func (tree *MutableTree) deleteVersionsRange(ctx context.Context, fromVersion, toVersion int64) error {
+	if err := tree.ndb.deleteVersionsRange(ctx, fromVersion, toVersion); err != nil {
+		if ctx.Err() != nil {
+			tree.forgetDeletedVersions(fromVersion, toVersion)
+		}
 		return err
 	}
 
@@ -893,18 +1343,38 @@ func (tree *MutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error
 	}
 
 	tree.mtx.Lock()
-	defer tree.mtx.Unlock()
 	for version := fromVersion; version < toVersion; version++ {
 		delete(tree.versions, version)
 	}
-
+	if tree.versionIndex != nil {
+		tree.versionIndex.removeRange(fromVersion, toVersion)
+	}
+	tree.mtx.Unlock()
 	return nil
 }
 
+// forgetDeletedVersions removes the versions in [fromVersion, toVersion) whose roots have been
+// deleted from the database from the set of known versions, after an interrupted deletion.
+func (tree *MutableTree) forgetDeletedVersions(fromVersion, toVersion int64) {
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	for version := range tree.versions {
+		if version < fromVersion || version >= toVersion {
+			continue
+		}
+		if ok, err := tree.ndb.HasRoot(version); err == nil && !ok {
+			delete(tree.versions, version)
+			if tree.versionIndex != nil {
+				tree.versionIndex.removeRange(version, version+1)
+			}
+		}
+	}
+}
+
 // DeleteVersion deletes a tree version from disk. The version can then no
 // longer be accessed.
 func (tree *MutableTree) DeleteVersion(version int64) error {
-	debug("DELETE VERSION: %d\n", version)
+	tree.ndb.logger.Info("deleting version", "version", version)
 
 	if err := tree.deleteVersion(version); err != nil {
 		return err
@@ -915,8 +1385,11 @@ func (tree *MutableTree) DeleteVersion(version int64) error {
 	}
 
 	tree.mtx.Lock()
-	defer tree.mtx.Unlock()
 	delete(tree.versions, version)
+	if tree.versionIndex != nil {
+		tree.versionIndex.removeRange(version, version+1)
+	}
+	tree.mtx.Unlock()
 	return nil
 }
 
@@ -928,6 +1401,7 @@ func (tree *MutableTree) rotateRight(node *Node) (*Node, *Node) {
 	node = node.clone(version)
 	orphaned := node.getLeftNode(tree.ImmutableTree)
 	newNode := orphaned.clone(version)
+	tree.recordRotation(false, node, orphaned)
 
 	newNoderHash, newNoderCached := newNode.rightHash, newNode.rightNode
 	newNode.rightHash, newNode.rightNode = node.hash, node
@@ -947,6 +1421,7 @@ func (tree *MutableTree) rotateLeft(node *Node) (*Node, *Node) {
 	node = node.clone(version)
 	orphaned := node.getRightNode(tree.ImmutableTree)
 	newNode := orphaned.clone(version)
+	tree.recordRotation(true, node, orphaned)
 
 	newNodelHash, newNodelCached := newNode.leftHash, newNode.leftNode
 	newNode.leftHash, newNode.leftNode = node.hash, node
@@ -1015,5 +1490,11 @@ func (tree *MutableTree) addOrphans(orphans []*Node) {
 			panic("Expected to find node hash, but was empty")
 		}
 		tree.orphans[string(node.hash)] = node.version
+		if node.isLeaf() {
+			if tree.orphanedLeaves == nil {
+				tree.orphanedLeaves = map[string]bool{}
+			}
+			tree.orphanedLeaves[string(node.key)] = true
+		}
 	}
 }
@@ -2,8 +2,10 @@ package iavl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"runtime"
 	"sort"
 	"strconv"
@@ -542,6 +544,90 @@ func TestMutableTree_SetRemoveSet(t *testing.T) {
 	require.Equal(t, 0, len(fastNodeRemovals))
 }
 
+func TestMutableTree_GetRemovedSavedKey(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// The saved fast node must not be returned for a key removed in the working tree.
+	_, removed := tree.Remove([]byte("a"))
+	require.True(t, removed)
+	require.Nil(t, tree.Get([]byte("a")))
+	require.Equal(t, []byte("2"), tree.Get([]byte("b")))
+}
+
+func TestMutableTree_ZeroCopyDecode(t *testing.T) {
+	mdb := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(mdb, 0, &Options{ZeroCopyDecode: true})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%03d", i)))
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(mdb, 10, &Options{ZeroCopyDecode: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	for i := 0; i < 100; i++ {
+		_, value := tree.GetWithIndex([]byte(fmt.Sprintf("key%03d", i)))
+		require.Equal(t, []byte(fmt.Sprintf("value%03d", i)), value)
+		require.Equal(t, []byte(fmt.Sprintf("value%03d", i)), tree.Get([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	tree.Set([]byte("key050"), []byte("changed"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []byte("changed"), tree.Get([]byte("key050")))
+}
+
+func TestMutableTree_LoadVersionForOverwriting_MatchesFreshTree(t *testing.T) {
+	// A tree overwritten back to version 5 must have the same database contents as a tree which
+	// only ever had the first 5 versions, in particular the same orphans.
+	build := func(versions int) (db.DB, *MutableTree) {
+		mdb := db.NewMemDB()
+		tree, err := NewMutableTree(mdb, 0)
+		require.NoError(t, err)
+		r := rand.New(rand.NewSource(7))
+		for v := 0; v < versions; v++ {
+			for i := 0; i < 50; i++ {
+				tree.Set([]byte(fmt.Sprintf("%03d", r.Intn(200))), []byte(fmt.Sprintf("%d", r.Int())))
+				tree.Remove([]byte(fmt.Sprintf("%03d", r.Intn(200))))
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return mdb, tree
+	}
+
+	expectedDB, _ := build(5)
+	actualDB, tree := build(10)
+	_, err := tree.LoadVersionForOverwriting(5)
+	require.NoError(t, err)
+
+	// Fast nodes are rebuilt when overwriting, with different update versions, so only nodes,
+	// orphans and roots are compared.
+	for _, prefix := range [][]byte{nodeKeyFormat.Key(), orphanKeyFormat.Key(), rootKeyFormat.Key()} {
+		expected, err := db.IteratePrefix(expectedDB, prefix)
+		require.NoError(t, err)
+		actual, err := db.IteratePrefix(actualDB, prefix)
+		require.NoError(t, err)
+		for ; expected.Valid(); expected.Next() {
+			require.True(t, actual.Valid())
+			require.Equal(t, expected.Key(), actual.Key())
+			require.Equal(t, expected.Value(), actual.Value())
+			actual.Next()
+		}
+		require.False(t, actual.Valid())
+		expected.Close()
+		actual.Close()
+	}
+}
+
 func TestMutableTree_FastNodeIntegration(t *testing.T) {
 	mdb := db.NewMemDB()
 	tree, err := NewMutableTree(mdb, 1000)
@@ -679,7 +765,7 @@ func TestUpgradeStorageToFast_LatestVersion_Success(t *testing.T) {
 
 	// Enable fast storage
 	require.True(t, tree.IsUpgradeable())
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 	require.False(t, tree.IsUpgradeable())
@@ -702,14 +788,14 @@ func TestUpgradeStorageToFast_AlreadyUpgraded_Success(t *testing.T) {
 
 	// Enable fast storage
 	require.True(t, tree.IsUpgradeable())
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 	require.True(t, tree.IsFastCacheEnabled())
 	require.False(t, tree.IsUpgradeable())
 
 	// Test enabling fast storage when already enabled
-	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 	require.True(t, tree.IsFastCacheEnabled())
@@ -763,7 +849,7 @@ func TestUpgradeStorageToFast_DbErrorEnableFastStorage_Failure(t *testing.T) {
 	require.NotNil(t, tree)
 	require.False(t, tree.IsFastCacheEnabled())
 
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.ErrorIs(t, err, expectedError)
 	require.False(t, enabled)
 	require.False(t, tree.IsFastCacheEnabled())
@@ -799,13 +885,17 @@ func TestFastStorageReUpgradeProtection_NoForceUpgrade_Success(t *testing.T) {
 
 	// Pretend that we called Load and have the latest state in the tree
 	tree.version = latestTreeVersion
-	require.Equal(t, tree.ndb.getLatestVersion(), int64(latestTreeVersion))
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, latest, int64(latestTreeVersion))
 
 	// Ensure that the right branch of enableFastStorageAndCommitIfNotEnabled will be triggered
 	require.True(t, tree.IsFastCacheEnabled())
-	require.False(t, tree.ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.False(t, shouldForce)
 
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 }
@@ -886,19 +976,23 @@ func TestFastStorageReUpgradeProtection_ForceUpgradeFirstTime_NoForceSecondTime_
 
 	// Pretend that we called Load and have the latest state in the tree
 	tree.version = latestTreeVersion
-	require.Equal(t, tree.ndb.getLatestVersion(), int64(latestTreeVersion))
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, latest, int64(latestTreeVersion))
 
 	// Ensure that the right branch of enableFastStorageAndCommitIfNotEnabled will be triggered
 	require.True(t, tree.IsFastCacheEnabled())
-	require.True(t, tree.ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.True(t, shouldForce)
 
 	// Actual method under test
-	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err := tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.True(t, enabled)
 
 	// Test that second time we call this, force upgrade does not happen
-	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled()
+	enabled, err = tree.enableFastStorageAndCommitIfNotEnabled(context.Background())
 	require.NoError(t, err)
 	require.False(t, enabled)
 }
@@ -1028,3 +1122,146 @@ func setupTreeAndMirrorForUpgrade(t *testing.T) (*MutableTree, [][]string) {
 	})
 	return tree, mirror
 }
+
+func TestLoadVersion_DiscardsUnsavedChanges(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("a"), []byte{2})
+	tree.Set([]byte("b"), []byte{2})
+	tree.RegisterPreimage([]byte("a"), []byte("preimage"))
+	require.NoError(t, tree.SetVersionMetadata(2, VersionMetadata{AppData: []byte("meta")}))
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, tree.Get([]byte("a")))
+	require.Nil(t, tree.Get([]byte("b")))
+	count := 0
+	tree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 1, count)
+
+	// Other pending state of the working version is discarded as well.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	preimage, err := tree.Preimage([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, preimage)
+	metadata, err := tree.GetVersionMetadata(2)
+	require.NoError(t, err)
+	require.Nil(t, metadata)
+}
+
+func TestMutableTree_WorkingHashMemoized(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte(strconv.Itoa(r.Intn(1000))), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		key := []byte(strconv.Itoa(r.Intn(1000)))
+		if i%2 == 0 {
+			tree.Set(key, []byte("new"))
+		} else {
+			tree.Remove(key)
+		}
+
+		// Only the nodes replaced by the update, including rotations, are rehashed.
+		dirty := int64(0)
+		tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+			if node.hash == nil {
+				dirty++
+			}
+			return false
+		})
+		require.LessOrEqual(t, dirty, int64(tree.root.height)+3)
+		_, count := tree.ImmutableTree.hashWithCount()
+		require.Equal(t, dirty, count)
+
+		_, count = tree.ImmutableTree.hashWithCount()
+		require.Zero(t, count)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LoadVersion(1)
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist), "got %v", err)
+
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	reloaded, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = reloaded.LoadVersion(2)
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist), "got %v", err)
+	_, err = reloaded.LazyLoadVersion(2)
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist), "got %v", err)
+
+	value, err := tree.LookupVersioned([]byte("key1"), 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	_, err = tree.LookupVersioned([]byte("missing"), 1)
+	require.True(t, errors.Is(err, ErrKeyNotFound), "got %v", err)
+	_, err = tree.LookupVersioned([]byte("key1"), 2)
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist), "got %v", err)
+	_, err = tree.GetMembershipProof([]byte("missing"))
+	require.True(t, errors.Is(err, ErrKeyNotFound), "got %v", err)
+
+	hash := tree.root.leftHash
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(hash)))
+	tree.ndb.nodeCache = newLRUCache(0)
+	func() {
+		defer func() {
+			err, ok := recover().(error)
+			require.True(t, ok)
+			require.True(t, errors.Is(err, ErrNodeMissing), "got %v", err)
+		}()
+		tree.ndb.GetNode(hash)
+	}()
+}
+
+func TestSetWithOldValue(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	old, updated, err := tree.SetWithOldValue([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	require.Nil(t, old)
+	require.False(t, updated)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	old, updated, err = tree.SetWithOldValue([]byte("a"), []byte("2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), old)
+	require.True(t, updated)
+	old, updated, err = tree.SetWithOldValue([]byte("key07"), []byte("new"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{7}, old)
+	require.True(t, updated)
+	old, updated, err = tree.SetWithOldValue([]byte("b"), []byte("3"))
+	require.NoError(t, err)
+	require.Nil(t, old)
+	require.False(t, updated)
+
+	old, removed := tree.Remove([]byte("key07"))
+	require.Equal(t, []byte("new"), old)
+	require.True(t, removed)
+	require.Equal(t, []byte("2"), tree.Get([]byte("a")))
+}
@@ -0,0 +1,280 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+
+	dbm "github.com/tendermint/tm-db"
+)
+
+// namespaceDB is a view of the keys of a database under a prefix, see Options.KeyPrefix. Unlike
+// tm-db's PrefixDB it takes no lock of its own and doesn't check the prefix of each iterated key,
+// since the domain of its iterators already bounds them to the prefix.
+type namespaceDB struct {
+	db     dbm.DB
+	prefix []byte
+}
+
+var (
+	_ dbm.DB      = (*namespaceDB)(nil)
+	_ KeyChecker  = (*namespaceDB)(nil)
+	_ Snapshotter = (*namespaceDB)(nil)
+)
+
+// namespaceKeyPool holds the buffers of prefixed keys for reads, which databases don't retain,
+// so that reading a key doesn't allocate a new one.
+var namespaceKeyPool = &sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+func newNamespaceDB(db dbm.DB, prefix []byte) *namespaceDB {
+	return &namespaceDB{
+		db:     db,
+		prefix: cp(prefix),
+	}
+}
+
+// key returns the key prefixed with the namespace.
+func (ns *namespaceDB) key(key []byte) []byte {
+	prefixed := make([]byte, 0, len(ns.prefix)+len(key))
+	return append(append(prefixed, ns.prefix...), key...)
+}
+
+// readKey returns a pooled buffer holding the key prefixed with the namespace, which must be
+// released with namespaceKeyPool.Put once read.
+func (ns *namespaceDB) readKey(key []byte) *[]byte {
+	buf := namespaceKeyPool.Get().(*[]byte)
+	*buf = append(append((*buf)[:0], ns.prefix...), key...)
+	return buf
+}
+
+// Get implements dbm.DB.
+func (ns *namespaceDB) Get(key []byte) ([]byte, error) {
+	return ns.get(ns.db, key)
+}
+
+// get reads a key of the namespace from the given reader.
+func (ns *namespaceDB) get(r dbReader, key []byte) ([]byte, error) {
+	buf := ns.readKey(key)
+	value, err := r.Get(*buf)
+	namespaceKeyPool.Put(buf)
+	return value, err
+}
+
+// Has implements dbm.DB.
+func (ns *namespaceDB) Has(key []byte) (bool, error) {
+	buf := ns.readKey(key)
+	exists, err := ns.db.Has(*buf)
+	namespaceKeyPool.Put(buf)
+	return exists, err
+}
+
+// HasKey implements KeyChecker.
+func (ns *namespaceDB) HasKey(key []byte) (bool, error) {
+	buf := ns.readKey(key)
+	exists, err := hasKey(ns.db, *buf)
+	namespaceKeyPool.Put(buf)
+	return exists, err
+}
+
+// Set implements dbm.DB.
+func (ns *namespaceDB) Set(key, value []byte) error {
+	return ns.db.Set(ns.key(key), value)
+}
+
+// SetSync implements dbm.DB.
+func (ns *namespaceDB) SetSync(key, value []byte) error {
+	return ns.db.SetSync(ns.key(key), value)
+}
+
+// Delete implements dbm.DB.
+func (ns *namespaceDB) Delete(key []byte) error {
+	return ns.db.Delete(ns.key(key))
+}
+
+// DeleteSync implements dbm.DB.
+func (ns *namespaceDB) DeleteSync(key []byte) error {
+	return ns.db.DeleteSync(ns.key(key))
+}
+
+// domain returns the domain of the underlying database covering the given domain.
+func (ns *namespaceDB) domain(start, end []byte) ([]byte, []byte) {
+	pstart, pend := ns.prefix, prefixEnd(ns.prefix)
+	if start != nil {
+		pstart = ns.key(start)
+	}
+	if end != nil {
+		pend = ns.key(end)
+	}
+	return pstart, pend
+}
+
+// Iterator implements dbm.DB.
+func (ns *namespaceDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	return ns.iterator(ns.db, start, end)
+}
+
+// iterator iterates over the keys of the namespace in the given reader.
+func (ns *namespaceDB) iterator(r dbReader, start, end []byte) (dbm.Iterator, error) {
+	pstart, pend := ns.domain(start, end)
+	source, err := r.Iterator(pstart, pend)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceIterator{source: source, prefixLen: len(ns.prefix), start: start, end: end}, nil
+}
+
+// ReverseIterator implements dbm.DB.
+func (ns *namespaceDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	pstart, pend := ns.domain(start, end)
+	source, err := ns.db.ReverseIterator(pstart, pend)
+	if err != nil {
+		return nil, err
+	}
+	return &namespaceIterator{source: source, prefixLen: len(ns.prefix), start: start, end: end}, nil
+}
+
+// Snapshot implements Snapshotter if the underlying database does, and returns a nil snapshot
+// otherwise.
+func (ns *namespaceDB) Snapshot() (DBSnapshot, error) {
+	snapshotter, ok := ns.db.(Snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	snapshot, err := snapshotter.Snapshot()
+	if err != nil || snapshot == nil {
+		return nil, err
+	}
+	return &namespaceSnapshot{ns: ns, source: snapshot}, nil
+}
+
+// NewBatch implements dbm.DB.
+func (ns *namespaceDB) NewBatch() dbm.Batch {
+	return &namespaceBatch{ns: ns, source: ns.db.NewBatch()}
+}
+
+// Close implements dbm.DB.
+func (ns *namespaceDB) Close() error {
+	return ns.db.Close()
+}
+
+// Print implements dbm.DB.
+func (ns *namespaceDB) Print() error {
+	itr, err := ns.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		fmt.Printf("[%X]:\t[%X]\n", itr.Key(), itr.Value())
+	}
+	return itr.Error()
+}
+
+// Stats implements dbm.DB.
+func (ns *namespaceDB) Stats() map[string]string {
+	return ns.db.Stats()
+}
+
+// namespaceIterator strips the namespace prefix from the keys of an iterator over the namespace.
+type namespaceIterator struct {
+	source    dbm.Iterator
+	prefixLen int
+	start     []byte
+	end       []byte
+}
+
+var _ dbm.Iterator = (*namespaceIterator)(nil)
+
+// Domain implements dbm.Iterator.
+func (itr *namespaceIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements dbm.Iterator.
+func (itr *namespaceIterator) Valid() bool {
+	return itr.source.Valid()
+}
+
+// Next implements dbm.Iterator.
+func (itr *namespaceIterator) Next() {
+	itr.source.Next()
+}
+
+// Key implements dbm.Iterator.
+func (itr *namespaceIterator) Key() []byte {
+	return itr.source.Key()[itr.prefixLen:]
+}
+
+// Value implements dbm.Iterator.
+func (itr *namespaceIterator) Value() []byte {
+	return itr.source.Value()
+}
+
+// Error implements dbm.Iterator.
+func (itr *namespaceIterator) Error() error {
+	return itr.source.Error()
+}
+
+// Close implements dbm.Iterator.
+func (itr *namespaceIterator) Close() error {
+	return itr.source.Close()
+}
+
+// namespaceSnapshot is a snapshot of the keys of a namespace.
+type namespaceSnapshot struct {
+	ns     *namespaceDB
+	source DBSnapshot
+}
+
+var _ DBSnapshot = (*namespaceSnapshot)(nil)
+
+// Get implements DBSnapshot.
+func (s *namespaceSnapshot) Get(key []byte) ([]byte, error) {
+	return s.ns.get(s.source, key)
+}
+
+// Iterator implements DBSnapshot.
+func (s *namespaceSnapshot) Iterator(start, end []byte) (dbm.Iterator, error) {
+	return s.ns.iterator(s.source, start, end)
+}
+
+// Close implements DBSnapshot.
+func (s *namespaceSnapshot) Close() error {
+	return s.source.Close()
+}
+
+// namespaceBatch writes prefixed keys to a batch of the underlying database.
+type namespaceBatch struct {
+	ns     *namespaceDB
+	source dbm.Batch
+}
+
+var _ dbm.Batch = (*namespaceBatch)(nil)
+
+// Set implements dbm.Batch.
+func (b *namespaceBatch) Set(key, value []byte) error {
+	return b.source.Set(b.ns.key(key), value)
+}
+
+// Delete implements dbm.Batch.
+func (b *namespaceBatch) Delete(key []byte) error {
+	return b.source.Delete(b.ns.key(key))
+}
+
+// Write implements dbm.Batch.
+func (b *namespaceBatch) Write() error {
+	return b.source.Write()
+}
+
+// WriteSync implements dbm.Batch.
+func (b *namespaceBatch) WriteSync() error {
+	return b.source.WriteSync()
+}
+
+// Close implements dbm.Batch.
+func (b *namespaceBatch) Close() error {
+	return b.source.Close()
+}
@@ -0,0 +1,143 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestNamespaceDB_Iterator(t *testing.T) {
+	for _, prefix := range [][]byte{[]byte("ns"), {0xff, 0xff}} {
+		prefix := prefix
+		t.Run(fmt.Sprintf("%X", prefix), func(t *testing.T) {
+			memDB := db.NewMemDB()
+			// Keys sorting around the namespace.
+			require.NoError(t, memDB.Set([]byte{0x01}, []byte{1}))
+			require.NoError(t, memDB.Set(append(cp(prefix[:1]), 0x00), []byte{1}))
+			require.NoError(t, memDB.Set(append(cp(prefix), 0xff, 0xff, 0xff), []byte{0})) // in namespace
+			if prefix[0] != 0xff {
+				require.NoError(t, memDB.Set(prefixEnd(prefix), []byte{1}))
+				require.NoError(t, memDB.Set([]byte{0xff}, []byte{1}))
+			}
+
+			ns := newNamespaceDB(memDB, prefix)
+			batch := ns.NewBatch()
+			for _, key := range []string{"a", "b", "c", "d"} {
+				require.NoError(t, batch.Set([]byte(key), []byte(key)))
+			}
+			require.NoError(t, batch.Write())
+			require.NoError(t, batch.Close())
+			require.NoError(t, ns.Delete([]byte("d")))
+
+			value, err := ns.Get([]byte("b"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("b"), value)
+			has, err := memDB.Has(append(cp(prefix), 'b'))
+			require.NoError(t, err)
+			require.True(t, has)
+
+			keys := func(itr db.Iterator, err error) []string {
+				require.NoError(t, err)
+				defer itr.Close()
+				var keys []string
+				for ; itr.Valid(); itr.Next() {
+					keys = append(keys, string(itr.Key()))
+				}
+				require.NoError(t, itr.Error())
+				return keys
+			}
+			all := []string{"a", "b", "c", "\xff\xff\xff"}
+			require.Equal(t, all, keys(ns.Iterator(nil, nil)))
+			require.Equal(t, []string{"b", "c"}, keys(ns.Iterator([]byte("b"), []byte("d"))))
+			require.Equal(t, []string{"\xff\xff\xff", "c", "b", "a"}, keys(ns.ReverseIterator(nil, nil)))
+			require.Equal(t, []string{"b", "a"}, keys(ns.ReverseIterator(nil, []byte("c"))))
+
+			itr, err := ns.Iterator([]byte("b"), nil)
+			require.NoError(t, err)
+			start, end := itr.Domain()
+			require.Equal(t, []byte("b"), start)
+			require.Nil(t, end)
+			require.NoError(t, itr.Close())
+		})
+	}
+}
+
+func TestOptions_KeyPrefix(t *testing.T) {
+	memDB := db.NewMemDB()
+	prefixes := [][]byte{[]byte("a/"), []byte("b/")}
+	newTree := func(prefix []byte) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{KeyPrefix: prefix})
+		require.NoError(t, err)
+		_, err = tree.Load()
+		require.NoError(t, err)
+		return tree
+	}
+
+	for i, prefix := range prefixes {
+		tree := newTree(prefix)
+		for v := 0; v < 3; v++ {
+			tree.Set([]byte(fmt.Sprintf("key%d", v)), []byte(fmt.Sprintf("%s%d", prefix, v)))
+			if i == 1 {
+				tree.Set([]byte("other"), []byte("value"))
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersion(1))
+	}
+
+	for key := range dumpPrefix(t, memDB, nil) {
+		require.True(t, bytes.HasPrefix([]byte(key), prefixes[0]) || bytes.HasPrefix([]byte(key), prefixes[1]),
+			"key %q is not prefixed", key)
+	}
+
+	for i, prefix := range prefixes {
+		tree := newTree(prefix)
+		require.Equal(t, []int{2, 3}, tree.AvailableVersions())
+		require.EqualValues(t, 3+i, tree.Size())
+		require.Equal(t, []byte(fmt.Sprintf("%s1", prefix)), tree.Get([]byte("key1")))
+		require.Equal(t, i == 1, tree.Has([]byte("other")))
+	}
+}
+
+func TestNamespaceDB_Snapshot(t *testing.T) {
+	memDB := &snapshotMemDB{MemDB: db.NewMemDB()}
+	require.NoError(t, memDB.Set([]byte("a"), []byte{0}))
+	ns := newNamespaceDB(memDB, []byte("ns"))
+	require.NoError(t, ns.Set([]byte("a"), []byte{1}))
+	require.NoError(t, ns.Set([]byte("b"), []byte{2}))
+
+	snapshot, err := ns.Snapshot()
+	require.NoError(t, err)
+	defer snapshot.Close()
+	require.NoError(t, ns.Delete([]byte("a")))
+
+	value, err := snapshot.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	itr, err := snapshot.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	// Without snapshots in the underlying database, there are none in the namespace either.
+	snapshot, err = newNamespaceDB(db.NewMemDB(), []byte("ns")).Snapshot()
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+}
+
+func TestNamespaceDB_GetNoAllocs(t *testing.T) {
+	memDB := db.NewMemDB()
+	ns := newNamespaceDB(memDB, []byte("ns"))
+	require.NoError(t, ns.Set([]byte("a"), []byte{1}))
+	key, prefixed := []byte("a"), []byte("nsa")
+	allocs := testing.AllocsPerRun(100, func() { _, _ = memDB.Get(prefixed) })
+	require.Equal(t, allocs, testing.AllocsPerRun(100, func() { _, _ = ns.Get(key) }))
+}
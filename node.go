@@ -44,34 +44,98 @@ func NewNode(key []byte, value []byte, version int64) *Node {
 // The new node doesn't have its hash saved or set. The caller must set it
 // afterwards.
 func MakeNode(buf []byte) (*Node, error) {
+	return makeNode(buf, decodeBytes)
+}
+
+// makeNodeNoCopy is like MakeNode, but the key, value and child hashes of the node alias buf
+// instead of being copied. buf is thus retained for as long as the node is referenced, e.g. by
+// the node cache, and must not be modified afterwards.
+func makeNodeNoCopy(buf []byte) (*Node, error) {
+	return makeNode(buf, decodeBytesNoCopy)
+}
+
+// NodeDecodeError is returned by MakeNode for a malformed node, identifying the field which
+// failed to decode and its byte offset in the encoded node.
+type NodeDecodeError struct {
+	Field  string // height, size, version, key, value, leftHash or rightHash
+	Offset int
+	Cause  error
+}
+
+func (e *NodeDecodeError) Error() string {
+	return fmt.Sprintf("decoding node.%s at offset %d: %v", e.Field, e.Offset, e.Cause)
+}
+
+// Unwrap returns the cause.
+func (e *NodeDecodeError) Unwrap() error {
+	return e.Cause
+}
+
+// nodeDecoder decodes the fields of an encoded node in order, tracking the offset.
+type nodeDecoder struct {
+	buf    []byte
+	offset int
+	decode func([]byte) ([]byte, int, error)
+	trace  func(field string, offset, length int, value interface{}) // called for each field, if set
+}
+
+func (d *nodeDecoder) varint(field string) (int64, error) {
+	i, n, err := decodeVarint(d.buf[d.offset:])
+	if err != nil {
+		return 0, &NodeDecodeError{Field: field, Offset: d.offset, Cause: err}
+	}
+	if d.trace != nil {
+		d.trace(field, d.offset, n, i)
+	}
+	d.offset += n
+	return i, nil
+}
+
+func (d *nodeDecoder) bytes(field string) ([]byte, error) {
+	bz, n, err := d.decode(d.buf[d.offset:])
+	if err != nil {
+		return nil, &NodeDecodeError{Field: field, Offset: d.offset, Cause: err}
+	}
+	if d.trace != nil {
+		d.trace(field, d.offset, n, bz)
+	}
+	d.offset += n
+	return bz, nil
+}
 
+func makeNode(buf []byte, decode func([]byte) ([]byte, int, error)) (*Node, error) {
+	return (&nodeDecoder{buf: buf, decode: decode}).node()
+}
+
+// node decodes the node. Errors are *NodeDecodeError.
+func (d *nodeDecoder) node() (*Node, error) {
 	// Read node header (height, size, version, key).
-	height, n, cause := decodeVarint(buf)
-	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.height")
+	height, err := d.varint("height")
+	if err != nil {
+		return nil, err
 	}
-	buf = buf[n:]
-	if height < int64(math.MinInt8) || height > int64(math.MaxInt8) {
-		return nil, errors.New("invalid height, must be int8")
+	if height < 0 || height > int64(math.MaxInt8) {
+		return nil, &NodeDecodeError{Field: "height", Offset: 0, Cause: errors.Errorf("invalid height %v", height)}
 	}
 
-	size, n, cause := decodeVarint(buf)
-	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.size")
+	offset := d.offset
+	size, err := d.varint("size")
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, &NodeDecodeError{Field: "size", Offset: offset, Cause: errors.Errorf("invalid size %v", size)}
 	}
-	buf = buf[n:]
 
-	ver, n, cause := decodeVarint(buf)
-	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.version")
+	ver, err := d.varint("version")
+	if err != nil {
+		return nil, err
 	}
-	buf = buf[n:]
 
-	key, n, cause := decodeBytes(buf)
-	if cause != nil {
-		return nil, errors.Wrap(cause, "decoding node.key")
+	key, err := d.bytes("key")
+	if err != nil {
+		return nil, err
 	}
-	buf = buf[n:]
 
 	node := &Node{
 		height:  int8(height),
@@ -83,24 +147,19 @@ func MakeNode(buf []byte) (*Node, error) {
 	// Read node body.
 
 	if node.isLeaf() {
-		val, _, cause := decodeBytes(buf)
-		if cause != nil {
-			return nil, errors.Wrap(cause, "decoding node.value")
+		node.value, err = d.bytes("value")
+		if err != nil {
+			return nil, err
 		}
-		node.value = val
 	} else { // Read children.
-		leftHash, n, cause := decodeBytes(buf)
-		if cause != nil {
-			return nil, errors.Wrap(cause, "deocding node.leftHash")
+		node.leftHash, err = d.bytes("leftHash")
+		if err != nil {
+			return nil, err
 		}
-		buf = buf[n:]
-
-		rightHash, _, cause := decodeBytes(buf)
-		if cause != nil {
-			return nil, errors.Wrap(cause, "decoding node.rightHash")
+		node.rightHash, err = d.bytes("rightHash")
+		if err != nil {
+			return nil, err
 		}
-		node.leftHash = leftHash
-		node.rightHash = rightHash
 	}
 	return node, nil
 }
@@ -181,6 +240,55 @@ func (node *Node) get(t *ImmutableTree, key []byte) (index int64, value []byte)
 	return index, value
 }
 
+// floor returns the leaf under the node with the greatest key less than or equal to the given key,
+// or nil if there is none.
+func (node *Node) floor(t *ImmutableTree, key []byte) *Node {
+	if node.isLeaf() {
+		if bytes.Compare(node.key, key) <= 0 {
+			return node
+		}
+		return nil
+	}
+	// The key of an inner node is the smallest key of its right subtree.
+	if bytes.Compare(key, node.key) < 0 {
+		return node.getLeftNode(t).floor(t, key)
+	}
+	return node.getRightNode(t).floor(t, key)
+}
+
+// ceiling returns the leaf under the node with the smallest key greater than or equal to the given
+// key, or nil if there is none.
+func (node *Node) ceiling(t *ImmutableTree, key []byte) *Node {
+	if node.isLeaf() {
+		if bytes.Compare(node.key, key) >= 0 {
+			return node
+		}
+		return nil
+	}
+	if bytes.Compare(key, node.key) < 0 {
+		if leaf := node.getLeftNode(t).ceiling(t, key); leaf != nil {
+			return leaf
+		}
+	}
+	return node.getRightNode(t).ceiling(t, key)
+}
+
+// firstLeaf returns the leftmost leaf under the node.
+func (node *Node) firstLeaf(t *ImmutableTree) *Node {
+	for !node.isLeaf() {
+		node = node.getLeftNode(t)
+	}
+	return node
+}
+
+// lastLeaf returns the rightmost leaf under the node.
+func (node *Node) lastLeaf(t *ImmutableTree) *Node {
+	for !node.isLeaf() {
+		node = node.getRightNode(t)
+	}
+	return node
+}
+
 func (node *Node) getByIndex(t *ImmutableTree, index int64) (key []byte, value []byte) {
 	if node.isLeaf() {
 		if index == 0 {
@@ -205,16 +313,13 @@ func (node *Node) _hash() []byte {
 		return node.hash
 	}
 
-	h := sha256.New()
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 	if err := node.writeHashBytes(buf); err != nil {
 		panic(err)
 	}
-	_, err := h.Write(buf.Bytes())
-	if err != nil {
-		panic(err)
-	}
-	node.hash = h.Sum(nil)
+	sum := sumSHA256(buf.Bytes())
+	node.hash = sum[:]
 
 	return node.hash
 }
@@ -231,17 +336,14 @@ func (node *Node) hashWithCount() ([]byte, int64) {
 		return node.hash, 0
 	}
 
-	h := sha256.New()
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 	hashCount, err := node.writeHashBytesRecursively(buf)
 	if err != nil {
 		panic(err)
 	}
-	_, err = h.Write(buf.Bytes())
-	if err != nil {
-		panic(err)
-	}
-	node.hash = h.Sum(nil)
+	sum := sumSHA256(buf.Bytes())
+	node.hash = sum[:]
 
 	return node.hash, hashCount + 1
 }
@@ -313,7 +415,7 @@ func (node *Node) writeHashBytes(w io.Writer) error {
 
 		// Indirection needed to provide proofs without values.
 		// (e.g. ProofLeafNode.ValueHash)
-		valueHash := sha256.Sum256(node.value)
+		valueHash := sumSHA256(node.value)
 
 		err = encodeBytes(w, valueHash[:])
 		if err != nil {
@@ -419,16 +521,22 @@ func (node *Node) writeBytes(w io.Writer) error {
 
 func (node *Node) getLeftNode(t *ImmutableTree) *Node {
 	if node.leftNode != nil {
+		t.observeNodeRead(node.leftNode, true)
 		return node.leftNode
 	}
-	return t.ndb.GetNode(node.leftHash)
+	left := t.getNode(node.leftHash)
+	t.observeNodeRead(left, false)
+	return left
 }
 
 func (node *Node) getRightNode(t *ImmutableTree) *Node {
 	if node.rightNode != nil {
+		t.observeNodeRead(node.rightNode, true)
 		return node.rightNode
 	}
-	return t.ndb.GetNode(node.rightHash)
+	right := t.getNode(node.rightHash)
+	t.observeNodeRead(right, false)
+	return right
 }
 
 // NOTE: mutates height and size
@@ -0,0 +1,68 @@
+package iavl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NodeField is a field of an encoded node, see DecodeNodeDiagnostics.
+type NodeField struct {
+	Name   string
+	Offset int         // byte offset of the field in the encoded node
+	Length int         // encoded length of the field in bytes
+	Value  interface{} // int64 for height, size and version, []byte otherwise
+}
+
+// NodeDiagnostics is a field-by-field decoding of an encoded node, see DecodeNodeDiagnostics.
+type NodeDiagnostics struct {
+	Fields   []NodeField // fields decoded, in order, including one with an invalid value
+	Err      error       // *NodeDecodeError for the first field which failed, if any
+	Trailing []byte      // bytes following the last field, which MakeNode ignores
+	Hash     []byte      // hash of the decoded node, nil if decoding failed
+}
+
+// DecodeNodeDiagnostics decodes an encoded node as MakeNode does, but reports each field decoded
+// along with its offset, and the hash of the node, to help debug corrupt nodes. The hash can be
+// compared with the database key the node was read from.
+func DecodeNodeDiagnostics(buf []byte) *NodeDiagnostics {
+	diag := &NodeDiagnostics{}
+	d := &nodeDecoder{
+		buf:    buf,
+		decode: decodeBytes,
+		trace: func(field string, offset, length int, value interface{}) {
+			diag.Fields = append(diag.Fields, NodeField{Name: field, Offset: offset, Length: length, Value: value})
+		},
+	}
+	node, err := d.node()
+	if err != nil {
+		diag.Err = err
+		return diag
+	}
+	diag.Trailing = buf[d.offset:]
+	diag.Hash = node._hash()
+	return diag
+}
+
+// String formats the diagnostics with one field per line.
+func (d *NodeDiagnostics) String() string {
+	var sb strings.Builder
+	for _, field := range d.Fields {
+		fmt.Fprintf(&sb, "%-9s offset %-4d length %-4d ", field.Name, field.Offset, field.Length)
+		switch value := field.Value.(type) {
+		case []byte:
+			fmt.Fprintf(&sb, "%X\n", value)
+		default:
+			fmt.Fprintf(&sb, "%v\n", value)
+		}
+	}
+	if d.Err != nil {
+		fmt.Fprintf(&sb, "error: %v\n", d.Err)
+	}
+	if len(d.Trailing) > 0 {
+		fmt.Fprintf(&sb, "trailing: %X\n", d.Trailing)
+	}
+	if d.Hash != nil {
+		fmt.Fprintf(&sb, "hash: %X\n", d.Hash)
+	}
+	return sb.String()
+}
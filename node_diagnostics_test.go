@@ -0,0 +1,76 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMakeNode_DecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	inner := &Node{
+		height:    1,
+		version:   2,
+		size:      2,
+		key:       []byte("key"),
+		leftHash:  bytes.Repeat([]byte{1}, hashSize),
+		rightHash: bytes.Repeat([]byte{2}, hashSize),
+	}
+	require.NoError(t, inner.writeBytes(&buf))
+	bz := buf.Bytes()
+
+	testcases := map[string]struct {
+		bz     []byte
+		field  string
+		offset int
+	}{
+		"empty":             {nil, "height", 0},
+		"negative height":   {[]byte{0x01}, "height", 0},
+		"negative size":     {[]byte{0x00, 0x01}, "size", 1},
+		"truncated version": {[]byte{0x00, 0x02, 0x80}, "version", 2},
+		"truncated key":     {bz[:5], "key", 3},
+		"truncated left":    {bz[:20], "leftHash", 7},
+		"truncated right":   {bz[:len(bz)-1], "rightHash", 40},
+		"overlong length":   {[]byte{0x00, 0x02, 0x02, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, "key", 3},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := MakeNode(tc.bz)
+			var decodeErr *NodeDecodeError
+			require.True(t, errors.As(err, &decodeErr), "got %v", err)
+			require.Equal(t, tc.field, decodeErr.Field)
+			require.Equal(t, tc.offset, decodeErr.Offset)
+
+			diag := DecodeNodeDiagnostics(tc.bz)
+			require.EqualError(t, diag.Err, err.Error())
+			require.Nil(t, diag.Hash)
+			if len(diag.Fields) > 0 {
+				last := diag.Fields[len(diag.Fields)-1]
+				require.LessOrEqual(t, last.Offset, tc.offset)
+			}
+		})
+	}
+}
+
+func TestDecodeNodeDiagnostics(t *testing.T) {
+	node := NewNode([]byte("key"), []byte("value"), 3)
+	var buf bytes.Buffer
+	require.NoError(t, node.writeBytes(&buf))
+	buf.Write([]byte{0xab})
+
+	diag := DecodeNodeDiagnostics(buf.Bytes())
+	require.NoError(t, diag.Err)
+	require.Equal(t, []NodeField{
+		{Name: "height", Offset: 0, Length: 1, Value: int64(0)},
+		{Name: "size", Offset: 1, Length: 1, Value: int64(1)},
+		{Name: "version", Offset: 2, Length: 1, Value: int64(3)},
+		{Name: "key", Offset: 3, Length: 4, Value: []byte("key")},
+		{Name: "value", Offset: 7, Length: 6, Value: []byte("value")},
+	}, diag.Fields)
+	require.Equal(t, []byte{0xab}, diag.Trailing)
+	require.Equal(t, node._hash(), diag.Hash)
+	require.Contains(t, diag.String(), "trailing: AB")
+}
@@ -79,10 +79,34 @@ func TestNode_encode_decode(t *testing.T) {
 				tc.node.value = []byte{}
 			}
 			require.Equal(t, tc.node, node)
+
+			node, err = makeNodeNoCopy(buf.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, tc.node, node)
 		})
 	}
 }
 
+func TestNode_makeNodeNoCopy(t *testing.T) {
+	var buf bytes.Buffer
+	err := (&Node{key: []byte("key"), value: []byte("value"), size: 1, version: 1}).writeBytes(&buf)
+	require.NoError(t, err)
+	bz := buf.Bytes()
+
+	copied, err := MakeNode(bz)
+	require.NoError(t, err)
+	aliased, err := makeNodeNoCopy(bz)
+	require.NoError(t, err)
+
+	// The aliased node shares memory with the buffer, the copied node does not.
+	bz[len(bz)-1] = 'X'
+	require.Equal(t, []byte("value"), copied.value)
+	require.Equal(t, []byte("valuX"), aliased.value)
+
+	// Appending to an aliased slice must not overwrite the rest of the buffer.
+	require.Equal(t, len(aliased.key), cap(aliased.key))
+}
+
 func TestNode_validate(t *testing.T) {
 	k := []byte("key")
 	v := []byte("value")
@@ -176,3 +200,52 @@ func BenchmarkNode_WriteBytes(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkMakeNode(b *testing.B) {
+	node := &Node{
+		key:       randBytes(25),
+		value:     randBytes(100),
+		version:   rand.Int63n(10000000),
+		height:    1,
+		size:      rand.Int63n(10000000),
+		leftHash:  randBytes(32),
+		rightHash: randBytes(32),
+	}
+	var buf bytes.Buffer
+	require.NoError(b, node.writeBytes(&buf))
+	bz := buf.Bytes()
+
+	b.ResetTimer()
+	b.Run("Copy", func(sub *testing.B) {
+		sub.ReportAllocs()
+		for i := 0; i < sub.N; i++ {
+			_, _ = MakeNode(bz)
+		}
+	})
+	b.Run("NoCopy", func(sub *testing.B) {
+		sub.ReportAllocs()
+		for i := 0; i < sub.N; i++ {
+			_, _ = makeNodeNoCopy(bz)
+		}
+	})
+}
+
+func BenchmarkNode_hash(b *testing.B) {
+	nodes := make([]*Node, b.N)
+	for i := range nodes {
+		nodes[i] = &Node{
+			key:       randBytes(25),
+			value:     randBytes(100),
+			version:   rand.Int63n(10000000),
+			height:    1,
+			size:      rand.Int63n(10000000),
+			leftHash:  randBytes(32),
+			rightHash: randBytes(32),
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		nodes[i]._hash()
+	}
+}
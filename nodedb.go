@@ -2,8 +2,9 @@ package iavl
 
 import (
 	"bytes"
-	"container/list"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"sort"
@@ -20,6 +21,15 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	// commitPendingKey marks a version whose commit is in progress. It is set in the batch before
+	// any nodes of the version are written, and deleted in the same atomic batch that writes the
+	// version root. If it is found on disk, the commit was torn, e.g. by a crash after nodes were
+	// flushed early.
+	commitPendingKey = "commit_pending"
+	// commitPendingNodesPrefix prefixes the hashes of the nodes of the pending commit which were
+	// flushed before its root, one entry per flushed batch. They are written in the same batch as
+	// the nodes they list, so recovery only has to delete the listed nodes.
+	commitPendingNodesPrefix = "commit_pending_nodes/"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -60,28 +70,63 @@ var (
 
 	// Root nodes are indexed separately by their version
 	rootKeyFormat = NewKeyFormat('r', int64Size) // r<version>
+
+	// Journal entries record unsaved Set/Remove operations applied on top of a saved version,
+	// in the order they were made. See Options.Journal.
+	journalKeyFormat = NewKeyFormat('j', int64Size, int64Size) // j<version><sequence>
 )
 
 var (
+	// errStopTraversal is returned by traversal callbacks to stop the traversal early.
+	errStopTraversal = errors.New("stop traversal")
+
 	errInvalidFastStorageVersion = fmt.Sprintf("Fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 )
 
 type nodeDB struct {
-	mtx            sync.Mutex       // Read/write lock.
+	mtx            sync.RWMutex     // Read/write lock.
 	db             dbm.DB           // Persistent node storage.
-	batch          dbm.Batch        // Batched writing buffer.
+	batch          *sizedBatch      // Batched writing buffer.
 	opts           Options          // Options to customize for pruning/writing
 	versionReaders map[int64]uint32 // Number of active version readers
 	storageVersion string           // Storage version
+	logger         Logger           // See Options.Logger. Never nil.
+
+	latestVersion    int64
+	cacheSize        int       // Cache size the nodeDB was created with.
+	nodeCache        *lruCache // Node cache, keyed by hash. Has its own locking.
+	fastNodeCache    *lruCache // FastNode cache, keyed by key. Has its own locking.
+	proofCache       *lruCache // Existence proof cache, keyed by version and key. Has its own locking.
+	rankCache        *lruCache // Leaf rank cache, see Options.RankCacheSize. Nil if disabled.
+	versionTreeCache *lruCache // ImmutableTrees of saved versions, see MutableTree.At.
+
+	quarantineMtx sync.Mutex
+	quarantined   map[string]bool // Hashes of broken nodes, see Options.RecoveryMode.
+
+	cacheAdvisor *cacheAdvisor    // See Options.CacheAdvisor. Nil if disabled.
+	missingKeys  *missingKeyCache // See Options.MissingKeyCacheSize. Nil if disabled.
+	throttle     *ioThrottle      // See Options.IOThrottle. Nil if disabled.
+
+	coldDemoted int64    // Last orphan version demoted to the cold tier, see Options.ColdTier.
+	coldDeletes [][]byte // Hashes to delete from the cold tier once the batch is written.
+
+	refCounted bool             // The database uses reference counts, see Options.RefCountGC.
+	refCounts  map[string]int64 // Reference counts set in the batch, by hash.
+	refDeltas  map[string]int64 // References added by the version being saved, by hash.
+
+	replicating bool      // Batch writes are recorded for a Replicator.
+	replicated  []BatchOp // Writes recorded since the last shipped version, see Replicator.
 
-	latestVersion  int64
-	nodeCache      map[string]*list.Element // Node cache.
-	nodeCacheSize  int                      // Node cache size limit in elements.
-	nodeCacheQueue *list.List               // LRU queue of cache elements. Used for deletion.
+	bytesWritten int64 // Size of the keys and values of all written batches, see SaveStats.
 
-	fastNodeCache      map[string]*list.Element // FastNode cache.
-	fastNodeCacheSize  int                      // FastNode cache size limit in elements.
-	fastNodeCacheQueue *list.List               // LRU queue of cache elements. Used for deletion.
+	commitPending        int64    // Version being committed, see setCommitPending. 0 if none.
+	commitPendingNodes   [][]byte // Hashes of the pending commit's nodes in the batch.
+	commitPendingFlushes uint64   // Number of batches flushed while the commit is pending.
+
+	resources     resourceTracker // Open iterators, exporters and goroutines, see Close.
+	closed        bool            // Close has been called.
+	loaded        bool            // A version has been loaded, see recoverOnLoad.
+	cleanShutdown bool            // The tree was closed cleanly when last used, see CleanShutdown.
 }
 
 func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
@@ -89,6 +134,15 @@ func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 		o := DefaultOptions()
 		opts = &o
 	}
+	if opts.Retry != nil {
+		db = newRetryDB(db, *opts.Retry, opts.Logger)
+	}
+	if len(opts.KeyPrefix) > 0 {
+		db = newNamespaceDB(db, opts.KeyPrefix)
+	}
+	if opts.DryRun {
+		db = newDryRunDB(db)
+	}
 
 	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
 
@@ -96,94 +150,236 @@ func newNodeDB(db dbm.DB, cacheSize int, opts *Options) *nodeDB {
 		storeVersion = []byte(defaultStorageVersionValue)
 	}
 
-	return &nodeDB{
-		db:                 db,
-		batch:              db.NewBatch(),
-		opts:               *opts,
-		latestVersion:      0, // initially invalid
-		nodeCache:          make(map[string]*list.Element),
-		nodeCacheSize:      cacheSize,
-		nodeCacheQueue:     list.New(),
-		fastNodeCache:      make(map[string]*list.Element),
-		fastNodeCacheSize:  cacheSize,
-		fastNodeCacheQueue: list.New(),
-		versionReaders:     make(map[int64]uint32, 8),
-		storageVersion:     string(storeVersion),
+	ndb := &nodeDB{
+		db:               db,
+		batch:            newSizedBatch(db.NewBatch()),
+		opts:             *opts,
+		latestVersion:    0, // initially invalid
+		cacheSize:        cacheSize,
+		nodeCache:        newNodeCache(cacheSize, opts),
+		fastNodeCache:    newFastNodeCache(cacheSize, opts),
+		proofCache:       newLRUCache(proofCacheSize),
+		versionTreeCache: newLRUCache(versionTreeCacheSize),
+		versionReaders:   make(map[int64]uint32, 8),
+		storageVersion:   string(storeVersion),
+		logger:           opts.Logger,
+	}
+	if ndb.logger == nil {
+		ndb.logger = nopLogger{}
+	}
+	if opts.RankCacheSize > 0 {
+		ndb.rankCache = newLRUCache(opts.RankCacheSize)
+	}
+	if opts.CacheAdvisor != nil {
+		ndb.cacheAdvisor = newCacheAdvisor(*opts.CacheAdvisor)
+	}
+	if opts.MissingKeyCacheSize > 0 {
+		ndb.missingKeys = newMissingKeyCache(opts.MissingKeyCacheSize)
+	}
+	if opts.IOThrottle != nil {
+		ndb.throttle = newIOThrottle(*opts.IOThrottle)
+	}
+	if opts.ColdTier != nil {
+		if opts.DryRun {
+			coldTier := *opts.ColdTier
+			coldTier.Tier = newDryRunTier(coldTier.Tier)
+			ndb.opts.ColdTier = &coldTier
+		}
 	}
+	return ndb
+}
+
+// cacheEntryOverhead approximates the memory used by a cache entry beyond its keys and values,
+// i.e. the struct, slice headers, list element and map entry.
+const cacheEntryOverhead = 200
+
+// newNodeCache returns the node cache sized by the options, defaulting to cacheSize entries.
+func newNodeCache(cacheSize int, opts *Options) *lruCache {
+	size := cacheSize
+	if opts.NodeCacheSize > 0 || opts.NodeCacheBytes > 0 {
+		size = opts.NodeCacheSize
+	}
+	c := newLRUCacheBytes(size, opts.NodeCacheBytes, func(value interface{}) int {
+		node := value.(*Node)
+		return len(node.key) + len(node.value) + len(node.leftHash) + len(node.rightHash) + cacheEntryOverhead
+	})
+	if logger := opts.Logger; logger != nil {
+		c.onEvict = func(key string) {
+			logger.Debug("evicted node from cache", "hash", []byte(key))
+		}
+	}
+	return c
+}
+
+// newFastNodeCache returns the fast node cache sized by the options, defaulting to cacheSize
+// entries.
+func newFastNodeCache(cacheSize int, opts *Options) *lruCache {
+	size := cacheSize
+	if opts.FastNodeCacheSize > 0 || opts.FastNodeCacheBytes > 0 {
+		size = opts.FastNodeCacheSize
+	}
+	c := newLRUCacheBytes(size, opts.FastNodeCacheBytes, func(value interface{}) int {
+		return len(value.(*FastNode).value) + cacheEntryOverhead
+	})
+	if logger := opts.Logger; logger != nil {
+		c.onEvict = func(key string) {
+			logger.Debug("evicted fast node from cache", "key", []byte(key))
+		}
+	}
+	return c
 }
 
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
 // load its children.
 func (ndb *nodeDB) GetNode(hash []byte) *Node {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	return ndb.getNode(hash, true)
+}
+
+// getNode gets a node from memory or disk, adding it to the cache when loaded from disk if
+// addToCache is set.
+func (ndb *nodeDB) getNode(hash []byte, addToCache bool) *Node {
+	return ndb.getNodeFrom(ndb.db, hash, addToCache, nil)
+}
+
+// getNodeFrom is like getNode, but loads the node from the given database snapshot if it isn't
+// cached. Nodes are immutable, so cached nodes are valid for any snapshot containing them. The
+// read is recorded in stats, if given.
+func (ndb *nodeDB) getNodeFrom(r dbReader, hash []byte, addToCache bool, stats *readStats) *Node {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
 
 	if len(hash) == 0 {
 		panic("nodeDB.GetNode() requires hash")
 	}
 
 	// Check the cache.
-	if elem, ok := ndb.nodeCache[string(hash)]; ok {
-		// Already exists. Move to back of nodeCacheQueue.
-		ndb.nodeCacheQueue.MoveToBack(elem)
-		return elem.Value.(*Node)
+	cached, ok := ndb.nodeCache.Get(hash)
+	if ndb.cacheAdvisor != nil {
+		ndb.cacheAdvisor.readNode(hash, ok)
+	}
+	if stats != nil {
+		stats.readNode(ok)
+	}
+	if ok {
+		return cached.(*Node)
 	}
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.nodeKey(hash))
+	buf, err := ndb.getNodeBytes(r, hash)
 	if err != nil {
 		panic(fmt.Sprintf("can't get node %X: %v", hash, err))
 	}
 	if buf == nil {
-		panic(fmt.Sprintf("Value missing for hash %x corresponding to nodeKey %x", hash, ndb.nodeKey(hash)))
+		ndb.nodeMissing(hash, errors.New("not found"))
+		panic(errors.Wrapf(ErrNodeMissing, "Value missing for hash %x corresponding to nodeKey %x", hash, ndb.nodeKey(hash)))
+	}
+	buf, err = ndb.decryptValue(buf)
+	if err != nil {
+		ndb.nodeMissing(hash, err)
+		if errors.Is(err, ErrChecksumMismatch) {
+			panic(&NodeMissingError{Hash: hash, Cause: err})
+		}
+		panic(errors.Wrapf(ErrNodeMissing, "can't decrypt node %X: %v", hash, err))
 	}
 
-	node, err := MakeNode(buf)
+	var node *Node
+	if ndb.opts.ZeroCopyDecode {
+		node, err = makeNodeNoCopy(buf)
+	} else {
+		node, err = MakeNode(buf)
+	}
 	if err != nil {
-		panic(fmt.Sprintf("Error reading Node. bytes: %x, error: %v", buf, err))
+		ndb.nodeMissing(hash, errors.Wrap(err, "decoding node"))
+		panic(errors.Wrapf(ErrNodeMissing, "Error reading Node. bytes: %x, error: %v", buf, err))
 	}
 
 	node.hash = hash
 	node.persisted = true
-	ndb.cacheNode(node)
+	if addToCache {
+		ndb.cacheNode(node)
+	}
 
 	return node
 }
 
 func (ndb *nodeDB) GetFastNode(key []byte) (*FastNode, error) {
-	ndb.mtx.Lock()
-	defer ndb.mtx.Unlock()
+	return ndb.getFastNode(key, nil)
+}
+
+// getFastNode is like GetFastNode, but records the read in stats, if given.
+func (ndb *nodeDB) getFastNode(key []byte, stats *readStats) (*FastNode, error) {
+	fastNode, cached, err := ndb.loadFastNode(key, stats)
+	if fastNode != nil {
+		ndb.observeFastNodeRead(fastNode, cached)
+	}
+	return fastNode, err
+}
+
+// loadFastNode loads a fast node for getFastNode, and returns whether it was cached.
+func (ndb *nodeDB) loadFastNode(key []byte, stats *readStats) (*FastNode, bool, error) {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
 	if !ndb.hasUpgradedToFastStorage() {
-		return nil, errors.New("storage version is not fast")
+		return nil, false, errors.New("storage version is not fast")
 	}
 
 	if len(key) == 0 {
-		return nil, fmt.Errorf("nodeDB.GetFastNode() requires key, len(key) equals 0")
+		return nil, false, fmt.Errorf("nodeDB.GetFastNode() requires key, len(key) equals 0")
 	}
 
 	// Check the cache.
-	if elem, ok := ndb.fastNodeCache[string(key)]; ok {
-		// Already exists. Move to back of fastNodeCacheQueue.
-		ndb.fastNodeCacheQueue.MoveToBack(elem)
-		return elem.Value.(*FastNode), nil
+	cached, ok := ndb.fastNodeCache.Get(key)
+	if ndb.cacheAdvisor != nil {
+		ndb.cacheAdvisor.readFastNode(key, ok)
+	}
+	if stats != nil {
+		stats.readFastNode(ok)
+	}
+	if ok {
+		return cached.(*FastNode), true, nil
 	}
 
 	// Doesn't exist, load.
 	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
 	if err != nil {
-		return nil, fmt.Errorf("can't get FastNode %X: %w", key, err)
+		return nil, false, fmt.Errorf("can't get FastNode %X: %w", key, err)
 	}
 	if buf == nil {
-		return nil, nil
+		return nil, false, nil
+	}
+	buf, err = ndb.decryptValue(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("can't decrypt FastNode %X: %w", key, err)
 	}
 
-	fastNode, err := DeserializeFastNode(key, buf)
+	var fastNode *FastNode
+	if ndb.opts.ZeroCopyDecode {
+		fastNode, err = deserializeFastNodeNoCopy(key, buf)
+	} else {
+		fastNode, err = DeserializeFastNode(key, buf)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
+		return nil, false, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
 
 	ndb.cacheFastNode(fastNode)
-	return fastNode, nil
+	return fastNode, false, nil
+}
+
+// hasFastNode returns whether a fast node exists for the given key, without decoding it.
+func (ndb *nodeDB) hasFastNode(key []byte) (bool, error) {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+	if !ndb.hasUpgradedToFastStorage() {
+		return false, errors.New("storage version is not fast")
+	}
+	if len(key) == 0 {
+		return false, fmt.Errorf("nodeDB.hasFastNode() requires key, len(key) equals 0")
+	}
+	if _, ok := ndb.fastNodeCache.Get(key); ok {
+		return true, nil
+	}
+	return ndb.db.Has(ndb.fastNodeKey(key))
 }
 
 // SaveNode saves a node to disk.
@@ -199,19 +395,27 @@ func (ndb *nodeDB) SaveNode(node *Node) {
 	}
 
 	// Save node bytes to db.
-	var buf bytes.Buffer
-	buf.Grow(node.encodedSize())
-
-	if err := node.writeBytes(&buf); err != nil {
+	bz, err := encodeNode(node)
+	if err != nil {
+		panic(err)
+	}
+	bz, err = ndb.encryptValue(bz)
+	if err != nil {
 		panic(err)
 	}
 
-	if err := ndb.batch.Set(ndb.nodeKey(node.hash), buf.Bytes()); err != nil {
+	if err := ndb.batch.Set(ndb.nodeKey(node.hash), bz); err != nil {
 		panic(err)
 	}
-	debug("BATCH SAVE %X %p\n", node.hash, node)
+	if ndb.commitPending != 0 {
+		ndb.commitPendingNodes = append(ndb.commitPendingNodes, node.hash)
+	}
+	ndb.addChildRefs(node)
+	ndb.logger.Debug("saving node", "hash", node.hash, "version", node.version)
 	node.persisted = true
-	ndb.cacheNode(node)
+	if !ndb.opts.SkipCacheOnSave {
+		ndb.cacheNode(node)
+	}
 }
 
 // SaveNode saves a FastNode to disk and add to cache.
@@ -249,7 +453,11 @@ func (ndb *nodeDB) setFastStorageVersionToBatch() error {
 		newVersion = fastStorageVersionValue
 	}
 
-	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(ndb.getLatestVersion()))
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latest))
 
 	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
 		return err
@@ -271,38 +479,50 @@ func (ndb *nodeDB) hasUpgradedToFastStorage() bool {
 // When the live state is not matched, we must force reupgrade.
 // We determine this by checking the version of the live state and the version of the live state when
 // latest storage was updated on disk the last time.
-func (ndb *nodeDB) shouldForceFastStorageUpgrade() bool {
+func (ndb *nodeDB) shouldForceFastStorageUpgrade() (bool, error) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 	versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
 
 	if len(versions) == 2 {
-		if versions[1] != strconv.Itoa(int(ndb.getLatestVersion())) {
-			return true
+		latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return false, err
+		}
+		if versions[1] != strconv.Itoa(int(latest)) {
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
 // SaveNode saves a FastNode to disk.
-// CONTRACT: the caller must serizlize access to this method through ndb.mtx.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
 func (ndb *nodeDB) saveFastNodeUnlocked(node *FastNode, shouldAddToCache bool) error {
 	if node.key == nil {
 		return fmt.Errorf("FastNode cannot have a nil value for key")
 	}
 
 	// Save node bytes to db.
-	var buf bytes.Buffer
+	buf := getBuffer()
+	defer putBuffer(buf)
 	buf.Grow(node.encodedSize())
 
-	if err := node.writeBytes(&buf); err != nil {
+	if err := node.writeBytes(buf); err != nil {
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
-	if err := ndb.batch.Set(ndb.fastNodeKey(node.key), buf.Bytes()); err != nil {
+	bz, err := ndb.encryptValue(cloneBufferBytes(buf))
+	if err != nil {
+		return err
+	}
+	if err := ndb.batch.Set(ndb.fastNodeKey(node.key), bz); err != nil {
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
-	if shouldAddToCache {
+	if shouldAddToCache && ndb.opts.SkipCacheOnSave {
+		// Don't leave a stale value for the key in the cache.
+		ndb.uncacheFastNode(node.key)
+	} else if shouldAddToCache {
 		ndb.cacheFastNode(node)
 	}
 	return nil
@@ -310,54 +530,206 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *FastNode, shouldAddToCache bool) e
 
 // Has checks if a hash exists in the database.
 func (ndb *nodeDB) Has(hash []byte) (bool, error) {
-	key := ndb.nodeKey(hash)
+	return hasKey(ndb.db, ndb.nodeKey(hash))
+}
 
-	if ldb, ok := ndb.db.(*dbm.GoLevelDB); ok {
-		exists, err := ldb.DB().Has(key, nil)
-		if err != nil {
-			return false, err
-		}
-		return exists, nil
-	}
-	value, err := ndb.db.Get(key)
-	if err != nil {
-		return false, err
+// encodeNode returns the serialized node. The batch may retain the value until written, so it is
+// copied out of the pooled buffer.
+func encodeNode(node *Node) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Grow(node.encodedSize())
+
+	if err := node.writeBytes(buf); err != nil {
+		return nil, err
 	}
+	return cloneBufferBytes(buf), nil
+}
+
+// saveBranchPipelineSize is the number of encoded nodes that SaveBranch buffers between hashing
+// and writing them to the batch.
+const saveBranchPipelineSize = 256
 
-	return value != nil, nil
+// nodeWrite is an encoded node to be written to the batch by SaveBranch.
+type nodeWrite struct {
+	hash  []byte
+	key   []byte
+	value []byte
+	flush bool // flush the batch after writing the node
 }
 
 // SaveBranch saves the given node and all of its descendants.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
+//
+// Hashing and encoding nodes (CPU) is pipelined with writing them to the batch (I/O): nodes are
+// produced by the calling goroutine and written by a separate goroutine, through a bounded
+// channel.
 // TODO refactor, maybe use hashWithCount() but provide a callback.
 func (ndb *nodeDB) SaveBranch(node *Node) []byte {
 	if node.persisted {
 		return node.hash
 	}
 
+	writes := make(chan nodeWrite, saveBranchPipelineSize)
+	done := make(chan error, 1)
+	go func() {
+		done <- ndb.writeNodes(writes)
+	}()
+
+	hash := func() []byte {
+		// Close the channel even if saving panics, so that the writer exits.
+		defer close(writes)
+		return ndb.saveBranch(node, writes)
+	}()
+	if err := <-done; err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// saveBranch hashes and encodes the unpersisted nodes of the branch, in post-order, and sends
+// them to be written.
+func (ndb *nodeDB) saveBranch(node *Node, writes chan<- nodeWrite) []byte {
+	if node.persisted {
+		return node.hash
+	}
+
 	if node.leftNode != nil {
-		node.leftHash = ndb.SaveBranch(node.leftNode)
+		node.leftHash = ndb.saveBranch(node.leftNode, writes)
 	}
 	if node.rightNode != nil {
-		node.rightHash = ndb.SaveBranch(node.rightNode)
+		node.rightHash = ndb.saveBranch(node.rightNode, writes)
 	}
 
 	node._hash()
-	ndb.SaveNode(node)
-
-	// resetBatch only working on generate a genesis block
-	if node.version <= genesisVersion {
-		ndb.resetBatch()
+	bz, err := encodeNode(node)
+	if err != nil {
+		panic(err)
 	}
+	bz, err = ndb.encryptValue(bz)
+	if err != nil {
+		panic(err)
+	}
+	writes <- nodeWrite{
+		hash:  node.hash,
+		key:   ndb.nodeKey(node.hash),
+		value: bz,
+		// resetBatch only working on generate a genesis block
+		flush: node.version <= genesisVersion,
+	}
+	ndb.addChildRefs(node)
+	ndb.logger.Debug("saving node", "hash", node.hash, "version", node.version)
+	node.persisted = true
+	if !ndb.opts.SkipCacheOnSave {
+		ndb.cacheNode(node)
+	}
+
 	node.leftNode = nil
 	node.rightNode = nil
 
 	return node.hash
 }
 
+// writeNodes writes the encoded nodes to the batch until the channel is closed. After an error,
+// the remaining nodes are drained and the first error is returned.
+func (ndb *nodeDB) writeNodes(writes <-chan nodeWrite) error {
+	var err error
+	for w := range writes {
+		if err != nil {
+			continue
+		}
+		ndb.mtx.Lock()
+		err = ndb.batch.Set(w.key, w.value)
+		if err == nil && ndb.commitPending != 0 {
+			ndb.commitPendingNodes = append(ndb.commitPendingNodes, w.hash)
+		}
+		if err == nil && w.flush {
+			err = ndb.resetBatch()
+		} else if err == nil {
+			err = ndb.flushBatchIfFull()
+		}
+		ndb.mtx.Unlock()
+	}
+	return err
+}
+
+// sizedBatch is a batch which keeps track of the size of the keys and values written to it, and
+// records them if record is set, see Replicator.
+type sizedBatch struct {
+	dbm.Batch
+	size   int
+	record bool
+	ops    []BatchOp
+}
+
+func newSizedBatch(batch dbm.Batch) *sizedBatch {
+	return &sizedBatch{Batch: batch}
+}
+
+// Set implements dbm.Batch.
+func (b *sizedBatch) Set(key, value []byte) error {
+	b.size += len(key) + len(value)
+	if b.record {
+		b.ops = append(b.ops, BatchOp{Key: key, Value: value})
+	}
+	return b.Batch.Set(key, value)
+}
+
+// Delete implements dbm.Batch.
+func (b *sizedBatch) Delete(key []byte) error {
+	b.size += len(key)
+	if b.record {
+		b.ops = append(b.ops, BatchOp{Key: key, Delete: true})
+	}
+	return b.Batch.Delete(key)
+}
+
+// flushBatchIfFull writes the batch if it exceeds Options.MaxBatchBytes.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) flushBatchIfFull() error {
+	if ndb.opts.MaxBatchBytes <= 0 || ndb.batch.size < ndb.opts.MaxBatchBytes {
+		return nil
+	}
+	ndb.logger.Debug("flushing batch", "bytes", ndb.batch.size)
+	return ndb.resetBatch()
+}
+
+// traverseRangeFlushing is like traverseRange, but writes the batch whenever it exceeds
+// Options.MaxBatchBytes after a call to fn. Since some databases don't allow writes while an
+// iterator is open, the iterator is closed before writing and reopened after the last key seen.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) traverseRangeFlushing(start []byte, end []byte, fn func(k, v []byte) error) error {
+	for {
+		var next []byte
+		err := ndb.traverseRange(start, end, func(k, v []byte) error {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+			if ndb.opts.MaxBatchBytes > 0 && ndb.batch.size >= ndb.opts.MaxBatchBytes {
+				next = cpSucc(k)
+				return errStopTraversal
+			}
+			return nil
+		})
+		if err != nil && err != errStopTraversal {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		if err := ndb.flushBatchIfFull(); err != nil {
+			return err
+		}
+		start = next
+	}
+}
+
 // resetBatch reset the db batch, keep low memory used
 func (ndb *nodeDB) resetBatch() error {
+	if err := ndb.recordCommitPendingNodes(); err != nil {
+		return err
+	}
 	var err error
 	if ndb.opts.Sync {
 		err = ndb.batch.WriteSync()
@@ -372,8 +744,22 @@ func (ndb *nodeDB) resetBatch() error {
 		return err
 	}
 
-	ndb.batch = ndb.db.NewBatch()
+	ndb.newBatch()
+	ndb.refCounts = nil
 
+	return ndb.flushColdDeletes()
+}
+
+// discardBatch discards the changes in the batch which haven't been written yet.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) discardBatch() error {
+	if err := ndb.batch.Close(); err != nil {
+		return err
+	}
+	ndb.batch = newSizedBatch(ndb.db.NewBatch())
+	ndb.batch.record = ndb.replicating
+	ndb.refCounts = nil
+	ndb.coldDeletes = nil
 	return nil
 }
 
@@ -386,25 +772,54 @@ func (ndb *nodeDB) DeleteVersion(version int64, checkLatestVersion bool) error {
 	if ndb.versionReaders[version] > 0 {
 		return errors.Errorf("unable to delete version %v, it has %v active readers", version, ndb.versionReaders[version])
 	}
+	if err := ndb.checkRetention(version, version+1); err != nil {
+		return err
+	}
 
-	err := ndb.deleteOrphans(version)
+	if err := ndb.checkRefCountStorage(); err != nil {
+		return err
+	}
+	root, err := ndb.getRoot(version)
 	if err != nil {
 		return err
 	}
 
+	// The root is deleted first, so that the version is never readable with missing nodes if
+	// the batch is flushed part-way, see Options.MaxBatchBytes.
 	err = ndb.deleteRoot(version, checkLatestVersion)
 	if err != nil {
 		return err
 	}
+
+	err = ndb.deleteVersionMetadataRange(version, version+1)
+	if err != nil {
+		return err
+	}
+	err = ndb.deleteExpiryUndo(version, version+1)
+	if err != nil {
+		return err
+	}
+
+	if ndb.opts.RefCountGC {
+		return ndb.releaseRoots(context.Background(), [][]byte{root})
+	}
+	err = ndb.deleteOrphans(version)
+	if err != nil {
+		return err
+	}
 	return err
 }
 
 // DeleteVersionsFrom permanently deletes all tree versions from the given version upwards.
 func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
-	latest := ndb.getLatestVersion()
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
 	if latest < version {
 		return nil
 	}
+	ndb.logger.Info("deleting versions", "fromVersion", version, "toVersion", latest+1)
 	root, err := ndb.getRoot(latest)
 	if err != nil {
 		return err
@@ -418,8 +833,65 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 			return errors.Errorf("unable to delete version %v with %v active readers", v, r)
 		}
 	}
+	if err := ndb.checkRetention(version, math.MaxInt64); err != nil {
+		return err
+	}
+	if err := ndb.checkRefCountStorage(); err != nil {
+		return err
+	}
+
+	// Delete the version root entries first, so that no version is readable with missing nodes
+	// if the batch is flushed part-way, see Options.MaxBatchBytes.
+	var roots [][]byte
+	err = ndb.traverseRange(rootKeyFormat.Key(version), rootKeyFormat.Key(int64(math.MaxInt64)), func(k, v []byte) error {
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+		roots = append(roots, append([]byte(nil), v...))
+		var rootVersion int64
+		if err := rootKeyFormat.ScanStrict(k, &rootVersion); err != nil {
+			return err
+		}
+		return ndb.unindexRoot(v, rootVersion)
+	})
+
+	if err != nil {
+		return err
+	}
 
-	// First, delete all active nodes in the current (latest) version whose node version is after
+	err = ndb.deleteAllVersionMetadataFrom(version)
+	if err != nil {
+		return err
+	}
+
+	err = ndb.deleteAllPrunedStubsFrom(version)
+	if err != nil {
+		return err
+	}
+
+	err = ndb.deletePreimagesFrom(version)
+	if err != nil {
+		return err
+	}
+
+	err = ndb.deleteExpiriesFrom(version)
+	if err != nil {
+		return err
+	}
+
+	err = ndb.markIndexesStale()
+	if err != nil {
+		return err
+	}
+
+	if ndb.opts.RefCountGC {
+		if err := ndb.releaseRoots(context.Background(), roots); err != nil {
+			return err
+		}
+		return ndb.deleteFastNodesFrom(version)
+	}
+
+	// Next, delete all active nodes in the current (latest) version whose node version is after
 	// the given version.
 	err = ndb.deleteNodesFrom(version, root)
 	if err != nil {
@@ -429,21 +901,33 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 	// Next, delete orphans:
 	// - Delete orphan entries *and referred nodes* with fromVersion >= version
 	// - Delete orphan entries with toVersion >= version-1 (since orphans at latest are not orphans)
-	err = ndb.traverseOrphans(func(key, hash []byte) error {
+	//
+	// Since an orphan's lifetime never ends before it begins (toVersion >= fromVersion), all of
+	// these have toVersion >= version-1, and are found by a range scan over the orphan keys,
+	// which are ordered by toVersion, rather than a scan over all orphans.
+	err = ndb.traverseRangeFlushing(orphanKeyFormat.Key(version-1), orphanKeyFormat.Key(int64(math.MaxInt64)), func(key, hash []byte) error {
 		var fromVersion, toVersion int64
-		orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+		if err := orphanKeyFormat.ScanStrict(key, &toVersion, &fromVersion); err != nil {
+			return err
+		}
 
 		if fromVersion >= version {
 			if err = ndb.batch.Delete(key); err != nil {
 				return err
 			}
-			if err = ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			if err = ndb.deleteOrphanedNode(hash, toVersion); err != nil {
 				return err
 			}
 		} else if toVersion >= version-1 {
 			if err := ndb.batch.Delete(key); err != nil {
 				return err
 			}
+			// The node is referenced by the new latest version again.
+			if ndb.opts.ColdTier != nil && toVersion <= ndb.coldDemoted {
+				if err := ndb.promoteNode(hash); err != nil {
+					return err
+				}
+			}
 		}
 		return nil
 	})
@@ -451,22 +935,27 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 	if err != nil {
 		return err
 	}
-
-	// Delete the version root entries
-	err = ndb.traverseRange(rootKeyFormat.Key(version), rootKeyFormat.Key(int64(math.MaxInt64)), func(k, v []byte) error {
-		if err := ndb.batch.Delete(k); err != nil {
+	if ndb.opts.ColdTier != nil && ndb.coldDemoted >= version-1 {
+		demoted := version - 2
+		if demoted < 0 {
+			demoted = 0
+		}
+		if err := ndb.setColdTierDemoted(demoted); err != nil {
 			return err
 		}
-		return nil
-	})
-
-	if err != nil {
-		return err
 	}
 
-	// Delete fast node entries
-	err = ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
+	return ndb.deleteFastNodesFrom(version)
+}
+
+// deleteFastNodesFrom deletes the fast nodes last updated at or after the given version.
+func (ndb *nodeDB) deleteFastNodesFrom(version int64) error {
+	err := ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
 		key := keyWithPrefix[1:]
+		v, err := ndb.decryptValue(v)
+		if err != nil {
+			return err
+		}
 		fastNode, err := DeserializeFastNode(key, v)
 
 		if err != nil {
@@ -488,8 +977,17 @@ func (ndb *nodeDB) DeleteVersionsFrom(version int64) error {
 	return nil
 }
 
-// DeleteVersionsRange deletes versions from an interval (not inclusive).
+// DeleteVersionsRange deletes versions from an interval (not inclusive). Nodes still referenced
+// by the version preceding the interval are kept, and their orphan entries re-anchored to it, so
+// that e.g. snapshot versions kept with a keep-every pruning strategy remain fully readable.
 func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
+	return ndb.deleteVersionsRange(context.Background(), fromVersion, toVersion)
+}
+
+// deleteVersionsRange is like DeleteVersionsRange, but stops if ctx is done, discarding the
+// changes not yet written. If the batch has been written part-way, see Options.MaxBatchBytes,
+// the versions are deleted but some of their nodes may be left behind.
+func (ndb *nodeDB) deleteVersionsRange(ctx context.Context, fromVersion, toVersion int64) (err error) {
 	if fromVersion >= toVersion {
 		return errors.New("toVersion must be greater than fromVersion")
 	}
@@ -500,64 +998,119 @@ func (ndb *nodeDB) DeleteVersionsRange(fromVersion, toVersion int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	latest := ndb.getLatestVersion()
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
 	if latest < toVersion {
 		return errors.Errorf("cannot delete latest saved version (%d)", latest)
 	}
 
-	predecessor := ndb.getPreviousVersion(fromVersion)
+	predecessor, err := ndb.getPreviousVersion(fromVersion)
+	if err != nil {
+		return err
+	}
 
 	for v, r := range ndb.versionReaders {
 		if v < toVersion && v > predecessor && r != 0 {
 			return errors.Errorf("unable to delete version %v with %v active readers", v, r)
 		}
 	}
+	if err := ndb.checkRetention(fromVersion, toVersion); err != nil {
+		return err
+	}
 
-	// If the predecessor is earlier than the beginning of the lifetime, we can delete the orphan.
-	// Otherwise, we shorten its lifetime, by moving its endpoint to the predecessor version.
-	for version := fromVersion; version < toVersion; version++ {
-		err := ndb.traverseOrphansVersion(version, func(key, hash []byte) error {
-			var from, to int64
-			orphanKeyFormat.Scan(key, &to, &from)
-			if err := ndb.batch.Delete(key); err != nil {
-				debug("%v\n", err)
-				return err
-			}
-			if from > predecessor {
-				if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
-					panic(err)
-				}
-				ndb.uncacheNode(hash)
-				ndb.uncacheFastNode(key)
-			} else {
-				ndb.saveOrphan(hash, from, predecessor)
+	if err := ndb.checkRefCountStorage(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			if discardErr := ndb.discardBatch(); discardErr != nil {
+				err = discardErr
 			}
-			return nil
-		})
-		if err != nil {
+		}
+	}()
+
+	// Delete the version root entries first, so that no version is readable with missing nodes
+	// if the batch is flushed part-way, see Options.MaxBatchBytes.
+	var roots [][]byte
+	err = ndb.traverseRange(rootKeyFormat.Key(fromVersion), rootKeyFormat.Key(toVersion), func(k, v []byte) error {
+		if ndb.throttle != nil {
+			ndb.throttle.charge(1, len(k)+len(v))
+		}
+		if err := ndb.batch.Delete(k); err != nil {
+			return err
+		}
+		roots = append(roots, append([]byte(nil), v...))
+		var rootVersion int64
+		if err := rootKeyFormat.ScanStrict(k, &rootVersion); err != nil {
 			return err
 		}
+		if err := ndb.setPrunedStub(rootVersion, v); err != nil {
+			return err
+		}
+		return ndb.unindexRoot(v, rootVersion)
+	})
+	if err != nil {
+		return err
+	}
+	err = ndb.deleteVersionMetadataRange(fromVersion, toVersion)
+	if err != nil {
+		return err
+	}
+	err = ndb.deleteExpiryUndo(fromVersion, toVersion)
+	if err != nil {
+		return err
 	}
 
-	for key, elem := range ndb.fastNodeCache {
-		fastNode := elem.Value.(*FastNode)
-		if fastNode.versionLastUpdatedAt >= fromVersion && fastNode.versionLastUpdatedAt < toVersion {
-			ndb.fastNodeCacheQueue.Remove(elem)
-			delete(ndb.fastNodeCache, string(key))
-		}
+	if ndb.opts.RefCountGC {
+		return ndb.releaseRoots(ctx, roots)
 	}
 
-	// Delete the version root entries
-	err := ndb.traverseRange(rootKeyFormat.Key(fromVersion), rootKeyFormat.Key(toVersion), func(k, v []byte) error {
-		if err := ndb.batch.Delete(k); err != nil {
+	// Orphans with a lifetime ending within the range are only needed by deleted versions past the
+	// predecessor. If the predecessor is earlier than the beginning of the lifetime, we can delete
+	// the orphan. Otherwise, we shorten its lifetime, by moving its endpoint to the predecessor
+	// version, i.e. the nearest version which is kept. Since orphans are keyed by their last
+	// version, all of them are found with a single range scan regardless of how sparse the
+	// versions in the range are.
+	err = ndb.traverseRangeFlushing(orphanKeyFormat.Key(fromVersion), orphanKeyFormat.Key(toVersion), func(key, hash []byte) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		if ndb.throttle != nil {
+			ndb.throttle.charge(1, len(key)+len(hash))
+		}
+		var from, to int64
+		if err := orphanKeyFormat.ScanStrict(key, &to, &from); err != nil {
+			return err
+		}
+		if err := ndb.batch.Delete(key); err != nil {
+			ndb.logger.Error("failed to delete orphan", "key", key, "err", err)
+			return err
+		}
+		if from > predecessor {
+			if err := ndb.deleteOrphanedNode(hash, to); err != nil {
+				panic(err)
+			}
+			ndb.uncacheNode(hash)
+			ndb.uncacheFastNode(key)
+		} else {
+			ndb.saveOrphan(hash, from, predecessor)
+		}
 		return nil
 	})
-
 	if err != nil {
 		return err
 	}
+
+	ndb.fastNodeCache.RemoveIf(func(key string, cached interface{}) bool {
+		fastNode := cached.(*FastNode)
+		return fastNode.versionLastUpdatedAt >= fromVersion && fastNode.versionLastUpdatedAt < toVersion
+	})
+
 	return nil
 }
 
@@ -573,29 +1126,38 @@ func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 
 // deleteNodesFrom deletes the given node and any descendants that have versions after the given
 // (inclusive). It is mainly used via LoadVersionForOverwriting, to delete the current version.
+//
+// Since a node is always created at or after the versions of its children, subtrees whose root
+// is older than the given version are skipped without being loaded. The traversal uses an
+// explicit worklist rather than recursion.
 func (ndb *nodeDB) deleteNodesFrom(version int64, hash []byte) error {
 	if len(hash) == 0 {
 		return nil
 	}
 
-	node := ndb.GetNode(hash)
-	if node.leftHash != nil {
-		if err := ndb.deleteNodesFrom(version, node.leftHash); err != nil {
-			return err
+	worklist := [][]byte{hash}
+	for len(worklist) > 0 {
+		hash := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		node := ndb.GetNode(hash)
+		if node.version < version {
+			continue
 		}
-	}
-	if node.rightHash != nil {
-		if err := ndb.deleteNodesFrom(version, node.rightHash); err != nil {
-			return err
+		if node.leftHash != nil {
+			worklist = append(worklist, node.leftHash)
+		}
+		if node.rightHash != nil {
+			worklist = append(worklist, node.rightHash)
 		}
-	}
 
-	if node.version >= version {
 		if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
 			return err
 		}
-
 		ndb.uncacheNode(hash)
+		if err := ndb.flushBatchIfFull(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -604,15 +1166,22 @@ func (ndb *nodeDB) deleteNodesFrom(version int64, hash []byte) error {
 // Saves orphaned nodes to disk under a special prefix.
 // version: the new version being saved.
 // orphans: the orphan nodes created since version-1
-func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) {
+func (ndb *nodeDB) SaveOrphans(version int64, orphans map[string]int64) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	toVersion := ndb.getPreviousVersion(version)
+	if ndb.opts.RefCountGC {
+		return nil
+	}
+	toVersion, err := ndb.getPreviousVersion(version)
+	if err != nil {
+		return err
+	}
 	for hash, fromVersion := range orphans {
-		debug("SAVEORPHAN %v-%v %X\n", fromVersion, toVersion, hash)
+		ndb.logger.Debug("saving orphan", "hash", []byte(hash), "fromVersion", fromVersion, "toVersion", toVersion)
 		ndb.saveOrphan([]byte(hash), fromVersion, toVersion)
 	}
+	return nil
 }
 
 // Saves a single orphan to disk.
@@ -630,16 +1199,25 @@ func (ndb *nodeDB) saveOrphan(hash []byte, fromVersion, toVersion int64) {
 // entries.
 func (ndb *nodeDB) deleteOrphans(version int64) error {
 	// Will be zero if there is no previous version.
-	predecessor := ndb.getPreviousVersion(version)
+	predecessor, err := ndb.getPreviousVersion(version)
+	if err != nil {
+		return err
+	}
 
 	// Traverse orphans with a lifetime ending at the version specified.
 	// TODO optimize.
-	return ndb.traverseOrphansVersion(version, func(key, hash []byte) error {
+	prefix := orphanKeyFormat.Key(version)
+	return ndb.traverseRangeFlushing(prefix, cpIncr(prefix), func(key, hash []byte) error {
 		var fromVersion, toVersion int64
 
 		// See comment on `orphanKeyFmt`. Note that here, `version` and
 		// `toVersion` are always equal.
-		orphanKeyFormat.Scan(key, &toVersion, &fromVersion)
+		if err := orphanKeyFormat.ScanStrict(key, &toVersion, &fromVersion); err != nil {
+			return err
+		}
+		if ndb.throttle != nil {
+			ndb.throttle.charge(1, len(key)+len(hash))
+		}
 
 		// Delete orphan key and reverse-lookup key.
 		if err := ndb.batch.Delete(key); err != nil {
@@ -652,13 +1230,13 @@ func (ndb *nodeDB) deleteOrphans(version int64) error {
 		// can delete the orphan.  Otherwise, we shorten its lifetime, by
 		// moving its endpoint to the previous version.
 		if predecessor < fromVersion || fromVersion == toVersion {
-			debug("DELETE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
-			if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			ndb.logger.Debug("deleting orphan", "hash", hash, "predecessor", predecessor, "fromVersion", fromVersion, "toVersion", toVersion)
+			if err := ndb.deleteOrphanedNode(hash, toVersion); err != nil {
 				return err
 			}
 			ndb.uncacheNode(hash)
 		} else {
-			debug("MOVE predecessor:%v fromVersion:%v toVersion:%v %X\n", predecessor, fromVersion, toVersion, hash)
+			ndb.logger.Debug("moving orphan", "hash", hash, "predecessor", predecessor, "fromVersion", fromVersion, "toVersion", toVersion)
 			ndb.saveOrphan(hash, fromVersion, predecessor)
 		}
 		return nil
@@ -681,11 +1259,15 @@ func (ndb *nodeDB) rootKey(version int64) []byte {
 	return rootKeyFormat.Key(version)
 }
 
-func (ndb *nodeDB) getLatestVersion() int64 {
+func (ndb *nodeDB) getLatestVersion() (int64, error) {
 	if ndb.latestVersion == 0 {
-		ndb.latestVersion = ndb.getPreviousVersion(1<<63 - 1)
+		latest, err := ndb.getPreviousVersion(1<<63 - 1)
+		if err != nil {
+			return 0, err
+		}
+		ndb.latestVersion = latest
 	}
-	return ndb.latestVersion
+	return ndb.latestVersion, nil
 }
 
 func (ndb *nodeDB) updateLatestVersion(version int64) {
@@ -696,46 +1278,70 @@ func (ndb *nodeDB) updateLatestVersion(version int64) {
 
 func (ndb *nodeDB) resetLatestVersion(version int64) {
 	ndb.latestVersion = version
+	if ndb.missingKeys != nil {
+		ndb.missingKeys.reset(version)
+	}
 }
 
-func (ndb *nodeDB) getPreviousVersion(version int64) int64 {
+// getPreviousVersion returns the latest saved version before the given one, or 0 if none.
+func (ndb *nodeDB) getPreviousVersion(version int64) (int64, error) {
 	itr, err := ndb.db.ReverseIterator(
 		rootKeyFormat.Key(1),
 		rootKeyFormat.Key(version),
 	)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	defer itr.Close()
 
 	pversion := int64(-1)
 	for ; itr.Valid(); itr.Next() {
 		k := itr.Key()
-		rootKeyFormat.Scan(k, &pversion)
-		return pversion
-	}
-
-	if err := itr.Error(); err != nil {
-		panic(err)
+		if err := rootKeyFormat.ScanStrict(k, &pversion); err != nil {
+			return 0, err
+		}
+		return pversion, nil
 	}
 
-	return 0
+	return 0, itr.Error()
 }
 
 // deleteRoot deletes the root entry from disk, but not the node it points to.
 func (ndb *nodeDB) deleteRoot(version int64, checkLatestVersion bool) error {
-	if checkLatestVersion && version == ndb.getLatestVersion() {
-		return errors.New("Tried to delete latest version")
+	if checkLatestVersion {
+		latest, err := ndb.getLatestVersion()
+		if err != nil {
+			return err
+		}
+		if version == latest {
+			return errors.New("Tried to delete latest version")
+		}
 	}
 	if err := ndb.batch.Delete(ndb.rootKey(version)); err != nil {
 		return err
 	}
-	return nil
+	if !ndb.opts.PrunedStubs && !ndb.opts.RootHashIndex {
+		return nil
+	}
+	hash, err := ndb.getRoot(version)
+	if err != nil {
+		return err
+	}
+	if err := ndb.setPrunedStub(version, hash); err != nil {
+		return err
+	}
+	return ndb.unindexRoot(hash, version)
 }
 
-// Traverse orphans and return error if any, nil otherwise
+// Traverse orphans and return error if any, nil otherwise. Returns an error wrapping
+// ErrMalformedKey for an orphan key which doesn't match orphanKeyFormat.
 func (ndb *nodeDB) traverseOrphans(fn func(keyWithPrefix, v []byte) error) error {
-	return ndb.traversePrefix(orphanKeyFormat.Key(), fn)
+	return ndb.traversePrefix(orphanKeyFormat.Key(), func(k, v []byte) error {
+		if err := orphanKeyFormat.ScanStrict(k); err != nil {
+			return err
+		}
+		return fn(k, v)
+	})
 }
 
 // Traverse fast nodes and return error if any, nil otherwise
@@ -743,11 +1349,6 @@ func (ndb *nodeDB) traverseFastNodes(fn func(k, v []byte) error) error {
 	return ndb.traversePrefix(fastKeyFormat.Key(), fn)
 }
 
-// Traverse orphans ending at a certain version. return error if any, nil otherwise
-func (ndb *nodeDB) traverseOrphansVersion(version int64, fn func(k, v []byte) error) error {
-	return ndb.traversePrefix(orphanKeyFormat.Key(version), fn)
-}
-
 // Traverse all keys and return error if any, nil otherwise
 func (ndb *nodeDB) traverse(fn func(key, value []byte) error) error {
 	return ndb.traverseRange(nil, nil, fn)
@@ -816,53 +1417,37 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (dbm.Itera
 }
 
 func (ndb *nodeDB) uncacheNode(hash []byte) {
-	if elem, ok := ndb.nodeCache[string(hash)]; ok {
-		ndb.nodeCacheQueue.Remove(elem)
-		delete(ndb.nodeCache, string(hash))
-	}
+	ndb.nodeCache.Remove(hash)
 }
 
 // Add a node to the cache and pop the least recently used node if we've
 // reached the cache size limit.
 func (ndb *nodeDB) cacheNode(node *Node) {
-	elem := ndb.nodeCacheQueue.PushBack(node)
-	ndb.nodeCache[string(node.hash)] = elem
-
-	if ndb.nodeCacheQueue.Len() > ndb.nodeCacheSize {
-		oldest := ndb.nodeCacheQueue.Front()
-		hash := ndb.nodeCacheQueue.Remove(oldest).(*Node).hash
-		delete(ndb.nodeCache, string(hash))
-	}
+	ndb.nodeCache.Add(node.hash, node)
 }
 
-// CONTRACT: the caller must serizlize access to this method through ndb.mtx.
 func (ndb *nodeDB) uncacheFastNode(key []byte) {
-	if elem, ok := ndb.fastNodeCache[string(key)]; ok {
-		ndb.fastNodeCacheQueue.Remove(elem)
-		delete(ndb.fastNodeCache, string(key))
-	}
+	ndb.fastNodeCache.Remove(key)
 }
 
 // Add a node to the cache and pop the least recently used node if we've
 // reached the cache size limit.
-// CONTRACT: the caller must serizlize access to this method through ndb.mtx.
 func (ndb *nodeDB) cacheFastNode(node *FastNode) {
-	elem := ndb.fastNodeCacheQueue.PushBack(node)
-	ndb.fastNodeCache[string(node.key)] = elem
-
-	if ndb.fastNodeCacheQueue.Len() > ndb.fastNodeCacheSize {
-		oldest := ndb.fastNodeCacheQueue.Front()
-		key := ndb.fastNodeCacheQueue.Remove(oldest).(*FastNode).key
-		delete(ndb.fastNodeCache, string(key))
-	}
+	ndb.fastNodeCache.Add(node.key, node)
 }
 
 // Write to disk.
 func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
+	if ndb.closed {
+		return ErrClosed
+	}
 
-	var err error
+	err := ndb.recordCommitPendingNodes()
+	if err != nil {
+		return err
+	}
 	if ndb.opts.Sync {
 		err = ndb.batch.WriteSync()
 	} else {
@@ -873,11 +1458,179 @@ func (ndb *nodeDB) Commit() error {
 	}
 
 	ndb.batch.Close()
-	ndb.batch = ndb.db.NewBatch()
+	ndb.newBatch()
+	ndb.refCounts = nil
 
+	return ndb.flushColdDeletes()
+}
+
+// newBatch replaces the written batch with a new one, recording its writes for replication.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) newBatch() {
+	ndb.bytesWritten += int64(ndb.batch.size)
+	if ndb.replicating {
+		ndb.replicated = append(ndb.replicated, ndb.batch.ops...)
+	}
+	ndb.batch = newSizedBatch(ndb.db.NewBatch())
+	ndb.batch.record = ndb.replicating
+}
+
+// commitPendingNodesKey returns the key listing the nodes of the pending commit flushed in the
+// given batch, see commitPendingNodesPrefix.
+func commitPendingNodesKey(flush uint64) []byte {
+	return metadataKeyFormat.Key(append([]byte(commitPendingNodesPrefix), formatUint64(flush)...))
+}
+
+// setCommitPending marks the given version as being committed, see commitPendingKey. Nodes
+// listed by a failed attempt are kept listed, since they are persisted and reused by the retry.
+func (ndb *nodeDB) setCommitPending(version int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.commitPending = version
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(commitPendingKey)), formatUint64(uint64(version)))
+}
+
+// recordCommitPendingNodes lists the pending commit's nodes in the batch before it is flushed,
+// see commitPendingNodesPrefix.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) recordCommitPendingNodes() error {
+	if ndb.commitPending == 0 || len(ndb.commitPendingNodes) == 0 {
+		return nil
+	}
+	bz := make([]byte, 0, len(ndb.commitPendingNodes)*hashSize)
+	for _, hash := range ndb.commitPendingNodes {
+		bz = append(bz, hash...)
+	}
+	if err := ndb.batch.Set(commitPendingNodesKey(ndb.commitPendingFlushes), bz); err != nil {
+		return err
+	}
+	ndb.commitPendingNodes = nil
+	ndb.commitPendingFlushes++
 	return nil
 }
 
+// clearCommitPending removes the commit marker and the node lists of flushed batches. It must be
+// called before the Commit() which writes the version root, so that both land in the same atomic
+// batch.
+func (ndb *nodeDB) clearCommitPending() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	for i := uint64(0); i < ndb.commitPendingFlushes; i++ {
+		if err := ndb.batch.Delete(commitPendingNodesKey(i)); err != nil {
+			return err
+		}
+	}
+	ndb.commitPending = 0
+	ndb.commitPendingNodes = nil
+	ndb.commitPendingFlushes = 0
+	return ndb.batch.Delete(metadataKeyFormat.Key([]byte(commitPendingKey)))
+}
+
+// recoverTornCommit rolls back a commit that was interrupted before its root was written. It
+// deletes the nodes listed under commitPendingNodesPrefix, which can only be referenced by the
+// missing root, along with the orphan entries and version metadata the commit wrote. Fast node
+// removals can't be undone from the fast index alone, so if fast storage is enabled, the storage
+// version is set to the pending version, which forces the fast index to be rebuilt from the
+// latest version on load, see shouldForceFastStorageUpgrade. With RefCountGC, references taken on
+// older nodes are kept, which can only delay their deletion. Returns the rolled back version, or 0
+// if there was no torn commit.
+func (ndb *nodeDB) recoverTornCommit() (int64, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	markerKey := metadataKeyFormat.Key([]byte(commitPendingKey))
+	bz, err := ndb.db.Get(markerKey)
+	if err != nil {
+		return 0, err
+	}
+	if bz == nil {
+		return 0, nil
+	}
+	if len(bz) != int64Size {
+		return 0, errors.Errorf("invalid pending commit marker %X", bz)
+	}
+	version := int64(binary.BigEndian.Uint64(bz))
+
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+
+	hasRoot, err := ndb.db.Has(ndb.rootKey(version))
+	if err != nil {
+		return 0, err
+	}
+	var storageVersion string
+	if !hasRoot {
+		ndb.logger.Info("rolling back torn commit", "version", version)
+		err = ndb.traversePrefix(metadataKeyFormat.Key([]byte(commitPendingNodesPrefix)), func(_, hashes []byte) error {
+			if len(hashes)%hashSize != 0 {
+				return errors.Errorf("invalid pending commit node list of length %d", len(hashes))
+			}
+			for i := 0; i < len(hashes); i += hashSize {
+				hash := hashes[i : i+hashSize]
+				ndb.uncacheNode(hash)
+				if err := batch.Delete(refCountKeyFormat.Key(hash)); err != nil {
+					return err
+				}
+				if err := batch.Delete(ndb.nodeKey(hash)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		// Orphan entries of the commit end at the previous version, and no others can, since it
+		// is the latest one.
+		previous, err := ndb.getPreviousVersion(version)
+		if err != nil {
+			return 0, err
+		}
+		err = ndb.traverseRange(orphanKeyFormat.Key(previous), orphanKeyFormat.Key(int64(math.MaxInt64)), func(key, _ []byte) error {
+			return batch.Delete(key)
+		})
+		if err != nil {
+			return 0, err
+		}
+		err = ndb.traverseRange(versionMetadataKey(version), versionMetadataKey(math.MaxInt64), func(key, _ []byte) error {
+			return batch.Delete(key)
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		if ndb.storageVersion >= fastStorageVersionValue {
+			versions := strings.Split(ndb.storageVersion, fastStorageVersionDelimiter)
+			storageVersion = versions[0] + fastStorageVersionDelimiter + strconv.Itoa(int(version))
+			err = batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(storageVersion))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	err = ndb.traversePrefix(metadataKeyFormat.Key([]byte(commitPendingNodesPrefix)), func(key, _ []byte) error {
+		return batch.Delete(key)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err = batch.Delete(markerKey); err != nil {
+		return 0, err
+	}
+	if err = batch.WriteSync(); err != nil {
+		return 0, err
+	}
+	if hasRoot {
+		return 0, nil
+	}
+	if storageVersion != "" {
+		ndb.storageVersion = storageVersion
+	}
+	return version, nil
+}
+
 func (ndb *nodeDB) HasRoot(version int64) (bool, error) {
 	return ndb.db.Has(ndb.rootKey(version))
 }
@@ -889,12 +1642,17 @@ func (ndb *nodeDB) getRoot(version int64) ([]byte, error) {
 func (ndb *nodeDB) getRoots() (map[int64][]byte, error) {
 	roots := map[int64][]byte{}
 
-	ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+	err := ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
 		var version int64
-		rootKeyFormat.Scan(k, &version)
+		if err := rootKeyFormat.ScanStrict(k, &version); err != nil {
+			return err
+		}
 		roots[version] = v
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	return roots, nil
 }
 
@@ -917,12 +1675,26 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 	defer ndb.mtx.Unlock()
 
 	// We allow the initial version to be arbitrary
-	latest := ndb.getLatestVersion()
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
 	if latest > 0 && version != latest+1 {
 		return fmt.Errorf("must save consecutive versions; expected %d, got %d", latest+1, version)
 	}
+	if err := ndb.checkRefCountStorage(); err != nil {
+		return err
+	}
+	if ndb.opts.RefCountGC {
+		if len(hash) > 0 {
+			ndb.addRef(hash)
+		}
+		if err := ndb.applyRefs(); err != nil {
+			return err
+		}
+	}
 
-	if err := ndb.batch.Set(ndb.rootKey(version), hash); err != nil {
+	if err := ndb.writeRoot(version, nil, hash); err != nil {
 		return err
 	}
 
@@ -931,6 +1703,29 @@ func (ndb *nodeDB) saveRoot(hash []byte, version int64) error {
 	return nil
 }
 
+// writeRoot writes the root entry of a version to the batch, replacing the previous root hash if
+// not nil, and keeps the root hash index and the caches of the version in sync.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) writeRoot(version int64, previous, hash []byte) error {
+	if previous != nil {
+		if err := ndb.unindexRoot(previous, version); err != nil {
+			return err
+		}
+	}
+	if err := ndb.batch.Set(ndb.rootKey(version), hash); err != nil {
+		return err
+	}
+	ndb.invalidateProofCache(version)
+	ndb.invalidateRankCache(version)
+	ndb.invalidateVersionTreeCache(version)
+	if ndb.opts.RootHashIndex {
+		if err := ndb.batch.Set(rootHashIndexKey(hash, version), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (ndb *nodeDB) incrVersionReaders(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -945,6 +1740,12 @@ func (ndb *nodeDB) decrVersionReaders(version int64) {
 	}
 }
 
+func (ndb *nodeDB) hasVersionReaders(version int64) bool {
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+	return ndb.versionReaders[version] > 0
+}
+
 // Utility and test functions
 
 func (ndb *nodeDB) leafNodes() ([]*Node, error) {
@@ -1015,17 +1816,61 @@ func (ndb *nodeDB) size() int {
 	return size
 }
 
-func (ndb *nodeDB) traverseNodes(fn func(hash []byte, node *Node) error) error {
-	nodes := []*Node{}
+// TraverseNodeHashes calls fn with the hash, encoded size and version of every node in the
+// database, across all versions, in hash order. Only the version is decoded from each node, so
+// this is much cheaper than loading the nodes, e.g. for external garbage collection, dedup or
+// disk usage tooling. The hash is only valid until fn returns.
+func (ndb *nodeDB) TraverseNodeHashes(fn func(hash []byte, size int, version int64) error) error {
+	return ndb.withSnapshot(func(r dbReader) error {
+		return traversePrefixIn(r, nodeKeyFormat.Key(), func(key, value []byte) error {
+			hash := key[1:]
+			plaintext, err := ndb.decryptValue(value)
+			if err != nil {
+				return errors.Wrapf(err, "decoding node %X", hash)
+			}
+			version, err := decodeNodeVersion(plaintext)
+			if err != nil {
+				return errors.Wrapf(err, "decoding node %X", hash)
+			}
+			return fn(hash, len(value), version)
+		})
+	})
+}
 
-	err := ndb.traversePrefix(nodeKeyFormat.Key(), func(key, value []byte) error {
-		node, err := MakeNode(value)
+// decodeNodeVersion decodes the version of an encoded node, skipping its height and size.
+func decodeNodeVersion(buf []byte) (int64, error) {
+	var version int64
+	for i := 0; i < 3; i++ {
+		var n int
+		var err error
+		version, n, err = decodeVarint(buf)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		nodeKeyFormat.Scan(key, &node.hash)
-		nodes = append(nodes, node)
-		return nil
+		buf = buf[n:]
+	}
+	return version, nil
+}
+
+func (ndb *nodeDB) traverseNodes(fn func(hash []byte, node *Node) error) error {
+	nodes := []*Node{}
+
+	err := ndb.withSnapshot(func(r dbReader) error {
+		return traversePrefixIn(r, nodeKeyFormat.Key(), func(key, value []byte) error {
+			value, err := ndb.decryptValue(value)
+			if err != nil {
+				return err
+			}
+			node, err := MakeNode(value)
+			if err != nil {
+				return err
+			}
+			if err := nodeKeyFormat.ScanStrict(key, &node.hash); err != nil {
+				return err
+			}
+			nodes = append(nodes, node)
+			return nil
+		})
 	})
 
 	if err != nil {
@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"math/rand"
@@ -30,6 +31,66 @@ func BenchmarkOrphanKey(b *testing.B) {
 	}
 }
 
+func BenchmarkNodeDBGetNodeParallel(b *testing.B) {
+	tree, err := NewMutableTree(db.NewMemDB(), 100000)
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		tree.Set([]byte(strconv.Itoa(i)), []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+	nodes, err := tree.ndb.nodes()
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			tree.ndb.GetNode(nodes[i%len(nodes)].hash)
+			i++
+		}
+	})
+}
+
+func BenchmarkNodeDBSaveNode(b *testing.B) {
+	ndb := newNodeDB(db.NewMemDB(), 0, nil)
+	nodes := make([]*Node, b.N)
+	for i := range nodes {
+		nodes[i] = NewNode(randBytes(32), randBytes(100), 1)
+		nodes[i]._hash()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ndb.SaveNode(nodes[i])
+		if i%1000 == 999 {
+			b.StopTimer()
+			require.NoError(b, ndb.Commit())
+			b.StartTimer()
+		}
+	}
+}
+
+func BenchmarkNodeDBSaveFastNode(b *testing.B) {
+	ndb := newNodeDB(db.NewMemDB(), 0, nil)
+	nodes := make([]*FastNode, b.N)
+	for i := range nodes {
+		nodes[i] = NewFastNode(randBytes(32), randBytes(100), 1)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, ndb.SaveFastNodeNoCache(nodes[i]))
+		if i%1000 == 999 {
+			b.StopTimer()
+			require.NoError(b, ndb.Commit())
+			b.StartTimer()
+		}
+	}
+}
+
 func TestNewNoDbStorage_StorageVersionInDb_Success(t *testing.T) {
 	const expectedVersion = defaultStorageVersionValue
 
@@ -79,7 +140,9 @@ func TestSetStorageVersion_Success(t *testing.T) {
 
 	err := ndb.setFastStorageVersionToBatch()
 	require.NoError(t, err)
-	require.Equal(t, expectedVersion+fastStorageVersionDelimiter+strconv.Itoa(int(ndb.getLatestVersion())), string(ndb.getStorageVersion()))
+	latest, err := ndb.getLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, expectedVersion+fastStorageVersionDelimiter+strconv.Itoa(int(latest)), string(ndb.getStorageVersion()))
 	ndb.batch.Write()
 }
 
@@ -185,7 +248,9 @@ func TestShouldForceFastStorageUpdate_DefaultVersion_True(t *testing.T) {
 	ndb.storageVersion = defaultStorageVersionValue
 	ndb.latestVersion = 100
 
-	require.False(t, ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.False(t, shouldForce)
 }
 
 func TestShouldForceFastStorageUpdate_FastVersion_Greater_True(t *testing.T) {
@@ -194,7 +259,9 @@ func TestShouldForceFastStorageUpdate_FastVersion_Greater_True(t *testing.T) {
 	ndb.latestVersion = 100
 	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion+1))
 
-	require.True(t, ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.True(t, shouldForce)
 }
 
 func TestShouldForceFastStorageUpdate_FastVersion_Smaller_True(t *testing.T) {
@@ -203,7 +270,9 @@ func TestShouldForceFastStorageUpdate_FastVersion_Smaller_True(t *testing.T) {
 	ndb.latestVersion = 100
 	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion-1))
 
-	require.True(t, ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.True(t, shouldForce)
 }
 
 func TestShouldForceFastStorageUpdate_FastVersion_Match_False(t *testing.T) {
@@ -212,7 +281,9 @@ func TestShouldForceFastStorageUpdate_FastVersion_Match_False(t *testing.T) {
 	ndb.latestVersion = 100
 	ndb.storageVersion = fastStorageVersionValue + fastStorageVersionDelimiter + strconv.Itoa(int(ndb.latestVersion))
 
-	require.False(t, ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.False(t, shouldForce)
 }
 
 func TestIsFastStorageEnabled_True(t *testing.T) {
@@ -230,7 +301,276 @@ func TestIsFastStorageEnabled_False(t *testing.T) {
 	ndb.latestVersion = 100
 	ndb.storageVersion = defaultStorageVersionValue
 
-	require.False(t, ndb.shouldForceFastStorageUpgrade())
+	shouldForce, err := ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.False(t, shouldForce)
+}
+
+func TestSaveBranch_WriteErrorPanics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	dbMock := mock.NewMockDB(ctrl)
+	batchMock := mock.NewMockBatch(ctrl)
+
+	dbMock.EXPECT().Get(gomock.Any()).Return(nil, nil).Times(1)
+	dbMock.EXPECT().NewBatch().Return(batchMock).Times(1)
+	batchMock.EXPECT().Set(gomock.Any(), gomock.Any()).Return(errors.New("write failed")).Times(1)
+
+	tree, err := NewMutableTree(dbMock, 0)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+
+	require.PanicsWithError(t, "write failed", func() {
+		tree.ndb.SaveBranch(tree.root)
+	})
+}
+
+func TestRecoverTornCommit(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+
+	// Simulate a crash in the middle of committing the genesis version, after SaveBranch has
+	// flushed the nodes but before the root was written.
+	require.NoError(t, tree.ndb.setCommitPending(1))
+	tree.ndb.SaveBranch(tree.root)
+	require.NotZero(t, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 0, version)
+	require.Zero(t, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+	marker, err := memDB.Get(metadataKeyFormat.Key([]byte(commitPendingKey)))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+
+	// A subsequent commit must succeed and leave no marker behind.
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	marker, err = memDB.Get(metadataKeyFormat.Key([]byte(commitPendingKey)))
+	require.NoError(t, err)
+	require.Nil(t, marker)
+	require.Zero(t, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(commitPendingNodesPrefix))))
+	nodes := countPrefixKeys(t, memDB, nodeKeyFormat.Key())
+
+	// Nodes of a torn later commit are removed, while committed versions are left intact.
+	recovered, err := tree.ndb.recoverTornCommit()
+	require.NoError(t, err)
+	require.Zero(t, recovered)
+	require.NoError(t, tree.ndb.setCommitPending(2))
+	node := NewNode([]byte{0xff}, []byte{0xff}, 2)
+	node._hash()
+	tree.ndb.SaveNode(node)
+	require.NoError(t, tree.ndb.Commit())
+	require.Equal(t, nodes+1, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+
+	recovered, err = tree.ndb.recoverTornCommit()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, recovered)
+	require.Equal(t, nodes, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err = tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, []byte{5}, tree.Get([]byte{5}))
+}
+
+func TestRecoverTornCommit_OnlyListedNodes(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{MaxBatchBytes: 512})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(strconv.Itoa(i)), []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	nodes := countPrefixKeys(t, memDB, nodeKeyFormat.Key())
+
+	// Recovery must not decode other nodes, so an undecodable one doesn't get in the way.
+	require.NoError(t, memDB.Set(nodeKeyFormat.Key(bytes.Repeat([]byte{0xff}, hashSize)), []byte{0xff}))
+
+	// Simulate a crash while committing version 2, after some batches of nodes were flushed.
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(strconv.Itoa(i)), []byte{2})
+	}
+	require.NoError(t, tree.ndb.setCommitPending(2))
+	tree.ndb.SaveBranch(tree.root)
+	require.NotZero(t, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(commitPendingNodesPrefix))))
+	require.Greater(t, countPrefixKeys(t, memDB, nodeKeyFormat.Key()), nodes+1)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, nodes+1, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+	require.Zero(t, countPrefixKeys(t, memDB, metadataKeyFormat.Key([]byte(commitPendingNodesPrefix))))
+	require.Equal(t, []byte{1}, tree.Get([]byte("50")))
+}
+
+func TestRecoverTornCommit_SideData(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	orphans := countPrefixKeys(t, memDB, orphanKeyFormat.Key())
+
+	// Simulate a crash while committing version 2, after everything but the root was written.
+	tree.Set([]byte{1}, []byte{0xff})
+	tree.Remove([]byte{2})
+	require.NoError(t, tree.SetVersionMetadata(2, VersionMetadata{AppData: []byte("meta")}))
+	require.NoError(t, tree.ndb.setCommitPending(2))
+	tree.ndb.SaveBranch(tree.root)
+	require.NoError(t, tree.ndb.SaveOrphans(2, tree.orphans))
+	require.NoError(t, tree.saveFastNodeVersion())
+	require.NoError(t, tree.ndb.setVersionMetadata(2, tree.pendingMetadata))
+	require.NoError(t, tree.ndb.Commit())
+	require.Greater(t, countPrefixKeys(t, memDB, orphanKeyFormat.Key()), orphans)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Equal(t, orphans, countPrefixKeys(t, memDB, orphanKeyFormat.Key()))
+	metadata, err := tree.ndb.getVersionMetadata(2)
+	require.NoError(t, err)
+	require.Nil(t, metadata)
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	require.NoError(t, err)
+	require.False(t, shouldForce)
+
+	// The fast index was rebuilt from version 1.
+	require.Equal(t, []byte{1}, tree.Get([]byte{1}))
+	require.Equal(t, []byte{2}, tree.Get([]byte{2}))
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, itree.Get([]byte{2}))
+}
+
+// getCountingDB counts the number of reads from the database.
+type getCountingDB struct {
+	db.DB
+	gets int
+}
+
+func (d *getCountingDB) Get(key []byte) ([]byte, error) {
+	d.gets++
+	return d.DB.Get(key)
+}
+
+func TestDeleteNodesFrom_SkipsOldSubtrees(t *testing.T) {
+	countingDB := &getCountingDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTree(countingDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		tree.Set([]byte(strconv.Itoa(i)), []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	nodes := countPrefixKeys(t, countingDB, nodeKeyFormat.Key())
+	tree.Set([]byte("500"), []byte{2})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	root, err := tree.ndb.getRoot(2)
+	require.NoError(t, err)
+	countingDB.gets = 0
+	require.NoError(t, tree.ndb.deleteNodesFrom(2, root))
+	require.NoError(t, tree.ndb.Commit())
+
+	// Only the path to the changed leaf and its siblings are loaded, and only the path deleted.
+	height := int(tree.Height())
+	require.LessOrEqual(t, countingDB.gets, 2*(height+1))
+	require.Equal(t, nodes, countPrefixKeys(t, countingDB, nodeKeyFormat.Key()))
+}
+
+// batchCountingDB counts the number of batches written to the database.
+type batchCountingDB struct {
+	db.DB
+	writes int
+}
+
+func (d *batchCountingDB) NewBatch() db.Batch {
+	return &countingBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type countingBatch struct {
+	db.Batch
+	db *batchCountingDB
+}
+
+func (b *countingBatch) Write() error {
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+func (b *countingBatch) WriteSync() error {
+	b.db.writes++
+	return b.Batch.WriteSync()
+}
+
+func TestMaxBatchBytes(t *testing.T) {
+	// Build identical trees with and without a batch limit, and check that they end up with the
+	// same database contents after saving and deleting versions.
+	build := func(maxBatchBytes int) (*batchCountingDB, []byte) {
+		countingDB := &batchCountingDB{DB: db.NewMemDB()}
+		tree, err := NewMutableTreeWithOpts(countingDB, 0, &Options{MaxBatchBytes: maxBatchBytes})
+		require.NoError(t, err)
+		r := rand.New(rand.NewSource(42))
+		for v := 0; v < 10; v++ {
+			for i := 0; i < 200; i++ {
+				tree.Set([]byte(strconv.Itoa(r.Intn(1000))), []byte(strconv.Itoa(r.Int())))
+			}
+			for i := 0; i < 20; i++ {
+				tree.Remove([]byte(strconv.Itoa(r.Intn(1000))))
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersion(2))
+		require.NoError(t, tree.DeleteVersionsRange(4, 7))
+		_, err = tree.LoadVersionForOverwriting(8)
+		require.NoError(t, err)
+		return countingDB, tree.Hash()
+	}
+
+	unlimited, unlimitedHash := build(0)
+	limited, limitedHash := build(2048)
+	require.Equal(t, unlimitedHash, limitedHash)
+	require.Greater(t, limited.writes, unlimited.writes)
+
+	require.Equal(t, dumpPrefix(t, unlimited, nil), dumpPrefix(t, limited, nil))
+
+	// The limited tree is fully readable at all remaining versions.
+	tree, err := NewMutableTreeWithOpts(limited, 0, nil)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for _, v := range tree.AvailableVersions() {
+		itree, err := tree.GetImmutable(int64(v))
+		require.NoError(t, err)
+		for i := int64(0); i < itree.Size(); i++ {
+			key, _ := itree.GetByIndex(i)
+			require.NotNil(t, key)
+		}
+	}
 }
 
 func makeHashes(b *testing.B, seed int64) [][]byte {
@@ -248,3 +588,117 @@ func makeHashes(b *testing.B, seed int64) [][]byte {
 	b.StartTimer()
 	return hashes
 }
+
+func TestTraverseNodeHashes(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(strconv.Itoa(v*10+i)), []byte(strconv.Itoa(v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	type nodeInfo struct {
+		size    int
+		version int64
+	}
+	expected := map[string]nodeInfo{}
+	err = tree.ndb.traverseNodes(func(hash []byte, node *Node) error {
+		expected[string(hash)] = nodeInfo{size: node.encodedSize(), version: node.version}
+		return nil
+	})
+	require.NoError(t, err)
+
+	actual := map[string]nodeInfo{}
+	err = tree.TraverseNodeHashes(func(hash []byte, size int, version int64) error {
+		actual[string(hash)] = nodeInfo{size: size, version: version}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+}
+
+func TestNodeDB_MalformedKeys(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for v := 0; v < 3; v++ {
+		tree.Set([]byte("key"), []byte(strconv.Itoa(v)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	orphanKey := append(orphanKeyFormat.Key(int64(1), int64(1), make([]byte, hashSize)), 0xff)
+	require.NoError(t, memDB.Set(orphanKey, []byte{1}))
+	err = tree.ndb.traverseOrphans(func(k, v []byte) error { return nil })
+	require.True(t, errors.Is(err, ErrMalformedKey), "got %v", err)
+
+	require.NoError(t, memDB.Set([]byte{'r', 0, 1}, []byte{1}))
+	_, err = tree.ndb.getRoots()
+	require.True(t, errors.Is(err, ErrMalformedKey), "got %v", err)
+	_, err = tree.ndb.getPreviousVersion(1<<63 - 1)
+	require.True(t, errors.Is(err, ErrMalformedKey), "got %v", err)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.True(t, errors.Is(err, ErrMalformedKey), "got %v", err)
+}
+
+func TestNodeDB_CacheOptions(t *testing.T) {
+	ndb := newNodeDB(db.NewMemDB(), 100, &Options{FastNodeCacheSize: 10000})
+	require.Equal(t, 100, ndb.nodeCache.Size())
+	require.Equal(t, 10000, ndb.fastNodeCache.Size())
+
+	ndb = newNodeDB(db.NewMemDB(), 100, &Options{NodeCacheSize: 50, FastNodeCacheBytes: 1 << 20})
+	require.Equal(t, 50, ndb.nodeCache.Size())
+	require.Greater(t, ndb.fastNodeCache.Size(), 100)
+
+	// Nodes are evicted once the byte limit is reached.
+	ndb = newNodeDB(db.NewMemDB(), 0, &Options{NodeCacheBytes: 10 * (cacheEntryOverhead + 100)})
+	for i := 0; i < 20; i++ {
+		node := NewNode([]byte{byte(i)}, make([]byte, 32), 1)
+		node._hash()
+		ndb.cacheNode(node)
+	}
+	require.Less(t, ndb.nodeCache.Len(), 20)
+	require.Greater(t, ndb.nodeCache.Len(), 0)
+}
+
+func TestNodeDB_CachePolicy(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 100, &Options{SkipCacheOnSave: true, SkipCacheOnIterate: true})
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte("key"+strconv.Itoa(i)), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Zero(t, tree.ndb.nodeCache.Len())
+	require.Zero(t, tree.ndb.fastNodeCache.Len())
+
+	// Loading the tree caches the root, but iterating doesn't cache its descendants.
+	tree, err = NewMutableTreeWithOpts(memDB, 100, &Options{SkipCacheOnIterate: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	cached := tree.ndb.nodeCache.Len()
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	count := 0
+	for ; itr.Valid(); itr.Next() {
+		count++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 50, count)
+	require.Equal(t, cached, tree.ndb.nodeCache.Len())
+
+	// By default, iterating populates the cache.
+	tree, err = NewMutableTreeWithOpts(memDB, 100, nil)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	tree.IterateRange(nil, nil, true, func(key, value []byte) bool { return false })
+	require.Greater(t, tree.ndb.nodeCache.Len(), cached)
+}
@@ -10,6 +10,206 @@ type Options struct {
 	// this, an error is returned when loading the tree. Only used for the initial SaveVersion()
 	// call.
 	InitialVersion uint64
+
+	// NodeCacheSize and FastNodeCacheSize are the number of nodes and fast nodes to cache. If 0,
+	// the cache size given when creating the tree is used for both. Fast nodes are much smaller
+	// than nodes, so the fast node cache can usually hold far more entries.
+	NodeCacheSize     int
+	FastNodeCacheSize int
+
+	// NodeCacheBytes and FastNodeCacheBytes additionally limit the approximate memory used by the
+	// node and fast node caches, in bytes. If 0, the caches are only limited by entry count. If
+	// positive and the corresponding cache size option is 0, the cache is only limited by bytes.
+	NodeCacheBytes     int
+	FastNodeCacheBytes int
+
+	// SkipCacheOnSave doesn't add newly saved nodes and fast nodes to the caches, so that large
+	// writes such as imports and upgrades don't evict the hot working set. By default, saved nodes
+	// are cached, since recently written keys are often read again soon.
+	SkipCacheOnSave bool
+
+	// SkipCacheOnIterate doesn't add nodes loaded from disk by iterators and range traversals,
+	// e.g. Iterator(), IterateRange() and exports, to the node cache, so that large scans don't
+	// evict the hot working set. Nodes which are already cached are still used.
+	SkipCacheOnIterate bool
+
+	// IteratorPrefetch is the maximum number of nodes loaded asynchronously ahead of iterators and
+	// range traversals, e.g. Iterator(), IterateRange() and exports. The children of the subtrees
+	// next in line are loaded while the current one is traversed, overlapping disk latency during
+	// large scans. If 0, nodes are loaded when they are reached.
+	IteratorPrefetch int
+
+	// MissingKeyCacheSize is the number of keys confirmed absent from the latest saved version to
+	// cache, so that repeated Get() and Has() calls for missing keys skip the tree and database.
+	// Keys set in a new version are invalidated when it is saved. If 0, missing keys are not
+	// cached.
+	MissingKeyCacheSize int
+
+	// Pruning is the policy used to automatically delete old versions after each SaveVersion()
+	// call. If nil, no versions are deleted automatically.
+	Pruning *PruningPolicy
+
+	// Journal writes each Set() and Remove() on the working tree to a write-ahead journal in the
+	// database, so that unsaved changes are replayed when the latest version is loaded again
+	// after e.g. a crash. The journal of a version is deleted when the next version is saved.
+	// MutableTree.Merge() is not supported with a journal.
+	Journal bool
+
+	// ZeroCopyDecode decodes nodes read from the database without copying their keys, values
+	// and child hashes, aliasing the buffer returned by the database instead. This saves
+	// allocations when loading nodes, but keeps the whole buffer alive for as long as the node is
+	// cached or referenced. It must only be used with databases which return buffers that are
+	// never modified afterwards, such as goleveldb and memdb.
+	ZeroCopyDecode bool
+
+	// Encryption encrypts node and fast node values before writing them to the database, and
+	// decrypts them when reading, for deployments where the database itself can't provide
+	// encryption at rest. Each value is prefixed with the version of the key used, such that keys
+	// can be rotated without re-encrypting existing values. It must be set whenever the database
+	// is opened once values have been encrypted. If nil, values are stored in plaintext.
+	Encryption EncryptionProvider
+
+	// MaxBatchBytes is the approximate size in bytes of the keys and values in a write batch
+	// above which it is written to the database while saving or deleting versions, rather than
+	// keeping the whole batch in memory. If 0, batches are only written at the end.
+	//
+	// When saving, intermediate batches only contain nodes, and a crash before the version root
+	// is written is rolled back when the tree is next loaded. When deleting, version roots are
+	// deleted first, so an interrupted deletion can leave unreferenced nodes behind, but never a
+	// version with missing nodes.
+	MaxBatchBytes int
+
+	// RootHashIndex maintains an index from root hashes to versions, for fast lookups with
+	// MutableTree.GetVersionByRootHash.
+	RootHashIndex bool
+
+	// RankCacheSize is the number of leaf ranks (key/index pairs) of saved versions to cache, so
+	// that repeated GetWithIndex() and GetByIndex() calls, e.g. for non-membership proofs, don't
+	// have to walk the tree. If 0, ranks are not cached.
+	RankCacheSize int
+
+	// Expiry maintains an index of keys set with MutableTree.SetWithExpiry by expiry version, and
+	// removes expired keys from the working tree when saving a version, see PurgeExpired.
+	Expiry bool
+
+	// RunInvariantChecks validates the new nodes of the working tree in SaveVersion() before
+	// committing them: AVL balance, heights, subtree sizes, key order, node versions and orphans.
+	// A corrupted tree returns an error wrapping ErrInvariantViolation instead of being saved.
+	RunInvariantChecks bool
+
+	// RecoveryMode quarantines nodes which are missing from the database or can't be decoded,
+	// and returns a *NodeMissingError matching ErrNodeMissing from methods returning errors, such
+	// as LoadVersion(), GetImmutable() and proof generation, instead of panicking. Methods which
+	// don't return errors, e.g. Get(), panic with the *NodeMissingError. Quarantined nodes can be
+	// backfilled from another replica with MutableTree.RepairFromPeerNodes.
+	RecoveryMode bool
+
+	// MigrationChunkSize is the number of keys migrated per batch when upgrading the storage
+	// format of a database as it is loaded. An interrupted migration resumes from the last
+	// batch written. Defaults to 10000 if 0.
+	MigrationChunkSize int
+
+	// MigrationProgress is called after each batch written by a storage migration, if set.
+	MigrationProgress func(MigrationProgress)
+
+	// RefCountGC garbage collects nodes by persistent reference counts, updated when versions are
+	// saved and deleted, instead of orphan entries. Deleting any set of versions then only visits
+	// the nodes which are freed. Existing databases are migrated when loaded, and a database using
+	// reference counts can't be opened without this option. It can't be used with ColdTier.
+	RefCountGC bool
+
+	// ColdTier demotes nodes which are only referenced by old versions to a slower backing store,
+	// e.g. for archive nodes keeping ancient versions in cheap storage. Demoted nodes are read
+	// from the tier transparently. If nil, all nodes are kept in the database.
+	ColdTier *ColdTierOptions
+
+	// CacheAdvisor tracks the number of distinct nodes and fast nodes read per version, and
+	// recommends cache sizes within the configured bounds, see MutableTree.CacheAdvice. It can
+	// also resize the caches automatically. If nil, the advisor is disabled.
+	CacheAdvisor *CacheAdvisorOptions
+
+	// Logger receives diagnostics at debug level for individual nodes saved, orphaned, deleted
+	// and evicted from the caches, at info level for versions saved and deleted and storage
+	// migrations, and at error level for failures which are otherwise handled. If nil, nothing
+	// is logged.
+	Logger Logger
+
+	// Tracer starts a span for each call of the context-accepting tree methods, such as
+	// MutableTree.SaveVersionContext, with the number of nodes and fast nodes read and cache
+	// hits as attributes. It can be backed by an OpenTelemetry tracer. If nil, those methods
+	// are not traced.
+	Tracer Tracer
+
+	// IOThrottle limits the rate of database operations of maintenance tasks, so that they don't
+	// starve block processing: DeleteVersionsRangeContext, storage migrations, the fast storage
+	// upgrade and exports. They wait with the database unlocked. Other deletions, including the
+	// pruning run by SaveVersion, never wait, so as not to stall commits, but their work is
+	// charged to the throttled tasks. If nil, these tasks run at full speed.
+	IOThrottle *IOThrottleOptions
+
+	// KeyPrefix is prepended to all keys written to the database, so that several trees, or other
+	// data, can share a database. It is cheaper than wrapping the database in a tm-db PrefixDB,
+	// whose iterators check every key. No other key of the database may start with the prefix,
+	// and the prefix of one tree may not be a prefix of another's. The cold tier is not prefixed.
+	KeyPrefix []byte
+
+	// PrunedStubs keeps a small stub of each deleted version, with its root hash and the time it
+	// was deleted, so that requests for the version return a *VersionPrunedError matching
+	// ErrVersionPruned rather than just ErrVersionDoesNotExist. Stubs are never deleted, except
+	// those of versions rolled back by LoadVersionForOverwriting.
+	PrunedStubs bool
+
+	// RotationAudit records every rotation performed while rebalancing the working tree, for
+	// differential debugging of nodes which produced different root hashes from the same writes.
+	// See MutableTree.Rotations, MutableTree.SavedRotations and WriteRotations.
+	RotationAudit bool
+
+	// CostObserver is notified of the nodes and fast nodes read and the keys written by tree
+	// operations, e.g. to charge storage gas precisely. Writes replayed from the journal while
+	// loading the tree are reported too. If nil, nothing is reported.
+	CostObserver CostObserver
+
+	// MaxKeySize and MaxValueSize limit the size in bytes of keys and values set in the tree, to
+	// bound state growth at the storage layer. Setting a larger entry panics with an error
+	// matching ErrKeyTooLarge or ErrValueTooLarge, see MutableTree.CheckSize. Existing entries
+	// are not affected, but can be found with IterateOversized. Zero means unlimited.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// Checksums appends a CRC-32C checksum to each node and fast node value written to the
+	// database, and verifies it when reading, so that values corrupted on disk are reported with
+	// an error matching ErrChecksumMismatch where they are read, rather than as a hash mismatch
+	// later on. Like Encryption, it must be set whenever the database is opened once values have
+	// been written with it, and can't be enabled for an existing database: the database records
+	// that it uses checksums, and opening a database without them with Checksums set fails.
+	Checksums bool
+
+	// DryRun keeps all writes to the database, and to the cold tier, in memory rather than
+	// writing them, while the tree reads them back as if they were written. It is used to preview
+	// destructive operations such as DeleteVersionsRange, LoadVersionForOverwriting or the
+	// storage migrations run by Load: open a tree with it, run the operations, and inspect the
+	// changes they would write with MutableTree.DryRunReport. The database must not be written by
+	// other trees meanwhile.
+	DryRun bool
+
+	// ProtectedVersions returns true for versions which must never be deleted, e.g. the versions
+	// at the snapshot interval which state sync depends on. Deleting them, whether explicitly or
+	// by rolling back with LoadVersionForOverwriting, fails with an error matching
+	// ErrVersionProtected, while the pruning policy keeps them. If nil, no version is protected.
+	ProtectedVersions func(version int64) bool
+
+	// MinRetainVersions is the minimum number of saved versions to retain. Deletions which would
+	// leave fewer versions fail with an error matching ErrVersionProtected, while the pruning
+	// policy deletes only as many versions as it can. Zero means no minimum.
+	MinRetainVersions int64
+
+	// Retry retries database reads, writes, batch writes and iterators which fail with transient
+	// errors, e.g. RocksDB's "Resource temporarily unavailable", with exponential backoff, rather
+	// than failing the operation and possibly panicking the tree. Iterators failing while
+	// iterating are reopened after the last key returned. Retries are logged at error level. The
+	// cold tier is not retried. Backoff happens while the tree may hold its database lock, see
+	// RetryOptions.MaxTotalBackoff. If nil, errors are returned at once.
+	Retry *RetryOptions
 }
 
 // DefaultOptions returns the default options for IAVL.
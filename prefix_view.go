@@ -0,0 +1,123 @@
+package iavl
+
+import (
+	ics23 "github.com/confio/ics23/go"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// PrefixView is a view of the keys of a MutableTree's working tree with a given prefix, with the
+// prefix removed. Keys given to and returned by the view are relative to the prefix, so modules
+// can be given isolated views of a tree without copying data. Proofs are for the prefixed keys,
+// and are thus valid for the parent tree.
+type PrefixView struct {
+	tree   *MutableTree
+	prefix []byte
+	end    []byte // the end of the prefix range, nil if unbounded
+}
+
+// PrefixView returns a view of the keys with the given prefix.
+func (tree *MutableTree) PrefixView(prefix []byte) *PrefixView {
+	return &PrefixView{
+		tree:   tree,
+		prefix: cp(prefix),
+		end:    prefixEnd(prefix),
+	}
+}
+
+// Prefix returns the prefix of the view.
+func (v *PrefixView) Prefix() []byte {
+	return v.prefix
+}
+
+// key returns the key of the parent tree for the given key of the view.
+func (v *PrefixView) key(key []byte) []byte {
+	prefixed := make([]byte, 0, len(v.prefix)+len(key))
+	return append(append(prefixed, v.prefix...), key...)
+}
+
+// Get returns the value of the given key, or nil if it does not exist.
+func (v *PrefixView) Get(key []byte) []byte {
+	return v.tree.Get(v.key(key))
+}
+
+// Has returns whether or not the given key exists.
+func (v *PrefixView) Has(key []byte) bool {
+	return v.tree.Has(v.key(key))
+}
+
+// Set sets a key, see MutableTree.Set.
+func (v *PrefixView) Set(key, value []byte) (updated bool) {
+	return v.tree.Set(v.key(key), value)
+}
+
+// Remove removes a key, see MutableTree.Remove.
+func (v *PrefixView) Remove(key []byte) ([]byte, bool) {
+	return v.tree.Remove(v.key(key))
+}
+
+// Iterate iterates over all keys of the view in ascending order. Returns true if stopped by the
+// callback.
+func (v *PrefixView) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
+	return v.IterateRange(nil, nil, true, fn)
+}
+
+// IterateRange iterates over the keys of the view in the range [start, end), where nil start or
+// end means an open bound. Returns true if stopped by the callback.
+func (v *PrefixView) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool) {
+	parentStart, parentEnd := v.bounds(start, end)
+	return v.tree.IterateRange(parentStart, parentEnd, ascending, func(key, value []byte) bool {
+		return fn(key[len(v.prefix):], value)
+	})
+}
+
+// Iterator returns an iterator over the keys of the view in the range [start, end), where nil
+// start or end means an open bound.
+func (v *PrefixView) Iterator(start, end []byte, ascending bool) dbm.Iterator {
+	parentStart, parentEnd := v.bounds(start, end)
+	return &prefixViewIterator{
+		Iterator: v.tree.Iterator(parentStart, parentEnd, ascending),
+		prefix:   v.prefix,
+		start:    start,
+		end:      end,
+	}
+}
+
+// bounds returns the range of the parent tree for the range [start, end) of the view.
+func (v *PrefixView) bounds(start, end []byte) ([]byte, []byte) {
+	parentStart, parentEnd := v.key(start), v.end
+	if end != nil {
+		parentEnd = v.key(end)
+	}
+	return parentStart, parentEnd
+}
+
+// GetMembershipProof returns a proof of the membership of the key in the parent tree, see
+// ImmutableTree.GetMembershipProof.
+func (v *PrefixView) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	return v.tree.GetMembershipProof(v.key(key))
+}
+
+// GetNonMembershipProof returns a proof of the non-membership of the key in the parent tree, see
+// ImmutableTree.GetNonMembershipProof.
+func (v *PrefixView) GetNonMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	return v.tree.GetNonMembershipProof(v.key(key))
+}
+
+// prefixViewIterator strips the prefix of a view from the keys of a parent tree iterator.
+type prefixViewIterator struct {
+	dbm.Iterator
+	prefix     []byte
+	start, end []byte
+}
+
+var _ dbm.Iterator = (*prefixViewIterator)(nil)
+
+// Domain implements dbm.Iterator.
+func (i *prefixViewIterator) Domain() ([]byte, []byte) {
+	return i.start, i.end
+}
+
+// Key implements dbm.Iterator.
+func (i *prefixViewIterator) Key() []byte {
+	return i.Iterator.Key()[len(i.prefix):]
+}
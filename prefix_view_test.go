@@ -0,0 +1,81 @@
+package iavl
+
+import (
+	"testing"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestPrefixView(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{0})
+	tree.Set([]byte("bank/"), []byte{0})
+	tree.Set([]byte("bank0"), []byte{0})
+	tree.Set([]byte("c"), []byte{0})
+
+	bank := tree.PrefixView([]byte("bank/"))
+	require.False(t, bank.Set([]byte("alice"), []byte{1}))
+	require.False(t, bank.Set([]byte("bob"), []byte{2}))
+	require.False(t, bank.Set([]byte("carol"), []byte{3}))
+	require.Equal(t, []byte{2}, tree.Get([]byte("bank/bob")))
+	require.Equal(t, []byte{2}, bank.Get([]byte("bob")))
+	require.True(t, bank.Has([]byte("carol")))
+	require.False(t, bank.Has([]byte("dave")))
+	value, removed := bank.Remove([]byte("carol"))
+	require.True(t, removed)
+	require.Equal(t, []byte{3}, value)
+
+	type kv struct{ key, value string }
+	var kvs []kv
+	bank.Iterate(func(key, value []byte) bool {
+		kvs = append(kvs, kv{string(key), string(value)})
+		return false
+	})
+	require.Equal(t, []kv{{"", "\x00"}, {"alice", "\x01"}, {"bob", "\x02"}}, kvs)
+
+	kvs = nil
+	bank.IterateRange([]byte("a"), nil, false, func(key, value []byte) bool {
+		kvs = append(kvs, kv{string(key), string(value)})
+		return false
+	})
+	require.Equal(t, []kv{{"bob", "\x02"}, {"alice", "\x01"}}, kvs)
+
+	itr := bank.Iterator([]byte("alice"), []byte("bob"), true)
+	start, end := itr.Domain()
+	require.Equal(t, []byte("alice"), start)
+	require.Equal(t, []byte("bob"), end)
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, []string{"alice"}, keys)
+
+	// Proofs are valid for the prefixed keys in the parent tree.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	proof, err := bank.GetMembershipProof([]byte("bob"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ProofSpec(), tree.Hash(), proof, []byte("bank/bob"), []byte{2}))
+	proof, err = bank.GetNonMembershipProof([]byte("carol"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyNonMembership(ProofSpec(), tree.Hash(), proof, []byte("bank/carol")))
+}
+
+func TestPrefixView_MaxPrefix(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte{0xfe}, []byte{0})
+	view := tree.PrefixView([]byte{0xff})
+	view.Set([]byte{0xff}, []byte{1})
+	count := 0
+	view.Iterate(func(key, value []byte) bool {
+		require.Equal(t, []byte{0xff}, key)
+		count++
+		return false
+	})
+	require.Equal(t, 1, count)
+}
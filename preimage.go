@@ -0,0 +1,149 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Pre-images are stored by tree key, with the version which registered them followed by the
+// pre-image as value.
+var preimageKeyFormat = NewKeyFormat('p', 0) // p<key>
+
+func preimageKey(key []byte) []byte {
+	return preimageKeyFormat.KeyBytes(key)
+}
+
+// getPreimage reads the registered pre-image of a key, returning nil if there is none.
+func (ndb *nodeDB) getPreimage(key []byte) ([]byte, error) {
+	_, preimage, err := ndb.getPreimageEntry(key)
+	return preimage, err
+}
+
+// getPreimageEntry reads the registered pre-image of a key and the version which registered it,
+// returning a nil pre-image if there is none.
+func (ndb *nodeDB) getPreimageEntry(key []byte) (int64, []byte, error) {
+	bz, err := ndb.db.Get(preimageKey(key))
+	if err != nil || bz == nil {
+		return 0, nil, err
+	}
+	return decodePreimage(bz)
+}
+
+func decodePreimage(bz []byte) (int64, []byte, error) {
+	if len(bz) < int64Size {
+		return 0, nil, errors.Errorf("invalid pre-image entry of %d bytes", len(bz))
+	}
+	return int64(binary.BigEndian.Uint64(bz)), bz[int64Size:], nil
+}
+
+// deletePreimagesFrom deletes the pre-images registered by the given version and later ones.
+// This scans the whole registry, and is only used when deleting the latest versions.
+func (ndb *nodeDB) deletePreimagesFrom(version int64) error {
+	return ndb.traversePrefix(preimageKeyFormat.Key(), func(k, v []byte) error {
+		registered, _, err := decodePreimage(v)
+		if err != nil {
+			return err
+		}
+		if registered < version {
+			return nil
+		}
+		return ndb.batch.Delete(k)
+	})
+}
+
+// RegisterPreimage records the pre-image of a key, for applications using a hash of the
+// pre-image as the tree key. It is written by the next SaveVersion, to a side index which is not
+// part of the tree or its hash, and can then be resolved during iteration and export, e.g. for
+// human-readable dumps. The tree doesn't verify that the key is a hash of the pre-image.
+//
+// Pre-images are deleted with the version which registered them by DeleteVersionsFrom, e.g. when
+// loading a version for overwriting, but not by pruning: a pre-image is a property of the key
+// rather than of any version, and the key can be set again after being removed. Registering the
+// same pre-image again keeps the version which first registered it.
+func (tree *MutableTree) RegisterPreimage(key, preimage []byte) {
+	if tree.pendingPreimages == nil {
+		tree.pendingPreimages = map[string][]byte{}
+	}
+	tree.pendingPreimages[string(key)] = preimage
+}
+
+// savePreimages writes the pre-images registered since the last saved version to the batch.
+func (tree *MutableTree) savePreimages(version int64) error {
+	keys := make([]string, 0, len(tree.pendingPreimages))
+	for key := range tree.pendingPreimages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tree.ndb.mtx.Lock()
+	defer tree.ndb.mtx.Unlock()
+	for _, key := range keys {
+		preimage := tree.pendingPreimages[key]
+		_, existing, err := tree.ndb.getPreimageEntry([]byte(key))
+		if err != nil {
+			return err
+		}
+		if existing != nil && bytes.Equal(existing, preimage) {
+			continue
+		}
+		value := make([]byte, int64Size, int64Size+len(preimage))
+		binary.BigEndian.PutUint64(value, uint64(version))
+		if err := tree.ndb.batch.Set(preimageKey([]byte(key)), append(value, preimage...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Preimage returns the registered pre-image of a key, or nil if there is none.
+func (t *ImmutableTree) Preimage(key []byte) ([]byte, error) {
+	return t.ndb.getPreimage(key)
+}
+
+// Preimage returns the registered pre-image of a key, including pre-images registered since the
+// last saved version, or nil if there is none.
+func (tree *MutableTree) Preimage(key []byte) ([]byte, error) {
+	if preimage, ok := tree.pendingPreimages[string(key)]; ok {
+		return preimage, nil
+	}
+	return tree.ndb.getPreimage(key)
+}
+
+// Preimage returns the registered pre-image of an exported key, or nil if there is none, see
+// MutableTree.RegisterPreimage.
+func (e *Exporter) Preimage(key []byte) ([]byte, error) {
+	return e.tree.Preimage(key)
+}
+
+// IterateWithPreimages is like Iterate, but also passes the registered pre-image of each key to
+// fn, or nil if there is none. It returns true if stopped by fn.
+func (t *ImmutableTree) IterateWithPreimages(fn func(key, preimage, value []byte) (stop bool)) (stopped bool, err error) {
+	return iterateWithPreimages(t.Iterate, t.Preimage, fn)
+}
+
+// IterateWithPreimages is like ImmutableTree.IterateWithPreimages, but iterates over the working
+// tree.
+func (tree *MutableTree) IterateWithPreimages(fn func(key, preimage, value []byte) (stop bool)) (stopped bool, err error) {
+	return iterateWithPreimages(tree.Iterate, tree.Preimage, fn)
+}
+
+func iterateWithPreimages(
+	iterate func(func(key, value []byte) bool) bool,
+	resolve func(key []byte) ([]byte, error),
+	fn func(key, preimage, value []byte) bool,
+) (stopped bool, err error) {
+	stopped = iterate(func(key, value []byte) bool {
+		var preimage []byte
+		if preimage, err = resolve(key); err != nil {
+			return true
+		}
+		return fn(key, preimage, value)
+	})
+	if err != nil {
+		return false, err
+	}
+	return stopped, nil
+}
@@ -0,0 +1,101 @@
+package iavl
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestPreimages(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	hashed := func(preimage string) []byte {
+		hash := sha256.Sum256([]byte(preimage))
+		return hash[:]
+	}
+	for _, preimage := range []string{"alice", "bob"} {
+		tree.Set(hashed(preimage), []byte("balance of "+preimage))
+		tree.RegisterPreimage(hashed(preimage), []byte(preimage))
+	}
+	tree.Set(hashed("carol"), []byte("balance of carol"))
+
+	preimage, err := tree.Preimage(hashed("alice"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("alice"), preimage)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Pre-images are not part of the tree.
+	plain, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for _, preimage := range []string{"alice", "bob", "carol"} {
+		plain.Set(hashed(preimage), []byte("balance of "+preimage))
+	}
+	plainHash, _, err := plain.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, plainHash, hash)
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	resolved := map[string]string{}
+	stopped, err := itree.IterateWithPreimages(func(key, preimage, value []byte) bool {
+		resolved[string(value)] = string(preimage)
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.Equal(t, map[string]string{
+		"balance of alice": "alice",
+		"balance of bob":   "bob",
+		"balance of carol": "",
+	}, resolved)
+
+	exporter := itree.Export()
+	defer exporter.Close()
+	preimages := 0
+	for {
+		node, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		if node.Height == 0 {
+			preimage, err := exporter.Preimage(node.Key)
+			require.NoError(t, err)
+			if preimage != nil {
+				preimages++
+			}
+		}
+	}
+	require.Equal(t, 2, preimages)
+
+	// Rolled back registrations are discarded.
+	tree.RegisterPreimage(hashed("carol"), []byte("carol"))
+	tree.Rollback()
+	preimage, err = tree.Preimage(hashed("carol"))
+	require.NoError(t, err)
+	require.Nil(t, preimage)
+
+	// Pre-images have their own keyspace, and those registered by deleted versions are deleted,
+	// while registering a pre-image again keeps the version which first registered it.
+	tree.RegisterPreimage(hashed("alice"), []byte("alice"))
+	tree.RegisterPreimage(hashed("carol"), []byte("carol"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 3, countPrefixKeys(t, memDB, preimageKeyFormat.Key()))
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	require.Equal(t, 2, countPrefixKeys(t, memDB, preimageKeyFormat.Key()))
+	for preimage, expected := range map[string][]byte{"alice": []byte("alice"), "carol": nil} {
+		resolved, err := tree.Preimage(hashed(preimage))
+		require.NoError(t, err)
+		require.Equal(t, expected, resolved)
+	}
+}
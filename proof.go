@@ -212,7 +212,7 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, path *PathToLeaf) (*N
 		if bytes.Equal(node.key, key) {
 			return node, nil
 		}
-		return node, errors.New("key does not exist")
+		return node, ErrKeyNotFound
 	}
 
 	// Note that we do not store the left child in the ProofInnerNode when we're going to add the
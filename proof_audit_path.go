@@ -0,0 +1,136 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
+)
+
+// AuditPath is an existence proof in a flat audit path format, for verifiers which can't use
+// ics23, such as EVM contracts bridging to IAVL chains. The root is computed from the leaf up:
+//
+//	hash := sha256(LeafPrefix || uvarint(len(Key)) || Key || 0x20 || sha256(Value))
+//	for each step:
+//	    if step.SiblingLeft: hash = sha256(step.Prefix || 0x20 || step.Sibling || 0x20 || hash)
+//	    else:                hash = sha256(step.Prefix || 0x20 || hash || 0x20 || step.Sibling)
+//
+// and must equal the root hash of the tree. To tell leaves and inner nodes apart, verifiers must
+// also check that LeafPrefix starts with 0x00 (a height of 0) and that no step prefix does. See
+// AuditPath.Verify for a reference verifier.
+type AuditPath struct {
+	Key        []byte
+	Value      []byte
+	LeafPrefix []byte      // the varint-encoded height, size and version of the leaf node
+	Steps      []AuditStep // inner nodes from the leaf up to the root
+}
+
+// AuditStep is an inner node of an AuditPath.
+type AuditStep struct {
+	Prefix      []byte // the varint-encoded height, size and version of the inner node
+	Sibling     []byte // the hash of the other child of the inner node
+	SiblingLeft bool   // whether the sibling is the left child of the inner node
+}
+
+// GetAuditPath returns an audit path proving the existence of the given key.
+func (t *ImmutableTree) GetAuditPath(key []byte) (*AuditPath, error) {
+	if t.root == nil {
+		return nil, ErrEmptyTree
+	}
+	proof, err := createExistenceProof(t, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditPath(proof)
+}
+
+// NewAuditPath converts an ics23 existence proof of an IAVL tree to an audit path.
+func NewAuditPath(proof *ics23.ExistenceProof) (*AuditPath, error) {
+	if proof == nil || proof.Leaf == nil {
+		return nil, errors.Wrap(ErrInvalidProof, "missing leaf")
+	}
+	if err := proof.CheckAgainstSpec(ProofSpec()); err != nil {
+		return nil, errors.Wrapf(ErrInvalidProof, "%v", err)
+	}
+
+	const childSize = sha256.Size + 1 // length-prefixed child hash
+	path := &AuditPath{
+		Key:        proof.Key,
+		Value:      proof.Value,
+		LeafPrefix: proof.Leaf.Prefix,
+		Steps:      make([]AuditStep, 0, len(proof.Path)),
+	}
+	for i, op := range proof.Path {
+		var step AuditStep
+		switch {
+		case len(op.Suffix) == childSize && len(op.Prefix) > 1:
+			// The child is on the left: prefix || 0x20 || child || 0x20 || sibling
+			step.Prefix = op.Prefix[:len(op.Prefix)-1]
+			step.Sibling = op.Suffix[1:]
+		case len(op.Suffix) == 0 && len(op.Prefix) > childSize+1:
+			// The child is on the right: prefix || 0x20 || sibling || 0x20 || child
+			step.Prefix = op.Prefix[:len(op.Prefix)-childSize-1]
+			step.Sibling = op.Prefix[len(op.Prefix)-childSize : len(op.Prefix)-1]
+			step.SiblingLeft = true
+		default:
+			return nil, errors.Wrapf(ErrInvalidProof, "unexpected inner op %v", i)
+		}
+		path.Steps = append(path.Steps, step)
+	}
+	return path, nil
+}
+
+// ComputeRoot computes the root hash of the audit path.
+func (p *AuditPath) ComputeRoot() ([]byte, error) {
+	if len(p.LeafPrefix) == 0 || p.LeafPrefix[0] != 0 {
+		return nil, errors.Wrap(ErrInvalidProof, "leaf prefix must start with a height of 0")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(p.LeafPrefix)
+	if err := encodeBytes(&buf, p.Key); err != nil {
+		return nil, err
+	}
+	valueHash := sha256.Sum256(p.Value)
+	if err := encodeBytes(&buf, valueHash[:]); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(buf.Bytes())
+
+	for _, step := range p.Steps {
+		if len(step.Prefix) == 0 || step.Prefix[0] == 0 {
+			return nil, errors.Wrap(ErrInvalidProof, "inner node prefix must start with a non-zero height")
+		}
+		if len(step.Sibling) != sha256.Size {
+			return nil, errors.Wrapf(ErrInvalidProof, "sibling hash has %v bytes", len(step.Sibling))
+		}
+		buf.Reset()
+		buf.Write(step.Prefix)
+		left, right := hash[:], step.Sibling
+		if step.SiblingLeft {
+			left, right = right, left
+		}
+		if err := encodeBytes(&buf, left); err != nil {
+			return nil, err
+		}
+		if err := encodeBytes(&buf, right); err != nil {
+			return nil, err
+		}
+		hash = sha256.Sum256(buf.Bytes())
+	}
+	return hash[:], nil
+}
+
+// Verify verifies that the audit path proves the existence of its key and value in the tree with
+// the given root hash.
+func (p *AuditPath) Verify(root []byte) error {
+	computed, err := p.ComputeRoot()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return errors.Wrapf(ErrInvalidRoot, "computed %X, expected %X", computed, root)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditPath(t *testing.T) {
+	tree, keys, err := BuildTree(500, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	for _, loc := range []Where{Left, Middle, Right} {
+		key := GetKey(keys, loc)
+		path, err := tree.GetAuditPath(key)
+		require.NoError(t, err)
+		require.Equal(t, key, path.Key)
+		require.Equal(t, tree.Get(key), path.Value)
+		require.NoError(t, path.Verify(root))
+
+		// Tampering with the value or any sibling must fail verification.
+		tampered := *path
+		tampered.Value = []byte("tampered")
+		require.True(t, errors.Is(tampered.Verify(root), ErrInvalidRoot))
+
+		tampered = *path
+		tampered.Steps = append([]AuditStep(nil), path.Steps...)
+		tampered.Steps[0].SiblingLeft = !tampered.Steps[0].SiblingLeft
+		require.True(t, errors.Is(tampered.Verify(root), ErrInvalidRoot))
+
+		// An inner node can't pass as a leaf.
+		tampered = *path
+		tampered.LeafPrefix = path.Steps[0].Prefix
+		require.True(t, errors.Is(tampered.Verify(root), ErrInvalidProof))
+	}
+
+	_, err = tree.GetAuditPath([]byte("missing"))
+	require.Error(t, err)
+}
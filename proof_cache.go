@@ -0,0 +1,72 @@
+package iavl
+
+import (
+	"sync"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
+)
+
+// proofCacheSize is the number of existence proofs cached by a nodeDB.
+const proofCacheSize = 1024
+
+// pathPool pools the paths built while creating existence proofs, which are discarded once
+// converted to ics23 inner ops.
+var pathPool = sync.Pool{
+	New: func() interface{} { return new(PathToLeaf) },
+}
+
+// proofCacheKey returns the cache key of the existence proof of a key in a saved version.
+func proofCacheKey(version int64, key []byte) []byte {
+	return append(formatUint64(uint64(version)), key...)
+}
+
+// invalidateProofCache drops the cached existence proofs of the given version, which is about to
+// be saved, in case the version number was used by versions since deleted.
+func (ndb *nodeDB) invalidateProofCache(version int64) {
+	prefix := string(formatUint64(uint64(version)))
+	ndb.proofCache.RemoveIf(func(key string, _ interface{}) bool {
+		return key[:len(prefix)] == prefix
+	})
+}
+
+// createExistenceProof returns an existence proof of the given key. Proofs of saved versions are
+// cached by version and key, since the contents of a saved version never change. Proofs of the
+// unsaved working tree are not, since its version number doesn't identify its contents. The
+// returned proof must not be modified.
+func createExistenceProof(tree *ImmutableTree, key []byte) (*ics23.ExistenceProof, error) {
+	if tree.root == nil {
+		return nil, errors.Wrap(ErrKeyNotFound, "cannot create ExistanceProof when Key not in State")
+	}
+
+	var cacheKey []byte
+	if tree.ndb != nil && tree.root.persisted {
+		cacheKey = proofCacheKey(tree.version, key)
+		if proof, ok := tree.ndb.proofCache.Get(cacheKey); ok {
+			return proof.(*ics23.ExistenceProof), nil
+		}
+	}
+
+	tree.root.hashWithCount() // Ensure that all hashes are calculated.
+
+	path := pathPool.Get().(*PathToLeaf)
+	defer func() {
+		*path = (*path)[:0]
+		pathPool.Put(path)
+	}()
+	leaf, err := tree.root.pathToLeaf(tree, key, path)
+	if err != nil {
+		return nil, errors.Wrap(ErrKeyNotFound, "cannot create ExistanceProof when Key not in State")
+	}
+
+	proof := &ics23.ExistenceProof{
+		Key:   leaf.key,
+		Value: leaf.value,
+		Leaf:  convertLeafOp(leaf.version),
+		Path:  convertInnerOps(*path),
+	}
+	if cacheKey != nil {
+		tree.ndb.proofCache.Add(cacheKey, proof)
+	}
+	return proof, nil
+}
@@ -4,20 +4,100 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
 )
 
+// ErrEmptyTree is returned when creating a proof for an empty tree. The root hash of an empty tree
+// is not derived from any leaf, so no ics23 proof can be verified against it.
+var ErrEmptyTree = errors.New("cannot create proofs for an empty tree")
+
+// ProofSpec returns the ics23 proof spec satisfied by the membership and non-membership proofs
+// of this package, derived from how nodes are hashed, see Node.writeHashBytes. Unlike
+// ics23.IavlSpec, which only allows for inner node prefixes of up to 12 bytes, it covers the full
+// range of node heights, sizes and versions, so proofs for large trees and versions verify. Forged
+// proofs are still rejected, since leaf prefixes (height 0) never match inner node prefixes.
+func ProofSpec() *ics23.ProofSpec {
+	// An inner node is hashed as its height, size and version, followed by the length-prefixed
+	// hashes of its children. The prefix of an inner op is thus the varint fields and a length
+	// byte, plus the left child when proving the right one, which ics23 accounts for via the
+	// child size.
+	minPrefixLength := encodeVarintSize(1) + encodeVarintSize(2) + encodeVarintSize(1) + 1
+	maxPrefixLength := encodeVarintSize(math.MaxInt8) + encodeVarintSize(math.MaxInt64) +
+		encodeVarintSize(math.MaxInt64) + 1
+
+	var varintBuf [binary.MaxVarintLen64]byte
+	return &ics23.ProofSpec{
+		LeafSpec: &ics23.LeafOp{
+			Hash:         ics23.HashOp_SHA256,
+			PrehashValue: ics23.HashOp_SHA256,
+			Length:       ics23.LengthOp_VAR_PROTO,
+			Prefix:       convertVarIntToBytes(0, varintBuf), // leaf nodes have height 0
+		},
+		InnerSpec: &ics23.InnerSpec{
+			ChildOrder:      []int32{0, 1},
+			MinPrefixLength: int32(minPrefixLength),
+			MaxPrefixLength: int32(maxPrefixLength),
+			ChildSize:       hashSize + 1,
+			Hash:            ics23.HashOp_SHA256,
+		},
+	}
+}
+
+// VerifyMembership verifies a serialized ics23 CommitmentProof, as returned by
+// GetMembershipProof and marshaled with its Marshal method, that key is set to value in the tree
+// with the given root hash. Batch proofs are accepted too. It returns ErrInvalidProof if the
+// proof doesn't verify.
+func VerifyMembership(root, key, value, proofBytes []byte) error {
+	proof, err := unmarshalCommitmentProof(proofBytes)
+	if err != nil {
+		return err
+	}
+	if !ics23.VerifyMembership(ProofSpec(), root, proof, key, value) {
+		return errors.Wrapf(ErrInvalidProof, "membership of key %X", key)
+	}
+	return nil
+}
+
+// VerifyNonMembership verifies a serialized ics23 CommitmentProof, as returned by
+// GetNonMembershipProof and marshaled with its Marshal method, that key is not set in the tree
+// with the given root hash. Batch proofs are accepted too. It returns ErrInvalidProof if the
+// proof doesn't verify.
+func VerifyNonMembership(root, key, proofBytes []byte) error {
+	proof, err := unmarshalCommitmentProof(proofBytes)
+	if err != nil {
+		return err
+	}
+	if !ics23.VerifyNonMembership(ProofSpec(), root, proof, key) {
+		return errors.Wrapf(ErrInvalidProof, "non-membership of key %X", key)
+	}
+	return nil
+}
+
+func unmarshalCommitmentProof(bz []byte) (*ics23.CommitmentProof, error) {
+	proof := &ics23.CommitmentProof{}
+	if err := proof.Unmarshal(bz); err != nil {
+		return nil, errors.Wrapf(ErrInvalidProof, "decoding proof: %v", err)
+	}
+	return proof, nil
+}
+
 /*
 GetMembershipProof will produce a CommitmentProof that the given key (and queries value) exists in the iavl tree.
 If the key doesn't exist in the tree, this will return an error.
 */
-func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+func (t *ImmutableTree) GetMembershipProof(key []byte) (proof *ics23.CommitmentProof, err error) {
+	defer recoverNodeMissing(&err)
+	if t.root == nil {
+		return nil, ErrEmptyTree
+	}
 	exist, err := createExistenceProof(t, key)
 	if err != nil {
 		return nil, err
 	}
-	proof := &ics23.CommitmentProof{
+	proof = &ics23.CommitmentProof{
 		Proof: &ics23.CommitmentProof_Exist{
 			Exist: exist,
 		},
@@ -30,6 +110,10 @@ GetNonMembershipProof will produce a CommitmentProof that the given key doesn't
 If the key exists in the tree, this will return an error.
 */
 func (t *ImmutableTree) GetNonMembershipProof(key []byte) (proof *ics23.CommitmentProof, err error) {
+	defer recoverNodeMissing(&err)
+	if t.root == nil {
+		return nil, ErrEmptyTree
+	}
 	var nonexist *ics23.NonExistenceProof
 	// TODO: to investigate more and potentially enable fast storage
 	// introduced in: https://github.com/osmosis-labs/iavl/pull/12
@@ -52,6 +136,123 @@ func (t *ImmutableTree) GetNonMembershipProof(key []byte) (proof *ics23.Commitme
 	return proof, nil
 }
 
+// FirstKeyWithProof returns the smallest key of the tree and its value, along with a membership
+// proof of the key. Verifiers can check that the key is the smallest one with ics23.IsLeftMost on
+// the proof path.
+func (t *ImmutableTree) FirstKeyWithProof() ([]byte, []byte, *ics23.CommitmentProof, error) {
+	key, value := t.FirstKey()
+	if key == nil {
+		return nil, nil, nil, ErrEmptyTree
+	}
+	proof, err := t.GetMembershipProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, value, proof, nil
+}
+
+// LastKeyWithProof returns the largest key of the tree and its value, along with a membership
+// proof of the key. Verifiers can check that the key is the largest one with ics23.IsRightMost on
+// the proof path.
+func (t *ImmutableTree) LastKeyWithProof() ([]byte, []byte, *ics23.CommitmentProof, error) {
+	key, value := t.LastKey()
+	if key == nil {
+		return nil, nil, nil, ErrEmptyTree
+	}
+	proof, err := t.GetMembershipProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, value, proof, nil
+}
+
+// FloorWithProof returns the same as Floor, along with a proof of the given key: a membership
+// proof if it exists, or otherwise a non-membership proof whose left neighbor proves the floor,
+// or has no left neighbor if there is no floor.
+func (t *ImmutableTree) FloorWithProof(key []byte) ([]byte, []byte, *ics23.CommitmentProof, error) {
+	if t.root == nil {
+		return nil, nil, nil, ErrEmptyTree
+	}
+	floorKey, floorValue := t.Floor(key)
+	_, proof, err := t.getKeyProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return floorKey, floorValue, proof, nil
+}
+
+// CeilingWithProof returns the same as Ceiling, along with a proof of the given key: a membership
+// proof if it exists, or otherwise a non-membership proof whose right neighbor proves the
+// ceiling, or has no right neighbor if there is no ceiling.
+func (t *ImmutableTree) CeilingWithProof(key []byte) ([]byte, []byte, *ics23.CommitmentProof, error) {
+	if t.root == nil {
+		return nil, nil, nil, ErrEmptyTree
+	}
+	ceilingKey, ceilingValue := t.Ceiling(key)
+	_, proof, err := t.getKeyProof(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return ceilingKey, ceilingValue, proof, nil
+}
+
+// GetWithProofBatch returns the values of the given keys at the specified version, along with a
+// single compressed ics23 batch proof of their membership (or non-membership for missing keys,
+// which have a nil value). The version is loaded once for all keys.
+func (tree *MutableTree) GetWithProofBatch(version int64, keys [][]byte) ([][]byte, *ics23.CommitmentProof, error) {
+	if !tree.VersionExists(version) {
+		return nil, nil, tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version))
+	}
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.getWithProofBatch(keys)
+}
+
+func (t *ImmutableTree) getWithProofBatch(keys [][]byte) ([][]byte, *ics23.CommitmentProof, error) {
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys given")
+	}
+	if t.root == nil {
+		return nil, nil, ErrEmptyTree
+	}
+
+	values := make([][]byte, len(keys))
+	proofs := make([]*ics23.CommitmentProof, len(keys))
+	for i, key := range keys {
+		value, proof, err := t.getKeyProof(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[i], proofs[i] = value, proof
+	}
+
+	proof, err := ics23.CombineProofs(proofs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to combine proofs")
+	}
+	return values, proof, nil
+}
+
+// getKeyProof returns the value of the given key along with a proof of its membership, or nil and
+// a proof of its non-membership if the key doesn't exist.
+func (t *ImmutableTree) getKeyProof(key []byte) ([]byte, *ics23.CommitmentProof, error) {
+	_, value := t.GetWithIndex(key)
+	if value != nil {
+		exist, err := createExistenceProof(t, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		return value, &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: exist}}, nil
+	}
+	nonexist, err := t.getNonMembershipProof(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Nonexist{Nonexist: nonexist}}, nil
+}
+
 // getNonMembershipProof using regular strategy
 // invariant: fast storage is enabled
 func (t *ImmutableTree) getNonMembershipProof(key []byte) (*ics23.NonExistenceProof, error) {
@@ -136,17 +337,6 @@ func (t *ImmutableTree) getNonMembershipProofFast(key []byte) (*ics23.NonExisten
 	return nonexist, nil
 }
 
-func createExistenceProof(tree *ImmutableTree, key []byte) (*ics23.ExistenceProof, error) {
-	value, proof, err := tree.GetWithProof(key)
-	if err != nil {
-		return nil, err
-	}
-	if value == nil {
-		return nil, fmt.Errorf("cannot create ExistanceProof when Key not in State")
-	}
-	return convertExistenceProof(proof, key, value)
-}
-
 // convertExistenceProof will convert the given proof into a valid
 // existence proof, if that's what it is.
 //
@@ -183,42 +373,46 @@ func convertLeafOp(version int64) *ics23.LeafOp {
 func convertInnerOps(path PathToLeaf) []*ics23.InnerOp {
 	steps := make([]*ics23.InnerOp, 0, len(path))
 
+	// we need to go in reverse order, iavl starts from root to leaf,
+	// we want to go up from the leaf to the root
+	for i := len(path) - 1; i >= 0; i-- {
+		steps = append(steps, convertInnerOp(path[i]))
+	}
+	return steps
+}
+
+// convertInnerOp converts a single inner node of a path into an ics23 InnerOp.
+func convertInnerOp(pin ProofInnerNode) *ics23.InnerOp {
 	// lengthByte is the length prefix prepended to each of the sha256 sub-hashes
 	var lengthByte byte = 0x20
 
 	var varintBuf [binary.MaxVarintLen64]byte
 
-	// we need to go in reverse order, iavl starts from root to leaf,
-	// we want to go up from the leaf to the root
-	for i := len(path) - 1; i >= 0; i-- {
-		// this is adapted from iavl/proof.go:proofInnerNode.Hash()
-		prefix := convertVarIntToBytes(int64(path[i].Height), varintBuf)
-		prefix = append(prefix, convertVarIntToBytes(path[i].Size, varintBuf)...)
-		prefix = append(prefix, convertVarIntToBytes(path[i].Version, varintBuf)...)
-
-		var suffix []byte
-		if len(path[i].Left) > 0 {
-			// length prefixed left side
-			prefix = append(prefix, lengthByte)
-			prefix = append(prefix, path[i].Left...)
-			// prepend the length prefix for child
-			prefix = append(prefix, lengthByte)
-		} else {
-			// prepend the length prefix for child
-			prefix = append(prefix, lengthByte)
-			// length-prefixed right side
-			suffix = []byte{lengthByte}
-			suffix = append(suffix, path[i].Right...)
-		}
+	// this is adapted from iavl/proof.go:proofInnerNode.Hash()
+	prefix := convertVarIntToBytes(int64(pin.Height), varintBuf)
+	prefix = append(prefix, convertVarIntToBytes(pin.Size, varintBuf)...)
+	prefix = append(prefix, convertVarIntToBytes(pin.Version, varintBuf)...)
 
-		op := &ics23.InnerOp{
-			Hash:   ics23.HashOp_SHA256,
-			Prefix: prefix,
-			Suffix: suffix,
-		}
-		steps = append(steps, op)
+	var suffix []byte
+	if len(pin.Left) > 0 {
+		// length prefixed left side
+		prefix = append(prefix, lengthByte)
+		prefix = append(prefix, pin.Left...)
+		// prepend the length prefix for child
+		prefix = append(prefix, lengthByte)
+	} else {
+		// prepend the length prefix for child
+		prefix = append(prefix, lengthByte)
+		// length-prefixed right side
+		suffix = []byte{lengthByte}
+		suffix = append(suffix, pin.Right...)
+	}
+
+	return &ics23.InnerOp{
+		Hash:   ics23.HashOp_SHA256,
+		Prefix: prefix,
+		Suffix: suffix,
 	}
-	return steps
 }
 
 func convertVarIntToBytes(orig int64, buf [binary.MaxVarintLen64]byte) []byte {
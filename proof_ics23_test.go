@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 
 	db "github.com/tendermint/tm-db"
@@ -50,11 +51,9 @@ func TestGetMembership(t *testing.T) {
 			proof, err := tree.GetMembershipProof(key)
 			require.NoError(t, err, "Creating Proof: %+v", err)
 
-			root := tree.Hash()
+			root := tree.WorkingHash()
 			valid := ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val)
-			if !valid {
-				require.NoError(t, err, "Membership Proof Invalid")
-			}
+			require.True(t, valid, "Membership Proof Invalid")
 		})
 	}
 }
@@ -72,17 +71,15 @@ func TestGetNonMembership(t *testing.T) {
 		"big right":    {size: 5431, loc: Right},
 	}
 
-	performTest := func(tree *MutableTree, allKeys [][]byte, loc Where) {
+	performTest := func(t *testing.T, tree *MutableTree, allKeys [][]byte, loc Where) {
 		key := GetNonKey(allKeys, loc)
 
 		proof, err := tree.GetNonMembershipProof(key)
 		require.NoError(t, err, "Creating Proof: %+v", err)
 
-		root := tree.Hash()
+		root := tree.WorkingHash()
 		valid := ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key)
-		if !valid {
-			require.NoError(t, err, "Non Membership Proof Invalid")
-		}
+		require.True(t, valid, "Non Membership Proof Invalid")
 	}
 
 	for name, tc := range cases {
@@ -96,7 +93,7 @@ func TestGetNonMembership(t *testing.T) {
 
 			require.True(t, tree.IsFastCacheEnabled())
 
-			performTest(tree, allkeys, tc.loc)
+			performTest(t, tree, allkeys, tc.loc)
 		})
 
 		t.Run("regular-"+name, func(t *testing.T) {
@@ -104,9 +101,152 @@ func TestGetNonMembership(t *testing.T) {
 			require.NoError(t, err, "Creating tree: %+v", err)
 			require.False(t, tree.IsFastCacheEnabled())
 
-			performTest(tree, allkeys, tc.loc)
+			performTest(t, tree, allkeys, tc.loc)
+		})
+	}
+}
+
+func TestGetProofs_EmptyTree(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.GetMembershipProof([]byte("a"))
+	require.Equal(t, ErrEmptyTree, err)
+	_, err = tree.GetNonMembershipProof([]byte("a"))
+	require.Equal(t, ErrEmptyTree, err)
+}
+
+// TestGetProofs_Random checks that proofs verify for random small trees, where most keys are
+// at or beyond the ends of the tree, both before and after saving.
+func TestGetProofs_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randKey := func() []byte {
+		key := make([]byte, 1+r.Intn(2))
+		r.Read(key)
+		return key
+	}
+
+	for i := 0; i < 200; i++ {
+		tree, err := NewMutableTree(db.NewMemDB(), 0)
+		require.NoError(t, err)
+		size := 1 + r.Intn(20)
+		for tree.Size() < int64(size) {
+			tree.Set(randKey(), []byte{byte(i)})
+		}
+		if i%2 == 0 {
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		root := tree.WorkingHash()
+
+		for j := 0; j < 20; j++ {
+			key := randKey()
+			if value := tree.Get(key); value != nil {
+				proof, err := tree.GetMembershipProof(key)
+				require.NoError(t, err)
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value),
+					"size %v key %X", size, key)
+				_, err = tree.GetNonMembershipProof(key)
+				require.Error(t, err)
+			} else {
+				proof, err := tree.GetNonMembershipProof(key)
+				require.NoError(t, err)
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key),
+					"size %v key %X", size, key)
+				_, err = tree.GetMembershipProof(key)
+				require.Error(t, err)
+			}
+		}
+	}
+}
+
+func TestIterateWithProofs(t *testing.T) {
+	tree, allkeys, err := BuildTree(500, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	cases := map[string]struct {
+		start, end []byte
+	}{
+		"full":       {nil, nil},
+		"open start": {nil, allkeys[100]},
+		"open end":   {allkeys[400], nil},
+		"bounded":    {allkeys[10], allkeys[250]},
+		"missing":    {GetNonKey(allkeys, Middle), GetNonKey(allkeys, Right)},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			expected := [][]byte{}
+			tree.IterateRange(tc.start, tc.end, true, func(key, value []byte) bool {
+				expected = append(expected, key)
+				return false
+			})
+
+			keys := [][]byte{}
+			stopped := tree.IterateWithProofs(tc.start, tc.end, func(key, value []byte, proof *ics23.CommitmentProof) bool {
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value),
+					"invalid proof for key %X", key)
+				keys = append(keys, key)
+				return false
+			})
+			require.False(t, stopped)
+			require.Equal(t, expected, keys)
 		})
 	}
+
+	count := 0
+	stopped := tree.IterateWithProofs(nil, nil, func(key, value []byte, proof *ics23.CommitmentProof) bool {
+		count++
+		return count == 3
+	})
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestGetWithProofBatch(t *testing.T) {
+	tree, allkeys, err := BuildTree(300, 0)
+	require.NoError(t, err)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	// Change the tree afterwards, proofs must be for the requested version.
+	tree.Set(allkeys[10], []byte("changed"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	existing := [][]byte{allkeys[0], allkeys[10], allkeys[150], allkeys[299]}
+	missing := [][]byte{GetNonKey(allkeys, Left), GetNonKey(allkeys, Middle), GetNonKey(allkeys, Right)}
+	keys := append(append([][]byte{}, existing...), missing...)
+
+	values, proof, err := tree.GetWithProofBatch(version, keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+	require.True(t, ics23.IsCompressed(proof))
+
+	items := map[string][]byte{}
+	for i, key := range existing {
+		require.Equal(t, []byte("value_for_key:"+string(key)), values[i])
+		items[string(key)] = values[i]
+	}
+	for i := range missing {
+		require.Nil(t, values[len(existing)+i])
+	}
+	require.True(t, ics23.BatchVerifyMembership(ics23.IavlSpec, root, proof, items))
+	require.True(t, ics23.BatchVerifyNonMembership(ics23.IavlSpec, root, proof, missing))
+	require.False(t, ics23.BatchVerifyMembership(ics23.IavlSpec, tree.Hash(), proof, items))
+
+	_, _, err = tree.GetWithProofBatch(version+5, keys)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.Contains(t, err.Error(), fmt.Sprintf("version %d", version+5))
+	_, _, err = tree.GetWithProofBatch(version, nil)
+	require.Error(t, err)
 }
 
 func BenchmarkGetNonMembership(b *testing.B) {
@@ -278,3 +418,198 @@ func BuildTree(size int, cacheSize int) (itree *MutableTree, keys [][]byte, err
 
 	return tree, keys, nil
 }
+
+func TestProofSpec(t *testing.T) {
+	spec := ProofSpec()
+	require.Equal(t, ics23.IavlSpec.LeafSpec, spec.LeafSpec)
+	require.Equal(t, ics23.IavlSpec.InnerSpec.MinPrefixLength, spec.InnerSpec.MinPrefixLength)
+	require.Greater(t, spec.InnerSpec.MaxPrefixLength, ics23.IavlSpec.InnerSpec.MaxPrefixLength)
+
+	// Proofs of small trees also satisfy ics23.IavlSpec.
+	small, keys, err := BuildTree(100, 0)
+	require.NoError(t, err)
+	_, _, err = small.SaveVersion()
+	require.NoError(t, err)
+	key := GetKey(keys, Middle)
+	proof, err := small.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(spec, small.Hash(), proof, key, small.Get(key)))
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, small.Hash(), proof, key, small.Get(key)))
+
+	// With large versions, inner node prefixes exceed the maximum length of ics23.IavlSpec, but
+	// not of the spec.
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{InitialVersion: 1 << 60})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	key = []byte{50}
+	proof, err = tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(spec, root, proof, key, key))
+	require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, key))
+	proofBytes, err := proof.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, VerifyMembership(root, key, key, proofBytes))
+}
+
+func TestVerifyMembership(t *testing.T) {
+	tree, keys, err := BuildTree(100, 0)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	key := GetKey(keys, Middle)
+	value := tree.Get(key)
+	proof, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	proofBytes, err := proof.Marshal()
+	require.NoError(t, err)
+
+	require.NoError(t, VerifyMembership(root, key, value, proofBytes))
+	err = VerifyMembership(root, key, []byte("other"), proofBytes)
+	require.True(t, errors.Is(err, ErrInvalidProof))
+	err = VerifyNonMembership(root, key, proofBytes)
+	require.True(t, errors.Is(err, ErrInvalidProof))
+	err = VerifyMembership(root, key, value, []byte("garbage"))
+	require.True(t, errors.Is(err, ErrInvalidProof))
+
+	missing := GetNonKey(keys, Right)
+	proof, err = tree.GetNonMembershipProof(missing)
+	require.NoError(t, err)
+	proofBytes, err = proof.Marshal()
+	require.NoError(t, err)
+
+	require.NoError(t, VerifyNonMembership(root, missing, proofBytes))
+	err = VerifyNonMembership(root, key, proofBytes)
+	require.True(t, errors.Is(err, ErrInvalidProof))
+
+	// Batch proofs are verified too.
+	_, proof, err = tree.GetWithProofBatch(tree.Version(), [][]byte{key, missing})
+	require.NoError(t, err)
+	proofBytes, err = proof.Marshal()
+	require.NoError(t, err)
+	require.NoError(t, VerifyMembership(root, key, value, proofBytes))
+	require.NoError(t, VerifyNonMembership(root, missing, proofBytes))
+}
+
+func TestExistenceProofCache(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	key := []byte{5}
+	proof1, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	proof2, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.Same(t, proof1.GetExist(), proof2.GetExist())
+
+	// Proofs of the working tree are not cached, since it has the version of the saved tree.
+	tree.Set(key, []byte{2})
+	proof3, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, proof3.GetExist().Value)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tree.WorkingHash(), proof3, key, []byte{2}))
+
+	// Saving a version number again invalidates its cached proofs.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	proof4, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	tree.Set(key, []byte{3})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	proof5, err := tree.GetMembershipProof(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, proof4.GetExist().Value)
+	require.Equal(t, []byte{3}, proof5.GetExist().Value)
+	require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tree.Hash(), proof5, key, []byte{3}))
+}
+
+func BenchmarkGetMembershipProof(b *testing.B) {
+	tree, keys, err := BuildTree(10000, 10000)
+	require.NoError(b, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := tree.GetMembershipProof(keys[i%len(keys)])
+		require.NoError(b, err)
+	}
+}
+
+func TestFloorCeilingWithProof(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, _, _, err = tree.FirstKeyWithProof()
+	require.Equal(t, ErrEmptyTree, err)
+	_, _, _, err = tree.FloorWithProof([]byte("a"))
+	require.Equal(t, ErrEmptyTree, err)
+
+	for _, key := range []string{"b", "d", "f", "h"} {
+		tree.Set([]byte(key), []byte(key))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+	spec := ProofSpec()
+
+	key, value, proof, err := tree.FirstKeyWithProof()
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), key)
+	require.True(t, ics23.VerifyMembership(spec, root, proof, key, value))
+	require.True(t, ics23.IsLeftMost(spec.InnerSpec, proof.GetExist().Path))
+
+	key, value, proof, err = tree.LastKeyWithProof()
+	require.NoError(t, err)
+	require.Equal(t, []byte("h"), key)
+	require.True(t, ics23.VerifyMembership(spec, root, proof, key, value))
+	require.True(t, ics23.IsRightMost(spec.InnerSpec, proof.GetExist().Path))
+
+	// An existing key is its own floor and ceiling.
+	key, _, proof, err = tree.FloorWithProof([]byte("d"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), key)
+	require.True(t, ics23.VerifyMembership(spec, root, proof, key, key))
+
+	// Otherwise, the neighbors of the non-membership proof are the floor and ceiling.
+	key, _, proof, err = tree.FloorWithProof([]byte("e"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("d"), key)
+	require.True(t, ics23.VerifyNonMembership(spec, root, proof, []byte("e")))
+	require.Equal(t, key, proof.GetNonexist().Left.Key)
+
+	key, _, proof, err = tree.CeilingWithProof([]byte("e"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("f"), key)
+	require.True(t, ics23.VerifyNonMembership(spec, root, proof, []byte("e")))
+	require.Equal(t, key, proof.GetNonexist().Right.Key)
+
+	key, _, proof, err = tree.FloorWithProof([]byte("a"))
+	require.NoError(t, err)
+	require.Nil(t, key)
+	require.True(t, ics23.VerifyNonMembership(spec, root, proof, []byte("a")))
+	require.Nil(t, proof.GetNonexist().Left)
+
+	key, _, proof, err = tree.CeilingWithProof([]byte("i"))
+	require.NoError(t, err)
+	require.Nil(t, key)
+	require.True(t, ics23.VerifyNonMembership(spec, root, proof, []byte("i")))
+	require.Nil(t, proof.GetNonexist().Right)
+}
@@ -0,0 +1,78 @@
+package iavl
+
+import (
+	"bytes"
+
+	ics23 "github.com/confio/ics23/go"
+)
+
+// IterateWithProofs makes a callback for all leaves with key between start (inclusive) and end
+// (exclusive), passing an ics23 membership proof for each of them. If either bound is nil, the
+// range is open on that side. Returns true if stopped by the callback, false otherwise.
+//
+// Unlike calling GetMembershipProof for every key, the inner path ops are built once per inner
+// node and shared between all leaves below it, so proving a range of n keys does not redo the
+// O(log n) descent for every key. The InnerOps of the returned proofs may therefore be shared
+// between proofs and must not be modified.
+func (t *ImmutableTree) IterateWithProofs(start, end []byte, fn func(key, value []byte, proof *ics23.CommitmentProof) bool) (stopped bool) {
+	if t.root == nil {
+		return false
+	}
+	t.root.hashWithCount() // Ensure that all hashes are calculated.
+
+	// ops holds the converted inner ops from the root down to the current node.
+	ops := make([]*ics23.InnerOp, 0, t.root.height)
+	return t.iterateWithProofs(t.root, start, end, ops, fn)
+}
+
+func (t *ImmutableTree) iterateWithProofs(node *Node, start, end []byte, ops []*ics23.InnerOp,
+	fn func(key, value []byte, proof *ics23.CommitmentProof) bool) bool {
+	if node.isLeaf() {
+		if start != nil && bytes.Compare(node.key, start) < 0 {
+			return false
+		}
+		if end != nil && bytes.Compare(node.key, end) >= 0 {
+			return false
+		}
+		// ics23 paths go from the leaf up to the root.
+		path := make([]*ics23.InnerOp, len(ops))
+		for i, op := range ops {
+			path[len(ops)-1-i] = op
+		}
+		proof := &ics23.CommitmentProof{
+			Proof: &ics23.CommitmentProof_Exist{
+				Exist: &ics23.ExistenceProof{
+					Key:   node.key,
+					Value: node.value,
+					Leaf:  convertLeafOp(node.version),
+					Path:  path,
+				},
+			},
+		}
+		return fn(node.key, node.value, proof)
+	}
+
+	if start == nil || bytes.Compare(start, node.key) < 0 {
+		op := convertInnerOp(ProofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+			Right:   node.rightHash,
+		})
+		if t.iterateWithProofs(node.getLeftNode(t), start, end, append(ops, op), fn) {
+			return true
+		}
+	}
+	if end == nil || bytes.Compare(node.key, end) < 0 {
+		op := convertInnerOp(ProofInnerNode{
+			Height:  node.height,
+			Size:    node.size,
+			Version: node.version,
+			Left:    node.leftHash,
+		})
+		if t.iterateWithProofs(node.getRightNode(t), start, end, append(ops, op), fn) {
+			return true
+		}
+	}
+	return false
+}
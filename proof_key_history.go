@@ -0,0 +1,147 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// KeyVersionProof proves the value of a key at a single version, see KeyHistoryProof.
+type KeyVersionProof struct {
+	Version    int64  `json:"version"`
+	RootHash   []byte `json:"root_hash"`
+	Value      []byte `json:"value"`       // nil if the key isn't set
+	SetVersion int64  `json:"set_version"` // version the value was set at, 0 if the key isn't set
+	Proof      []byte `json:"proof"`       // serialized ics23 CommitmentProof, nil if the tree is empty
+}
+
+// KeyHistoryProof proves that a key had a given value, or was unset, at two versions, e.g. for
+// dispute resolution. Each version carries an ics23 membership or non-membership proof against
+// its root hash, along with the version the value was set at, which is committed to by the leaf.
+// The set versions link the two versions: if the value at To was set no later than From, it must
+// be the same leaf as at From, and otherwise the key was set in between.
+type KeyHistoryProof struct {
+	Key  []byte           `json:"key"`
+	From *KeyVersionProof `json:"from"`
+	To   *KeyVersionProof `json:"to"`
+}
+
+// GetKeyHistoryProof generates a proof of the value of a key at fromVersion and toVersion, see
+// KeyHistoryProof.
+func (tree *MutableTree) GetKeyHistoryProof(key []byte, fromVersion, toVersion int64) (*KeyHistoryProof, error) {
+	if len(key) == 0 {
+		return nil, errors.Wrap(ErrInvalidInputs, "key cannot be empty")
+	}
+	if fromVersion > toVersion {
+		return nil, errors.Wrap(ErrInvalidInputs, "fromVersion must not be after toVersion")
+	}
+	from, err := tree.getKeyVersionProof(key, fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := tree.getKeyVersionProof(key, toVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyHistoryProof{Key: key, From: from, To: to}, nil
+}
+
+// getKeyVersionProof generates a proof of the value of a key at a version.
+func (tree *MutableTree) getKeyVersionProof(key []byte, version int64) (*KeyVersionProof, error) {
+	t, err := tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	proof := &KeyVersionProof{Version: version, RootHash: t.Hash()}
+	if t.root == nil {
+		return proof, nil
+	}
+	_, proof.Value = t.root.get(t, key)
+	if proof.Value != nil {
+		commitment, err := t.GetMembershipProof(key)
+		if err != nil {
+			return nil, err
+		}
+		proof.SetVersion, err = decodeNodeVersion(commitment.GetExist().Leaf.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		proof.Proof, err = commitment.Marshal()
+		return proof, err
+	}
+	commitment, err := t.GetNonMembershipProof(key)
+	if err != nil {
+		return nil, err
+	}
+	proof.Proof, err = commitment.Marshal()
+	return proof, err
+}
+
+// Verify verifies the proof against the trusted root hashes of the two versions. It returns an
+// error wrapping ErrInvalidRoot if the proof is for other roots, or ErrInvalidProof if it is
+// invalid.
+func (proof *KeyHistoryProof) Verify(fromRoot, toRoot []byte) error {
+	if proof == nil || proof.From == nil || proof.To == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is incomplete")
+	}
+	if proof.From.Version > proof.To.Version {
+		return errors.Wrap(ErrInvalidProof, "versions are out of order")
+	}
+	if err := proof.From.verify(proof.Key, fromRoot); err != nil {
+		return errors.Wrapf(err, "verifying version %d", proof.From.Version)
+	}
+	if err := proof.To.verify(proof.Key, toRoot); err != nil {
+		return errors.Wrapf(err, "verifying version %d", proof.To.Version)
+	}
+
+	// A value at To which was set no later than From must be the value at From.
+	to, from := proof.To, proof.From
+	if to.Value != nil && to.SetVersion <= from.Version &&
+		(from.SetVersion != to.SetVersion || !bytes.Equal(from.Value, to.Value)) {
+		return errors.Wrapf(ErrInvalidProof, "value at version %d set at version %d differs from version %d",
+			to.Version, to.SetVersion, from.Version)
+	}
+	return nil
+}
+
+// verify verifies the proof of a single version against its trusted root hash.
+func (proof *KeyVersionProof) verify(key, root []byte) error {
+	if !bytes.Equal(proof.RootHash, root) {
+		return errors.Wrapf(ErrInvalidRoot, "expected %X, got %X", root, proof.RootHash)
+	}
+	if proof.Value == nil && proof.SetVersion != 0 {
+		return errors.Wrap(ErrInvalidProof, "unset key has a set version")
+	}
+	if proof.Proof == nil {
+		// An empty tree has no keys, and its root is the empty hash.
+		if proof.Value != nil || !bytes.Equal(root, sha256.New().Sum(nil)) {
+			return errors.Wrap(ErrInvalidProof, "missing proof")
+		}
+		return nil
+	}
+	if proof.Value == nil {
+		return VerifyNonMembership(root, key, proof.Proof)
+	}
+	if err := VerifyMembership(root, key, proof.Value, proof.Proof); err != nil {
+		return err
+	}
+
+	// The set version is committed to by the leaf, and can't be later than the version itself.
+	commitment, err := unmarshalCommitmentProof(proof.Proof)
+	if err != nil {
+		return err
+	}
+	exist := commitment.GetExist()
+	if exist == nil {
+		return errors.Wrap(ErrInvalidProof, "expected an existence proof")
+	}
+	setVersion, err := decodeNodeVersion(exist.Leaf.Prefix)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidProof, "decoding leaf version: %v", err)
+	}
+	if setVersion != proof.SetVersion || setVersion > proof.Version {
+		return errors.Wrapf(ErrInvalidProof, "leaf has version %d", setVersion)
+	}
+	return nil
+}
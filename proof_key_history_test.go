@@ -0,0 +1,77 @@
+package iavl
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyHistoryProof(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	key := []byte("key")
+	roots := map[int64][]byte{}
+	_, _, err = tree.SaveVersion() // version 1 is empty
+	require.NoError(t, err)
+	for v := int64(2); v <= 6; v++ {
+		tree.Set([]byte{byte(v)}, []byte{byte(v)})
+		switch v {
+		case 3:
+			tree.Set(key, []byte("x"))
+		case 5:
+			tree.Set(key, []byte("y"))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	for v := int64(1); v <= 6; v++ {
+		iTree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		roots[v] = iTree.Hash()
+	}
+
+	testcases := []struct {
+		from, to         int64
+		fromValue, value []byte
+	}{
+		{1, 3, nil, []byte("x")},
+		{2, 4, nil, []byte("x")},
+		{3, 4, []byte("x"), []byte("x")},
+		{4, 6, []byte("x"), []byte("y")},
+	}
+	for _, tc := range testcases {
+		proof, err := tree.GetKeyHistoryProof(key, tc.from, tc.to)
+		require.NoError(t, err)
+		require.Equal(t, tc.fromValue, proof.From.Value)
+		require.Equal(t, tc.value, proof.To.Value)
+		require.NoError(t, proof.Verify(roots[tc.from], roots[tc.to]))
+
+		// The proof survives a JSON round trip.
+		bz, err := json.Marshal(proof)
+		require.NoError(t, err)
+		decoded := &KeyHistoryProof{}
+		require.NoError(t, json.Unmarshal(bz, decoded))
+		require.NoError(t, decoded.Verify(roots[tc.from], roots[tc.to]))
+
+		require.ErrorIs(t, proof.Verify(roots[tc.to], roots[tc.to]), ErrInvalidRoot)
+	}
+
+	proof, err := tree.GetKeyHistoryProof(key, 4, 6)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, proof.From.SetVersion)
+	require.EqualValues(t, 5, proof.To.SetVersion)
+
+	// Tampering with values or set versions is detected.
+	proof.To.Value = []byte("z")
+	require.ErrorIs(t, proof.Verify(roots[4], roots[6]), ErrInvalidProof)
+	proof.To.Value = []byte("y")
+	proof.To.SetVersion = 3
+	require.ErrorIs(t, proof.Verify(roots[4], roots[6]), ErrInvalidProof)
+	proof.To.SetVersion = 5
+	proof.From.Value = nil
+	require.ErrorIs(t, proof.Verify(roots[4], roots[6]), ErrInvalidProof)
+
+	_, err = tree.GetKeyHistoryProof(key, 6, 4)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+}
@@ -333,6 +333,9 @@ func (proof *RangeProof) ToProto() *iavlproto.RangeProof {
 // rangeProofFromProto generates a RangeProof from a Protobuf RangeProof.
 func RangeProofFromProto(pbProof *iavlproto.RangeProof) (RangeProof, error) {
 	proof := RangeProof{}
+	if pbProof == nil {
+		return proof, errors.New("range proof cannot be nil")
+	}
 
 	for _, pbInner := range pbProof.LeftPath {
 		inner, err := proofInnerNodeFromProto(pbInner)
@@ -423,8 +426,9 @@ func (t *ImmutableTree) getRangeProof(keyStart, keyEnd []byte, limit int) (proof
 		}, keys, values, nil
 	}
 
-	// Get the key after left.key to iterate from.
-	afterLeft := cpIncr(left.key)
+	// Get the key after left.key to iterate from. This must be the immediate successor, since
+	// cpIncr would skip longer keys sharing the prefix (e.g. "cc" between "c" and "d").
+	afterLeft := cpSucc(left.key)
 
 	// Traverse starting from afterLeft, until keyEnd or the next leaf
 	// after keyEnd.
@@ -549,7 +553,7 @@ func (tree *MutableTree) GetVersionedWithProof(key []byte, version int64) ([]byt
 
 		return t.GetWithProof(key)
 	}
-	return nil, nil, errors.Wrap(ErrVersionDoesNotExist, "")
+	return nil, nil, tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version))
 }
 
 // GetVersionedRangeWithProof gets key/value pairs within the specified range
@@ -564,5 +568,5 @@ func (tree *MutableTree) GetVersionedRangeWithProof(startKey, endKey []byte, lim
 		}
 		return t.GetRangeWithProof(startKey, endKey, limit)
 	}
-	return nil, nil, nil, errors.Wrap(ErrVersionDoesNotExist, "")
+	return nil, nil, nil, tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version))
 }
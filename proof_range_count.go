@@ -0,0 +1,152 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
+)
+
+// RangeCountProof proves the number of keys in the range [Start, End) of a tree, as returned by
+// CountRange. Inner nodes are hashed along with the size of their subtree, so the path to a key
+// also proves its index: the sum of the sizes of the left siblings along the path. The count is
+// the difference between the indexes of the bounds.
+type RangeCountProof struct {
+	Start []byte // nil for an open start
+	End   []byte // nil for an open end
+	Count int64
+
+	// StartProof proves the membership or non-membership of Start, and is nil if Start is nil.
+	StartProof *ics23.CommitmentProof
+	// EndProof proves the membership or non-membership of End. If End is nil, it proves the
+	// membership of the last key in the tree instead, which gives the size of the tree.
+	EndProof *ics23.CommitmentProof
+}
+
+// GetRangeCountProof returns the number of keys in the range [start, end), where nil start or end
+// means an open bound, along with a proof of the count.
+func (t *ImmutableTree) GetRangeCountProof(start, end []byte) (*RangeCountProof, error) {
+	count, err := t.CountRange(start, end)
+	if err != nil {
+		return nil, err
+	}
+	if t.root == nil {
+		return nil, ErrEmptyTree
+	}
+
+	proof := &RangeCountProof{Start: start, End: end, Count: count}
+	if start != nil {
+		if _, proof.StartProof, err = t.getKeyProof(start); err != nil {
+			return nil, err
+		}
+	}
+	if end != nil {
+		_, proof.EndProof, err = t.getKeyProof(end)
+	} else {
+		lastKey, _ := t.GetByIndex(t.root.size - 1)
+		proof.EndProof, err = t.GetMembershipProof(lastKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proof, nil
+}
+
+// Verify verifies that the tree with the given root hash has Count keys in the range. It returns
+// ErrInvalidProof if the proof doesn't verify.
+func (p *RangeCountProof) Verify(root []byte) error {
+	if p.Start != nil && p.End != nil && bytes.Compare(p.Start, p.End) > 0 {
+		return errors.Wrap(ErrInvalidProof, "range start is after end")
+	}
+
+	var startIndex int64
+	if p.Start != nil {
+		index, _, err := verifyKeyIndex(root, p.Start, p.StartProof)
+		if err != nil {
+			return errors.Wrap(err, "start")
+		}
+		startIndex = index
+	}
+
+	var endIndex int64
+	if p.End != nil {
+		index, _, err := verifyKeyIndex(root, p.End, p.EndProof)
+		if err != nil {
+			return errors.Wrap(err, "end")
+		}
+		endIndex = index
+	} else {
+		exist := p.EndProof.GetExist()
+		if exist == nil {
+			return errors.Wrap(ErrInvalidProof, "end: expected a membership proof of the last key")
+		}
+		index, size, err := verifyKeyIndex(root, exist.Key, p.EndProof)
+		if err != nil {
+			return errors.Wrap(err, "end")
+		}
+		if index != size-1 {
+			return errors.Wrapf(ErrInvalidProof, "end: key %X is not the last key", exist.Key)
+		}
+		endIndex = size
+	}
+
+	if count := endIndex - startIndex; count != p.Count {
+		return errors.Wrapf(ErrInvalidProof, "proven count is %v, not %v", count, p.Count)
+	}
+	return nil
+}
+
+// verifyKeyIndex verifies a membership or non-membership proof of the key against the root hash,
+// and returns the index the key has or would have in the tree, along with the size of the tree.
+func verifyKeyIndex(root, key []byte, proof *ics23.CommitmentProof) (index, size int64, err error) {
+	switch {
+	case proof.GetExist() != nil:
+		exist := proof.GetExist()
+		if !ics23.VerifyMembership(ProofSpec(), root, proof, key, exist.Value) {
+			return 0, 0, errors.Wrapf(ErrInvalidProof, "membership of key %X", key)
+		}
+		return existenceProofIndex(exist)
+
+	case proof.GetNonexist() != nil:
+		nonexist := proof.GetNonexist()
+		if !ics23.VerifyNonMembership(ProofSpec(), root, proof, key) {
+			return 0, 0, errors.Wrapf(ErrInvalidProof, "non-membership of key %X", key)
+		}
+		if nonexist.Left != nil {
+			index, size, err = existenceProofIndex(nonexist.Left)
+			return index + 1, size, err
+		}
+		return existenceProofIndex(nonexist.Right)
+
+	default:
+		return 0, 0, errors.Wrap(ErrInvalidProof, "expected a membership or non-membership proof")
+	}
+}
+
+// existenceProofIndex returns the index of the leaf proven by the existence proof, along with the
+// size of the tree, from the subtree sizes of the inner nodes along the path. The proof must
+// already have been verified.
+func existenceProofIndex(proof *ics23.ExistenceProof) (index, size int64, err error) {
+	path, err := NewAuditPath(proof)
+	if err != nil {
+		return 0, 0, err
+	}
+	size = 1
+	for i, step := range path.Steps {
+		// The prefix starts with the varint height, followed by the varint size.
+		_, n := binary.Varint(step.Prefix)
+		if n <= 0 {
+			return 0, 0, errors.Wrapf(ErrInvalidProof, "invalid height in inner op %v", i)
+		}
+		parentSize, m := binary.Varint(step.Prefix[n:])
+		if m <= 0 || parentSize <= size {
+			return 0, 0, errors.Wrapf(ErrInvalidProof, "invalid size in inner op %v", i)
+		}
+		if step.SiblingLeft {
+			index += parentSize - size
+		}
+		size = parentSize
+	}
+	return index, size, nil
+}
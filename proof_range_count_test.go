@@ -0,0 +1,122 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestCountRange(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	count, err := tree.CountRange(nil, nil)
+	require.NoError(t, err)
+	require.Zero(t, count)
+	_, err = tree.GetRangeCountProof(nil, nil)
+	require.Equal(t, ErrEmptyTree, err)
+
+	// Keys 000, 002, ..., 198.
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("%03d", i*2)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	root := tree.Hash()
+
+	testcases := []struct {
+		start, end string
+		nilStart   bool
+		nilEnd     bool
+		count      int64
+	}{
+		{nilStart: true, nilEnd: true, count: 100},
+		{start: "000", nilEnd: true, count: 100},
+		{start: "001", nilEnd: true, count: 99},
+		{nilStart: true, end: "198", count: 99},
+		{nilStart: true, end: "199", count: 100},
+		{start: "010", end: "020", count: 5},
+		{start: "011", end: "021", count: 5},
+		{start: "010", end: "010", count: 0},
+		{start: "/", end: "000", count: 0},
+		{start: "200", end: "300", count: 0},
+		{start: "/", end: "300", count: 100},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		var start, end []byte
+		if !tc.nilStart {
+			start = []byte(tc.start)
+		}
+		if !tc.nilEnd {
+			end = []byte(tc.end)
+		}
+		t.Run(fmt.Sprintf("%q-%q", start, end), func(t *testing.T) {
+			count, err := tree.CountRange(start, end)
+			require.NoError(t, err)
+			require.Equal(t, tc.count, count)
+
+			proof, err := tree.GetRangeCountProof(start, end)
+			require.NoError(t, err)
+			require.Equal(t, tc.count, proof.Count)
+			require.NoError(t, proof.Verify(root))
+
+			proof.Count++
+			require.True(t, errors.Is(proof.Verify(root), ErrInvalidProof))
+			proof.Count--
+			require.True(t, errors.Is(proof.Verify([]byte("invalid root hash padded to 32B")), ErrInvalidProof))
+		})
+	}
+
+	_, err = tree.CountRange([]byte("b"), []byte("a"))
+	require.Error(t, err)
+
+	// Bounds can't be swapped for those of another range with the same proof.
+	proof, err := tree.GetRangeCountProof([]byte("010"), []byte("020"))
+	require.NoError(t, err)
+	proof.End = []byte("030")
+	require.True(t, errors.Is(proof.Verify(root), ErrInvalidProof))
+
+	// An open end must be proven by the last key.
+	proof, err = tree.GetRangeCountProof(nil, []byte("198"))
+	require.NoError(t, err)
+	proof.EndProof, err = tree.GetMembershipProof([]byte("196"))
+	require.NoError(t, err)
+	proof.End = nil
+	require.True(t, errors.Is(proof.Verify(root), ErrInvalidProof))
+}
+
+func TestCountRange_Random(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		tree.Set([]byte(fmt.Sprintf("%05d", r.Intn(10000))), []byte{1})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := 0; i < 50; i++ {
+		start := []byte(fmt.Sprintf("%05d", r.Intn(10000)))
+		end := []byte(fmt.Sprintf("%05d", r.Intn(10000)))
+		if string(start) > string(end) {
+			start, end = end, start
+		}
+		expect := int64(0)
+		tree.IterateRange(start, end, true, func(_, _ []byte) bool {
+			expect++
+			return false
+		})
+		count, err := tree.CountRange(start, end)
+		require.NoError(t, err)
+		require.Equal(t, expect, count)
+
+		proof, err := tree.GetRangeCountProof(start, end)
+		require.NoError(t, err)
+		require.NoError(t, proof.Verify(tree.Hash()))
+	}
+}
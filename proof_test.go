@@ -115,6 +115,22 @@ func TestTreeKeyExistsProof(t *testing.T) {
 	// TODO: Test with single value in tree.
 }
 
+func TestTreeRangeProofVariableLengthKeys(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for _, key := range []string{"b", "c", "cc", "d", "e"} {
+		tree.Set([]byte(key), []byte(key))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// "cc" sorts between "c" and "d", and must not be skipped.
+	keys, _, proof, err := tree.GetRangeWithProof([]byte("c"), []byte("e"), 0)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("c"), []byte("cc"), []byte("d")}, keys)
+	require.NoError(t, proof.Verify(tree.Hash()))
+}
+
 func TestTreeKeyInRangeProofs(t *testing.T) {
 	tree, err := getTestTree(0)
 	require.NoError(t, err)
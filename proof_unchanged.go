@@ -0,0 +1,230 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrRangeChanged is returned when a key range can't be proven unchanged between two versions,
+// because the subtree spanning it was rewritten in between, see UnchangedRangeProof.
+var ErrRangeChanged = errors.New("range changed between versions")
+
+// UnchangedRangeProof proves that no key within [Start, End) was set or removed between
+// FromVersion and ToVersion, by the version stamps of the nodes of the tree at ToVersion.
+//
+// Nodes are immutable, and every write rewrites the nodes on the path to the written leaf with
+// the version being saved, so a node with a version of FromVersion or earlier still in the tree
+// at ToVersion spans exactly the same leaves at both versions. The proof consists of the paths to
+// two leaves at ToVersion: Left, the last leaf before Start, and Right, the first leaf at or after
+// End. All keys of the range fall between them at both versions, so the range is unchanged if
+// their deepest common ancestor has a version of FromVersion or earlier. The proof is
+// logarithmic in the size of the tree, regardless of the size of the range.
+//
+// If there is no leaf before Start, Left is the first leaf instead, and FromLeftPath proves that
+// it was the first leaf at FromVersion too. Likewise, Right is then the last leaf, proven to be
+// the last leaf at FromVersion by FromRightPath.
+type UnchangedRangeProof struct {
+	Start         []byte         `json:"start"`
+	End           []byte         `json:"end"`
+	FromVersion   int64          `json:"from_version"`
+	ToVersion     int64          `json:"to_version"`
+	Left          *ProofLeafNode `json:"left"` // nil if the tree is empty at both versions
+	LeftPath      PathToLeaf     `json:"left_path"`
+	Right         *ProofLeafNode `json:"right"` // nil if the tree is empty at both versions
+	RightPath     PathToLeaf     `json:"right_path"`
+	FromLeftPath  PathToLeaf     `json:"from_left_path,omitempty"`
+	FromRightPath PathToLeaf     `json:"from_right_path,omitempty"`
+}
+
+// GetUnchangedRangeProof generates a proof that no keys in the range [start, end) changed between
+// fromVersion and toVersion. Either bound may be nil to leave the range open on that side. It
+// returns an error wrapping ErrRangeChanged if the range can't be proven unchanged, which is also
+// the case when only the keys just outside the range were written, since their paths share the
+// subtree spanning the range.
+func (tree *MutableTree) GetUnchangedRangeProof(start, end []byte, fromVersion, toVersion int64) (*UnchangedRangeProof, error) {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return nil, errors.Wrap(ErrInvalidInputs, "start must be before end")
+	}
+	if fromVersion > toVersion {
+		return nil, errors.Wrap(ErrInvalidInputs, "fromVersion must not be after toVersion")
+	}
+	from, err := tree.getImmutableForProof(fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	to, err := tree.getImmutableForProof(toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &UnchangedRangeProof{
+		Start:       start,
+		End:         end,
+		FromVersion: fromVersion,
+		ToVersion:   toVersion,
+	}
+	if to.root == nil {
+		if from.root != nil {
+			return nil, errors.Wrapf(ErrRangeChanged, "tree is empty at version %d only", toVersion)
+		}
+		return proof, nil
+	}
+
+	leftIndex, leftEdge := int64(0), true
+	if start != nil {
+		if index, _ := to.GetWithIndex(start); index > 0 {
+			leftIndex, leftEdge = index-1, false
+		}
+	}
+	rightIndex, rightEdge := to.Size()-1, true
+	if end != nil {
+		if index, _ := to.GetWithIndex(end); index < to.Size() {
+			rightIndex, rightEdge = index, false
+		}
+	}
+	if proof.Left, proof.LeftPath, err = leafWithPath(to, leftIndex); err != nil {
+		return nil, err
+	}
+	if proof.Right, proof.RightPath, err = leafWithPath(to, rightIndex); err != nil {
+		return nil, err
+	}
+	if leftEdge {
+		if proof.FromLeftPath, err = edgePath(from, proof.Left, 0); err != nil {
+			return nil, err
+		}
+	}
+	if rightEdge {
+		if proof.FromRightPath, err = edgePath(from, proof.Right, from.Size()-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if version := proof.spanVersion(); version > fromVersion {
+		return nil, errors.Wrapf(ErrRangeChanged, "the subtree spanning the range was written at version %d", version)
+	}
+	return proof, nil
+}
+
+// getImmutableForProof returns the tree of a saved version to generate a proof with.
+func (tree *MutableTree) getImmutableForProof(version int64) (*ImmutableTree, error) {
+	if !tree.VersionExists(version) {
+		return nil, tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %d", version))
+	}
+	return tree.GetImmutable(version)
+}
+
+// leafWithPath returns the leaf at the given index of a non-empty tree, and the path to it.
+func leafWithPath(t *ImmutableTree, index int64) (*ProofLeafNode, PathToLeaf, error) {
+	key, _ := t.GetByIndex(index)
+	path, node, err := t.root.PathToLeaf(t, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	valueHash := sha256.Sum256(node.value)
+	return &ProofLeafNode{Key: node.key, ValueHash: valueHash[:], Version: node.version}, path, nil
+}
+
+// edgePath returns the path to a leaf at the given index of an older tree, which must be the
+// same leaf as the given one, returning an error wrapping ErrRangeChanged otherwise.
+func edgePath(t *ImmutableTree, leaf *ProofLeafNode, index int64) (PathToLeaf, error) {
+	if t.root == nil {
+		return nil, errors.Wrapf(ErrRangeChanged, "tree is empty at version %d", t.version)
+	}
+	edge, path, err := leafWithPath(t, index)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(edge.Hash(), leaf.Hash()) {
+		return nil, errors.Wrapf(ErrRangeChanged, "key %X is no longer at the edge of the tree", edge.Key)
+	}
+	return path, nil
+}
+
+// spanVersion returns the version of the deepest common ancestor of the Left and Right leaves,
+// or -1 if their paths don't share the root. Paths are ordered from the root.
+func (proof *UnchangedRangeProof) spanVersion() int64 {
+	left := pathHashes(proof.LeftPath, proof.Left.Hash())
+	right := pathHashes(proof.RightPath, proof.Right.Hash())
+	version := int64(-1)
+	for i := 0; i < len(left) && i < len(right) && bytes.Equal(left[i], right[i]); i++ {
+		if i < len(proof.LeftPath) {
+			version = proof.LeftPath[i].Version
+		} else {
+			version = proof.Left.Version
+		}
+	}
+	return version
+}
+
+// pathHashes returns the hashes of the nodes of a path, from the root down to the leaf.
+func pathHashes(path PathToLeaf, leafHash []byte) [][]byte {
+	hashes := make([][]byte, len(path)+1)
+	hashes[len(path)] = leafHash
+	for i := len(path) - 1; i >= 0; i-- {
+		hashes[i] = path[i].Hash(hashes[i+1])
+	}
+	return hashes
+}
+
+// Verify verifies the proof against the root hashes of the two versions. It returns nil if the
+// range is proven unchanged, an error wrapping ErrRangeChanged if the subtree spanning the range
+// was written after FromVersion, and an error wrapping ErrInvalidProof or ErrInvalidRoot if the
+// proof itself is invalid.
+func (proof *UnchangedRangeProof) Verify(fromRoot, toRoot []byte) error {
+	if proof == nil {
+		return errors.Wrap(ErrInvalidProof, "proof is nil")
+	}
+	if proof.Left == nil || proof.Right == nil {
+		if proof.Left != nil || proof.Right != nil {
+			return errors.Wrap(ErrInvalidProof, "proof has a single leaf")
+		}
+		if !isEmptyRoot(fromRoot) || !isEmptyRoot(toRoot) {
+			return errors.Wrap(ErrInvalidRoot, "proof is for empty trees")
+		}
+		return nil
+	}
+
+	leftHash, rightHash := proof.Left.Hash(), proof.Right.Hash()
+	if !bytes.Equal(proof.LeftPath.computeRootHash(leftHash), toRoot) ||
+		!bytes.Equal(proof.RightPath.computeRootHash(rightHash), toRoot) {
+		return errors.Wrapf(ErrInvalidRoot, "root hash doesn't match at version %d", proof.ToVersion)
+	}
+	if bytes.Compare(proof.Left.Key, proof.Right.Key) > 0 {
+		return errors.Wrap(ErrInvalidProof, "left leaf is after right leaf")
+	}
+
+	if proof.Start == nil || bytes.Compare(proof.Left.Key, proof.Start) >= 0 {
+		if !proof.LeftPath.isLeftmost() || !proof.FromLeftPath.isLeftmost() {
+			return errors.Wrap(ErrInvalidProof, "left leaf is neither before the range nor the first leaf")
+		}
+		if !bytes.Equal(proof.FromLeftPath.computeRootHash(leftHash), fromRoot) {
+			return errors.Wrapf(ErrInvalidRoot, "root hash doesn't match at version %d", proof.FromVersion)
+		}
+	}
+	if proof.End == nil || bytes.Compare(proof.Right.Key, proof.End) < 0 {
+		if !proof.RightPath.isRightmost() || !proof.FromRightPath.isRightmost() {
+			return errors.Wrap(ErrInvalidProof, "right leaf is neither after the range nor the last leaf")
+		}
+		if !bytes.Equal(proof.FromRightPath.computeRootHash(rightHash), fromRoot) {
+			return errors.Wrapf(ErrInvalidRoot, "root hash doesn't match at version %d", proof.FromVersion)
+		}
+	}
+
+	if version := proof.spanVersion(); version > proof.FromVersion {
+		return errors.Wrapf(ErrRangeChanged, "the subtree spanning the range was written at version %d", version)
+	}
+	return nil
+}
+
+// isEmptyRoot returns true if the root hash is that of an empty tree.
+func isEmptyRoot(root []byte) bool {
+	return len(root) == 0 || bytes.Equal(root, sha256.New().Sum(nil))
+}
+
+// String returns a string representation of the proof.
+func (proof *UnchangedRangeProof) String() string {
+	return fmt.Sprintf("UnchangedRangeProof{%X-%X %d..%d}", proof.Start, proof.End, proof.FromVersion, proof.ToVersion)
+}
@@ -0,0 +1,105 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/tendermint/tm-db"
+)
+
+func TestUnchangedRangeProof(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("k%02d", i)) }
+	for i := 0; i < 64; i++ {
+		tree.Set(key(i), key(i))
+	}
+	_, v1, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set(key(60), []byte("updated"))
+	tree.Remove(key(62))
+	_, v2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("k30b"), []byte("inserted"))
+	_, v3, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	roots := map[int64][]byte{}
+	for _, v := range []int64{v1, v2, v3} {
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		roots[v] = itree.Hash()
+	}
+
+	cases := map[string]struct {
+		start, end []byte
+		from, to   int64
+		changed    bool
+	}{
+		"unchanged middle":  {key(10), key(20), v1, v2, false},
+		"unchanged start":   {nil, key(5), v1, v3, false},
+		"missing bounds":    {[]byte("k10a"), []byte("k19a"), v1, v2, false},
+		"same version":      {nil, nil, v2, v2, false},
+		"updated key":       {key(55), key(61), v1, v2, true},
+		"removed key":       {key(50), nil, v1, v2, true},
+		"inserted key":      {key(25), key(35), v2, v3, true},
+		"changed neighbour": {key(61), key(62), v1, v2, true},
+	}
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			proof, err := tree.GetUnchangedRangeProof(tc.start, tc.end, tc.from, tc.to)
+			if tc.changed {
+				require.ErrorIs(t, err, ErrRangeChanged)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, proof.Verify(roots[tc.from], roots[tc.to]))
+			// The proof is logarithmic in the size of the tree.
+			require.LessOrEqual(t, len(proof.LeftPath)+len(proof.RightPath), 2*int(tree.Height()))
+		})
+	}
+
+	proof, err := tree.GetUnchangedRangeProof(key(10), key(20), v1, v2)
+	require.NoError(t, err)
+	require.ErrorIs(t, proof.Verify(roots[v1], roots[v3]), ErrInvalidRoot)
+
+	// The proof doesn't cover a larger range.
+	proof.End = key(61)
+	require.ErrorIs(t, proof.Verify(roots[v1], roots[v2]), ErrInvalidProof)
+
+	// A proof claiming an earlier from version shows that the range was written after it.
+	proof, err = tree.GetUnchangedRangeProof(nil, nil, v3, v3)
+	require.NoError(t, err)
+	proof.FromVersion = v2
+	require.ErrorIs(t, proof.Verify(roots[v3], roots[v3]), ErrRangeChanged)
+
+	_, err = tree.GetUnchangedRangeProof(key(20), key(10), v1, v2)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.GetUnchangedRangeProof(nil, nil, v1, 10)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestUnchangedRangeProof_Empty(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	_, v1, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, v2, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	proof, err := tree.GetUnchangedRangeProof(nil, nil, v1, v2)
+	require.NoError(t, err)
+	require.NoError(t, proof.Verify(nil, nil))
+
+	tree.Set([]byte("a"), []byte("a"))
+	_, v3, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.GetUnchangedRangeProof(nil, nil, v1, v3)
+	require.ErrorIs(t, err, ErrRangeChanged)
+}
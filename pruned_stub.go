@@ -0,0 +1,107 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// prunedStubPrefix prefixes the keys of pruned version stubs in the metadata keyspace. It is
+// followed by the big-endian version number.
+const prunedStubPrefix = "pruned/"
+
+// ErrVersionPruned is returned when a requested version existed, but has been deleted, see
+// Options.PrunedStubs.
+var ErrVersionPruned = errors.New("version has been pruned")
+
+// PrunedVersion describes a deleted version, as recorded with Options.PrunedStubs.
+type PrunedVersion struct {
+	Version  int64
+	RootHash []byte
+	PrunedAt time.Time
+}
+
+// VersionPrunedError is returned when a requested version has been deleted, but a stub of it was
+// kept with Options.PrunedStubs. It matches both ErrVersionPruned and ErrVersionDoesNotExist.
+type VersionPrunedError struct {
+	PrunedVersion
+}
+
+// Error implements error.
+func (e *VersionPrunedError) Error() string {
+	return fmt.Sprintf("%v: version %v with root hash %X, pruned at %v", ErrVersionPruned,
+		e.Version, e.RootHash, e.PrunedAt.Format(time.RFC3339))
+}
+
+// Is implements errors.Is.
+func (e *VersionPrunedError) Is(target error) bool {
+	return target == ErrVersionPruned || target == ErrVersionDoesNotExist
+}
+
+func prunedStubKey(version int64) []byte {
+	return metadataKeyFormat.Key(append([]byte(prunedStubPrefix), formatUint64(uint64(version))...))
+}
+
+// setPrunedStub writes a stub of a deleted version to the batch, if enabled.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) setPrunedStub(version int64, rootHash []byte) error {
+	if !ndb.opts.PrunedStubs {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := encodeBytes(&buf, rootHash); err != nil {
+		return err
+	}
+	if err := encodeVarint(&buf, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	return ndb.batch.Set(prunedStubKey(version), buf.Bytes())
+}
+
+// getPrunedStub reads the stub of a deleted version, returning nil if there is none.
+func (ndb *nodeDB) getPrunedStub(version int64) (*PrunedVersion, error) {
+	bz, err := ndb.db.Get(prunedStubKey(version))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	rootHash, n, err := decodeBytes(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding pruned stub root hash")
+	}
+	nanos, _, err := decodeVarint(bz[n:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding pruned stub time")
+	}
+	return &PrunedVersion{Version: version, RootHash: rootHash, PrunedAt: time.Unix(0, nanos).UTC()}, nil
+}
+
+// deleteAllPrunedStubsFrom deletes the stubs of all versions from the given version, when rolling
+// back versions which can be saved again.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteAllPrunedStubsFrom(version int64) error {
+	return ndb.traverseRange(prunedStubKey(version), prunedStubKey(math.MaxInt64), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+}
+
+// versionMissing returns a *VersionPrunedError if a missing version has a pruned stub, or err
+// otherwise.
+func (ndb *nodeDB) versionMissing(version int64, err error) error {
+	stub, stubErr := ndb.getPrunedStub(version)
+	if stubErr != nil {
+		return stubErr
+	}
+	if stub == nil {
+		return err
+	}
+	return &VersionPrunedError{PrunedVersion: *stub}
+}
+
+// PrunedVersion returns the stub of a deleted version kept with Options.PrunedStubs, or nil if
+// there is none.
+func (tree *MutableTree) PrunedVersion(version int64) (*PrunedVersion, error) {
+	return tree.ndb.getPrunedStub(version)
+}
@@ -0,0 +1,89 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestPrunedStubs(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{PrunedStubs: true})
+	require.NoError(t, err)
+	hashes := map[int64][]byte{}
+	for v := int64(1); v <= 6; v++ {
+		tree.Set([]byte(fmt.Sprintf("key%d", v)), []byte("value"))
+		hash, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes[version] = hash
+	}
+	before := time.Now()
+	require.NoError(t, tree.DeleteVersion(1))
+	require.NoError(t, tree.DeleteVersionsRange(2, 4))
+
+	for v := int64(1); v <= 3; v++ {
+		stub, err := tree.PrunedVersion(v)
+		require.NoError(t, err)
+		require.NotNil(t, stub)
+		require.Equal(t, v, stub.Version)
+		require.Equal(t, hashes[v], stub.RootHash)
+		require.False(t, stub.PrunedAt.Before(before.Truncate(time.Second)))
+
+		_, err = tree.GetImmutable(v)
+		require.True(t, errors.Is(err, ErrVersionPruned), "got %v", err)
+		require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+		var pruned *VersionPrunedError
+		require.True(t, errors.As(err, &pruned))
+		require.Equal(t, hashes[v], pruned.RootHash)
+
+		_, _, err = tree.GetVersionedWithProof([]byte("key1"), v)
+		require.True(t, errors.Is(err, ErrVersionPruned), "got %v", err)
+		h := tree.At(v)
+		require.True(t, errors.Is(h.Err(), ErrVersionPruned), "got %v", h.Err())
+	}
+
+	// Versions which never existed have no stub.
+	stub, err := tree.PrunedVersion(10)
+	require.NoError(t, err)
+	require.Nil(t, stub)
+	_, err = tree.GetImmutable(10)
+	require.Equal(t, ErrVersionDoesNotExist, err)
+
+	reloaded, err := NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	_, err = reloaded.LoadVersion(2)
+	require.True(t, errors.Is(err, ErrVersionPruned), "got %v", err)
+	_, err = reloaded.LazyLoadVersion(3)
+	require.True(t, errors.Is(err, ErrVersionPruned), "got %v", err)
+
+	// Rolled back versions can be saved again, so their stubs are removed.
+	require.NoError(t, tree.DeleteVersion(5))
+	_, err = reloaded.LoadVersionForOverwriting(4)
+	require.NoError(t, err)
+	stub, err = reloaded.PrunedVersion(5)
+	require.NoError(t, err)
+	require.Nil(t, stub)
+	stub, err = reloaded.PrunedVersion(3)
+	require.NoError(t, err)
+	require.NotNil(t, stub)
+}
+
+func TestPrunedStubs_Disabled(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	for v := 0; v < 3; v++ {
+		tree.Set([]byte("key"), []byte{byte(v)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(1))
+	stub, err := tree.PrunedVersion(1)
+	require.NoError(t, err)
+	require.Nil(t, stub)
+	_, err = tree.GetImmutable(1)
+	require.Equal(t, ErrVersionDoesNotExist, err)
+}
@@ -0,0 +1,176 @@
+package iavl
+
+import (
+	"time"
+)
+
+// PruningPolicy decides which versions are deleted automatically after each SaveVersion. A
+// version is kept if any of the configured rules keeps it, and the latest version is always kept.
+// A zero PruningPolicy keeps all versions.
+type PruningPolicy struct {
+	// KeepRecent keeps the given number of most recent versions, including the latest one.
+	KeepRecent int64
+
+	// KeepEvery keeps every version which is a multiple of KeepEvery, e.g. snapshot versions.
+	KeepEvery int64
+
+	// KeepWithin keeps versions whose time, as given by VersionTime, is within the given duration
+	// of the time of the latest version. Versions with unknown times are kept.
+	KeepWithin time.Duration
+
+	// VersionTime maps a version to its time (e.g. the block time), returning false if unknown.
+	// Using the time of the latest version rather than the wall clock keeps pruning deterministic.
+	// If nil, the times recorded with MutableTree.SetVersionMetadata are used for automatic
+	// pruning, while ShouldKeep ignores KeepWithin.
+	VersionTime func(version int64) (time.Time, bool)
+}
+
+// isEnabled returns true if the policy may prune any versions.
+func (p *PruningPolicy) isEnabled() bool {
+	return p != nil && (p.KeepRecent > 0 || p.KeepEvery > 0 || (p.KeepWithin > 0 && p.VersionTime != nil))
+}
+
+// ShouldKeep returns whether the policy keeps the given version when latest is the latest version.
+func (p *PruningPolicy) ShouldKeep(version, latest int64) bool {
+	if !p.isEnabled() || version >= latest {
+		return true
+	}
+	if p.KeepRecent > 0 && latest-version < p.KeepRecent {
+		return true
+	}
+	if p.KeepEvery > 0 && version%p.KeepEvery == 0 {
+		return true
+	}
+	if p.KeepWithin > 0 && p.VersionTime != nil {
+		latestTime, ok := p.VersionTime(latest)
+		if !ok {
+			return true
+		}
+		versionTime, ok := p.VersionTime(version)
+		if !ok || latestTime.Sub(versionTime) < p.KeepWithin {
+			return true
+		}
+	}
+	return false
+}
+
+// keepsForever returns true if the policy keeps the version however many versions follow it.
+func (p *PruningPolicy) keepsForever(version int64) bool {
+	return p.KeepEvery > 0 && version%p.KeepEvery == 0
+}
+
+// keepsFrom returns true if the policy keeps the version because of KeepRecent, or because of
+// KeepWithin with both its time and the time of the latest version known, in which case all later
+// versions are kept too.
+func (p *PruningPolicy) keepsFrom(version, latest int64) bool {
+	if version >= latest || (p.KeepRecent > 0 && latest-version < p.KeepRecent) {
+		return true
+	}
+	if p.KeepWithin > 0 && p.VersionTime != nil {
+		latestTime, ok := p.VersionTime(latest)
+		if !ok {
+			return false
+		}
+		versionTime, ok := p.VersionTime(version)
+		return ok && latestTime.Sub(versionTime) < p.KeepWithin
+	}
+	return false
+}
+
+// MaintenanceError returns the error of the automatic pruning or cold node demotion run by the
+// last SaveVersion, or nil. They run once the version is committed, so their failure doesn't fail
+// SaveVersion, and the versions left over are pruned or demoted by later saves.
+func (tree *MutableTree) MaintenanceError() error {
+	return tree.maintenanceErr
+}
+
+// prune deletes all versions not kept by the configured pruning policy. Versions with active
+// readers are skipped, and will be pruned by a later call once released.
+func (tree *MutableTree) prune() error {
+	return tree.pruneWith(tree.ndb.opts.Pruning)
+}
+
+// pruneWith deletes all versions not kept by the given pruning policy, see prune. The policy must
+// be the same for all calls on a tree. Only the versions which may have become prunable since the
+// last call are visited: those from the prune cursor, below which all versions were deleted or are
+// kept forever, and those skipped before because of readers, retention options or unknown times.
+func (tree *MutableTree) pruneWith(policy *PruningPolicy) error {
+	if policy != nil && policy.KeepWithin > 0 && policy.VersionTime == nil {
+		withMetadata := *policy
+		withMetadata.VersionTime = tree.versionTime
+		policy = &withMetadata
+	}
+	if !policy.isEnabled() {
+		return nil
+	}
+
+	var skipped, versions []int64
+	var total int64
+	err := tree.withVersionIndex(func(idx *versionIndex) {
+		total = int64(len(idx.versions))
+		for _, version := range tree.pruneSkipped {
+			if idx.contains(version) {
+				skipped = append(skipped, version)
+			}
+		}
+		versions = append(versions, idx.versions[idx.search(tree.pruneCursor):]...)
+	})
+	if err != nil {
+		return err
+	}
+	latest := tree.version
+	tree.pruneSkipped = nil
+
+	// Versions protected by the retention options are kept, rather than failing the deletion.
+	deletable := total - tree.ndb.opts.MinRetainVersions
+	prunable := func(version int64) bool {
+		if deletable > 0 && !tree.ndb.hasVersionReaders(version) && !tree.ndb.isProtectedVersion(version) {
+			deletable--
+			return true
+		}
+		tree.pruneSkipped = append(tree.pruneSkipped, version)
+		return false
+	}
+
+	for _, version := range skipped {
+		if policy.ShouldKeep(version, latest) {
+			tree.pruneSkipped = append(tree.pruneSkipped, version)
+		} else if prunable(version) {
+			if err := tree.DeleteVersionsRange(version, version+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Delete contiguous runs of existing versions as a single range, so that orphans are moved
+	// or deleted in one pass per run. Versions kept by KeepRecent or KeepWithin are followed by
+	// kept versions only, so the scan stops at the first one. Versions kept only because their
+	// time is unknown are skipped, and visited again by later calls.
+	from, to := int64(-1), int64(-1)
+	for _, version := range versions {
+		forever := policy.keepsForever(version)
+		if !forever && policy.keepsFrom(version, latest) {
+			break
+		}
+		tree.pruneCursor = version + 1
+		if !forever && policy.ShouldKeep(version, latest) {
+			tree.pruneSkipped = append(tree.pruneSkipped, version)
+		} else if !forever && prunable(version) {
+			if from < 0 {
+				from = version
+			}
+			to = version + 1
+			continue
+		}
+		if from >= 0 {
+			if err := tree.DeleteVersionsRange(from, to); err != nil {
+				return err
+			}
+			from = -1
+		}
+	}
+	if from >= 0 {
+		return tree.DeleteVersionsRange(from, to)
+	}
+	return nil
+}
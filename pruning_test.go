@@ -0,0 +1,182 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/tendermint/tm-db"
+)
+
+func TestPruningPolicy_ShouldKeep(t *testing.T) {
+	genesis := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	versionTime := func(version int64) (time.Time, bool) {
+		if version == 3 {
+			return time.Time{}, false
+		}
+		return genesis.Add(time.Duration(version) * time.Minute), true
+	}
+
+	testcases := map[string]struct {
+		policy *PruningPolicy
+		kept   []int64
+	}{
+		"nil":          {nil, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		"zero":         {&PruningPolicy{}, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		"recent":       {&PruningPolicy{KeepRecent: 3}, []int64{8, 9, 10}},
+		"every":        {&PruningPolicy{KeepEvery: 4}, []int64{4, 8, 10}},
+		"recent every": {&PruningPolicy{KeepRecent: 2, KeepEvery: 4}, []int64{4, 8, 9, 10}},
+		"within": {
+			&PruningPolicy{KeepWithin: 4 * time.Minute, VersionTime: versionTime},
+			[]int64{3, 7, 8, 9, 10},
+		},
+		"within without time": {&PruningPolicy{KeepWithin: time.Minute}, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			kept := []int64{}
+			for v := int64(1); v <= 10; v++ {
+				if tc.policy.ShouldKeep(v, 10) {
+					kept = append(kept, v)
+				}
+			}
+			require.Equal(t, tc.kept, kept)
+		})
+	}
+}
+
+func TestMutableTree_SaveVersionPrunes(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{
+		Pruning: &PruningPolicy{KeepRecent: 2, KeepEvery: 5},
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= 12; i++ {
+		tree.Set([]byte(fmt.Sprintf("k%d", i%4)), []byte(fmt.Sprintf("v%d", i)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{5, 10, 11, 12}, tree.AvailableVersions())
+
+	// Pruned versions are gone from disk, kept versions are fully readable.
+	for _, version := range []int64{5, 10, 11} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.EqualValues(t, 4, itree.Size())
+		require.Equal(t, []byte(fmt.Sprintf("v%d", version)), itree.Get([]byte(fmt.Sprintf("k%d", version%4))))
+	}
+	_, err = tree.GetImmutable(9)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// A version with active readers is only pruned once released.
+	itree, err := tree.GetImmutable(11)
+	require.NoError(t, err)
+	exporter := itree.Export()
+	tree.Set([]byte("k0"), []byte("v13"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 11, 12, 13}, tree.AvailableVersions())
+	exporter.Close()
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 13, 14}, tree.AvailableVersions())
+
+	// Reloading from disk yields the same versions.
+	reloaded, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{5, 10, 13, 14}, reloaded.AvailableVersions())
+}
+
+func TestMutableTree_KeepEveryPruningRelinksOrphans(t *testing.T) {
+	r := rand.New(rand.NewSource(1)) // nolint:gosec
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		Pruning: &PruningPolicy{KeepRecent: 1, KeepEvery: 10},
+	})
+	require.NoError(t, err)
+
+	mirrors := map[int64]map[string]string{}
+	mirror := map[string]string{}
+	for v := 1; v <= 55; v++ {
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%d", r.Intn(50))
+			if r.Intn(4) == 0 {
+				tree.Remove([]byte(key))
+				delete(mirror, key)
+			} else {
+				value := fmt.Sprintf("v%d", r.Intn(1000))
+				tree.Set([]byte(key), []byte(value))
+				mirror[key] = value
+			}
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		mirrors[version] = make(map[string]string, len(mirror))
+		for k, v := range mirror {
+			mirrors[version][k] = v
+		}
+	}
+	require.Equal(t, []int{10, 20, 30, 40, 50, 55}, tree.AvailableVersions())
+
+	// Every kept version is fully readable, and no nodes are leaked.
+	reachable := map[string]bool{}
+	for _, version := range tree.AvailableVersions() {
+		itree, err := tree.GetImmutable(int64(version))
+		require.NoError(t, err)
+		leaves := map[string]string{}
+		itree.root.traverse(itree, true, func(node *Node) bool {
+			reachable[string(node.hash)] = true
+			if node.isLeaf() {
+				leaves[string(node.key)] = string(node.value)
+			}
+			return false
+		})
+		require.Equal(t, mirrors[int64(version)], leaves, "version %d", version)
+	}
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	require.Len(t, nodes, len(reachable))
+
+	// Deleting snapshot versions out of order keeps the remaining ones intact.
+	require.NoError(t, tree.DeleteVersionsRange(30, 31))
+	require.NoError(t, tree.DeleteVersionsRange(10, 21))
+	for _, version := range []int64{40, 50, 55} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		leaves := map[string]string{}
+		itree.Iterate(func(key, value []byte) bool {
+			leaves[string(key)] = string(value)
+			return false
+		})
+		require.Equal(t, mirrors[version], leaves, "version %d", version)
+	}
+}
+
+func TestMutableTree_PruningUnknownVersionTimes(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		Pruning: &PruningPolicy{KeepRecent: 2, KeepWithin: time.Minute},
+	})
+	require.NoError(t, err)
+
+	// Versions 2 and 3 have no metadata, so their times are unknown and they are kept, but they
+	// don't keep later versions from being pruned.
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 8; i++ {
+		if i != 2 && i != 3 {
+			require.NoError(t, tree.SetVersionMetadata(int64(i), VersionMetadata{
+				Time: start.Add(time.Duration(i) * 30 * time.Second),
+			}))
+		}
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		require.NoError(t, tree.MaintenanceError())
+	}
+	require.Equal(t, []int{2, 3, 7, 8}, tree.AvailableVersions())
+}
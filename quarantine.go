@@ -0,0 +1,204 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNodeMissing is matched by errors returned for nodes which are missing from the database or
+// can't be decoded, see Options.RecoveryMode.
+var ErrNodeMissing = errors.New("node missing")
+
+// NodeMissingError is returned in recovery mode for a node which is missing from the database or
+// can't be decoded. It matches ErrNodeMissing with errors.Is.
+type NodeMissingError struct {
+	Hash  []byte
+	Cause error
+}
+
+func (e *NodeMissingError) Error() string {
+	return fmt.Sprintf("node %X is missing: %v", e.Hash, e.Cause)
+}
+
+// Is implements errors.Is for ErrNodeMissing.
+func (e *NodeMissingError) Is(target error) bool {
+	return target == ErrNodeMissing
+}
+
+// Unwrap returns the cause.
+func (e *NodeMissingError) Unwrap() error {
+	return e.Cause
+}
+
+// nodeMissing is called by GetNode for a broken node. In recovery mode, it quarantines the node
+// and panics with a *NodeMissingError, which is recovered into an error by the methods returning
+// errors. Otherwise, it returns and GetNode panics as usual.
+func (ndb *nodeDB) nodeMissing(hash []byte, cause error) {
+	if !ndb.opts.RecoveryMode {
+		return
+	}
+	ndb.quarantine(hash)
+	panic(&NodeMissingError{Hash: hash, Cause: cause})
+}
+
+// quarantine records a broken node, to be repaired by RepairFromPeerNodes.
+func (ndb *nodeDB) quarantine(hash []byte) {
+	ndb.quarantineMtx.Lock()
+	defer ndb.quarantineMtx.Unlock()
+	if ndb.quarantined == nil {
+		ndb.quarantined = map[string]bool{}
+	}
+	ndb.quarantined[string(hash)] = true
+}
+
+// recoverNodeMissing recovers a *NodeMissingError panic raised by GetNode in recovery mode into
+// the given error. It must be deferred directly.
+func recoverNodeMissing(err *error) {
+	if r := recover(); r != nil {
+		if e, ok := r.(*NodeMissingError); ok {
+			*err = e
+			return
+		}
+		panic(r)
+	}
+}
+
+// QuarantinedNodes returns the hashes of the broken nodes encountered in recovery mode, or found
+// by FindMissingNodes, which have not been repaired, in sorted order.
+func (tree *MutableTree) QuarantinedNodes() [][]byte {
+	ndb := tree.ndb
+	ndb.quarantineMtx.Lock()
+	defer ndb.quarantineMtx.Unlock()
+	hashes := make([][]byte, 0, len(ndb.quarantined))
+	for hash := range ndb.quarantined {
+		hashes = append(hashes, []byte(hash))
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i], hashes[j]) < 0 })
+	return hashes
+}
+
+// FindMissingNodes scans all nodes of a saved version, and quarantines and returns the hashes of
+// nodes which are missing or can't be decoded. Subtrees below broken nodes can't be scanned until
+// the nodes are repaired.
+func (tree *MutableTree) FindMissingNodes(version int64) ([][]byte, error) {
+	rootHash, err := tree.ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootHash == nil {
+		return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %v", version)
+	}
+
+	var missing [][]byte
+	stack := [][]byte{}
+	if len(rootHash) > 0 {
+		stack = append(stack, rootHash)
+	}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node, err := tree.ndb.readNode(hash)
+		if errors.Is(err, ErrNodeMissing) {
+			tree.ndb.quarantine(hash)
+			missing = append(missing, hash)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if !node.isLeaf() {
+			stack = append(stack, node.rightHash, node.leftHash)
+		}
+	}
+	return missing, nil
+}
+
+// readNode reads and decodes a node from the database, bypassing the cache so that nodes which
+// were cached before being lost are found, returning a *NodeMissingError if it is missing or
+// can't be decoded.
+func (ndb *nodeDB) readNode(hash []byte) (*Node, error) {
+	buf, err := ndb.getNodeBytes(ndb.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = ndb.decryptValue(buf)
+	if err != nil {
+		return nil, &NodeMissingError{Hash: hash, Cause: err}
+	}
+	return decodeNodeWithHash(hash, buf)
+}
+
+// decodeNodeWithHash decodes a node, verifying that it has the given hash.
+func decodeNodeWithHash(hash, buf []byte) (*Node, error) {
+	if buf == nil {
+		return nil, &NodeMissingError{Hash: hash, Cause: errors.New("not found")}
+	}
+	node, err := MakeNode(buf)
+	if err != nil {
+		return nil, &NodeMissingError{Hash: hash, Cause: errors.Wrap(err, "decoding node")}
+	}
+	if computed := node._hash(); !bytes.Equal(computed, hash) {
+		return nil, &NodeMissingError{Hash: hash, Cause: errors.Errorf("node has hash %X", computed)}
+	}
+	return node, nil
+}
+
+// RepairFromPeerNodes backfills the quarantined nodes, and any missing nodes below them, with the
+// encoded nodes returned by fetch, e.g. from another replica. fetch returns nil for unknown nodes.
+// Fetched nodes are only written if they have the expected hash. It returns the number of nodes
+// repaired, and an error matching ErrNodeMissing if some nodes couldn't be repaired.
+func (tree *MutableTree) RepairFromPeerNodes(fetch func(hash []byte) []byte) (int, error) {
+	ndb := tree.ndb
+	repaired := 0
+	var failed [][]byte
+	stack := tree.QuarantinedNodes()
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		buf := fetch(hash)
+		node, err := decodeNodeWithHash(hash, buf)
+		if err != nil {
+			failed = append(failed, hash)
+			continue
+		}
+		buf, err = ndb.encryptValue(buf)
+		if err != nil {
+			return repaired, err
+		}
+		ndb.mtx.Lock()
+		err = ndb.batch.Set(ndb.nodeKey(hash), buf)
+		ndb.mtx.Unlock()
+		if err != nil {
+			return repaired, err
+		}
+		repaired++
+		ndb.quarantineMtx.Lock()
+		delete(ndb.quarantined, string(hash))
+		ndb.quarantineMtx.Unlock()
+
+		// Children of a missing node may be missing too.
+		if !node.isLeaf() {
+			for _, child := range [][]byte{node.leftHash, node.rightHash} {
+				if _, err := ndb.readNode(child); errors.Is(err, ErrNodeMissing) {
+					stack = append(stack, child)
+				} else if err != nil {
+					return repaired, err
+				}
+			}
+		}
+	}
+	if err := ndb.Commit(); err != nil {
+		return repaired, err
+	}
+
+	for _, hash := range failed {
+		ndb.quarantine(hash)
+	}
+	if len(failed) > 0 {
+		return repaired, errors.Wrapf(ErrNodeMissing, "%v nodes could not be repaired", len(failed))
+	}
+	return repaired, nil
+}
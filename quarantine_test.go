@@ -0,0 +1,131 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRecoveryMode(t *testing.T) {
+	newReplica := func() db.DB {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTree(memDB, 0)
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte{byte(i)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		return memDB
+	}
+	memDB, peerDB := newReplica(), newReplica()
+	peer, err := NewMutableTree(peerDB, 0)
+	require.NoError(t, err)
+	_, err = peer.Load()
+	require.NoError(t, err)
+
+	// Delete the left child of the root, and corrupt a node below the right child.
+	root := peer.root
+	broken := root.getRightNode(peer.ImmutableTree).getLeftNode(peer.ImmutableTree)
+	require.NoError(t, memDB.Delete(peer.ndb.nodeKey(root.leftHash)))
+	require.NoError(t, memDB.Set(peer.ndb.nodeKey(broken.hash), []byte{0xff}))
+
+	// Without recovery mode, reading the nodes panics as usual.
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Panics(t, func() { _, _ = tree.GetMembershipProof([]byte("key000")) })
+	require.Empty(t, tree.QuarantinedNodes())
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{RecoveryMode: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	_, err = tree.GetMembershipProof([]byte("key000"))
+	require.True(t, errors.Is(err, ErrNodeMissing))
+	var missingErr *NodeMissingError
+	require.True(t, errors.As(err, &missingErr))
+	require.Equal(t, root.leftHash, missingErr.Hash)
+	require.Equal(t, [][]byte{root.leftHash}, tree.QuarantinedNodes())
+
+	missing, err := tree.FindMissingNodes(1)
+	require.NoError(t, err)
+	require.ElementsMatch(t, [][]byte{root.leftHash, broken.hash}, missing)
+	require.ElementsMatch(t, missing, tree.QuarantinedNodes())
+
+	// Nodes which can't be fetched, or don't match their hash, are not repaired.
+	repaired, err := tree.RepairFromPeerNodes(func(hash []byte) []byte {
+		bz, err := peerDB.Get(peer.ndb.nodeKey(root.rightHash))
+		require.NoError(t, err)
+		return bz
+	})
+	require.True(t, errors.Is(err, ErrNodeMissing))
+	require.Zero(t, repaired)
+	require.ElementsMatch(t, missing, tree.QuarantinedNodes())
+
+	repaired, err = tree.RepairFromPeerNodes(func(hash []byte) []byte {
+		bz, err := peerDB.Get(peer.ndb.nodeKey(hash))
+		require.NoError(t, err)
+		return bz
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, repaired)
+	require.Empty(t, tree.QuarantinedNodes())
+
+	missing, err = tree.FindMissingNodes(1)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+
+	// A new tree reads the repaired nodes.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{RecoveryMode: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		proof, err := tree.GetMembershipProof([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.NotNil(t, proof)
+	}
+}
+
+func TestRecoveryMode_MissingRoot(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	tree.Set([]byte("b"), []byte{2})
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(hash)))
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{RecoveryMode: true})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.True(t, errors.Is(err, ErrNodeMissing))
+	require.Equal(t, [][]byte{hash}, tree.QuarantinedNodes())
+}
+
+func TestFindMissingNodes_Cached(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 100, &Options{RecoveryMode: true})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// A node lost from the database is found even while it is cached.
+	node := tree.root.getLeftNode(tree.ImmutableTree)
+	_, ok := tree.ndb.nodeCache.Get(node.hash)
+	require.True(t, ok)
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(node.hash)))
+	missing, err := tree.FindMissingNodes(1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{node.hash}, missing)
+}
@@ -0,0 +1,73 @@
+package iavl
+
+// rankCacheEntry is a leaf of a saved version cached by Options.RankCacheSize. Entries for
+// missing keys have a nil key and value, and the index the key would have.
+type rankCacheEntry struct {
+	index int64
+	key   []byte
+	value []byte
+}
+
+// rankCacheKeyByKey returns the rank cache key for a key lookup in a saved version.
+func rankCacheKeyByKey(version int64, key []byte) []byte {
+	return append(append([]byte{'k'}, formatUint64(uint64(version))...), key...)
+}
+
+// rankCacheKeyByIndex returns the rank cache key for an index lookup in a saved version.
+func rankCacheKeyByIndex(version int64, index int64) []byte {
+	return append(append([]byte{'i'}, formatUint64(uint64(version))...), formatUint64(uint64(index))...)
+}
+
+// invalidateRankCache drops the cached leaf ranks of the given version, which is about to be
+// saved, in case the version number was used by versions since deleted.
+func (ndb *nodeDB) invalidateRankCache(version int64) {
+	if ndb.rankCache == nil {
+		return
+	}
+	v := string(formatUint64(uint64(version)))
+	ndb.rankCache.RemoveIf(func(key string, _ interface{}) bool {
+		return key[1:1+len(v)] == v
+	})
+}
+
+// rankCacheEnabled returns true if leaf ranks of the tree can be cached. Like existence proofs,
+// only ranks in saved versions are cached, since the version number of the working tree doesn't
+// identify its contents.
+func (t *ImmutableTree) rankCacheEnabled() bool {
+	return t.ndb != nil && t.ndb.rankCache != nil && t.root != nil && t.root.persisted
+}
+
+// getWithIndexCached is GetWithIndex using the rank cache.
+func (t *ImmutableTree) getWithIndexCached(key []byte) (int64, []byte) {
+	cacheKey := rankCacheKeyByKey(t.version, key)
+	if cached, ok := t.ndb.rankCache.Get(cacheKey); ok {
+		entry := cached.(*rankCacheEntry)
+		return entry.index, entry.value
+	}
+
+	index, value := t.root.get(t, key)
+	entry := &rankCacheEntry{index: index, value: value}
+	if value != nil {
+		entry.key = cp(key)
+		t.ndb.rankCache.Add(rankCacheKeyByIndex(t.version, index), entry)
+	}
+	t.ndb.rankCache.Add(cacheKey, entry)
+	return index, value
+}
+
+// getByIndexCached is GetByIndex using the rank cache.
+func (t *ImmutableTree) getByIndexCached(index int64) ([]byte, []byte) {
+	cacheKey := rankCacheKeyByIndex(t.version, index)
+	if cached, ok := t.ndb.rankCache.Get(cacheKey); ok {
+		entry := cached.(*rankCacheEntry)
+		return entry.key, entry.value
+	}
+
+	key, value := t.root.getByIndex(t, index)
+	if key != nil {
+		entry := &rankCacheEntry{index: index, key: key, value: value}
+		t.ndb.rankCache.Add(cacheKey, entry)
+		t.ndb.rankCache.Add(rankCacheKeyByKey(t.version, key), entry)
+	}
+	return key, value
+}
@@ -0,0 +1,113 @@
+package iavl
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+)
+
+// This file contains a low-level API to read and write encoded nodes directly, for tools such as
+// repair, replication and analytics. It bypasses the tree: SetRawNode doesn't update roots,
+// orphans or reference counts, so a written node is only reachable from versions which already
+// reference its hash, and is never pruned otherwise. Most users should not need it.
+
+// GetRawNode returns the encoded node with the given hash, as decoded by DecodeNode, or nil if it
+// doesn't exist. Demoted nodes are read from the cold tier, and encrypted nodes are decrypted.
+func (t *ImmutableTree) GetRawNode(hash []byte) ([]byte, error) {
+	ndb := t.ndb
+	ndb.mtx.RLock()
+	defer ndb.mtx.RUnlock()
+
+	buf, err := ndb.getNodeBytes(ndb.db, hash)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return ndb.decryptValue(buf)
+}
+
+// SetRawNode writes the encoded node with the given hash to the database, e.g. one returned by
+// GetRawNode for another database. The node must decode and have the given hash. It is
+// encrypted if the tree uses encryption, and removed from the quarantined nodes if it was
+// broken, see Options.RecoveryMode.
+func (tree *MutableTree) SetRawNode(hash, buf []byte) error {
+	node, err := DecodeNode(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(node.hash, hash) {
+		return errors.Errorf("node has hash %X, expected %X", node.hash, hash)
+	}
+	ndb := tree.ndb
+	buf, err = ndb.encryptValue(buf)
+	if err != nil {
+		return err
+	}
+	ndb.mtx.Lock()
+	err = ndb.batch.Set(ndb.nodeKey(hash), buf)
+	ndb.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+	ndb.quarantineMtx.Lock()
+	delete(ndb.quarantined, string(hash))
+	ndb.quarantineMtx.Unlock()
+	return nil
+}
+
+// DecodeNode decodes an encoded node, as returned by GetRawNode, and computes its hash.
+func DecodeNode(buf []byte) (*Node, error) {
+	node, err := MakeNode(buf)
+	if err != nil {
+		return nil, err
+	}
+	node._hash()
+	return node, nil
+}
+
+// Key returns the key of the node. For inner nodes, it is the least key of the right subtree.
+func (node *Node) Key() []byte {
+	return node.key
+}
+
+// Value returns the value of a leaf node, or nil for inner nodes.
+func (node *Node) Value() []byte {
+	return node.value
+}
+
+// Version returns the version the node was created at.
+func (node *Node) Version() int64 {
+	return node.version
+}
+
+// Height returns the height of the subtree of the node, which is 0 for leaf nodes.
+func (node *Node) Height() int8 {
+	return node.height
+}
+
+// Size returns the number of leaf nodes in the subtree of the node.
+func (node *Node) Size() int64 {
+	return node.size
+}
+
+// Hash returns the hash of the node, or nil if it hasn't been computed, e.g. by MakeNode.
+func (node *Node) Hash() []byte {
+	return node.hash
+}
+
+// LeftHash returns the hash of the left child of an inner node, or nil for leaf nodes.
+func (node *Node) LeftHash() []byte {
+	return node.leftHash
+}
+
+// RightHash returns the hash of the right child of an inner node, or nil for leaf nodes.
+func (node *Node) RightHash() []byte {
+	return node.rightHash
+}
+
+// IsLeaf returns whether the node is a leaf node.
+func (node *Node) IsLeaf() bool {
+	return node.isLeaf()
+}
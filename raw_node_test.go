@@ -0,0 +1,87 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRawNodes(t *testing.T) {
+	newReplica := func(opts *Options) (db.DB, *MutableTree) {
+		memDB := db.NewMemDB()
+		tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+		require.NoError(t, err)
+		for i := 0; i < 50; i++ {
+			tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		return memDB, tree
+	}
+	_, peer := newReplica(nil)
+	memDB, tree := newReplica(&Options{RecoveryMode: true})
+
+	root := peer.root
+	buf, err := peer.GetRawNode(root.hash)
+	require.NoError(t, err)
+	node, err := DecodeNode(buf)
+	require.NoError(t, err)
+	require.Equal(t, root.hash, node.Hash())
+	require.Equal(t, root.key, node.Key())
+	require.Nil(t, node.Value())
+	require.Equal(t, root.version, node.Version())
+	require.Equal(t, root.height, node.Height())
+	require.EqualValues(t, 50, node.Size())
+	require.Equal(t, root.leftHash, node.LeftHash())
+	require.Equal(t, root.rightHash, node.RightHash())
+	require.False(t, node.IsLeaf())
+
+	buf, err = peer.GetRawNode(make([]byte, hashSize))
+	require.NoError(t, err)
+	require.Nil(t, buf)
+	_, err = DecodeNode([]byte{0xff})
+	require.Error(t, err)
+
+	// Break a node, and repair it from the peer.
+	require.NoError(t, memDB.Delete(tree.ndb.nodeKey(root.leftHash)))
+	tree.ndb.nodeCache = newLRUCache(0)
+	missing, err := tree.FindMissingNodes(1)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{root.leftHash}, missing)
+
+	buf, err = peer.GetRawNode(root.leftHash)
+	require.NoError(t, err)
+	require.Error(t, tree.SetRawNode(root.rightHash, buf))
+	require.NoError(t, tree.SetRawNode(root.leftHash, buf))
+	require.Empty(t, tree.QuarantinedNodes())
+	missing, err = tree.FindMissingNodes(1)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, []byte{0}, tree.Get([]byte("key00")))
+}
+
+func TestRawNodes_Encryption(t *testing.T) {
+	enc, err := NewAESGCMEncryption(1, map[byte][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{Encryption: enc})
+	require.NoError(t, err)
+	tree.Set([]byte("key"), []byte("value"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	buf, err := tree.GetRawNode(tree.root.hash)
+	require.NoError(t, err)
+	node, err := DecodeNode(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), node.Value())
+	require.True(t, node.IsLeaf())
+
+	require.NoError(t, tree.SetRawNode(tree.root.hash, buf))
+	stored, err := memDB.Get(tree.ndb.nodeKey(tree.root.hash))
+	require.NoError(t, err)
+	require.NotEqual(t, buf, stored)
+}
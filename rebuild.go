@@ -0,0 +1,219 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// RebuildFromLeaves rebuilds the inner nodes of a saved version from its leaves, for recovering
+// databases where inner nodes are corrupted or missing but leaves are intact, and returns the new
+// root hash. The leaves of the version are found by scanning all stored nodes, as the leaves of
+// the version or earlier which were not orphaned before it. Stored nodes which can't be decoded
+// are quarantined and skipped, see QuarantinedNodes. For the latest version, the leaves are
+// checked against the fast nodes, if any, before anything is written.
+//
+// The leaves are joined into a balanced tree of inner nodes with the given version, which
+// replaces the root of the version. Its shape, and thus the root hash, generally differs from the
+// original one, so all nodes replicating the tree must rebuild the version the same way. The
+// original inner nodes are not deleted. It can be called before loading the tree, e.g. when
+// loading fails, and the tree must be loaded again afterwards to use the rebuilt version.
+// Rebuilding is not supported with Options.RefCountGC, nor for versions with nodes demoted to the
+// cold tier.
+func (tree *MutableTree) RebuildFromLeaves(version int64) ([]byte, error) {
+	ndb := tree.ndb
+	if ndb.opts.RefCountGC {
+		return nil, errors.New("rebuilding versions is not supported with reference counting")
+	}
+	if ndb.opts.ColdTier != nil && version <= ndb.coldDemoted {
+		return nil, errors.Errorf("version %v may have nodes demoted to the cold tier", version)
+	}
+	rootHash, err := ndb.getRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	if rootHash == nil {
+		return nil, errors.Wrapf(ErrVersionDoesNotExist, "version %v", version)
+	}
+
+	leaves, err := ndb.leavesAt(version)
+	if err != nil {
+		return nil, err
+	}
+	latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	latest := version == latestVersion
+	if latest && ndb.hasUpgradedToFastStorage() {
+		if err := ndb.checkLeavesWithFastNodes(leaves); err != nil {
+			return nil, err
+		}
+	}
+
+	var inner []*Node
+	var root *Node
+	if len(leaves) > 0 {
+		root = buildFromLeaves(tree.ImmutableTree, leaves, version, &inner)
+	}
+
+	// Intact stored nodes already have their lifecycle, and broken ones are rewritten in place.
+	// New nodes of an older version are only used by it, so they are orphaned at it and deleted
+	// with it, while those of the latest version are orphaned by later versions as usual.
+	var ops []BatchOp
+	var orphans [][]byte
+	for _, node := range inner {
+		exists, err := ndb.Has(node.hash)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			if _, err := ndb.readNode(node.hash); err == nil {
+				continue
+			} else if !errors.Is(err, ErrNodeMissing) {
+				return nil, err
+			}
+		} else if !latest {
+			orphans = append(orphans, node.hash)
+		}
+		bz, err := encodeNode(node)
+		if err != nil {
+			return nil, err
+		}
+		if bz, err = ndb.encryptValue(bz); err != nil {
+			return nil, err
+		}
+		ops = append(ops, BatchOp{Key: ndb.nodeKey(node.hash), Value: bz})
+	}
+	newRootHash := []byte{}
+	if root != nil {
+		newRootHash = root.hash
+	}
+
+	ndb.mtx.Lock()
+	err = func() error {
+		for _, op := range ops {
+			if err := ndb.batch.Set(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+		for _, hash := range orphans {
+			ndb.saveOrphan(hash, version, version)
+		}
+		return ndb.writeRoot(version, rootHash, newRootHash)
+	}()
+	ndb.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := ndb.Commit(); err != nil {
+		return nil, err
+	}
+	return newRootHash, nil
+}
+
+// leavesAt returns the stored leaves of a version in key order: the leaves of the version or
+// earlier which were not orphaned before it. Nodes which can't be decoded are quarantined and
+// skipped.
+func (ndb *nodeDB) leavesAt(version int64) ([]*Node, error) {
+	orphaned := map[string]bool{}
+	err := ndb.traverseOrphans(func(k, v []byte) error {
+		var toVersion, fromVersion int64
+		orphanKeyFormat.Scan(k, &toVersion, &fromVersion)
+		if toVersion < version {
+			orphaned[string(v)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var leaves []*Node
+	err = ndb.traversePrefix(nodeKeyFormat.Key(), func(k, v []byte) error {
+		hash := append([]byte(nil), k[1:]...)
+		if orphaned[string(hash)] {
+			return nil
+		}
+		buf, err := ndb.decryptValue(v)
+		if err == nil {
+			var node *Node
+			if node, err = decodeNodeWithHash(hash, buf); err == nil {
+				if node.isLeaf() && node.version <= version {
+					node.hash = hash
+					leaves = append(leaves, node)
+				}
+				return nil
+			}
+		}
+		ndb.quarantine(hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(leaves, func(i, j int) bool { return bytes.Compare(leaves[i].key, leaves[j].key) < 0 })
+	for i := 1; i < len(leaves); i++ {
+		if bytes.Equal(leaves[i-1].key, leaves[i].key) {
+			return nil, errors.Errorf("key %X has leaves of versions %v and %v at version %v",
+				leaves[i].key, leaves[i-1].version, leaves[i].version, version)
+		}
+	}
+	return leaves, nil
+}
+
+// checkLeavesWithFastNodes checks that the leaves of the latest version, in key order, have the
+// keys and values of the fast nodes, returning an error matching ErrNodeMissing otherwise.
+func (ndb *nodeDB) checkLeavesWithFastNodes(leaves []*Node) error {
+	i := 0
+	err := ndb.traverseFastNodes(func(k, v []byte) error {
+		v, err := ndb.decryptValue(v)
+		if err != nil {
+			return err
+		}
+		fastNode, err := DeserializeFastNode(k[1:], v)
+		if err != nil {
+			return err
+		}
+		if i >= len(leaves) || !bytes.Equal(leaves[i].key, fastNode.key) {
+			return errors.Wrapf(ErrNodeMissing, "no leaf found for fast node of key %X", fastNode.key)
+		}
+		if !bytes.Equal(leaves[i].value, fastNode.value) {
+			return errors.Wrapf(ErrNodeMissing, "leaf of key %X doesn't match its fast node", fastNode.key)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if i < len(leaves) {
+		return errors.Wrapf(ErrNodeMissing, "leaf of key %X has no fast node", leaves[i].key)
+	}
+	return nil
+}
+
+// buildFromLeaves returns a balanced tree of the given sorted leaves, with hashed inner nodes of
+// the given version, which are appended to inner.
+func buildFromLeaves(t *ImmutableTree, leaves []*Node, version int64, inner *[]*Node) *Node {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	mid := len(leaves) / 2
+	left := buildFromLeaves(t, leaves[:mid], version, inner)
+	right := buildFromLeaves(t, leaves[mid:], version, inner)
+	node := &Node{
+		key:       leaves[mid].key,
+		version:   version,
+		leftHash:  left.hash,
+		leftNode:  left,
+		rightHash: right.hash,
+		rightNode: right,
+	}
+	node.calcHeightAndSize(t)
+	node._hash()
+	*inner = append(*inner, node)
+	return node
+}
@@ -0,0 +1,114 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRebuildFromLeaves(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%02d", (i*7+v)%30)), []byte(fmt.Sprintf("v%d-%d", v, i)))
+		}
+		tree.Remove([]byte(fmt.Sprintf("k%02d", v)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	expected := map[int64]map[string]string{}
+	for v := int64(1); v <= 3; v++ {
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		expected[v] = map[string]string{}
+		itree.Iterate(func(k, v []byte) bool {
+			expected[itree.Version()][string(k)] = string(v)
+			return false
+		})
+	}
+
+	// Delete the inner nodes of versions 2 and 3, such that the tree can't be loaded.
+	for _, v := range []int64{2, 3} {
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		itree.root.traverse(itree, true, func(node *Node) bool {
+			if !node.isLeaf() {
+				require.NoError(t, memDB.Delete(tree.ndb.nodeKey(node.hash)))
+			}
+			return false
+		})
+	}
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	_, err = tree.RebuildFromLeaves(4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	for _, v := range []int64{2, 3} {
+		_, err = tree.RebuildFromLeaves(v)
+		require.NoError(t, err)
+	}
+
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for v := int64(1); v <= 3; v++ {
+		itree, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		missing, err := tree.FindMissingNodes(v)
+		require.NoError(t, err)
+		require.Empty(t, missing)
+		actual := map[string]string{}
+		itree.Iterate(func(k, v []byte) bool {
+			actual[string(k)] = string(v)
+			return false
+		})
+		require.Equal(t, expected[v], actual)
+	}
+
+	// The rebuilt versions are saved over and deleted as usual.
+	tree.Set([]byte("k99"), []byte("v"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsRange(1, 4))
+	missing, err := tree.FindMissingNodes(4)
+	require.NoError(t, err)
+	require.Empty(t, missing)
+	require.Equal(t, int(tree.root.size*2-1), countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+}
+
+func TestRebuildFromLeaves_RootHashIndex(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RootHashIndex: true})
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("k99"), []byte("v"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	handle := tree.At(1)
+	require.NoError(t, handle.Err())
+	handle.Release()
+
+	// The rebuilt root replaces the original one in the root hash index and the caches.
+	rebuilt, err := tree.RebuildFromLeaves(1)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, rebuilt)
+	_, err = tree.GetVersionByRootHash(hash)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	version, err := tree.GetVersionByRootHash(rebuilt)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	handle = tree.At(1)
+	require.NoError(t, handle.Err())
+	defer handle.Release()
+	rootHash, err := handle.Hash()
+	require.NoError(t, err)
+	require.Equal(t, rebuilt, rootHash)
+}
@@ -0,0 +1,298 @@
+package iavl
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// refCountStorageKey is the metadata key marking a database whose nodes are garbage
+	// collected by reference counts rather than orphan lifetimes, see Options.RefCountGC. Its
+	// value is the reference count storage version.
+	refCountStorageKey     = "refcount_storage_version"
+	refCountStorageVersion = "1"
+)
+
+// Reference counts are indexed by node hash. The count is the number of saved parent nodes and
+// version roots referencing the node.
+var refCountKeyFormat = NewKeyFormat('c', hashSize) // c<hash>
+
+// ErrRefCountStorage is returned when Options.RefCountGC doesn't match the garbage collection
+// strategy of the database.
+var ErrRefCountStorage = errors.New("reference count storage mismatch")
+
+// loadRefCountStorage loads whether the database uses reference counts. It is loaded lazily, by
+// checkRefCountStorage, since a database can only switch to reference counts.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) loadRefCountStorage() error {
+	bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(refCountStorageKey)))
+	if err != nil || bz == nil {
+		return err
+	}
+	if string(bz) != refCountStorageVersion {
+		return errors.Errorf("unknown reference count storage version %q", bz)
+	}
+	ndb.refCounted = true
+	return nil
+}
+
+// setRefCountStorage marks the database as using reference counts in the batch.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) setRefCountStorage() error {
+	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(refCountStorageKey)), []byte(refCountStorageVersion)); err != nil {
+		return err
+	}
+	ndb.refCounted = true
+	return nil
+}
+
+// checkRefCountStorage checks that Options.RefCountGC matches the database, marking a database
+// without versions as reference counted if enabled.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) checkRefCountStorage() error {
+	if !ndb.refCounted {
+		if err := ndb.loadRefCountStorage(); err != nil {
+			return err
+		}
+	}
+	if ndb.refCounted == ndb.opts.RefCountGC {
+		return nil
+	}
+	if ndb.refCounted {
+		return errors.Wrap(ErrRefCountStorage, "database uses reference counts, but Options.RefCountGC is disabled")
+	}
+	latest, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latest == 0 {
+		return ndb.setRefCountStorage()
+	}
+	return errors.Wrap(ErrRefCountStorage, "database must be migrated to reference counts by loading it")
+}
+
+// getRefCount returns the reference count of a node, including changes not yet written.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) getRefCount(hash []byte) (int64, error) {
+	if count, ok := ndb.refCounts[string(hash)]; ok {
+		return count, nil
+	}
+	bz, err := ndb.db.Get(refCountKeyFormat.Key(hash))
+	if err != nil || bz == nil {
+		return 0, err
+	}
+	if len(bz) != int64Size {
+		return 0, errors.Errorf("invalid reference count for node %X: %X", hash, bz)
+	}
+	return int64(binary.BigEndian.Uint64(bz)), nil
+}
+
+// setRefCount sets the reference count of a node in the batch, deleting it if 0.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) setRefCount(hash []byte, count int64) error {
+	if ndb.refCounts == nil {
+		ndb.refCounts = make(map[string]int64)
+	}
+	ndb.refCounts[string(hash)] = count
+	if count == 0 {
+		return ndb.batch.Delete(refCountKeyFormat.Key(hash))
+	}
+	return ndb.batch.Set(refCountKeyFormat.Key(hash), formatUint64(uint64(count)))
+}
+
+// addRef records a new reference to a node, applied by applyRefs.
+// CONTRACT: only called by the goroutine saving the version.
+func (ndb *nodeDB) addRef(hash []byte) {
+	if ndb.refDeltas == nil {
+		ndb.refDeltas = make(map[string]int64)
+	}
+	ndb.refDeltas[string(hash)]++
+}
+
+// addChildRefs records the references of a newly saved node to its children.
+func (ndb *nodeDB) addChildRefs(node *Node) {
+	if !ndb.opts.RefCountGC || node.isLeaf() {
+		return
+	}
+	ndb.addRef(node.leftHash)
+	ndb.addRef(node.rightHash)
+}
+
+// applyRefs writes the references recorded by addRef to the batch. It is called along with
+// writing the version root, so that the counts land in the same batch as the root.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) applyRefs() error {
+	for hash, delta := range ndb.refDeltas {
+		count, err := ndb.getRefCount([]byte(hash))
+		if err != nil {
+			return err
+		}
+		if err := ndb.setRefCount([]byte(hash), count+delta); err != nil {
+			return err
+		}
+	}
+	ndb.refDeltas = nil
+	return nil
+}
+
+// releaseNode removes a reference to a node. Once a node is no longer referenced it is deleted,
+// and its references to its children are released in turn. The cost is proportional to the
+// number of nodes deleted, regardless of the number of versions.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) releaseNode(hash []byte) error {
+	stack := [][]byte{hash}
+	for len(stack) > 0 {
+		hash := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ndb.throttle != nil {
+			ndb.throttle.charge(1, len(hash))
+		}
+
+		count, err := ndb.getRefCount(hash)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.Errorf("node %X has no reference count", hash)
+		}
+		if count > 1 {
+			if err := ndb.setRefCount(hash, count-1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		node, err := ndb.readNode(hash)
+		if err != nil {
+			return err
+		}
+		if !node.isLeaf() {
+			stack = append(stack, node.leftHash, node.rightHash)
+		}
+		ndb.logger.Debug("releasing node", "hash", hash)
+		if err := ndb.batch.Delete(ndb.nodeKey(hash)); err != nil {
+			return err
+		}
+		if err := ndb.setRefCount(hash, 0); err != nil {
+			return err
+		}
+		ndb.uncacheNode(hash)
+		if err := ndb.flushBatchIfFull(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseRoots releases the given version roots, see releaseNode. Empty roots are skipped.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) releaseRoots(ctx context.Context, roots [][]byte) error {
+	for _, root := range roots {
+		if len(root) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := ndb.releaseNode(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerMigration(&migration{
+		name:    "refcounts",
+		version: 1,
+		needed:  (*nodeDB).needsRefCountMigration,
+		step:    (*nodeDB).migrateRefCounts,
+	})
+}
+
+// needsRefCountMigration returns whether a database using orphan lifetimes must be migrated to
+// reference counts, i.e. if Options.RefCountGC is enabled.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) needsRefCountMigration() (bool, error) {
+	if err := ndb.loadRefCountStorage(); err != nil {
+		return false, err
+	}
+	if !ndb.opts.RefCountGC || ndb.refCounted {
+		return false, ndb.checkRefCountStorage()
+	}
+	if ndb.opts.ColdTier != nil {
+		return false, errors.New("reference counts can't be used with a cold tier")
+	}
+	return true, nil
+}
+
+// migrateRefCounts migrates a chunk of a database using orphan lifetimes to reference counts.
+// The count of every node is accumulated from the saved nodes and version roots referencing it,
+// after which the orphan entries are deleted. The phase of the migration is given by the prefix
+// of the cursor. The database is marked as using reference counts in the final chunk.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) migrateRefCounts(cursor []byte, limit int) ([]byte, int, error) {
+	if cursor == nil {
+		cursor = nodeKeyFormat.Key()
+	}
+	switch cursor[0] {
+	case nodeKeyFormat.prefix:
+		next, keys, err := ndb.migrateRange(cursor, cpIncr(nodeKeyFormat.Key()), limit, func(key, value []byte) error {
+			value, err := ndb.decryptValue(value)
+			if err != nil {
+				return err
+			}
+			node, err := MakeNode(value)
+			if err != nil {
+				return errors.Wrapf(err, "decoding node %X", key[1:])
+			}
+			if node.isLeaf() {
+				return nil
+			}
+			if err := ndb.incrRefCount(node.leftHash); err != nil {
+				return err
+			}
+			return ndb.incrRefCount(node.rightHash)
+		})
+		if err == nil && next == nil {
+			next = rootKeyFormat.Key()
+		}
+		return next, keys, err
+
+	case rootKeyFormat.prefix:
+		next, keys, err := ndb.migrateRange(cursor, cpIncr(rootKeyFormat.Key()), limit, func(_, hash []byte) error {
+			if len(hash) == 0 {
+				return nil
+			}
+			return ndb.incrRefCount(hash)
+		})
+		if err == nil && next == nil {
+			next = orphanKeyFormat.Key()
+		}
+		return next, keys, err
+
+	case orphanKeyFormat.prefix:
+		next, keys, err := ndb.migrateRange(cursor, cpIncr(orphanKeyFormat.Key()), limit, func(key, _ []byte) error {
+			return ndb.batch.Delete(key)
+		})
+		if err == nil && next == nil {
+			err = ndb.setRefCountStorage()
+		}
+		return next, keys, err
+
+	default:
+		return nil, 0, errors.Errorf("invalid reference count migration cursor %X", cursor)
+	}
+}
+
+// incrRefCount increments the reference count of a node in the batch.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) incrRefCount(hash []byte) error {
+	count, err := ndb.getRefCount(hash)
+	if err != nil {
+		return err
+	}
+	return ndb.setRefCount(hash, count+1)
+}
@@ -0,0 +1,139 @@
+package iavl
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// saveRefCountVersions saves versions 1 through n, each updating a few keys and removing one.
+func saveRefCountVersions(t *testing.T, tree *MutableTree, n int) {
+	for v := 1; v <= n; v++ {
+		for i := 0; i < 8; i++ {
+			if (i+v)%3 == 0 {
+				tree.Set([]byte{byte(i)}, []byte(strconv.Itoa(v)))
+			}
+		}
+		tree.Remove([]byte{byte(v % 8)})
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+}
+
+// countTreeNodes returns the number of nodes in a tree.
+func countTreeNodes(tree *ImmutableTree) int {
+	nodes := 0
+	tree.root.traverse(tree, true, func(*Node) bool {
+		nodes++
+		return false
+	})
+	return nodes
+}
+
+func TestRefCountGC(t *testing.T) {
+	refDB, orphanDB := db.NewMemDB(), db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(refDB, 0, &Options{RefCountGC: true})
+	require.NoError(t, err)
+	orphanTree, err := NewMutableTreeWithOpts(orphanDB, 0, nil)
+	require.NoError(t, err)
+	saveRefCountVersions(t, tree, 10)
+	saveRefCountVersions(t, orphanTree, 10)
+	require.Zero(t, countPrefixKeys(t, refDB, orphanKeyFormat.Key()))
+	require.Positive(t, countPrefixKeys(t, refDB, refCountKeyFormat.Key()))
+
+	// Deleting arbitrary versions frees exactly the nodes freed by orphan lifetimes.
+	for _, tr := range []*MutableTree{tree, orphanTree} {
+		require.NoError(t, tr.DeleteVersion(4))
+		require.NoError(t, tr.DeleteVersion(1))
+		require.NoError(t, tr.DeleteVersionsRange(6, 9))
+	}
+	require.Equal(t, countPrefixKeys(t, orphanDB, nodeKeyFormat.Key()), countPrefixKeys(t, refDB, nodeKeyFormat.Key()))
+
+	for _, v := range []int64{2, 3, 5, 9, 10} {
+		expect, err := orphanTree.GetImmutable(v)
+		require.NoError(t, err)
+		actual, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		require.Equal(t, expect.Hash(), actual.Hash())
+		require.Equal(t, iterateAll(t, expect.Iterator(nil, nil, true)), iterateAll(t, actual.Iterator(nil, nil, true)))
+	}
+
+	// Deleting all but the latest version leaves only its nodes, each referenced once.
+	require.NoError(t, tree.DeleteVersionsRange(2, 10))
+	nodes := countTreeNodes(tree.ImmutableTree)
+	require.Equal(t, nodes, countPrefixKeys(t, refDB, nodeKeyFormat.Key()))
+	require.Equal(t, nodes, countPrefixKeys(t, refDB, refCountKeyFormat.Key()))
+
+	// Rolling back releases the nodes of the later versions.
+	saveRefCountVersions(t, tree, 3)
+	_, err = tree.LoadVersionForOverwriting(10)
+	require.NoError(t, err)
+	require.Equal(t, nodes, countPrefixKeys(t, refDB, nodeKeyFormat.Key()))
+}
+
+func TestRefCountGC_Migrate(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	saveRefCountVersions(t, tree, 6)
+	require.Positive(t, countPrefixKeys(t, memDB, orphanKeyFormat.Key()))
+	hash := tree.Hash()
+
+	opts := &Options{RefCountGC: true}
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	require.Zero(t, countPrefixKeys(t, memDB, orphanKeyFormat.Key()))
+
+	require.NoError(t, tree.DeleteVersionsRange(1, 6))
+	nodes := countTreeNodes(tree.ImmutableTree)
+	require.Equal(t, nodes, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+
+	// The database can no longer be used with orphan lifetimes.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, nil)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.ErrorIs(t, err, ErrRefCountStorage)
+}
+
+func TestRefCountGC_Import(t *testing.T) {
+	tree, err := getTestTree(0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	exporter := tree.ImmutableTree.Export()
+	defer exporter.Close()
+
+	memDB := db.NewMemDB()
+	target, err := NewMutableTreeWithOpts(memDB, 0, &Options{RefCountGC: true})
+	require.NoError(t, err)
+	importer, err := target.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		item, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(item))
+	}
+	require.NoError(t, importer.Commit())
+
+	// Replacing every key frees all imported nodes once the imported version is deleted.
+	for i := 0; i < 20; i++ {
+		target.Set([]byte{byte(i)}, []byte{byte(i + 1)})
+	}
+	_, _, err = target.SaveVersion()
+	require.NoError(t, err)
+	require.NoError(t, target.DeleteVersion(version))
+	nodes := countTreeNodes(target.ImmutableTree)
+	require.Equal(t, nodes, countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+}
@@ -30,21 +30,23 @@ import (
 // the case.
 func Repair013Orphans(db dbm.DB) (uint64, error) {
 	ndb := newNodeDB(db, 0, &Options{Sync: true})
-	version := ndb.getLatestVersion()
+	version, err := ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
 	if version == 0 {
 		return 0, errors.New("no versions found")
 	}
 
-	var (
-		repaired uint64
-		err      error
-	)
+	var repaired uint64
 	batch := db.NewBatch()
 	defer batch.Close()
 	err = ndb.traverseRange(orphanKeyFormat.Key(version), orphanKeyFormat.Key(int64(math.MaxInt64)), func(k, v []byte) error {
 		// Sanity check so we don't remove stuff we shouldn't
 		var toVersion int64
-		orphanKeyFormat.Scan(k, &toVersion)
+		if err = orphanKeyFormat.ScanStrict(k, &toVersion); err != nil {
+			return err
+		}
 		if toVersion < version {
 			err = errors.Errorf("Found unexpected orphan with toVersion=%v, lesser than latest version %v",
 				toVersion, version)
@@ -0,0 +1,281 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// ReplicationFormat is the version of the replication stream format written by StreamSink.
+const ReplicationFormat = 1
+
+// replicationMagic starts every replication stream, followed by the uvarint format version.
+const replicationMagic = "IAVLREPL"
+
+// ErrUnknownReplicationFormat is returned when reading a replication stream with an unsupported
+// format version, e.g. one written by a newer release.
+var ErrUnknownReplicationFormat = errors.New("unknown replication format")
+
+// BatchOp is a database write shipped by a Replicator: a set of Key to Value, or a delete of Key.
+type BatchOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
+}
+
+// ReplicationBatch contains the database writes made by a tree since the previous saved version,
+// up to and including the writes saving Version, in the order they were made.
+type ReplicationBatch struct {
+	Version  int64
+	RootHash []byte
+	Ops      []BatchOp
+}
+
+// ReplicationSink receives the batches shipped by a Replicator, e.g. to send them to a follower.
+// Batches are shipped synchronously by SaveVersion, so slow sinks should queue them.
+type ReplicationSink interface {
+	Ship(batch *ReplicationBatch) error
+}
+
+// ChannelSink is a ReplicationSink sending batches to a channel, for followers in the same
+// process.
+type ChannelSink chan<- *ReplicationBatch
+
+var _ ReplicationSink = ChannelSink(nil)
+
+// Ship implements ReplicationSink.
+func (c ChannelSink) Ship(batch *ReplicationBatch) error {
+	c <- batch
+	return nil
+}
+
+// Replicator ships the database writes of each version saved by a tree to a ReplicationSink, from
+// SaveVersion hooks. Applying the batches to a copy of the leader database taken when the
+// Replicator was created, with ApplyReplicationBatch, produces a byte-identical replica, e.g. for
+// read scaling. Writes made while loading the tree, such as storage migrations, and by imports
+// are not shipped, and the cold tier is not replicated.
+//
+// If shipping a batch fails, the Replicator stops shipping, since the follower can't apply later
+// batches, and Err returns the error.
+type Replicator struct {
+	BaseHooks
+	ndb  *nodeDB
+	sink ReplicationSink
+
+	mtx sync.Mutex
+	err error
+}
+
+// NewReplicator starts recording the database writes of the tree, and registers a Replicator
+// shipping them to the sink after each saved version.
+func NewReplicator(tree *MutableTree, sink ReplicationSink) *Replicator {
+	tree.ndb.startReplication()
+	r := &Replicator{ndb: tree.ndb, sink: sink}
+	tree.AddHooks(r)
+	return r
+}
+
+// OnSaveVersion implements Hooks.
+func (r *Replicator) OnSaveVersion(version int64, rootHash []byte, _ []KVPair) {
+	ops := r.ndb.takeReplicated()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.err != nil {
+		return
+	}
+	err := r.sink.Ship(&ReplicationBatch{Version: version, RootHash: rootHash, Ops: ops})
+	if err != nil {
+		r.err = errors.Wrapf(err, "shipping version %v", version)
+		r.ndb.logger.Error("replication stopped", "version", version, "err", err)
+	}
+}
+
+// Err returns the error which stopped shipping, if any.
+func (r *Replicator) Err() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.err
+}
+
+// ApplyReplicationBatch writes the operations of a replication batch to a follower database
+// atomically, without verifying them, see Follower. The follower must not be written to
+// otherwise. Keys are relative to the Options.KeyPrefix of the leader, if any, so a Follower must
+// be used to apply them under the prefix.
+func ApplyReplicationBatch(db dbm.DB, batch *ReplicationBatch) error {
+	b := db.NewBatch()
+	defer b.Close()
+	for _, op := range batch.Ops {
+		var err error
+		if op.Delete {
+			err = b.Delete(op.Key)
+		} else {
+			err = b.Set(op.Key, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.WriteSync()
+}
+
+// startReplication starts recording the writes of batches, see Replicator.
+func (ndb *nodeDB) startReplication() {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.replicating = true
+	ndb.batch.record = true
+}
+
+// takeReplicated returns and clears the writes recorded since the previous call.
+func (ndb *nodeDB) takeReplicated() []BatchOp {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ops := ndb.replicated
+	ndb.replicated = nil
+	return ops
+}
+
+// StreamSink is a ReplicationSink writing batches to a stream in the current ReplicationFormat,
+// e.g. a network connection to a follower, which reads them with ReplicationReader.
+type StreamSink struct {
+	mtx sync.Mutex
+	w   *bufio.Writer
+	buf bytes.Buffer
+}
+
+var _ ReplicationSink = (*StreamSink)(nil)
+
+// NewStreamSink writes the header of a replication stream, and returns a sink writing batches to
+// it.
+func NewStreamSink(w io.Writer) (*StreamSink, error) {
+	s := &StreamSink{w: bufio.NewWriter(w)}
+	s.buf.WriteString(replicationMagic)
+	if err := encodeUvarint(&s.buf, ReplicationFormat); err != nil {
+		return nil, err
+	}
+	if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := s.w.Flush(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ship implements ReplicationSink. The batch is flushed to the underlying writer.
+//
+// Batches are encoded as:
+//
+//	batch:  varint(version) || bytes(root hash) || uvarint(op count) || op...
+//	op:     0x01 || bytes(key) || bytes(value) for sets, 0x02 || bytes(key) for deletes
+//
+// where bytes are uvarint length-prefixed.
+func (s *StreamSink) Ship(batch *ReplicationBatch) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.buf.Reset()
+	if err := encodeVarint(&s.buf, batch.Version); err != nil {
+		return err
+	}
+	if err := encodeBytes(&s.buf, batch.RootHash); err != nil {
+		return err
+	}
+	if err := encodeUvarint(&s.buf, uint64(len(batch.Ops))); err != nil {
+		return err
+	}
+	for _, op := range batch.Ops {
+		if op.Delete {
+			s.buf.WriteByte(0x02)
+			if err := encodeBytes(&s.buf, op.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		s.buf.WriteByte(0x01)
+		if err := encodeBytes(&s.buf, op.Key); err != nil {
+			return err
+		}
+		if err := encodeBytes(&s.buf, op.Value); err != nil {
+			return err
+		}
+	}
+	if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// ReplicationReader reads the batches of a replication stream written by StreamSink.
+type ReplicationReader struct {
+	r *bufio.Reader
+}
+
+// NewReplicationReader reads the header of a replication stream, returning
+// ErrUnknownReplicationFormat if its format is not supported.
+func NewReplicationReader(r io.Reader) (*ReplicationReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(replicationMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading replication header")
+	}
+	if string(magic) != replicationMagic {
+		return nil, errors.New("not a replication stream")
+	}
+	format, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading replication format")
+	}
+	if format != ReplicationFormat {
+		return nil, errors.Wrapf(ErrUnknownReplicationFormat, "format %v", format)
+	}
+	return &ReplicationReader{r: br}, nil
+}
+
+// Next reads the next batch, or returns io.EOF if the stream ended after the previous batch.
+func (rr *ReplicationReader) Next() (*ReplicationBatch, error) {
+	version, err := binary.ReadVarint(rr.r)
+	if err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading batch version")
+	}
+	batch := &ReplicationBatch{Version: version}
+	if batch.RootHash, err = readExportBytes(rr.r); err != nil {
+		return nil, errors.Wrap(err, "reading batch root hash")
+	}
+	count, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return nil, errors.Wrap(unexpectedEOF(err), "reading batch op count")
+	}
+	for i := uint64(0); i < count; i++ {
+		marker, err := rr.r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(unexpectedEOF(err), "reading batch op")
+		}
+		var op BatchOp
+		switch marker {
+		case 0x01:
+		case 0x02:
+			op.Delete = true
+		default:
+			return nil, errors.Errorf("invalid batch op marker %#x", marker)
+		}
+		if op.Key, err = readExportBytes(rr.r); err != nil {
+			return nil, errors.Wrap(err, "reading batch op key")
+		}
+		if !op.Delete {
+			if op.Value, err = readExportBytes(rr.r); err != nil {
+				return nil, errors.Wrap(err, "reading batch op value")
+			}
+		}
+		batch.Ops = append(batch.Ops, op)
+	}
+	return batch, nil
+}
@@ -0,0 +1,122 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestReplicator(t *testing.T) {
+	leaderDB := db.NewMemDB()
+	leader, err := NewMutableTree(leaderDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		leader.Set([]byte(fmt.Sprintf("key%02d", i)), []byte{byte(i)})
+	}
+	_, _, err = leader.SaveVersion()
+	require.NoError(t, err)
+
+	// The follower starts from a copy of the leader database.
+	followerDB := db.NewMemDB()
+	for key, value := range dumpPrefix(t, leaderDB, nil) {
+		require.NoError(t, followerDB.Set([]byte(key), []byte(value)))
+	}
+
+	batches := make(chan *ReplicationBatch, 1)
+	replicator := NewReplicator(leader, ChannelSink(batches))
+	for v := 2; v <= 6; v++ {
+		for i := 0; i < 5; i++ {
+			leader.Set([]byte(fmt.Sprintf("key%02d", (v*7+i)%30)), []byte{byte(v)})
+		}
+		leader.Remove([]byte(fmt.Sprintf("key%02d", v)))
+		if v == 4 {
+			require.NoError(t, leader.DeleteVersion(2))
+		}
+		hash, version, err := leader.SaveVersion()
+		require.NoError(t, err)
+
+		batch := <-batches
+		require.EqualValues(t, version, batch.Version)
+		require.Equal(t, hash, batch.RootHash)
+		require.NotEmpty(t, batch.Ops)
+		require.NoError(t, ApplyReplicationBatch(followerDB, batch))
+		require.Equal(t, dumpPrefix(t, leaderDB, nil), dumpPrefix(t, followerDB, nil))
+	}
+	require.NoError(t, replicator.Err())
+
+	follower, err := NewMutableTree(followerDB, 0)
+	require.NoError(t, err)
+	_, err = follower.Load()
+	require.NoError(t, err)
+	require.Equal(t, leader.Hash(), follower.Hash())
+	require.Equal(t, leader.AvailableVersions(), follower.AvailableVersions())
+}
+
+type failingSink struct {
+	shipped int
+}
+
+func (s *failingSink) Ship(*ReplicationBatch) error {
+	s.shipped++
+	return errors.New("connection lost")
+}
+
+func TestReplicator_SinkError(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	sink := &failingSink{}
+	replicator := NewReplicator(tree, sink)
+	for i := 0; i < 3; i++ {
+		tree.Set([]byte("key"), []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, sink.shipped)
+	require.EqualError(t, replicator.Err(), "shipping version 1: connection lost")
+}
+
+func TestStreamSink(t *testing.T) {
+	batches := []*ReplicationBatch{
+		{Version: 1, RootHash: []byte{1, 2, 3}, Ops: []BatchOp{
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("b"), Value: []byte{}},
+			{Key: []byte("c"), Delete: true},
+		}},
+		{Version: 2, RootHash: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	sink, err := NewStreamSink(&buf)
+	require.NoError(t, err)
+	for _, batch := range batches {
+		require.NoError(t, sink.Ship(batch))
+	}
+	stream := buf.Bytes()
+
+	reader, err := NewReplicationReader(bytes.NewReader(stream))
+	require.NoError(t, err)
+	for _, expect := range batches {
+		batch, err := reader.Next()
+		require.NoError(t, err)
+		require.Equal(t, expect, batch)
+	}
+	_, err = reader.Next()
+	require.Equal(t, io.EOF, err)
+
+	reader, err = NewReplicationReader(bytes.NewReader(stream[:len(stream)-1]))
+	require.NoError(t, err)
+	_, err = reader.Next()
+	require.NoError(t, err)
+	_, err = reader.Next()
+	require.True(t, errors.Is(err, io.ErrUnexpectedEOF), "got %v", err)
+
+	_, err = NewReplicationReader(bytes.NewReader([]byte("IAVLEXPORT\x01")))
+	require.Error(t, err)
+	_, err = NewReplicationReader(bytes.NewReader([]byte("IAVLREPL\x02")))
+	require.True(t, errors.Is(err, ErrUnknownReplicationFormat))
+}
@@ -0,0 +1,48 @@
+package iavl
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrVersionProtected is matched by errors returned when deleting versions protected by
+// Options.ProtectedVersions or Options.MinRetainVersions.
+var ErrVersionProtected = errors.New("version is protected")
+
+// isProtectedVersion returns true if the version is protected by Options.ProtectedVersions.
+func (ndb *nodeDB) isProtectedVersion(version int64) bool {
+	return ndb.opts.ProtectedVersions != nil && ndb.opts.ProtectedVersions(version)
+}
+
+// checkRetention returns an error matching ErrVersionProtected if deleting the saved versions in
+// [fromVersion, toVersion) would delete a protected version, or leave fewer versions than
+// Options.MinRetainVersions.
+func (ndb *nodeDB) checkRetention(fromVersion, toVersion int64) error {
+	minRetain := ndb.opts.MinRetainVersions
+	if ndb.opts.ProtectedVersions == nil && minRetain <= 0 {
+		return nil
+	}
+	var versions, deleted int64
+	err := ndb.traversePrefix(rootKeyFormat.Key(), func(k, _ []byte) error {
+		var version int64
+		if err := rootKeyFormat.ScanStrict(k, &version); err != nil {
+			return err
+		}
+		versions++
+		if version < fromVersion || version >= toVersion {
+			return nil
+		}
+		if ndb.isProtectedVersion(version) {
+			return errors.Wrapf(ErrVersionProtected, "version %v", version)
+		}
+		deleted++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if deleted > 0 && versions-deleted < minRetain {
+		return errors.Wrapf(ErrVersionProtected, "deleting %v versions would leave %v, fewer than the %v to retain",
+			deleted, versions-deleted, minRetain)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRetention_ProtectedVersions(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		ProtectedVersions: func(version int64) bool { return version%5 == 0 },
+	})
+	require.NoError(t, err)
+	for v := 0; v < 12; v++ {
+		tree.Set([]byte{byte(v)}, []byte{1})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	require.True(t, errors.Is(tree.DeleteVersion(5), ErrVersionProtected))
+	require.True(t, errors.Is(tree.DeleteVersionsRange(1, 7), ErrVersionProtected))
+	_, err = tree.LoadVersionForOverwriting(8)
+	require.True(t, errors.Is(err, ErrVersionProtected))
+	require.EqualValues(t, 12, tree.Version())
+	versions, err := tree.Versions()
+	require.NoError(t, err)
+	require.Len(t, versions, 12)
+
+	require.NoError(t, tree.DeleteVersionsRange(1, 5))
+	require.NoError(t, tree.DeleteVersion(6))
+
+	// Pruning keeps protected versions.
+	tree.ndb.opts.Pruning = &PruningPolicy{KeepRecent: 1}
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	versions, err = tree.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{5, 10, 13}, versions)
+}
+
+func TestRetention_MinRetainVersions(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{MinRetainVersions: 3})
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		tree.Set([]byte{byte(v)}, []byte{1})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	require.True(t, errors.Is(tree.DeleteVersionsRange(1, 4), ErrVersionProtected))
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.True(t, errors.Is(err, ErrVersionProtected))
+	require.NoError(t, tree.DeleteVersion(1))
+
+	// Pruning deletes only as many versions as it can.
+	tree.ndb.opts.Pruning = &PruningPolicy{KeepRecent: 1}
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	versions, err := tree.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{4, 5, 6}, versions)
+}
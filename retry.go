@@ -0,0 +1,332 @@
+package iavl
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+const (
+	defaultRetryMaxAttempts     = 5
+	defaultRetryInitialBackoff  = 10 * time.Millisecond
+	defaultRetryMaxBackoff      = 100 * time.Millisecond
+	defaultRetryMaxTotalBackoff = 200 * time.Millisecond
+)
+
+// RetryOptions retries database operations failing with transient errors, see Options.Retry.
+//
+// Operations are retried where they fail, often while the tree holds its database lock, e.g.
+// while saving a version, so other readers and writers of the tree wait for the backoff too.
+// MaxTotalBackoff bounds this wait, and should stay well below the block time.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts of each operation, including the first one.
+	// Defaults to 5.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry, doubled for each further retry up to
+	// MaxBackoff. They default to 10ms and 100ms.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxTotalBackoff is the maximum total wait for the retries of each operation, which fails
+	// rather than waiting longer. Defaults to 200ms.
+	MaxTotalBackoff time.Duration
+
+	// Retryable returns true for errors which are transient, and worth retrying. Defaults to
+	// IsTransientError.
+	Retryable func(err error) bool
+}
+
+// transientErrorMessages are the messages of the errors which RocksDB reports for EAGAIN, e.g.
+// while a file lock is contended, and for its Busy status, since its errors don't wrap the
+// underlying errno. Broader messages such as "timed out" are left to RetryOptions.Retryable, as
+// they also match errors which are not worth retrying.
+var transientErrorMessages = []string{
+	"resource temporarily unavailable",
+	"resource busy",
+}
+
+// IsTransientError returns true if the error is transient, such that the operation failing with
+// it may succeed when retried: EAGAIN, EBUSY or EINTR, or an error with a message reporting them
+// as RocksDB does. It is the default of RetryOptions.Retryable.
+func IsTransientError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, transient := range transientErrorMessages {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDB is a database which retries operations failing with transient errors, with backoff.
+// Batches are retried as a whole, which relies on batch writes being atomic, and iterators which
+// fail while iterating are reopened after the last key returned.
+type retryDB struct {
+	dbm.DB
+	opts   RetryOptions
+	logger Logger
+	sleep  func(time.Duration)
+}
+
+var (
+	_ dbm.DB      = (*retryDB)(nil)
+	_ KeyChecker  = (*retryDB)(nil)
+	_ Snapshotter = (*retryDB)(nil)
+)
+
+func newRetryDB(db dbm.DB, opts RetryOptions, logger Logger) *retryDB {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = opts.InitialBackoff
+	}
+	if opts.MaxTotalBackoff <= 0 {
+		opts.MaxTotalBackoff = defaultRetryMaxTotalBackoff
+	}
+	if opts.Retryable == nil {
+		opts.Retryable = IsTransientError
+	}
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	return &retryDB{DB: db, opts: opts, logger: logger, sleep: time.Sleep}
+}
+
+// retry runs an operation until it succeeds, fails with an error which isn't retryable, or runs
+// out of attempts or backoff time.
+func (d *retryDB) retry(op string, fn func() error) error {
+	backoff := d.opts.InitialBackoff
+	var total time.Duration
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !d.opts.Retryable(err) {
+			return err
+		}
+		if attempt >= d.opts.MaxAttempts || total+backoff > d.opts.MaxTotalBackoff {
+			return errors.Wrapf(err, "database %s failed after %v attempts", op, attempt)
+		}
+		d.logger.Error("transient database error, retrying", "op", op, "attempt", attempt,
+			"backoff", backoff, "err", err)
+		d.sleep(backoff)
+		total += backoff
+		if backoff *= 2; backoff > d.opts.MaxBackoff {
+			backoff = d.opts.MaxBackoff
+		}
+	}
+}
+
+// Get implements dbm.DB.
+func (d *retryDB) Get(key []byte) (value []byte, err error) {
+	err = d.retry("get", func() error {
+		value, err = d.DB.Get(key)
+		return err
+	})
+	return value, err
+}
+
+// Has implements dbm.DB.
+func (d *retryDB) Has(key []byte) (exists bool, err error) {
+	err = d.retry("has", func() error {
+		exists, err = d.DB.Has(key)
+		return err
+	})
+	return exists, err
+}
+
+// HasKey implements KeyChecker, with the cheapest lookup of the wrapped database.
+func (d *retryDB) HasKey(key []byte) (exists bool, err error) {
+	err = d.retry("has", func() error {
+		exists, err = hasKey(d.DB, key)
+		return err
+	})
+	return exists, err
+}
+
+// Set implements dbm.DB.
+func (d *retryDB) Set(key, value []byte) error {
+	return d.retry("set", func() error { return d.DB.Set(key, value) })
+}
+
+// SetSync implements dbm.DB.
+func (d *retryDB) SetSync(key, value []byte) error {
+	return d.retry("set", func() error { return d.DB.SetSync(key, value) })
+}
+
+// Delete implements dbm.DB.
+func (d *retryDB) Delete(key []byte) error {
+	return d.retry("delete", func() error { return d.DB.Delete(key) })
+}
+
+// DeleteSync implements dbm.DB.
+func (d *retryDB) DeleteSync(key []byte) error {
+	return d.retry("delete", func() error { return d.DB.DeleteSync(key) })
+}
+
+// Iterator implements dbm.DB.
+func (d *retryDB) Iterator(start, end []byte) (dbm.Iterator, error) {
+	itr := &retryIterator{db: d, start: start, end: end}
+	if err := itr.open(start, end); err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+// ReverseIterator implements dbm.DB.
+func (d *retryDB) ReverseIterator(start, end []byte) (dbm.Iterator, error) {
+	itr := &retryIterator{db: d, start: start, end: end, reverse: true}
+	if err := itr.open(start, end); err != nil {
+		return nil, err
+	}
+	return itr, nil
+}
+
+// Snapshot implements Snapshotter if the wrapped database does, and returns a nil snapshot
+// otherwise. Taking the snapshot is retried, but not reading it.
+func (d *retryDB) Snapshot() (snapshot DBSnapshot, err error) {
+	snapshotter, ok := d.DB.(Snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	err = d.retry("snapshot", func() error {
+		snapshot, err = snapshotter.Snapshot()
+		return err
+	})
+	return snapshot, err
+}
+
+// NewBatch implements dbm.DB.
+func (d *retryDB) NewBatch() dbm.Batch {
+	return &retryBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+// retryBatch is a batch of a retryDB, whose writes are retried.
+type retryBatch struct {
+	dbm.Batch
+	db *retryDB
+}
+
+// Write implements dbm.Batch.
+func (b *retryBatch) Write() error {
+	return b.db.retry("batch write", b.Batch.Write)
+}
+
+// WriteSync implements dbm.Batch.
+func (b *retryBatch) WriteSync() error {
+	return b.db.retry("batch write", b.Batch.WriteSync)
+}
+
+// retryIterator is an iterator of a retryDB. Opening it is retried, and if it fails with a
+// transient error while iterating, it is reopened after the last key returned.
+type retryIterator struct {
+	db         *retryDB
+	start, end []byte
+	reverse    bool
+	itr        dbm.Iterator
+}
+
+var _ dbm.Iterator = (*retryIterator)(nil)
+
+// open opens the wrapped iterator on the given range, until it is opened without a transient error.
+// Other errors of the opened iterator are reported by its Error method, as usual.
+func (itr *retryIterator) open(start, end []byte) error {
+	return itr.db.retry("iterator", func() error {
+		var source dbm.Iterator
+		var err error
+		if itr.reverse {
+			source, err = itr.db.DB.ReverseIterator(start, end)
+		} else {
+			source, err = itr.db.DB.Iterator(start, end)
+		}
+		if err != nil {
+			return err
+		}
+		if err = source.Error(); err != nil && itr.db.opts.Retryable(err) {
+			source.Close()
+			return err
+		}
+		itr.itr = source
+		return nil
+	})
+}
+
+// Domain implements dbm.Iterator.
+func (itr *retryIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements dbm.Iterator.
+func (itr *retryIterator) Valid() bool {
+	return itr.itr.Valid()
+}
+
+// Next implements dbm.Iterator. If advancing fails with a transient error, the iterator is
+// reopened after the current key, where a failure to reopen it is reported by Error.
+func (itr *retryIterator) Next() {
+	last := cp(itr.itr.Key())
+	itr.itr.Next()
+	err := itr.itr.Error()
+	if err == nil || !itr.db.opts.Retryable(err) {
+		return
+	}
+	itr.itr.Close()
+	start, end := append(last, 0), itr.end
+	if itr.reverse {
+		start, end = itr.start, last
+	}
+	if err := itr.open(start, end); err != nil {
+		itr.itr = &errIterator{start: itr.start, end: itr.end, err: err}
+	}
+}
+
+// Key implements dbm.Iterator.
+func (itr *retryIterator) Key() []byte {
+	return itr.itr.Key()
+}
+
+// Value implements dbm.Iterator.
+func (itr *retryIterator) Value() []byte {
+	return itr.itr.Value()
+}
+
+// Error implements dbm.Iterator.
+func (itr *retryIterator) Error() error {
+	return itr.itr.Error()
+}
+
+// Close implements dbm.Iterator.
+func (itr *retryIterator) Close() error {
+	return itr.itr.Close()
+}
+
+// errIterator is an invalid iterator reporting an error, in place of one which couldn't be opened.
+type errIterator struct {
+	start, end []byte
+	err        error
+}
+
+var _ dbm.Iterator = (*errIterator)(nil)
+
+func (itr *errIterator) Domain() ([]byte, []byte) { return itr.start, itr.end }
+func (itr *errIterator) Valid() bool              { return false }
+func (itr *errIterator) Next()                    { panic("iterator is invalid") }
+func (itr *errIterator) Key() []byte              { panic("iterator is invalid") }
+func (itr *errIterator) Value() []byte            { panic("iterator is invalid") }
+func (itr *errIterator) Error() error             { return itr.err }
+func (itr *errIterator) Close() error             { return nil }
@@ -0,0 +1,237 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// flakyDB is a database failing its next failNext operations, and every nth one, with a transient
+// error, including batch writes and iterator steps.
+type flakyDB struct {
+	db.DB
+	mtx      sync.Mutex
+	n        int
+	failNext int
+	calls    int
+	fails    int
+}
+
+func (d *flakyDB) fail() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.calls++
+	if d.failNext > 0 || (d.n > 0 && d.calls%d.n == 0) {
+		if d.failNext > 0 {
+			d.failNext--
+		}
+		d.fails++
+		return errors.Wrap(syscall.EAGAIN, "flaky")
+	}
+	return nil
+}
+
+func (d *flakyDB) Get(key []byte) ([]byte, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	return d.DB.Get(key)
+}
+
+func (d *flakyDB) Has(key []byte) (bool, error) {
+	if err := d.fail(); err != nil {
+		return false, err
+	}
+	return d.DB.Has(key)
+}
+
+func (d *flakyDB) Set(key, value []byte) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.DB.Set(key, value)
+}
+
+func (d *flakyDB) Iterator(start, end []byte) (db.Iterator, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	itr, err := d.DB.Iterator(start, end)
+	return &flakyIterator{Iterator: itr, db: d}, err
+}
+
+func (d *flakyDB) ReverseIterator(start, end []byte) (db.Iterator, error) {
+	if err := d.fail(); err != nil {
+		return nil, err
+	}
+	itr, err := d.DB.ReverseIterator(start, end)
+	return &flakyIterator{Iterator: itr, db: d}, err
+}
+
+func (d *flakyDB) NewBatch() db.Batch {
+	return &flakyBatch{Batch: d.DB.NewBatch(), db: d}
+}
+
+type flakyBatch struct {
+	db.Batch
+	db *flakyDB
+}
+
+func (b *flakyBatch) Write() error {
+	if err := b.db.fail(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func (b *flakyBatch) WriteSync() error {
+	if err := b.db.fail(); err != nil {
+		return err
+	}
+	return b.Batch.WriteSync()
+}
+
+type flakyIterator struct {
+	db.Iterator
+	db  *flakyDB
+	err error
+}
+
+func (itr *flakyIterator) Valid() bool {
+	return itr.err == nil && itr.Iterator.Valid()
+}
+
+func (itr *flakyIterator) Next() {
+	if itr.err = itr.db.fail(); itr.err == nil {
+		itr.Iterator.Next()
+	}
+}
+
+func (itr *flakyIterator) Error() error {
+	if itr.err != nil {
+		return itr.err
+	}
+	return itr.Iterator.Error()
+}
+
+func TestIsTransientError(t *testing.T) {
+	require.False(t, IsTransientError(nil))
+	require.False(t, IsTransientError(errors.New("corruption")))
+	require.True(t, IsTransientError(errors.Wrap(syscall.EAGAIN, "get")))
+	require.True(t, IsTransientError(syscall.EBUSY))
+	require.True(t, IsTransientError(errors.New("IO error: lock /data/LOCK: Resource temporarily unavailable")))
+	require.True(t, IsTransientError(errors.New("Resource busy: ")))
+}
+
+func TestRetryDB(t *testing.T) {
+	flaky := &flakyDB{DB: db.NewMemDB()}
+	require.NoError(t, flaky.DB.Set([]byte("a"), []byte{1}))
+	d := newRetryDB(flaky, RetryOptions{MaxAttempts: 3, MaxBackoff: 15 * time.Millisecond}, nil)
+	var sleeps []time.Duration
+	d.sleep = func(backoff time.Duration) { sleeps = append(sleeps, backoff) }
+
+	// Two failures are retried with backoff.
+	flaky.failNext = 2
+	value, err := d.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 15 * time.Millisecond}, sleeps)
+
+	// Failures beyond the maximum number of attempts are returned.
+	flaky.failNext = 3
+	_, err = d.Get([]byte("a"))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, syscall.EAGAIN))
+	require.Equal(t, 5, flaky.fails)
+
+	// Errors which aren't transient are returned at once.
+	d.opts.Retryable = func(error) bool { return false }
+	flaky.failNext = 1
+	_, err = d.Get([]byte("a"))
+	require.Error(t, err)
+	require.Equal(t, 6, flaky.fails)
+
+	// Retries stop when the next backoff would exceed the total.
+	d = newRetryDB(flaky, RetryOptions{MaxAttempts: 10, MaxTotalBackoff: 35 * time.Millisecond}, nil)
+	sleeps = nil
+	d.sleep = func(backoff time.Duration) { sleeps = append(sleeps, backoff) }
+	flaky.failNext = 10
+	_, err = d.Get([]byte("a"))
+	require.True(t, errors.Is(err, syscall.EAGAIN))
+	require.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, sleeps)
+	require.False(t, IsTransientError(errors.New("context deadline exceeded: timed out")))
+}
+
+func TestRetryDB_Iterator(t *testing.T) {
+	flaky := &flakyDB{DB: db.NewMemDB()}
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		keys = append(keys, key)
+		require.NoError(t, flaky.DB.Set(key, []byte{byte(i)}))
+	}
+	d := newRetryDB(flaky, RetryOptions{}, nil)
+	d.sleep = func(time.Duration) {}
+	flaky.n = 4
+
+	for _, reverse := range []bool{false, true} {
+		open := d.Iterator
+		if reverse {
+			open = d.ReverseIterator
+		}
+		itr, err := open(keys[2], keys[18])
+		require.NoError(t, err)
+		var seen [][]byte
+		for ; itr.Valid(); itr.Next() {
+			seen = append(seen, cp(itr.Key()))
+		}
+		require.NoError(t, itr.Error())
+		require.NoError(t, itr.Close())
+		expected := keys[2:18]
+		if reverse {
+			expected = make([][]byte, 0, 16)
+			for i := 17; i >= 2; i-- {
+				expected = append(expected, keys[i])
+			}
+		}
+		require.Equal(t, expected, seen)
+	}
+	require.NotZero(t, flaky.fails)
+}
+
+func TestRetry(t *testing.T) {
+	flaky := &flakyDB{DB: db.NewMemDB(), n: 3}
+	opts := &Options{Retry: &RetryOptions{InitialBackoff: time.Microsecond}}
+	tree, err := NewMutableTreeWithOpts(flaky, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 50; i++ {
+			tree.Set([]byte(fmt.Sprintf("%v/%v", v, i)), []byte{byte(i)})
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(1))
+
+	tree, err = NewMutableTreeWithOpts(flaky, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	count := 0
+	itree.Iterate(func(key, value []byte) bool {
+		count++
+		return false
+	})
+	require.Equal(t, 150, count)
+	require.NotZero(t, flaky.fails)
+}
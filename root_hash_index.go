@@ -0,0 +1,98 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// rootHashIndexPrefix prefixes the keys of the root hash index in the metadata keyspace. It is
+// followed by the root hash and the big-endian version number, so that all versions with a given
+// root hash can be found with a prefix scan.
+const rootHashIndexPrefix = "root_hash/"
+
+// rootHashIndexKey returns the index key for a root entry. Empty roots are stored as an empty
+// hash, but are indexed by the hash of the empty tree.
+func rootHashIndexKey(hash []byte, version int64) []byte {
+	if len(hash) == 0 {
+		hash = sha256.New().Sum(nil)
+	}
+	key := make([]byte, 0, len(rootHashIndexPrefix)+len(hash)+int64Size)
+	key = append(key, rootHashIndexPrefix...)
+	key = append(key, hash...)
+	return metadataKeyFormat.Key(append(key, formatUint64(uint64(version))...))
+}
+
+// unindexRoot removes a root entry from the root hash index, if enabled.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) unindexRoot(hash []byte, version int64) error {
+	if !ndb.opts.RootHashIndex {
+		return nil
+	}
+	return ndb.batch.Delete(rootHashIndexKey(hash, version))
+}
+
+// getVersionByRootHash returns the lowest version with the given root hash in the root hash
+// index, or 0 if there is none.
+func (ndb *nodeDB) getVersionByRootHash(hash []byte) (int64, error) {
+	prefix := rootHashIndexKey(hash, 0)
+	prefix = prefix[:len(prefix)-int64Size]
+
+	var version int64
+	err := ndb.traversePrefix(prefix, func(k, v []byte) error {
+		version = int64(binary.BigEndian.Uint64(k[len(prefix):]))
+		return errStopTraversal
+	})
+	if err != nil && err != errStopTraversal {
+		return 0, err
+	}
+	return version, nil
+}
+
+// scanVersionByRootHash returns the lowest version with the given root hash by scanning all root
+// entries, or 0 if there is none.
+func (ndb *nodeDB) scanVersionByRootHash(hash []byte) (int64, error) {
+	emptyHash := sha256.New().Sum(nil)
+	var version int64
+	err := ndb.traversePrefix(rootKeyFormat.Key(), func(k, v []byte) error {
+		if len(v) == 0 {
+			v = emptyHash
+		}
+		if bytes.Equal(v, hash) {
+			if err := rootKeyFormat.ScanStrict(k, &version); err != nil {
+				return err
+			}
+			return errStopTraversal
+		}
+		return nil
+	})
+	if err != nil && err != errStopTraversal {
+		return 0, err
+	}
+	return version, nil
+}
+
+// GetVersionByRootHash returns the lowest saved version with the given root hash, or
+// ErrVersionDoesNotExist if there is none. With Options.RootHashIndex this is a single index
+// lookup, but versions saved while the option was disabled are not found. Otherwise, all version
+// roots are scanned.
+func (tree *MutableTree) GetVersionByRootHash(hash []byte) (int64, error) {
+	var (
+		version int64
+		err     error
+	)
+	if tree.ndb.opts.RootHashIndex {
+		version, err = tree.ndb.getVersionByRootHash(hash)
+	} else {
+		version, err = tree.ndb.scanVersionByRootHash(hash)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errors.Wrapf(ErrVersionDoesNotExist, "root hash %X", hash)
+	}
+	return version, nil
+}
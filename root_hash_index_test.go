@@ -0,0 +1,58 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestGetVersionByRootHash(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		index := index
+		t.Run("", func(t *testing.T) {
+			tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{RootHashIndex: index})
+			require.NoError(t, err)
+
+			emptyHash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			hashes := [][]byte{emptyHash}
+			for i := 0; i < 5; i++ {
+				tree.Set([]byte{byte(i)}, []byte{byte(i)})
+				hash, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				hashes = append(hashes, hash)
+			}
+			// An unchanged version has the same root hash as its predecessor.
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			for i, hash := range hashes {
+				version, err := tree.GetVersionByRootHash(hash)
+				require.NoError(t, err)
+				require.EqualValues(t, i+1, version)
+			}
+
+			_, err = tree.GetVersionByRootHash([]byte("unknown"))
+			require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+
+			// Deleted versions are no longer found.
+			require.NoError(t, tree.DeleteVersion(1))
+			_, err = tree.GetVersionByRootHash(emptyHash)
+			require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+
+			require.NoError(t, tree.DeleteVersionsRange(2, 4))
+			_, err = tree.GetVersionByRootHash(hashes[1])
+			require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+
+			version, err := tree.GetVersionByRootHash(hashes[5])
+			require.NoError(t, err)
+			require.EqualValues(t, 6, version)
+			_, err = tree.LoadVersionForOverwriting(5)
+			require.NoError(t, err)
+			_, err = tree.GetVersionByRootHash(hashes[5])
+			require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package iavl
+
+import (
+	"fmt"
+	"io"
+)
+
+// Rotation is a rotation performed while rebalancing the working tree, recorded with
+// Options.RotationAudit.
+type Rotation struct {
+	Version  int64  // The working version the rotation was performed in.
+	Seq      int    // The position of the rotation among those of the version.
+	Left     bool   // Whether it was a left rotation, otherwise a right rotation.
+	NodeKey  []byte // The key of the rotated node, which moves down.
+	PivotKey []byte // The key of the child which moves up in its place.
+	Height   int8   // The height of the rotated node before the rotation.
+}
+
+// String implements fmt.Stringer.
+func (r Rotation) String() string {
+	direction := "right"
+	if r.Left {
+		direction = "left"
+	}
+	return fmt.Sprintf("%v/%v %v node=%X pivot=%X height=%v", r.Version, r.Seq, direction,
+		r.NodeKey, r.PivotKey, r.Height)
+}
+
+// recordRotation records a rotation of node, whose child pivot moves up, if enabled.
+func (tree *MutableTree) recordRotation(left bool, node, pivot *Node) {
+	if !tree.ndb.opts.RotationAudit {
+		return
+	}
+	tree.rotations = append(tree.rotations, Rotation{
+		Version:  tree.version + 1,
+		Seq:      len(tree.rotations),
+		Left:     left,
+		NodeKey:  node.key,
+		PivotKey: pivot.key,
+		Height:   node.height,
+	})
+}
+
+// Rotations returns the rotations performed in the working tree since the last saved version, in
+// order, with Options.RotationAudit. The returned slice must not be modified.
+func (tree *MutableTree) Rotations() []Rotation {
+	return tree.rotations
+}
+
+// SavedRotations returns the rotations performed in the last version saved by this tree, in
+// order, with Options.RotationAudit. The returned slice must not be modified.
+func (tree *MutableTree) SavedRotations() []Rotation {
+	return tree.savedRotations
+}
+
+// WriteRotations writes rotations to w, one per line, e.g. to diff the rotations of two nodes
+// which produced different root hashes for the same writes.
+func WriteRotations(w io.Writer, rotations []Rotation) error {
+	for _, r := range rotations {
+		if _, err := fmt.Fprintln(w, r.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestRotationAudit(t *testing.T) {
+	newTree := func(opts *Options, keys []int) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts)
+		require.NoError(t, err)
+		for _, i := range keys {
+			tree.Set([]byte(fmt.Sprintf("key%02d", i)), []byte("value"))
+		}
+		return tree
+	}
+	ascending := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	opts := &Options{RotationAudit: true}
+
+	tree := newTree(opts, ascending)
+	rotations := tree.Rotations()
+	require.NotEmpty(t, rotations)
+	require.Equal(t, Rotation{
+		Version: 1, Seq: 0, Left: true, NodeKey: []byte("key01"), PivotKey: []byte("key02"), Height: 3,
+	}, rotations[0])
+	require.Equal(t, "1/0 left node=6B65793031 pivot=6B65793032 height=3", rotations[0].String())
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, rotations, tree.SavedRotations())
+	require.Empty(t, tree.Rotations())
+
+	// Identical writes produce identical rotations, while reordered ones diverge.
+	var same, reordered bytes.Buffer
+	require.NoError(t, WriteRotations(&same, newTree(opts, ascending).Rotations()))
+	require.NoError(t, WriteRotations(&reordered, newTree(opts, []int{7, 6, 5, 4, 3, 2, 1, 0}).Rotations()))
+	var expect bytes.Buffer
+	require.NoError(t, WriteRotations(&expect, rotations))
+	require.Equal(t, expect.String(), same.String())
+	require.Len(t, strings.Split(strings.TrimSpace(same.String()), "\n"), len(rotations))
+	require.NotEqual(t, same.String(), reordered.String())
+
+	tree.Set([]byte("key08"), []byte("value"))
+	tree.Rollback()
+	require.Empty(t, tree.Rotations())
+
+	require.Empty(t, newTree(nil, ascending).Rotations())
+}
@@ -0,0 +1,66 @@
+package iavl
+
+import "fmt"
+
+// SaveStats contains statistics of the writes of a saved version, as returned by
+// MutableTree.LastSaveStats(), e.g. to meter state growth per block.
+type SaveStats struct {
+	Version       int64 // The saved version.
+	NewLeaves     int64 // Number of keys added.
+	UpdatedLeaves int64 // Number of existing keys set, even to the same value.
+	DeletedLeaves int64 // Number of existing keys removed.
+	NewInnerNodes int64 // Number of inner nodes written.
+	Orphans       int64 // Number of nodes of previous versions no longer used by the version.
+	BytesWritten  int64 // Size of the keys and values written to the database.
+}
+
+// String returns a string representation of the stats.
+func (s SaveStats) String() string {
+	return fmt.Sprintf("SaveStats{version=%d leaves(new=%d updated=%d deleted=%d) inner=%d orphans=%d bytes=%d}",
+		s.Version, s.NewLeaves, s.UpdatedLeaves, s.DeletedLeaves, s.NewInnerNodes, s.Orphans, s.BytesWritten)
+}
+
+// LastSaveStats returns the statistics of the last version saved by this tree, or zero stats if
+// none was saved since it was loaded.
+func (tree *MutableTree) LastSaveStats() SaveStats {
+	tree.mtx.RLock()
+	defer tree.mtx.RUnlock()
+	return tree.saveStats
+}
+
+// unsavedStats returns the leaf, inner node and orphan counts of the working tree about to be
+// saved as the given version.
+func (tree *MutableTree) unsavedStats(version int64) SaveStats {
+	stats := SaveStats{Version: version, Orphans: int64(len(tree.orphans))}
+	for key := range tree.orphanedLeaves {
+		if _, ok := tree.unsavedFastNodeRemovals[key]; ok {
+			stats.DeletedLeaves++
+		} else {
+			stats.UpdatedLeaves++
+		}
+	}
+
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		if node == nil || node.persisted {
+			return
+		}
+		if node.isLeaf() {
+			stats.NewLeaves++
+			return
+		}
+		stats.NewInnerNodes++
+		walk(node.leftNode)
+		walk(node.rightNode)
+	}
+	walk(tree.root)
+	stats.NewLeaves -= stats.UpdatedLeaves
+	return stats
+}
+
+// writtenBytes returns the size of the keys and values of all batches written so far.
+func (ndb *nodeDB) writtenBytes() int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.bytesWritten
+}
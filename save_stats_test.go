@@ -0,0 +1,56 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestLastSaveStats(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	require.Equal(t, SaveStats{}, tree.LastSaveStats())
+
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	stats := tree.LastSaveStats()
+	require.EqualValues(t, 1, stats.Version)
+	require.EqualValues(t, 10, stats.NewLeaves)
+	require.EqualValues(t, 9, stats.NewInnerNodes)
+	require.Zero(t, stats.UpdatedLeaves)
+	require.Zero(t, stats.DeletedLeaves)
+	require.Zero(t, stats.Orphans)
+	require.Positive(t, stats.BytesWritten)
+
+	before := countPrefixKeys(t, memDB, nodeKeyFormat.Key())
+	tree.Set([]byte("key1"), []byte("updated"))
+	tree.Set([]byte("key2"), []byte{2})
+	tree.Remove([]byte("key3"))
+	tree.Set([]byte("new"), []byte("value"))
+	tree.Set([]byte("transient"), []byte("value"))
+	tree.Remove([]byte("transient"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	stats = tree.LastSaveStats()
+	require.EqualValues(t, 2, stats.Version)
+	require.EqualValues(t, 1, stats.NewLeaves)
+	require.EqualValues(t, 2, stats.UpdatedLeaves)
+	require.EqualValues(t, 1, stats.DeletedLeaves)
+	require.Positive(t, stats.NewInnerNodes)
+	require.EqualValues(t, countPrefixKeys(t, memDB, nodeKeyFormat.Key())-before, stats.NewLeaves+stats.UpdatedLeaves+stats.NewInnerNodes)
+	require.EqualValues(t, countPrefixKeys(t, memDB, orphanKeyFormat.Key()), stats.Orphans)
+	require.Positive(t, stats.BytesWritten)
+
+	// A version without changes only writes its root reference.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	stats = tree.LastSaveStats()
+	require.EqualValues(t, 3, stats.Version)
+	require.Zero(t, stats.NewLeaves+stats.UpdatedLeaves+stats.DeletedLeaves+stats.NewInnerNodes+stats.Orphans)
+}
@@ -0,0 +1,161 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// SetBatch sets the given key/value pairs in the working tree, and returns whether each key was
+// updated (true) or newly inserted (false), in the order given. If a key is given several times,
+// the last value wins, as with sequential Set calls. Nil values are invalid, and the pairs must
+// not be modified after this call. If any pair exceeds the size limits, an error matching
+// ErrKeyTooLarge or ErrValueTooLarge is returned, and none are set.
+//
+// The pairs are sorted and applied in a single pass, descending each path of the tree once and
+// rebalancing each replaced subtree once, rather than once per key. The resulting tree, and thus
+// the root hash, differs from setting the same pairs with Set, so all nodes replicating the tree
+// must apply the batch the same way.
+func (tree *MutableTree) SetBatch(pairs []KVPair) ([]bool, error) {
+	for _, pair := range pairs {
+		if err := tree.ndb.checkSize(pair.Key, pair.Value); err != nil {
+			return nil, err
+		}
+	}
+	// Pending merges are superseded by the batch, but reported as existing values if they
+	// produce one.
+	var merged map[string]bool
+	for _, pair := range pairs {
+		if value, ok := tree.takeMerged(pair.Key); ok {
+			if merged == nil {
+				merged = map[string]bool{}
+			}
+			merged[string(pair.Key)] = value != nil
+		}
+	}
+	updated := tree.setBatch(pairs)
+	for i, pair := range pairs {
+		if exists, ok := merged[string(pair.Key)]; ok {
+			updated[i] = exists
+			delete(merged, string(pair.Key))
+		}
+	}
+	if len(pairs) > 0 {
+		tree.writeJournal(&journalEntry{op: journalOpSetBatch, pairs: pairs})
+	}
+	for _, pair := range pairs {
+		tree.clearExpiry(pair.Key)
+		for _, h := range tree.hooks {
+			h.OnSet(pair.Key, pair.Value)
+		}
+	}
+	return updated, nil
+}
+
+// setBatch applies the pairs to the working tree, see SetBatch.
+func (tree *MutableTree) setBatch(pairs []KVPair) []bool {
+	for _, pair := range pairs {
+		if pair.Value == nil {
+			panic(fmt.Sprintf("Attempt to store nil value at key '%s'", pair.Key))
+		}
+	}
+	order := make([]int, len(pairs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(pairs[order[i]].Key, pairs[order[j]].Key) < 0
+	})
+
+	// Keep the last value of each key. Later occurrences of a key update the earlier ones.
+	updated := make([]bool, len(pairs))
+	sorted := make([]KVPair, 0, len(pairs))
+	first := make([]int, 0, len(pairs))
+	for i := 0; i < len(order); {
+		j := i + 1
+		for j < len(order) && bytes.Equal(pairs[order[i]].Key, pairs[order[j]].Key) {
+			updated[order[j]] = true
+			j++
+		}
+		sorted = append(sorted, pairs[order[j-1]])
+		first = append(first, order[i])
+		i = j
+	}
+
+	version := tree.version + 1
+	for _, pair := range sorted {
+		tree.addUnsavedAddition(pair.Key, NewFastNode(pair.Key, pair.Value, version))
+	}
+	existed := make([]bool, len(sorted))
+	orphans := tree.prepareOrphansSlice()
+	tree.root = tree.setBatchFrom(tree.root, sorted, existed, &orphans)
+	tree.addOrphans(orphans)
+
+	for i, idx := range first {
+		updated[idx] = existed[i]
+	}
+	return updated
+}
+
+// setBatchFrom sets the sorted pairs in the subtree of node, which may be nil, recording in
+// existed whether each key was already present, and returns the new subtree.
+func (tree *MutableTree) setBatchFrom(node *Node, pairs []KVPair, existed []bool, orphans *[]*Node) *Node {
+	if len(pairs) == 0 {
+		return node
+	}
+	version := tree.version + 1
+
+	if node == nil || node.isLeaf() {
+		leaves := make([]*Node, 0, len(pairs)+1)
+		for i, pair := range pairs {
+			if node != nil && bytes.Compare(node.key, pair.Key) < 0 {
+				leaves = append(leaves, node)
+				node = nil
+			} else if node != nil && bytes.Equal(node.key, pair.Key) {
+				existed[i] = true
+				*orphans = append(*orphans, node)
+				node = nil
+			}
+			leaves = append(leaves, NewNode(pair.Key, pair.Value, version))
+		}
+		if node != nil {
+			leaves = append(leaves, node)
+		}
+		return tree.buildBalanced(leaves)
+	}
+
+	i := sort.Search(len(pairs), func(i int) bool {
+		return bytes.Compare(pairs[i].Key, node.key) >= 0
+	})
+	left := tree.setBatchFrom(node.getLeftNode(tree.ImmutableTree), pairs[:i], existed[:i], orphans)
+	right := tree.setBatchFrom(node.getRightNode(tree.ImmutableTree), pairs[i:], existed[i:], orphans)
+	*orphans = append(*orphans, node)
+
+	if diff := int(left.height) - int(right.height); diff < -1 || diff > 1 {
+		return tree.join(left, right, orphans)
+	}
+	node = node.clone(version)
+	node.leftHash, node.leftNode = left.hash, left
+	node.rightHash, node.rightNode = right.hash, right
+	node.calcHeightAndSize(tree.ImmutableTree)
+	return node
+}
+
+// buildBalanced returns a balanced subtree of the given sorted leaves.
+func (tree *MutableTree) buildBalanced(leaves []*Node) *Node {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	mid := len(leaves) / 2
+	left, right := tree.buildBalanced(leaves[:mid]), tree.buildBalanced(leaves[mid:])
+	node := &Node{
+		key:       leaves[mid].key,
+		version:   tree.version + 1,
+		leftHash:  left.hash,
+		leftNode:  left,
+		rightHash: right.hash,
+		rightNode: right,
+	}
+	node.calcHeightAndSize(tree.ImmutableTree)
+	return node
+}
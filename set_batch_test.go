@@ -0,0 +1,124 @@
+package iavl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestSetBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTreeWithOpts(memDB, 0, &Options{RunInvariantChecks: true})
+	require.NoError(t, err)
+	expect := map[string]string{}
+	for v := 0; v < 20; v++ {
+		pairs := make([]KVPair, 0, 100)
+		updated := make([]bool, 0, 100)
+		seen := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%04d", r.Intn(2000))
+			value := fmt.Sprintf("value%d-%d", v, i)
+			_, exists := expect[key]
+			pairs = append(pairs, KVPair{Key: []byte(key), Value: []byte(value)})
+			updated = append(updated, exists || seen[key])
+			seen[key] = true
+		}
+		for _, pair := range pairs {
+			expect[string(pair.Key)] = string(pair.Value)
+		}
+		actualUpdated, err := tree.SetBatch(pairs)
+		require.NoError(t, err)
+		require.Equal(t, updated, actualUpdated)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		require.EqualValues(t, len(expect), tree.Size())
+		actual := map[string]string{}
+		tree.Iterate(func(key, value []byte) bool {
+			actual[string(key)] = string(value)
+			return false
+		})
+		require.Equal(t, expect, actual)
+		for key, value := range expect {
+			require.Equal(t, []byte(value), tree.Get([]byte(key)))
+		}
+	}
+
+	// Nodes replaced by the batches are orphaned.
+	require.NoError(t, tree.DeleteVersionsRange(1, 20))
+	require.Equal(t, countTreeNodes(tree.ImmutableTree), countPrefixKeys(t, memDB, nodeKeyFormat.Key()))
+
+	updated, err := tree.SetBatch(nil)
+	require.NoError(t, err)
+	require.Empty(t, updated)
+	require.Panics(t, func() {
+		tree.SetBatch([]KVPair{{Key: []byte("key")}})
+	})
+}
+
+func TestSetBatch_Journal(t *testing.T) {
+	memDB := db.NewMemDB()
+	opts := &Options{Journal: true}
+	tree, err := NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	pairs := make([]KVPair, 0, 50)
+	for i := 0; i < 50; i++ {
+		pairs = append(pairs, KVPair{Key: []byte(fmt.Sprintf("key%02d", i*2)), Value: []byte("value")})
+	}
+	_, err = tree.SetBatch(pairs)
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	for i := range pairs {
+		pairs[i].Key = []byte(fmt.Sprintf("key%02d", i*2+1))
+	}
+	_, err = tree.SetBatch(pairs)
+	require.NoError(t, err)
+	require.Equal(t, 1, countPrefixKeys(t, memDB, journalKeyFormat.Key()))
+	workingHash := tree.WorkingHash()
+
+	// The replayed tree has the same shape as the one the batch was applied to.
+	tree, err = NewMutableTreeWithOpts(memDB, 0, opts)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, workingHash, tree.WorkingHash())
+	require.EqualValues(t, 100, tree.Size())
+}
+
+func BenchmarkSetBatch(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(b, err)
+	for i := 0; i < 100000; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%08d", r.Intn(1e8))), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(b, err)
+
+	pairs := make([]KVPair, 1000)
+	for _, batch := range []bool{false, true} {
+		batch := batch
+		b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for j := range pairs {
+					pairs[j] = KVPair{Key: []byte(fmt.Sprintf("key%08d", r.Intn(1e8))), Value: []byte("value")}
+				}
+				if batch {
+					tree.SetBatch(pairs)
+				} else {
+					for _, pair := range pairs {
+						tree.Set(pair.Key, pair.Value)
+					}
+				}
+				tree.WorkingHash()
+				tree.Rollback()
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package iavl
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrKeyTooLarge is returned for keys larger than Options.MaxKeySize.
+	ErrKeyTooLarge = errors.New("key too large")
+	// ErrValueTooLarge is returned for values larger than Options.MaxValueSize.
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// CheckSize returns an error matching ErrKeyTooLarge or ErrValueTooLarge if the key or value
+// exceeds Options.MaxKeySize or Options.MaxValueSize. Writes return the error, except for Set,
+// which panics with it, see SetChecked.
+func (tree *MutableTree) CheckSize(key, value []byte) error {
+	return tree.ndb.checkSize(key, value)
+}
+
+// checkSize checks an entry against the size limits, see MutableTree.CheckSize.
+func (ndb *nodeDB) checkSize(key, value []byte) error {
+	if limit := ndb.opts.MaxKeySize; limit > 0 && len(key) > limit {
+		return errors.Wrapf(ErrKeyTooLarge, "key %X has %v bytes, limit is %v", key, len(key), limit)
+	}
+	if limit := ndb.opts.MaxValueSize; limit > 0 && len(value) > limit {
+		return errors.Wrapf(ErrValueTooLarge, "value of key %X has %v bytes, limit is %v", key, len(value), limit)
+	}
+	return nil
+}
+
+// IterateOversized calls fn for each entry of the tree exceeding Options.MaxKeySize or
+// Options.MaxValueSize, in key order, with an error matching ErrKeyTooLarge or ErrValueTooLarge,
+// until fn returns true. Such entries can only have been set before the limits were configured
+// or lowered. It returns true if stopped by fn.
+func (t *ImmutableTree) IterateOversized(fn func(key, value []byte, err error) (stop bool)) (stopped bool) {
+	if t.ndb == nil || (t.ndb.opts.MaxKeySize <= 0 && t.ndb.opts.MaxValueSize <= 0) {
+		return false
+	}
+	return t.Iterate(func(key, value []byte) bool {
+		if err := t.ndb.checkSize(key, value); err != nil {
+			return fn(key, value, err)
+		}
+		return false
+	})
+}
+
+// IterateOversized is like ImmutableTree.IterateOversized, but iterates over the working tree.
+func (tree *MutableTree) IterateOversized(fn func(key, value []byte, err error) (stop bool)) (stopped bool) {
+	if tree.ndb.opts.MaxKeySize <= 0 && tree.ndb.opts.MaxValueSize <= 0 {
+		return false
+	}
+	return tree.Iterate(func(key, value []byte) bool {
+		if err := tree.ndb.checkSize(key, value); err != nil {
+			return fn(key, value, err)
+		}
+		return false
+	})
+}
@@ -0,0 +1,96 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestSizeLimits(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("legacy-key"), []byte("v"))
+	tree.Set([]byte("a"), []byte("legacy value"))
+	tree.Set([]byte("b"), []byte("v"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(memDB, 0, &Options{MaxKeySize: 4, MaxValueSize: 8})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	require.NoError(t, tree.CheckSize([]byte("key"), []byte("12345678")))
+	err = tree.CheckSize([]byte("key12"), []byte("v"))
+	require.True(t, errors.Is(err, ErrKeyTooLarge), "got %v", err)
+	err = tree.CheckSize([]byte("key"), []byte("123456789"))
+	require.True(t, errors.Is(err, ErrValueTooLarge), "got %v", err)
+
+	concat := func(key, existing []byte, operands [][]byte) []byte {
+		for _, op := range operands {
+			existing = append(existing, op...)
+		}
+		return existing
+	}
+	for name, set := range map[string]func() error{
+		"SetChecked": func() error {
+			_, err := tree.SetChecked([]byte("key12"), []byte("v"))
+			return err
+		},
+		"SetWithOldValue": func() error {
+			_, _, err := tree.SetWithOldValue([]byte("c"), []byte("123456789"))
+			return err
+		},
+		"SetBatch": func() error {
+			_, err := tree.SetBatch([]KVPair{{Key: []byte("d"), Value: []byte("v")}, {Key: []byte("c"), Value: []byte("123456789")}})
+			return err
+		},
+		"SetIfAbsent": func() error {
+			_, err := tree.SetIfAbsent([]byte("key12"), []byte("v"))
+			return err
+		},
+		"CompareAndSwap": func() error {
+			_, _, err := tree.CompareAndSwap([]byte("b"), []byte("v"), []byte("123456789"))
+			return err
+		},
+		"Transaction": func() error { return NewTxManager(tree).Begin().Set([]byte("c"), []byte("123456789")) },
+	} {
+		err := set()
+		require.True(t, errors.Is(err, ErrKeyTooLarge) || errors.Is(err, ErrValueTooLarge), "%v: %v", name, err)
+	}
+	require.Panics(t, func() { tree.Set([]byte("key12"), []byte("v")) })
+	require.Nil(t, tree.Get([]byte("d")))
+
+	// Oversized merge results fail the save before anything is written, and are kept pending.
+	require.NoError(t, tree.Merge([]byte("c"), []byte("123456789"), concat))
+	_, _, err = tree.SaveVersion()
+	require.True(t, errors.Is(err, ErrValueTooLarge), err)
+	require.Panics(t, func() { tree.WorkingHash() })
+	require.EqualValues(t, 1, tree.Version())
+	tree.Remove([]byte("c"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Nil(t, tree.Get([]byte("key12")))
+	require.Nil(t, tree.Get([]byte("c")))
+
+	// Entries set before the limits are found by iteration.
+	var oversized []string
+	tree.IterateOversized(func(key, value []byte, err error) bool {
+		oversized = append(oversized, string(key))
+		return false
+	})
+	require.Equal(t, []string{"a", "legacy-key"}, oversized)
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+	var errs []error
+	itree.IterateOversized(func(key, value []byte, err error) bool {
+		errs = append(errs, err)
+		return false
+	})
+	require.Len(t, errs, 2)
+	require.True(t, errors.Is(errs[0], ErrValueTooLarge))
+	require.True(t, errors.Is(errs[1], ErrKeyTooLarge))
+}
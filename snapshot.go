@@ -0,0 +1,72 @@
+package iavl
+
+import (
+	dbm "github.com/tendermint/tm-db"
+)
+
+// Snapshotter is implemented by databases which can provide consistent read-only snapshots, such
+// as LevelDB and RocksDB. When the database passed to the tree implements it, long-running reads
+// like exports and node traversals read from a snapshot, so they see a consistent view of the
+// database while new versions are saved, instead of the live state.
+type Snapshotter interface {
+	// Snapshot returns a read-only view of the database as of the call.
+	Snapshot() (DBSnapshot, error)
+}
+
+// DBSnapshot is a consistent read-only view of a database, see Snapshotter. It must be closed
+// when done.
+type DBSnapshot interface {
+	Get(key []byte) ([]byte, error)
+	Iterator(start, end []byte) (dbm.Iterator, error)
+	Close() error
+}
+
+// dbReader is the read access to a database or a snapshot of it.
+type dbReader interface {
+	Get(key []byte) ([]byte, error)
+	Iterator(start, end []byte) (dbm.Iterator, error)
+}
+
+var (
+	_ dbReader = (dbm.DB)(nil)
+	_ dbReader = (DBSnapshot)(nil)
+)
+
+// snapshot returns a snapshot of the database, or nil if it doesn't implement Snapshotter.
+func (ndb *nodeDB) snapshot() (DBSnapshot, error) {
+	snapshotter, ok := ndb.db.(Snapshotter)
+	if !ok {
+		return nil, nil
+	}
+	return snapshotter.Snapshot()
+}
+
+// withSnapshot calls fn with a snapshot of the database if supported, or the database itself
+// otherwise.
+func (ndb *nodeDB) withSnapshot(fn func(r dbReader) error) error {
+	snapshot, err := ndb.snapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return fn(ndb.db)
+	}
+	defer snapshot.Close()
+	return fn(snapshot)
+}
+
+// traversePrefixIn calls fn for all keys with the given prefix in the reader.
+func traversePrefixIn(r dbReader, prefix []byte, fn func(k, v []byte) error) error {
+	itr, err := r.Iterator(prefix, cpIncr(prefix))
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if err := fn(itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+	return itr.Error()
+}
@@ -0,0 +1,104 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+// snapshotMemDB is a MemDB supporting snapshots by copying its contents.
+type snapshotMemDB struct {
+	*db.MemDB
+	snapshots int
+}
+
+func (d *snapshotMemDB) Snapshot() (DBSnapshot, error) {
+	d.snapshots++
+	snapshot := db.NewMemDB()
+	itr, err := d.Iterator(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if err := snapshot.Set(itr.Key(), itr.Value()); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+func TestExporter_Snapshot(t *testing.T) {
+	memDB := &snapshotMemDB{MemDB: db.NewMemDB()}
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+	}
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Load the tree afresh, so that the export reads its nodes from the database.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	exporter := tree.ImmutableTree.Export()
+	defer exporter.Close()
+	require.Equal(t, 1, memDB.snapshots)
+
+	// Changes to the live database after the export started aren't seen by it.
+	itr, err := memDB.Iterator(nodeKeyFormat.Key(), cpIncr(nodeKeyFormat.Key()))
+	require.NoError(t, err)
+	var keys [][]byte
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, itr.Key())
+	}
+	require.NoError(t, itr.Close())
+	for _, key := range keys {
+		require.NoError(t, memDB.Delete(key))
+	}
+
+	target, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	importer, err := target.Import(version)
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		item, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(item))
+	}
+	require.NoError(t, importer.Commit())
+	require.Equal(t, hash, target.Hash())
+}
+
+func TestTraverseNodeHashes_Snapshot(t *testing.T) {
+	memDB := &snapshotMemDB{MemDB: db.NewMemDB()}
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// Nodes saved during the traversal aren't seen by it.
+	nodes := 0
+	err = tree.TraverseNodeHashes(func(hash []byte, size int, version int64) error {
+		if nodes == 0 {
+			tree.Set([]byte("c"), []byte("3"))
+			if _, _, err := tree.SaveVersion(); err != nil {
+				return err
+			}
+		}
+		nodes++
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, nodes)
+	require.Equal(t, 1, memDB.snapshots)
+}
@@ -0,0 +1,285 @@
+package iavl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// StoreManager hosts many logically separate trees, called stores, in a single database under
+// per-store key prefixes. The stores share a node cache and a write batch, so that Commit saves a
+// new version of all stores atomically, and the stores are always at the same version. Commit
+// also returns an aggregate root hash of all store roots, see AggregateRootHash.
+//
+// Commit saves the stores into the shared batch, and their writes are only persisted once it is
+// written, so the stores must only be changed with Set() and Remove() calls. They must not be
+// saved or written to directly, e.g. with SaveVersion(), DeleteVersion() or Import(), which read
+// back their own writes. Options.Journal and Options.MaxBatchBytes are not supported. A
+// StoreManager is not safe for concurrent use.
+type StoreManager struct {
+	db        dbm.DB
+	cacheSize int
+	opts      Options
+	nodeCache *lruCache
+	batch     dbm.Batch // the shared batch written by Commit
+	stores    map[string]*MutableTree
+	names     []string // sorted store names
+	version   int64
+	rootHash  []byte
+}
+
+// NewStoreManager returns a store manager for the given database. The cache size is the size of
+// the node cache shared by all stores, and of the fast node cache of each store, unless
+// overridden by the cache options. The options apply to all stores, with the pruning policy
+// applied after each Commit.
+func NewStoreManager(db dbm.DB, cacheSize int, opts *Options) (*StoreManager, error) {
+	if opts == nil {
+		defaultOpts := DefaultOptions()
+		opts = &defaultOpts
+	}
+	if opts.Journal {
+		return nil, errors.New("journal is not supported by StoreManager")
+	}
+	if opts.MaxBatchBytes > 0 {
+		return nil, errors.New("MaxBatchBytes is not supported by StoreManager")
+	}
+	return &StoreManager{
+		db:        db,
+		cacheSize: cacheSize,
+		opts:      *opts,
+		nodeCache: newNodeCache(cacheSize, opts),
+		batch:     db.NewBatch(),
+		stores:    make(map[string]*MutableTree),
+	}, nil
+}
+
+// storePrefix returns the key prefix of a store: its length-prefixed name, so that no prefix is a
+// prefix of another.
+func storePrefix(name string) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('s')
+	_ = encodeBytes(&buf, []byte(name))
+	return buf.Bytes()
+}
+
+// Mount adds a store with the given name, and returns its tree. Stores must be mounted before
+// Load is called. A store mounted for the first time starts at the next version to be committed.
+func (m *StoreManager) Mount(name string) (*MutableTree, error) {
+	if name == "" {
+		return nil, errors.New("store name cannot be empty")
+	}
+	if _, ok := m.stores[name]; ok {
+		return nil, errors.Errorf("store %q is already mounted", name)
+	}
+
+	opts := m.opts
+	opts.Pruning = nil // pruned by Commit once the shared batch is written
+	db := &storeDB{
+		DB:      dbm.NewPrefixDB(m.db, storePrefix(name)),
+		manager: m,
+		prefix:  storePrefix(name),
+	}
+	tree, err := NewMutableTreeWithOpts(db, m.cacheSize, &opts)
+	if err != nil {
+		return nil, err
+	}
+	tree.ndb.nodeCache = m.nodeCache
+
+	m.stores[name] = tree
+	m.names = append(m.names, name)
+	sort.Strings(m.names)
+	return tree, nil
+}
+
+// Store returns the tree of a mounted store, or nil if it isn't mounted.
+func (m *StoreManager) Store(name string) *MutableTree {
+	return m.stores[name]
+}
+
+// Names returns the names of the mounted stores, in sorted order.
+func (m *StoreManager) Names() []string {
+	return append([]string{}, m.names...)
+}
+
+// Load loads the latest version of all mounted stores, returning the version. All stores which
+// have been committed before must be at the same version.
+func (m *StoreManager) Load() (int64, error) {
+	var version int64
+	for _, name := range m.names {
+		storeVersion, err := m.stores[name].Load()
+		if err != nil {
+			return 0, errors.Wrapf(err, "loading store %q", name)
+		}
+		if storeVersion == 0 {
+			continue
+		}
+		if version > 0 && storeVersion != version {
+			return 0, errors.Errorf("store %q is at version %v, expected %v", name, storeVersion, version)
+		}
+		version = storeVersion
+	}
+
+	// Loading may repair or upgrade the stores.
+	if err := m.writeBatch(); err != nil {
+		return 0, err
+	}
+	m.version = version
+	m.rootHash = m.AggregateRootHash()
+	return version, nil
+}
+
+// Commit saves a new version of all stores in a single atomic write, applies the pruning policy,
+// and returns the aggregate root hash and the version. If it fails, the manager must be loaded
+// again before further use.
+func (m *StoreManager) Commit() ([]byte, int64, error) {
+	version := m.version + 1
+	if m.version == 0 && m.opts.InitialVersion > 0 {
+		version = int64(m.opts.InitialVersion)
+	}
+	for _, name := range m.names {
+		// A newly mounted store starts at the version being committed.
+		if _, _, err := m.stores[name].saveVersion(version); err != nil {
+			return nil, 0, errors.Wrapf(err, "saving store %q", name)
+		}
+	}
+	if err := m.writeBatch(); err != nil {
+		return nil, 0, err
+	}
+	m.version = version
+	m.rootHash = m.AggregateRootHash()
+
+	if m.opts.Pruning != nil {
+		for _, name := range m.names {
+			if err := m.stores[name].pruneWith(m.opts.Pruning); err != nil {
+				return nil, 0, errors.Wrapf(err, "pruning store %q", name)
+			}
+		}
+		if err := m.writeBatch(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return m.rootHash, version, nil
+}
+
+// Version returns the latest committed version.
+func (m *StoreManager) Version() int64 {
+	return m.version
+}
+
+// RootHash returns the aggregate root hash of the latest committed version.
+func (m *StoreManager) RootHash() []byte {
+	return m.rootHash
+}
+
+// writeBatch writes and resets the shared batch.
+func (m *StoreManager) writeBatch() error {
+	var err error
+	if m.opts.Sync {
+		err = m.batch.WriteSync()
+	} else {
+		err = m.batch.Write()
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write batch")
+	}
+	m.batch.Close()
+	m.batch = m.db.NewBatch()
+	return nil
+}
+
+// AggregateRootHash returns the aggregate root hash of the last saved versions of the stores: the
+// root of a binary Merkle tree of the stores in name order, split like RFC 6962, where
+//
+//	leaf  = sha256(0x00 || uvarint(len(name)) || name || uvarint(len(root)) || root)
+//	inner = sha256(0x01 || left || right)
+//
+// and the root of an empty manager is sha256 of the empty string.
+func (m *StoreManager) AggregateRootHash() []byte {
+	leaves := make([][]byte, 0, len(m.names))
+	for _, name := range m.names {
+		leaves = append(leaves, storeLeafHash(name, m.stores[name].Hash()))
+	}
+	return merkleRoot(leaves)
+}
+
+func storeLeafHash(name string, root []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0)
+	_ = encodeBytes(&buf, []byte(name))
+	_ = encodeBytes(&buf, root)
+	hash := sha256.Sum256(buf.Bytes())
+	return hash[:]
+}
+
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return sha256.New().Sum(nil)
+	case 1:
+		return leaves[0]
+	}
+	// Split at the largest power of two smaller than the number of leaves.
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(merkleRoot(leaves[:split]))
+	h.Write(merkleRoot(leaves[split:]))
+	return h.Sum(nil)
+}
+
+// storeDB is the database of a store: a prefixed view of the manager database, whose batches
+// write to the shared batch of the manager.
+type storeDB struct {
+	dbm.DB
+	manager *StoreManager
+	prefix  []byte
+}
+
+// NewBatch implements dbm.DB.
+func (db *storeDB) NewBatch() dbm.Batch {
+	return &storeBatch{db: db}
+}
+
+// storeBatch writes prefixed keys to the shared batch of the manager. Writing it does nothing,
+// since the shared batch is written by StoreManager.Commit.
+type storeBatch struct {
+	db *storeDB
+}
+
+var _ dbm.Batch = (*storeBatch)(nil)
+
+func (b *storeBatch) key(key []byte) []byte {
+	prefixed := make([]byte, 0, len(b.db.prefix)+len(key))
+	return append(append(prefixed, b.db.prefix...), key...)
+}
+
+// Set implements dbm.Batch.
+func (b *storeBatch) Set(key, value []byte) error {
+	return b.db.manager.batch.Set(b.key(key), value)
+}
+
+// Delete implements dbm.Batch.
+func (b *storeBatch) Delete(key []byte) error {
+	return b.db.manager.batch.Delete(b.key(key))
+}
+
+// Write implements dbm.Batch.
+func (b *storeBatch) Write() error {
+	return nil
+}
+
+// WriteSync implements dbm.Batch.
+func (b *storeBatch) WriteSync() error {
+	return nil
+}
+
+// Close implements dbm.Batch.
+func (b *storeBatch) Close() error {
+	return nil
+}
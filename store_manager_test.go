@@ -0,0 +1,82 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestStoreManager(t *testing.T) {
+	memDB := db.NewMemDB()
+	m, err := NewStoreManager(memDB, 100, &Options{Pruning: &PruningPolicy{KeepRecent: 2}})
+	require.NoError(t, err)
+	bank, err := m.Mount("bank")
+	require.NoError(t, err)
+	staking, err := m.Mount("staking")
+	require.NoError(t, err)
+	_, err = m.Mount("bank")
+	require.Error(t, err)
+	version, err := m.Load()
+	require.NoError(t, err)
+	require.Zero(t, version)
+	require.Equal(t, []string{"bank", "staking"}, m.Names())
+
+	// Nothing is written until the stores are committed together.
+	bank.Set([]byte("key"), []byte("bank"))
+	staking.Set([]byte("key"), []byte("staking"))
+	before := countPrefixKeys(t, memDB, nil)
+	root, version, err := m.Commit()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Greater(t, countPrefixKeys(t, memDB, nil), before)
+	require.Equal(t, root, m.RootHash())
+	require.Equal(t, merkleRoot([][]byte{
+		storeLeafHash("bank", bank.Hash()),
+		storeLeafHash("staking", staking.Hash()),
+	}), root)
+
+	for i := 0; i < 3; i++ {
+		bank.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = m.Commit()
+		require.NoError(t, err)
+	}
+	require.EqualValues(t, 4, m.Version())
+	require.Equal(t, []int{3, 4}, bank.AvailableVersions())
+	require.Equal(t, []int{3, 4}, staking.AvailableVersions())
+
+	// Reload, with a new store mounted, which starts at the next version.
+	root = m.RootHash()
+	m, err = NewStoreManager(memDB, 100, nil)
+	require.NoError(t, err)
+	bank, err = m.Mount("bank")
+	require.NoError(t, err)
+	staking, err = m.Mount("staking")
+	require.NoError(t, err)
+	gov, err := m.Mount("gov")
+	require.NoError(t, err)
+	version, err = m.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+	require.NotEqual(t, root, m.RootHash()) // gov is included
+
+	require.Equal(t, []byte("bank"), bank.Get([]byte("key")))
+	require.Equal(t, []byte("staking"), staking.Get([]byte("key")))
+	require.Equal(t, []byte{2}, bank.Get([]byte{2}))
+	require.Nil(t, staking.Get([]byte{2}))
+
+	gov.Set([]byte("proposal"), []byte{1})
+	_, version, err = m.Commit()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+	require.EqualValues(t, 5, gov.Version())
+	require.Equal(t, []int{5}, gov.AvailableVersions())
+	require.Zero(t, gov.ndb.opts.InitialVersion)
+}
+
+func TestStoreManager_UnsupportedOptions(t *testing.T) {
+	_, err := NewStoreManager(db.NewMemDB(), 0, &Options{Journal: true})
+	require.Error(t, err)
+	_, err = NewStoreManager(db.NewMemDB(), 0, &Options{MaxBatchBytes: 1})
+	require.Error(t, err)
+}
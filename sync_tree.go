@@ -0,0 +1,251 @@
+package iavl
+
+import (
+	"sync"
+
+	ics23 "github.com/confio/ics23/go"
+)
+
+// SyncMutableTree wraps a MutableTree to make it safe for concurrent use. Reads of the working
+// tree (Get, Iterate, Hash etc.) may run concurrently with each other, and are only blocked by
+// writes (Set, Remove, SaveVersion etc.).
+//
+// The wrapped tree must not be used directly while it is wrapped.
+type SyncMutableTree struct {
+	mtx  sync.RWMutex
+	tree *MutableTree
+}
+
+// NewSyncMutableTree wraps the given tree for concurrent use.
+func NewSyncMutableTree(tree *MutableTree) *SyncMutableTree {
+	return &SyncMutableTree{tree: tree}
+}
+
+// Get returns the value of the specified key in the working tree, or nil if it does not exist.
+func (t *SyncMutableTree) Get(key []byte) []byte {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Get(key)
+}
+
+// GetWithIndex returns the index and value of the specified key in the working tree.
+func (t *SyncMutableTree) GetWithIndex(key []byte) (int64, []byte) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.GetWithIndex(key)
+}
+
+// Has returns whether or not the key exists in the working tree.
+func (t *SyncMutableTree) Has(key []byte) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Has(key)
+}
+
+// HasAll returns whether or not each of the given keys exists in the working tree.
+func (t *SyncMutableTree) HasAll(keys [][]byte) []bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.HasAll(keys)
+}
+
+// FirstKey returns the smallest key of the working tree and its value.
+func (t *SyncMutableTree) FirstKey() ([]byte, []byte) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.FirstKey()
+}
+
+// LastKey returns the largest key of the working tree and its value.
+func (t *SyncMutableTree) LastKey() ([]byte, []byte) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.LastKey()
+}
+
+// Floor returns the greatest key of the working tree less than or equal to key, and its value.
+func (t *SyncMutableTree) Floor(key []byte) ([]byte, []byte) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Floor(key)
+}
+
+// Ceiling returns the smallest key of the working tree greater than or equal to key, and its
+// value.
+func (t *SyncMutableTree) Ceiling(key []byte) ([]byte, []byte) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Ceiling(key)
+}
+
+// GetVersioned returns the value of the specified key at a saved version.
+func (t *SyncMutableTree) GetVersioned(key []byte, version int64) []byte {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.GetVersioned(key, version)
+}
+
+// GetVersionedWithProof returns the value of the specified key at a saved version, with a proof.
+func (t *SyncMutableTree) GetVersionedWithProof(key []byte, version int64) ([]byte, *RangeProof, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.GetVersionedWithProof(key, version)
+}
+
+// GetWithProofBatch returns the values of the given keys at a saved version, with a batch proof.
+func (t *SyncMutableTree) GetWithProofBatch(version int64, keys [][]byte) ([][]byte, *ics23.CommitmentProof, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.GetWithProofBatch(version, keys)
+}
+
+// GetImmutable returns the tree at a saved version. The returned tree is safe for concurrent use.
+func (t *SyncMutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.GetImmutable(version)
+}
+
+// At returns a handle for querying a saved version, see MutableTree.At. The handle is safe for
+// concurrent use.
+func (t *SyncMutableTree) At(version int64) *VersionHandle {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.At(version)
+}
+
+// Iterate iterates over all keys of the working tree. The tree can't be written to until the
+// iteration completes, so fn must not write to it.
+func (t *SyncMutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Iterate(fn)
+}
+
+// IterateRange iterates over a range of keys of the working tree. The tree can't be written to
+// until the iteration completes, so fn must not write to it.
+func (t *SyncMutableTree) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (stopped bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.IterateRange(start, end, ascending, fn)
+}
+
+// Hash returns the hash of the latest saved version.
+func (t *SyncMutableTree) Hash() []byte {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Hash()
+}
+
+// WorkingHash returns the hash of the working tree. Since it hashes unsaved nodes in place, it
+// takes the write lock.
+func (t *SyncMutableTree) WorkingHash() []byte {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.WorkingHash()
+}
+
+// Version returns the latest saved version.
+func (t *SyncMutableTree) Version() int64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Version()
+}
+
+// Size returns the number of leaf nodes in the working tree.
+func (t *SyncMutableTree) Size() int64 {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Size()
+}
+
+// VersionExists returns whether or not a version exists.
+func (t *SyncMutableTree) VersionExists(version int64) bool {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.VersionExists(version)
+}
+
+// AvailableVersions returns all available versions in ascending order.
+func (t *SyncMutableTree) AvailableVersions() []int {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.AvailableVersions()
+}
+
+// Versions returns all persisted versions in ascending order.
+func (t *SyncMutableTree) Versions() ([]int64, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.Versions()
+}
+
+// VersionRanges returns the persisted versions as contiguous ranges in ascending order.
+func (t *SyncMutableTree) VersionRanges() ([]VersionRange, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.VersionRanges()
+}
+
+// HasVersionRange returns true if all versions in the inclusive range are persisted.
+func (t *SyncMutableTree) HasVersionRange(fromVersion, toVersion int64) (bool, error) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.tree.HasVersionRange(fromVersion, toVersion)
+}
+
+// Set sets a key in the working tree.
+func (t *SyncMutableTree) Set(key, value []byte) (updated bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.Set(key, value)
+}
+
+// Remove removes a key from the working tree.
+func (t *SyncMutableTree) Remove(key []byte) ([]byte, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.Remove(key)
+}
+
+// SaveVersion saves a new tree version, see MutableTree.SaveVersion.
+func (t *SyncMutableTree) SaveVersion() ([]byte, int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.SaveVersion()
+}
+
+// Rollback discards unsaved changes to the working tree.
+func (t *SyncMutableTree) Rollback() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.tree.Rollback()
+}
+
+// Load loads the latest version, see MutableTree.Load.
+func (t *SyncMutableTree) Load() (int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.Load()
+}
+
+// LoadVersion loads the given version, see MutableTree.LoadVersion.
+func (t *SyncMutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.LoadVersion(targetVersion)
+}
+
+// DeleteVersion deletes a saved version, see MutableTree.DeleteVersion.
+func (t *SyncMutableTree) DeleteVersion(version int64) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.DeleteVersion(version)
+}
+
+// DeleteVersionsRange deletes a range of saved versions, see MutableTree.DeleteVersionsRange.
+func (t *SyncMutableTree) DeleteVersionsRange(fromVersion, toVersion int64) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.tree.DeleteVersionsRange(fromVersion, toVersion)
+}
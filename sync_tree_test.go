@@ -0,0 +1,64 @@
+package iavl
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestSyncMutableTree_ConcurrentReadWrite(t *testing.T) {
+	mutable, err := NewMutableTree(db.NewMemDB(), 100)
+	require.NoError(t, err)
+	tree := NewSyncMutableTree(mutable)
+
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				require.Equal(t, []byte("value"), tree.Get([]byte("key050")))
+				require.True(t, tree.Has([]byte("key000")))
+				require.True(t, tree.VersionExists(1))
+				require.NotNil(t, tree.GetVersioned([]byte("key001"), 1))
+				count := 0
+				tree.Iterate(func(key, value []byte) bool {
+					count++
+					return false
+				})
+				require.GreaterOrEqual(t, count, 100)
+				require.NotEmpty(t, tree.Hash())
+			}
+		}()
+	}
+
+	for v := 0; v < 10; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("new%02d-%02d", v, i)), []byte("value"))
+		}
+		tree.Remove([]byte(fmt.Sprintf("new%02d-%02d", v, 0)))
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	close(done)
+	wg.Wait()
+
+	require.EqualValues(t, 11, tree.Version())
+	require.EqualValues(t, 100+10*19, tree.Size())
+	require.Equal(t, tree.Hash(), tree.WorkingHash())
+}
@@ -85,6 +85,40 @@ func P(n *Node) string {
 	return fmt.Sprintf("(%v %v)", P(n.leftNode), P(n.rightNode))
 }
 
+// dumpPrefix returns all key/value pairs of a database with the given prefix, or all of them if
+// the prefix is nil.
+func dumpPrefix(t *testing.T, db dbm.DB, prefix []byte) map[string]string {
+	items := make(map[string]string)
+	iteratePrefix(t, db, prefix, func(key, value []byte) {
+		items[string(key)] = string(value)
+	})
+	return items
+}
+
+// countPrefixKeys returns the number of keys of a database with the given prefix, or of all keys
+// if the prefix is nil.
+func countPrefixKeys(t *testing.T, db dbm.DB, prefix []byte) int {
+	count := 0
+	iteratePrefix(t, db, prefix, func(key, value []byte) {
+		count++
+	})
+	return count
+}
+
+func iteratePrefix(t *testing.T, db dbm.DB, prefix []byte, fn func(key, value []byte)) {
+	var end []byte
+	if len(prefix) > 0 {
+		end = cpIncr(prefix)
+	}
+	itr, err := db.Iterator(prefix, end)
+	require.NoError(t, err)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		fn(itr.Key(), itr.Value())
+	}
+	require.NoError(t, itr.Error())
+}
+
 func randBytes(length int) []byte {
 	key := make([]byte, length)
 	// math.rand.Read always returns err=nil
@@ -0,0 +1,78 @@
+package iavl
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// throttleBurst is the amount of work an ioThrottle allows ahead of its rate, so that short
+// bursts don't sleep in tiny increments.
+const throttleBurst = 100 * time.Millisecond
+
+// IOThrottleOptions limits the rate of database operations of maintenance tasks, see
+// Options.IOThrottle. Zero fields are unlimited.
+type IOThrottleOptions struct {
+	// OpsPerSecond is the maximum number of keys read or written per second.
+	OpsPerSecond int
+
+	// BytesPerSecond is the maximum number of key and value bytes read or written per second.
+	BytesPerSecond int
+}
+
+// ioThrottle paces work to the configured rates. Work is charged as it is done, possibly with
+// the database locked, and waited for once the lock is released.
+type ioThrottle struct {
+	opts IOThrottleOptions
+	now  func() time.Time
+
+	mtx  sync.Mutex
+	next time.Time // time at which the work charged so far is paid for
+}
+
+func newIOThrottle(opts IOThrottleOptions) *ioThrottle {
+	return &ioThrottle{opts: opts, now: time.Now}
+}
+
+// charge records the given number of operations and bytes.
+func (t *ioThrottle) charge(ops, bytes int) {
+	var cost time.Duration
+	if t.opts.OpsPerSecond > 0 {
+		cost = time.Duration(ops) * time.Second / time.Duration(t.opts.OpsPerSecond)
+	}
+	if t.opts.BytesPerSecond > 0 {
+		if c := time.Duration(bytes) * time.Second / time.Duration(t.opts.BytesPerSecond); c > cost {
+			cost = c
+		}
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if now := t.now(); t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(cost)
+}
+
+// delay returns how long to wait for the work charged so far.
+func (t *ioThrottle) delay() time.Duration {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.next.Sub(t.now()) - throttleBurst
+}
+
+// wait waits for the work charged so far, or until ctx is done.
+func (t *ioThrottle) wait(ctx context.Context) error {
+	delay := t.delay()
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,102 @@
+package iavl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestIOThrottle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	throttle := newIOThrottle(IOThrottleOptions{OpsPerSecond: 100, BytesPerSecond: 1000})
+	throttle.now = func() time.Time { return now }
+
+	// Work within the burst doesn't wait.
+	throttle.charge(5, 0)
+	require.LessOrEqual(t, throttle.delay(), time.Duration(0))
+
+	// The slower of the two rates applies.
+	throttle.charge(5, 1000)
+	require.Equal(t, 1050*time.Millisecond-throttleBurst, throttle.delay())
+	throttle.charge(100, 0)
+	require.Equal(t, 2050*time.Millisecond-throttleBurst, throttle.delay())
+
+	// Time passing pays for the work, but idle time isn't saved up.
+	now = now.Add(10 * time.Second)
+	require.Equal(t, 2050*time.Millisecond-10*time.Second-throttleBurst, throttle.delay())
+	throttle.charge(10, 0)
+	require.Equal(t, 100*time.Millisecond-throttleBurst, throttle.delay())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	throttle.charge(1000, 0)
+	require.True(t, errors.Is(throttle.wait(ctx), context.Canceled))
+}
+
+func TestIOThrottle_Maintenance(t *testing.T) {
+	build := func(opts *Options) *MutableTree {
+		tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, opts)
+		require.NoError(t, err)
+		for v := 0; v < 5; v++ {
+			for i := 0; i < 20; i++ {
+				tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", v)))
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+	expect := build(nil)
+	require.NoError(t, expect.DeleteVersionsRange(1, 4))
+
+	opts := &Options{IOThrottle: &IOThrottleOptions{OpsPerSecond: 200}}
+	tree := build(opts)
+
+	// Throttled deletions have the same result.
+	start := time.Now()
+	require.NoError(t, tree.DeleteVersionsRangeContext(context.Background(), 1, 4))
+	require.Equal(t, expect.AvailableVersions(), tree.AvailableVersions())
+	require.Equal(t, dumpPrefix(t, expect.ndb.db, nil), dumpPrefix(t, tree.ndb.db, nil))
+	require.Error(t, tree.DeleteVersionsRangeContext(context.Background(), 4, 6))
+
+	// Exports are paced: each node costs 5ms, and the deletion above was charged too.
+	exporter := tree.Export()
+	defer exporter.Close()
+	nodes := 0
+	for {
+		_, err := exporter.Next()
+		if err == ExportDone {
+			break
+		}
+		require.NoError(t, err)
+		nodes++
+	}
+	require.Equal(t, 39, nodes)
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Duration(nodes)*5*time.Millisecond-throttleBurst))
+}
+
+func TestIOThrottle_SaveVersionPruning(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		IOThrottle: &IOThrottleOptions{OpsPerSecond: 1},
+		Pruning:    &PruningPolicy{KeepRecent: 1},
+	})
+	require.NoError(t, err)
+
+	// Pruning by SaveVersion is charged, but never waits.
+	start := time.Now()
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 20; i++ {
+			tree.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", v)))
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.Equal(t, []int{5}, tree.AvailableVersions())
+	require.Positive(t, tree.ndb.throttle.delay())
+}
@@ -0,0 +1,149 @@
+package iavl
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Span attributes set by traced tree operations.
+const (
+	AttrVersion           = "iavl.version"
+	AttrNodeReads         = "iavl.node_reads"
+	AttrNodeCacheHits     = "iavl.node_cache_hits"
+	AttrFastNodeReads     = "iavl.fast_node_reads"
+	AttrFastNodeCacheHits = "iavl.fast_node_cache_hits"
+)
+
+// Tracer starts spans for tree operations, see Options.Tracer. It is a minimal subset of the
+// OpenTelemetry API, which can be adapted by wrapping trace.Tracer.Start and converting
+// attribute values with attribute.Int64, attribute.Bool and attribute.String.
+type Tracer interface {
+	// Start starts a span with the given name as a child of any span in ctx, and returns a
+	// context containing the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span. Values are int64, bool or string.
+	SetAttribute(key string, value interface{})
+	// RecordError records an error returned by the operation.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// readStats counts the nodes and fast nodes read by a traced operation. It is safe for
+// concurrent use.
+type readStats struct {
+	nodeReads, nodeCacheHits         int64
+	fastNodeReads, fastNodeCacheHits int64
+}
+
+// readNode records a read of a node.
+func (s *readStats) readNode(hit bool) {
+	atomic.AddInt64(&s.nodeReads, 1)
+	if hit {
+		atomic.AddInt64(&s.nodeCacheHits, 1)
+	}
+}
+
+// readFastNode records a read of a fast node.
+func (s *readStats) readFastNode(hit bool) {
+	atomic.AddInt64(&s.fastNodeReads, 1)
+	if hit {
+		atomic.AddInt64(&s.fastNodeCacheHits, 1)
+	}
+}
+
+// startSpan starts a span for an operation on the given tree if tracing is enabled, and
+// returns the context of the span and a copy of the tree recording its reads, along with a
+// function ending the span, which must be called with the operation's error. If tracing is
+// disabled, the context and tree are returned as is.
+func (t *ImmutableTree) startSpan(ctx context.Context, name string) (context.Context, *ImmutableTree, func(err error)) {
+	if t.ndb == nil || t.ndb.opts.Tracer == nil {
+		return ctx, t, func(error) {}
+	}
+	ctx, span := t.ndb.opts.Tracer.Start(ctx, name)
+	traced := *t
+	traced.stats = &readStats{}
+	return ctx, &traced, func(err error) {
+		endSpan(span, traced.version, traced.stats, err)
+	}
+}
+
+// startWriteSpan is like ImmutableTree.startSpan, but for an operation writing the working tree.
+// The traced copy replaces the working tree until the span ends, so that the working tree seen
+// by any other reader is never modified to record reads. Writes already require exclusive
+// access to the tree.
+func (tree *MutableTree) startWriteSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	ctx, traced, end := tree.ImmutableTree.startSpan(ctx, name)
+	if traced == tree.ImmutableTree {
+		return ctx, end
+	}
+	tree.ImmutableTree = traced
+	return ctx, func(err error) {
+		// The operation may have replaced the working tree, e.g. by saving a version.
+		if tree.ImmutableTree == traced {
+			untraced := *traced
+			untraced.stats = nil
+			tree.ImmutableTree = &untraced
+		}
+		end(err)
+	}
+}
+
+// endSpan sets the read attributes of a span and ends it.
+func endSpan(span Span, version int64, stats *readStats, err error) {
+	span.SetAttribute(AttrVersion, version)
+	span.SetAttribute(AttrNodeReads, atomic.LoadInt64(&stats.nodeReads))
+	span.SetAttribute(AttrNodeCacheHits, atomic.LoadInt64(&stats.nodeCacheHits))
+	span.SetAttribute(AttrFastNodeReads, atomic.LoadInt64(&stats.fastNodeReads))
+	span.SetAttribute(AttrFastNodeCacheHits, atomic.LoadInt64(&stats.fastNodeCacheHits))
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// GetContext is like Get, but traced by Options.Tracer as a child of any span in ctx.
+func (t *ImmutableTree) GetContext(ctx context.Context, key []byte) []byte {
+	_, traced, end := t.startSpan(ctx, "iavl.Get")
+	value := traced.Get(key)
+	end(nil)
+	return value
+}
+
+// GetWithProofContext is like GetWithProof, but traced by Options.Tracer as a child of any
+// span in ctx.
+func (t *ImmutableTree) GetWithProofContext(ctx context.Context, key []byte) ([]byte, *RangeProof, error) {
+	_, traced, end := t.startSpan(ctx, "iavl.GetWithProof")
+	value, proof, err := traced.GetWithProof(key)
+	end(err)
+	return value, proof, err
+}
+
+// GetContext is like Get, but traced by Options.Tracer as a child of any span in ctx.
+func (tree *MutableTree) GetContext(ctx context.Context, key []byte) []byte {
+	_, traced, end := tree.ImmutableTree.startSpan(ctx, "iavl.Get")
+	value := tree.getMerged(traced, key)
+	end(nil)
+	return value
+}
+
+// SetContext is like Set, but traced by Options.Tracer as a child of any span in ctx.
+func (tree *MutableTree) SetContext(ctx context.Context, key, value []byte) (updated bool) {
+	_, end := tree.startWriteSpan(ctx, "iavl.Set")
+	updated = tree.Set(key, value)
+	end(nil)
+	return updated
+}
+
+// SaveVersionContext is like SaveVersion, but traced by Options.Tracer as a child of any span
+// in ctx.
+func (tree *MutableTree) SaveVersionContext(ctx context.Context) ([]byte, int64, error) {
+	_, end := tree.startWriteSpan(ctx, "iavl.SaveVersion")
+	hash, version, err := tree.SaveVersion()
+	end(err)
+	return hash, version, err
+}
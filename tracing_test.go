@@ -0,0 +1,110 @@
+package iavl
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+type recordingSpan struct {
+	name       string
+	parent     *recordingSpan
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *recordingSpan) RecordError(err error)                      { s.err = err }
+func (s *recordingSpan) End()                                       { s.ended = true }
+
+type recordingSpanKey struct{}
+
+// recordingTracer records the spans started.
+type recordingTracer struct {
+	mtx   sync.Mutex
+	spans []*recordingSpan
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	parent, _ := ctx.Value(recordingSpanKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attributes: map[string]interface{}{}}
+	tr.spans = append(tr.spans, span)
+	return context.WithValue(ctx, recordingSpanKey{}, span), span
+}
+
+func (tr *recordingTracer) last() *recordingSpan {
+	tr.mtx.Lock()
+	defer tr.mtx.Unlock()
+	return tr.spans[len(tr.spans)-1]
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 100, &Options{Tracer: tracer})
+	require.NoError(t, err)
+
+	parentCtx, parent := tracer.Start(context.Background(), "parent")
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.False(t, tree.SetContext(parentCtx, []byte(key), []byte("v"+key)))
+	}
+	span := tracer.last()
+	require.Equal(t, "iavl.Set", span.name)
+	require.Equal(t, parent, span.parent)
+	require.True(t, span.ended)
+	require.Nil(t, tree.ImmutableTree.stats)
+
+	// Spans started within a traced operation are its children.
+	ctx, _, end := tree.ImmutableTree.startSpan(parentCtx, "iavl.Test")
+	require.Equal(t, tracer.last(), ctx.Value(recordingSpanKey{}))
+	end(nil)
+
+	hash, version, err := tree.SaveVersionContext(parentCtx)
+	require.NoError(t, err)
+	span = tracer.last()
+	require.Equal(t, "iavl.SaveVersion", span.name)
+	require.Equal(t, version, span.attributes[AttrVersion])
+	require.Nil(t, span.err)
+	require.Nil(t, tree.ImmutableTree.stats)
+
+	// Reads of the saved version hit the node cache and fast node cache.
+	require.Equal(t, []byte("vc"), tree.GetContext(parentCtx, []byte("c")))
+	span = tracer.last()
+	require.Equal(t, "iavl.Get", span.name)
+	require.EqualValues(t, 1, span.attributes[AttrFastNodeReads])
+	require.EqualValues(t, 1, span.attributes[AttrFastNodeCacheHits])
+
+	// A fresh tree loads nodes from the database.
+	tracer = &recordingTracer{}
+	tree, err = NewMutableTreeWithOpts(tree.ndb.db, 100, &Options{Tracer: tracer})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	value, proof, err := itree.GetWithProofContext(context.Background(), []byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("vb"), value)
+	require.NoError(t, proof.Verify(hash))
+	span = tracer.last()
+	require.Equal(t, "iavl.GetWithProof", span.name)
+	require.EqualValues(t, version, span.attributes[AttrVersion])
+	require.Positive(t, span.attributes[AttrNodeReads])
+	require.Less(t, span.attributes[AttrNodeCacheHits], span.attributes[AttrNodeReads])
+	require.Nil(t, itree.stats)
+}
+
+func TestTracing_Disabled(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, nil)
+	require.NoError(t, err)
+	require.False(t, tree.SetContext(context.Background(), []byte("k"), []byte("v")))
+	_, _, err = tree.SaveVersionContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), tree.GetContext(context.Background(), []byte("k")))
+}
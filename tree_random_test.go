@@ -353,7 +353,9 @@ func assertEmptyDatabase(t *testing.T, tree *MutableTree) {
 
 	storageVersionValue, err := tree.ndb.db.Get([]byte(firstKey))
 	require.NoError(t, err)
-	require.Equal(t, fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(int(tree.ndb.getLatestVersion())), string(storageVersionValue))
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	require.Equal(t, fastStorageVersionValue+fastStorageVersionDelimiter+strconv.Itoa(int(latest)), string(storageVersionValue))
 
 	var foundVersion int64
 	rootKeyFormat.Scan([]byte(secondKey), &foundVersion)
@@ -413,28 +415,32 @@ func assertMirror(t *testing.T, tree *MutableTree, mirror map[string]string, ver
 
 // Checks that fast node cache matches live state.
 func assertFastNodeCacheIsLive(t *testing.T, tree *MutableTree, mirror map[string]string, version int64) {
-	if tree.ndb.getLatestVersion() != version {
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	if latest != version {
 		// The fast node cache check should only be done to the latest version
 		return
 	}
 
-	for key, cacheElem := range tree.ndb.fastNodeCache {
+	tree.ndb.fastNodeCache.Each(func(key string, cached interface{}) {
 		liveFastNode := mirror[key]
 
 		require.NotNil(t, liveFastNode, "cached fast node must be in live tree")
-		require.Equal(t, liveFastNode, string(cacheElem.Value.(*FastNode).value), "cached fast node's value must be equal to live state value")
-	}
+		require.Equal(t, liveFastNode, string(cached.(*FastNode).value), "cached fast node's value must be equal to live state value")
+	})
 }
 
 // Checks that fast nodes on disk match live state.
 func assertFastNodeDiskIsLive(t *testing.T, tree *MutableTree, mirror map[string]string, version int64) {
-	if tree.ndb.getLatestVersion() != version {
+	latest, err := tree.ndb.getLatestVersion()
+	require.NoError(t, err)
+	if latest != version {
 		// The fast node disk check should only be done to the latest version
 		return
 	}
 
 	count := 0
-	err := tree.ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
+	err = tree.ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
 		key := keyWithPrefix[1:]
 		count += 1
 		fastNode, err := DeserializeFastNode(key, v)
@@ -0,0 +1,198 @@
+package iavl
+
+import "fmt"
+
+// TreeStats contains shape and size statistics of a tree, as returned by ImmutableTree.Stats()
+// and ImmutableTree.SampleStats().
+type TreeStats struct {
+	Height         int8    // Height of the root node.
+	LeafCount      int64   // Number of leaf nodes, i.e. keys.
+	InnerNodeCount int64   // Number of inner nodes.
+	MaxDepth       int     // Depth of the deepest leaf, where the root has depth 0.
+	AvgDepth       float64 // Average depth of leaves.
+	KeyBytes       int64   // Total size of all leaf keys.
+	ValueBytes     int64   // Total size of all leaf values.
+	NodeBytes      int64   // Total encoded size of all nodes, as stored in the database.
+
+	// Sampled is true if the depth and byte statistics were estimated from a sample of leaves.
+	// Height, LeafCount, InnerNodeCount and MaxDepth are always exact.
+	Sampled bool
+}
+
+// String returns a string representation of the stats.
+func (s TreeStats) String() string {
+	return fmt.Sprintf("TreeStats{height=%d leaves=%d inner=%d depth(max=%d avg=%.2f) bytes(keys=%d values=%d nodes=%d) sampled=%v}",
+		s.Height, s.LeafCount, s.InnerNodeCount, s.MaxDepth, s.AvgDepth,
+		s.KeyBytes, s.ValueBytes, s.NodeBytes, s.Sampled)
+}
+
+// Stats traverses the whole tree and returns its exact statistics. For large trees, consider
+// SampleStats instead, which only visits a bounded number of nodes.
+func (t *ImmutableTree) Stats() TreeStats {
+	stats := t.exactStats()
+	if t.root == nil {
+		return stats
+	}
+
+	var depthSum int64
+	var walk func(node *Node, depth int)
+	walk = func(node *Node, depth int) {
+		stats.NodeBytes += int64(node.encodedSize())
+		if node.isLeaf() {
+			depthSum += int64(depth)
+			stats.KeyBytes += int64(len(node.key))
+			stats.ValueBytes += int64(len(node.value))
+			return
+		}
+		walk(node.getLeftNode(t), depth+1)
+		walk(node.getRightNode(t), depth+1)
+	}
+	walk(t.root, 0)
+
+	stats.AvgDepth = float64(depthSum) / float64(stats.LeafCount)
+	return stats
+}
+
+// SampleStats estimates the tree statistics by descending to at most samples leaves, evenly
+// spaced by index. It visits at most samples*(height+1) nodes regardless of the tree size. If
+// samples is at least the number of leaves, the result is the same as Stats().
+func (t *ImmutableTree) SampleStats(samples int) TreeStats {
+	if samples <= 0 {
+		samples = 1
+	}
+	if t.root == nil || int64(samples) >= t.root.size {
+		return t.Stats()
+	}
+
+	stats := t.exactStats()
+	stats.Sampled = true
+
+	var (
+		depthSum, keyBytes, valueBytes, leafBytes int64
+		innerBytes, innerSeen                     int64
+	)
+	for i := 0; i < samples; i++ {
+		index := int64(i) * stats.LeafCount / int64(samples)
+		node, depth := t.root, 0
+		for !node.isLeaf() {
+			innerBytes += int64(node.encodedSize())
+			innerSeen++
+			left := node.getLeftNode(t)
+			if index < left.size {
+				node = left
+			} else {
+				index -= left.size
+				node = node.getRightNode(t)
+			}
+			depth++
+		}
+		depthSum += int64(depth)
+		keyBytes += int64(len(node.key))
+		valueBytes += int64(len(node.value))
+		leafBytes += int64(node.encodedSize())
+	}
+
+	scale := float64(stats.LeafCount) / float64(samples)
+	stats.AvgDepth = float64(depthSum) / float64(samples)
+	stats.KeyBytes = int64(float64(keyBytes) * scale)
+	stats.ValueBytes = int64(float64(valueBytes) * scale)
+	stats.NodeBytes = int64(float64(leafBytes) * scale)
+	if innerSeen > 0 {
+		stats.NodeBytes += innerBytes * stats.InnerNodeCount / innerSeen
+	}
+	return stats
+}
+
+// PrefixStats contains size statistics of the leaves under a key prefix, as returned by
+// ImmutableTree.PrefixStats().
+type PrefixStats struct {
+	Prefix     []byte
+	LeafCount  int64 // Number of leaves with the prefix.
+	KeyBytes   int64 // Total size of the leaf keys.
+	ValueBytes int64 // Total size of the leaf values.
+	NodeBytes  int64 // Total encoded size of the leaf nodes, as stored in the database.
+
+	// Sampled is true if the byte statistics were estimated from a sample of leaves. LeafCount
+	// is always exact.
+	Sampled bool
+}
+
+// PrefixStats attributes the leaves of the tree to the given key prefixes, e.g. the store
+// prefixes of modules, to find out which of them is responsible for state growth. Inner nodes
+// are shared between prefixes, and are not attributed. If samples is positive, the byte
+// statistics of prefixes with more leaves are estimated from that many leaves, evenly spaced by
+// index, visiting at most samples*(height+1) nodes per prefix.
+func (t *ImmutableTree) PrefixStats(prefixes [][]byte, samples int) []PrefixStats {
+	result := make([]PrefixStats, len(prefixes))
+	for i, prefix := range prefixes {
+		result[i] = t.prefixStats(prefix, samples)
+	}
+	return result
+}
+
+func (t *ImmutableTree) prefixStats(prefix []byte, samples int) PrefixStats {
+	stats := PrefixStats{Prefix: prefix}
+	if t.root == nil {
+		return stats
+	}
+
+	// The index of a key is the number of leaves before it, whether it exists or not.
+	start, _ := t.root.get(t, prefix)
+	end := t.root.size
+	if endKey := prefixEnd(prefix); endKey != nil {
+		end, _ = t.root.get(t, endKey)
+	}
+	stats.LeafCount = end - start
+
+	addLeaf := func(node *Node) {
+		stats.KeyBytes += int64(len(node.key))
+		stats.ValueBytes += int64(len(node.value))
+		stats.NodeBytes += int64(node.encodedSize())
+	}
+
+	if samples <= 0 || int64(samples) >= stats.LeafCount {
+		t.root.traverseInRange(t, prefix, prefixEnd(prefix), true, false, false, func(node *Node) bool {
+			if node.isLeaf() {
+				addLeaf(node)
+			}
+			return false
+		})
+		return stats
+	}
+
+	stats.Sampled = true
+	for i := 0; i < samples; i++ {
+		index := start + int64(i)*stats.LeafCount/int64(samples)
+		node := t.root
+		for !node.isLeaf() {
+			left := node.getLeftNode(t)
+			if index < left.size {
+				node = left
+			} else {
+				index -= left.size
+				node = node.getRightNode(t)
+			}
+		}
+		addLeaf(node)
+	}
+	scale := float64(stats.LeafCount) / float64(samples)
+	stats.KeyBytes = int64(float64(stats.KeyBytes) * scale)
+	stats.ValueBytes = int64(float64(stats.ValueBytes) * scale)
+	stats.NodeBytes = int64(float64(stats.NodeBytes) * scale)
+	return stats
+}
+
+// exactStats returns the statistics which can be derived from the root node alone.
+func (t *ImmutableTree) exactStats() TreeStats {
+	if t.root == nil {
+		return TreeStats{}
+	}
+	// Every inner node has exactly two children, and the height of a node is the length of the
+	// longest path to a leaf below it.
+	return TreeStats{
+		Height:         t.root.height,
+		LeafCount:      t.root.size,
+		InnerNodeCount: t.root.size - 1,
+		MaxDepth:       int(t.root.height),
+	}
+}
@@ -0,0 +1,88 @@
+package iavl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	db "github.com/tendermint/tm-db"
+)
+
+func TestImmutableTree_Stats(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	require.Equal(t, TreeStats{}, tree.Stats())
+
+	const count = 1000
+	for i := 0; i < count; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	stats := tree.Stats()
+	require.False(t, stats.Sampled)
+	require.Equal(t, tree.Height(), stats.Height)
+	require.EqualValues(t, count, stats.LeafCount)
+	require.EqualValues(t, count-1, stats.InnerNodeCount)
+	require.EqualValues(t, tree.nodeSize(), stats.LeafCount+stats.InnerNodeCount)
+	require.Equal(t, int(tree.Height()), stats.MaxDepth)
+	require.EqualValues(t, count*7, stats.KeyBytes)
+	require.True(t, stats.AvgDepth > 9 && stats.AvgDepth <= float64(stats.MaxDepth), "avg depth %v", stats.AvgDepth)
+
+	nodeBytes := int64(0)
+	err = tree.ndb.traverseNodes(func(hash []byte, node *Node) error {
+		nodeBytes += int64(node.encodedSize())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, nodeBytes, stats.NodeBytes)
+
+	sampled := tree.SampleStats(100)
+	require.True(t, sampled.Sampled)
+	require.Equal(t, stats.Height, sampled.Height)
+	require.Equal(t, stats.LeafCount, sampled.LeafCount)
+	require.Equal(t, stats.InnerNodeCount, sampled.InnerNodeCount)
+	require.Equal(t, stats.KeyBytes, sampled.KeyBytes)
+	require.InDelta(t, stats.AvgDepth, sampled.AvgDepth, 1)
+	require.InEpsilon(t, stats.ValueBytes, sampled.ValueBytes, 0.05)
+	require.InEpsilon(t, stats.NodeBytes, sampled.NodeBytes, 0.25)
+
+	require.Equal(t, stats, tree.SampleStats(count))
+}
+
+func TestImmutableTree_PrefixStats(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	modules := map[string]int{"bank/": 10, "gov/": 100, "staking/": 1000}
+	for module, valueSize := range modules {
+		for i := 0; i < valueSize; i++ {
+			tree.Set([]byte(fmt.Sprintf("%s%04d", module, i)), make([]byte, valueSize))
+		}
+	}
+	tree.Set([]byte{0xff, 0xff}, []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	prefixes := [][]byte{[]byte("bank/"), []byte("gov/"), []byte("staking/"), []byte("missing/"), {0xff}}
+	for _, samples := range []int{0, 20} {
+		stats := tree.PrefixStats(prefixes, samples)
+		require.Len(t, stats, len(prefixes))
+		for i, module := range []string{"bank/", "gov/", "staking/"} {
+			count := modules[module]
+			require.Equal(t, []byte(module), stats[i].Prefix)
+			require.EqualValues(t, count, stats[i].LeafCount)
+			require.EqualValues(t, count*(len(module)+4), stats[i].KeyBytes)
+			require.EqualValues(t, count*count, stats[i].ValueBytes)
+			require.Equal(t, samples > 0 && count > samples, stats[i].Sampled)
+		}
+		require.Equal(t, PrefixStats{Prefix: []byte("missing/")}, stats[3])
+		require.EqualValues(t, 1, stats[4].LeafCount)
+		require.EqualValues(t, 2, stats[4].KeyBytes)
+	}
+
+	stats := tree.PrefixStats([][]byte{nil}, 0)
+	require.EqualValues(t, tree.Size(), stats[0].LeafCount)
+	require.Equal(t, tree.Stats().ValueBytes, stats[0].ValueBytes)
+}
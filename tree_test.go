@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -1370,6 +1371,29 @@ func TestLazyLoadVersion(t *testing.T) {
 	require.Equal(t, version, int64(maxVersions))
 }
 
+func TestLoadRootOnly(t *testing.T) {
+	countingDB := &getCountingDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTree(countingDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		tree.Set([]byte(strconv.Itoa(i%5)), []byte(strconv.Itoa(i)))
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	base := NewImmutableTreeWithOpts(countingDB, 0, nil)
+	countingDB.gets = 0
+	iTree, err := base.LoadRootOnly(7)
+	require.NoError(t, err)
+	require.Equal(t, 2, countingDB.gets) // the root entry and the root node
+	require.EqualValues(t, 7, iTree.Version())
+	require.Equal(t, []byte("6"), iTree.Get([]byte("1")))
+	require.Nil(t, iTree.Get([]byte("9")))
+
+	_, err = base.LoadRootOnly(21)
+	require.Equal(t, ErrVersionDoesNotExist, err)
+}
+
 func TestOverwrite(t *testing.T) {
 	require := require.New(t)
 
@@ -1384,7 +1408,7 @@ func TestOverwrite(t *testing.T) {
 
 	// Set another kv pair and save version 2
 	tree.Set([]byte("key2"), []byte("value2"))
-	_, _, err = tree.SaveVersion()
+	hash2, _, err := tree.SaveVersion()
 	require.NoError(err, "SaveVersion should not fail")
 
 	// Reload tree at version 1
@@ -1395,13 +1419,21 @@ func TestOverwrite(t *testing.T) {
 
 	// Attempt to put a different kv pair into the tree and save
 	tree.Set([]byte("key2"), []byte("different value 2"))
+	differentHash := tree.WorkingHash()
 	_, _, err = tree.SaveVersion()
 	require.Error(err, "SaveVersion should fail because of changed value")
+	var existsErr *VersionExistsError
+	require.True(errors.As(err, &existsErr))
+	require.EqualValues(2, existsErr.Version)
+	require.Equal(hash2, existsErr.ExistingHash)
+	require.Equal(differentHash, existsErr.NewHash)
 
 	// Replay the original transition from version 1 to version 2 and attempt to save
 	tree.Set([]byte("key2"), []byte("value2"))
-	_, _, err = tree.SaveVersion()
+	hash, version, err := tree.SaveVersion()
 	require.NoError(err, "SaveVersion should not fail, overwrite was idempotent")
+	require.Equal(hash2, hash)
+	require.EqualValues(2, version)
 }
 
 func TestOverwriteEmpty(t *testing.T) {
@@ -1923,3 +1955,151 @@ func Benchmark_GetByIndex(b *testing.B) {
 		}
 	})
 }
+
+func TestRankCache(t *testing.T) {
+	countingDB := &getCountingDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTreeWithOpts(countingDB, 0, &Options{RankCacheSize: 100})
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("key%03d", i*2)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree, err = NewMutableTreeWithOpts(countingDB, 0, &Options{RankCacheSize: 100})
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+
+	index, value := tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 5, index)
+	require.Equal(t, []byte{5}, value)
+	index, value = tree.GetWithIndex([]byte("key011"))
+	require.EqualValues(t, 6, index)
+	require.Nil(t, value)
+
+	// Repeated lookups, and index lookups of keys looked up before, don't read any nodes.
+	countingDB.gets = 0
+	index, value = tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 5, index)
+	require.Equal(t, []byte{5}, value)
+	index, value = tree.GetWithIndex([]byte("key011"))
+	require.EqualValues(t, 6, index)
+	require.Nil(t, value)
+	key, value := tree.GetByIndex(5)
+	require.Equal(t, []byte("key010"), key)
+	require.Equal(t, []byte{5}, value)
+	require.Zero(t, countingDB.gets)
+
+	// Ranks of the working tree are not cached, and cached ranks are dropped when the version
+	// number is saved again.
+	tree.Set([]byte("key000a"), []byte{1})
+	index, _ = tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 6, index)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	index, _ = tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 6, index)
+
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	index, _ = tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 5, index)
+	tree.Remove([]byte("key000"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	index, _ = tree.GetWithIndex([]byte("key010"))
+	require.EqualValues(t, 4, index)
+}
+
+func TestHasAll(t *testing.T) {
+	countingDB := &getCountingDB{DB: db.NewMemDB()}
+	tree, err := NewMutableTree(countingDB, 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("b"), []byte("2"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Remove([]byte("a"))
+	tree.Set([]byte("c"), []byte("3"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+
+	tree, err = NewMutableTree(countingDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	latest, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	countingDB.gets = 0
+	require.Equal(t, []bool{false, true, true, false}, latest.HasAll(keys))
+	require.Zero(t, countingDB.gets) // the latest version only checks the fast index
+
+	old, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, false, false}, old.HasAll(keys))
+	require.Empty(t, old.HasAll(nil))
+
+	tree.Set([]byte("d"), []byte("4"))
+	tree.Remove([]byte("b"))
+	require.Equal(t, []bool{false, false, true, true}, tree.HasAll(keys))
+	require.True(t, tree.Has([]byte("c")))
+}
+
+func TestFloorCeiling(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	key, _ := tree.FirstKey()
+	require.Nil(t, key)
+	key, _ = tree.Floor([]byte("a"))
+	require.Nil(t, key)
+
+	// Keys 010, 020, ..., 990.
+	for i := 1; i < 100; i++ {
+		tree.Set([]byte(fmt.Sprintf("%03d", i*10)), []byte{byte(i)})
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	key, value := tree.FirstKey()
+	require.Equal(t, []byte("010"), key)
+	require.Equal(t, []byte{1}, value)
+	key, value = tree.LastKey()
+	require.Equal(t, []byte("990"), key)
+	require.Equal(t, []byte{99}, value)
+
+	for i := 0; i < 1000; i++ {
+		query := []byte(fmt.Sprintf("%03d", i))
+		key, value := tree.Floor(query)
+		if i < 10 {
+			require.Nil(t, key)
+			require.Nil(t, value)
+		} else {
+			require.Equal(t, []byte(fmt.Sprintf("%03d", i/10*10)), key)
+			require.Equal(t, []byte{byte(i / 10)}, value)
+		}
+
+		key, value = tree.Ceiling(query)
+		if i > 990 {
+			require.Nil(t, key)
+			require.Nil(t, value)
+		} else {
+			next := (i + 9) / 10 * 10
+			if next == 0 {
+				next = 10
+			}
+			require.Equal(t, []byte(fmt.Sprintf("%03d", next)), key)
+			require.Equal(t, []byte{byte(next / 10)}, value)
+		}
+	}
+
+	// The working tree is queried, including unsaved changes.
+	tree.Set([]byte("015"), []byte{0})
+	tree.Remove([]byte("990"))
+	key, _ = tree.Floor([]byte("019"))
+	require.Equal(t, []byte("015"), key)
+	key, _ = tree.LastKey()
+	require.Equal(t, []byte("980"), key)
+}
@@ -0,0 +1,193 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTxConflict is returned when committing a transaction which read or wrote a key that was
+// written by another transaction committed after it began.
+var ErrTxConflict = errors.New("transaction conflicts with a committed transaction")
+
+// ErrTxDone is returned when using a transaction that was already committed or discarded.
+var ErrTxDone = errors.New("transaction has already been committed or discarded")
+
+// TxManager runs optimistic transactions against a MutableTree. Transactions can be prepared
+// concurrently from multiple goroutines: each reads a snapshot of the working tree taken when it
+// began, which writes to the working tree don't affect since they copy the nodes on the path to
+// the written key, and its writes are buffered in the transaction. On commit, a transaction is
+// validated against the transactions committed since it began, and fails with ErrTxConflict if
+// any of them wrote a key it read or wrote. Otherwise its writes are applied to the working tree.
+//
+// The wrapped tree must only be written to via the manager while it is in use, and the versions
+// whose nodes a snapshot still references must not be deleted until the transactions reading it
+// are done.
+type TxManager struct {
+	mtx       sync.RWMutex
+	tree      *MutableTree
+	seq       uint64            // Sequence number of the latest committed transaction
+	lastWrite map[string]uint64 // Sequence number of the latest commit writing each key
+	active    int               // Number of transactions neither committed nor discarded
+}
+
+// Tx is an optimistic transaction, see TxManager. A Tx is not safe for concurrent use, but
+// separate transactions may be used concurrently.
+type Tx struct {
+	manager  *TxManager
+	snapshot *ImmutableTree // The working tree when the transaction began
+	startSeq uint64
+	reads    map[string]struct{}
+	writes   map[string][]byte // nil values are removals
+	done     bool
+}
+
+// NewTxManager returns a transaction manager for the given tree.
+func NewTxManager(tree *MutableTree) *TxManager {
+	return &TxManager{
+		tree:      tree,
+		lastWrite: map[string]uint64{},
+	}
+}
+
+// Begin starts a new transaction.
+func (m *TxManager) Begin() *Tx {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.active++
+	return &Tx{
+		manager: m,
+		snapshot: &ImmutableTree{
+			root:    m.tree.root,
+			ndb:     m.tree.ndb,
+			version: m.tree.version,
+		},
+		startSeq: m.seq,
+		reads:    map[string]struct{}{},
+		writes:   map[string][]byte{},
+	}
+}
+
+// SaveVersion saves the working tree, including all committed transactions, as a new version.
+// Transactions in progress are unaffected.
+func (m *TxManager) SaveVersion() ([]byte, int64, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.tree.SaveVersion()
+}
+
+// Get returns the value of the key as seen by the transaction, i.e. the value in its snapshot of
+// the working tree, or its own write of the key.
+func (tx *Tx) Get(key []byte) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	if value, ok := tx.writes[string(key)]; ok {
+		return value, nil
+	}
+	tx.reads[string(key)] = struct{}{}
+	if tx.snapshot.root == nil {
+		return nil, nil
+	}
+
+	// Saving a version updates the nodes of the snapshot in place, see nodeDB.SaveBranch.
+	tx.manager.mtx.RLock()
+	defer tx.manager.mtx.RUnlock()
+	_, value := tx.snapshot.root.get(tx.snapshot, key)
+	return value, nil
+}
+
+// Set buffers a write of the key in the transaction. Nil values are invalid.
+func (tx *Tx) Set(key, value []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if value == nil {
+		panic("Attempt to store nil value in transaction")
+	}
+	if err := tx.manager.tree.ndb.checkSize(key, value); err != nil {
+		return err
+	}
+	tx.writes[string(key)] = value
+	return nil
+}
+
+// Remove buffers a removal of the key in the transaction.
+func (tx *Tx) Remove(key []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.writes[string(key)] = nil
+	return nil
+}
+
+// Commit validates the transaction and applies its writes to the working tree, or returns
+// ErrTxConflict. The transaction can't be used afterwards, even if it fails.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	m := tx.manager
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	defer tx.finish()
+
+	for key := range tx.reads {
+		if m.lastWrite[key] > tx.startSeq {
+			return errors.Wrapf(ErrTxConflict, "key %X was read", key)
+		}
+	}
+	for key := range tx.writes {
+		if m.lastWrite[key] > tx.startSeq {
+			return errors.Wrapf(ErrTxConflict, "key %X was written", key)
+		}
+	}
+
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	// Apply writes in key order, so that the resulting tree does not depend on map ordering.
+	keys := make([][]byte, 0, len(tx.writes))
+	for key := range tx.writes {
+		keys = append(keys, []byte(key))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+
+	m.seq++
+	for _, key := range keys {
+		if value := tx.writes[string(key)]; value != nil {
+			m.tree.Set(key, value)
+		} else {
+			m.tree.Remove(key)
+		}
+		m.lastWrite[string(key)] = m.seq
+	}
+	return nil
+}
+
+// Discard abandons the transaction without applying its writes.
+func (tx *Tx) Discard() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.manager.mtx.Lock()
+	defer tx.manager.mtx.Unlock()
+	tx.finish()
+	return nil
+}
+
+// finish marks the transaction as done. Once no transactions are active, the write history is
+// no longer needed for validation and is released. The caller must hold the manager lock.
+func (tx *Tx) finish() {
+	tx.done = true
+	m := tx.manager
+	m.active--
+	if m.active == 0 && len(m.lastWrite) > 0 {
+		m.lastWrite = map[string]uint64{}
+	}
+}
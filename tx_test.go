@@ -0,0 +1,143 @@
+package iavl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestTx_Conflicts(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	m := NewTxManager(tree)
+
+	// Disjoint transactions both commit.
+	tx1, tx2 := m.Begin(), m.Begin()
+	tx1.Set([]byte("b"), []byte("2"))
+	tx2.Set([]byte("c"), []byte("3"))
+	require.NoError(t, tx1.Commit())
+	require.NoError(t, tx2.Commit())
+	require.Equal(t, []byte("2"), tree.Get([]byte("b")))
+	require.Equal(t, []byte("3"), tree.Get([]byte("c")))
+
+	// A read of a key written by a later commit conflicts.
+	tx1, tx2 = m.Begin(), m.Begin()
+	value, err := tx1.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	tx1.Set([]byte("d"), []byte("4"))
+	tx2.Set([]byte("a"), []byte("5"))
+	require.NoError(t, tx2.Commit())
+	err = tx1.Commit()
+	require.True(t, errors.Is(err, ErrTxConflict), err)
+	require.Nil(t, tree.Get([]byte("d")))
+	require.True(t, errors.Is(tx1.Commit(), ErrTxDone))
+
+	// Overlapping writes conflict as well, and own writes are visible.
+	tx1, tx2 = m.Begin(), m.Begin()
+	tx1.Remove([]byte("b"))
+	value, err = tx1.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	tx2.Set([]byte("b"), []byte("6"))
+	require.NoError(t, tx1.Commit())
+	require.True(t, errors.Is(tx2.Commit(), ErrTxConflict))
+	require.Nil(t, tree.Get([]byte("b")))
+
+	// Discarded transactions are not applied.
+	tx1 = m.Begin()
+	tx1.Set([]byte("e"), []byte("7"))
+	require.NoError(t, tx1.Discard())
+	require.Nil(t, tree.Get([]byte("e")))
+
+	// Transactions can't be used once done.
+	_, err = tx1.Get([]byte("a"))
+	require.True(t, errors.Is(err, ErrTxDone))
+	require.True(t, errors.Is(tx1.Set([]byte("e"), []byte("7")), ErrTxDone))
+	require.True(t, errors.Is(tx1.Remove([]byte("e")), ErrTxDone))
+	require.True(t, errors.Is(tx1.Discard(), ErrTxDone))
+
+	_, version, err := m.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+	require.Equal(t, []byte("5"), tree.Get([]byte("a")))
+}
+
+func TestTx_ConcurrentCounters(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	m := NewTxManager(tree)
+
+	const workers = 8
+	const increments = 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				for {
+					tx := m.Begin()
+					var counter uint64
+					bz, err := tx.Get([]byte("counter"))
+					require.NoError(t, err)
+					if bz != nil {
+						counter = binary.BigEndian.Uint64(bz)
+					}
+					bz = make([]byte, 8)
+					binary.BigEndian.PutUint64(bz, counter+1)
+					tx.Set([]byte("counter"), bz)
+					tx.Set([]byte(fmt.Sprintf("worker%d-%d", w, i)), []byte{1})
+					err = tx.Commit()
+					if err == nil {
+						break
+					}
+					require.True(t, errors.Is(err, ErrTxConflict), err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	require.EqualValues(t, workers*increments, binary.BigEndian.Uint64(tree.Get([]byte("counter"))))
+	require.EqualValues(t, workers*increments+1, tree.Size())
+	require.Empty(t, m.lastWrite)
+}
+
+func TestTx_Snapshot(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte("1"))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	m := NewTxManager(tree)
+
+	// A transaction reads the working tree as of when it began, even across saved versions.
+	tx1, tx2 := m.Begin(), m.Begin()
+	require.NoError(t, tx2.Set([]byte("a"), []byte("2")))
+	require.NoError(t, tx2.Set([]byte("b"), []byte("3")))
+	require.NoError(t, tx2.Commit())
+	_, _, err = m.SaveVersion()
+	require.NoError(t, err)
+	value, err := tx1.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	value, err = tx1.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.True(t, errors.Is(tx1.Commit(), ErrTxConflict))
+
+	tx1 = m.Begin()
+	value, err = tx1.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+	require.NoError(t, tx1.Commit())
+}
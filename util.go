@@ -81,6 +81,27 @@ func cpIncr(bz []byte) (ret []byte) {
 	return []byte{0x00}
 }
 
+// Returns the smallest key greater than all keys with the given prefix, or nil if there is
+// none, i.e. if the prefix is empty or all 0xFF.
+func prefixEnd(prefix []byte) []byte {
+	end := cp(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < byte(0xFF) {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Returns the immediate lexicographic successor of bz, i.e. a copy of bz
+// with 0x00 appended. Unlike cpIncr, no key can sort between bz and the result.
+func cpSucc(bz []byte) (ret []byte) {
+	ret = make([]byte, len(bz)+1)
+	copy(ret, bz)
+	return ret
+}
+
 type byteslices [][]byte
 
 func (bz byteslices) Len() int {
@@ -0,0 +1,142 @@
+package iavl
+
+import (
+	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
+	dbm "github.com/tendermint/tm-db"
+)
+
+// versionTreeCacheSize is the number of ImmutableTrees of saved versions cached for At().
+const versionTreeCacheSize = 16
+
+// VersionHandle is a handle for querying a saved version, as returned by MutableTree.At(). It
+// pins the version, so that it can't be deleted or pruned until the handle is released. Methods
+// return the error of At() if the version couldn't be loaded. Queries may run concurrently, but
+// not concurrently with Release().
+type VersionHandle struct {
+	version int64
+	tree    *ImmutableTree
+	err     error
+	ndb     *nodeDB
+}
+
+// At returns a handle for querying the given saved version, reusing a cached ImmutableTree of
+// the version if possible. The handle must be released with Release() when done.
+func (tree *MutableTree) At(version int64) *VersionHandle {
+	h := &VersionHandle{version: version, ndb: tree.ndb}
+	tree.ndb.incrVersionReaders(version)
+	if !tree.VersionExists(version) {
+		tree.ndb.decrVersionReaders(version)
+		h.err = tree.ndb.versionMissing(version, errors.Wrapf(ErrVersionDoesNotExist, "version %v", version))
+		return h
+	}
+
+	cacheKey := formatUint64(uint64(version))
+	if cached, ok := tree.ndb.versionTreeCache.Get(cacheKey); ok {
+		h.tree = cached.(*ImmutableTree)
+		return h
+	}
+	h.tree, h.err = tree.GetImmutable(version)
+	if h.err != nil {
+		tree.ndb.decrVersionReaders(version)
+		return h
+	}
+	tree.ndb.versionTreeCache.Add(cacheKey, h.tree)
+	return h
+}
+
+// invalidateVersionTreeCache drops the cached ImmutableTree of the given version, which is about
+// to be saved, in case the version number was used by a version since deleted.
+func (ndb *nodeDB) invalidateVersionTreeCache(version int64) {
+	ndb.versionTreeCache.Remove(formatUint64(uint64(version)))
+}
+
+// Release releases the version pinned by the handle. The handle must not be used afterwards.
+func (h *VersionHandle) Release() {
+	if h.tree != nil {
+		h.ndb.decrVersionReaders(h.version)
+		h.tree = nil
+		if h.err == nil {
+			h.err = errors.New("version handle is released")
+		}
+	}
+}
+
+// Version returns the version of the handle.
+func (h *VersionHandle) Version() int64 {
+	return h.version
+}
+
+// Err returns the error loading the version, if any.
+func (h *VersionHandle) Err() error {
+	return h.err
+}
+
+// Tree returns the ImmutableTree of the version. It must not be used after the handle is
+// released.
+func (h *VersionHandle) Tree() (*ImmutableTree, error) {
+	return h.tree, h.err
+}
+
+// Hash returns the root hash of the version.
+func (h *VersionHandle) Hash() ([]byte, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	return h.tree.Hash(), nil
+}
+
+// Get returns the value of the key in the version, or nil if it doesn't exist.
+func (h *VersionHandle) Get(key []byte) ([]byte, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	return h.tree.Get(key), nil
+}
+
+// Has returns whether or not the key exists in the version.
+func (h *VersionHandle) Has(key []byte) (bool, error) {
+	if h.err != nil {
+		return false, h.err
+	}
+	return h.tree.Has(key), nil
+}
+
+// Iterate iterates over all keys of the version in ascending order. Returns true if stopped by
+// the callback.
+func (h *VersionHandle) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
+	if h.err != nil {
+		return false, h.err
+	}
+	return h.tree.Iterate(fn), nil
+}
+
+// IterateRange iterates over the keys of the version in the range [start, end). Returns true if
+// stopped by the callback.
+func (h *VersionHandle) IterateRange(start, end []byte, ascending bool, fn func(key []byte, value []byte) bool) (bool, error) {
+	if h.err != nil {
+		return false, h.err
+	}
+	return h.tree.IterateRange(start, end, ascending, fn), nil
+}
+
+// Iterator returns an iterator over the keys of the version in the range [start, end). It must
+// be closed before the handle is released.
+func (h *VersionHandle) Iterator(start, end []byte, ascending bool) (dbm.Iterator, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+	return h.tree.Iterator(start, end, ascending), nil
+}
+
+// ProofOf returns the value of the key in the version along with an ics23 proof of its
+// membership, or nil and a proof of its non-membership if the key doesn't exist.
+func (h *VersionHandle) ProofOf(key []byte) ([]byte, *ics23.CommitmentProof, error) {
+	if h.err != nil {
+		return nil, nil, h.err
+	}
+	if h.tree.root == nil {
+		return nil, nil, ErrEmptyTree
+	}
+	return h.tree.getKeyProof(key)
+}
@@ -0,0 +1,105 @@
+package iavl
+
+import (
+	"testing"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestAt(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{2})
+	tree.Set([]byte("b"), []byte{2})
+	hash2, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	h := tree.At(1)
+	require.NoError(t, h.Err())
+	value, err := h.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	has, err := h.Has([]byte("b"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// The version is pinned until released.
+	require.Error(t, tree.DeleteVersion(1))
+	h.Release()
+	_, err = h.Get([]byte("a"))
+	require.Error(t, err)
+	require.NoError(t, tree.DeleteVersion(1))
+
+	h = tree.At(1)
+	require.True(t, errors.Is(h.Err(), ErrVersionDoesNotExist))
+	_, err = h.Get([]byte("a"))
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+	h.Release()
+
+	// Handles of the same version share the cached tree.
+	h = tree.At(2)
+	defer h.Release()
+	h2 := tree.At(2)
+	defer h2.Release()
+	tree1, err := h.Tree()
+	require.NoError(t, err)
+	tree2, err := h2.Tree()
+	require.NoError(t, err)
+	require.True(t, tree1 == tree2)
+
+	hash, err := h.Hash()
+	require.NoError(t, err)
+	require.Equal(t, hash2, hash)
+	var keys []string
+	_, err = h.Iterate(func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, keys)
+
+	value, proof, err := h.ProofOf([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, ics23.VerifyMembership(ProofSpec(), hash2, proof, []byte("b"), value))
+	value, proof, err = h.ProofOf([]byte("c"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.True(t, ics23.VerifyNonMembership(ProofSpec(), hash2, proof, []byte("c")))
+}
+
+func TestAt_Overwritten(t *testing.T) {
+	tree, err := NewMutableTree(db.NewMemDB(), 0)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{2})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	h := tree.At(2)
+	value, err := h.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, value)
+	h.Release()
+
+	_, err = tree.LoadVersionForOverwriting(1)
+	require.NoError(t, err)
+	tree.Set([]byte("a"), []byte{3})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	h = tree.At(2)
+	defer h.Release()
+	value, err = h.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, value)
+}
@@ -0,0 +1,151 @@
+package iavl
+
+import (
+	"sort"
+)
+
+// VersionRange is a contiguous range of versions, including both From and To.
+type VersionRange struct {
+	From int64
+	To   int64
+}
+
+// versionIndex is a sorted set of persisted versions, maintained by the MutableTree as versions
+// are saved and deleted, so that version queries don't have to scan the root keys.
+type versionIndex struct {
+	versions []int64
+}
+
+// newVersionIndex builds a version index from the given roots, as returned by nodeDB.getRoots.
+func newVersionIndex(roots map[int64][]byte) *versionIndex {
+	versions := make([]int64, 0, len(roots))
+	for version := range roots {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return &versionIndex{versions: versions}
+}
+
+// search returns the position of the first version greater than or equal to the given version.
+func (idx *versionIndex) search(version int64) int {
+	return sort.Search(len(idx.versions), func(i int) bool { return idx.versions[i] >= version })
+}
+
+func (idx *versionIndex) contains(version int64) bool {
+	i := idx.search(version)
+	return i < len(idx.versions) && idx.versions[i] == version
+}
+
+// containsRange returns true if all versions in [from, to] are in the index.
+func (idx *versionIndex) containsRange(from, to int64) bool {
+	if from > to {
+		return false
+	}
+	if to-from >= int64(len(idx.versions)) {
+		return false
+	}
+	i := idx.search(from)
+	j := i + int(to-from)
+	if j >= len(idx.versions) {
+		return false
+	}
+	// Versions are unique and sorted, so the range is complete if its ends are at the expected
+	// distance from each other.
+	return idx.versions[i] == from && idx.versions[j] == to
+}
+
+func (idx *versionIndex) add(version int64) {
+	i := idx.search(version)
+	if i < len(idx.versions) && idx.versions[i] == version {
+		return
+	}
+	idx.versions = append(idx.versions, 0)
+	copy(idx.versions[i+1:], idx.versions[i:])
+	idx.versions[i] = version
+}
+
+// removeRange removes all versions in [from, to).
+func (idx *versionIndex) removeRange(from, to int64) {
+	i, j := idx.search(from), idx.search(to)
+	idx.versions = append(idx.versions[:i], idx.versions[j:]...)
+}
+
+func (idx *versionIndex) list() []int64 {
+	return append([]int64(nil), idx.versions...)
+}
+
+func (idx *versionIndex) ranges() []VersionRange {
+	var ranges []VersionRange
+	for _, version := range idx.versions {
+		if n := len(ranges); n > 0 && ranges[n-1].To == version-1 {
+			ranges[n-1].To = version
+			continue
+		}
+		ranges = append(ranges, VersionRange{From: version, To: version})
+	}
+	return ranges
+}
+
+// getVersionIndex returns the version index, building it from the root keys on first use after a
+// lazy load.
+// CONTRACT: the caller must hold the tree.mtx write lock.
+func (tree *MutableTree) getVersionIndex() (*versionIndex, error) {
+	if tree.versionIndex == nil {
+		roots, err := tree.ndb.getRoots()
+		if err != nil {
+			return nil, err
+		}
+		tree.versionIndex = newVersionIndex(roots)
+	}
+	return tree.versionIndex, nil
+}
+
+// withVersionIndex calls fn with the version index under the tree lock.
+func (tree *MutableTree) withVersionIndex(fn func(idx *versionIndex)) error {
+	tree.mtx.RLock()
+	idx := tree.versionIndex
+	if idx != nil {
+		fn(idx)
+		tree.mtx.RUnlock()
+		return nil
+	}
+	tree.mtx.RUnlock()
+
+	tree.mtx.Lock()
+	defer tree.mtx.Unlock()
+	idx, err := tree.getVersionIndex()
+	if err != nil {
+		return err
+	}
+	fn(idx)
+	return nil
+}
+
+// Versions returns all persisted versions in ascending order.
+func (tree *MutableTree) Versions() ([]int64, error) {
+	var versions []int64
+	err := tree.withVersionIndex(func(idx *versionIndex) {
+		versions = idx.list()
+	})
+	return versions, err
+}
+
+// VersionRanges returns the persisted versions as contiguous ranges in ascending order, e.g. to
+// find gaps left by pruning.
+func (tree *MutableTree) VersionRanges() ([]VersionRange, error) {
+	var ranges []VersionRange
+	err := tree.withVersionIndex(func(idx *versionIndex) {
+		ranges = idx.ranges()
+	})
+	return ranges, err
+}
+
+// HasVersionRange returns true if all versions from fromVersion to toVersion (inclusive) are
+// persisted.
+func (tree *MutableTree) HasVersionRange(fromVersion, toVersion int64) (bool, error) {
+	var has bool
+	err := tree.withVersionIndex(func(idx *versionIndex) {
+		has = idx.containsRange(fromVersion, toVersion)
+	})
+	return has, err
+}
@@ -0,0 +1,73 @@
+package iavl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestVersionIndex(t *testing.T) {
+	idx := newVersionIndex(map[int64][]byte{3: nil, 1: nil, 2: nil, 7: nil})
+	require.Equal(t, []int64{1, 2, 3, 7}, idx.list())
+
+	idx.add(5)
+	idx.add(5)
+	idx.add(8)
+	require.Equal(t, []int64{1, 2, 3, 5, 7, 8}, idx.list())
+	require.Equal(t, []VersionRange{{1, 3}, {5, 5}, {7, 8}}, idx.ranges())
+
+	require.True(t, idx.contains(5))
+	require.False(t, idx.contains(4))
+	require.True(t, idx.containsRange(1, 3))
+	require.True(t, idx.containsRange(7, 7))
+	require.False(t, idx.containsRange(3, 5))
+	require.False(t, idx.containsRange(7, 9))
+	require.False(t, idx.containsRange(0, 100))
+	require.False(t, idx.containsRange(3, 1))
+
+	idx.removeRange(2, 6)
+	require.Equal(t, []VersionRange{{1, 1}, {7, 8}}, idx.ranges())
+}
+
+func TestMutableTree_VersionRanges(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersion(3))
+	require.NoError(t, tree.DeleteVersionsRange(5, 7))
+
+	ranges, err := tree.VersionRanges()
+	require.NoError(t, err)
+	require.Equal(t, []VersionRange{{1, 2}, {4, 4}, {7, 10}}, ranges)
+	has, err := tree.HasVersionRange(7, 10)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = tree.HasVersionRange(2, 4)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// A lazily loaded tree builds its index from the root keys on first use.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.LazyLoadVersion(0)
+	require.NoError(t, err)
+	versions, err := tree.Versions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{1, 2, 4, 7, 8, 9, 10}, versions)
+	require.Equal(t, []int{1, 2, 4, 7, 8, 9, 10}, tree.AvailableVersions())
+
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.LoadVersionForOverwriting(8)
+	require.NoError(t, err)
+	ranges, err = tree.VersionRanges()
+	require.NoError(t, err)
+	require.Equal(t, []VersionRange{{1, 2}, {4, 4}, {7, 8}}, ranges)
+	require.False(t, tree.VersionExists(9))
+}
@@ -0,0 +1,150 @@
+package iavl
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// versionMetadataPrefix prefixes the keys of version metadata in the metadata keyspace. It is
+// followed by the big-endian version number.
+const versionMetadataPrefix = "version_metadata/"
+
+// VersionMetadata is optional metadata recorded for a version, e.g. by the application when
+// committing a block.
+type VersionMetadata struct {
+	// Time is the time of the version, e.g. the block time. The zero time means unknown.
+	Time time.Time
+	// AppData is arbitrary application-defined data, e.g. an app hash.
+	AppData []byte
+}
+
+const versionMetadataHasTime = 1 << 0
+
+func (m *VersionMetadata) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	var flags byte
+	if !m.Time.IsZero() {
+		flags |= versionMetadataHasTime
+	}
+	buf.WriteByte(flags)
+	if flags&versionMetadataHasTime != 0 {
+		if err := encodeVarint(&buf, m.Time.UnixNano()); err != nil {
+			return nil, err
+		}
+	}
+	if err := encodeBytes(&buf, m.AppData); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeVersionMetadata(bz []byte) (*VersionMetadata, error) {
+	if len(bz) == 0 {
+		return nil, errors.New("empty version metadata")
+	}
+	flags := bz[0]
+	bz = bz[1:]
+
+	m := &VersionMetadata{}
+	if flags&versionMetadataHasTime != 0 {
+		nanos, n, err := decodeVarint(bz)
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding version metadata time")
+		}
+		m.Time = time.Unix(0, nanos).UTC()
+		bz = bz[n:]
+	}
+	appData, _, err := decodeBytes(bz)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding version metadata app data")
+	}
+	if len(appData) > 0 {
+		m.AppData = appData
+	}
+	return m, nil
+}
+
+func versionMetadataKey(version int64) []byte {
+	return metadataKeyFormat.Key(append([]byte(versionMetadataPrefix), formatUint64(uint64(version))...))
+}
+
+// setVersionMetadata writes the version metadata to the batch.
+func (ndb *nodeDB) setVersionMetadata(version int64, metadata *VersionMetadata) error {
+	bz, err := metadata.encode()
+	if err != nil {
+		return err
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(versionMetadataKey(version), bz)
+}
+
+// writeVersionMetadata writes the metadata of a saved version directly to the database, bypassing
+// the batch, which may hold unrelated changes of the working version.
+func (ndb *nodeDB) writeVersionMetadata(version int64, metadata *VersionMetadata) error {
+	bz, err := metadata.encode()
+	if err != nil {
+		return err
+	}
+	if ndb.opts.Sync {
+		return ndb.db.SetSync(versionMetadataKey(version), bz)
+	}
+	return ndb.db.Set(versionMetadataKey(version), bz)
+}
+
+// getVersionMetadata reads the version metadata, returning nil if there is none.
+func (ndb *nodeDB) getVersionMetadata(version int64) (*VersionMetadata, error) {
+	bz, err := ndb.db.Get(versionMetadataKey(version))
+	if err != nil || bz == nil {
+		return nil, err
+	}
+	return decodeVersionMetadata(bz)
+}
+
+// deleteVersionMetadataRange deletes the metadata of versions in [fromVersion, toVersion).
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteVersionMetadataRange(fromVersion, toVersion int64) error {
+	return ndb.traverseRange(versionMetadataKey(fromVersion), versionMetadataKey(toVersion), func(k, v []byte) error {
+		return ndb.batch.Delete(k)
+	})
+}
+
+// SetVersionMetadata records metadata for a saved version, or for the working version, in which
+// case it is written by the next SaveVersion(). Any previous metadata of the version is replaced.
+func (tree *MutableTree) SetVersionMetadata(version int64, metadata VersionMetadata) error {
+	if version == tree.workingVersion() {
+		// The caller may reuse the app data, so keep a copy of it.
+		if metadata.AppData != nil {
+			metadata.AppData = cp(metadata.AppData)
+		}
+		tree.pendingMetadata = &metadata
+		return nil
+	}
+	if !tree.VersionExists(version) {
+		return errors.Wrapf(ErrVersionDoesNotExist, "version %v", version)
+	}
+	return tree.ndb.writeVersionMetadata(version, &metadata)
+}
+
+// GetVersionMetadata returns the metadata recorded for a saved version, or nil if there is none.
+func (tree *MutableTree) GetVersionMetadata(version int64) (*VersionMetadata, error) {
+	return tree.ndb.getVersionMetadata(version)
+}
+
+// versionTime returns the recorded time of a version, see PruningPolicy.VersionTime.
+func (tree *MutableTree) versionTime(version int64) (time.Time, bool) {
+	metadata, err := tree.ndb.getVersionMetadata(version)
+	if err != nil || metadata == nil || metadata.Time.IsZero() {
+		return time.Time{}, false
+	}
+	return metadata.Time, true
+}
+
+// deleteAllVersionMetadataFrom deletes the metadata of all versions from the given version.
+// CONTRACT: the caller must serialize access to this method through ndb.mtx.
+func (ndb *nodeDB) deleteAllVersionMetadataFrom(version int64) error {
+	return ndb.deleteVersionMetadataRange(version, math.MaxInt64)
+}
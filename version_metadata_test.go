@@ -0,0 +1,92 @@
+package iavl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	db "github.com/tendermint/tm-db"
+)
+
+func TestVersionMetadata(t *testing.T) {
+	memDB := db.NewMemDB()
+	tree, err := NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+
+	// Metadata of the working version is written by SaveVersion.
+	blockTime := time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)
+	appData := []byte("app")
+	require.NoError(t, tree.SetVersionMetadata(1, VersionMetadata{Time: blockTime, AppData: appData}))
+	copy(appData, "xxx")
+	tree.Set([]byte("a"), []byte{1})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	tree.Set([]byte("b"), []byte{2})
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	meta, err := tree.GetVersionMetadata(1)
+	require.NoError(t, err)
+	require.Equal(t, &VersionMetadata{Time: blockTime, AppData: []byte("app")}, meta)
+
+	meta, err = tree.GetVersionMetadata(2)
+	require.NoError(t, err)
+	require.Nil(t, meta)
+
+	// Saved versions can be annotated later, without writing the batch, but missing versions can't.
+	staged := metadataKeyFormat.Key([]byte("staged"))
+	require.NoError(t, tree.ndb.batch.Set(staged, []byte{1}))
+	require.NoError(t, tree.SetVersionMetadata(2, VersionMetadata{AppData: []byte("late")}))
+	require.Zero(t, countPrefixKeys(t, memDB, staged))
+	require.NoError(t, tree.ndb.discardBatch())
+	err = tree.SetVersionMetadata(7, VersionMetadata{})
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrVersionDoesNotExist))
+
+	// The metadata persists across reloads.
+	tree, err = NewMutableTree(memDB, 0)
+	require.NoError(t, err)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	meta, err = tree.GetVersionMetadata(2)
+	require.NoError(t, err)
+	require.Equal(t, &VersionMetadata{AppData: []byte("late")}, meta)
+
+	// Deleting a version deletes its metadata.
+	require.NoError(t, tree.DeleteVersion(1))
+	meta, err = tree.GetVersionMetadata(1)
+	require.NoError(t, err)
+	require.Nil(t, meta)
+
+	// So does overwriting it.
+	require.NoError(t, tree.SetVersionMetadata(3, VersionMetadata{AppData: []byte("v3")}))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.LoadVersionForOverwriting(2)
+	require.NoError(t, err)
+	meta, err = tree.GetVersionMetadata(3)
+	require.NoError(t, err)
+	require.Nil(t, meta)
+}
+
+func TestPruningPolicy_KeepWithinVersionMetadata(t *testing.T) {
+	tree, err := NewMutableTreeWithOpts(db.NewMemDB(), 0, &Options{
+		Pruning: &PruningPolicy{KeepRecent: 1, KeepWithin: time.Minute},
+	})
+	require.NoError(t, err)
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, tree.SetVersionMetadata(int64(i), VersionMetadata{
+			Time: start.Add(time.Duration(i) * 30 * time.Second),
+		}))
+		tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// Version 5 is at 2m30s, so only versions after 1m30s are within a minute.
+	require.Equal(t, []int{4, 5}, tree.AvailableVersions())
+}